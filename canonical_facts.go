@@ -2,6 +2,7 @@ package yggdrasil
 
 import (
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -10,7 +11,10 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"git.sr.ht/~spc/go-log"
 	"github.com/google/uuid"
 )
 
@@ -24,6 +28,37 @@ type CanonicalFacts struct {
 	IPAddresses           []string `json:"ip_addresses"`
 	MACAddresses          []string `json:"mac_addresses"`
 	FQDN                  string   `json:"fqdn"`
+	OS                    string   `json:"os"`
+
+	// WorkerFacts holds the facts contributed by workers, keyed by the
+	// handler of the worker that contributed them.
+	WorkerFacts map[string]map[string]string `json:"worker_facts,omitempty"`
+
+	// CustomFacts holds the facts of the custom fact collectors, keyed by
+	// the name of the collector.
+	CustomFacts map[string]map[string]interface{} `json:"custom_facts,omitempty"`
+
+	// Errors describes each fact that could not be collected, so that
+	// consumers can tell a partial set of facts from a complete one.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// MarshalJSON encodes the facts, omitting the keys listed in DisabledFacts.
+func (f CanonicalFacts) MarshalJSON() ([]byte, error) {
+	type facts CanonicalFacts
+	data, err := json.Marshal(facts(f))
+	if err != nil || len(DisabledFacts) == 0 {
+		return data, err
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	for _, key := range DisabledFacts {
+		delete(m, key)
+	}
+	return json.Marshal(m)
 }
 
 // CanonicalFactsFromMap creates a CanonicalFacts struct from the key-value
@@ -94,63 +129,310 @@ func CanonicalFactsFromMap(m map[string]interface{}) (*CanonicalFacts, error) {
 		}
 	}
 
+	if val, ok := m["os"]; ok {
+		switch val := val.(type) {
+		case string:
+			facts.OS = val
+		default:
+			return nil, &InvalidValueTypeError{key: "os", val: val}
+		}
+	}
+
 	return &facts, nil
 }
 
+// BIOSUUIDFile is the file the BIOS UUID is read from. It is only readable by
+// a privileged user.
+const BIOSUUIDFile = "/sys/devices/virtual/dmi/id/product_uuid"
+
 // GetCanonicalFacts attempts to construct a CanonicalFacts struct by collecting
-// data from the localhost.
+// data from the localhost. Facts that only a privileged user can read are
+// omitted if SkipPrivilegedFacts is true.
+//
+// Collection is best-effort: if some facts cannot be collected, the facts that
+// could be are returned along with a *FactsCollectionError, and each failure
+// is recorded in the Errors field of the facts. Up to FactCollectorParallelism
+// facts are collected at once, and a fact that takes longer than
+// FactCollectorTimeout to collect is omitted, after FactCollectorRetries
+// further attempts.
+//
+// The facts of the registered custom fact collectors and of the fact scripts
+// in FactsDir are collected alongside, into CustomFacts.
+//
+// The facts listed in DisabledFacts are not collected.
 func GetCanonicalFacts() (*CanonicalFacts, error) {
-	var facts CanonicalFacts
-	var err error
+	collectors := append([]factCollector{}, factCollectors...)
+	if !containsKey(DisabledFacts, customFactsKey) {
+		collectors = append(collectors, customFactCollectors()...)
+	}
+	return collectFacts(enabledFactCollectors(collectors, DisabledFacts))
+}
 
-	if _, err := os.Stat("/etc/insights-client/machine-id"); !os.IsNotExist(err) {
-		insightsID, err := readFile("/etc/insights-client/machine-id")
-		if err != nil {
-			return nil, err
+// FactGroups names groups of canonical facts, by JSON key, that can be
+// disabled together.
+var FactGroups = map[string][]string{
+	"identifiers": {"insights_id", "machine_id", "bios_uuid", "subscription_manager_id"},
+	"network":     {"ip_addresses", "mac_addresses", "fqdn"},
+}
+
+// MinimalFacts are the canonical facts the platform needs to identify the
+// host: subscription_manager_id links the connection to the registration of
+// the host, and machine_id identifies the host in the inventory.
+var MinimalFacts = []string{"machine_id", "subscription_manager_id"}
+
+// FactKeys returns the JSON keys of the canonical facts, including the facts
+// contributed by workers and custom fact collectors, in the order they are
+// collected.
+func FactKeys() []string {
+	keys := make([]string, 0, len(factCollectors)+2)
+	for _, c := range factCollectors {
+		keys = append(keys, c.key)
+	}
+	return append(keys, "worker_facts", customFactsKey)
+}
+
+// ResolveFacts expands the fact groups in names to the facts they hold,
+// returning the JSON keys of the facts named, without duplicates. It returns an
+// error if a name is neither a fact nor a fact group.
+func ResolveFacts(names []string) ([]string, error) {
+	keys := make([]string, 0, len(names))
+	seen := make(map[string]bool)
+	for _, name := range names {
+		members, prs := FactGroups[name]
+		if !prs {
+			if !containsKey(FactKeys(), name) {
+				return nil, fmt.Errorf("unknown fact: %v", name)
+			}
+			members = []string{name}
+		}
+		for _, key := range members {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
 		}
-		facts.InsightsID = insightsID
 	}
+	return keys, nil
+}
 
-	machineID, err := readFile("/etc/machine-id")
-	if err != nil {
-		return nil, err
+// enabledFactCollectors returns the collectors whose fact is not listed in
+// disabled.
+func enabledFactCollectors(collectors []factCollector, disabled []string) []factCollector {
+	if len(disabled) == 0 {
+		return collectors
 	}
-	facts.MachineID, err = toUUIDv4(machineID)
-	if err != nil {
-		return nil, err
+	enabled := make([]factCollector, 0, len(collectors))
+	for _, c := range collectors {
+		if !containsKey(disabled, c.key) {
+			enabled = append(enabled, c)
+		}
 	}
+	return enabled
+}
 
-	if _, err := os.Stat("/sys/devices/virtual/dmi/id/product_uuid"); !os.IsNotExist(err) {
-		BIOSUUID, err := readFile("/sys/devices/virtual/dmi/id/product_uuid")
-		if err != nil {
-			return nil, err
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
 		}
-		facts.BIOSUUID = BIOSUUID
 	}
+	return false
+}
 
-	facts.SubscriptionManagerID, err = readCert("/etc/pki/consumer/cert.pem")
-	if err != nil {
-		return nil, err
-	}
+// A factCollector collects the fact key into facts.
+type factCollector struct {
+	key     string
+	collect func(facts *CanonicalFacts) error
+}
 
-	facts.IPAddresses, err = collectIPAddresses()
-	if err != nil {
-		return nil, err
+// factCollectors collect each of the canonical facts, in the order they are
+// collected.
+var factCollectors = []factCollector{
+	{"insights_id", func(facts *CanonicalFacts) error {
+		if _, err := os.Stat("/etc/insights-client/machine-id"); os.IsNotExist(err) {
+			return nil
+		}
+		var err error
+		facts.InsightsID, err = readFile("/etc/insights-client/machine-id")
+		return err
+	}},
+	{"machine_id", func(facts *CanonicalFacts) error {
+		var err error
+		facts.MachineID, err = MachineID()
+		return err
+	}},
+	{"bios_uuid", func(facts *CanonicalFacts) error {
+		if _, err := os.Stat(BIOSUUIDFile); os.IsNotExist(err) || SkipPrivilegedFacts {
+			return nil
+		}
+		var err error
+		facts.BIOSUUID, err = readFile(BIOSUUIDFile)
+		return err
+	}},
+	{"subscription_manager_id", func(facts *CanonicalFacts) error {
+		var err error
+		facts.SubscriptionManagerID, err = readCert("/etc/pki/consumer/cert.pem")
+		return err
+	}},
+	{"ip_addresses", func(facts *CanonicalFacts) error {
+		var err error
+		facts.IPAddresses, err = collectIPAddresses()
+		return err
+	}},
+	{"fqdn", func(facts *CanonicalFacts) error {
+		var err error
+		facts.FQDN, err = os.Hostname()
+		return err
+	}},
+	{"mac_addresses", func(facts *CanonicalFacts) error {
+		var err error
+		facts.MACAddresses, err = collectMACAddresses()
+		return err
+	}},
+	{"os", func(facts *CanonicalFacts) error {
+		var err error
+		facts.OS, err = readOSReleaseID(OSReleaseFiles...)
+		return err
+	}},
+}
+
+// collectFacts runs each of collectors, recording the failures in the Errors
+// field of the facts returned and in the error, if any. The collectors run
+// concurrently, FactCollectorParallelism at a time, each into facts of its
+// own that are merged in the order of collectors once all have finished or
+// been abandoned.
+func collectFacts(collectors []factCollector) (*CanonicalFacts, error) {
+	parallelism := FactCollectorParallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	retries := FactCollectorRetries
+	if retries < 0 {
+		retries = 0
 	}
 
-	facts.FQDN, err = os.Hostname()
-	if err != nil {
-		return nil, err
+	collected := make([]*CanonicalFacts, len(collectors))
+	errs := make([]error, len(collectors))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, c := range collectors {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, c factCollector) {
+			defer func() { <-sem; wg.Done() }()
+			collected[i], errs[i] = runFactCollector(c, FactCollectorTimeout, retries)
+		}(i, c)
 	}
+	wg.Wait()
 
-	facts.MACAddresses, err = collectMACAddresses()
-	if err != nil {
-		return nil, err
+	var facts CanonicalFacts
+	for i, c := range collectors {
+		if errs[i] != nil {
+			facts.Errors = append(facts.Errors, c.key+": "+errs[i].Error())
+			continue
+		}
+		mergeFact(&facts, collected[i], c.key)
 	}
 
+	if len(facts.Errors) > 0 {
+		return &facts, &FactsCollectionError{Errors: facts.Errors}
+	}
 	return &facts, nil
 }
 
+// runFactCollector runs c, abandoning each attempt that takes longer than
+// timeout (if positive) and making up to retries further attempts if it fails.
+// It returns the facts collected by the first attempt that succeeds.
+func runFactCollector(c factCollector, timeout time.Duration, retries int) (*CanonicalFacts, error) {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		start := time.Now()
+		// Each attempt collects into facts of its own, so that an
+		// abandoned attempt that finishes late cannot change the facts
+		// returned.
+		facts := &CanonicalFacts{}
+		done := make(chan error, 1)
+		go func() { done <- c.collect(facts) }()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer = time.NewTimer(timeout)
+			expired = timer.C
+		}
+		select {
+		case err = <-done:
+		case <-expired:
+			err = fmt.Errorf("timed out after %v", timeout)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if err == nil {
+			log.Debugf("collected fact %v in %v", c.key, time.Since(start))
+			return facts, nil
+		}
+		log.Debugf("cannot collect fact %v (attempt %v of %v, %v): %v", c.key, attempt+1, retries+1, time.Since(start), err)
+	}
+	return nil, err
+}
+
+// mergeFact copies the fact key, as collected into src, into dst.
+func mergeFact(dst *CanonicalFacts, src *CanonicalFacts, key string) {
+	switch key {
+	case "insights_id":
+		dst.InsightsID = src.InsightsID
+	case "machine_id":
+		dst.MachineID = src.MachineID
+	case "bios_uuid":
+		dst.BIOSUUID = src.BIOSUUID
+	case "subscription_manager_id":
+		dst.SubscriptionManagerID = src.SubscriptionManagerID
+	case "ip_addresses":
+		dst.IPAddresses = src.IPAddresses
+	case "fqdn":
+		dst.FQDN = src.FQDN
+	case "mac_addresses":
+		dst.MACAddresses = src.MACAddresses
+	case "os":
+		dst.OS = src.OS
+	default:
+		if name := strings.TrimPrefix(key, customFactsKey+"."); name != key {
+			if dst.CustomFacts == nil {
+				dst.CustomFacts = make(map[string]map[string]interface{})
+			}
+			dst.CustomFacts[name] = src.CustomFacts[name]
+		}
+	}
+}
+
+// OSReleaseFiles are the os-release files the os fact is read from, in order
+// of precedence.
+var OSReleaseFiles = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// readOSReleaseID returns the ID field of the first of the os-release files
+// that exists, such as "rhel" or "fedora", or an empty string if none does.
+func readOSReleaseID(files ...string) (string, error) {
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "ID=") {
+				return strings.Trim(strings.TrimPrefix(line, "ID="), `"'`), nil
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
 // readFile reads the contents of filename into a string, trims whitespace,
 // and returns the result.
 func readFile(filename string) (string, error) {
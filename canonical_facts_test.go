@@ -2,7 +2,13 @@ package yggdrasil
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -24,6 +30,7 @@ func TestCanonicalFactsFromMap(t *testing.T) {
 				"ip_addresses":            []string{"1.2.3.4", "5.6.7.8"},
 				"fqdn":                    "foo.bar.com",
 				"mac_addresses":           []string{"CC:D1:7A:44:6D:1B", "A7:03:90:D0:05:A7"},
+				"os":                      "rhel",
 			},
 			want: &CanonicalFacts{
 				InsightsID:            "bb69cd34-263f-444c-9278-5935b61d7f60",
@@ -33,6 +40,7 @@ func TestCanonicalFactsFromMap(t *testing.T) {
 				IPAddresses:           []string{"1.2.3.4", "5.6.7.8"},
 				FQDN:                  "foo.bar.com",
 				MACAddresses:          []string{"CC:D1:7A:44:6D:1B", "A7:03:90:D0:05:A7"},
+				OS:                    "rhel",
 			},
 		},
 		{
@@ -154,3 +162,214 @@ func BenchmarkCanonicalFactsFromMap(b *testing.B) {
 		}
 	}
 }
+
+func TestCollectFacts(t *testing.T) {
+	collectors := []factCollector{
+		{"machine_id", func(facts *CanonicalFacts) error {
+			facts.MachineID = "acc046d0-0add-4550-ac7c-5a833b1b6470"
+			return nil
+		}},
+		{"subscription_manager_id", func(facts *CanonicalFacts) error {
+			return fmt.Errorf("no such file")
+		}},
+		{"fqdn", func(facts *CanonicalFacts) error {
+			facts.FQDN = "foo.bar.com"
+			return nil
+		}},
+	}
+
+	got, err := collectFacts(collectors)
+	want := &CanonicalFacts{
+		MachineID: "acc046d0-0add-4550-ac7c-5a833b1b6470",
+		FQDN:      "foo.bar.com",
+		Errors:    []string{"subscription_manager_id: no such file"},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+	if !cmp.Equal(err, &FactsCollectionError{Errors: want.Errors}) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	got, err = collectFacts(collectors[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Errors != nil {
+		t.Errorf("unexpected errors: %v", got.Errors)
+	}
+}
+
+func TestCollectFactsTimeout(t *testing.T) {
+	defer func(timeout time.Duration, retries int) {
+		FactCollectorTimeout, FactCollectorRetries = timeout, retries
+	}(FactCollectorTimeout, FactCollectorRetries)
+	FactCollectorTimeout = 50 * time.Millisecond
+	FactCollectorRetries = 1
+
+	hang := make(chan struct{})
+	defer close(hang)
+	var attempts int32
+	collectors := []factCollector{
+		{"machine_id", func(facts *CanonicalFacts) error {
+			<-hang
+			facts.MachineID = "acc046d0-0add-4550-ac7c-5a833b1b6470"
+			return nil
+		}},
+		{"fqdn", func(facts *CanonicalFacts) error {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				return fmt.Errorf("temporary failure")
+			}
+			facts.FQDN = "foo.bar.com"
+			return nil
+		}},
+	}
+
+	got, err := collectFacts(collectors)
+	want := &CanonicalFacts{
+		FQDN:   "foo.bar.com",
+		Errors: []string{"machine_id: timed out after 50ms"},
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+	if !cmp.Equal(err, &FactsCollectionError{Errors: want.Errors}) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestResolveFacts(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		want        []string
+		wantError   bool
+	}{
+		{
+			description: "none",
+			want:        []string{},
+		},
+		{
+			description: "facts and groups",
+			input:       []string{"bios_uuid", "network", "fqdn"},
+			want:        []string{"bios_uuid", "ip_addresses", "mac_addresses", "fqdn"},
+		},
+		{
+			description: "worker facts",
+			input:       []string{"worker_facts"},
+			want:        []string{"worker_facts"},
+		},
+		{
+			description: "unknown fact",
+			input:       []string{"hostname"},
+			wantError:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := ResolveFacts(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDisabledFacts(t *testing.T) {
+	defer func(disabled []string) { DisabledFacts = disabled }(DisabledFacts)
+	DisabledFacts = []string{"ip_addresses", "mac_addresses", "fqdn", "worker_facts"}
+
+	collectors := enabledFactCollectors(factCollectors, DisabledFacts)
+	var keys []string
+	for _, c := range collectors {
+		keys = append(keys, c.key)
+	}
+	if want := []string{"insights_id", "machine_id", "bios_uuid", "subscription_manager_id", "os"}; !cmp.Equal(keys, want) {
+		t.Errorf("%v != %v", keys, want)
+	}
+
+	facts := CanonicalFacts{
+		MachineID:   "acc046d0-0add-4550-ac7c-5a833b1b6470",
+		FQDN:        "foo.bar.com",
+		WorkerFacts: map[string]map[string]string{"echo": {"version": "1"}},
+	}
+	got, err := json.Marshal(struct {
+		Facts CanonicalFacts `json:"canonical_facts"`
+	}{facts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"canonical_facts":{"bios_uuid":"","insights_id":"","machine_id":"acc046d0-0add-4550-ac7c-5a833b1b6470","os":"","subscription_manager_id":""}}`
+	if string(got) != want {
+		t.Errorf("%s != %v", got, want)
+	}
+}
+
+func TestReadOSReleaseID(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		description string
+		contents    []string
+		want        string
+	}{
+		{
+			description: "quoted",
+			contents:    []string{"NAME=\"Red Hat Enterprise Linux\"\nID=\"rhel\"\nID_LIKE=\"fedora\"\n"},
+			want:        "rhel",
+		},
+		{
+			description: "unquoted",
+			contents:    []string{"NAME=Fedora\nID=fedora\n"},
+			want:        "fedora",
+		},
+		{
+			description: "first file takes precedence",
+			contents:    []string{"ID=rhel\n", "ID=fedora\n"},
+			want:        "rhel",
+		},
+		{
+			description: "missing first file",
+			contents:    []string{"", "ID=fedora\n"},
+			want:        "fedora",
+		},
+		{
+			description: "no files",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			files := []string{filepath.Join(dir, "etc-os-release"), filepath.Join(dir, "lib-os-release")}
+			for i, file := range files {
+				os.Remove(file)
+				if i < len(test.contents) && test.contents[i] != "" {
+					if err := ioutil.WriteFile(file, []byte(test.contents[i]), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			got, err := readOSReleaseID(files...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
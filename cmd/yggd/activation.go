@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// errWorkerNotActivated is returned by startProcess if the activation
+// condition of the worker is not met.
+var errWorkerNotActivated = errors.New("activation condition not met")
+
+// activationFacts collects the canonical facts that worker activation
+// conditions are evaluated against. It is replaced by the daemon with the
+// facts cache.
+var activationFacts = yggdrasil.GetCanonicalFacts
+
+// activationFactValues maps the names of the facts an activation condition
+// may refer to, as "facts.NAME", to their values. A fact holding a list has a
+// value for each element.
+var activationFactValues = map[string]func(f *yggdrasil.CanonicalFacts) []string{
+	"insights_id":             func(f *yggdrasil.CanonicalFacts) []string { return []string{f.InsightsID} },
+	"machine_id":              func(f *yggdrasil.CanonicalFacts) []string { return []string{f.MachineID} },
+	"bios_uuid":               func(f *yggdrasil.CanonicalFacts) []string { return []string{f.BIOSUUID} },
+	"subscription_manager_id": func(f *yggdrasil.CanonicalFacts) []string { return []string{f.SubscriptionManagerID} },
+	"ip_addresses":            func(f *yggdrasil.CanonicalFacts) []string { return f.IPAddresses },
+	"mac_addresses":           func(f *yggdrasil.CanonicalFacts) []string { return f.MACAddresses },
+	"fqdn":                    func(f *yggdrasil.CanonicalFacts) []string { return []string{f.FQDN} },
+	"os":                      func(f *yggdrasil.CanonicalFacts) []string { return []string{f.OS} },
+}
+
+// An activation is a parsed worker activation condition. A condition is made
+// of comparisons of facts ("facts.NAME") and string literals (quoted with
+// single or double quotes), combined with "&&", "||", "!" and parentheses:
+//
+//	a == b    a and b are equal
+//	a != b    a and b are not equal
+//	a =~ 're' a matches the regular expression re, which must be a literal
+//
+// A comparison with a fact holding a list is true if it is true for any
+// element of the list.
+type activation struct {
+	source string
+	root   condition
+}
+
+// A condition is a node of a parsed activation condition.
+type condition interface {
+	eval(facts *yggdrasil.CanonicalFacts) bool
+}
+
+type orCondition struct{ left, right condition }
+
+func (c orCondition) eval(facts *yggdrasil.CanonicalFacts) bool {
+	return c.left.eval(facts) || c.right.eval(facts)
+}
+
+type andCondition struct{ left, right condition }
+
+func (c andCondition) eval(facts *yggdrasil.CanonicalFacts) bool {
+	return c.left.eval(facts) && c.right.eval(facts)
+}
+
+type notCondition struct{ operand condition }
+
+func (c notCondition) eval(facts *yggdrasil.CanonicalFacts) bool {
+	return !c.operand.eval(facts)
+}
+
+// An operand is either the fact named fact or the literal value.
+type operand struct {
+	fact  string
+	value string
+}
+
+func (o operand) values(facts *yggdrasil.CanonicalFacts) []string {
+	if o.fact == "" {
+		return []string{o.value}
+	}
+	return activationFactValues[o.fact](facts)
+}
+
+type comparison struct {
+	op          string
+	left, right operand
+	re          *regexp.Regexp
+}
+
+func (c comparison) eval(facts *yggdrasil.CanonicalFacts) bool {
+	if c.op == "!=" {
+		return !comparison{op: "==", left: c.left, right: c.right}.eval(facts)
+	}
+	for _, l := range c.left.values(facts) {
+		if c.op == "=~" {
+			if c.re.MatchString(l) {
+				return true
+			}
+			continue
+		}
+		for _, r := range c.right.values(facts) {
+			if l == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseActivation parses the activation condition source.
+func parseActivation(source string) (*activation, error) {
+	tokens, err := tokenizeActivation(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid activate-if: %w", err)
+	}
+	p := activationParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %v", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid activate-if: %w", err)
+	}
+	return &activation{source: source, root: root}, nil
+}
+
+// met returns true if the condition holds for facts.
+func (a *activation) met(facts *yggdrasil.CanonicalFacts) bool {
+	return a.root.eval(facts)
+}
+
+// An activationToken is an operator, a fact reference or a string literal.
+type activationToken struct {
+	kind  string // "op", "fact" or "string"
+	value string
+}
+
+func (t activationToken) String() string {
+	if t.kind == "string" {
+		return fmt.Sprintf("string %q", t.value)
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+// activationOperators are the operators of the activation condition
+// language.
+var activationOperators = []string{"==", "!=", "=~", "&&", "||", "!", "(", ")"}
+
+func tokenizeActivation(source string) ([]activationToken, error) {
+	var tokens []activationToken
+	for i := 0; i < len(source); {
+		switch ch := source[i]; {
+		case unicode.IsSpace(rune(ch)):
+			i++
+		case ch == '\'' || ch == '"':
+			end := strings.IndexByte(source[i+1:], ch)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %v", i)
+			}
+			tokens = append(tokens, activationToken{kind: "string", value: source[i+1 : i+1+end]})
+			i += end + 2
+		case strings.HasPrefix(source[i:], "facts."):
+			end := i + len("facts.")
+			for end < len(source) && (source[end] == '_' || unicode.IsLetter(rune(source[end])) || unicode.IsDigit(rune(source[end]))) {
+				end++
+			}
+			name := source[i+len("facts.") : end]
+			if _, ok := activationFactValues[name]; !ok {
+				return nil, fmt.Errorf("unknown fact %q at offset %v", name, i)
+			}
+			tokens = append(tokens, activationToken{kind: "fact", value: name})
+			i = end
+		default:
+			var op string
+			for _, o := range activationOperators {
+				if strings.HasPrefix(source[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at offset %v", ch, i)
+			}
+			tokens = append(tokens, activationToken{kind: "op", value: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+// activationParser is a recursive descent parser of activation conditions.
+type activationParser struct {
+	tokens []activationToken
+	pos    int
+}
+
+// accept consumes the next token and returns true if it is the operator op.
+func (p *activationParser) accept(op string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == "op" && p.tokens[p.pos].value == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *activationParser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCondition{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *activationParser) parseAnd() (condition, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andCondition{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *activationParser) parseUnary() (condition, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{operand: operand}, nil
+	}
+	if p.accept("(") {
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return c, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *activationParser) parseComparison() (condition, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	var c comparison
+	switch {
+	case p.accept("=="):
+		c.op = "=="
+	case p.accept("!="):
+		c.op = "!="
+	case p.accept("=~"):
+		c.op = "=~"
+	default:
+		return nil, fmt.Errorf("expected a comparison operator after %v", p.tokens[p.pos-1])
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	c.left, c.right = left, right
+	if c.op == "=~" {
+		if right.fact != "" {
+			return nil, fmt.Errorf("the right operand of =~ must be a string")
+		}
+		c.re, err = regexp.Compile(right.value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile regular expression: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (p *activationParser) parseOperand() (operand, error) {
+	if p.pos >= len(p.tokens) {
+		return operand{}, fmt.Errorf("unexpected end of condition")
+	}
+	t := p.tokens[p.pos]
+	switch t.kind {
+	case "fact":
+		p.pos++
+		return operand{fact: t.value}, nil
+	case "string":
+		p.pos++
+		return operand{value: t.value}, nil
+	default:
+		return operand{}, fmt.Errorf("unexpected %v", t)
+	}
+}
+
+// checkActivation returns an error wrapping errWorkerNotActivated if config
+// has an activation condition that the canonical facts do not meet.
+func checkActivation(config *workerConfig) error {
+	if config.ActivateIf == "" {
+		return nil
+	}
+	a, err := parseActivation(config.ActivateIf)
+	if err != nil {
+		return err
+	}
+
+	facts, err := activationFacts()
+	if err != nil {
+		if facts == nil {
+			return fmt.Errorf("cannot collect facts: %w", err)
+		}
+		log.Warnf("evaluating activation condition with partially collected facts: %v", err)
+	}
+	if !a.met(facts) {
+		return fmt.Errorf("%w: %v", errWorkerNotActivated, a.source)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestActivation(t *testing.T) {
+	facts := &yggdrasil.CanonicalFacts{
+		FQDN:        "db1.example.com",
+		MachineID:   "1234",
+		IPAddresses: []string{"10.0.0.5", "192.168.1.5"},
+		OS:          "rhel",
+	}
+
+	tests := []struct {
+		description string
+		input       string
+		want        bool
+		wantError   bool
+	}{
+		{
+			description: "equal",
+			input:       "facts.fqdn == 'db1.example.com'",
+			want:        true,
+		},
+		{
+			description: "not equal",
+			input:       `facts.fqdn != "db1.example.com"`,
+			want:        false,
+		},
+		{
+			description: "match",
+			input:       `facts.fqdn =~ '^db[0-9]+\.'`,
+			want:        true,
+		},
+		{
+			description: "list element",
+			input:       "facts.ip_addresses == '192.168.1.5'",
+			want:        true,
+		},
+		{
+			description: "list mismatch",
+			input:       "facts.ip_addresses =~ '^172\\.'",
+			want:        false,
+		},
+		{
+			description: "precedence",
+			input:       "facts.machine_id == 'x' && facts.fqdn == 'x' || facts.machine_id == '1234'",
+			want:        true,
+		},
+		{
+			description: "negation and parentheses",
+			input:       "!(facts.machine_id == '1234' || facts.fqdn == 'x')",
+			want:        false,
+		},
+		{
+			description: "fact comparison",
+			input:       "facts.insights_id == facts.bios_uuid",
+			want:        true,
+		},
+		{
+			description: "os",
+			input:       "facts.os == 'rhel'",
+			want:        true,
+		},
+		{
+			description: "unknown fact",
+			input:       "facts.kernel == 'linux'",
+			wantError:   true,
+		},
+		{
+			description: "unterminated string",
+			input:       "facts.fqdn == 'db1",
+			wantError:   true,
+		},
+		{
+			description: "missing operator",
+			input:       "facts.fqdn",
+			wantError:   true,
+		},
+		{
+			description: "missing parenthesis",
+			input:       "(facts.fqdn == 'x'",
+			wantError:   true,
+		},
+		{
+			description: "trailing token",
+			input:       "facts.fqdn == 'x' 'y'",
+			wantError:   true,
+		},
+		{
+			description: "invalid regular expression",
+			input:       "facts.fqdn =~ '('",
+			wantError:   true,
+		},
+		{
+			description: "fact regular expression",
+			input:       "facts.fqdn =~ facts.machine_id",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			a, err := parseActivation(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error parsing %q", test.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := a.met(facts); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckActivation(t *testing.T) {
+	defer func(f func() (*yggdrasil.CanonicalFacts, error)) { activationFacts = f }(activationFacts)
+	activationFacts = func() (*yggdrasil.CanonicalFacts, error) {
+		return &yggdrasil.CanonicalFacts{FQDN: "web1.example.com"}, nil
+	}
+
+	if err := checkActivation(&workerConfig{}); err != nil {
+		t.Errorf("expected a worker without a condition to be activated, got %v", err)
+	}
+	if err := checkActivation(&workerConfig{ActivateIf: "facts.fqdn =~ '^web'"}); err != nil {
+		t.Errorf("expected the condition to be met, got %v", err)
+	}
+	if err := checkActivation(&workerConfig{ActivateIf: "facts.fqdn =~ '^db'"}); !errors.Is(err, errWorkerNotActivated) {
+		t.Errorf("expected errWorkerNotActivated, got %v", err)
+	}
+}
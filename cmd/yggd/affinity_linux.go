@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// setCPUAffinity restricts every thread of the process pid to running on the
+// CPU cores cpus. Threads the process creates afterwards inherit the
+// restriction.
+func setCPUAffinity(pid int, cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+
+	// sched_setaffinity applies to a single thread, and a freshly started
+	// process may already have created more.
+	tasks, err := ioutil.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "task"))
+	if err != nil {
+		return fmt.Errorf("cannot read threads of process %v: %w", pid, err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := unix.SchedSetaffinity(tid, &set); err != nil {
+			return fmt.Errorf("cannot set CPU affinity of process %v: %w", pid, err)
+		}
+	}
+	return nil
+}
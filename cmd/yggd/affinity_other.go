@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// setCPUAffinity returns errAffinityUnsupported; CPU affinity is only
+// supported on Linux.
+func setCPUAffinity(pid int, cpus []int) error {
+	return errAffinityUnsupported
+}
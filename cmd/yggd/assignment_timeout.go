@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// timeoutMetadataKey is the metadata key of a result that records that the
+// assignment it responds to timed out.
+const timeoutMetadataKey = "timeout"
+
+// The values of the timeoutMetadataKey metadata of a result.
+const (
+	// timeoutStatusTimedOut marks the result published in place of a
+	// worker's result once its assignment times out.
+	timeoutStatusTimedOut = "timed-out"
+
+	// timeoutStatusLate marks a worker's result that arrives after its
+	// assignment timed out, if late results are flagged.
+	timeoutStatusLate = "late"
+)
+
+// The ways a result that arrives after its assignment timed out can be
+// handled.
+const (
+	// lateResultDiscard drops the result and logs it.
+	lateResultDiscard = "discard"
+
+	// lateResultPublish publishes the result to the late results topic
+	// rather than as a response.
+	lateResultPublish = "publish"
+
+	// lateResultFlag publishes the result as usual, marked "late".
+	lateResultFlag = "flag"
+)
+
+// assignmentRetention is how long an assignment its worker has not responded
+// to is tracked when it has no assignment timeout, and how long a message
+// whose assignment timed out or was cancelled is remembered for its late
+// result. Either is
+// otherwise forgotten only once its worker responds or exits, so a worker that
+// lives on without responding would hold it forever.
+const assignmentRetention = 24 * time.Hour
+
+// assignmentSweepInterval is how often assignments are checked against
+// assignmentRetention.
+const assignmentSweepInterval = time.Hour
+
+// A forgottenAssignment records the worker process of an assignment that was
+// forgotten before its worker responded, and when, so that a result the
+// worker sends afterwards is recognized until assignmentRetention passes.
+type forgottenAssignment struct {
+	pid int
+	at  time.Time
+}
+
+// assignmentTimeouts holds the assignment timeouts of the running worker
+// processes whose config sets their own, by PID.
+var assignmentTimeouts sync.Map
+
+// assignmentTimeoutFor returns the assignment timeout of the worker process
+// pid: its own, if its config sets one, or the dispatcher's.
+func (d *dispatcher) assignmentTimeoutFor(pid int) time.Duration {
+	if v, ok := assignmentTimeouts.Load(pid); ok {
+		return v.(time.Duration)
+	}
+	return d.assignmentTimeout
+}
+
+// startAssignmentTimer starts the timer that times out the assignment a of
+// the message id, if an assignment timeout is set for its worker process.
+func (d *dispatcher) startAssignmentTimer(id string, a *assignment) {
+	timeout := d.assignmentTimeoutFor(a.pid)
+	if timeout <= 0 {
+		return
+	}
+	a.timer = time.AfterFunc(timeout, func() { d.timeOut(id, a, timeout) })
+}
+
+// timeOut times out the assignment a of the message id after timeout, unless
+// it has since been responded to: it is forgotten, the worker's Send call is
+// cancelled if it has not returned, and a result marked "timed-out" is
+// published in place of the worker's. A result the worker sends afterwards is
+// a late result.
+func (d *dispatcher) timeOut(id string, a *assignment, timeout time.Duration) {
+	d.Lock()
+	if d.assignments[id] != a {
+		d.Unlock()
+		return
+	}
+	delete(d.assignments, id)
+	d.timedOut[id] = forgottenAssignment{pid: a.pid, at: time.Now()}
+	if a.cancel != nil {
+		// The call returns once cancelled; with the assignment forgotten,
+		// its error is ignored.
+		a.cancel()
+	}
+	d.Unlock()
+
+	processLogger(a.pid).Warnf("assignment of message %v timed out: worker process %v did not respond within %v", id, a.pid, timeout)
+	metrics.add("assignments_timed_out_total", 1)
+	d.trackResponse(id)
+	d.releaseSlot(id)
+	d.history.finish(id, assignmentTimeout, fmt.Errorf("no response within %v", timeout))
+	d.recvQ <- timedOutResult(a.data)
+}
+
+// sweepAssignments checks the assignments against assignmentRetention every
+// assignmentSweepInterval. It does not return.
+func (d *dispatcher) sweepAssignments() {
+	ticker := time.NewTicker(assignmentSweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		d.forgetStaleAssignments(now)
+	}
+}
+
+// forgetStaleAssignments forgets the assignments without a timeout that were
+// started more than assignmentRetention before now, releasing their slots, and
+// the messages whose assignment timed out or was cancelled that long ago. A
+// result the worker sends afterwards is published as usual.
+func (d *dispatcher) forgetStaleAssignments(now time.Time) {
+	d.Lock()
+	for id, f := range d.timedOut {
+		if now.Sub(f.at) >= assignmentRetention {
+			delete(d.timedOut, id)
+		}
+	}
+	for id, f := range d.cancelledIDs {
+		if now.Sub(f.at) >= assignmentRetention {
+			delete(d.cancelledIDs, id)
+		}
+	}
+	stale := make(map[string]int)
+	for id, a := range d.assignments {
+		if a.timer != nil || now.Sub(a.started) < assignmentRetention {
+			continue
+		}
+		delete(d.assignments, id)
+		if a.cancel != nil {
+			a.cancel()
+		}
+		stale[id] = a.pid
+	}
+	d.Unlock()
+
+	for id, pid := range stale {
+		processLogger(pid).Warnf("forgetting assignment of message %v: its worker did not respond within %v", id, assignmentRetention)
+		d.trackResponse(id)
+		d.releaseSlot(id)
+		d.history.finish(id, assignmentTimeout, fmt.Errorf("no response within %v", assignmentRetention))
+		if d.abandoned != nil {
+			d.abandoned(id)
+		}
+	}
+}
+
+// late returns true if the message id is one whose assignment timed out, and
+// forgets it.
+func (d *dispatcher) late(id string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.timedOut[id]; !ok {
+		return false
+	}
+	delete(d.timedOut, id)
+	return true
+}
+
+// lateResponse handles data, a result that arrived after its assignment
+// timed out, according to the configured handling. It returns true if data is
+// to be published as a response.
+func (d *dispatcher) lateResponse(data *yggdrasil.Data) bool {
+	metrics.add("late_results_total", 1)
+
+	switch d.lateResults {
+	case lateResultPublish:
+		log.Warnf("publishing late result %v to message %v to the late results topic", data.MessageID, data.ResponseTo)
+		if d.lateResult != nil {
+			d.lateResult(*data)
+		}
+		return false
+	case lateResultFlag:
+		log.Warnf("publishing late result %v to message %v", data.MessageID, data.ResponseTo)
+		metadata := make(map[string]string, len(data.Metadata)+1)
+		for k, v := range data.Metadata {
+			metadata[k] = v
+		}
+		metadata[timeoutMetadataKey] = timeoutStatusLate
+		data.Metadata = metadata
+		return true
+	default:
+		log.Warnf("discarding late result %v to message %v: its assignment timed out", data.MessageID, data.ResponseTo)
+		payloadLog.log("late", data)
+		return false
+	}
+}
+
+// timedOutResult creates the result published after the assignment of data
+// times out.
+func timedOutResult(data yggdrasil.Data) yggdrasil.Data {
+	return yggdrasil.Data{
+		Type:       yggdrasil.MessageTypeData,
+		MessageID:  uuid.New().String(),
+		ResponseTo: data.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Directive:  data.Directive,
+		Metadata:   map[string]string{timeoutMetadataKey: timeoutStatusTimedOut},
+		Content:    json.RawMessage("null"),
+	}
+}
+
+// PublishLateResult publishes msg, a result that arrived after its assignment
+// timed out, to the destination dest.
+func (c *Client) PublishLateResult(msg yggdrasil.Data, dest string) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("cannot marshal message: %v", err)
+		return
+	}
+	if err := c.sendAcknowledgedData(data, dest); err != nil {
+		log.Errorf("cannot publish late result %v: %v", msg.MessageID, err)
+		return
+	}
+	log.Debugf("published late result %v to %v", msg.MessageID, dest)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+func TestAssignmentTimeout(t *testing.T) {
+	tests := []struct {
+		description   string
+		lateResults   string
+		respondEarly  bool
+		wantPublished bool
+		wantLate      bool
+	}{
+		{description: "responded in time", respondEarly: true},
+		{description: "discard", lateResults: lateResultDiscard},
+		{description: "publish", lateResults: lateResultPublish, wantLate: true},
+		{description: "flag", lateResults: lateResultFlag, wantPublished: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.assignmentTimeout = 20 * time.Millisecond
+			d.lateResults = test.lateResults
+			var late []yggdrasil.Data
+			d.lateResult = func(data yggdrasil.Data) { late = append(late, data) }
+
+			d.trackDispatch(1, "1234")
+			d.assign(queuedData{data: yggdrasil.Data{MessageID: "1234", Directive: "echo"}}, 1, nil)
+			if err := d.delivered("1234", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			response := &pb.Data{MessageId: "r", ResponseTo: "1234", Directive: "echo"}
+			if test.respondEarly {
+				go d.Send(context.Background(), response)
+				select {
+				case got := <-d.Results():
+					if got.Metadata[timeoutMetadataKey] != "" {
+						t.Errorf("unexpected result: %+v", got)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("no result published")
+				}
+				select {
+				case got := <-d.Results():
+					t.Fatalf("unexpected result after responding: %+v", got)
+				case <-time.After(50 * time.Millisecond):
+				}
+				return
+			}
+
+			select {
+			case got := <-d.Results():
+				if got.ResponseTo != "1234" || got.Metadata[timeoutMetadataKey] != timeoutStatusTimedOut {
+					t.Errorf("unexpected timed-out result: %+v", got)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no timed-out result published")
+			}
+			d.RLock()
+			outstanding := len(d.outstanding[1])
+			d.RUnlock()
+			if outstanding != 0 {
+				t.Errorf("timed-out message still outstanding")
+			}
+
+			done := make(chan struct{})
+			go func() {
+				d.Send(context.Background(), response)
+				close(done)
+			}()
+			var published bool
+			select {
+			case got := <-d.Results():
+				published = true
+				if got.Metadata[timeoutMetadataKey] != timeoutStatusLate {
+					t.Errorf("late result not flagged: %+v", got)
+				}
+			case <-done:
+			}
+			<-done
+			if published != test.wantPublished {
+				t.Errorf("published: %v != %v", published, test.wantPublished)
+			}
+			if (len(late) == 1) != test.wantLate {
+				t.Errorf("published to the late results topic: %v", late)
+			}
+			if d.late("1234") {
+				t.Error("late result not forgotten")
+			}
+		})
+	}
+}
+
+func TestAssignmentTimeoutCancelsSend(t *testing.T) {
+	assignmentTimeouts.Store(2, 20*time.Millisecond)
+	defer assignmentTimeouts.Delete(2)
+	d := newDispatcher(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d.assign(queuedData{data: yggdrasil.Data{MessageID: "1234", Directive: "echo"}}, 2, cancel)
+
+	select {
+	case got := <-d.Results():
+		if got.Metadata[timeoutMetadataKey] != timeoutStatusTimedOut {
+			t.Errorf("unexpected result: %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no timed-out result published")
+	}
+	if ctx.Err() == nil {
+		t.Error("Send call not cancelled")
+	}
+	if err := d.delivered("1234", ctx.Err()); err != nil {
+		t.Errorf("unexpected error once timed out: %v", err)
+	}
+}
+
+func TestForgetStaleAssignments(t *testing.T) {
+	d := newDispatcher(nil)
+	d.assign(queuedData{data: yggdrasil.Data{MessageID: "old", Directive: "echo"}}, 1, nil)
+	d.assign(queuedData{data: yggdrasil.Data{MessageID: "new", Directive: "echo"}}, 1, nil)
+	d.assignments["old"].started = time.Now().Add(-assignmentRetention)
+	d.timedOut["old-timed-out"] = forgottenAssignment{pid: 1, at: time.Now().Add(-assignmentRetention)}
+	d.timedOut["new-timed-out"] = forgottenAssignment{pid: 1, at: time.Now()}
+	d.cancelledIDs["old-cancelled"] = forgottenAssignment{pid: 1, at: time.Now().Add(-assignmentRetention)}
+
+	d.forgetStaleAssignments(time.Now())
+
+	if _, ok := d.assignments["old"]; ok {
+		t.Error("stale assignment not forgotten")
+	}
+	if _, ok := d.assignments["new"]; !ok {
+		t.Error("recent assignment forgotten")
+	}
+	if d.late("old-timed-out") {
+		t.Error("stale timed-out message not forgotten")
+	}
+	if !d.late("new-timed-out") {
+		t.Error("recent timed-out message forgotten")
+	}
+	if d.cancelledLate("old-cancelled") {
+		t.Error("stale cancelled message not forgotten")
+	}
+}
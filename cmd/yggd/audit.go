@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultAuditFile is where the audit log is kept by default.
+var defaultAuditFile = filepath.Join(yggdrasil.LocalstateDir, "lib", yggdrasil.LongName, "audit.jsonl")
+
+// defaultAuditMaxSize is the size in bytes at which the audit log is rotated
+// if no size is configured.
+const defaultAuditMaxSize = 10 * 1024 * 1024
+
+// defaultAuditMaxFiles is the number of rotated audit log files kept if no
+// number is configured.
+const defaultAuditMaxFiles = 10
+
+// auditRetentionInterval is how often rotated audit log files are checked
+// against the retention period.
+const auditRetentionInterval = time.Hour
+
+// An auditLog appends every event of the daemon to a file, one JSON object
+// per line, so that the work a host executed can be accounted for after the
+// fact. Unlike an event subscriber, it is written to as each event is
+// emitted, so that no event is dropped. If a retention period is set, the
+// files rotated out of it are kept until they are older than it, however many
+// there are, and are then removed.
+type auditLog struct {
+	file      *rotatingFile
+	path      string
+	retention time.Duration
+}
+
+// openAuditLog opens the audit log at path for appending, rotating it when it
+// reaches maxSize bytes and keeping at least maxFiles rotated files.
+func openAuditLog(path string, maxSize int64, maxFiles int, retention time.Duration) (*auditLog, error) {
+	f, err := openRotatingFile(path, maxSize, maxFiles)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+	a := &auditLog{file: f, path: path, retention: retention}
+	f.discard = a.discard
+	a.expire(time.Now())
+	return a, nil
+}
+
+// record appends e to the log. It does nothing if a is nil.
+func (a *auditLog) record(e event) {
+	if a == nil {
+		return
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("cannot marshal audit record: %v", err)
+		return
+	}
+	if _, err := a.file.Write(append(data, '\n')); err != nil {
+		metrics.add("audit_write_errors_total", 1)
+		log.Errorf("cannot write audit record: %v", err)
+	}
+}
+
+// discard returns true if the file name may be discarded by a rotation: if no
+// retention period is set, or it was last written to longer ago than it. The
+// records of a discarded file are counted as dropped.
+func (a *auditLog) discard(name string) bool {
+	if a.retention > 0 {
+		info, err := os.Stat(name)
+		if err == nil && time.Since(info.ModTime()) <= a.retention {
+			return false
+		}
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		log.Errorf("cannot read audit log: %v", err)
+		return true
+	}
+	if n := bytes.Count(data, []byte{'\n'}); n > 0 {
+		metrics.add("audit_dropped_records_total", float64(n))
+		log.Warnf("dropping %v audit records rotated out of %v", n, a.path)
+	}
+	return true
+}
+
+// runRetention removes expired rotated files every auditRetentionInterval. It
+// does not return.
+func (a *auditLog) runRetention() {
+	ticker := time.NewTicker(auditRetentionInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		a.expire(now)
+	}
+}
+
+// expire removes the rotated files last written to more than the retention
+// period before now. It does nothing if no retention period is set.
+func (a *auditLog) expire(now time.Time) {
+	if a.retention <= 0 {
+		return
+	}
+	for _, file := range rotatedAuditFiles(a.path) {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if now.Sub(info.ModTime()) <= a.retention {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			log.Errorf("cannot remove expired audit log: %v", err)
+			continue
+		}
+		log.Debugf("removed expired audit log %v", file)
+	}
+}
+
+// contentDigest returns the SHA-256 digest of content, as recorded in the
+// audit log.
+func contentDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// rotatedAuditFiles returns the names of the files rotated out of the audit
+// log at path, most recent first.
+func rotatedAuditFiles(path string) []string {
+	var files []string
+	for i := 1; ; i++ {
+		file := fmt.Sprintf("%v.%v", path, i)
+		if _, err := os.Stat(file); err != nil {
+			return files
+		}
+		files = append(files, file)
+	}
+}
+
+// readAuditLog calls f with each record of the audit log at path, and of the
+// files rotated out of it, oldest first, that was recorded between since and
+// until. A zero since or until does not bound the records.
+func readAuditLog(path string, since, until time.Time, f func(e event, line []byte) error) error {
+	rotated := rotatedAuditFiles(path)
+	files := []string{}
+	for i := len(rotated) - 1; i >= 0; i-- {
+		files = append(files, rotated[i])
+	}
+	files = append(files, path)
+
+	for _, file := range files {
+		r, err := os.Open(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot open audit log: %w", err)
+		}
+		err = readAuditFile(r, since, until, f)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read audit log '%v': %w", file, err)
+		}
+	}
+	return nil
+}
+
+func readAuditFile(r io.Reader, since, until time.Time, f func(e event, line []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A record cut short by a crash is skipped.
+			log.Debugf("cannot unmarshal audit record: %v", err)
+			continue
+		}
+		if !since.IsZero() && e.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && e.Time.After(until) {
+			continue
+		}
+		if err := f(e, scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseAuditTime parses s as an RFC 3339 time or as a duration before now. It
+// returns the zero time if s is empty.
+func parseAuditTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid time: %v", s)
+	}
+	return now.Add(-d), nil
+}
+
+// auditAction prints the records of the audit log between the times given by
+// the "since" and "until" flags. It reads the log files directly, so the
+// daemon need not be running.
+func auditAction(c *cli.Context) error {
+	path := c.String("audit-file")
+	if path == "" {
+		return cli.Exit(fmt.Errorf("no audit-file is configured"), 1)
+	}
+	now := time.Now()
+	since, err := parseAuditTime(c.String("since"), now)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("cannot parse since: %w", err), 1)
+	}
+	until, err := parseAuditTime(c.String("until"), now)
+	if err != nil {
+		return cli.Exit(fmt.Errorf("cannot parse until: %w", err), 1)
+	}
+
+	err = readAuditLog(path, since, until, func(e event, line []byte) error {
+		if c.Bool("json") {
+			_, err := fmt.Fprintln(c.App.Writer, string(line))
+			return err
+		}
+		_, err := fmt.Fprintln(c.App.Writer, formatEvent(e))
+		return err
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	return nil
+}
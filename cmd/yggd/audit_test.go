@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	// Each record is larger than the maximum size, so each is rotated out by
+	// the next. Rotated files within the retention period are kept beyond
+	// the maximum number of files.
+	a, err := openAuditLog(path, 1, 2, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+	for i, id := range []string{"1", "2", "3", "4"} {
+		a.record(event{Time: start.Add(time.Duration(i) * time.Minute), Type: eventMessageReceived, MessageID: id})
+	}
+
+	read := func(since, until time.Time) []string {
+		var ids []string
+		if err := readAuditLog(path, since, until, func(e event, line []byte) error {
+			ids = append(ids, e.MessageID)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	if got, want := read(time.Time{}, time.Time{}), []string{"1", "2", "3", "4"}; !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got, want := read(start.Add(time.Minute), start.Add(2*time.Minute)), []string{"2", "3"}; !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+
+	// Rotated files past the retention period are removed.
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(path+".3", old, old); err != nil {
+		t.Fatal(err)
+	}
+	a.expire(time.Now())
+	if got, want := read(time.Time{}, time.Time{}), []string{"2", "3", "4"}; !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+
+	// Without a retention period, rotated files beyond the maximum number
+	// are discarded.
+	a.retention = 0
+	a.record(event{Time: start.Add(4 * time.Minute), Type: eventMessageReceived, MessageID: "5"})
+	if got, want := read(time.Time{}, time.Time{}), []string{"3", "4", "5"}; !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestParseAuditTime(t *testing.T) {
+	now := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		description string
+		input       string
+		want        time.Time
+		wantError   bool
+	}{
+		{
+			description: "empty",
+		},
+		{
+			description: "timestamp",
+			input:       "2021-03-01T08:30:00Z",
+			want:        time.Date(2021, 3, 1, 8, 30, 0, 0, time.UTC),
+		},
+		{
+			description: "duration ago",
+			input:       "24h",
+			want:        now.Add(-24 * time.Hour),
+		},
+		{
+			description: "negative duration",
+			input:       "-1h",
+			wantError:   true,
+		},
+		{
+			description: "invalid",
+			input:       "yesterday",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseAuditTime(test.input, now)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
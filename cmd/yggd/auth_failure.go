@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+)
+
+// The ways a broker rejecting the client's credentials is handled.
+const (
+	// authFailureBackoff connects again, no sooner than the auth failure
+	// retry interval, in case the credentials are refreshed meanwhile.
+	authFailureBackoff = "backoff"
+
+	// authFailureStop stops connecting until the daemon is restarted.
+	authFailureStop = "stop"
+)
+
+// checkAuthFailureAction returns an error if action is not a known way of
+// handling a broker rejecting the client's credentials.
+func checkAuthFailureAction(action string) error {
+	switch action {
+	case authFailureBackoff, authFailureStop:
+		return nil
+	default:
+		return fmt.Errorf("invalid mqtt-auth-failure-action: %v", action)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// The supported worker bootstrap policies.
+const (
+	// bootstrapPolicyStrict exits the daemon if any worker fails to start.
+	bootstrapPolicyStrict = "strict"
+
+	// bootstrapPolicyBestEffort continues with the workers that started,
+	// unless a required worker failed to start.
+	bootstrapPolicyBestEffort = "best-effort"
+)
+
+// A bootstrapReport records the outcome of starting the workers when the
+// daemon started. It is not modified after it is created.
+type bootstrapReport struct {
+	Started []string          `json:"started"`
+	Failed  map[string]string `json:"failed"`
+}
+
+// newBootstrapReport creates a report from the workers started and the error
+// returned by bootstrapWorkers.
+func newBootstrapReport(started []string, err error) *bootstrapReport {
+	r := bootstrapReport{
+		Started: started,
+		Failed:  make(map[string]string),
+	}
+	var bootstrapErr *workerBootstrapError
+	if errors.As(err, &bootstrapErr) {
+		for name, err := range bootstrapErr.failures {
+			r.Failed[name] = err.Error()
+		}
+	}
+	return &r
+}
+
+// checkBootstrapPolicy returns an error if the daemon must exit because of the
+// workers that failed to start, according to policy. Under either policy, the
+// daemon must exit if any of the required workers did not start, whether it
+// failed to or was never found.
+func checkBootstrapPolicy(report *bootstrapReport, policy string, required []string) error {
+	switch policy {
+	case bootstrapPolicyStrict:
+		if len(report.Failed) > 0 {
+			return fmt.Errorf("%v of the workers failed to start", len(report.Failed))
+		}
+	case bootstrapPolicyBestEffort:
+	default:
+		return fmt.Errorf("unsupported worker bootstrap policy: %v", policy)
+	}
+
+	started := make(map[string]bool, len(report.Started))
+	for _, name := range report.Started {
+		started[name] = true
+	}
+	var missing []string
+	for _, name := range required {
+		if !started[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("required workers did not start: %v", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// handle is the control handler for the "bootstrap-status" command. It
+// reports which workers started and which failed when the daemon started.
+func (r *bootstrapReport) handle(args map[string]string) (interface{}, error) {
+	return r, nil
+}
+
+// bootstrapStatusAction calls the "bootstrap-status" control command on the
+// running daemon and prints the result.
+func bootstrapStatusAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "bootstrap-status", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var report bootstrapReport
+	if err := json.Unmarshal(result, &report); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	for _, name := range report.Started {
+		fmt.Fprintf(c.App.Writer, "%v: started\n", name)
+	}
+	names := make([]string, 0, len(report.Failed))
+	for name := range report.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(c.App.Writer, "%v: failed: %v\n", name, report.Failed[name])
+	}
+
+	return nil
+}
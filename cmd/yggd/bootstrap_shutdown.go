@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// The ways a shutdown signal received during the bootstrap is handled.
+const (
+	// bootstrapShutdownAbort abandons the bootstrap step in progress: the
+	// handshake is abandoned, no further worker is started, a worker
+	// waiting to register is stopped and the self-test is cut short.
+	bootstrapShutdownAbort = "abort"
+
+	// bootstrapShutdownWait lets the bootstrap step in progress complete,
+	// and shuts down at the checkpoint that follows it.
+	bootstrapShutdownWait = "wait"
+)
+
+// checkBootstrapShutdown returns an error if policy is not a known way of
+// handling a shutdown signal received during the bootstrap.
+func checkBootstrapShutdown(policy string) error {
+	switch policy {
+	case bootstrapShutdownAbort, bootstrapShutdownWait:
+		return nil
+	default:
+		return fmt.Errorf("invalid bootstrap-shutdown: %v", policy)
+	}
+}
+
+// watchBootstrapSignal waits for a signal on quit until done is closed. If a
+// signal is received first, interrupt is called and the signal is put back on
+// quit, so that it is still received by the shutdown that follows.
+func watchBootstrapSignal(quit chan os.Signal, interrupt func(), done <-chan struct{}) {
+	select {
+	case sig := <-quit:
+		log.Infof("received %v during bootstrap", sig)
+		interrupt()
+		select {
+		case quit <- sig:
+		default:
+		}
+	case <-done:
+	}
+}
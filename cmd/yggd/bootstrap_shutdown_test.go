@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchBootstrapSignal(t *testing.T) {
+	tests := []struct {
+		description   string
+		signal        bool
+		wantInterrupt bool
+	}{
+		{description: "signal during bootstrap", signal: true, wantInterrupt: true},
+		{description: "bootstrap completes"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			quit := make(chan os.Signal, 1)
+			done := make(chan struct{})
+			interrupted := make(chan struct{})
+			returned := make(chan struct{})
+			go func() {
+				watchBootstrapSignal(quit, func() { close(interrupted) }, done)
+				close(returned)
+			}()
+
+			if test.signal {
+				quit <- syscall.SIGTERM
+				select {
+				case <-interrupted:
+				case <-time.After(time.Second):
+					t.Fatal("bootstrap was not interrupted")
+				}
+			} else {
+				close(done)
+			}
+			select {
+			case <-returned:
+			case <-time.After(time.Second):
+				t.Fatal("watchBootstrapSignal did not return")
+			}
+
+			select {
+			case <-interrupted:
+				if !test.wantInterrupt {
+					t.Error("bootstrap was interrupted")
+				}
+			default:
+			}
+			if test.signal {
+				select {
+				case sig := <-quit:
+					if sig != syscall.SIGTERM {
+						t.Errorf("%v != %v", sig, syscall.SIGTERM)
+					}
+				default:
+					t.Error("signal was not put back")
+				}
+			}
+		})
+	}
+}
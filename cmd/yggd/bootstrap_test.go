@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckBootstrapPolicy(t *testing.T) {
+	failed := newBootstrapReport([]string{"a-worker"}, &workerBootstrapError{
+		failures: map[string]error{"b-worker": fmt.Errorf("exec format error")},
+	})
+	ok := newBootstrapReport([]string{"a-worker", "b-worker"}, nil)
+
+	tests := []struct {
+		description string
+		report      *bootstrapReport
+		policy      string
+		required    []string
+		wantError   bool
+	}{
+		{
+			description: "strict without failures",
+			report:      ok,
+			policy:      bootstrapPolicyStrict,
+		},
+		{
+			description: "strict with failures",
+			report:      failed,
+			policy:      bootstrapPolicyStrict,
+			wantError:   true,
+		},
+		{
+			description: "best-effort with failures",
+			report:      failed,
+			policy:      bootstrapPolicyBestEffort,
+			required:    []string{"a-worker"},
+		},
+		{
+			description: "best-effort with required failure",
+			report:      failed,
+			policy:      bootstrapPolicyBestEffort,
+			required:    []string{"b-worker"},
+			wantError:   true,
+		},
+		{
+			description: "best-effort with required worker not found",
+			report:      ok,
+			policy:      bootstrapPolicyBestEffort,
+			required:    []string{"c-worker"},
+			wantError:   true,
+		},
+		{
+			description: "unsupported policy",
+			report:      ok,
+			policy:      "lenient",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := checkBootstrapPolicy(test.report, test.policy, test.required)
+			if test.wantError && err == nil {
+				t.Error("expected error")
+			}
+			if !test.wantError && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCheckWorkerExecutable(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "echo-worker"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "data-worker"), []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir-worker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		input       string
+		wantError   bool
+	}{
+		{
+			description: "executable",
+			input:       "echo-worker",
+		},
+		{
+			description: "not executable",
+			input:       "data-worker",
+			wantError:   true,
+		},
+		{
+			description: "directory",
+			input:       "dir-worker",
+			wantError:   true,
+		},
+		{
+			description: "missing",
+			input:       "missing-worker",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := checkWorkerExecutable(filepath.Join(dir, test.input))
+			if test.wantError {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestWaitForStartup(t *testing.T) {
+	registeredAt := time.Now().Add(200 * time.Millisecond)
+	registered := func(pid int) bool {
+		return pid == 1 && time.Now().After(registeredAt)
+	}
+
+	if err := waitForStartup(context.Background(), 1, time.Second, registered); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	err := waitForStartup(context.Background(), 2, 200*time.Millisecond, registered)
+	var timeoutErr *workerStartupTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected startup timeout, got %v", err)
+	}
+	report := newBootstrapReport(nil, &workerBootstrapError{failures: map[string]error{"b-worker": err}})
+	if got, want := report.Failed["b-worker"], "startup-timeout: worker did not register within 200ms"; got != want {
+		t.Errorf("got reason %q, want %q", got, want)
+	}
+}
+
+func TestWaitForStartupAborted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := waitForStartup(ctx, 1, time.Minute, func(pid int) bool { return false })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waited %v after cancellation", elapsed)
+	}
+}
+
+func TestBootstrapWorkersAborted(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a-worker"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	started, err := bootstrapWorkers(ctx, dir, nil, 1, 0, func(pid int) bool { return true }, make(chan int))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	if len(started) != 0 {
+		t.Errorf("started workers after cancellation: %v", started)
+	}
+}
+
+func TestCheckWorkersFound(t *testing.T) {
+	tests := []struct {
+		description string
+		files       []string
+		require     bool
+		wantError   bool
+	}{
+		{
+			description: "no workers",
+		},
+		{
+			description: "no workers required",
+			files:       []string{"README"},
+			require:     true,
+			wantError:   true,
+		},
+		{
+			description: "workers required",
+			files:       []string{"echo-worker"},
+			require:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for _, name := range test.files {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = checkWorkersFound(dir, test.require)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUmaskTrampoline(t *testing.T) {
+	cmd := exec.Command("/usr/libexec/yggdrasil/echo-worker", "-v")
+	cmd.Path = verifiedExecutablePath
+	umaskTrampoline(cmd, 027)
+
+	if cmd.Path != "/proc/self/exe" {
+		t.Errorf("%v != %v", cmd.Path, "/proc/self/exe")
+	}
+	want := []string{
+		"/usr/libexec/yggdrasil/echo-worker",
+		umaskTrampolineArg,
+		"0027",
+		verifiedExecutablePath,
+		"/usr/libexec/yggdrasil/echo-worker",
+		"-v",
+	}
+	if !cmp.Equal(cmd.Args, want) {
+		t.Errorf("%v != %v", cmd.Args, want)
+	}
+
+	if err := umaskTrampolineExec([]string{"0999", "/bin/true", "true"}); err == nil {
+		t.Error("expected error for an invalid umask")
+	}
+}
+
+func TestBootstrapWorkersParallelism(t *testing.T) {
+	defer func() { bootstrapStart = startWorker }()
+
+	tests := []struct {
+		description string
+		parallelism int
+		fail        string
+		wantActive  int
+		wantStarted []string
+	}{
+		{
+			description: "sequential",
+			parallelism: 1,
+			wantActive:  1,
+			wantStarted: []string{"a-worker", "b-worker", "c-worker", "d-worker"},
+		},
+		{
+			description: "limited",
+			parallelism: 2,
+			fail:        "c-worker",
+			wantActive:  2,
+			wantStarted: []string{"a-worker", "b-worker", "d-worker"},
+		},
+		{
+			description: "unlimited",
+			wantActive:  4,
+			wantStarted: []string{"a-worker", "b-worker", "c-worker", "d-worker"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for _, name := range []string{"a-worker", "b-worker", "c-worker", "d-worker"} {
+				if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Each start holds its slot until release is closed, once
+			// as many starts as the parallelism allows are under way.
+			var (
+				lock      sync.Mutex
+				active    int
+				maxActive int
+			)
+			entered := make(chan struct{}, 4)
+			release := make(chan struct{})
+			bootstrapStart = func(ctx context.Context, dir string, name string, env []string, startupTimeout time.Duration, registered func(pid int) bool, died chan int) error {
+				lock.Lock()
+				active++
+				if active > maxActive {
+					maxActive = active
+				}
+				lock.Unlock()
+				entered <- struct{}{}
+				<-release
+				lock.Lock()
+				active--
+				lock.Unlock()
+				if name == test.fail {
+					return errors.New("failed")
+				}
+				return nil
+			}
+
+			type result struct {
+				started []string
+				err     error
+			}
+			done := make(chan result)
+			go func() {
+				started, err := bootstrapWorkers(context.Background(), dir, nil, test.parallelism, 0, nil, nil)
+				done <- result{started, err}
+			}()
+			for i := 0; i < test.wantActive; i++ {
+				<-entered
+			}
+			close(release)
+			got := <-done
+
+			if maxActive != test.wantActive {
+				t.Errorf("%v workers started at once, want %v", maxActive, test.wantActive)
+			}
+			if !cmp.Equal(got.started, test.wantStarted) {
+				t.Errorf("%v != %v", got.started, test.wantStarted)
+			}
+			var bootstrapErr *workerBootstrapError
+			if test.fail != "" {
+				if !errors.As(got.err, &bootstrapErr) || bootstrapErr.failures[test.fail] == nil {
+					t.Errorf("expected %v to fail, got %v", test.fail, got.err)
+				}
+			} else if got.err != nil {
+				t.Errorf("unexpected error: %v", got.err)
+			}
+		})
+	}
+}
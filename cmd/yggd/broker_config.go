@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/pelletier/go-toml"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// brokerConfig holds the settings for a single MQTT broker, read from a
+// "[[broker]]" or "[[publish-broker]]" table in the config file. Empty fields
+// fall back to the global values set by the corresponding command line flags.
+type brokerConfig struct {
+	// URL is the address of the broker.
+	URL string `toml:"url"`
+
+	// CertFile, KeyFile and CARoot override the "cert-file", "key-file" and
+	// "ca-root" flags for connections to this broker.
+	CertFile string   `toml:"cert-file"`
+	KeyFile  string   `toml:"key-file"`
+	CARoot   []string `toml:"ca-root"`
+
+	// KeepAlive overrides the "mqtt-keepalive" flag.
+	KeepAlive string `toml:"keepalive"`
+
+	// MaxReconnectInterval overrides the "mqtt-max-reconnect-interval" flag.
+	MaxReconnectInterval string `toml:"max-reconnect-interval"`
+}
+
+// keepAlive parses the KeepAlive field. It returns 0 if the field is empty.
+func (c *brokerConfig) keepAlive() (time.Duration, error) {
+	return parseOptionalDuration(c.KeepAlive)
+}
+
+// maxReconnectInterval parses the MaxReconnectInterval field. It returns 0 if
+// the field is empty.
+func (c *brokerConfig) maxReconnectInterval() (time.Duration, error) {
+	return parseOptionalDuration(c.MaxReconnectInterval)
+}
+
+// hasTLSOverride returns true if the broker sets any of its own TLS settings.
+func (c *brokerConfig) hasTLSOverride() bool {
+	return c.CertFile != "" || c.KeyFile != "" || len(c.CARoot) > 0
+}
+
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration: %v", s)
+	}
+	return d, nil
+}
+
+// readBrokerConfigs reads from its input, unmarshalling the array of broker
+// tables named table (such as "broker") of the TOML-encoded value and
+// validating their values. Other keys are ignored.
+func readBrokerConfigs(in io.Reader, table string) ([]brokerConfig, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read input: %w", err)
+	}
+
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse TOML: %w", err)
+	}
+	if !tree.Has(table) {
+		return nil, nil
+	}
+	tables, ok := tree.Get(table).([]*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("%v: not an array of tables", table)
+	}
+
+	brokers := make([]brokerConfig, 0, len(tables))
+	for i, t := range tables {
+		var broker brokerConfig
+		if err := t.Unmarshal(&broker); err != nil {
+			return nil, fmt.Errorf("%v %v: %w", table, i, err)
+		}
+		if broker.URL == "" {
+			return nil, fmt.Errorf("%v %v: missing url", table, i)
+		}
+		broker.URL, err = normalizeBrokerURL(broker.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%v %v: %w", table, i, err)
+		}
+		if _, err := broker.keepAlive(); err != nil {
+			return nil, fmt.Errorf("%v %v: keepalive: %w", table, broker.URL, err)
+		}
+		if _, err := broker.maxReconnectInterval(); err != nil {
+			return nil, fmt.Errorf("%v %v: max-reconnect-interval: %w", table, broker.URL, err)
+		}
+		brokers = append(brokers, broker)
+	}
+
+	return brokers, nil
+}
+
+// loadBrokerConfigs reads the broker tables named table from the config file.
+// If file is empty, no brokers are returned.
+func loadBrokerConfigs(file string, table string) ([]brokerConfig, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := readConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	brokers, err := readBrokerConfigs(bytes.NewReader(data), table)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read broker config from '%v': %w", file, err)
+	}
+	return brokers, nil
+}
+
+// brokerPorts are the default ports of the broker URL schemes, by scheme.
+var brokerPorts = map[string]string{
+	"tcp": "1883", "mqtt": "1883",
+	"ssl": "8883", "tls": "8883", "mqtts": "8883", "mqtt+ssl": "8883", "tcps": "8883",
+	"ws": "80", "wss": "443",
+}
+
+// normalizeBrokerURL validates the broker URL raw and returns it in the form
+// the transport connects to. A URL without a scheme, such as "host:port", is
+// connected to over TCP, and the default port of the scheme is filled in if
+// the URL has none. SRV and Unix socket URLs are returned as given.
+func normalizeBrokerURL(raw string) (string, error) {
+	s := raw
+	if !strings.Contains(s, "://") {
+		s = "tcp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid broker URL %v: %w", raw, err)
+	}
+	if u.Scheme == "srv" || u.Scheme == "unix" {
+		return s, nil
+	}
+	port, ok := brokerPorts[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("unsupported scheme %v in broker URL %v: use tcp://, ssl://, ws://, wss:// or srv://", u.Scheme, raw)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("missing host in broker URL %v", raw)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		if u.Path != "" && u.Path != "/" {
+			return "", fmt.Errorf("unexpected path %v in broker URL %v: only ws:// and wss:// brokers take a path", u.Path, raw)
+		}
+		u.Path = ""
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u.String(), nil
+}
+
+// checkBrokerURLs returns an error if any of servers (such as the values of
+// "server" and "publish-server") or of the broker URLs in the config file is
+// invalid, so that a broker typo is reported before the daemon starts up.
+func checkBrokerURLs(configFile string, servers ...string) error {
+	for _, server := range servers {
+		if server == "" {
+			continue
+		}
+		if _, err := normalizeBrokerURL(server); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"broker", "publish-broker"} {
+		if _, err := loadBrokerConfigs(configFile, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mqttBrokers returns the brokers an MQTT transport connects to: the broker
+// given by server, if any, followed by the brokers listed in the config file
+// tables named table. Broker URLs are normalized, and repeated brokers are
+// connected to once, in the place they first appear. TLS settings are loaded
+// only for brokers that override them, and are reloaded before each connection
+// attempt, warning when a certificate expires within expiryWarning.
+func mqttBrokers(server string, configFile string, table string, expiryWarning time.Duration) ([]transport.MQTTBroker, error) {
+	configs, err := loadBrokerConfigs(configFile, table)
+	if err != nil {
+		return nil, err
+	}
+	if server != "" {
+		server, err = normalizeBrokerURL(server)
+		if err != nil {
+			return nil, err
+		}
+		configs = append([]brokerConfig{{URL: server}}, configs...)
+	}
+
+	brokers := make([]transport.MQTTBroker, 0, len(configs))
+	seen := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		if seen[config.URL] {
+			log.Warnf("ignoring repeated broker %v", config.URL)
+			continue
+		}
+		seen[config.URL] = true
+		broker := transport.MQTTBroker{URL: config.URL}
+		// Values were validated by readBrokerConfigs.
+		broker.KeepAlive, _ = config.keepAlive()
+		broker.MaxReconnectInterval, _ = config.maxReconnectInterval()
+		if config.hasTLSOverride() {
+			loader := newTLSLoader(config.CertFile, config.KeyFile, config.CARoot, expiryWarning)
+			broker.TLSConfig, err = loader.load()
+			broker.LoadTLSConfig = loader.load
+			if err != nil {
+				return nil, fmt.Errorf("cannot create TLS config for broker %v: %w", config.URL, err)
+			}
+		}
+		brokers = append(brokers, broker)
+	}
+	return brokers, nil
+}
+
+// tlsSchemes are the broker URL schemes connected to over TLS.
+var tlsSchemes = map[string]bool{
+	"ssl": true, "tls": true, "mqtts": true, "mqtt+ssl": true, "tcps": true,
+}
+
+// checkBrokerCertificates returns an error if any of the brokers connected to
+// over TLS has no client certificate, either of its own or in defaults, so
+// that a missing certificate is reported rather than the client connecting
+// without one.
+func checkBrokerCertificates(brokers []transport.MQTTBroker, defaults *tls.Config) error {
+	for _, broker := range brokers {
+		u, err := url.Parse(broker.URL)
+		if err != nil {
+			return fmt.Errorf("cannot parse broker URL: %w", err)
+		}
+		if !tlsSchemes[u.Scheme] {
+			continue
+		}
+		config := broker.TLSConfig
+		if config == nil {
+			config = defaults
+		}
+		if config == nil || len(config.Certificates) == 0 {
+			return fmt.Errorf("broker %v uses TLS but no client certificate is set: set 'cert-file' and 'key-file'", broker.URL)
+		}
+	}
+	return nil
+}
+
+// parseBrokerRole parses the name of the broker a kind of message is published
+// to when results are published to a separate broker, returning true for the
+// inbound (command) broker and false for the outbound (results) broker.
+func parseBrokerRole(role string) (bool, error) {
+	switch role {
+	case "inbound":
+		return true, nil
+	case "outbound":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unsupported broker: %v", role)
+	}
+}
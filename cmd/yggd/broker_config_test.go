@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+func TestReadBrokerConfigs(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		table       string
+		want        []brokerConfig
+		wantError   bool
+	}{
+		{
+			description: "no brokers",
+			input:       `server = "tcp://localhost:1883"`,
+			want:        nil,
+		},
+		{
+			description: "multiple brokers",
+			input: strings.Join([]string{
+				`server = "tcp://localhost:1883"`,
+				`[[broker]]`,
+				`url = "ssl://primary.example.com:8883"`,
+				`keepalive = "15s"`,
+				`ca-root = ["/etc/pki/primary-ca.pem"]`,
+				`[[broker]]`,
+				`url = "ssl://fallback.example.com:8883"`,
+				`max-reconnect-interval = "1m"`,
+			}, "\n"),
+			want: []brokerConfig{
+				{
+					URL:       "ssl://primary.example.com:8883",
+					KeepAlive: "15s",
+					CARoot:    []string{"/etc/pki/primary-ca.pem"},
+				},
+				{
+					URL:                  "ssl://fallback.example.com:8883",
+					MaxReconnectInterval: "1m",
+				},
+			},
+		},
+		{
+			description: "publish brokers",
+			input: strings.Join([]string{
+				`[[broker]]`,
+				`url = "ssl://commands.example.com:8883"`,
+				`[[publish-broker]]`,
+				`url = "ssl://results.example.com:8883"`,
+			}, "\n"),
+			table: "publish-broker",
+			want: []brokerConfig{
+				{URL: "ssl://results.example.com:8883"},
+			},
+		},
+		{
+			description: "not an array of tables",
+			input:       "[broker]\nurl = \"tcp://localhost:1883\"",
+			wantError:   true,
+		},
+		{
+			description: "missing url",
+			input:       "[[broker]]\nkeepalive = \"15s\"",
+			wantError:   true,
+		},
+		{
+			description: "invalid duration",
+			input:       "[[broker]]\nurl = \"tcp://localhost:1883\"\nkeepalive = \"soon\"",
+			wantError:   true,
+		},
+		{
+			description: "normalized url",
+			input:       "[[broker]]\nurl = \"broker.example.com\"",
+			want:        []brokerConfig{{URL: "tcp://broker.example.com:1883"}},
+		},
+		{
+			description: "unsupported scheme",
+			input:       "[[broker]]\nurl = \"http://broker.example.com\"",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			table := test.table
+			if table == "" {
+				table = "broker"
+			}
+			got, err := readBrokerConfigs(strings.NewReader(test.input), table)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeBrokerURL(t *testing.T) {
+	tests := []struct {
+		input     string
+		want      string
+		wantError bool
+	}{
+		{input: "tcp://localhost:1883", want: "tcp://localhost:1883"},
+		{input: "localhost:1883", want: "tcp://localhost:1883"},
+		{input: "localhost", want: "tcp://localhost:1883"},
+		{input: "[::1]", want: "tcp://[::1]:1883"},
+		{input: "ssl://broker.example.com", want: "ssl://broker.example.com:8883"},
+		{input: "SSL://broker.example.com:8884/", want: "ssl://broker.example.com:8884"},
+		{input: "wss://broker.example.com/mqtt", want: "wss://broker.example.com:443/mqtt"},
+		{input: "srv://_mqtts._tcp.example.com", want: "srv://_mqtts._tcp.example.com"},
+		{input: "http://broker.example.com", wantError: true},
+		{input: "tcp://:1883", wantError: true},
+		{input: "tcp://broker.example.com/mqtt", wantError: true},
+		{input: "tcp://broker.example.com:port", wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := normalizeBrokerURL(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMQTTBrokersRepeated(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.toml")
+	config := strings.Join([]string{
+		`[[broker]]`,
+		`url = "tcp://primary.example.com:1883"`,
+		`[[broker]]`,
+		`url = "fallback.example.com"`,
+		`[[broker]]`,
+		`url = "tcp://fallback.example.com:1883"`,
+	}, "\n")
+	if err := ioutil.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	brokers, err := mqttBrokers("primary.example.com:1883", configFile, "broker", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, b := range brokers {
+		got = append(got, b.URL)
+	}
+	want := []string{"tcp://primary.example.com:1883", "tcp://fallback.example.com:1883"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+}
+
+func TestCheckBrokerCertificates(t *testing.T) {
+	withCert := &tls.Config{Certificates: []tls.Certificate{{}}}
+	tests := []struct {
+		description string
+		brokers     []transport.MQTTBroker
+		defaults    *tls.Config
+		wantError   bool
+	}{
+		{
+			description: "plain",
+			brokers:     []transport.MQTTBroker{{URL: "tcp://localhost:1883"}},
+			defaults:    &tls.Config{},
+		},
+		{
+			description: "default certificate",
+			brokers:     []transport.MQTTBroker{{URL: "ssl://broker.example.com:8883"}},
+			defaults:    withCert,
+		},
+		{
+			description: "broker certificate",
+			brokers:     []transport.MQTTBroker{{URL: "tls://broker.example.com:8883", TLSConfig: withCert}},
+			defaults:    &tls.Config{},
+		},
+		{
+			description: "no certificate",
+			brokers:     []transport.MQTTBroker{{URL: "ssl://broker.example.com:8883"}},
+			defaults:    &tls.Config{},
+			wantError:   true,
+		},
+		{
+			description: "broker override without certificate",
+			brokers:     []transport.MQTTBroker{{URL: "mqtts://broker.example.com:8883", TLSConfig: &tls.Config{}}},
+			defaults:    withCert,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := checkBrokerCertificates(test.brokers, test.defaults)
+			if test.wantError && err == nil {
+				t.Error("expected error")
+			}
+			if !test.wantError && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
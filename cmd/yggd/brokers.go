@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+	"github.com/urfave/cli/v2"
+)
+
+// handleBrokers is the control handler for the "brokers" command. It reports
+// the state of the transport's connection to each of its brokers.
+func (c *Client) handleBrokers(args map[string]string) (interface{}, error) {
+	r, ok := c.t.(transport.BrokerStatusReporter)
+	if !ok {
+		return nil, fmt.Errorf("transport does not connect to brokers")
+	}
+	return r.BrokerStatus(), nil
+}
+
+// connectedBrokers returns the number of brokers in statuses that are
+// connected.
+func connectedBrokers(statuses []transport.BrokerStatus) int {
+	n := 0
+	for _, b := range statuses {
+		if b.Connected {
+			n++
+		}
+	}
+	return n
+}
+
+// brokersAction calls the "brokers" control command on the running daemon and
+// prints the state of each broker connection, either as a table or as JSON.
+func brokersAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "brokers", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var brokers []transport.BrokerStatus
+	if err := json.Unmarshal(result, &brokers); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(brokers, "", "  ")
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot marshal brokers: %w", err), 1)
+		}
+		fmt.Fprintln(c.App.Writer, string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.App.Writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "URL\tSTATE\tFAILURES\tLAST ERROR")
+	for _, b := range brokers {
+		state := "disconnected"
+		if b.Connected {
+			state = "connected"
+		}
+		if b.Active {
+			state += " (active)"
+		}
+		if b.AuthFailed {
+			state += fmt.Sprintf(" (auth failed, CONNACK %v)", b.ReturnCode)
+		}
+		if b.FreshClientID != "" {
+			state += " (client ID " + b.FreshClientID + ")"
+		}
+		lastError := ""
+		if b.LastErrorAt != nil {
+			lastError = fmt.Sprintf("%v ago: %v", time.Since(*b.LastErrorAt).Round(time.Second), b.LastError)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", b.URL, state, b.Failures, lastError)
+	}
+	if err := w.Flush(); err != nil {
+		return cli.Exit(fmt.Errorf("cannot write brokers: %w", err), 1)
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cancelMetadataKey is the metadata key of a result that records what became
+// of a request to cancel the assignment it responds to.
+const cancelMetadataKey = "cancel"
+
+// The values of the cancelMetadataKey metadata of a result.
+const (
+	// cancelStatusCancelled marks the result published in place of a worker's
+	// result after its assignment is cancelled.
+	cancelStatusCancelled = "cancelled"
+
+	// cancelStatusTooLate marks a worker's result if its assignment could
+	// not be cancelled because the worker had already finished it or
+	// returned from its Send call.
+	cancelStatusTooLate = "too-late"
+)
+
+// cancelTimeout bounds how long a worker may take to acknowledge the
+// cancellation of a message it accepted.
+const cancelTimeout = 10 * time.Second
+
+// errAssignmentCancelled is returned by sendToWorker if the worker's Send
+// call was cancelled.
+var errAssignmentCancelled = errors.New("assignment cancelled")
+
+// An assignment is a data message delivered to a worker that has not yet been
+// responded to.
+type assignment struct {
+	pid int
+
+	// handler is the handler the worker process registered for, which labels
+	// the metrics of the assignment as it labels those of the dispatch.
+	handler string
+
+	// started is when delivering the message began.
+	started time.Time
+
+	// data is the message as it was dispatched, and queued when it was
+	// queued, so that it can be dispatched again, keeping its age, if the
+	// worker is displaced.
+	data   yggdrasil.Data
+	queued time.Time
+
+	// cancel cancels the context of the worker's Send call. It is nil once
+	// the call has returned.
+	cancel context.CancelFunc
+
+	// cancelled is set once cancelling the assignment has been requested.
+	cancelled bool
+
+	// displaced is set if the worker was displaced during the Send call.
+	displaced bool
+
+	// timer, if set, times out the assignment.
+	timer *time.Timer
+}
+
+// assign records that the message of q is being delivered to the worker
+// process pid. Until the worker's Send call returns, calling cancel cancels
+// it.
+func (d *dispatcher) assign(q queuedData, pid int, cancel context.CancelFunc) {
+	d.Lock()
+	defer d.Unlock()
+
+	a := &assignment{pid: pid, handler: d.pidHandlers[pid], started: time.Now(), data: q.data, queued: q.queued, cancel: cancel}
+	d.assignments[q.data.MessageID] = a
+	d.lastActivity[pid] = time.Now()
+	d.startAssignmentTimer(q.data.MessageID, a)
+}
+
+// delivered records that the worker's Send call for the message id returned
+// err. If the call was cancelled, errAssignmentCancelled is returned. If the
+// worker responded to the message before its Send call returned, the response
+// supersedes err.
+func (d *dispatcher) delivered(id string, err error) error {
+	d.Lock()
+	defer d.Unlock()
+
+	a, ok := d.assignments[id]
+	if !ok {
+		return nil
+	}
+	a.cancel = nil
+	if err == nil {
+		return nil
+	}
+	delete(d.assignments, id)
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	if a.displaced && status.Code(err) == codes.Canceled {
+		return errAssignmentDisplaced
+	}
+	if a.cancelled && status.Code(err) == codes.Canceled {
+		return errAssignmentCancelled
+	}
+	return err
+}
+
+// responded records that a response to the message id was received, and
+// returns true if cancelling its assignment was requested too late.
+func (d *dispatcher) responded(id string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	a, ok := d.assignments[id]
+	if !ok {
+		return false
+	}
+	metrics.observeSeries("worker_assignment_duration_seconds", []metricLabel{{"worker", a.handler}}, time.Since(a.started).Seconds())
+	delete(d.assignments, id)
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	return a.cancelled
+}
+
+// Cancel requests that the assignment of the message id be cancelled. If the
+// worker's Send call for the message has not returned, its context is
+// cancelled and, once the call returns, a result marked "cancelled" is
+// published in place of the worker's result. Otherwise the cancellation is
+// forwarded to the worker, which has accepted the message, in the background.
+// If the worker cannot cancel its work, its result, when it arrives, is marked
+// "too-late".
+func (d *dispatcher) Cancel(id string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	a, ok := d.assignments[id]
+	if !ok {
+		return fmt.Errorf("no assignment in flight for message %v", id)
+	}
+	logger := processLogger(a.pid)
+	if a.cancelled {
+		logger.Infof("cancelling message %v is already in progress", id)
+		return nil
+	}
+	a.cancelled = true
+	if a.cancel == nil {
+		w, ok := d.workerByPID(a.pid)
+		if !ok {
+			logger.Warnf("cannot cancel message %v: worker process %v is not registered", id, a.pid)
+			return nil
+		}
+		logger.Infof("forwarding cancellation of message %v to worker %v", id, w.handler)
+		go d.cancelAccepted(id, a, w)
+		return nil
+	}
+	logger.Infof("cancelling message %v", id)
+	a.cancel()
+	return nil
+}
+
+// cancelAccepted asks the worker w to cancel its work on the message id it
+// accepted, as assignment a. Once the worker has cancelled it, the assignment
+// is forgotten and a result marked "cancelled" is published in place of the
+// worker's; a result the worker sends afterwards is discarded.
+func (d *dispatcher) cancelAccepted(id string, a *assignment, w worker) {
+	logger := processLogger(a.pid)
+	if err := d.cancelWorker(w.addr, id); err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			logger.Warnf("cannot cancel message %v: worker %v does not support cancelling accepted messages", id, w.handler)
+		} else {
+			logger.Warnf("cannot cancel message %v: worker %v: %v", id, w.handler, err)
+		}
+		return
+	}
+
+	d.Lock()
+	if d.assignments[id] != a {
+		d.Unlock()
+		logger.Warnf("cancelling message %v was too late; worker finished it", id)
+		return
+	}
+	delete(d.assignments, id)
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	d.cancelledIDs[id] = forgottenAssignment{pid: a.pid, at: time.Now()}
+	d.Unlock()
+
+	logger.Infof("cancelled message %v", id)
+	d.trackResponse(id)
+	d.releaseSlot(id)
+	d.history.finish(id, assignmentCancelled, nil)
+	d.recvQ <- cancelledResult(a.data)
+}
+
+// cancelledLate returns true if the message id is one whose assignment was
+// cancelled by its worker after accepting it, and forgets it.
+func (d *dispatcher) cancelledLate(id string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.cancelledIDs[id]; !ok {
+		return false
+	}
+	delete(d.cancelledIDs, id)
+	return true
+}
+
+// cancelOnWorker calls the Cancel method of the worker listening on addr for
+// the message id.
+func cancelOnWorker(addr string, id string) error {
+	conn, err := grpc.Dial("unix:"+addr, grpc.WithInsecure())
+	if err != nil {
+		return fmt.Errorf("cannot dial socket: %w", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	_, err = pb.NewWorkerClient(conn).Cancel(ctx, &pb.CancelRequest{MessageId: id})
+	return err
+}
+
+// cancelledResult creates the result published after the assignment of data
+// is cancelled.
+func cancelledResult(data yggdrasil.Data) yggdrasil.Data {
+	return yggdrasil.Data{
+		Type:       yggdrasil.MessageTypeData,
+		MessageID:  uuid.New().String(),
+		ResponseTo: data.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Directive:  data.Directive,
+		Metadata:   map[string]string{cancelMetadataKey: cancelStatusCancelled},
+		Content:    json.RawMessage("null"),
+	}
+}
+
+// handleCancel is the control handler for the "cancel" command.
+func (d *dispatcher) handleCancel(args map[string]string) (interface{}, error) {
+	id := args["message_id"]
+	if id == "" {
+		return nil, fmt.Errorf("missing message_id argument")
+	}
+	if err := d.Cancel(id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// cancelAction calls the "cancel" control command on the running daemon.
+func cancelAction(c *cli.Context) error {
+	if !c.Args().Present() {
+		return cli.Exit("missing MESSAGE_ID argument", 1)
+	}
+
+	if _, err := callControl(c.String("control-socket-addr"), "cancel", map[string]string{"message_id": c.Args().First()}); err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	return nil
+}
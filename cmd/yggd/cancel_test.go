@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCancel(t *testing.T) {
+	tests := []struct {
+		description   string
+		cancelDuring  bool
+		cancelAfter   bool
+		sendErr       error
+		respondDuring bool
+		wantErr       error
+		wantTooLate   bool
+	}{
+		{
+			description: "not cancelled",
+		},
+		{
+			description:  "cancelled during send",
+			cancelDuring: true,
+			sendErr:      status.Error(codes.Canceled, "context canceled"),
+			wantErr:      errAssignmentCancelled,
+		},
+		{
+			description:  "send finished before cancellation",
+			cancelDuring: true,
+			wantTooLate:  true,
+		},
+		{
+			description:   "responded before cancellation took effect",
+			cancelDuring:  true,
+			respondDuring: true,
+			sendErr:       status.Error(codes.Canceled, "context canceled"),
+			wantTooLate:   true,
+		},
+		{
+			description: "cancelled after send",
+			cancelAfter: true,
+			wantTooLate: true,
+		},
+		{
+			description: "send failed",
+			sendErr:     status.Error(codes.Unavailable, "unavailable"),
+			wantErr:     status.Error(codes.Unavailable, "unavailable"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			d.assign(queuedData{data: yggdrasil.Data{MessageID: "1234"}}, 1, cancel)
+			tooLate := false
+			if test.cancelDuring {
+				if err := d.Cancel("1234"); err != nil {
+					t.Fatal(err)
+				}
+				if ctx.Err() == nil {
+					t.Errorf("expected context to be cancelled")
+				}
+			}
+			if test.respondDuring {
+				tooLate = d.responded("1234")
+			}
+
+			err := d.delivered("1234", test.sendErr)
+			if test.wantErr == errAssignmentCancelled {
+				if !errors.Is(err, errAssignmentCancelled) {
+					t.Fatalf("%v != %v", err, test.wantErr)
+				}
+			} else if status.Code(err) != status.Code(test.wantErr) {
+				t.Fatalf("%v != %v", err, test.wantErr)
+			}
+
+			if test.cancelAfter {
+				if err := d.Cancel("1234"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !test.respondDuring && err == nil {
+				tooLate = d.responded("1234")
+			}
+			if tooLate != test.wantTooLate {
+				t.Errorf("too late: %v != %v", tooLate, test.wantTooLate)
+			}
+
+			if err := d.Cancel("1234"); err == nil {
+				t.Errorf("expected error cancelling finished assignment")
+			}
+		})
+	}
+}
+
+func TestCancelAccepted(t *testing.T) {
+	tests := []struct {
+		description   string
+		cancelErr     error
+		wantCancelled bool
+	}{
+		{
+			description:   "cancelled by worker",
+			wantCancelled: true,
+		},
+		{
+			description: "not supported by worker",
+			cancelErr:   status.Error(codes.Unimplemented, "method Cancel not implemented"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.workers["echo"] = worker{pid: 1, handler: "echo", addr: "@ygg-echo-test"}
+			d.pidHandlers[1] = "echo"
+			forwarded := make(chan string, 1)
+			d.cancelWorker = func(addr string, id string) error {
+				forwarded <- addr + " " + id
+				return test.cancelErr
+			}
+
+			d.assign(queuedData{data: yggdrasil.Data{MessageID: "1234", Directive: "echo"}}, 1, nil)
+			if err := d.delivered("1234", nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Cancel("1234"); err != nil {
+				t.Fatal(err)
+			}
+			if got := <-forwarded; got != "@ygg-echo-test 1234" {
+				t.Errorf("forwarded cancellation: %v", got)
+			}
+
+			if !test.wantCancelled {
+				// The worker's result, when it arrives, is too late.
+				if !d.responded("1234") {
+					t.Errorf("expected cancelling to be too late")
+				}
+				if d.cancelledLate("1234") {
+					t.Errorf("result to message not cancelled by the worker discarded")
+				}
+				return
+			}
+
+			select {
+			case result := <-d.recvQ:
+				if result.ResponseTo != "1234" || result.Metadata[cancelMetadataKey] != cancelStatusCancelled {
+					t.Errorf("unexpected result: %+v", result)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no cancelled result published")
+			}
+			if err := d.Cancel("1234"); err == nil {
+				t.Errorf("expected error cancelling cancelled assignment")
+			}
+			if !d.cancelledLate("1234") || d.cancelledLate("1234") {
+				t.Errorf("expected a single result to the cancelled message to be discarded")
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// supportedCommands are the commands the client accepts on the "control"
+// topic.
+var supportedCommands = []yggdrasil.CommandName{
+	yggdrasil.CommandNameCancel,
+	yggdrasil.CommandNameDisconnect,
+	yggdrasil.CommandNamePing,
+	yggdrasil.CommandNameReconnect,
+}
+
+// capabilities describes where capabilities messages are published, and
+// records the directives last published so that unchanged capabilities are
+// not re-published.
+type capabilities struct {
+	dest   string
+	retain bool
+
+	lock      sync.Mutex
+	published []string
+}
+
+// directives returns the sorted handlers of the dispatchers map.
+func directives(dispatchers map[string]map[string]string) []string {
+	directives := make([]string, 0, len(dispatchers))
+	for handler := range dispatchers {
+		directives = append(directives, handler)
+	}
+	sort.Strings(directives)
+	return directives
+}
+
+// Capabilities creates a capabilities message listing the directives of the
+// currently registered workers.
+func (c *Client) Capabilities() *yggdrasil.Capabilities {
+	msg := yggdrasil.Capabilities{
+		Type:      yggdrasil.MessageTypeCapabilities,
+		MessageID: uuid.New().String(),
+		Version:   1,
+		Sent:      time.Now(),
+	}
+	msg.Content.Directives = directives(c.d.Dispatchers())
+	msg.Content.Commands = supportedCommands
+	return &msg
+}
+
+// PublishCapabilities publishes a capabilities message, waiting for the
+// transport to acknowledge it. Unless force is true, the message is not
+// published if the directives are unchanged since the last message published.
+func (c *Client) PublishCapabilities(force bool) error {
+	if c.capabilities == nil {
+		return nil
+	}
+
+	msg := c.Capabilities()
+
+	c.capabilities.lock.Lock()
+	defer c.capabilities.lock.Unlock()
+
+	if !force && c.capabilities.published != nil && reflect.DeepEqual(c.capabilities.published, msg.Content.Directives) {
+		log.Debug("capabilities unchanged; skipping")
+		return nil
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("cannot marshal message: %w", err)
+	}
+
+	if t, ok := c.t.(transport.AcknowledgingTransporter); ok {
+		if err := t.SendDataWithOptions(data, c.capabilities.dest, c.acknowledgedOptions(c.capabilities.retain)); err != nil {
+			return fmt.Errorf("cannot publish capabilities: %w", err)
+		}
+	} else if err := c.t.SendData(data, c.capabilities.dest); err != nil {
+		return fmt.Errorf("cannot publish capabilities: %w", err)
+	}
+	c.capabilities.published = msg.Content.Directives
+	log.Debugf("published capabilities: %v", msg.Content.Directives)
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestPublishCapabilities(t *testing.T) {
+	tr := &recordingTransport{}
+	d := newDispatcher(nil)
+	c := Client{t: tr, d: d, capabilities: &capabilities{dest: "capabilities", retain: true}}
+
+	d.workers["sleep"] = worker{handler: "sleep"}
+	d.workers["echo"] = worker{handler: "echo"}
+
+	// The first message is published even without force; subsequent
+	// messages are skipped until the directives change.
+	for _, force := range []bool{false, false, true} {
+		if err := c.PublishCapabilities(force); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(tr.sent["capabilities"]) != 2 {
+		t.Fatalf("expected 2 messages, got %v", len(tr.sent["capabilities"]))
+	}
+	if !tr.options.Retain {
+		t.Errorf("expected retained message")
+	}
+
+	d.workers["cat"] = worker{handler: "cat"}
+	if err := c.PublishCapabilities(false); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.sent["capabilities"]) != 3 {
+		t.Fatalf("expected 3 messages, got %v", len(tr.sent["capabilities"]))
+	}
+
+	var got yggdrasil.Capabilities
+	if err := json.Unmarshal(tr.sent["capabilities"][2], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != yggdrasil.MessageTypeCapabilities {
+		t.Errorf("%v != %v", got.Type, yggdrasil.MessageTypeCapabilities)
+	}
+	if !cmp.Equal(got.Content.Directives, []string{"cat", "echo", "sleep"}) {
+		t.Errorf("%#v", cmp.Diff(got.Content.Directives, []string{"cat", "echo", "sleep"}))
+	}
+	if !cmp.Equal(got.Content.Commands, supportedCommands) {
+		t.Errorf("%#v", cmp.Diff(got.Content.Commands, supportedCommands))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// A fileStamp identifies a version of a file by its modification time and
+// size. The zero value stands for a file that does not exist.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// A certWatcher checks the certificate, key and certificate authority files
+// every interval and calls changed once any of them was replaced or modified,
+// so that a renewed certificate is presented to the broker without waiting
+// for the connection to drop.
+type certWatcher struct {
+	files    []string
+	interval time.Duration
+	changed  func()
+	stamps   map[string]fileStamp
+}
+
+func newCertWatcher(files []string, interval time.Duration, changed func()) *certWatcher {
+	w := &certWatcher{
+		files:    files,
+		interval: interval,
+		changed:  changed,
+		stamps:   make(map[string]fileStamp, len(files)),
+	}
+	w.check()
+	return w
+}
+
+// run checks the files every interval, calling changed after a change.
+func (w *certWatcher) run() {
+	log.Infof("watching TLS files for changes every %v", w.interval)
+	for {
+		time.Sleep(w.interval)
+		if w.check() {
+			w.changed()
+		}
+	}
+}
+
+// check records the current version of each file, returning true if any of
+// them changed since the previous check.
+func (w *certWatcher) check() bool {
+	changed := false
+	for _, file := range w.files {
+		var stamp fileStamp
+		if info, err := os.Stat(file); err == nil {
+			stamp = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+		if prev, ok := w.stamps[file]; ok && prev != stamp {
+			log.Debugf("TLS file %v changed", file)
+			changed = true
+		}
+		w.stamps[file] = stamp
+	}
+	return changed
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertWatcherCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(cert, []byte("cert"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newCertWatcher([]string{cert, key}, time.Minute, nil)
+	if w.check() {
+		t.Error("changed without a change")
+	}
+
+	steps := []struct {
+		description string
+		change      func() error
+	}{
+		{"modified", func() error { return ioutil.WriteFile(cert, []byte("renewed cert"), 0600) }},
+		{"touched", func() error {
+			later := time.Now().Add(time.Hour)
+			return os.Chtimes(cert, later, later)
+		}},
+		{"created", func() error { return ioutil.WriteFile(key, []byte("key"), 0600) }},
+		{"removed", func() error { return os.Remove(key) }},
+	}
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatal(err)
+		}
+		if !w.check() {
+			t.Errorf("%v: change not detected", step.description)
+		}
+		if w.check() {
+			t.Errorf("%v: change detected twice", step.description)
+		}
+	}
+}
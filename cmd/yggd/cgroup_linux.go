@@ -0,0 +1,239 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// cgroupMount is the mount point of the cgroup v2 hierarchy.
+const cgroupMount = "/sys/fs/cgroup"
+
+// cgroupCPUPeriod is the period, in microseconds, over which the CPU quota of
+// a worker cgroup is enforced.
+const cgroupCPUPeriod = 100000
+
+var workerCgroups struct {
+	once   sync.Once
+	parent string
+	err    error
+}
+
+// prepareCgroup creates the cgroup of the worker name, if it does not exist,
+// limits it to cpuQuota percent of a single CPU and memoryMax bytes of memory,
+// and returns its path. A zero limit is no limit.
+func prepareCgroup(name string, cpuQuota int, memoryMax int64) (string, error) {
+	workerCgroups.once.Do(func() {
+		workerCgroups.parent, workerCgroups.err = setupWorkerCgroups()
+	})
+	if workerCgroups.err != nil {
+		return "", workerCgroups.err
+	}
+
+	dir := filepath.Join(workerCgroups.parent, "worker-"+name)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("cannot create cgroup: %w", err)
+	}
+
+	cpuMax := "max"
+	if cpuQuota > 0 {
+		cpuMax = strconv.Itoa(cpuQuota * cgroupCPUPeriod / 100)
+	}
+	if err := writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%v %v", cpuMax, cgroupCPUPeriod)); err != nil {
+		return "", err
+	}
+	memMax := "max"
+	if memoryMax > 0 {
+		memMax = strconv.FormatInt(memoryMax, 10)
+	}
+	if err := writeCgroupFile(dir, "memory.max", memMax); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// cgroupTrampoline makes cmd run the daemon's executable as a trampoline that
+// joins the cgroup dir and then executes the path and arguments cmd was set up
+// to run. The credential of cmd, if any, is passed to the trampoline to switch
+// to once it has joined the cgroup, as a process running as the worker's user
+// may not be allowed to move itself.
+func cgroupTrampoline(cmd *exec.Cmd, dir string) {
+	cred := "-"
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.Credential != nil {
+		cred = formatTrampolineCredential(cmd.SysProcAttr.Credential)
+		cmd.SysProcAttr.Credential = nil
+	}
+	cmd.Args = append([]string{cmd.Args[0], cgroupTrampolineArg, dir, cred, cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+}
+
+// runCgroupTrampoline runs the trampoline set up by cgroupTrampoline, with
+// args following cgroupTrampolineArg: it moves the process into the cgroup,
+// switches to the credential and executes the command. It does not return.
+func runCgroupTrampoline(args []string) {
+	if err := cgroupTrampolineExec(args); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot start worker in cgroup: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func cgroupTrampolineExec(args []string) error {
+	if len(args) < 4 {
+		return fmt.Errorf("missing arguments")
+	}
+	dir, cred, path, argv := args[0], args[1], args[2], args[3:]
+
+	if err := writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+		return fmt.Errorf("cannot move process to cgroup: %w", err)
+	}
+	if cred != "-" {
+		c, err := parseTrampolineCredential(cred)
+		if err != nil {
+			return err
+		}
+		groups := make([]int, 0, len(c.Groups))
+		for _, gid := range c.Groups {
+			groups = append(groups, int(gid))
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("cannot set groups: %w", err)
+		}
+		if err := syscall.Setgid(int(c.Gid)); err != nil {
+			return fmt.Errorf("cannot set group ID: %w", err)
+		}
+		if err := syscall.Setuid(int(c.Uid)); err != nil {
+			return fmt.Errorf("cannot set user ID: %w", err)
+		}
+	}
+	if err := syscall.Exec(path, argv, os.Environ()); err != nil {
+		return fmt.Errorf("cannot execute %v: %w", argv[0], err)
+	}
+	return nil
+}
+
+// formatTrampolineCredential formats cred as "uid:gid:groups", where groups
+// is a comma-separated list of group IDs.
+func formatTrampolineCredential(cred *syscall.Credential) string {
+	groups := make([]string, 0, len(cred.Groups))
+	for _, gid := range cred.Groups {
+		groups = append(groups, strconv.FormatUint(uint64(gid), 10))
+	}
+	return fmt.Sprintf("%v:%v:%v", cred.Uid, cred.Gid, strings.Join(groups, ","))
+}
+
+// parseTrampolineCredential parses a credential formatted by
+// formatTrampolineCredential.
+func parseTrampolineCredential(s string) (*syscall.Credential, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid credential: %v", s)
+	}
+	ids := []string{fields[0], fields[1]}
+	if fields[2] != "" {
+		ids = append(ids, strings.Split(fields[2], ",")...)
+	}
+	cred := &syscall.Credential{Groups: []uint32{}}
+	for i, field := range ids {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential: %v", s)
+		}
+		switch i {
+		case 0:
+			cred.Uid = uint32(id)
+		case 1:
+			cred.Gid = uint32(id)
+		default:
+			cred.Groups = append(cred.Groups, uint32(id))
+		}
+	}
+	return cred, nil
+}
+
+// setupWorkerCgroups prepares the cgroup of the daemon to hold the worker
+// cgroups, and returns its path. A cgroup cannot both hold processes and
+// pass controllers to its children, so the processes in it, the daemon and
+// any workers started without limits, are first moved to its child "daemon".
+// This requires the cgroup to be delegated to the daemon (for example, with
+// Delegate=yes in its systemd unit).
+func setupWorkerCgroups() (string, error) {
+	parent, err := daemonCgroup()
+	if err != nil {
+		return "", err
+	}
+
+	leaf := filepath.Join(parent, "daemon")
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("cannot create cgroup: %w", err)
+	}
+	procs, err := ioutil.ReadFile(filepath.Join(parent, "cgroup.procs"))
+	if err != nil {
+		return "", fmt.Errorf("cannot read processes of cgroup: %w", err)
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		if err := writeCgroupFile(leaf, "cgroup.procs", pid); err != nil {
+			return "", fmt.Errorf("cannot move process %v to cgroup: %w", pid, err)
+		}
+	}
+
+	if err := writeCgroupFile(parent, "cgroup.subtree_control", "+cpu +memory"); err != nil {
+		return "", fmt.Errorf("cannot enable cgroup controllers: %w", err)
+	}
+	return parent, nil
+}
+
+// daemonCgroup returns the path of the cgroup v2 the daemon was started in.
+func daemonCgroup() (string, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("cannot read cgroup of daemon: %w", err)
+	}
+	var path string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "0::") {
+			path = strings.TrimPrefix(scanner.Text(), "0::")
+		}
+	}
+	if path == "" {
+		return "", fmt.Errorf("cannot find cgroup of daemon: cgroup v2 is not in use")
+	}
+	return filepath.Join(cgroupMount, path), nil
+}
+
+// checkCgroupSetup returns an error if the daemon cannot create the cgroups of
+// its workers under its own cgroup, move processes between them and enable
+// their controllers, as setupWorkerCgroups does.
+func checkCgroupSetup() error {
+	parent, err := daemonCgroup()
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{".", "cgroup.procs", "cgroup.subtree_control"} {
+		if err := unix.Access(filepath.Join(parent, name), unix.W_OK); err != nil {
+			return fmt.Errorf("cannot write %v: %w", filepath.Join(parent, name), err)
+		}
+	}
+	return nil
+}
+
+// writeCgroupFile writes value to the interface file name of the cgroup dir.
+func writeCgroupFile(dir, name, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("cannot write %v: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCgroupTrampoline(t *testing.T) {
+	cred := &syscall.Credential{Uid: 1000, Gid: 1001, Groups: []uint32{10, 20}}
+	cmd := exec.Command("/usr/libexec/yggdrasil/echo-worker", "-v")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	cmd.Path = verifiedExecutablePath
+	cgroupTrampoline(cmd, "/sys/fs/cgroup/yggd.service/worker-echo-worker")
+
+	if cmd.Path != "/proc/self/exe" {
+		t.Errorf("%v != %v", cmd.Path, "/proc/self/exe")
+	}
+	if cmd.SysProcAttr.Credential != nil {
+		t.Errorf("credential left to the trampoline process: %#v", cmd.SysProcAttr.Credential)
+	}
+	want := []string{
+		"/usr/libexec/yggdrasil/echo-worker",
+		cgroupTrampolineArg,
+		"/sys/fs/cgroup/yggd.service/worker-echo-worker",
+		"1000:1001:10,20",
+		verifiedExecutablePath,
+		"/usr/libexec/yggdrasil/echo-worker",
+		"-v",
+	}
+	if !cmp.Equal(cmd.Args, want) {
+		t.Errorf("%v != %v", cmd.Args, want)
+	}
+
+	got, err := parseTrampolineCredential(cmd.Args[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, cred) {
+		t.Errorf("%#v != %#v", got, cred)
+	}
+	if got, err := parseTrampolineCredential("0:0:"); err != nil || len(got.Groups) != 0 {
+		t.Errorf("credential without groups: %#v, %v", got, err)
+	}
+	if _, err := parseTrampolineCredential("0:root:"); err == nil {
+		t.Error("expected error for an invalid credential")
+	}
+}
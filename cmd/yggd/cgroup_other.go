@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// prepareCgroup returns errCgroupUnsupported; cgroup limits are only supported
+// on Linux.
+func prepareCgroup(name string, cpuQuota int, memoryMax int64) (string, error) {
+	return "", errCgroupUnsupported
+}
+
+// checkCgroupSetup returns errCgroupUnsupported; cgroup limits are only
+// supported on Linux.
+func checkCgroupSetup() error {
+	return errCgroupUnsupported
+}
+
+// cgroupTrampoline does nothing; cgroup limits are only supported on Linux.
+func cgroupTrampoline(cmd *exec.Cmd, dir string) {}
+
+// runCgroupTrampoline exits with an error; cgroup limits are only supported
+// on Linux.
+func runCgroupTrampoline(args []string) {
+	fmt.Fprintf(os.Stderr, "cannot start worker in cgroup: %v\n", errCgroupUnsupported)
+	os.Exit(1)
+}
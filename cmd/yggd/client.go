@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"git.sr.ht/~spc/go-log"
@@ -16,40 +19,779 @@ import (
 
 type Client struct {
 	t transport.Transporter
-	d *dispatcher
+	d Dispatcher
+
+	// router decodes data received from the transport and routes it. If nil,
+	// the client routes data to itself.
+	router Router
+
+	// payloadTransforms normalizes the payloads received on each topic
+	// before they are decoded.
+	payloadTransforms payloadTransformer
+
+	// publishers, if set, publishes the results returned by workers
+	// concurrently. Otherwise they are published one at a time.
+	publishers *publishPool
+
+	// resultQueue, if set, queues the results returned by workers until
+	// they are published. Otherwise each is handed over to be published as
+	// it is returned.
+	resultQueue messageQueue
+
+	// rateLimits, if set, delays or drops the messages published to a
+	// destination beyond its rate limit.
+	rateLimits *publishRateLimiter
+
+	// startup, if set, announces that the daemon is operational once the
+	// first handshake completes.
+	startup *startupAnnouncement
+
+	// seen, if set, drops data messages whose ID, or content, was recently
+	// received.
+	seen *seenCache
+
+	// directives rejects data messages received from the transport whose
+	// directive is not permitted, before they reach the inbound transform
+	// chain.
+	directives *directiveFilter
+
+	// deadLetterDenied causes messages rejected by the directive filter to be
+	// published to the "dead-letter" destination instead of being dropped.
+	deadLetterDenied bool
+
+	// inbound is applied to data messages received from the transport
+	// before they are dispatched to a worker.
+	inbound *transformChain
+
+	// outbound is applied to data messages returned by workers before they
+	// are published.
+	outbound *transformChain
+
+	// enricher, if set, adds metadata rendered from the canonical facts to
+	// data messages returned by workers, before the outbound transform chain.
+	enricher *metadataEnricher
+
+	// deadLetterRejected causes messages rejected by the outbound transform
+	// chain to be published to the "dead-letter" destination instead of
+	// being dropped.
+	deadLetterRejected bool
+
+	// loops rejects inbound data messages that appear to be looping and
+	// stamps outbound data messages with an origin and hop count.
+	loops *loopDetector
+
+	// spool stores data messages that cannot be sent until they can be
+	// flushed. Messages that cannot be sent are dropped if spool is nil.
+	spool *spool
+
+	// deadLetterStale causes messages that waited too long to be dispatched
+	// to be published to the "dead-letter" destination instead of being
+	// dropped.
+	deadLetterStale bool
+
+	// deadLetterDests maps directives to the destinations their
+	// dead-lettered messages are published to, instead of the "dead-letter"
+	// destination. A directive of "*" applies to directives not in the map.
+	deadLetterDests map[string]string
+
+	// deadLetters, if set, keeps a copy of the dead-lettered messages so
+	// that they can be replayed.
+	deadLetters *deadLetterStore
+
+	// replaying is 1 while dead-lettered messages are being replayed.
+	replaying int32
+
+	// receipts maps directives to the destinations that "received" and
+	// "dispatched" receipts for their messages are published to. Receipts
+	// are not published for directives not in the map.
+	receipts map[string]string
+
+	// warmUp is how long to wait after the transport connects before
+	// publishing to it, for brokers that do not reliably accept publishes
+	// right after accepting a connection. sleep waits for it; it is replaced
+	// in tests.
+	warmUp time.Duration
+	sleep  func(time.Duration)
+
+	// ackTimeout bounds the wait for the acknowledgement of messages that are
+	// always sent with acknowledgement, such as connection-status messages.
+	// publishQoS is the configured QoS they are published at, raised by the
+	// transport if it cannot be acknowledged.
+	ackTimeout time.Duration
+	publishQoS byte
+
+	// handshakeTimeout bounds the handshake run by Handshake, from connecting
+	// to publishing the connection status. handshakeStep is the step the
+	// handshake is at. If handshakeTimeout is zero, the handshake is not
+	// bounded.
+	handshakeTimeout time.Duration
+	handshakeStep    atomic.Value
+
+	// authRetryInterval is the least delay before ConnectLazily tries again
+	// after every broker rejected the client's credentials. If
+	// stopOnAuthFailure is true, it does not try again.
+	authRetryInterval time.Duration
+	stopOnAuthFailure bool
+
+	// draining is set when the client begins shutting down. Data messages
+	// received while draining are rejected rather than dispatched, unless
+	// processWhileDraining is true. If nackWhileDraining is true, as it is
+	// when messages are acknowledged after processing, a rejected message
+	// is not acknowledged instead: ReceiveDataMessage holds it until
+	// disconnected is closed, once the transport has disconnected and can
+	// no longer send the acknowledgment, so that the broker delivers it
+	// again to the next session.
+	draining             atomic.Value
+	processWhileDraining bool
+	nackWhileDraining    bool
+	disconnected         chan struct{}
+
+	// facts caches the canonical facts included in connection-status
+	// messages. If nil, facts are collected for every message.
+	facts *factsCache
+
+	// heartbeat, if set, periodically re-publishes the connection status. It
+	// is reset whenever a connection-status message is published.
+	heartbeat *heartbeat
+
+	// factsWatch, if set, periodically collects the canonical facts and
+	// re-publishes the connection status when they change.
+	factsWatch *factsWatcher
+
+	// statusThrottle, if set, bounds the rate at which connection-status
+	// messages are re-published.
+	statusThrottle *statusThrottle
+
+	// connectedAt is the time the transport last connected.
+	connectedAt atomic.Value
+
+	// session is the session ID generated when the transport last connected.
+	session atomic.Value
+
+	// presence, if set, describes the messages published when the client
+	// connects and when it shuts down cleanly.
+	presence *presence
+
+	// handshake encodes connection-status messages and handshakeDest is the
+	// destination they are published to. If nil or empty, they are encoded
+	// as JSON and published to the "control" destination.
+	handshake     codec
+	handshakeDest string
+
+	// certExpiryDest is the destination certificate-expiry messages are
+	// published to.
+	certExpiryDest string
+
+	// signer, if set, signs the results published by the client.
+	signer *resultSigner
+
+	// verifier, if set, verifies the signatures of data messages received
+	// before they are dispatched.
+	verifier *payloadVerifier
+
+	// inFlight, if set, tracks each data message received from the
+	// transport until it has been processed, limiting the number of messages
+	// in flight. If the transport acknowledges messages after processing,
+	// this delays the acknowledgement to the broker.
+	inFlight *inFlightTracker
+
+	// capabilities, if set, describes where capabilities messages are
+	// published.
+	capabilities *capabilities
+
+	// unparseable describes how payloads received from the transport that
+	// cannot be decoded are handled. If nil, they are logged and dropped.
+	unparseable *unparseablePayloads
+
+	// desiredState, if set, reconciles the desired-state messages received
+	// from its destination.
+	desiredState *desiredStateReconciler
+
+	// uploads, if set, uploads the content of large data messages returned
+	// by workers over HTTP, publishing only a reference to it.
+	uploads *payloadUploader
+
+	// downloads, if set, fetches the content of data messages received with
+	// a reference to uploaded content in its place before dispatching them.
+	downloads *payloadDownloader
+
+	// idle, if set, disconnects the transport while no messages flow and
+	// connects it again on schedule or when a message is sent.
+	idle *idleDisconnector
+
+	// injected holds the IDs of the data messages injected through the
+	// control socket, whose results are logged rather than published.
+	injected injectedMessages
+}
+
+// Drain stops the client from accepting new data messages for dispatch. It is
+// called at the start of a graceful shutdown.
+func (c *Client) Drain() {
+	c.disconnected = make(chan struct{})
+	c.draining.Store(true)
+}
+
+// Disconnected releases the data messages held unacknowledged while draining.
+// It is called once the transport has disconnected, after Drain.
+func (c *Client) Disconnected() {
+	close(c.disconnected)
 }
 
+// isDraining returns true once Drain has been called.
+func (c *Client) isDraining() bool {
+	draining, _ := c.draining.Load().(bool)
+	return draining
+}
+
+// Connect connects the transport and, once connected and subscribed,
+// publishes the online presence and capabilities messages.
 func (c *Client) Connect() error {
-	return c.t.Connect()
+	return c.connect(context.Background())
 }
 
+// connect runs the steps of Connect, stopping with the error of ctx at the
+// first step reached once ctx is done.
+func (c *Client) connect(ctx context.Context) error {
+	c.handshakeStep.Store("connect and subscribe")
+	if err := c.t.Connect(); err != nil {
+		return err
+	}
+	c.startSession()
+	events.emit(event{Type: eventConnected})
+	c.handshakeStep.Store("warm up")
+	if err := c.warmUpConnection(ctx); err != nil {
+		return err
+	}
+	c.handshakeStep.Store("publish online presence")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.PublishOnline(); err != nil {
+		log.Errorf("cannot publish online presence: %v", err)
+	}
+	c.handshakeStep.Store("publish capabilities")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.PublishCapabilities(true); err != nil {
+		log.Errorf("cannot publish capabilities: %v", err)
+	}
+	return nil
+}
+
+// startSession records that the transport connected, generating a new session
+// ID.
+func (c *Client) startSession() {
+	c.connectedAt.Store(time.Now())
+	id := uuid.New().String()
+	c.session.Store(id)
+	log.Debugf("started session %v", id)
+}
+
+// sessionID returns the session ID of the current connection, or an empty
+// string if the transport has not connected.
+func (c *Client) sessionID() string {
+	id, _ := c.session.Load().(string)
+	return id
+}
+
+// warmUpConnection waits for the warm-up delay, if any, after the transport
+// connects and before anything is published to it. If ctx is done first, its
+// error is returned.
+func (c *Client) warmUpConnection(ctx context.Context) error {
+	if c.warmUp <= 0 {
+		return nil
+	}
+	log.Infof("waiting %v for the broker to warm up before publishing", c.warmUp)
+	sleep := c.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	return runStep(ctx, func() { sleep(c.warmUp) })
+}
+
+// ConnectLazily runs the handshake in the background, retrying until it
+// succeeds. The delay between attempts starts at initialInterval and doubles
+// after each failure, up to maxInterval. A subscription refused by the broker
+// is not retried; its error is returned. If every broker rejected the client's
+// credentials, the next attempt waits at least authRetryInterval, or, if
+// stopOnAuthFailure is true, the error is returned.
+func (c *Client) ConnectLazily(initialInterval time.Duration, maxInterval time.Duration) error {
+	delay := initialInterval
+	for {
+		err := c.Handshake(context.Background())
+		if err == nil {
+			log.Info("connected using transport")
+			return nil
+		}
+		if errors.Is(err, transport.ErrSubscribeRefused) {
+			return err
+		}
+		wait := delay
+		if errors.Is(err, transport.ErrAuthFailed) {
+			if c.stopOnAuthFailure {
+				return err
+			}
+			if wait < c.authRetryInterval {
+				wait = c.authRetryInterval
+			}
+			log.Errorf("broker rejected credentials, retrying in %v: %v", wait, err)
+		} else {
+			log.Warnf("cannot connect using transport, retrying in %v: %v", wait, err)
+		}
+
+		time.Sleep(wait)
+		delay *= 2
+		if delay > maxInterval {
+			delay = maxInterval
+		}
+	}
+}
+
+// ConnectAfterIdle connects the transport after it was disconnected for being
+// idle. Once connected, the connection status is published and the spool is
+// flushed.
+func (c *Client) ConnectAfterIdle() error {
+	if err := c.Connect(); err != nil {
+		return err
+	}
+	c.requestConnectionStatus(true)
+	go func() {
+		if err := c.FlushSpool(); err != nil {
+			log.Debugf("cannot flush spool: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Reconnect disconnects the transport and connects it again, retrying as
+// ConnectLazily does, so that the broker is presented the TLS config last
+// loaded. It does nothing while the transport is disconnected for being idle,
+// as the config is used once it connects again.
+func (c *Client) Reconnect(initialInterval time.Duration, maxInterval time.Duration) error {
+	if c.idle.isAsleep() {
+		return nil
+	}
+	log.Info("reconnecting using transport")
+	c.t.Disconnect(500)
+	return c.ConnectLazily(initialInterval, maxInterval)
+}
+
+// busy returns true while data messages received from the transport are
+// being processed.
+func (c *Client) busy() bool {
+	return c.inFlight != nil && c.inFlight.status().InFlight > 0
+}
+
+// publishConnectionStatus creates and publishes a connection-status message.
+func (c *Client) publishConnectionStatus() error {
+	return c.publishConnectionStatusContext(context.Background())
+}
+
+// publishConnectionStatusContext is publishConnectionStatus, returning the
+// error of ctx instead if ctx is done before the facts are collected.
+func (c *Client) publishConnectionStatusContext(ctx context.Context) error {
+	c.statusThrottle.mark()
+	c.handshakeStep.Store("collect facts")
+	var (
+		msg *yggdrasil.ConnectionStatus
+		err error
+	)
+	if err := runStep(ctx, func() { msg, err = c.ConnectionStatus() }); err != nil {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("cannot get connection status: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.SendConnectionStatusMessage(msg)
+}
+
+// ReconnectHandlerFunc publishes the online presence message, the
+// capabilities message and a fresh connection-status message after the
+// transport reconnects, since the broker will have published the offline will
+// message when the connection was lost.
+func (c *Client) ReconnectHandlerFunc() {
+	metrics.add("reconnects_total", 1)
+	c.startSession()
+	events.emit(event{Type: eventConnected, Detail: "reconnected"})
+	go func() {
+		c.warmUpConnection(context.Background())
+		if err := c.PublishOnline(); err != nil {
+			log.Errorf("cannot publish online presence: %v", err)
+		}
+		if err := c.PublishCapabilities(true); err != nil {
+			log.Errorf("cannot publish capabilities: %v", err)
+		}
+		c.requestConnectionStatus(true)
+		// Send the messages spooled while disconnected now, rather than at
+		// the next flush interval.
+		if err := c.FlushSpool(); err != nil {
+			log.Debugf("cannot flush spool: %v", err)
+		}
+	}()
+}
+
+// ConnectionLostHandlerFunc records that the transport lost its connection
+// with err.
+func (c *Client) ConnectionLostHandlerFunc(err error) {
+	events.emit(event{Type: eventDisconnected, Detail: err.Error()})
+}
+
+// FactsChangedHandlerFunc publishes a connection-status message after a worker
+// changes the facts it contributes.
+func (c *Client) FactsChangedHandlerFunc() {
+	c.requestConnectionStatus(false)
+}
+
+// HeartbeatFunc re-publishes the connection status, through the throttle if
+// publishes are throttled.
+func (c *Client) HeartbeatFunc() {
+	if c.statusThrottle != nil {
+		c.requestConnectionStatus(false)
+		return
+	}
+	if err := c.publishConnectionStatus(); err != nil {
+		log.Errorf("cannot send heartbeat: %v", err)
+		return
+	}
+	log.Debug("published heartbeat")
+}
+
+// SendDataMessage publishes msg to the "data" destination, within its rate
+// limit. A message queued for the rate limit is published later, and an error
+// publishing it then is logged.
 func (c *Client) SendDataMessage(msg *yggdrasil.Data) error {
-	return c.sendMessage(msg, "data")
+	_, err := c.sendLimited(msg, "data", func(err error) {
+		if err != nil {
+			log.Errorf("cannot send data message %v: %v", msg.MessageID, err)
+		}
+	})
+	return err
 }
 
+// SendDeadLetterMessage publishes msg to the dead-letter destination of its
+// directive, recording reason in the "dead_letter_reason" metadata key. Once
+// the publish is accepted, the message is also kept in the dead-letter store,
+// if any.
+func (c *Client) SendDeadLetterMessage(msg *yggdrasil.Data, reason error) error {
+	return c.sendDeadLetter(msg, reason, false)
+}
+
+// SendOversizedDeadLetterMessage dead-letters msg, whose content is too large
+// to publish, as SendDeadLetterMessage does, except that the content is
+// replaced by its digest in the published message. The dead-letter store
+// keeps the message with its content.
+func (c *Client) SendOversizedDeadLetterMessage(msg *yggdrasil.Data, reason error) error {
+	return c.sendDeadLetter(msg, reason, true)
+}
+
+func (c *Client) sendDeadLetter(msg *yggdrasil.Data, reason error, oversized bool) error {
+	data := *msg
+	data.Metadata = copyMetadata(msg.Metadata)
+	data.Metadata["dead_letter_reason"] = reason.Error()
+	stored := data
+	if oversized {
+		var err error
+		data, err = withContentDigest(data)
+		if err != nil {
+			return err
+		}
+	}
+	queued, err := c.sendLimited(&data, c.deadLetterDest(msg.Directive), func(err error) {
+		if err != nil {
+			log.Errorf("failed to send dead-letter message: %v", err)
+			return
+		}
+		c.storeDeadLetter(stored)
+	})
+	if !queued && err == nil {
+		c.storeDeadLetter(stored)
+	}
+	return err
+}
+
+// storeDeadLetter keeps msg, once its publish to the dead-letter destination
+// is accepted, in the dead-letter store.
+func (c *Client) storeDeadLetter(msg yggdrasil.Data) {
+	if err := c.deadLetters.add(msg); err != nil {
+		log.Errorf("cannot store dead-lettered message %v: %v", msg.MessageID, err)
+	}
+}
+
+// SendConnectionStatusMessage publishes msg, encoded with the handshake codec,
+// to the handshake destination. The broker must acknowledge the message for it
+// to be considered sent. Publishing a connection status resets the heartbeat
+// timer.
 func (c *Client) SendConnectionStatusMessage(msg *yggdrasil.ConnectionStatus) error {
-	return c.sendMessage(msg, "control")
+	if c.heartbeat != nil {
+		c.heartbeat.reset()
+	}
+
+	var handshake codec = jsonCodec{}
+	if c.handshake != nil {
+		handshake = c.handshake
+	}
+	dest := "control"
+	if c.handshakeDest != "" {
+		dest = c.handshakeDest
+	}
+
+	c.handshakeStep.Store("marshal connection status")
+	data, err := handshake.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("cannot marshal message: %w", err)
+	}
+	c.handshakeStep.Store("publish connection status")
+	return c.sendAcknowledgedData(data, dest)
 }
 
 func (c *Client) SendEventMessage(msg *yggdrasil.Event) error {
 	return c.sendMessage(msg, "control")
 }
 
+// sendAcknowledgedData sends data to dest, waiting for the transport to
+// acknowledge it regardless of the transport's default publish options.
+func (c *Client) sendAcknowledgedData(data []byte, dest string) error {
+	c.idle.wake()
+	t, ok := c.t.(transport.AcknowledgingTransporter)
+	if !ok {
+		return c.t.SendData(data, dest)
+	}
+	return t.SendDataWithOptions(data, dest, c.acknowledgedOptions(false))
+}
+
+// acknowledgedOptions returns the options of a message sent with
+// acknowledgement: the configured QoS, raised to the lowest that is
+// acknowledged if necessary, and retained if retain is true.
+func (c *Client) acknowledgedOptions(retain bool) transport.PublishOptions {
+	return transport.PublishOptions{WaitForAck: true, AckTimeout: c.ackTimeout, Retain: retain, QoS: c.publishQoS}
+}
+
+// spoolMessage stores msg in the spool, to be sent to dest when the spool is
+// next flushed.
+func (c *Client) spoolMessage(msg interface{}, dest string) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("cannot marshal message: %w", err)
+	}
+	return c.spool.put(data, dest)
+}
+
+// FlushSpool sends any spooled messages using the configured transport. The
+// spool is not flushed while the transport is disconnected for being idle.
+func (c *Client) FlushSpool() error {
+	if c.spool == nil || c.idle.isAsleep() {
+		return nil
+	}
+	return c.spool.flush(c.t.SendData)
+}
+
 func (c *Client) sendMessage(msg interface{}, dest string) error {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("cannot marshal message: %w", err)
 	}
+	c.idle.wake()
 	return c.t.SendData(data, dest)
 }
 
-// ReceiveDataMessage sends a value to a channel for dispatching to worker processes.
+// sendLimited sends msg to dest, a data or dead-letter destination, within
+// the rate limit of dest. A message queued for the rate limit is sent later by
+// the rate limiter, which then passes the error sending it to done, and true
+// is returned.
+func (c *Client) sendLimited(msg interface{}, dest string, done func(error)) (queued bool, err error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return false, fmt.Errorf("cannot marshal message: %w", err)
+	}
+	return c.rateLimits.publish(dest, func() error {
+		c.idle.wake()
+		return c.t.SendData(data, dest)
+	}, done)
+}
+
+// ReceiveDataMessage checks that the directive of msg is permitted, runs msg
+// through the inbound transform chain and sends the result to a channel for
+// dispatching to worker processes. A message rejected by a transform or that
+// duplicates a recently received message is dropped; a message whose
+// directive is not permitted is dropped or dead-lettered. A message that fails
+// payload verification, whose referenced content cannot be downloaded, or
+// that is received while the client is draining is not dispatched and a
+// "rejected" receipt is published for it, unless the client withholds the
+// acknowledgment of messages received while draining. A message referencing
+// its content is downloaded and dispatched on a goroutine of its own, so that
+// a slow download does not hold up the messages received after it. If the client
+// tracks in-flight messages, ReceiveDataMessage waits for a free slot before
+// dispatching the message and returns once the message is processed or the
+// processing timeout elapses. A desired state reconciled by a message that is
+// not dispatched is reconciled again when it is next received.
 func (c *Client) ReceiveDataMessage(msg *yggdrasil.Data) error {
-	c.d.sendQ <- *msg
+	metrics.add("messages_received_total", 1)
+	labels := payloadLabels.seriesLabels(msg)
+	payloadLabels.add("payload_messages_received_total", labels, 1)
+	events.emit(event{Type: eventMessageReceived, MessageID: msg.MessageID, Directive: msg.Directive, Worker: msg.Directive})
+	payloadLog.log("received", msg)
+
+	s := tracing.startSpan("receive", msg.Metadata)
+	s.set("message_id", msg.MessageID)
+	s.set("directive", msg.Directive)
+	downloading := false
+	dispatching := false
+	defer func() {
+		if !downloading {
+			s.finish(nil)
+		}
+		if !dispatching {
+			c.desiredState.failed(msg.MessageID)
+		}
+	}()
+
+	if c.isDraining() && !c.processWhileDraining && c.nackWhileDraining {
+		log.Warnf("not acknowledging message %v: shutting down", msg.MessageID)
+		<-c.disconnected
+		return nil
+	}
+	if c.isDraining() && !c.processWhileDraining {
+		log.Warnf("rejecting message %v: shutting down", msg.MessageID)
+		if err := c.SendReceiptMessage(msg, yggdrasil.ReceiptStatusRejected); err != nil {
+			log.Errorf("cannot publish receipt: %v", err)
+		}
+		return nil
+	}
+
+	// Forged messages are dropped before they can reach the duplicate
+	// detection cache.
+	if err := c.verifier.check(msg); err != nil {
+		log.Warnf("rejecting message %v: %v", msg.MessageID, err)
+		if err := c.SendReceiptMessage(msg, yggdrasil.ReceiptStatusRejected); err != nil {
+			log.Errorf("cannot publish receipt: %v", err)
+		}
+		return nil
+	}
+
+	if c.loops != nil {
+		if err := c.loops.check(msg); err != nil {
+			log.Warnf("dropping message %v: %v", msg.MessageID, err)
+			return nil
+		}
+	}
+
+	if c.seen != nil {
+		switch c.seen.duplicate(msg) {
+		case dedupKeyID:
+			log.Warnf("dropping message %v: duplicate", msg.MessageID)
+			return nil
+		case dedupKeyContent:
+			log.Warnf("dropping message %v: duplicate content of a message received within %v", msg.MessageID, c.seen.contentTTL)
+			return nil
+		}
+	}
+
+	if c.directives != nil {
+		if err := c.directives.check(msg.Directive); err != nil {
+			if !c.deadLetterDenied {
+				log.Warnf("dropping message %v: %v", msg.MessageID, err)
+				return nil
+			}
+			log.Warnf("dead-lettering message %v: %v", msg.MessageID, err)
+			if err := c.SendDeadLetterMessage(msg, err); err != nil {
+				log.Errorf("failed to send dead-letter message: %v", err)
+			}
+			return nil
+		}
+	}
 
+	dispatching = true
+	if c.downloads.references(*msg) {
+		downloading = true
+		msg := *msg
+		go func() {
+			defer s.finish(nil)
+			data, err := c.downloads.download(msg)
+			if err != nil {
+				metrics.add("downloads_failed_total", 1)
+				log.Warnf("rejecting message %v: %v", msg.MessageID, err)
+				if err := c.SendReceiptMessage(&msg, yggdrasil.ReceiptStatusRejected); err != nil {
+					log.Errorf("cannot publish receipt: %v", err)
+				}
+				c.desiredState.failed(msg.MessageID)
+				return
+			}
+			c.dispatchReceived(data, labels, s)
+		}()
+		return nil
+	}
+	c.dispatchReceived(*msg, labels, s)
 	return nil
 }
 
+// dispatchReceived runs data, a received message that passed the checks of
+// ReceiveDataMessage, through the inbound transform chain and dispatches it
+// with the payload labels extracted when it was received, within the receive
+// span s.
+func (c *Client) dispatchReceived(data yggdrasil.Data, labels []metricLabel, s *span) {
+	id := data.MessageID
+	if c.inbound != nil {
+		var err error
+		data, err = c.inbound.apply(data)
+		if err != nil {
+			log.Warnf("dropping message %v: %v", data.MessageID, err)
+			c.desiredState.failed(id)
+			return
+		}
+	}
+
+	if err := c.SendReceiptMessage(&data, yggdrasil.ReceiptStatusReceived); err != nil {
+		log.Errorf("cannot publish receipt: %v", err)
+	}
+
+	data.Metadata = s.withTraceparent(data.Metadata)
+	if id := c.sessionID(); id != "" {
+		data.Metadata = copyMetadata(data.Metadata)
+		data.Metadata[yggdrasil.SessionIDMetadataKey] = id
+	}
+	if c.inFlight == nil {
+		c.d.Dispatch(data, labels)
+		return
+	}
+
+	done, ok := c.inFlight.acquire(data.MessageID)
+	if !ok {
+		log.Warnf("rejecting message %v: %v messages in flight", data.MessageID, c.inFlight.limit)
+		metrics.add("in_flight_rejected_total", 1)
+		if err := c.SendReceiptMessage(&data, yggdrasil.ReceiptStatusRejected); err != nil {
+			log.Errorf("cannot publish receipt: %v", err)
+		}
+		c.desiredState.failed(id)
+		return
+	}
+	c.d.Dispatch(data, labels)
+	if !c.inFlight.wait(data.MessageID, done) {
+		log.Warnf("message %v not processed within %v; no longer waiting for it", data.MessageID, c.inFlight.timeout)
+	}
+}
+
+// UndeliverableHandlerFunc marks data as processed if it cannot be delivered
+// to a worker, so that it no longer counts as in flight.
+func (c *Client) UndeliverableHandlerFunc(data yggdrasil.Data) {
+	if c.inFlight != nil {
+		c.inFlight.done(data.MessageID)
+	}
+	c.desiredState.failed(data.MessageID)
+}
+
+// AbandonedHandlerFunc marks the message id as processed if its assignment
+// ends without a result, so that it no longer counts as in flight.
+func (c *Client) AbandonedHandlerFunc(id string) {
+	if c.inFlight != nil {
+		c.inFlight.done(id)
+	}
+	c.desiredState.failed(id)
+}
+
 // ReceiveControlMessage unpacks a control message and acts accordingly.
 func (c *Client) ReceiveControlMessage(msg *yggdrasil.Control) error {
 	switch msg.Type {
@@ -81,8 +823,17 @@ func (c *Client) ReceiveControlMessage(msg *yggdrasil.Control) error {
 			if err := c.t.SendData(data, "control"); err != nil {
 				return fmt.Errorf("cannot send data: %w", err)
 			}
+		case yggdrasil.CommandNameCancel:
+			id := cmd.Content.Arguments["message_id"]
+			if id == "" {
+				return fmt.Errorf("cannot cancel message: missing message_id argument")
+			}
+			if err := c.d.Cancel(id); err != nil {
+				return fmt.Errorf("cannot cancel message: %w", err)
+			}
 		case yggdrasil.CommandNameDisconnect:
 			log.Info("disconnecting...")
+			c.idle.stop()
 			c.t.Disconnect(500)
 		case yggdrasil.CommandNameReconnect:
 			log.Info("reconnecting...")
@@ -106,16 +857,75 @@ func (c *Client) ReceiveControlMessage(msg *yggdrasil.Control) error {
 	return nil
 }
 
+// DataReceiveHandlerFunc routes data received from the transport using the
+// client's router. Transports without topics are taken to receive dest on the
+// topic an MQTT transport would, for the selection of payload transforms.
 func (c *Client) DataReceiveHandlerFunc(data []byte, dest string) {
+	c.TopicReceiveHandlerFunc(data, dest, transport.Topic(topicPrefix.get(), ClientID, dest, "in"))
+}
+
+// TopicReceiveHandlerFunc routes data received from the transport on topic
+// using the client's router.
+func (c *Client) TopicReceiveHandlerFunc(data []byte, dest string, topic string) {
+	c.idle.touch()
+	if c.router != nil {
+		c.router.Route(data, dest)
+		return
+	}
+	r := messageRouter{p: c, unparseable: c.UnparseableHandlerFunc, transforms: c.payloadTransforms, topic: topic}
+	if c.desiredState != nil {
+		r.desiredStateDest = c.desiredState.dest
+		r.desiredState = c.ReceiveDesiredStateMessage
+	}
+	r.Route(data, dest)
+}
+
+// messageRouter is a Router that decodes data and control messages and passes
+// them to a Processor. Payloads are first passed through the payload
+// transforms of topic, the topic they were received on, if any. Payloads that
+// cannot be transformed or decoded are passed to unparseable, if set, and
+// otherwise logged. If desiredStateDest is set, desired-state messages
+// received from it are passed to desiredState.
+type messageRouter struct {
+	p           Processor
+	unparseable func(payload []byte, dest string, err error)
+	transforms  payloadTransformer
+	topic       string
+
+	desiredStateDest string
+	desiredState     func(msg *yggdrasil.DesiredState) error
+}
+
+func (r messageRouter) Route(data []byte, dest string) {
+	payload, err := r.transforms.apply(data, r.topic)
+	if err != nil {
+		r.malformed(data, dest, err)
+		return
+	}
+	data = payload
+
+	if r.desiredStateDest != "" && dest == r.desiredStateDest {
+		var message yggdrasil.DesiredState
+
+		if err := json.Unmarshal(data, &message); err != nil {
+			r.malformed(data, dest, err)
+			return
+		}
+		if err := r.desiredState(&message); err != nil {
+			log.Errorf("cannot process desired-state message: %v", err)
+		}
+		return
+	}
+
 	switch dest {
 	case "data":
 		var message yggdrasil.Data
 
 		if err := json.Unmarshal(data, &message); err != nil {
-			log.Errorf("cannot unmarshal data message: %v", err)
+			r.malformed(data, dest, err)
 			return
 		}
-		if err := c.ReceiveDataMessage(&message); err != nil {
+		if err := r.p.ReceiveDataMessage(&message); err != nil {
 			log.Errorf("cannot process data message: %v", err)
 			return
 		}
@@ -123,10 +933,10 @@ func (c *Client) DataReceiveHandlerFunc(data []byte, dest string) {
 		var message yggdrasil.Control
 
 		if err := json.Unmarshal(data, &message); err != nil {
-			log.Errorf("cannot unmarshal control message: %v", err)
+			r.malformed(data, dest, err)
 			return
 		}
-		if err := c.ReceiveControlMessage(&message); err != nil {
+		if err := r.p.ReceiveControlMessage(&message); err != nil {
 			log.Errorf("cannot process control message: %v", err)
 			return
 		}
@@ -136,22 +946,256 @@ func (c *Client) DataReceiveHandlerFunc(data []byte, dest string) {
 	}
 }
 
-// ReceiveData receives values from workers via a dispatch receive queue and
-// sends them using the configured transport.
+func (r messageRouter) malformed(data []byte, dest string, err error) {
+	if r.unparseable == nil {
+		log.Errorf("cannot unmarshal %v message: %v", dest, err)
+		return
+	}
+	r.unparseable(data, dest, err)
+}
+
+// ReceiveData receives values from workers via a dispatch receive queue, runs
+// them through the outbound transform chain and sends them using the
+// configured transport. Messages that cannot be sent are spooled, if a spool
+// is configured. Once a response has been handled, the message it responds to
+// is marked as processed and, if it reconciled a desired state, the state's
+// version is marked as applied. If the client has a publish pool, the values
+// are published by the pool, and ReceiveData waits for the values queued to
+// it to be published once the queue is closed. If the client has a result
+// queue, the values pass through it, and each is acknowledged to it once it
+// has been handled. ReceiveData also waits for the uploads of large values
+// to finish.
 func (c *Client) ReceiveData() {
-	for msg := range c.d.recvQ {
-		if err := c.SendDataMessage(&msg); err != nil {
-			log.Errorf("failed to send data message: %v", err)
+	defer c.uploads.wait()
+	if c.resultQueue != nil {
+		go func() {
+			for msg := range c.d.Results() {
+				if err := c.resultQueue.Enqueue(queuedData{data: msg}); err != nil {
+					log.Errorf("cannot queue data message %v, publishing it unqueued: %v", msg.MessageID, err)
+					c.handleResult(msg)
+				}
+			}
+			c.resultQueue.Close()
+		}()
+		publish := c.handleResult
+		if c.publishers != nil {
+			publish = c.publishers.submit
+		}
+		for {
+			q, ok := c.resultQueue.Dequeue()
+			if !ok {
+				break
+			}
+			publish(q.data)
+		}
+		if c.publishers != nil {
+			c.publishers.close()
+		}
+		return
+	}
+	if c.publishers != nil {
+		for msg := range c.d.Results() {
+			c.publishers.submit(msg)
+		}
+		c.publishers.close()
+		return
+	}
+	for msg := range c.d.Results() {
+		c.handleResult(msg)
+	}
+}
+
+// handleResult publishes the result msg and, once it is published or given up
+// on, marks the message it responds to as handled. A result queued for the
+// rate limit is handled once the rate limiter sends it. Only a successful
+// result, as reported by appliesDesiredState, applies a desired state. The
+// result of a message injected through the control socket is logged instead.
+func (c *Client) handleResult(msg yggdrasil.Data) {
+	id, responseTo := msg.MessageID, msg.ResponseTo
+	start := time.Now()
+	done := func() {
+		metrics.observe("publish_duration_seconds", time.Since(start).Seconds())
+		if c.resultQueue != nil {
+			if err := c.resultQueue.Ack(id); err != nil {
+				log.Errorf("cannot acknowledge queued data message %v: %v", id, err)
+			}
+		}
+		if c.inFlight != nil && responseTo != "" {
+			c.inFlight.done(responseTo)
+		}
+		if appliesDesiredState(msg) {
+			c.desiredState.applied(responseTo)
+		} else {
+			c.desiredState.failed(responseTo)
+		}
+	}
+	if c.injected.contains(responseTo) {
+		log.Infof("not publishing result %v of injected message %v: %s", id, responseTo, msg.Content)
+		done()
+		return
+	}
+	c.publishResult(msg, done)
+}
+
+// publishResult runs msg through the outbound transform chain and sends it
+// using the configured transport, spooling it if it cannot be sent. Content
+// larger than the upload threshold is uploaded first, if configured, on a
+// goroutine of its own, so that an upload and its retries do not hold up the
+// results published after it. done, if set, is called once msg is published
+// or given up on, which for an uploaded result or one queued for the rate
+// limit is after publishResult returns.
+func (c *Client) publishResult(msg yggdrasil.Data, done func()) {
+	s := tracing.startSpan("publish", tracing.responseMetadata(msg))
+	s.set("message_id", msg.MessageID)
+	s.set("response_to", msg.ResponseTo)
+	msg.Metadata = s.withTraceparent(msg.Metadata)
+	finish := func(failure error) {
+		s.finish(failure)
+		if done != nil {
+			done()
+		}
+	}
+
+	msg = c.enricher.apply(msg)
+	if c.outbound != nil {
+		data, err := c.outbound.apply(msg)
+		if err != nil {
+			defer finish(err)
+			if !c.deadLetterRejected {
+				log.Warnf("dropping message %v: %v", msg.MessageID, err)
+				return
+			}
+			log.Warnf("dead-lettering message %v: %v", msg.MessageID, err)
+			if err := c.SendDeadLetterMessage(&msg, err); err != nil {
+				log.Errorf("failed to send dead-letter message: %v", err)
+			}
+			return
 		}
+		msg = data
+	}
+	if c.loops != nil {
+		c.loops.stamp(&msg)
+	}
+	if c.uploads.exceeds(msg) {
+		c.uploads.run(func() { c.uploadResult(msg, finish) })
+		return
+	}
+	c.sendResult(msg, finish)
+}
+
+// uploadResult uploads the content of the result msg, retrying as configured,
+// and sends msg with a reference to the uploaded content in its place. If the
+// upload fails, msg is handled under the upload failure action.
+func (c *Client) uploadResult(msg yggdrasil.Data, finish func(error)) {
+	uploaded, err := c.uploads.upload(msg)
+	if err == nil {
+		c.sendResult(uploaded, finish)
+		return
+	}
+	switch c.uploads.failureAction {
+	case uploadFailureDeadLetter:
+		log.Warnf("dead-lettering message %v: %v", msg.MessageID, err)
+		if err := c.SendOversizedDeadLetterMessage(&msg, err); err != nil {
+			log.Errorf("failed to send dead-letter message: %v", err)
+		}
+		finish(err)
+	case uploadFailureDrop:
+		log.Warnf("dropping message %v: %v", msg.MessageID, err)
+		finish(err)
+	default:
+		log.Warnf("publishing content of message %v inline: %v", msg.MessageID, err)
+		c.sendResult(msg, func(failure error) {
+			if failure == nil {
+				failure = err
+			}
+			finish(failure)
+		})
+	}
+}
+
+// sendResult signs the result msg and sends it using the configured
+// transport, spooling it if it cannot be sent. finish is called with the
+// error, if any, once msg is published or given up on, which for a result
+// queued for the rate limit is after sendResult returns.
+func (c *Client) sendResult(msg yggdrasil.Data, finish func(error)) {
+	if err := c.signer.sign(&msg); err != nil {
+		log.Errorf("dropping message %v: %v", msg.MessageID, err)
+		finish(err)
+		return
+	}
+	// A result queued for the rate limit is published, or fails, later.
+	queued, err := c.sendLimited(&msg, "data", func(err error) {
+		if err != nil {
+			c.publishFailed(msg, err)
+		} else {
+			metrics.add("messages_published_total", 1)
+		}
+		finish(nil)
+	})
+	if err != nil {
+		c.publishFailed(msg, err)
+		finish(err)
+		return
+	}
+	if !queued {
+		metrics.add("messages_published_total", 1)
+		finish(nil)
+	}
+}
+
+// publishFailed handles the result msg that could not be published for err:
+// an oversized result is uploaded or dead-lettered, one dropped for the rate
+// limit is logged, and any other is spooled, if there is a spool.
+func (c *Client) publishFailed(msg yggdrasil.Data, err error) {
+	if errors.Is(err, transport.ErrMessageTooLarge) {
+		c.publishOversized(msg, err)
+		return
+	}
+	if errors.Is(err, errPublishRateLimited) {
+		log.Warnf("dropping data message %v: %v", msg.MessageID, err)
+		return
+	}
+	if c.spool == nil {
+		log.Errorf("failed to send data message: %v", err)
+		return
+	}
+	log.Warnf("spooling data message %v: %v", msg.MessageID, err)
+	// A full disk is logged once by the spool rather than for each message it
+	// drops.
+	if err := c.spoolMessage(&msg, "data"); err != nil && !isDiskFull(err) {
+		log.Errorf("cannot spool data message: %v", err)
 	}
 }
 
 // ConnectionStatus creates a connection-status message using the current state
-// of the client.
+// of the client, including the number of seconds since the transport last
+// connected. If some canonical facts cannot be collected, the message holds
+// those that could be, with the failures listed in their errors field.
 func (c *Client) ConnectionStatus() (*yggdrasil.ConnectionStatus, error) {
-	facts, err := yggdrasil.GetCanonicalFacts()
+	var facts *yggdrasil.CanonicalFacts
+	var err error
+	if c.facts != nil {
+		facts, err = c.facts.get()
+	} else {
+		facts, err = yggdrasil.GetCanonicalFacts()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("cannot get canonical facts: %w", err)
+		if facts == nil {
+			return nil, fmt.Errorf("cannot get canonical facts: %w", err)
+		}
+		log.Warnf("publishing partial canonical facts: %v", err)
+	}
+
+	if workerFacts := c.d.WorkerFacts(); len(workerFacts) > 0 {
+		merged := *facts
+		merged.WorkerFacts = workerFacts
+		facts = &merged
+	}
+	c.enricher.resolve(facts)
+
+	var uptime int64
+	if connectedAt, ok := c.connectedAt.Load().(time.Time); ok {
+		uptime = int64(time.Since(connectedAt).Seconds())
 	}
 
 	tagsFilePath := filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "tags.toml")
@@ -175,11 +1219,17 @@ func (c *Client) ConnectionStatus() (*yggdrasil.ConnectionStatus, error) {
 			Dispatchers    map[string]map[string]string "json:\"dispatchers\""
 			State          yggdrasil.ConnectionState    "json:\"state\""
 			Tags           map[string]string            "json:\"tags,omitempty\""
+			Uptime         int64                        "json:\"uptime,omitempty\""
+			SessionID      string                       "json:\"session_id,omitempty\""
+			Degraded       []string                     "json:\"degraded,omitempty\""
 		}{
 			CanonicalFacts: *facts,
-			Dispatchers:    c.d.makeDispatchersMap(),
+			Dispatchers:    c.d.Dispatchers(),
 			State:          yggdrasil.ConnectionStateOnline,
 			Tags:           tagMap,
+			Uptime:         uptime,
+			SessionID:      c.sessionID(),
+			Degraded:       workerRestarts.degraded(),
 		},
 	}
 
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+func TestReceiveDataMessageWhileDraining(t *testing.T) {
+	tests := []struct {
+		description          string
+		processWhileDraining bool
+		nackWhileDraining    bool
+		wantDispatched       bool
+		wantStatus           yggdrasil.ReceiptStatus
+	}{
+		{
+			description: "reject",
+			wantStatus:  yggdrasil.ReceiptStatusRejected,
+		},
+		{
+			description:       "nack",
+			nackWhileDraining: true,
+		},
+		{
+			description:          "process after processing",
+			processWhileDraining: true,
+			nackWhileDraining:    true,
+			wantDispatched:       true,
+			wantStatus:           yggdrasil.ReceiptStatusReceived,
+		},
+		{
+			description:          "process",
+			processWhileDraining: true,
+			wantDispatched:       true,
+			wantStatus:           yggdrasil.ReceiptStatusReceived,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tr := &recordingTransport{}
+			d := newDispatcher(nil)
+			d.queue = &bufferedQueue{}
+			c := Client{
+				t:                    tr,
+				d:                    d,
+				receipts:             map[string]string{receiptWildcard: "status"},
+				processWhileDraining: test.processWhileDraining,
+				nackWhileDraining:    test.nackWhileDraining,
+			}
+			c.Drain()
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- c.ReceiveDataMessage(&yggdrasil.Data{MessageID: "1234", Directive: "echo"})
+			}()
+			if !test.processWhileDraining && test.nackWhileDraining {
+				// The message must be held until the transport has
+				// disconnected, so that it is not acknowledged.
+				select {
+				case <-errs:
+					t.Fatal("message released before the transport disconnected")
+				default:
+				}
+				c.Disconnected()
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+
+			if got := d.queue.Len() == 1; got != test.wantDispatched {
+				t.Errorf("dispatched: %v != %v", got, test.wantDispatched)
+			}
+
+			if test.wantStatus == "" {
+				if len(tr.sent["status"]) != 0 {
+					t.Errorf("expected no receipt, got %v", tr.sent)
+				}
+				return
+			}
+			if len(tr.sent["status"]) != 1 {
+				t.Fatalf("expected 1 receipt, got %v", tr.sent)
+			}
+			var receipt yggdrasil.Receipt
+			if err := json.Unmarshal(tr.sent["status"][0], &receipt); err != nil {
+				t.Fatal(err)
+			}
+			if receipt.Content.Status != test.wantStatus {
+				t.Errorf("%v != %v", receipt.Content.Status, test.wantStatus)
+			}
+		})
+	}
+}
+
+// recordingProcessor is a Processor that records the messages it receives.
+type recordingProcessor struct {
+	data    []*yggdrasil.Data
+	control []*yggdrasil.Control
+}
+
+func (p *recordingProcessor) ReceiveDataMessage(msg *yggdrasil.Data) error {
+	p.data = append(p.data, msg)
+	return nil
+}
+
+func (p *recordingProcessor) ReceiveControlMessage(msg *yggdrasil.Control) error {
+	p.control = append(p.control, msg)
+	return nil
+}
+
+func TestMessageRouter(t *testing.T) {
+	p := &recordingProcessor{}
+	r := messageRouter{p: p}
+
+	r.Route([]byte(`{"type":"data","message_id":"1234","directive":"echo"}`), "data")
+	r.Route([]byte(`{"type":"command","message_id":"5678"}`), "control")
+	r.Route([]byte(`not json`), "data")
+	r.Route([]byte(`{}`), "unknown")
+
+	if len(p.data) != 1 || p.data[0].MessageID != "1234" {
+		t.Errorf("unexpected data messages: %+v", p.data)
+	}
+	if len(p.control) != 1 || p.control[0].MessageID != "5678" {
+		t.Errorf("unexpected control messages: %+v", p.control)
+	}
+}
+
+func TestConnectWarmUp(t *testing.T) {
+	tr := &recordingTransport{}
+	var slept time.Duration
+	var sentBefore int
+	c := Client{
+		t:        tr,
+		presence: &presence{dest: "presence", online: []byte("online")},
+		warmUp:   2 * time.Second,
+		sleep: func(d time.Duration) {
+			slept = d
+			sentBefore = len(tr.sent)
+		},
+	}
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if slept != 2*time.Second {
+		t.Errorf("slept %v, want 2s", slept)
+	}
+	if sentBefore != 0 || len(tr.sent["presence"]) != 1 {
+		t.Errorf("expected online presence to be published after the warm-up, sent %v before", sentBefore)
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	d := newDispatcher(nil)
+	d.queue = &bufferedQueue{}
+	c := Client{
+		t: &recordingTransport{},
+		d: d,
+		facts: &factsCache{collect: func() (*yggdrasil.CanonicalFacts, error) {
+			return &yggdrasil.CanonicalFacts{}, nil
+		}},
+	}
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	session := c.sessionID()
+	if session == "" {
+		t.Fatal("expected a session ID after connecting")
+	}
+	msg, err := c.ConnectionStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content.SessionID != session {
+		t.Errorf("connection status has session %q, want %q", msg.Content.SessionID, session)
+	}
+	if err := c.ReceiveDataMessage(&yggdrasil.Data{MessageID: "1", Directive: "echo"}); err != nil {
+		t.Fatal(err)
+	}
+	if q, _ := d.queue.Dequeue(); q.data.Metadata[yggdrasil.SessionIDMetadataKey] != session {
+		t.Errorf("dispatched message has metadata %v, want session %v", q.data.Metadata, session)
+	}
+
+	c.ReconnectHandlerFunc()
+	if c.sessionID() == session {
+		t.Errorf("expected the session ID to change on reconnect")
+	}
+}
+
+func TestSendAcknowledgedData(t *testing.T) {
+	tests := []struct {
+		description   string
+		acknowledging bool
+		ackTimeout    time.Duration
+		wantOptions   transport.PublishOptions
+	}{
+		{
+			description:   "timeout",
+			acknowledging: true,
+			ackTimeout:    5 * time.Second,
+			wantOptions:   transport.PublishOptions{WaitForAck: true, AckTimeout: 5 * time.Second, QoS: 1},
+		},
+		{
+			description:   "no timeout",
+			acknowledging: true,
+			wantOptions:   transport.PublishOptions{WaitForAck: true, QoS: 1},
+		},
+		{
+			description: "transport without acknowledgements",
+			ackTimeout:  5 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tr := &recordingTransport{}
+			c := Client{t: struct{ transport.Transporter }{tr}, ackTimeout: test.ackTimeout, publishQoS: 1}
+			if test.acknowledging {
+				c.t = tr
+			}
+
+			if err := c.sendAcknowledgedData([]byte("{}"), "control"); err != nil {
+				t.Fatal(err)
+			}
+			if len(tr.sent["control"]) != 1 {
+				t.Fatalf("expected 1 message, got %v", tr.sent)
+			}
+			if tr.options != test.wantOptions {
+				t.Errorf("%+v != %+v", tr.options, test.wantOptions)
+			}
+		})
+	}
+}
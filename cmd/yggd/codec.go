@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A codec encodes messages for publishing.
+type codec interface {
+	Marshal(v interface{}) ([]byte, error)
+}
+
+// newCodec returns the codec with the given name: "json" or "cbor".
+func newCodec(name string) (codec, error) {
+	switch name {
+	case "json":
+		return jsonCodec{}, nil
+	case "cbor":
+		return cborCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %v", name)
+	}
+}
+
+// jsonCodec encodes messages as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// cborCodec encodes messages as CBOR (RFC 8949). A message is encoded with the
+// same structure, field names and values as its JSON encoding, with map keys
+// in the order required for deterministic encoding (RFC 8949, section 4.2.1).
+type cborCodec struct{}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := encodeCBOR(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The CBOR major types.
+const (
+	cborUnsigned byte = 0 << 5
+	cborNegative byte = 1 << 5
+	cborText     byte = 3 << 5
+	cborArray    byte = 4 << 5
+	cborMap      byte = 5 << 5
+	cborSimple   byte = 7 << 5
+)
+
+// encodeCBOR writes the CBOR encoding of v, a value decoded from JSON, to buf.
+func encodeCBOR(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(cborSimple | 22)
+	case bool:
+		if v {
+			buf.WriteByte(cborSimple | 21)
+		} else {
+			buf.WriteByte(cborSimple | 20)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			if i < 0 {
+				writeCBORHead(buf, cborNegative, uint64(-(i + 1)))
+			} else {
+				writeCBORHead(buf, cborUnsigned, uint64(i))
+			}
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("cannot encode number %v: %w", v, err)
+		}
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(f))
+		buf.WriteByte(cborSimple | 27)
+		buf.Write(b[:])
+	case string:
+		writeCBORHead(buf, cborText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		writeCBORHead(buf, cborArray, uint64(len(v)))
+		for _, e := range v {
+			if err := encodeCBOR(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		// Shorter keys have shorter heads, so sorting the encoded keys
+		// bytewise sorts by length first.
+		sort.Slice(keys, func(i, j int) bool {
+			if len(keys[i]) != len(keys[j]) {
+				return len(keys[i]) < len(keys[j])
+			}
+			return keys[i] < keys[j]
+		})
+
+		writeCBORHead(buf, cborMap, uint64(len(v)))
+		for _, k := range keys {
+			writeCBORHead(buf, cborText, uint64(len(k)))
+			buf.WriteString(k)
+			if err := encodeCBOR(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot encode value of type %T", v)
+	}
+	return nil
+}
+
+// writeCBORHead writes the initial bytes of a data item of the given major
+// type, using the shortest form that holds n.
+func writeCBORHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		var b [2]byte
+		binary.BigEndian.PutUint16(b[:], uint16(n))
+		buf.WriteByte(major | 25)
+		buf.Write(b[:])
+	case n <= math.MaxUint32:
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(n))
+		buf.WriteByte(major | 26)
+		buf.Write(b[:])
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		buf.WriteByte(major | 27)
+		buf.Write(b[:])
+	}
+}
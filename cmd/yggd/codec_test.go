@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestCBORCodec(t *testing.T) {
+	tests := []struct {
+		description string
+		input       interface{}
+		want        string
+	}{
+		{description: "zero", input: 0, want: "00"},
+		{description: "one byte uint", input: 24, want: "1818"},
+		{description: "two byte uint", input: 1000, want: "1903e8"},
+		{description: "negative", input: -1, want: "20"},
+		{description: "large negative", input: -1000, want: "3903e7"},
+		{description: "float", input: 1.5, want: "fb3ff8000000000000"},
+		{description: "string", input: "a", want: "6161"},
+		{description: "true", input: true, want: "f5"},
+		{description: "null", input: nil, want: "f6"},
+		{description: "array", input: []int{1, 2, 3}, want: "83010203"},
+		{
+			description: "map",
+			input:       map[string]interface{}{"b": []int{2, 3}, "a": 1},
+			want:        "a26161016162820203",
+		},
+		{
+			description: "map keys sorted by length first",
+			input:       map[string]int{"aa": 1, "b": 2},
+			want:        "a261620262616101",
+		},
+		{
+			description: "struct",
+			input: struct {
+				Type  string `json:"type"`
+				Count int    `json:"count,omitempty"`
+			}{Type: "x"},
+			want: "a164747970656178",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := cborCodec{}.Marshal(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(got) != test.want {
+				t.Errorf("%x != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewCodec(t *testing.T) {
+	for _, name := range []string{"json", "cbor"} {
+		if _, err := newCodec(name); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+	if _, err := newCodec("xml"); err == nil {
+		t.Error("expected error for unsupported encoding")
+	}
+}
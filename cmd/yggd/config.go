@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pelletier/go-toml"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// gzipMagic is the header that begins every gzip-compressed file.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readConfigFile reads the config file at path, decompressing it if it is
+// gzip-compressed. Compression is detected from the file contents rather than
+// its name, so both "config.toml" and "config.toml.gz" may hold either form.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress config file: %w", err)
+	}
+	defer r.Close()
+
+	data, err = ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress config file: %w", err)
+	}
+	return data, nil
+}
+
+// newConfigInputSource creates an altsrc input source from the TOML config
+// file at path, which may be gzip-compressed. altsrc can only read TOML from a
+// file, so a compressed config is decompressed to a temporary file first; an
+// uncompressed config is read directly. The config is parsed first, so that
+// invalid TOML is reported with its position. If the file does not exist, the
+// error returned wraps os.ErrNotExist.
+func newConfigInputSource(path string) (altsrc.InputSourceContext, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := toml.LoadBytes(data); err != nil {
+		return nil, fmt.Errorf("cannot parse config file '%v': %w", path, err)
+	}
+
+	compressed, err := isGzipFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		return altsrc.NewTomlSourceFromFile(path)
+	}
+
+	f, err := ioutil.TempFile("", "yggd-config-*.toml")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot write to file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("cannot close file: %w", err)
+	}
+
+	return altsrc.NewTomlSourceFromFile(f.Name())
+}
+
+// isGzipFile returns true if the file at path begins with the gzip header.
+func isGzipFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("cannot open '%v' for reading: %w", path, err)
+	}
+	defer f.Close()
+
+	header := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, fmt.Errorf("cannot read file: %w", err)
+	}
+	return bytes.Equal(header[:n], gzipMagic), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/pelletier/go-toml"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+)
+
+// redacted replaces the secrets in the values of a config dump.
+const redacted = "REDACTED"
+
+// effectiveConfig returns the values of the flags that can be set in the
+// config file, as c resolved them from the command line, the config file and
+// the defaults, keyed by flag name. Durations are formatted as strings, as
+// they are written in the config file. Secrets embedded in URLs are redacted.
+func effectiveConfig(c *cli.Context, flags []cli.Flag) map[string]interface{} {
+	values := make(map[string]interface{}, len(flags))
+	for _, flag := range flags {
+		name := flag.Names()[0]
+		switch flag.(type) {
+		case *altsrc.BoolFlag:
+			values[name] = c.Bool(name)
+		case *altsrc.DurationFlag:
+			values[name] = c.Duration(name).String()
+		case *altsrc.Float64Flag:
+			values[name] = c.Float64(name)
+		case *altsrc.IntFlag:
+			values[name] = int64(c.Int(name))
+		case *altsrc.StringFlag:
+			values[name] = redactURL(c.String(name))
+		case *altsrc.StringSliceFlag:
+			slice := []interface{}{}
+			for _, v := range c.StringSlice(name) {
+				slice = append(slice, redactURL(v))
+			}
+			values[name] = slice
+		}
+	}
+	return values
+}
+
+// redactURL returns value with the password and the query parameter values
+// redacted, if it is a URL that has either. Any other value is returned
+// unchanged.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return value
+	}
+
+	changed := false
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			changed = true
+		}
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{redacted}
+		}
+		u.RawQuery = query.Encode()
+		changed = true
+	}
+	if !changed {
+		return value
+	}
+	return u.String()
+}
+
+// dumpConfig returns the effective configuration as a TOML document that can
+// be used as a config file. If sources is not nil, each value is preceded by
+// a comment naming the source it came from.
+func dumpConfig(c *cli.Context, flags []cli.Flag, sources map[string]string) (string, error) {
+	tree, err := toml.TreeFromMap(effectiveConfig(c, flags))
+	if err != nil {
+		return "", fmt.Errorf("cannot encode config: %w", err)
+	}
+	for name, source := range sources {
+		if tree.Has(name) {
+			tree.SetWithComment(name, "source: "+source, false, tree.Get(name))
+		}
+	}
+	data, err := tree.ToTomlString()
+	if err != nil {
+		return "", fmt.Errorf("cannot encode config: %w", err)
+	}
+	return "# Effective configuration; secrets are redacted.\n" + data, nil
+}
+
+// handleConfig returns the effective configuration of the daemon, with the
+// source of each value if the "sources" argument is "true".
+func handleConfig(c *cli.Context, flags []cli.Flag) func(args map[string]string) (interface{}, error) {
+	return func(args map[string]string) (interface{}, error) {
+		var sources map[string]string
+		if args["sources"] == "true" {
+			sources = configSources
+		}
+		return dumpConfig(c, flags, sources)
+	}
+}
+
+// rootApp returns the app the command line of c was parsed by. Commands with
+// subcommands run as an app of their own, with only their own flags.
+func rootApp(c *cli.Context) *cli.App {
+	app := c.App
+	for _, ctx := range c.Lineage() {
+		if ctx.App != nil {
+			app = ctx.App
+		}
+	}
+	return app
+}
+
+// configDumpAction prints the effective configuration, or that of the running
+// daemon if the "running" flag is set. If the "sources" flag is set, the
+// source of each value is printed along with it.
+func configDumpAction(c *cli.Context) error {
+	if !c.Bool("running") {
+		var sources map[string]string
+		if c.Bool("sources") {
+			sources = configSources
+		}
+		data, err := dumpConfig(c, rootApp(c).Flags, sources)
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		fmt.Fprint(c.App.Writer, data)
+		return nil
+	}
+
+	var args map[string]string
+	if c.Bool("sources") {
+		args = map[string]string{"sources": "true"}
+	}
+	result, err := callControl(c.String("control-socket-addr"), "config", args)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	var data string
+	if err := json.Unmarshal(result, &data); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+	fmt.Fprint(c.App.Writer, data)
+	return nil
+}
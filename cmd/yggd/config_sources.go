@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/urfave/cli/v2"
+)
+
+// The sources a flag value can come from, in increasing order of precedence.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// configSources holds the source each flag value of the daemon came from,
+// keyed by flag name. It is recorded before the command runs.
+var configSources map[string]string
+
+// flagSources returns the source of each of flags in c, as resolved from the
+// command line, the environment and the defaults: a flag given on the command
+// line is visited by its flag set, while one set from an environment variable
+// is only marked as set. It is called before the config file is applied,
+// because applying it sets the flags it contains as if given on the command
+// line.
+func flagSources(c *cli.Context, flags []cli.Flag) map[string]string {
+	visited := make(map[string]bool)
+	for _, name := range c.LocalFlagNames() {
+		visited[name] = true
+	}
+
+	sources := make(map[string]string, len(flags))
+	for _, flag := range flags {
+		name := flag.Names()[0]
+		sources[name] = sourceDefault
+		for _, alias := range flag.Names() {
+			if visited[alias] {
+				sources[name] = sourceFlag
+			}
+		}
+		if sources[name] == sourceDefault && c.IsSet(name) {
+			sources[name] = sourceEnv
+		}
+	}
+	return sources
+}
+
+// markFileSources marks the flags in sources that still have their default
+// value as set from the config file, if c has since set them.
+func markFileSources(c *cli.Context, sources map[string]string) {
+	visited := make(map[string]bool)
+	for _, name := range c.LocalFlagNames() {
+		visited[name] = true
+	}
+	for name, source := range sources {
+		if source == sourceDefault && visited[name] {
+			sources[name] = sourceFile
+		}
+	}
+}
+
+// logConfigSources logs the effective value of each of flags that can be set
+// in the config file, along with the source it came from.
+func logConfigSources(c *cli.Context, flags []cli.Flag, sources map[string]string) {
+	values := effectiveConfig(c, flags)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Infof("config %v = %v (from %v)", name, values[name], sources[name])
+	}
+}
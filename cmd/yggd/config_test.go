@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewConfigInputSource(t *testing.T) {
+	const config = `server = "tcp://localhost:1883"`
+
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write([]byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		name        string
+		contents    []byte
+	}{
+		{
+			description: "plaintext",
+			name:        "config.toml",
+			contents:    []byte(config),
+		},
+		{
+			description: "gzip",
+			name:        "config.toml.gz",
+			contents:    compressed.Bytes(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, test.name)
+			if err := ioutil.WriteFile(path, test.contents, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			source, err := newConfigInputSource(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := source.String("server")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != "tcp://localhost:1883" {
+				t.Errorf("%v != %v", got, "tcp://localhost:1883")
+			}
+		})
+	}
+}
+
+func TestNewConfigInputSourceErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := newConfigInputSource(filepath.Join(dir, "missing.toml")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a missing file error, got %v", err)
+	}
+
+	path := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(path, []byte("server = \"tcp://localhost:1883\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = newConfigInputSource(path)
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a parse error, got %v", err)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultControlSocketAddr is the path of the unix socket on which the
+// daemon listens for control commands.
+var defaultControlSocketAddr = filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "control.sock")
+
+// controlRejectTimeout bounds the time spent telling a client its connection
+// is rejected.
+const controlRejectTimeout = time.Second
+
+// controlProtocolVersion is the version of the control protocol spoken by
+// this build. It is incremented when the protocol changes in a way a client
+// may need to know of, such as the arguments or results of a command.
+// Adding a command does not change it: a client finds the commands of a
+// daemon from its "unsupported-command" errors or its "control-protocol"
+// command.
+const controlProtocolVersion = 1
+
+// controlCodeUnsupportedCommand is the code of the error returned for a
+// command the daemon does not support.
+const controlCodeUnsupportedCommand = "unsupported-command"
+
+// A controlRequest is sent by a client over the control socket to invoke a
+// command on the running daemon. Version is the control protocol version of
+// the client, or 0 for a client that predates versioning.
+type controlRequest struct {
+	Command   string            `json:"command"`
+	Arguments map[string]string `json:"arguments,omitempty"`
+	Version   int               `json:"version,omitempty"`
+}
+
+// A controlResponse is returned to the client in reply to a controlRequest.
+// Exactly one of Result or Error is set. An error may carry a Code that
+// identifies it; an "unsupported-command" error also carries the control
+// protocol Version of the daemon and the Commands it supports.
+type controlResponse struct {
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Code     string          `json:"code,omitempty"`
+	Version  int             `json:"version,omitempty"`
+	Commands []string        `json:"commands,omitempty"`
+}
+
+// err returns the error of r, for the request of command, or nil if r holds no
+// error. An "unsupported-command" error, or the plain "unknown command" error
+// of a daemon that predates versioning, is returned as an
+// *unsupportedCommandError.
+func (r *controlResponse) err(command string) error {
+	switch {
+	case r.Error == "":
+		return nil
+	case r.Code == controlCodeUnsupportedCommand:
+		return &unsupportedCommandError{command: command, version: r.Version, commands: r.Commands}
+	case r.Code == "" && r.Error == "unknown command: "+command:
+		return &unsupportedCommandError{command: command}
+	default:
+		return errors.New(r.Error)
+	}
+}
+
+// An unsupportedCommandError is returned by callControl and streamControl if
+// the daemon does not support the command. version is the control protocol
+// version of the daemon, and commands the commands it supports; both are
+// unknown (0 and nil) for a daemon that predates versioning.
+type unsupportedCommandError struct {
+	command  string
+	version  int
+	commands []string
+}
+
+func (e *unsupportedCommandError) Error() string {
+	if e.version == 0 {
+		return fmt.Sprintf("unsupported command: %v: the running daemon predates control protocol version %v", e.command, controlProtocolVersion)
+	}
+	return fmt.Sprintf("unsupported command: %v: the running daemon speaks control protocol version %v and supports: %v", e.command, e.version, strings.Join(e.commands, ", "))
+}
+
+// A controlProtocol describes the control protocol spoken by the daemon.
+type controlProtocol struct {
+	Version  int      `json:"version"`
+	Commands []string `json:"commands"`
+}
+
+// A controlHandlerFunc handles a single control command, returning a value
+// that is encoded as JSON in the response Result.
+type controlHandlerFunc func(args map[string]string) (interface{}, error)
+
+// A controlStreamFunc handles a control command whose response is a stream of
+// results. It passes each result to send, which encodes it as JSON in the
+// Result of a response, until done is closed when the client disconnects.
+type controlStreamFunc func(args map[string]string, send func(v interface{}) error, done <-chan struct{}) error
+
+// controlServer accepts connections on a unix socket and invokes the handler
+// registered for each request's command.
+//
+// If maxConns is greater than zero, connections beyond that many open at once
+// are rejected with an error response. If idleTimeout is greater than zero, a
+// connection is closed once its client has not sent its request, or not read
+// a response, for that long.
+type controlServer struct {
+	sync.RWMutex
+	handlers    map[string]controlHandlerFunc
+	streams     map[string]controlStreamFunc
+	listener    net.Listener
+	maxConns    int
+	idleTimeout time.Duration
+	conns       int
+}
+
+func newControlServer() *controlServer {
+	s := &controlServer{
+		handlers: make(map[string]controlHandlerFunc),
+		streams:  make(map[string]controlStreamFunc),
+	}
+	s.handlers["control-protocol"] = s.handleProtocol
+	return s
+}
+
+// commands returns the commands with a handler or stream handler, sorted.
+func (s *controlServer) commands() []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	commands := make([]string, 0, len(s.handlers)+len(s.streams))
+	for command := range s.handlers {
+		commands = append(commands, command)
+	}
+	for command := range s.streams {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// handleProtocol is the control handler for the "control-protocol" command.
+func (s *controlServer) handleProtocol(args map[string]string) (interface{}, error) {
+	return controlProtocol{Version: controlProtocolVersion, Commands: s.commands()}, nil
+}
+
+// handle registers h as the handler for command.
+func (s *controlServer) handle(command string, h controlHandlerFunc) {
+	s.Lock()
+	defer s.Unlock()
+	s.handlers[command] = h
+}
+
+// handleStream registers h as the stream handler for command.
+func (s *controlServer) handleStream(command string, h controlStreamFunc) {
+	s.Lock()
+	defer s.Unlock()
+	s.streams[command] = h
+}
+
+// listenAndServe listens on the unix socket addr and serves control requests
+// until close is called.
+func (s *controlServer) listenAndServe(addr string) error {
+	if err := os.MkdirAll(filepath.Dir(addr), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove stale socket: %w", err)
+	}
+
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen to socket: %w", err)
+	}
+	if err := os.Chmod(addr, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("cannot set socket permissions: %w", err)
+	}
+
+	s.Lock()
+	s.listener = l
+	s.Unlock()
+
+	log.Infof("listening for control commands on socket: %v", addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return nil
+		}
+		if !s.acquire() {
+			go s.reject(conn)
+			continue
+		}
+		go func() {
+			defer s.release()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// acquire counts a new connection as open and returns true, unless the
+// maximum number of connections are already open.
+func (s *controlServer) acquire() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.maxConns > 0 && s.conns >= s.maxConns {
+		return false
+	}
+	s.conns++
+	return true
+}
+
+// release counts a connection as closed.
+func (s *controlServer) release() {
+	s.Lock()
+	defer s.Unlock()
+	s.conns--
+}
+
+// connections returns the number of open connections.
+func (s *controlServer) connections() int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.conns
+}
+
+// reject writes an error response to conn, without reading its request, and
+// closes it.
+func (s *controlServer) reject(conn net.Conn) {
+	defer conn.Close()
+	log.Warnf("rejecting control connection: %v connections are open", s.maxConns)
+	metrics.add("control_connections_rejected_total", 1)
+	conn.SetWriteDeadline(time.Now().Add(controlRejectTimeout))
+	resp := controlResponse{Error: fmt.Sprintf("too many control connections: limit of %v reached", s.maxConns)}
+	if err := json.NewEncoder(conn).Encode(&resp); err != nil {
+		log.Debugf("cannot encode control response: %v", err)
+	}
+}
+
+// deadline returns the time by which the client must next send or read, or
+// the zero time if there is no idle timeout.
+func (s *controlServer) deadline() time.Time {
+	if s.idleTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.idleTimeout)
+}
+
+// close stops the server from accepting new connections.
+func (s *controlServer) close() error {
+	s.RLock()
+	defer s.RUnlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// serveConn reads a single request from conn and writes back the response.
+func (s *controlServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(s.deadline())
+	var req controlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			log.Debugf("closing idle control connection: no request within %v", s.idleTimeout)
+			return
+		}
+		log.Errorf("cannot decode control request: %v", err)
+		return
+	}
+	log.Debugf("received control command: %v (control protocol version %v)", req.Command, req.Version)
+	log.Tracef("control request: %+v", req)
+
+	s.RLock()
+	stream, prs := s.streams[req.Command]
+	s.RUnlock()
+	if prs {
+		s.serveStream(conn, &req, stream)
+		return
+	}
+
+	conn.SetWriteDeadline(s.deadline())
+	if err := json.NewEncoder(conn).Encode(s.dispatch(&req)); err != nil {
+		log.Errorf("cannot encode control response: %v", err)
+	}
+}
+
+// serveStream writes a response to conn for each result of the stream handler
+// h until the client disconnects or h returns. If h returns an error, it is
+// written as a final response.
+func (s *controlServer) serveStream(conn net.Conn, req *controlRequest, h controlStreamFunc) {
+	// The client sends nothing after its request, so reading returns once it
+	// closes the connection. A stream may be idle for as long as the handler
+	// has nothing to send, so only the client reading is bounded.
+	conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(done)
+	}()
+
+	enc := json.NewEncoder(conn)
+	send := func(v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("cannot marshal result: %w", err)
+		}
+		conn.SetWriteDeadline(s.deadline())
+		return enc.Encode(&controlResponse{Result: data})
+	}
+
+	if err := h(req.Arguments, send, done); err != nil {
+		conn.SetWriteDeadline(s.deadline())
+		if err := enc.Encode(&controlResponse{Error: err.Error()}); err != nil {
+			log.Debugf("cannot encode control response: %v", err)
+		}
+	}
+}
+
+// dispatch invokes the handler for req and packs its result into a response.
+func (s *controlServer) dispatch(req *controlRequest) *controlResponse {
+	s.RLock()
+	h, prs := s.handlers[req.Command]
+	s.RUnlock()
+
+	if !prs {
+		log.Warnf("received unsupported control command: %v", req.Command)
+		return &controlResponse{
+			Error:    fmt.Sprintf("unsupported command: %v", req.Command),
+			Code:     controlCodeUnsupportedCommand,
+			Version:  controlProtocolVersion,
+			Commands: s.commands(),
+		}
+	}
+
+	result, err := h(req.Arguments)
+	if err != nil {
+		return &controlResponse{Error: err.Error()}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return &controlResponse{Error: fmt.Sprintf("cannot marshal result: %v", err)}
+	}
+
+	return &controlResponse{Result: data}
+}
+
+// callControl connects to the control socket at addr, invokes command with
+// args and returns the raw JSON result.
+func callControl(addr string, command string, args map[string]string) (json.RawMessage, error) {
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to daemon: %w", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(controlRequest{Command: command, Arguments: args, Version: controlProtocolVersion}); err != nil {
+		return nil, fmt.Errorf("cannot send control request: %w", err)
+	}
+
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("cannot read control response: %w", err)
+	}
+	if err := resp.err(command); err != nil {
+		return nil, err
+	}
+
+	return resp.Result, nil
+}
+
+// streamControl connects to the control socket at addr, invokes the stream
+// command with args and calls f with the raw JSON of each result, until the
+// daemon closes the connection or f returns an error.
+func streamControl(addr string, command string, args map[string]string, f func(result json.RawMessage) error) error {
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		return fmt.Errorf("cannot connect to daemon: %w", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(controlRequest{Command: command, Arguments: args, Version: controlProtocolVersion}); err != nil {
+		return fmt.Errorf("cannot send control request: %w", err)
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var resp controlResponse
+		if err := dec.Decode(&resp); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("cannot read control response: %w", err)
+		}
+		if err := resp.err(command); err != nil {
+			return err
+		}
+		if err := f(resp.Result); err != nil {
+			return err
+		}
+	}
+}
+
+// controlProtocolAction calls the "control-protocol" control command on the
+// running daemon and prints the control protocol version of the daemon and of
+// this build, and the commands the daemon supports.
+func controlProtocolAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "control-protocol", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var protocol controlProtocol
+	if err := json.Unmarshal(result, &protocol); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	fmt.Fprintf(c.App.Writer, "daemon version: %v\n", protocol.Version)
+	fmt.Fprintf(c.App.Writer, "client version: %v\n", controlProtocolVersion)
+	fmt.Fprintf(c.App.Writer, "commands: %v\n", strings.Join(protocol.Commands, " "))
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestControlServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-control-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "control.sock")
+
+	s := newControlServer()
+	s.handle("echo", func(args map[string]string) (interface{}, error) {
+		return args, nil
+	})
+	s.handle("fail", func(args map[string]string) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	go s.listenAndServe(addr)
+	defer s.close()
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		description string
+		command     string
+		args        map[string]string
+		want        map[string]string
+		wantError   string
+	}{
+		{
+			description: "echo",
+			command:     "echo",
+			args:        map[string]string{"key": "value"},
+			want:        map[string]string{"key": "value"},
+		},
+		{
+			description: "handler error",
+			command:     "fail",
+			wantError:   "failed",
+		},
+		{
+			description: "unsupported command",
+			command:     "bogus",
+			wantError:   "unsupported command: bogus: the running daemon speaks control protocol version 1 and supports: control-protocol, echo, fail",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			result, err := callControl(addr, test.command, test.args)
+			if test.wantError != "" {
+				if err == nil || err.Error() != test.wantError {
+					t.Errorf("%v != %v", err, test.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]string
+			if err := json.Unmarshal(result, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestControlServerConnectionLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-control-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "control.sock")
+
+	s := newControlServer()
+	s.maxConns = 1
+	s.idleTimeout = 100 * time.Millisecond
+	s.handle("echo", func(args map[string]string) (interface{}, error) {
+		return args, nil
+	})
+	go s.listenAndServe(addr)
+	defer s.close()
+
+	waitFor(t, func() bool { _, err := os.Stat(addr); return err == nil })
+
+	// A client that connects and never sends its request.
+	idle, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	waitFor(t, func() bool { return s.connections() == 1 })
+
+	if _, err := callControl(addr, "echo", nil); err == nil || err.Error() != "too many control connections: limit of 1 reached" {
+		t.Errorf("expected the connection to be rejected, got %v", err)
+	}
+
+	// The idle connection is closed once the timeout passes.
+	waitFor(t, func() bool { return s.connections() == 0 })
+	if _, err := callControl(addr, "echo", nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestControlResponseErr(t *testing.T) {
+	tests := []struct {
+		description     string
+		resp            controlResponse
+		wantError       string
+		wantUnsupported *unsupportedCommandError
+	}{
+		{
+			description: "no error",
+			resp:        controlResponse{Result: json.RawMessage(`{}`)},
+		},
+		{
+			description: "handler error",
+			resp:        controlResponse{Error: "failed"},
+			wantError:   "failed",
+		},
+		{
+			description: "unsupported command",
+			resp: controlResponse{
+				Error:    "unsupported command: bogus",
+				Code:     controlCodeUnsupportedCommand,
+				Version:  2,
+				Commands: []string{"control-protocol", "queue"},
+			},
+			wantUnsupported: &unsupportedCommandError{command: "bogus", version: 2, commands: []string{"control-protocol", "queue"}},
+		},
+		{
+			description:     "unknown command of an unversioned daemon",
+			resp:            controlResponse{Error: "unknown command: bogus"},
+			wantUnsupported: &unsupportedCommandError{command: "bogus"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := test.resp.err("bogus")
+			var unsupported *unsupportedCommandError
+			switch {
+			case test.wantUnsupported != nil:
+				if !errors.As(err, &unsupported) {
+					t.Fatalf("expected an unsupported command error, got %v", err)
+				}
+				if !cmp.Equal(unsupported, test.wantUnsupported, cmp.AllowUnexported(unsupportedCommandError{})) {
+					t.Errorf("%#v != %#v", unsupported, test.wantUnsupported)
+				}
+			case test.wantError != "":
+				if err == nil || err.Error() != test.wantError || errors.As(err, &unsupported) {
+					t.Errorf("%v != %v", err, test.wantError)
+				}
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
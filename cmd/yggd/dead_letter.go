@@ -0,0 +1,35 @@
+package main
+
+import "fmt"
+
+// defaultDeadLetterDest is the destination dead-lettered messages are
+// published to unless a destination is configured for their directive.
+const defaultDeadLetterDest = "dead-letter"
+
+// parseDeadLetterDests parses values of the form "DIRECTIVE=DEST" into a map
+// of destinations that dead-lettered messages of each directive are published
+// to. A DIRECTIVE of "*" applies to every directive not listed explicitly.
+func parseDeadLetterDests(values []string) (map[string]string, error) {
+	dests := make(map[string]string)
+	for _, value := range values {
+		directive, dest := splitPair(value, "=")
+		if directive == "" || dest == "" {
+			return nil, fmt.Errorf("invalid dead-letter topic: %v", value)
+		}
+		dests[directive] = dest
+	}
+	return dests, nil
+}
+
+// deadLetterDest returns the destination dead-lettered messages of directive
+// are published to: the destination configured for directive, else the one
+// configured for "*", else the "dead-letter" destination.
+func (c *Client) deadLetterDest(directive string) string {
+	if dest, prs := c.deadLetterDests[directive]; prs {
+		return dest
+	}
+	if dest, prs := c.deadLetterDests[receiptWildcard]; prs {
+		return dest
+	}
+	return defaultDeadLetterDest
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestSendDeadLetterMessageDest(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		directive   string
+		wantDest    string
+		wantError   bool
+	}{
+		{
+			description: "default",
+			directive:   "echo",
+			wantDest:    "dead-letter",
+		},
+		{
+			description: "directive",
+			input:       []string{"security=security-dead-letter", "*=other-dead-letter"},
+			directive:   "security",
+			wantDest:    "security-dead-letter",
+		},
+		{
+			description: "wildcard",
+			input:       []string{"security=security-dead-letter", "*=other-dead-letter"},
+			directive:   "telemetry",
+			wantDest:    "other-dead-letter",
+		},
+		{
+			description: "unmapped",
+			input:       []string{"security=security-dead-letter"},
+			directive:   "telemetry",
+			wantDest:    "dead-letter",
+		},
+		{
+			description: "invalid",
+			input:       []string{"security"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dests, err := parseDeadLetterDests(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error parsing %v", test.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tr := &recordingTransport{}
+			c := Client{t: tr, deadLetterDests: dests}
+			msg := yggdrasil.Data{MessageID: "1234", Directive: test.directive}
+			if err := c.SendDeadLetterMessage(&msg, errors.New("failed")); err != nil {
+				t.Fatal(err)
+			}
+			if len(tr.sent) != 1 || len(tr.sent[test.wantDest]) != 1 {
+				t.Errorf("expected the message to be sent to %v, sent %v", test.wantDest, tr.sent)
+			}
+		})
+	}
+}
+
+func TestSendDeadLetterMessageStore(t *testing.T) {
+	tests := []struct {
+		description string
+		limit       int
+		want        int
+	}{
+		{
+			description: "published",
+			limit:       1 << 20,
+			want:        1,
+		},
+		{
+			description: "publish failed",
+			limit:       1,
+			want:        0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-dead-letters-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s := newDeadLetterStore(filepath.Join(dir, "dead-letters.json"))
+			c := Client{t: &limitedTransport{limit: test.limit}, deadLetters: s}
+			msg := yggdrasil.Data{MessageID: "1234", Directive: "echo"}
+			if err := c.SendDeadLetterMessage(&msg, errors.New("failed")); err == nil && test.want == 0 {
+				t.Errorf("expected the publish to fail")
+			}
+			msgs, err := s.read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != test.want {
+				t.Errorf("stored %v messages, want %v", len(msgs), test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultDesiredStateFile is where the state versions applied by each worker
+// are recorded by default.
+var defaultDesiredStateFile = filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "desired-state.json")
+
+// A desiredStateRecord describes the reconciliation of the desired state of
+// one directive. Applied is the version of the state the worker last applied,
+// at AppliedAt; Pending is the version dispatched to the worker that it has
+// not yet responded to.
+type desiredStateRecord struct {
+	Directive string     `json:"directive"`
+	Applied   string     `json:"applied,omitempty"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	Pending   string     `json:"pending,omitempty"`
+
+	// pendingID is the message ID of the data message dispatched for the
+	// pending version.
+	pendingID string
+}
+
+// A desiredStateReconciler turns desired-state messages received from dest
+// into data messages for the worker of their directive, skipping states whose
+// version is already applied or pending. Applied versions are recorded in
+// file, if not empty, so that a retained desired-state message redelivered
+// after a restart is not reconciled again.
+type desiredStateReconciler struct {
+	dest string
+	file string
+
+	lock    sync.Mutex
+	records map[string]*desiredStateRecord
+}
+
+// newDesiredStateReconciler creates a reconciler for desired-state messages
+// received from dest, reading the versions previously applied from file.
+func newDesiredStateReconciler(dest string, file string) (*desiredStateReconciler, error) {
+	r := desiredStateReconciler{
+		dest:    dest,
+		file:    file,
+		records: make(map[string]*desiredStateRecord),
+	}
+	if file == "" {
+		return &r, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &r, nil
+		}
+		return nil, fmt.Errorf("cannot read desired state file: %w", err)
+	}
+	var records []*desiredStateRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal desired state file: %w", err)
+	}
+	for _, record := range records {
+		record.Pending = ""
+		r.records[record.Directive] = record
+	}
+	return &r, nil
+}
+
+// stateVersion returns the version of msg's state: its state version if set,
+// and otherwise a digest of the state.
+func stateVersion(msg *yggdrasil.DesiredState) string {
+	if msg.Content.StateVersion != "" {
+		return msg.Content.StateVersion
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(msg.Content.State))
+}
+
+// reconcile returns the data message that reconciles msg, and marks its
+// version pending. It returns false if the version is already applied or
+// pending.
+func (r *desiredStateReconciler) reconcile(msg *yggdrasil.DesiredState) (*yggdrasil.Data, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	version := stateVersion(msg)
+	record, prs := r.records[msg.Content.Directive]
+	if !prs {
+		record = &desiredStateRecord{Directive: msg.Content.Directive}
+		r.records[msg.Content.Directive] = record
+	}
+	if version == record.Pending || (record.Pending == "" && version == record.Applied) {
+		return nil, false
+	}
+
+	data := yggdrasil.Data{
+		Type:       yggdrasil.MessageTypeData,
+		MessageID:  uuid.New().String(),
+		ResponseTo: msg.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+		Directive:  msg.Content.Directive,
+		Metadata:   map[string]string{yggdrasil.DesiredStateVersionMetadataKey: version},
+		Content:    msg.Content.State,
+	}
+	record.Pending = version
+	record.pendingID = data.MessageID
+	return &data, true
+}
+
+// applied marks the version dispatched in the message id as applied, if id is
+// the pending reconciliation of a directive. It does nothing if r is nil.
+func (r *desiredStateReconciler) applied(id string) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	record := r.pending(id)
+	if record == nil {
+		return
+	}
+	now := time.Now()
+	record.Applied = record.Pending
+	record.AppliedAt = &now
+	record.Pending = ""
+	record.pendingID = ""
+	log.Infof("desired state version %v applied by worker for directive %v", record.Applied, record.Directive)
+
+	if err := r.save(); err != nil {
+		log.Errorf("cannot save desired state: %v", err)
+	}
+}
+
+// failed clears the pending version dispatched in the message id, so that the
+// state is reconciled again when it is next received. It does nothing if r is
+// nil.
+func (r *desiredStateReconciler) failed(id string) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if record := r.pending(id); record != nil {
+		record.Pending = ""
+		record.pendingID = ""
+	}
+}
+
+// appliesDesiredState reports whether the result msg is a worker's successful
+// response, which applies the desired state its message reconciled. A result
+// published in place of a worker's, because the assignment timed out or was
+// cancelled or the worker's response was malformed, does not.
+func appliesDesiredState(msg yggdrasil.Data) bool {
+	if msg.Metadata[timeoutMetadataKey] == timeoutStatusTimedOut || msg.Metadata[cancelMetadataKey] == cancelStatusCancelled {
+		return false
+	}
+	_, malformed := msg.Metadata[malformedMetadataKey]
+	return !malformed
+}
+
+// pending returns the record whose pending reconciliation was dispatched in
+// the message id, or nil. r.lock must be held.
+func (r *desiredStateReconciler) pending(id string) *desiredStateRecord {
+	if id == "" {
+		return nil
+	}
+	for _, record := range r.records {
+		if record.pendingID == id {
+			return record
+		}
+	}
+	return nil
+}
+
+// list returns the record of each directive, sorted by directive. r.lock must
+// be held.
+func (r *desiredStateReconciler) list() []desiredStateRecord {
+	records := make([]desiredStateRecord, 0, len(r.records))
+	for _, record := range r.records {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Directive < records[j].Directive })
+	return records
+}
+
+// save writes the applied versions to the desired state file. r.lock must be
+// held.
+func (r *desiredStateReconciler) save() error {
+	if r.file == "" {
+		return nil
+	}
+
+	var records []desiredStateRecord
+	for _, record := range r.list() {
+		if record.Applied != "" {
+			record.Pending = ""
+			records = append(records, record)
+		}
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("cannot marshal desired state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(r.file), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	tmp := r.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := os.Rename(tmp, r.file); err != nil {
+		return fmt.Errorf("cannot rename file: %w", err)
+	}
+	return nil
+}
+
+// handle is the control handler for the "desired-state" command. It reports
+// the applied and pending state version of each directive.
+func (r *desiredStateReconciler) handle(args map[string]string) (interface{}, error) {
+	if r == nil {
+		return nil, fmt.Errorf("desired state is not enabled")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.list(), nil
+}
+
+// ReceiveDesiredStateMessage reconciles the desired state in msg by passing a
+// data message holding the state to the worker for its directive, unless the
+// state's version is already applied or being applied. The data message is
+// received as if it came from the transport, so it is subject to the
+// directive filter, transforms and receipts.
+func (c *Client) ReceiveDesiredStateMessage(msg *yggdrasil.DesiredState) error {
+	if msg.Content.Directive == "" {
+		return fmt.Errorf("cannot reconcile desired state %v: missing directive", msg.MessageID)
+	}
+
+	data, ok := c.desiredState.reconcile(msg)
+	if !ok {
+		log.Debugf("desired state version %v already applied or pending for directive %v", stateVersion(msg), msg.Content.Directive)
+		return nil
+	}
+	log.Infof("reconciling desired state version %v for directive %v", data.Metadata[yggdrasil.DesiredStateVersionMetadataKey], data.Directive)
+
+	return c.ReceiveDataMessage(data)
+}
+
+// desiredStateAction calls the "desired-state" control command on the running
+// daemon and prints the state version of each directive, either as a table or
+// as JSON.
+func desiredStateAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "desired-state", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var records []desiredStateRecord
+	if err := json.Unmarshal(result, &records); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot marshal desired state: %w", err), 1)
+		}
+		fmt.Fprintln(c.App.Writer, string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.App.Writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTIVE\tAPPLIED\tAPPLIED AT\tPENDING")
+	for _, r := range records {
+		appliedAt := ""
+		if r.AppliedAt != nil {
+			appliedAt = r.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", r.Directive, r.Applied, appliedAt, r.Pending)
+	}
+	if err := w.Flush(); err != nil {
+		return cli.Exit(fmt.Errorf("cannot write desired state: %w", err), 1)
+	}
+
+	return nil
+}
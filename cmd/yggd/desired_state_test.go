@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func desiredState(id string, directive string, version string, state string) *yggdrasil.DesiredState {
+	msg := yggdrasil.DesiredState{Type: yggdrasil.MessageTypeDesiredState, MessageID: id}
+	msg.Content.Directive = directive
+	msg.Content.StateVersion = version
+	msg.Content.State = json.RawMessage(state)
+	return &msg
+}
+
+func TestReconcileDesiredState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-desired-state-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "desired-state.json")
+
+	r, err := newDesiredStateReconciler("desired-state", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, ok := r.reconcile(desiredState("1", "echo", "v1", `{"a":1}`))
+	if !ok {
+		t.Fatal("expected first state to be reconciled")
+	}
+	if data.Directive != "echo" || data.ResponseTo != "1" || data.Metadata[yggdrasil.DesiredStateVersionMetadataKey] != "v1" || string(data.Content) != `{"a":1}` {
+		t.Errorf("unexpected data message: %+v", data)
+	}
+
+	// A redelivery of a pending version is not reconciled again.
+	if _, ok := r.reconcile(desiredState("2", "echo", "v1", `{"a":1}`)); ok {
+		t.Errorf("expected pending version to be skipped")
+	}
+
+	r.applied(data.MessageID)
+	if _, ok := r.reconcile(desiredState("3", "echo", "v1", `{"a":1}`)); ok {
+		t.Errorf("expected applied version to be skipped")
+	}
+
+	// A version that could not be delivered is reconciled again.
+	next, ok := r.reconcile(desiredState("4", "echo", "v2", `{"a":2}`))
+	if !ok {
+		t.Fatal("expected new version to be reconciled")
+	}
+	r.failed(next.MessageID)
+	if _, ok := r.reconcile(desiredState("5", "echo", "v2", `{"a":2}`)); !ok {
+		t.Errorf("expected undelivered version to be reconciled again")
+	}
+
+	// States without a version are versioned by their contents.
+	unversioned, ok := r.reconcile(desiredState("6", "sleep", "", `{"b":1}`))
+	if !ok {
+		t.Fatal("expected unversioned state to be reconciled")
+	}
+	r.applied(unversioned.MessageID)
+	if _, ok := r.reconcile(desiredState("7", "sleep", "", `{"b":1}`)); ok {
+		t.Errorf("expected unchanged unversioned state to be skipped")
+	}
+	if _, ok := r.reconcile(desiredState("8", "sleep", "", `{"b":2}`)); !ok {
+		t.Errorf("expected changed unversioned state to be reconciled")
+	}
+
+	// Applied versions survive a restart; pending ones do not.
+	restarted, err := newDesiredStateReconciler("desired-state", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.reconcile(desiredState("9", "echo", "v1", `{"a":1}`)); ok {
+		t.Errorf("expected version applied before the restart to be skipped")
+	}
+	if _, ok := restarted.reconcile(desiredState("10", "echo", "v2", `{"a":2}`)); !ok {
+		t.Errorf("expected version pending before the restart to be reconciled")
+	}
+}
+
+func TestReceiveDesiredStateMessage(t *testing.T) {
+	r, err := newDesiredStateReconciler("desired-state", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDispatcher(nil)
+	d.queue = &bufferedQueue{}
+	c := Client{t: &recordingTransport{}, d: d, desiredState: r}
+
+	payload, err := json.Marshal(desiredState("1", "echo", "v1", `{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.DataReceiveHandlerFunc(payload, "desired-state")
+	c.DataReceiveHandlerFunc(payload, "desired-state")
+
+	if d.queue.Len() != 1 {
+		t.Fatalf("expected 1 dispatched message, got %v", d.queue.Len())
+	}
+	q, _ := d.queue.Dequeue()
+	if q.data.Directive != "echo" || q.data.Metadata[yggdrasil.DesiredStateVersionMetadataKey] != "v1" {
+		t.Errorf("unexpected dispatched message: %+v", q.data)
+	}
+
+	if err := c.ReceiveDesiredStateMessage(desiredState("2", "", "v1", `{}`)); err == nil {
+		t.Errorf("expected error for a desired state without a directive")
+	}
+}
+
+func TestDesiredStateTerminalPaths(t *testing.T) {
+	tests := []struct {
+		description string
+		end         func(c *Client, data yggdrasil.Data)
+		wantApplied string
+	}{
+		{
+			description: "result",
+			end: func(c *Client, data yggdrasil.Data) {
+				c.handleResult(yggdrasil.Data{MessageID: "result", ResponseTo: data.MessageID, Directive: "echo"})
+			},
+			wantApplied: "v1",
+		},
+		{
+			description: "timed out",
+			end:         func(c *Client, data yggdrasil.Data) { c.handleResult(timedOutResult(data)) },
+		},
+		{
+			description: "cancelled",
+			end:         func(c *Client, data yggdrasil.Data) { c.handleResult(cancelledResult(data)) },
+		},
+		{
+			description: "malformed",
+			end: func(c *Client, data yggdrasil.Data) {
+				c.handleResult(malformedResult(yggdrasil.Data{ResponseTo: data.MessageID, Directive: "echo"}, errMalformedResponse))
+			},
+		},
+		{
+			description: "stale",
+			end:         func(c *Client, data yggdrasil.Data) { c.StaleHandlerFunc(data, fmt.Errorf("stale")) },
+		},
+		{
+			description: "abandoned",
+			end:         func(c *Client, data yggdrasil.Data) { c.AbandonedHandlerFunc(data.MessageID) },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r, err := newDesiredStateReconciler("desired-state", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := Client{t: &recordingTransport{}, desiredState: r}
+
+			data, ok := r.reconcile(desiredState("1", "echo", "v1", `{"a":1}`))
+			if !ok {
+				t.Fatal("expected desired state to be reconciled")
+			}
+			test.end(&c, *data)
+
+			records := r.list()
+			if len(records) != 1 {
+				t.Fatalf("expected 1 record, got %v", len(records))
+			}
+			if records[0].Pending != "" {
+				t.Errorf("expected no pending version, got %v", records[0].Pending)
+			}
+			if records[0].Applied != test.wantApplied {
+				t.Errorf("%v != %v", records[0].Applied, test.wantApplied)
+			}
+		})
+	}
+}
+
+func TestDesiredStateDropped(t *testing.T) {
+	tests := []struct {
+		description string
+		setup       func(c *Client)
+	}{
+		{
+			description: "draining",
+			setup:       func(c *Client) { c.Drain() },
+		},
+		{
+			description: "directive denied",
+			setup:       func(c *Client) { c.directives = newDirectiveFilter(nil, []string{"echo"}) },
+		},
+		{
+			description: "duplicate",
+			setup:       func(c *Client) { c.seen = newSeenCache(10, time.Minute) },
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.description, func(t *testing.T) {
+			r, err := newDesiredStateReconciler("desired-state", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := newDispatcher(nil)
+			d.queue = &bufferedQueue{}
+			c := &Client{t: &recordingTransport{}, d: d, desiredState: r}
+			test.setup(c)
+
+			data, ok := r.reconcile(desiredState("1", "echo", "v1", `{"a":1}`))
+			if !ok {
+				t.Fatal("expected desired state to be reconciled")
+			}
+			if c.seen != nil {
+				c.seen.duplicate(data)
+			}
+			if err := c.ReceiveDataMessage(data); err != nil {
+				t.Fatal(err)
+			}
+
+			if d.queue.Len() != 0 {
+				t.Fatalf("expected no dispatched message, got %v", d.queue.Len())
+			}
+			records := r.list()
+			if len(records) != 1 || records[0].Pending != "" {
+				t.Errorf("expected no pending version, got %+v", records)
+			}
+		})
+	}
+}
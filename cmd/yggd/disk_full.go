@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/urfave/cli/v2"
+)
+
+// The actions the spool can take when the disk it writes to is full.
+const (
+	// diskFullDrop drops the messages that cannot be spooled and stops
+	// trying to spool until diskFullRetryInterval has passed.
+	diskFullDrop = "drop"
+
+	// diskFullEvict removes the oldest spooled messages to make room for the
+	// new one.
+	diskFullEvict = "evict"
+
+	// diskFullBlock retries spooling a message every diskFullRetryInterval
+	// until it succeeds, holding back the messages behind it.
+	diskFullBlock = "block"
+)
+
+// diskFullRetryInterval is how long to wait before writing to a full disk
+// again.
+var diskFullRetryInterval = 10 * time.Second
+
+// errDiskFull is returned when data is not written because the disk is full.
+var errDiskFull = errors.New("disk full")
+
+// isDiskFull returns true if err reports that a write failed for lack of space
+// or quota.
+func isDiskFull(err error) bool {
+	return errors.Is(err, errDiskFull) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// A diskComponent is the state of writes to disk by one part of the daemon.
+type diskComponent struct {
+	Component string    `json:"component"`
+	Full      bool      `json:"full"`
+	Since     time.Time `json:"since,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Dropped   uint64    `json:"dropped"`
+}
+
+// A diskState records which parts of the daemon cannot write to disk because
+// it is full. Each change of a part to and from being degraded is logged once,
+// rather than each write that fails.
+type diskState struct {
+	lock       sync.Mutex
+	components map[string]*diskComponent
+}
+
+func newDiskState() *diskState {
+	return &diskState{components: make(map[string]*diskComponent)}
+}
+
+// disk is the state of the daemon's writes to disk.
+var disk = newDiskState()
+
+// full records that component failed to write to disk with err, and that the
+// data it was writing was dropped if dropped is true.
+func (s *diskState) full(component string, err error, dropped bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, prs := s.components[component]
+	if !prs {
+		c = &diskComponent{Component: component}
+		s.components[component] = c
+	}
+	if !c.Full {
+		log.Errorf("%v degraded: cannot write to disk: %v", component, err)
+		c.Full = true
+		c.Since = time.Now()
+		c.Error = err.Error()
+	}
+	if dropped {
+		c.Dropped++
+		metrics.add("disk_full_dropped_total", 1)
+	}
+}
+
+// ok records that component wrote to disk.
+func (s *diskState) ok(component string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, prs := s.components[component]
+	if !prs || !c.Full {
+		return
+	}
+	log.Infof("%v recovered: writing to disk again after %v", component, time.Since(c.Since).Round(time.Second))
+	c.Full = false
+	c.Since = time.Time{}
+	c.Error = ""
+}
+
+// isFull returns true if component last failed to write to disk because it is
+// full, and when it started to.
+func (s *diskState) isFull(component string) (bool, time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	c, prs := s.components[component]
+	if !prs {
+		return false, time.Time{}
+	}
+	return c.Full, c.Since
+}
+
+// degraded returns the number of components that cannot write to disk.
+func (s *diskState) degraded() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	for _, c := range s.components {
+		if c.Full {
+			n++
+		}
+	}
+	return n
+}
+
+// status returns the state of each component that has written to a full
+// disk, sorted by component.
+func (s *diskState) status() []diskComponent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	status := make([]diskComponent, 0, len(s.components))
+	for _, c := range s.components {
+		status = append(status, *c)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Component < status[j].Component })
+	return status
+}
+
+// handle is the control handler for the "disk" command.
+func (s *diskState) handle(args map[string]string) (interface{}, error) {
+	return s.status(), nil
+}
+
+// diskAction calls the "disk" control command on the running daemon and
+// prints the result.
+func diskAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "disk", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var status []diskComponent
+	if err := json.Unmarshal(result, &status); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	if len(status) == 0 {
+		fmt.Fprintln(c.App.Writer, "ok")
+		return nil
+	}
+	for _, s := range status {
+		state := "ok"
+		if s.Full {
+			state = fmt.Sprintf("disk full since %v: %v", s.Since.Format(time.RFC3339), s.Error)
+		}
+		fmt.Fprintf(c.App.Writer, "%v: %v (dropped %v)\n", s.Component, state, s.Dropped)
+	}
+	return nil
+}
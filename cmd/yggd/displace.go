@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The supported duplicate registration policies, deciding the outcome of a
+// registration for a handler that already has a registered worker, when it is
+// neither a handover to an upgraded worker nor joins a worker pool.
+const (
+	// duplicateRegistrationReject rejects the new registration; the
+	// registered worker keeps serving the handler.
+	duplicateRegistrationReject = "reject"
+
+	// duplicateRegistrationDisplace registers the new worker in place of the
+	// registered one, which is stopped. The messages delivered to the
+	// displaced worker that it has not responded to are dispatched again.
+	duplicateRegistrationDisplace = "displace"
+)
+
+// errAssignmentDisplaced is returned by sendToWorker if the worker's Send
+// call was cancelled because the worker was displaced.
+var errAssignmentDisplaced = errors.New("assignment displaced")
+
+// checkDuplicateRegistrationPolicy returns an error if policy is not a
+// supported duplicate registration policy.
+func checkDuplicateRegistrationPolicy(policy string) error {
+	switch policy {
+	case duplicateRegistrationReject, duplicateRegistrationDisplace:
+		return nil
+	default:
+		return fmt.Errorf("unsupported duplicate registration policy: %v", policy)
+	}
+}
+
+// displace stops the worker old after a new worker process has registered in
+// its place. New messages are already routed to the new worker. Messages being
+// delivered to old are cancelled, and those it accepted but has not responded
+// to are dispatched again; either way they are delivered to the new worker.
+// They keep the time they were queued, so they still expire under
+// max-queue-age.
+func (d *dispatcher) displace(old worker) {
+	d.Lock()
+	var retry []queuedData
+	for id, a := range d.assignments {
+		if a.pid != old.pid {
+			continue
+		}
+		if a.cancel != nil {
+			// The Send call is in progress; dispatch retries the message
+			// once it returns.
+			a.displaced = true
+			a.cancel()
+			continue
+		}
+		delete(d.assignments, id)
+		retry = append(retry, queuedData{data: a.data, queued: a.queued})
+	}
+	delete(d.outstanding, old.pid)
+	d.Unlock()
+
+	logger := processLogger(old.pid)
+	logger.Warnf("worker process %v for handler %v was displaced by a new registration; dispatching its %v outstanding messages again", old.pid, old.handler, len(retry))
+	for _, q := range retry {
+		go d.dispatch(q)
+	}
+
+	if err := d.retire(old.pid); err != nil {
+		logger.Errorf("cannot stop worker process %v: %v", old.pid, err)
+	}
+}
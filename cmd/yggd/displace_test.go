@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+func TestRegisterDuplicate(t *testing.T) {
+	tests := []struct {
+		description    string
+		policy         string
+		wantRegistered bool
+		wantRetired    bool
+	}{
+		{
+			description: "reject",
+			policy:      duplicateRegistrationReject,
+		},
+		{
+			description:    "displace",
+			policy:         duplicateRegistrationDisplace,
+			wantRegistered: true,
+			wantRetired:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.duplicatePolicy = test.policy
+			// A restart of the same executable is not a handover, even
+			// with handovers enabled.
+			d.handoverTimeout = time.Minute
+			d.upgraded = func(old, pid int) bool { return false }
+			retired := make(chan int, 1)
+			d.retire = func(pid int) error {
+				retired <- pid
+				return nil
+			}
+			go func() {
+				for range d.dispatchers {
+				}
+			}()
+			defer close(d.dispatchers)
+
+			if _, err := d.Register(context.Background(), &pb.RegistrationRequest{Handler: "echo", Pid: oldWorkerPID}); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := d.Register(context.Background(), &pb.RegistrationRequest{Handler: "echo", Pid: newWorkerPID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.GetRegistered() != test.wantRegistered {
+				t.Fatalf("registered: %v", resp.GetRegistered())
+			}
+
+			select {
+			case pid := <-retired:
+				if !test.wantRetired {
+					t.Errorf("retired worker process %v", pid)
+				} else if pid != oldWorkerPID {
+					t.Errorf("retired %v, want %v", pid, oldWorkerPID)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if test.wantRetired {
+					t.Error("old worker process not retired")
+				}
+			}
+		})
+	}
+}
+
+func TestDisplaceRedispatches(t *testing.T) {
+	d := newDispatcher(nil)
+	d.retire = func(pid int) error { return nil }
+	d.workers["echo"] = worker{handler: "echo", pid: newWorkerPID, addr: "@ygg-test-displaced"}
+	undeliverable := make(chan yggdrasil.Data, 1)
+	d.undeliverable = func(data yggdrasil.Data) { undeliverable <- data }
+
+	d.assign(queuedData{data: yggdrasil.Data{MessageID: "1", Directive: "echo"}}, oldWorkerPID, nil)
+	d.trackDispatch(oldWorkerPID, "1")
+
+	d.displace(worker{handler: "echo", pid: oldWorkerPID})
+
+	d.RLock()
+	outstanding := len(d.outstanding[oldWorkerPID])
+	d.RUnlock()
+	if outstanding != 0 {
+		t.Errorf("%v messages outstanding for the displaced worker", outstanding)
+	}
+
+	// The new worker is not listening, so the message dispatched again to it
+	// is undeliverable.
+	select {
+	case data := <-undeliverable:
+		if data.MessageID != "1" {
+			t.Errorf("dispatched %v again, want 1", data.MessageID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not dispatched again")
+	}
+}
+
+func TestDisplaceKeepsQueueAge(t *testing.T) {
+	d := newDispatcher(nil)
+	d.retire = func(pid int) error { return nil }
+	d.maxQueueAge = time.Minute
+	d.workers["echo"] = worker{handler: "echo", pid: newWorkerPID, addr: "@ygg-test-displaced-age"}
+	stale := make(chan yggdrasil.Data, 1)
+	d.stale = func(data yggdrasil.Data, reason error) { stale <- data }
+
+	d.assign(queuedData{data: yggdrasil.Data{MessageID: "1", Directive: "echo"}, queued: time.Now().Add(-time.Hour)}, oldWorkerPID, nil)
+	d.displace(worker{handler: "echo", pid: oldWorkerPID})
+
+	select {
+	case data := <-stale:
+		if data.MessageID != "1" {
+			t.Errorf("expired %v, want 1", data.MessageID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message dispatched again did not expire")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// defaultDownloadTimeout is how long a payloadDownloader waits for a download
+// to complete if no timeout is configured.
+const defaultDownloadTimeout = 5 * time.Minute
+
+// A downloadClient sends HTTP requests on behalf of a payloadDownloader.
+type downloadClient interface {
+	Download(url string, timeout time.Duration, maxSize int64) ([]byte, error)
+}
+
+// A payloadDownloader fetches the content of data messages received with an
+// uploadReference in place of their content, the inverse of a
+// payloadUploader, so that the server can send workers content larger than
+// the broker accepts. It only fetches content from the hosts it is given,
+// gives up on a download after timeout, and refuses content larger than
+// maxSize bytes, if maxSize is greater than 0, whatever size the reference
+// declares.
+type payloadDownloader struct {
+	client  downloadClient
+	hosts   []string
+	timeout time.Duration
+	maxSize int64
+}
+
+func newPayloadDownloader(client downloadClient, hosts []string, timeout time.Duration, maxSize int64) *payloadDownloader {
+	return &payloadDownloader{client: client, hosts: hosts, timeout: timeout, maxSize: maxSize}
+}
+
+// allowed returns true if content may be downloaded from host.
+func (d *payloadDownloader) allowed(host string) bool {
+	for _, h := range d.hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// references returns true if the content of msg is an upload reference. It
+// returns false if d is nil.
+func (d *payloadDownloader) references(msg yggdrasil.Data) bool {
+	return d != nil && msg.Metadata["content_encoding"] == uploadReferenceEncoding
+}
+
+// download fetches the content msg references over HTTPS and returns msg with
+// its content replaced by the fetched content, once its size and digest
+// match those of the reference.
+func (d *payloadDownloader) download(msg yggdrasil.Data) (yggdrasil.Data, error) {
+	var ref uploadReference
+	if err := json.Unmarshal(msg.Content, &ref); err != nil {
+		return msg, fmt.Errorf("cannot unmarshal upload reference: %w", err)
+	}
+	u, err := url.Parse(ref.URL)
+	if err != nil {
+		return msg, fmt.Errorf("cannot parse reference URL: %w", err)
+	}
+	if u.Scheme != "https" {
+		return msg, fmt.Errorf("unsupported reference URL scheme: %v", ref.URL)
+	}
+	if !d.allowed(u.Hostname()) {
+		return msg, fmt.Errorf("reference URL host is not a download host: %v", u.Hostname())
+	}
+	if ref.Size < 0 {
+		return msg, fmt.Errorf("invalid reference size: %v", ref.Size)
+	}
+	if d.maxSize > 0 && int64(ref.Size) > d.maxSize {
+		return msg, fmt.Errorf("reference size %v exceeds max-download-size %v", ref.Size, d.maxSize)
+	}
+
+	content, err := d.client.Download(u.String(), d.timeout, int64(ref.Size))
+	if err != nil {
+		return msg, fmt.Errorf("cannot download content: %w", err)
+	}
+	if len(content) != ref.Size {
+		return msg, fmt.Errorf("downloaded %v bytes of content, want %v", len(content), ref.Size)
+	}
+	sum := sha256.Sum256(content)
+	if digest := hex.EncodeToString(sum[:]); digest != ref.SHA256 {
+		return msg, fmt.Errorf("downloaded content has SHA-256 digest %v, want %v", digest, ref.SHA256)
+	}
+	log.Debugf("downloaded %v bytes of content of message %v from %v", len(content), msg.MessageID, ref.URL)
+
+	msg.Metadata = copyMetadata(msg.Metadata)
+	delete(msg.Metadata, "content_encoding")
+	msg.Content = content
+	return msg, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// fakeDownloadClient serves the content of its URLs.
+type fakeDownloadClient map[string]string
+
+func (c fakeDownloadClient) Download(url string, timeout time.Duration, maxSize int64) ([]byte, error) {
+	content, ok := c[url]
+	if !ok {
+		return nil, fmt.Errorf("not found: %v", url)
+	}
+	if int64(len(content)) > maxSize {
+		return nil, fmt.Errorf("response body exceeds %v bytes", maxSize)
+	}
+	return []byte(content), nil
+}
+
+func TestPayloadDownloader(t *testing.T) {
+	const digest = "d9fd9a3d81d750e6edc61aec66e7c4112f7af7c34ebe0a0d20189464ec9df135" // `"result"`
+
+	tests := []struct {
+		description string
+		ref         string
+		want        yggdrasil.Data
+		wantError   bool
+	}{
+		{
+			description: "downloaded",
+			ref:         `{"url":"https://bucket.example.com/1234","size":8,"sha256":"` + digest + `"}`,
+			want:        yggdrasil.Data{MessageID: "1234", Metadata: map[string]string{"a": "b"}, Content: json.RawMessage(`"result"`)},
+		},
+		{
+			description: "not found",
+			ref:         `{"url":"https://bucket.example.com/5678","size":8,"sha256":"` + digest + `"}`,
+			wantError:   true,
+		},
+		{
+			description: "plain HTTP",
+			ref:         `{"url":"http://bucket.example.com/1234","size":8,"sha256":"` + digest + `"}`,
+			wantError:   true,
+		},
+		{
+			description: "host not allowed",
+			ref:         `{"url":"https://example.org/1234","size":8,"sha256":"` + digest + `"}`,
+			wantError:   true,
+		},
+		{
+			description: "larger than referenced",
+			ref:         `{"url":"https://bucket.example.com/1234","size":7,"sha256":"` + digest + `"}`,
+			wantError:   true,
+		},
+		{
+			description: "size mismatch",
+			ref:         `{"url":"https://bucket.example.com/1234","size":9,"sha256":"` + digest + `"}`,
+			wantError:   true,
+		},
+		{
+			description: "digest mismatch",
+			ref:         `{"url":"https://bucket.example.com/1234","size":8,"sha256":"00"}`,
+			wantError:   true,
+		},
+		{
+			description: "exceeds max-download-size",
+			ref:         `{"url":"https://bucket.example.com/5678","size":22,"sha256":"d3b89b7fb8ad14458ec474900f0e8ad7835b81b03c69e4d099a5e98766ac6104"}`,
+			wantError:   true,
+		},
+		{
+			description: "malformed reference",
+			ref:         `"https://bucket.example.com/1234"`,
+			wantError:   true,
+		},
+	}
+
+	d := newPayloadDownloader(fakeDownloadClient{
+		"https://bucket.example.com/1234": `"result"`,
+		"https://bucket.example.com/5678": `"a much larger result"`,
+		"https://example.org/1234":        `"result"`,
+	}, []string{"Bucket.example.com"}, time.Minute, 16)
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			msg := yggdrasil.Data{
+				MessageID: "1234",
+				Metadata:  map[string]string{"a": "b", "content_encoding": uploadReferenceEncoding},
+				Content:   json.RawMessage(test.ref),
+			}
+			if !d.references(msg) {
+				t.Fatal("expected message to reference content")
+			}
+			got, err := d.download(msg)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestPayloadDownloaderReferences(t *testing.T) {
+	msg := yggdrasil.Data{Metadata: map[string]string{"content_encoding": uploadReferenceEncoding}}
+	var d *payloadDownloader
+	if d.references(msg) {
+		t.Errorf("nil downloader references content")
+	}
+	d = newPayloadDownloader(fakeDownloadClient{}, nil, time.Minute, 0)
+	if d.references(yggdrasil.Data{}) {
+		t.Errorf("message without upload reference references content")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// factReference matches a reference to a canonical fact in a metadata
+// template, such as "{facts.machine_id}" or "{facts.worker_facts.echo.version}".
+var factReference = regexp.MustCompile(`\{facts\.([A-Za-z0-9_.-]+)\}`)
+
+// A metadataEnricher adds metadata to every published result, with values
+// rendered from templates that reference canonical facts. Templates are
+// resolved each time the facts are collected, and results use the values of
+// the last resolution.
+type metadataEnricher struct {
+	templates map[string]string
+
+	lock     sync.RWMutex
+	resolved map[string]string
+}
+
+// newMetadataEnricher creates an enricher from values of the form
+// "KEY=TEMPLATE".
+func newMetadataEnricher(values []string) (*metadataEnricher, error) {
+	e := metadataEnricher{templates: make(map[string]string, len(values))}
+	for _, value := range values {
+		key, template := splitPair(value, "=")
+		if !strings.Contains(value, "=") || key == "" {
+			return nil, fmt.Errorf("invalid result metadata: %v", value)
+		}
+		if strings.Contains(factReference.ReplaceAllString(template, ""), "{facts.") {
+			return nil, fmt.Errorf("invalid fact reference in result metadata: %v", value)
+		}
+		e.templates[key] = template
+	}
+	return &e, nil
+}
+
+// resolve renders the templates from facts. References to facts that are
+// missing are logged and rendered empty. It does nothing if e is nil.
+func (e *metadataEnricher) resolve(facts *yggdrasil.CanonicalFacts) {
+	if e == nil {
+		return
+	}
+
+	values, err := factValues(facts)
+	if err != nil {
+		log.Errorf("cannot resolve result metadata: %v", err)
+		return
+	}
+
+	resolved := make(map[string]string, len(e.templates))
+	var missing []string
+	for key, template := range e.templates {
+		resolved[key] = factReference.ReplaceAllStringFunc(template, func(ref string) string {
+			name := factReference.FindStringSubmatch(ref)[1]
+			value, ok := lookupFact(values, name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		log.Warnf("result metadata references missing facts: %v", strings.Join(missing, ", "))
+	}
+
+	e.lock.Lock()
+	e.resolved = resolved
+	e.lock.Unlock()
+}
+
+// apply adds the resolved metadata to msg. Keys the worker set itself are not
+// overwritten. It returns msg unchanged if e is nil or the templates have not
+// been resolved yet.
+func (e *metadataEnricher) apply(msg yggdrasil.Data) yggdrasil.Data {
+	if e == nil {
+		return msg
+	}
+
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	if e.resolved == nil {
+		log.Debugf("not adding result metadata to message %v: facts have not been collected", msg.MessageID)
+		return msg
+	}
+	msg.Metadata = copyMetadata(msg.Metadata)
+	for key, value := range e.resolved {
+		if _, prs := msg.Metadata[key]; !prs {
+			msg.Metadata[key] = value
+		}
+	}
+	return msg
+}
+
+// factValues returns facts as a tree of values keyed by their JSON names.
+func factValues(facts *yggdrasil.CanonicalFacts) (map[string]interface{}, error) {
+	data, err := json.Marshal(facts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal facts: %w", err)
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal facts: %w", err)
+	}
+	return values, nil
+}
+
+// lookupFact returns the value of the fact name, a dot-separated path into
+// values, formatted as a string. Lists are joined with commas. It returns false
+// if the fact is missing or empty.
+func lookupFact(values map[string]interface{}, name string) (string, bool) {
+	var value interface{} = values
+	for _, field := range strings.Split(name, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = m[field]; !ok {
+			return "", false
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, v != ""
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ","), len(items) > 0
+	case map[string]interface{}:
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestMetadataEnricher(t *testing.T) {
+	facts := &yggdrasil.CanonicalFacts{
+		MachineID:   "f2a0b4e8",
+		FQDN:        "host.example.com",
+		IPAddresses: []string{"192.0.2.1", "192.0.2.2"},
+		WorkerFacts: map[string]map[string]string{"echo": {"version": "1.2"}},
+	}
+
+	tests := []struct {
+		description string
+		values      []string
+		metadata    map[string]string
+		want        map[string]string
+		wantError   bool
+	}{
+		{
+			description: "facts",
+			values:      []string{"device_id={facts.machine_id}", "host=device {facts.fqdn} at {facts.ip_addresses}"},
+			want:        map[string]string{"device_id": "f2a0b4e8", "host": "device host.example.com at 192.0.2.1,192.0.2.2"},
+		},
+		{
+			description: "worker facts",
+			values:      []string{"echo_version={facts.worker_facts.echo.version}"},
+			want:        map[string]string{"echo_version": "1.2"},
+		},
+		{
+			description: "missing facts",
+			values:      []string{"location={facts.location}", "bios={facts.bios_uuid}"},
+			want:        map[string]string{"location": "", "bios": ""},
+		},
+		{
+			description: "worker metadata kept",
+			values:      []string{"device_id={facts.machine_id}", "site=lab"},
+			metadata:    map[string]string{"device_id": "set-by-worker"},
+			want:        map[string]string{"device_id": "set-by-worker", "site": "lab"},
+		},
+		{
+			description: "missing key",
+			values:      []string{"={facts.machine_id}"},
+			wantError:   true,
+		},
+		{
+			description: "invalid reference",
+			values:      []string{"device_id={facts.machine id}"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			e, err := newMetadataEnricher(test.values)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg := yggdrasil.Data{MessageID: "1", Metadata: test.metadata}
+			if got := e.apply(msg); len(got.Metadata) != len(test.metadata) {
+				t.Errorf("expected no metadata before facts are resolved, got %v", got.Metadata)
+			}
+
+			e.resolve(facts)
+			got := e.apply(msg)
+			if !cmp.Equal(got.Metadata, test.want) {
+				t.Errorf("%#v != %#v", got.Metadata, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// The types of pipeline events.
+const (
+	eventMessageReceived   = "message-received"
+	eventAssignmentCreated = "assignment-created"
+	eventResultReceived    = "result-received"
+	eventWorkerStarted     = "worker-started"
+	eventWorkerRejected    = "worker-rejected"
+	eventWorkerRegistered  = "worker-registered"
+	eventWorkerDied        = "worker-died"
+	eventWorkerRecycled    = "worker-recycled"
+	eventWorkerUnhealthy   = "worker-unhealthy"
+	eventConnected         = "connected"
+	eventDisconnected      = "disconnected"
+)
+
+// eventTypes lists every event type, for validating filters.
+var eventTypes = []string{
+	eventMessageReceived,
+	eventAssignmentCreated,
+	eventResultReceived,
+	eventWorkerStarted,
+	eventWorkerRejected,
+	eventWorkerRegistered,
+	eventWorkerDied,
+	eventWorkerRecycled,
+	eventWorkerUnhealthy,
+	eventConnected,
+	eventDisconnected,
+}
+
+// eventSubscriberBuffer is the number of events buffered for each subscriber.
+// Events emitted while a subscriber's buffer is full are dropped for that
+// subscriber, so that a slow subscriber cannot hold up the pipeline.
+const eventSubscriberBuffer = 256
+
+// An event is something that happened in the pipeline. Worker is the name of
+// the worker executable for worker-started, worker-rejected, worker-died,
+// worker-recycled and worker-unhealthy events, and the handler for other
+// events. ResponseTo and Digest are the message a result responds to and the
+// digest of its content, for result-received events.
+type event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	MessageID  string    `json:"message_id,omitempty"`
+	ResponseTo string    `json:"response_to,omitempty"`
+	Directive  string    `json:"directive,omitempty"`
+	Worker     string    `json:"worker,omitempty"`
+	PID        int       `json:"pid,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// An eventBus delivers the events emitted by the pipeline to its subscribers,
+// and records them in its audit log, if it has one.
+type eventBus struct {
+	lock        sync.Mutex
+	subscribers map[chan event]bool
+	audit       *auditLog
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[chan event]bool)}
+}
+
+// events delivers the events of the daemon.
+var events = newEventBus()
+
+// emit stamps e with the current time, records it in the audit log and
+// delivers it to every subscriber. The record is written under the lock, so
+// that the audit log is in the order of the events' times.
+func (b *eventBus) emit(e event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	e.Time = time.Now()
+	b.audit.record(e)
+
+	if len(b.subscribers) == 0 {
+		return
+	}
+	for c := range b.subscribers {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel on which emitted events are received, until
+// unsubscribe is called with it.
+func (b *eventBus) subscribe() chan event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	c := make(chan event, eventSubscriberBuffer)
+	b.subscribers[c] = true
+	return c
+}
+
+func (b *eventBus) unsubscribe(c chan event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.subscribers, c)
+}
+
+// An eventFilter selects events by type and worker. Empty fields match every
+// event.
+type eventFilter struct {
+	types  map[string]bool
+	worker string
+}
+
+// parseEventFilter creates a filter from the arguments of the "events"
+// control command: "types", a comma-separated list of event types, and
+// "worker".
+func parseEventFilter(args map[string]string) (*eventFilter, error) {
+	f := eventFilter{worker: args["worker"]}
+	if args["types"] != "" {
+		f.types = make(map[string]bool)
+		for _, t := range strings.Split(args["types"], ",") {
+			if !containsString(eventTypes, t) {
+				return nil, fmt.Errorf("unsupported event type: %v", t)
+			}
+			f.types[t] = true
+		}
+	}
+	return &f, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *eventFilter) match(e event) bool {
+	if f.types != nil && !f.types[e.Type] {
+		return false
+	}
+	return f.worker == "" || f.worker == e.Worker
+}
+
+// streamEvents is the control stream handler for the "events" command. It
+// sends each event matching the filter in args until done is closed.
+func (b *eventBus) streamEvents(args map[string]string, send func(v interface{}) error, done <-chan struct{}) error {
+	f, err := parseEventFilter(args)
+	if err != nil {
+		return err
+	}
+
+	c := b.subscribe()
+	defer b.unsubscribe(c)
+
+	for {
+		select {
+		case e := <-c:
+			if !f.match(e) {
+				continue
+			}
+			if err := send(e); err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// formatEvent formats e as a single line of text.
+func formatEvent(e event) string {
+	fields := []string{e.Time.Format(time.RFC3339Nano), e.Type}
+	for _, f := range []struct{ key, value string }{
+		{"message", e.MessageID},
+		{"response-to", e.ResponseTo},
+		{"directive", e.Directive},
+		{"worker", e.Worker},
+	} {
+		if f.value != "" {
+			fields = append(fields, f.key+"="+f.value)
+		}
+	}
+	if e.PID != 0 {
+		fields = append(fields, fmt.Sprintf("pid=%v", e.PID))
+	}
+	if e.Digest != "" {
+		fields = append(fields, "digest="+e.Digest)
+	}
+	if e.Detail != "" {
+		fields = append(fields, fmt.Sprintf("detail=%q", e.Detail))
+	}
+	return strings.Join(fields, " ")
+}
+
+// eventsAction streams events from the running daemon and prints each as it
+// is received, until the daemon closes the connection.
+func eventsAction(c *cli.Context) error {
+	args := map[string]string{}
+	if len(c.StringSlice("type")) > 0 {
+		args["types"] = strings.Join(c.StringSlice("type"), ",")
+	}
+	if c.String("worker") != "" {
+		args["worker"] = c.String("worker")
+	}
+
+	err := streamControl(c.String("control-socket-addr"), "events", args, func(result json.RawMessage) error {
+		if c.Bool("json") {
+			fmt.Fprintln(c.App.Writer, string(result))
+			return nil
+		}
+		var e event
+		if err := json.Unmarshal(result, &e); err != nil {
+			return fmt.Errorf("cannot unmarshal event: %w", err)
+		}
+		fmt.Fprintln(c.App.Writer, formatEvent(e))
+		return nil
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	return nil
+}
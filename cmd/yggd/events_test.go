@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventFilter(t *testing.T) {
+	tests := []struct {
+		description string
+		args        map[string]string
+		input       event
+		want        bool
+		wantError   bool
+	}{
+		{
+			description: "no filter",
+			input:       event{Type: eventWorkerStarted, Worker: "echo-worker"},
+			want:        true,
+		},
+		{
+			description: "type matches",
+			args:        map[string]string{"types": eventWorkerStarted + "," + eventWorkerDied},
+			input:       event{Type: eventWorkerDied},
+			want:        true,
+		},
+		{
+			description: "type does not match",
+			args:        map[string]string{"types": eventWorkerStarted},
+			input:       event{Type: eventMessageReceived},
+		},
+		{
+			description: "worker does not match",
+			args:        map[string]string{"worker": "echo"},
+			input:       event{Type: eventMessageReceived, Worker: "sleep"},
+		},
+		{
+			description: "unsupported type",
+			args:        map[string]string{"types": "everything"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			f, err := parseEventFilter(test.args)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.match(test.input); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-control-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "control.sock")
+
+	bus := newEventBus()
+	s := newControlServer()
+	s.handleStream("events", bus.streamEvents)
+	go s.listenAndServe(addr)
+	defer s.close()
+
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Emit events until the subscriber has connected.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				bus.emit(event{Type: eventMessageReceived, MessageID: "1234", Worker: "sleep"})
+				bus.emit(event{Type: eventMessageReceived, MessageID: "5678", Worker: "echo"})
+			}
+		}
+	}()
+
+	var got []event
+	errDone := errors.New("done")
+	err = streamControl(addr, "events", map[string]string{"worker": "echo"}, func(result json.RawMessage) error {
+		var e event
+		if err := json.Unmarshal(result, &e); err != nil {
+			return err
+		}
+		got = append(got, e)
+		if len(got) == 2 {
+			return errDone
+		}
+		return nil
+	})
+	if err != errDone {
+		t.Fatal(err)
+	}
+	for _, e := range got {
+		if e.MessageID != "5678" || e.Time.IsZero() {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	}
+
+	if err := streamControl(addr, "events", map[string]string{"types": "bogus"}, func(json.RawMessage) error { return nil }); err == nil {
+		t.Errorf("expected error for unsupported event type")
+	}
+}
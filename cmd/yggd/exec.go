@@ -2,13 +2,19 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"git.sr.ht/~spc/go-log"
@@ -16,111 +22,774 @@ import (
 	"github.com/rjeczalik/notify"
 )
 
-func startProcess(file string, env []string, delay time.Duration, died chan int) {
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		log.Warnf("cannot start worker: %v", err)
-		return
+// startProcess starts the worker executable file, with the arguments in its
+// config, after an optional delay, and begins watching it for exit. It returns
+// the PID of the started process. A negative delay indicates the worker has
+// failed to start too many times and is not started.
+func startProcess(file string, env []string, delay time.Duration, died chan int) (int, error) {
+	if stoppingWorkers() {
+		return 0, errWorkersStopping
+	}
+	if err := checkWorkerExecutable(file); err != nil {
+		return 0, fmt.Errorf("cannot start worker: %w", err)
+	}
+
+	config, err := loadWorkerConfig(filepath.Base(file))
+	if err != nil {
+		return 0, fmt.Errorf("cannot load worker config: %w", err)
+	}
+
+	if err := checkActivation(config); err != nil {
+		return 0, err
+	}
+
+	exe, err := verifyWorkerIntegrity(file, config)
+	if err != nil {
+		if errors.Is(err, errWorkerIntegrity) {
+			metrics.add("worker_integrity_failures_total", 1)
+			events.emit(event{Type: eventWorkerRejected, Worker: filepath.Base(file), Detail: err.Error()})
+		}
+		return 0, err
+	}
+	if exe != nil {
+		defer exe.Close()
+	}
+
+	cred, err := config.credential()
+	if err != nil {
+		return 0, fmt.Errorf("cannot start worker: %w", err)
+	}
+	if cred != nil && !switchWorkerUsers {
+		return 0, fmt.Errorf("cannot start worker as user %v: cannot switch users", cred.Uid)
+	}
+
+	if err := config.prepareWorkingDirectory(cred); err != nil {
+		return 0, err
+	}
+
+	name := filepath.Base(file)
+	level, ok, _ := config.logLevel()
+	setConfiguredWorkerLogLevel(name, level, ok)
+	logger := workerLogger(name)
+	if ok {
+		env = withWorkerLogLevel(env, level)
+	}
+
+	args, err := config.args(env)
+	if err != nil {
+		return 0, err
 	}
 
-	cmd := exec.Command(file)
+	cmd := exec.Command(file, args...)
+	if exe != nil {
+		cmd.ExtraFiles = []*os.File{exe}
+		cmd.Path = verifiedExecutablePath
+	}
 	cmd.Env = env
+	cmd.Dir = config.WorkingDirectory
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
 
 	if delay < 0 {
-		log.Errorf("failed to start worker '%v' too many times", file)
-		return
+		return 0, fmt.Errorf("failed to start worker '%v' too many times", file)
 	}
 
 	if delay > 0 {
-		log.Tracef("delaying worker start for %v...", delay)
+		logger.Tracef("delaying worker start for %v...", delay)
 		time.Sleep(delay)
+		if stoppingWorkers() {
+			return 0, errWorkersStopping
+		}
 	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		log.Errorf("cannot connect to stdout: %v", err)
-		return
+		return 0, fmt.Errorf("cannot connect to stdout: %w", err)
 	}
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		log.Errorf("cannot connect to stderr: %v", err)
-		return
+		return 0, fmt.Errorf("cannot connect to stderr: %w", err)
 	}
 
-	if err := cmd.Start(); err != nil {
-		log.Errorf("cannot start worker: %v: %v", file, err)
-		return
+	logFile, err := config.openLogFile()
+	if isDiskFull(err) {
+		// A full disk must not keep the worker from starting; its output
+		// goes to the daemon's log until it is restarted with room for
+		// its own.
+		disk.full(workerLogComponent, err, false)
+		logFile = nil
+	} else if err != nil {
+		return 0, err
 	}
-	log.Debugf("started process: %v", cmd.Process.Pid)
 
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			log.Tracef("[%v] %v", file, scanner.Text())
+	if config.CPUQuota != "" || config.MemoryMax > 0 {
+		if err := applyCgroupLimits(cmd, file, config); err != nil {
+			if logFile != nil {
+				logFile.Close()
+			}
+			return 0, fmt.Errorf("cannot start worker: %w", err)
+		}
+	}
+
+	if err := startCommand(cmd, config); err != nil {
+		if logFile != nil {
+			logFile.Close()
+		}
+		return 0, fmt.Errorf("cannot start worker: %w", err)
+	}
+	if stoppingWorkers() {
+		// The daemon began stopping its workers while this one started,
+		// possibly too late to find it.
+		if err := cmd.Process.Kill(); err != nil {
+			log.Errorf("cannot kill process %v: %v", cmd.Process.Pid, err)
 		}
-		if err := scanner.Err(); err != nil {
-			log.Errorf("cannot read from stdout: %v", err)
+		cmd.Wait()
+		if logFile != nil {
+			logFile.Close()
 		}
-	}()
+		return 0, errWorkersStopping
+	}
+	logger.Debugf("started process: %v", cmd.Process.Pid)
+	workerNames.Store(cmd.Process.Pid, name)
+	events.emit(event{Type: eventWorkerStarted, Worker: filepath.Base(file), PID: cmd.Process.Pid})
 
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			log.Errorf("[%v] %v", file, scanner.Text())
+	if config.CPUAffinity != "" {
+		if err := applyCPUAffinity(cmd, file, config); err != nil {
+			if logFile != nil {
+				logFile.Close()
+			}
+			return 0, fmt.Errorf("cannot start worker: %w", err)
 		}
-		if err := scanner.Err(); err != nil {
-			log.Errorf("cannot read from stderr: %v", err)
+	}
+
+	if config.Nice != nil {
+		if err := applyNice(cmd, file, *config.Nice); err != nil {
+			if logFile != nil {
+				logFile.Close()
+			}
+			return 0, fmt.Errorf("cannot start worker: %w", err)
 		}
-	}()
+	}
+
+	if logFile != nil {
+		logger.Infof("writing output of worker %v to %v", file, config.LogFile)
+		size, interval, _ := config.logBuffer()
+		go captureWorkerOutput(newWorkerLog(logFile, size, interval), stdout, stderr)
+	} else {
+		go func() {
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				logger.Tracef("[%v] %v", file, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				log.Errorf("cannot read from stdout: %v", err)
+			}
+		}()
+
+		go func() {
+			scanner := bufio.NewScanner(stderr)
+			for scanner.Scan() {
+				logger.Errorf("[%v] %v", file, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				log.Errorf("cannot read from stderr: %v", err)
+			}
+		}()
+	}
+
+	workerRestarts.started(name)
+
+	if sequence, _ := config.stopSequence(); sequence != nil {
+		stopSequences.Store(cmd.Process.Pid, sequence)
+	}
+	if timeout, ok, _ := config.assignmentTimeout(); ok {
+		assignmentTimeouts.Store(cmd.Process.Pid, timeout)
+	}
+
+	if lifetime, _ := config.maxLifetime(); lifetime > 0 {
+		exited := make(chan struct{})
+		go func() {
+			watchProcess(cmd, file, delay, died)
+			close(exited)
+		}()
+		go recycleProcess(cmd.Process.Pid, file, config, time.Now(), exited)
+	} else {
+		go watchProcess(cmd, file, delay, died)
+	}
+
+	if !writePIDFiles {
+		return cmd.Process.Pid, nil
+	}
 
-	pidDirPath := filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "workers")
+	pidDirPath := workerPIDDir()
 
 	if err := os.MkdirAll(pidDirPath, 0755); err != nil {
-		log.Errorf("cannot create directory: %v", err)
-		return
+		return 0, fmt.Errorf("cannot create directory: %w", err)
 	}
 
 	if err := ioutil.WriteFile(filepath.Join(pidDirPath, filepath.Base(file)+".pid"), []byte(fmt.Sprintf("%v", cmd.Process.Pid)), 0644); err != nil {
-		log.Errorf("cannot write to file: %v", err)
-		return
+		return 0, fmt.Errorf("cannot write to file: %w", err)
 	}
 
-	go watchProcess(cmd, delay, died)
+	return cmd.Process.Pid, nil
 }
 
-func watchProcess(cmd *exec.Cmd, delay time.Duration, died chan int) {
-	log.Debugf("watching process: %v", cmd.Process.Pid)
+// switchWorkerUsers is false if the daemon cannot switch users, in which case
+// workers configured with a user or group are not started.
+var switchWorkerUsers = true
 
-	state, err := cmd.Process.Wait()
+// writePIDFiles is false if worker PID files are not written, in which case
+// orphaned workers are not killed at startup and the process of a removed
+// worker executable is not stopped.
+var writePIDFiles = true
+
+// workerPIDDir returns the directory in which worker PID files are written.
+func workerPIDDir() string {
+	return filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "workers")
+}
+
+// workerLogComponent names the worker log files in the disk state.
+const workerLogComponent = "worker log"
+
+// captureWorkerOutput writes each line read from stdout and stderr to w,
+// closing w once both are exhausted.
+func captureWorkerOutput(w io.WriteCloser, stdout io.Reader, stderr io.Reader) {
+	var wg sync.WaitGroup
+	for _, r := range []io.Reader{stdout, stderr} {
+		wg.Add(1)
+		go func(r io.Reader) {
+			defer wg.Done()
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				if _, err := fmt.Fprintln(w, scanner.Text()); err != nil {
+					log.Errorf("cannot write to worker log file: %v", err)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				log.Errorf("cannot read worker output: %v", err)
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	if err := w.Close(); err != nil {
+		log.Errorf("cannot close worker log file: %v", err)
+	}
+}
+
+// A workerBootstrapError lists the workers that could not be started during
+// bootstrap along with the reason each one failed.
+type workerBootstrapError struct {
+	failures map[string]error
+}
+
+func (e *workerBootstrapError) Error() string {
+	names := make([]string, 0, len(e.failures))
+	for name := range e.failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reasons := make([]string, 0, len(names))
+	for _, name := range names {
+		reasons = append(reasons, fmt.Sprintf("%v: %v", name, e.failures[name]))
+	}
+	return fmt.Sprintf("cannot start %v of the workers: %v", len(names), strings.Join(reasons, "; "))
+}
+
+// A workerStartupTimeoutError is the reason a worker failed to start when it
+// did not register within its startup timeout.
+type workerStartupTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *workerStartupTimeoutError) Error() string {
+	return fmt.Sprintf("startup-timeout: worker did not register within %v", e.timeout)
+}
+
+// checkWorkerExecutable returns an error if file does not exist or is not an
+// executable regular file, so that a worker that cannot be run is not started.
+func checkWorkerExecutable(file string) error {
+	info, err := os.Stat(file)
 	if err != nil {
-		log.Errorf("process %v exited with error: %v", cmd.Process.Pid, err)
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%v: not a regular file", file)
 	}
+	if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%v: not executable", file)
+	}
+	return nil
+}
 
-	died <- state.Pid()
+// waitForStartup waits until the worker process pid has registered, as
+// reported by registered, or returns a *workerStartupTimeoutError once timeout
+// elapses. If ctx is done first, the error of ctx is returned.
+func waitForStartup(ctx context.Context, pid int, timeout time.Duration, registered func(pid int) bool) error {
+	deadline := time.Now().Add(timeout)
+	for !registered(pid) {
+		if time.Now().After(deadline) {
+			return &workerStartupTimeoutError{timeout: timeout}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
 
-	if state.SystemTime() < time.Duration(1*time.Second) {
-		delay += 5 * time.Second
+// findWorkers returns the names of the worker executables in dir.
+func findWorkers(dir string) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read contents of directory: %w", err)
 	}
-	if delay >= time.Duration(30*time.Second) {
-		delay = -1
+
+	workers := make([]string, 0, len(fileInfos))
+	for _, info := range fileInfos {
+		if strings.HasSuffix(info.Name(), "worker") {
+			workers = append(workers, info.Name())
+		}
 	}
+	return workers, nil
+}
 
-	go startProcess(cmd.Path, cmd.Env, delay, died)
+// checkWorkersFound returns an error if dir holds no worker executables and
+// require is true. Otherwise, it only logs a warning that there are none: the
+// daemon stays connected without them, and data messages received before a
+// worker registers are undeliverable.
+func checkWorkersFound(dir string, require bool) error {
+	workers, err := findWorkers(dir)
+	if err != nil {
+		return fmt.Errorf("cannot find workers: %w", err)
+	}
+	if len(workers) > 0 {
+		return nil
+	}
+	if require {
+		return fmt.Errorf("no workers found in %v", dir)
+	}
+	log.Warnf("no workers found in %v; data messages are undeliverable until a worker is installed", dir)
+	return nil
 }
 
-func killProcess(pid int) error {
-	process, err := os.FindProcess(int(pid))
+// bootstrapWorkers starts every worker executable found in dir, starting at
+// most parallelism workers at a time (or all at once if parallelism is less
+// than 1), and returns the names of the workers started. If startupTimeout
+// (or the startup-timeout of a worker's config) is not 0, each worker must
+// also register, as reported by registered, within that time of being
+// launched; a worker that does not is stopped and fails to start. A worker
+// whose activation condition is not met is not started, and is neither
+// started nor failed. A worker failing to start does not prevent the others
+// from starting; if any fail, a *workerBootstrapError describing them is
+// returned.
+//
+// If ctx is done before every worker is started, no further worker is
+// launched and a worker waiting to register is stopped. bootstrapWorkers still
+// returns only once the workers already launched are started or stopped, so
+// that none is left starting behind the caller's back; the error of ctx is
+// returned along with the workers started.
+func bootstrapWorkers(ctx context.Context, dir string, env []string, parallelism int, startupTimeout time.Duration, registered func(pid int) bool, died chan int) ([]string, error) {
+	workers, err := findWorkers(dir)
 	if err != nil {
-		return fmt.Errorf("cannot find process with pid: %w", err)
+		return nil, err
 	}
-	if err := process.Kill(); err != nil {
-		log.Errorf("cannot kill process: %v", err)
-	} else {
-		log.Infof("killed process %v", process.Pid)
+	if parallelism < 1 {
+		parallelism = len(workers)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		failures = make(map[string]error)
+		skipped  = make(map[string]bool)
+		launched = make(map[string]bool)
+		sem      = make(chan struct{}, parallelism)
+	)
+launch:
+	for _, name := range workers {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break launch
+		}
+		if ctx.Err() != nil {
+			<-sem
+			break launch
+		}
+		launched[name] = true
+		wg.Add(1)
+		go func(name string) {
+			defer func() { <-sem; wg.Done() }()
+
+			log.Debugf("starting worker: %v", name)
+			err := bootstrapStart(ctx, dir, name, env, startupTimeout, registered, died)
+			switch {
+			case ctx.Err() != nil && err != nil:
+				log.Infof("aborted start of worker '%v': %v", name, err)
+				lock.Lock()
+				skipped[name] = true
+				lock.Unlock()
+			case errors.Is(err, errWorkerNotActivated):
+				log.Infof("not starting worker '%v': %v", name, err)
+				lock.Lock()
+				skipped[name] = true
+				lock.Unlock()
+			case err != nil:
+				log.Errorf("cannot start worker '%v': %v", name, err)
+				lock.Lock()
+				failures[name] = err
+				lock.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	started := make([]string, 0, len(workers))
+	for _, name := range workers {
+		if _, failed := failures[name]; launched[name] && !failed && !skipped[name] {
+			started = append(started, name)
+		}
 	}
+
+	if err := ctx.Err(); err != nil {
+		return started, err
+	}
+
+	if len(failures) > 0 {
+		return started, &workerBootstrapError{failures: failures}
+	}
+	return started, nil
+}
+
+// bootstrapStart starts each worker for bootstrapWorkers. It is startWorker,
+// replaced in tests.
+var bootstrapStart = startWorker
+
+// startWorker starts the worker executable name in dir and, if it has a
+// startup timeout, waits for it to register, stopping it if it does not or if
+// ctx is done first.
+func startWorker(ctx context.Context, dir string, name string, env []string, startupTimeout time.Duration, registered func(pid int) bool, died chan int) error {
+	config, err := loadWorkerConfig(name)
+	if err != nil {
+		return fmt.Errorf("cannot load worker config: %w", err)
+	}
+	timeout, err := config.startupTimeout()
+	if err != nil {
+		return err
+	}
+	if timeout == 0 {
+		timeout = startupTimeout
+	}
+
+	pid, err := startProcess(filepath.Join(dir, name), env, 0, died)
+	if err != nil {
+		return err
+	}
+	if timeout == 0 {
+		return nil
+	}
+
+	if err := waitForStartup(ctx, pid, timeout, registered); err != nil {
+		if err := retireProcess(pid); err != nil {
+			log.Errorf("cannot stop worker '%v': %v", name, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// umaskTrampolineArg, as the first argument of the daemon's executable, runs
+// it as the trampoline that applies a worker's umask and executes it.
+const umaskTrampolineArg = "__yggd-umask-trampoline"
+
+// startCommand starts cmd, applying the umask from config (if any) to the
+// worker process alone: the umask is shared by every thread of the daemon, so
+// rather than changing it around the start, cmd is made to run the daemon's
+// executable as a trampoline that sets the umask and only then executes the
+// worker.
+func startCommand(cmd *exec.Cmd, config *workerConfig) error {
+	if config.Umask != "" {
+		mask, err := config.umask()
+		if err != nil {
+			return err
+		}
+		umaskTrampoline(cmd, mask)
+	}
+
+	return cmd.Start()
+}
+
+// umaskTrampoline makes cmd run the daemon's executable as a trampoline that
+// sets the umask to mask and then executes the path and arguments cmd was set
+// up to run.
+func umaskTrampoline(cmd *exec.Cmd, mask int) {
+	cmd.Args = append([]string{cmd.Args[0], umaskTrampolineArg, fmt.Sprintf("%04o", mask), cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+}
+
+// runUmaskTrampoline runs the trampoline set up by umaskTrampoline, with args
+// following umaskTrampolineArg: it sets the umask and executes the command. It
+// does not return.
+func runUmaskTrampoline(args []string) {
+	if err := umaskTrampolineExec(args); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot start worker with umask: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func umaskTrampolineExec(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("missing arguments")
+	}
+	mask, err := (&workerConfig{Umask: args[0]}).umask()
+	if err != nil {
+		return err
+	}
+	path, argv := args[1], args[2:]
+
+	syscall.Umask(mask)
+	if err := syscall.Exec(path, argv, os.Environ()); err != nil {
+		return fmt.Errorf("cannot execute %v: %w", argv[0], err)
+	}
+	return nil
+}
+
+// errAffinityUnsupported is returned by setCPUAffinity on platforms that do
+// not support CPU affinity.
+var errAffinityUnsupported = errors.New("CPU affinity is not supported on this platform")
+
+// applyCPUAffinity restricts the started process of cmd, running the worker
+// file, to the CPU cores in config. If the cores cannot be applied, the
+// process is killed. On platforms without CPU affinity, a warning is logged and
+// the process runs unrestricted.
+func applyCPUAffinity(cmd *exec.Cmd, file string, config *workerConfig) error {
+	cpus, err := config.cpus()
+	if err == nil {
+		err = setCPUAffinity(cmd.Process.Pid, cpus)
+	}
+	if errors.Is(err, errAffinityUnsupported) {
+		log.Warnf("ignoring cpu-affinity of worker %v: %v", file, err)
+		return nil
+	}
+	if err != nil {
+		if err := cmd.Process.Kill(); err != nil {
+			log.Errorf("cannot kill process %v: %v", cmd.Process.Pid, err)
+		}
+		cmd.Wait()
+		return err
+	}
+	log.Debugf("restricted process %v to CPU cores %v", cmd.Process.Pid, cpus)
+	return nil
+}
+
+// errNiceUnsupported is returned by setNice on platforms that do not support
+// setting the nice value of workers.
+var errNiceUnsupported = errors.New("setting the nice value is not supported on this platform")
+
+// applyNice sets the nice value of the started process of cmd, running the
+// worker file. If it cannot be set, the process is killed. On platforms without
+// setpriority, a warning is logged and the process runs at the daemon's nice
+// value.
+func applyNice(cmd *exec.Cmd, file string, nice int) error {
+	err := setNice(cmd.Process.Pid, nice)
+	if errors.Is(err, errNiceUnsupported) {
+		log.Warnf("ignoring nice of worker %v: %v", file, err)
+		return nil
+	}
+	if err != nil {
+		if err := cmd.Process.Kill(); err != nil {
+			log.Errorf("cannot kill process %v: %v", cmd.Process.Pid, err)
+		}
+		cmd.Wait()
+		return err
+	}
+	log.Debugf("set nice value of process %v to %v", cmd.Process.Pid, nice)
+	return nil
+}
+
+// errCgroupUnsupported is returned by prepareCgroup on platforms that do not
+// support cgroups.
+var errCgroupUnsupported = errors.New("cgroups are not supported on this platform")
+
+// workerCgroupsEnabled is false if the daemon cannot set up worker cgroups,
+// in which case workers run without their cpu-quota and memory-max.
+var workerCgroupsEnabled = true
+
+// cgroupTrampolineArg, as the first argument of the daemon's executable, runs
+// it as the trampoline that joins a worker to its cgroup and executes it.
+const cgroupTrampolineArg = "__yggd-cgroup-trampoline"
+
+// applyCgroupLimits prepares a cgroup that limits the CPU and memory use of
+// the worker file as in config, and has cmd start the worker in it: cmd is
+// made to run the daemon's executable as a trampoline that joins the cgroup,
+// switches to the worker's credentials and only then executes the worker, so
+// that the worker never runs outside the cgroup. On platforms without cgroups,
+// a warning is logged and the worker runs unlimited.
+func applyCgroupLimits(cmd *exec.Cmd, file string, config *workerConfig) error {
+	if !workerCgroupsEnabled {
+		log.Warnf("ignoring cpu-quota and memory-max of worker %v: worker cgroups cannot be set up", file)
+		return nil
+	}
+	var quota int
+	var err error
+	if config.CPUQuota != "" {
+		quota, err = config.cpuQuota()
+	}
+	var dir string
+	if err == nil {
+		dir, err = prepareCgroup(filepath.Base(file), quota, config.MemoryMax)
+	}
+	if errors.Is(err, errCgroupUnsupported) {
+		log.Warnf("ignoring cpu-quota and memory-max of worker %v: %v", file, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cgroupTrampoline(cmd, dir)
+	log.Debugf("limiting worker %v to cpu-quota %v and memory-max %v", file, config.CPUQuota, config.MemoryMax)
 	return nil
 }
 
+func watchProcess(cmd *exec.Cmd, file string, delay time.Duration, died chan int) {
+	logger := processLogger(cmd.Process.Pid)
+	logger.Debugf("watching process: %v", cmd.Process.Pid)
+
+	state, err := cmd.Process.Wait()
+	if err != nil {
+		logger.Errorf("process %v exited with error: %v", cmd.Process.Pid, err)
+	}
+
+	events.emit(event{Type: eventWorkerDied, Worker: filepath.Base(file), PID: state.Pid(), Detail: state.String()})
+	// The assignments of the process are forgotten once it is
+	// unregistered, so they are collected first.
+	lost := lostAssignments(state.Pid())
+	died <- state.Pid()
+	stopSequences.Delete(state.Pid())
+	assignmentTimeouts.Delete(state.Pid())
+
+	// A retired process has been replaced by a newer one and is not
+	// restarted.
+	if _, retired := retiredProcesses.Load(state.Pid()); retired {
+		retiredProcesses.Delete(state.Pid())
+		return
+	}
+
+	// Workers stopped for the daemon to exit are not restarted.
+	if stoppingWorkers() {
+		return
+	}
+
+	// A recycled process was stopped on purpose and is restarted at once.
+	_, recycled := recycledProcesses.Load(state.Pid())
+	if recycled {
+		recycledProcesses.Delete(state.Pid())
+		delay = 0
+	} else {
+		policy := restartPolicy(filepath.Base(file))
+		restart := restartsAfter(policy, state)
+		if !restart {
+			delay = -1
+		} else {
+			if state.SystemTime() < time.Duration(1*time.Second) {
+				delay = nextRestartBackoff(delay)
+			}
+			if delay >= restartBackoffLimit {
+				delay = -1
+			}
+			if workerRestarts.exited(filepath.Base(file), state.String()) {
+				delay = -1
+			}
+			if delay < 0 {
+				events.emit(event{Type: eventWorkerUnhealthy, Worker: filepath.Base(file), PID: state.Pid(), Detail: state.String()})
+			}
+		}
+		workerExited(workerExit{
+			worker:     filepath.Base(file),
+			pid:        state.Pid(),
+			reason:     state.String(),
+			restarting: delay >= 0,
+			lost:       lost,
+		})
+		if !restart {
+			logger.Infof("not restarting worker %v after %v: restart policy is %v", file, state, policy)
+			return
+		}
+	}
+
+	if delay >= 0 {
+		metrics.addSeries("worker_restarts_total", []metricLabel{{"worker", filepath.Base(file)}}, 1)
+	}
+	go func() {
+		// The restart delay is a floor on the wait before restarting: the
+		// worker waits for it less the backoff startProcess waits for, which
+		// keeps counting crash loops unchanged. A config that cannot be
+		// loaded is reported by startProcess.
+		if config, err := loadWorkerConfig(filepath.Base(file)); err == nil && delay >= 0 {
+			if wait := restartWait(config, delay); wait > 0 {
+				logger.Debugf("delaying restart of worker %v for %v", file, wait)
+				time.Sleep(wait)
+			}
+		}
+		if jitter := restartJitter(); !recycled && delay >= 0 && jitter > 0 {
+			logger.Debugf("delaying restart of worker %v by a jitter of %v", file, jitter)
+			time.Sleep(jitter)
+		}
+		// The daemon may have begun stopping its workers while this one
+		// waited; startProcess checks again after the backoff.
+		if stoppingWorkers() {
+			return
+		}
+		if _, err := startProcess(file, cmd.Env, delay, died); errors.Is(err, errWorkersStopping) {
+			logger.Debugf("not restarting worker %v: %v", file, err)
+		} else if err != nil {
+			logger.Errorf("cannot restart worker '%v': %v", file, err)
+		}
+	}()
+}
+
+// restartBackoffBase is the crash-loop backoff of a worker after its first
+// quick exit. It doubles with each quick exit that follows.
+const restartBackoffBase = 5 * time.Second
+
+// restartBackoffLimit is the crash-loop backoff at which a worker is no longer
+// restarted, reached on its sixth quick exit.
+const restartBackoffLimit = 160 * time.Second
+
+// nextRestartBackoff returns the crash-loop backoff that follows backoff after
+// another quick exit.
+func nextRestartBackoff(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return restartBackoffBase
+	}
+	return 2 * backoff
+}
+
+// restartWait returns how much longer than backoff a worker with config must
+// wait before it is restarted, for its restart delay to elapse.
+func restartWait(config *workerConfig, backoff time.Duration) time.Duration {
+	floor, _ := config.restartDelay()
+	if floor <= backoff {
+		return 0
+	}
+	return floor - backoff
+}
+
+// retiredProcesses holds the PIDs of worker processes stopped by retireProcess.
+var retiredProcesses sync.Map
+
+// retireProcess stops the worker process pid without restarting it.
+func retireProcess(pid int) error {
+	retiredProcesses.Store(pid, true)
+	return killProcess(pid)
+}
+
 func killWorker(pidFile string) error {
 	data, err := ioutil.ReadFile(pidFile)
 	if err != nil {
@@ -142,7 +811,11 @@ func killWorker(pidFile string) error {
 }
 
 func killWorkers() error {
-	pidDirPath := filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "workers")
+	if !writePIDFiles {
+		return nil
+	}
+
+	pidDirPath := workerPIDDir()
 	if err := os.MkdirAll(pidDirPath, 0755); err != nil {
 		return fmt.Errorf("cannot create directory: %w", err)
 	}
@@ -151,13 +824,24 @@ func killWorkers() error {
 		return fmt.Errorf("cannot read contents of directory: %w", err)
 	}
 
-	for _, info := range fileInfos {
-		pidFilePath := filepath.Join(pidDirPath, info.Name())
-		if err := killWorker(pidFilePath); err != nil {
+	// The workers are stopped at once, so that the waits of their stop
+	// sequences overlap.
+	var wg sync.WaitGroup
+	errs := make([]error, len(fileInfos))
+	for i, info := range fileInfos {
+		wg.Add(1)
+		go func(i int, pidFilePath string) {
+			defer wg.Done()
+			errs[i] = killWorker(pidFilePath)
+		}(i, filepath.Join(pidDirPath, info.Name()))
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
 			return fmt.Errorf("cannot kill worker: %w", err)
 		}
 	}
-
 	return nil
 }
 
@@ -176,11 +860,23 @@ func watchWorkerDir(dir string, env []string, died chan int) {
 		case notify.InCloseWrite, notify.InMovedTo:
 			if strings.HasSuffix(e.Path(), "worker") {
 				log.Tracef("new worker detected: %v", e.Path())
-				go startProcess(e.Path(), env, 0, died)
+				go func(file string) {
+					_, err := startProcess(file, env, 0, died)
+					switch {
+					case errors.Is(err, errWorkerNotActivated):
+						log.Infof("not starting worker '%v': %v", file, err)
+					case err != nil:
+						log.Errorf("cannot start worker '%v': %v", file, err)
+					}
+				}(e.Path())
 			}
 		case notify.InDelete, notify.InMovedFrom:
 			workerName := filepath.Base(e.Path())
-			pidFilePath := filepath.Join(yggdrasil.LocalstateDir, "run", yggdrasil.LongName, "workers", workerName+".pid")
+			if !writePIDFiles {
+				log.Warnf("cannot stop worker %v: worker PID files are not written", workerName)
+				continue
+			}
+			pidFilePath := filepath.Join(workerPIDDir(), workerName+".pid")
 
 			if err := killWorker(pidFilePath); err != nil {
 				log.Errorf("cannot kill worker: %v", err)
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// A componentError is an error that causes the daemon to exit, attributed to
+// the component of the daemon it occurred in.
+type componentError struct {
+	component string
+	err       error
+}
+
+// exitError returns an error that causes the daemon to exit with status 1,
+// recording component as the source of err.
+func exitError(component string, err error) error {
+	return &componentError{component: component, err: err}
+}
+
+func (e *componentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *componentError) Unwrap() error {
+	return e.err
+}
+
+// ExitCode implements cli.ExitCoder.
+func (e *componentError) ExitCode() int {
+	return 1
+}
+
+// An exitRecord describes why the daemon exited. A record without an error
+// describes a clean shutdown.
+type exitRecord struct {
+	Time      time.Time `json:"time"`
+	Component string    `json:"component,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// newExitRecord creates a record of the daemon exiting with err, which may be
+// nil.
+func newExitRecord(err error) exitRecord {
+	r := exitRecord{Time: time.Now().UTC()}
+	if err == nil {
+		return r
+	}
+
+	r.Component = "main"
+	var ce *componentError
+	if errors.As(err, &ce) {
+		r.Component = ce.component
+	}
+	r.Error = err.Error()
+	return r
+}
+
+func (r exitRecord) String() string {
+	if r.Error == "" {
+		return fmt.Sprintf("exited cleanly at %v", r.Time.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("exited at %v with error in %v: %v", r.Time.Format(time.RFC3339), r.Component, r.Error)
+}
+
+// reportExit logs record and, if file is not empty, writes it to file so that
+// it can be read after the daemon restarts.
+func reportExit(record exitRecord, file string) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("cannot marshal exit record: %v", err)
+		return
+	}
+
+	if record.Error != "" {
+		log.Errorf("exit record: %s", data)
+	} else {
+		log.Infof("exit record: %s", data)
+	}
+
+	if file == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		log.Errorf("cannot create directory: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(file, append(data, '\n'), 0644); err != nil {
+		log.Errorf("cannot write exit record: %v", err)
+	}
+}
+
+// readExitRecord reads the record written by a previous instance of the
+// daemon to file. It returns nil if the file does not exist.
+func readExitRecord(file string) (*exitRecord, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read exit record: %w", err)
+	}
+
+	var record exitRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal exit record: %w", err)
+	}
+	return &record, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewExitRecord(t *testing.T) {
+	tests := []struct {
+		description   string
+		input         error
+		wantComponent string
+		wantError     string
+	}{
+		{
+			description: "clean exit",
+		},
+		{
+			description:   "component error",
+			input:         exitError("transport", errors.New("cannot connect")),
+			wantComponent: "transport",
+			wantError:     "cannot connect",
+		},
+		{
+			description:   "wrapped component error",
+			input:         fmt.Errorf("fatal: %w", exitError("workers", errors.New("no workers"))),
+			wantComponent: "workers",
+			wantError:     "fatal: no workers",
+		},
+		{
+			description:   "other error",
+			input:         errors.New("unexpected"),
+			wantComponent: "main",
+			wantError:     "unexpected",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := newExitRecord(test.input)
+			if got.Component != test.wantComponent {
+				t.Errorf("%q != %q", got.Component, test.wantComponent)
+			}
+			if got.Error != test.wantError {
+				t.Errorf("%q != %q", got.Error, test.wantError)
+			}
+		})
+	}
+}
+
+func TestReportExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state", "last-exit.json")
+
+	got, err := readExitRecord(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Fatalf("expected no record, got %+v", got)
+	}
+
+	want := newExitRecord(exitError("spool", errors.New("cannot create spool")))
+	reportExit(want, file)
+
+	got, err = readExitRecord(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || !got.Time.Equal(want.Time) || got.Component != want.Component || got.Error != want.Error {
+		t.Errorf("%+v != %+v", got, want)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"google.golang.org/grpc/stats"
+)
+
+// externalWorkerIDBase is the first of the IDs given in place of a PID to
+// workers registered over the external registration socket. It is above the
+// largest PID Linux allocates (pid_max is at most 2^22), so that no process is
+// ever signalled or inspected with the ID of an external worker, and the PIDs
+// workers in other PID namespaces report cannot collide.
+const externalWorkerIDBase = 1 << 30
+
+// isExternalWorker returns true if pid is the ID of a worker registered over
+// the external registration socket rather than the PID of a process.
+func isExternalWorker(pid int) bool {
+	return pid >= externalWorkerIDBase
+}
+
+// An externalConn is a connection to the external registration socket, with
+// the IDs of the workers registered over it.
+type externalConn struct {
+	lock sync.Mutex
+	ids  []int
+}
+
+// add records that the worker id registered over c. It does nothing if c is
+// nil.
+func (c *externalConn) add(id int) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ids = append(c.ids, id)
+}
+
+type externalConnKey struct{}
+
+// externalConnFromContext returns the external registration connection a
+// call was made over, or nil if it was made over the dispatcher socket.
+func externalConnFromContext(ctx context.Context) *externalConn {
+	c, _ := ctx.Value(externalConnKey{}).(*externalConn)
+	return c
+}
+
+// An externalRegistry lets long-running processes that yggd did not start
+// register as workers over a unix socket, the external registration socket.
+// Each worker is given an ID in place of its PID, and an address in the
+// directory of the socket to listen on, so that a worker in a container can
+// be reached through the same mounted directory. It is a gRPC stats handler
+// tracking the connections to the socket: once one closes, the workers
+// registered over it are unregistered.
+type externalRegistry struct {
+	dir        string
+	lastID     int64
+	unregister chan<- int
+}
+
+func newExternalRegistry(socket string, unregister chan<- int) *externalRegistry {
+	return &externalRegistry{
+		dir:        filepath.Dir(socket),
+		lastID:     externalWorkerIDBase - 1,
+		unregister: unregister,
+	}
+}
+
+// worker returns the ID and address of a worker registering for handler over
+// the connection of ctx. ok is false if r is nil or the worker is registering
+// over the dispatcher socket. An error is returned if handler cannot name a
+// socket in the directory of the registration socket.
+func (r *externalRegistry) worker(ctx context.Context, handler string) (id int, addr string, ok bool, err error) {
+	if r == nil || externalConnFromContext(ctx) == nil {
+		return 0, "", false, nil
+	}
+	if strings.Contains(handler, "/") || strings.Contains(handler, "..") {
+		return 0, "", true, fmt.Errorf("invalid handler: %q", handler)
+	}
+	id = int(atomic.AddInt64(&r.lastID, 1))
+	addr = filepath.Join(r.dir, fmt.Sprintf("ygg-%v-%v.sock", handler, randomString(6)))
+	return id, addr, true, nil
+}
+
+// listen listens on the unix socket path, handling an address already in use
+// according to action, and allows the owner and group of the daemon to
+// connect to it.
+func (r *externalRegistry) listen(path string, action string, timeout time.Duration) (net.Listener, error) {
+	l, err := listenDispatcher(path, action, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("cannot set socket permissions: %w", err)
+	}
+	return l, nil
+}
+
+func (r *externalRegistry) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	return context.WithValue(ctx, externalConnKey{}, &externalConn{})
+}
+
+// HandleConn unregisters the workers registered over a connection once it
+// closes.
+func (r *externalRegistry) HandleConn(ctx context.Context, s stats.ConnStats) {
+	if _, ok := s.(*stats.ConnEnd); !ok {
+		return
+	}
+	c := externalConnFromContext(ctx)
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	ids := c.ids
+	c.ids = nil
+	c.lock.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+	log.Infof("external worker connection closed; unregistering %v workers", len(ids))
+	go func() {
+		for _, id := range ids {
+			r.unregister <- id
+		}
+	}()
+}
+
+func (r *externalRegistry) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (r *externalRegistry) HandleRPC(ctx context.Context, s stats.RPCStats) {}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"google.golang.org/grpc"
+)
+
+func TestExternalWorkerRegistration(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "workers.sock")
+
+	d := newDispatcher(nil)
+	d.external = newExternalRegistry(socket, d.deadWorkers)
+	go d.unregisterWorker()
+	updates := make(chan map[string]map[string]string, 4)
+	go func() {
+		for m := range d.dispatchers {
+			updates <- m
+		}
+	}()
+
+	l, err := d.external.listen(socket, addrInUseFail, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(grpc.StatsHandler(d.external))
+	pb.RegisterDispatcherServer(s, d)
+	go s.Serve(l)
+	defer s.Stop()
+
+	conn, err := grpc.Dial("unix:"+socket, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := pb.NewDispatcherClient(conn)
+	var addrs []string
+	for _, handler := range []string{"echo", "sleep"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		r, err := c.Register(ctx, &pb.RegistrationRequest{Handler: handler, Pid: 1, Features: map[string]string{"version": "1"}})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.GetRegistered() {
+			t.Fatalf("worker not registered for %v", handler)
+		}
+		addrs = append(addrs, r.GetAddress())
+		<-updates
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	r, err := c.Register(ctx, &pb.RegistrationRequest{Handler: "../escape", Pid: 1})
+	cancel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.GetRegistered() {
+		t.Errorf("worker registered for a handler naming another directory")
+	}
+
+	for _, addr := range addrs {
+		if filepath.Dir(addr) != dir || !strings.HasSuffix(addr, ".sock") {
+			t.Errorf("worker address not in socket directory: %v", addr)
+		}
+	}
+	want := map[string]map[string]string{"echo": {"version": "1"}, "sleep": {"version": "1"}}
+	if got := d.Dispatchers(); !cmp.Equal(got, want) {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+	d.RLock()
+	for _, w := range d.workers {
+		if !isExternalWorker(w.pid) {
+			t.Errorf("worker %v registered with PID %v", w.handler, w.pid)
+		}
+	}
+	d.RUnlock()
+
+	conn.Close()
+	for range addrs {
+		select {
+		case <-updates:
+		case <-time.After(5 * time.Second):
+			t.Fatal("workers not unregistered")
+		}
+	}
+	if got := d.Dispatchers(); len(got) != 0 {
+		t.Errorf("workers still registered: %v", got)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// factsAction collects the canonical facts exactly as they would be published
+// in a connection-status message and prints them to the application writer
+// as JSON. No broker connection is made. Facts that cannot be collected are
+// reported on the application's error writer.
+func factsAction(c *cli.Context) error {
+	facts, err := yggdrasil.GetCanonicalFacts()
+	if err != nil {
+		if facts == nil {
+			return cli.Exit(fmt.Errorf("cannot get canonical facts: %w", err), 1)
+		}
+		fmt.Fprintf(c.App.ErrWriter, "warning: %v\n", err)
+	}
+
+	data, err := marshalFacts(facts, c.String("key"), c.Bool("pretty"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	fmt.Fprintln(c.App.Writer, string(data))
+
+	return nil
+}
+
+// marshalFacts encodes facts as JSON. If key is non-zero, only the value of
+// the fact with that JSON key is encoded.
+func marshalFacts(facts *yggdrasil.CanonicalFacts, key string, pretty bool) ([]byte, error) {
+	var v interface{} = facts
+	if key != "" {
+		data, err := json.Marshal(facts)
+		if err != nil {
+			return nil, fmt.Errorf("cannot marshal facts: %w", err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal facts: %w", err)
+		}
+		val, ok := m[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown fact: %v", key)
+		}
+		v = val
+	}
+
+	if pretty {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+// A factsRefresher debounces requests to refresh the canonical facts, so that
+// refresh runs at most once per interval however often it is requested.
+// Requests made within interval of the last refresh collapse into a single
+// refresh, run once the interval has elapsed.
+type factsRefresher struct {
+	interval time.Duration
+	refresh  func()
+
+	lock    sync.Mutex
+	last    time.Time
+	pending bool
+}
+
+func newFactsRefresher(interval time.Duration, refresh func()) *factsRefresher {
+	return &factsRefresher{
+		interval: interval,
+		refresh:  refresh,
+	}
+}
+
+// request requests a refresh. It returns false if the request collapsed into
+// a refresh that is already scheduled.
+func (r *factsRefresher) request() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.pending {
+		return false
+	}
+	r.pending = true
+
+	delay := r.last.Add(r.interval).Sub(time.Now())
+	if delay < 0 {
+		delay = 0
+	}
+	time.AfterFunc(delay, r.run)
+	return true
+}
+
+// run refreshes the facts for the scheduled request.
+func (r *factsRefresher) run() {
+	r.lock.Lock()
+	r.pending = false
+	r.last = time.Now()
+	r.lock.Unlock()
+
+	r.refresh()
+}
+
+// RefreshFacts implements the "RefreshFacts" method of the Dispatcher gRPC
+// service. It requests that the canonical facts be collected again and
+// published, on behalf of the registered worker for the handler in r.
+func (d *dispatcher) RefreshFacts(ctx context.Context, r *pb.RefreshFactsRequest) (*pb.Receipt, error) {
+	d.RLock()
+	_, prs := d.workers[r.GetHandler()]
+	d.RUnlock()
+	if !prs {
+		return nil, fmt.Errorf("cannot refresh facts: no worker registered for handler %v", r.GetHandler())
+	}
+	if d.factsRefresh == nil {
+		return nil, fmt.Errorf("cannot refresh facts: not supported")
+	}
+
+	if d.factsRefresh.request() {
+		log.Debugf("worker %v requested a facts refresh", r.GetHandler())
+	} else {
+		log.Debugf("worker %v requested a facts refresh; one is already scheduled", r.GetHandler())
+	}
+	return &pb.Receipt{}, nil
+}
+
+// RefreshFacts collects the canonical facts again, regardless of the facts
+// cache TTL, and publishes a connection-status message with them. The publish
+// is forced through the throttle, if publishes are throttled.
+func (c *Client) RefreshFacts() {
+	c.facts.invalidate()
+	if c.statusThrottle != nil {
+		c.requestConnectionStatus(true)
+		return
+	}
+	if err := c.publishConnectionStatus(); err != nil {
+		log.Errorf("cannot send connection status message: %v", err)
+		return
+	}
+	log.Info("published refreshed canonical facts")
+}
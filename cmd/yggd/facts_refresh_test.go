@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+func TestFactsRefresher(t *testing.T) {
+	tests := []struct {
+		description string
+		requests    int
+		want        []bool
+		wantRuns    int32
+	}{
+		{
+			description: "single",
+			requests:    1,
+			want:        []bool{true},
+			wantRuns:    1,
+		},
+		{
+			description: "collapsed",
+			requests:    3,
+			want:        []bool{true, false, false},
+			wantRuns:    1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var runs int32
+			r := newFactsRefresher(50*time.Millisecond, func() { atomic.AddInt32(&runs, 1) })
+			r.last = time.Now()
+
+			got := make([]bool, 0, test.requests)
+			for i := 0; i < test.requests; i++ {
+				got = append(got, r.request())
+			}
+			for i := range test.want {
+				if got[i] != test.want[i] {
+					t.Fatalf("request %v: got %v, want %v", i, got[i], test.want[i])
+				}
+			}
+			waitFor(t, func() bool { return atomic.LoadInt32(&runs) == test.wantRuns })
+		})
+	}
+}
+
+func TestFactsRefresherInterval(t *testing.T) {
+	var runs int32
+	r := newFactsRefresher(100*time.Millisecond, func() { atomic.AddInt32(&runs, 1) })
+
+	r.request()
+	waitFor(t, func() bool { return atomic.LoadInt32(&runs) == 1 })
+
+	start := time.Now()
+	r.request()
+	waitFor(t, func() bool { return atomic.LoadInt32(&runs) == 2 })
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("refreshed again after %v, want at least the interval", elapsed)
+	}
+}
+
+func TestRefreshFacts(t *testing.T) {
+	tests := []struct {
+		description string
+		input       *pb.RefreshFactsRequest
+		wantError   bool
+	}{
+		{
+			description: "registered",
+			input:       &pb.RefreshFactsRequest{Handler: "inventory"},
+		},
+		{
+			description: "unregistered",
+			input:       &pb.RefreshFactsRequest{Handler: "echo"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var runs int32
+			d := newDispatcher(nil)
+			d.workers["inventory"] = worker{handler: "inventory"}
+			d.factsRefresh = newFactsRefresher(time.Hour, func() { atomic.AddInt32(&runs, 1) })
+
+			_, err := d.RefreshFacts(context.Background(), test.input)
+			if test.wantError {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool { return atomic.LoadInt32(&runs) == 1 })
+		})
+	}
+}
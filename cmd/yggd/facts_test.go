@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestMarshalFacts(t *testing.T) {
+	facts := &yggdrasil.CanonicalFacts{
+		MachineID:    "acc046d0-0add-4550-ac7c-5a833b1b6470",
+		FQDN:         "foo.bar.com",
+		IPAddresses:  []string{"1.2.3.4"},
+		MACAddresses: []string{"CC:D1:7A:44:6D:1B"},
+	}
+
+	tests := []struct {
+		description string
+		key         string
+		pretty      bool
+		want        string
+		wantError   bool
+	}{
+		{
+			description: "single string key",
+			key:         "fqdn",
+			want:        `"foo.bar.com"`,
+		},
+		{
+			description: "single slice key pretty",
+			key:         "ip_addresses",
+			pretty:      true,
+			want:        "[\n  \"1.2.3.4\"\n]",
+		},
+		{
+			description: "unknown key",
+			key:         "rack_id",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := marshalFacts(facts, test.key, test.pretty)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", string(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("%v != %v", string(got), test.want)
+			}
+		})
+	}
+}
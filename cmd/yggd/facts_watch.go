@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// A factsWatcher collects the canonical facts every interval and calls changed
+// with the JSON keys of the facts that differ from those it collected last, so
+// that a change such as a new DHCP address reaches the backend without
+// waiting for the next heartbeat.
+type factsWatcher struct {
+	interval time.Duration
+	collect  func() (*yggdrasil.CanonicalFacts, error)
+	changed  func(keys []string)
+
+	// last holds the encoded value of each fact collected last, by JSON
+	// key, or nil until the facts are first collected.
+	last map[string]json.RawMessage
+}
+
+func newFactsWatcher(interval time.Duration, collect func() (*yggdrasil.CanonicalFacts, error), changed func(keys []string)) *factsWatcher {
+	return &factsWatcher{
+		interval: interval,
+		collect:  collect,
+		changed:  changed,
+	}
+}
+
+// run checks the facts every interval. It does not return.
+func (w *factsWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := w.check(); err != nil {
+			log.Debugf("cannot check canonical facts for changes: %v", err)
+		}
+	}
+}
+
+// check collects the facts and, if any differ from those collected last,
+// calls changed with their keys, sorted. The facts first collected are only
+// recorded. Partially collected facts are not compared, so that a fact that
+// fails to be collected now and then is not reported as changing each time.
+func (w *factsWatcher) check() error {
+	facts, err := w.collect()
+	if err != nil {
+		return fmt.Errorf("cannot collect canonical facts: %w", err)
+	}
+	current, err := encodeFacts(facts)
+	if err != nil {
+		return err
+	}
+
+	previous := w.last
+	w.last = current
+	if previous == nil {
+		return nil
+	}
+
+	var keys []string
+	for key, value := range current {
+		if string(previous[key]) != string(value) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range previous {
+		if _, prs := current[key]; !prs {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	w.changed(keys)
+	return nil
+}
+
+// encodeFacts returns the JSON encoding of each fact of facts, by JSON key.
+func encodeFacts(facts *yggdrasil.CanonicalFacts) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(facts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal facts: %w", err)
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal facts: %w", err)
+	}
+	return m, nil
+}
+
+// collectFacts collects the canonical facts again, replacing those cached, so
+// that the next connection-status message carries them.
+func (c *Client) collectFacts() (*yggdrasil.CanonicalFacts, error) {
+	c.facts.invalidate()
+	return c.facts.get()
+}
+
+// FactsWatchFunc publishes a connection-status message after the canonical
+// facts with the JSON keys changed.
+func (c *Client) FactsWatchFunc(keys []string) {
+	log.Infof("canonical facts changed: %v", keys)
+	metrics.add("facts_changes_total", 1)
+	c.requestConnectionStatus(true)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestFactsWatcher(t *testing.T) {
+	tests := []struct {
+		description string
+		facts       []*yggdrasil.CanonicalFacts
+		wantErrors  []bool
+		want        [][]string
+	}{
+		{
+			description: "unchanged",
+			facts: []*yggdrasil.CanonicalFacts{
+				{FQDN: "foo.bar.com", IPAddresses: []string{"192.0.2.1"}},
+				{FQDN: "foo.bar.com", IPAddresses: []string{"192.0.2.1"}},
+			},
+		},
+		{
+			description: "address changed",
+			facts: []*yggdrasil.CanonicalFacts{
+				{FQDN: "foo.bar.com", IPAddresses: []string{"192.0.2.1"}},
+				{FQDN: "foo.bar.com", IPAddresses: []string{"192.0.2.7"}},
+				{FQDN: "foo.bar.com", IPAddresses: []string{"192.0.2.7"}},
+			},
+			want: [][]string{{"ip_addresses"}},
+		},
+		{
+			description: "facts added and removed",
+			facts: []*yggdrasil.CanonicalFacts{
+				{FQDN: "foo.bar.com", MachineID: "1234"},
+				{FQDN: "baz.bar.com", MACAddresses: []string{"00:00:5e:00:53:01"}},
+			},
+			want: [][]string{{"fqdn", "mac_addresses", "machine_id"}},
+		},
+		{
+			description: "partial facts",
+			facts: []*yggdrasil.CanonicalFacts{
+				{FQDN: "foo.bar.com", MachineID: "1234"},
+				{FQDN: "foo.bar.com", Errors: []string{"machine_id: no such file"}},
+				{FQDN: "foo.bar.com", MachineID: "1234"},
+			},
+			wantErrors: []bool{false, true, false},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var i int
+			var got [][]string
+			w := newFactsWatcher(0, func() (*yggdrasil.CanonicalFacts, error) {
+				facts := test.facts[i]
+				i++
+				if len(facts.Errors) > 0 {
+					return facts, &yggdrasil.FactsCollectionError{Errors: facts.Errors}
+				}
+				return facts, nil
+			}, func(keys []string) {
+				got = append(got, keys)
+			})
+
+			for range test.facts {
+				err := w.check()
+				if wantError := test.wantErrors != nil && test.wantErrors[i-1]; (err != nil) != wantError {
+					t.Fatalf("check %v: unexpected error: %v", i, err)
+				}
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
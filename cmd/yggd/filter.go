@@ -0,0 +1,36 @@
+package main
+
+import "fmt"
+
+// A directiveFilter decides which data message directives the client
+// accepts. Directives in deny are always rejected. If allow is non-empty, only
+// directives in allow are accepted.
+type directiveFilter struct {
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+func newDirectiveFilter(allow []string, deny []string) *directiveFilter {
+	f := directiveFilter{
+		allow: make(map[string]bool),
+		deny:  make(map[string]bool),
+	}
+	for _, directive := range allow {
+		f.allow[directive] = true
+	}
+	for _, directive := range deny {
+		f.deny[directive] = true
+	}
+	return &f
+}
+
+// check returns an error if directive is not permitted.
+func (f *directiveFilter) check(directive string) error {
+	if f.deny[directive] {
+		return fmt.Errorf("directive '%v' is denied", directive)
+	}
+	if len(f.allow) > 0 && !f.allow[directive] {
+		return fmt.Errorf("directive '%v' is not allowed", directive)
+	}
+	return nil
+}
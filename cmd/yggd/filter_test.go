@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestDirectiveFilter(t *testing.T) {
+	tests := []struct {
+		description string
+		allow       []string
+		deny        []string
+		directive   string
+		wantError   bool
+	}{
+		{
+			description: "no lists",
+			directive:   "echo",
+		},
+		{
+			description: "allowed",
+			allow:       []string{"echo"},
+			directive:   "echo",
+		},
+		{
+			description: "not allowed",
+			allow:       []string{"echo"},
+			directive:   "sleep",
+			wantError:   true,
+		},
+		{
+			description: "denied",
+			deny:        []string{"sleep"},
+			directive:   "sleep",
+			wantError:   true,
+		},
+		{
+			description: "allowed and denied",
+			allow:       []string{"echo"},
+			deny:        []string{"echo"},
+			directive:   "echo",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := newDirectiveFilter(test.allow, test.deny).check(test.directive)
+			if test.wantError && err == nil {
+				t.Error("expected error")
+			}
+			if !test.wantError && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
 	"sync"
@@ -14,6 +15,8 @@ import (
 	"github.com/redhatinsights/yggdrasil"
 	pb "github.com/redhatinsights/yggdrasil/protocol"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type worker struct {
@@ -22,55 +25,275 @@ type worker struct {
 	addr            string
 	features        map[string]string
 	detachedContent bool
+	facts           map[string]string
+	metadata        map[string]string
+	lastHeartbeat   time.Time
 }
 
 type dispatcher struct {
 	pb.UnimplementedDispatcherServer
 	sync.RWMutex
 	dispatchers chan map[string]map[string]string
-	sendQ       chan yggdrasil.Data
+	// queue holds the messages waiting to be dispatched, and those being
+	// processed until they are acknowledged.
+	queue       messageQueue
 	recvQ       chan yggdrasil.Data
 	deadWorkers chan int
 	workers     map[string]worker
 	pidHandlers map[int]string
 	httpClient  *http.Client
+
+	// shadows maps directives to workers that receive a copy of their
+	// messages. Responses to the copies are discarded.
+	shadows   map[string]shadowRoute
+	shadowIDs *shadowTracker
+	shadowSem chan struct{}
+
+	// dispatched, if set, is called after a message is delivered to its
+	// worker.
+	dispatched func(data yggdrasil.Data)
+
+	// undeliverable, if set, is called after a message cannot be delivered
+	// to a worker.
+	undeliverable func(data yggdrasil.Data)
+
+	// rejected, if set, is called after a message is not dispatched because
+	// the queue of its worker group is full.
+	rejected func(data yggdrasil.Data, reason error)
+
+	// abandoned, if set, is called with the ID of each message whose
+	// assignment ends without a result: its worker exited, or it was
+	// forgotten after assignmentRetention.
+	abandoned func(id string)
+
+	// maxQueueAge is the longest a message may wait to be dispatched. A
+	// message that waits longer is not dispatched, and stale, if set, is
+	// called with it. expired counts such messages. If zero, messages are
+	// dispatched however long they wait.
+	maxQueueAge time.Duration
+	stale       func(data yggdrasil.Data, reason error)
+	expired     uint64
+
+	// queueBackend names the backend that holds queue.
+	queueBackend string
+
+	// memory, if set, bounds the memory held by the messages waiting to be
+	// dispatched and by the duplicate detection cache.
+	memory *memoryBudget
+
+	// usage, if set, samples the CPU and memory usage of the worker
+	// processes.
+	usage *usageSampler
+
+	// factsChanged, if set, is called after a worker changes the facts it
+	// contributes.
+	factsChanged func()
+
+	// factsRefresh, if set, debounces the requests of workers to refresh the
+	// canonical facts.
+	factsRefresh *factsRefresher
+
+	// handoverTimeout bounds the time an old worker process is given to
+	// finish its work after a newer instance registers for its handler. If
+	// zero, a second registration for a handler is rejected.
+	handoverTimeout time.Duration
+	upgraded        func(old int, pid int) bool
+
+	// duplicatePolicy decides the outcome of any other registration for a
+	// handler that already has a registered worker. retire stops a worker
+	// process that was handed over from or displaced.
+	duplicatePolicy string
+	retire          func(pid int) error
+
+	// heartbeatTimeout is the longest a worker that sends heartbeats may go
+	// without sending one before it is considered hung.
+	heartbeatTimeout time.Duration
+
+	// outstanding holds, for each worker process, the IDs of the messages
+	// delivered to it that have not been responded to. retiring holds a
+	// channel for each worker process being handed over from, closed once
+	// it has no outstanding messages, and for each worker process being
+	// recycled. No messages are routed to a retiring worker process.
+	outstanding map[int]map[string]bool
+	retiring    map[int]chan struct{}
+
+	// lastActivity holds, for each worker process, the time it registered or
+	// was last delivered or responded to a message.
+	lastActivity map[int]time.Time
+
+	// assignments holds the messages delivered to workers that have not been
+	// responded to, keyed by message ID, so that they can be cancelled.
+	assignments map[string]*assignment
+
+	// assignmentTimeout is how long a worker has to respond to a message
+	// before its assignment times out, or 0 to wait indefinitely. timedOut
+	// holds the worker process of each message whose assignment timed out
+	// and that has not been responded to since, for up to
+	// assignmentRetention. A result to such a message
+	// is handled according to lateResults, calling lateResult, if set, to
+	// publish it to the late results topic.
+	assignmentTimeout time.Duration
+	timedOut          map[string]forgottenAssignment
+	lateResults       string
+	lateResult        func(data yggdrasil.Data)
+
+	// strategies maps handlers to the strategy used to select one of the
+	// workers registered for them. When a handler has a strategy, further
+	// workers registering for it join its pool rather than being rejected.
+	// next holds the position of each handler's round-robin selection.
+	strategies     map[string]string
+	pools          map[string][]worker
+	next           map[string]int
+	processRunning func(pid int) bool
+
+	// selfTests holds a channel for each outstanding startup self-test
+	// message, closed when the worker responds to it.
+	selfTests map[string]chan struct{}
+
+	// groups, if set, limits the number of messages the workers of each
+	// worker group may be working on at once.
+	groups *workerGroups
+
+	// ordering, if set, dispatches the messages of the ordered directives
+	// one at a time in each of their sequences.
+	ordering *orderedSequences
+
+	// paused holds the messages for the workers whose dispatch is paused.
+	paused *pausedWorkers
+
+	// history, if set, keeps the records of recent assignments.
+	history *assignmentHistory
+
+	// malformedLimit is the number of malformed responses in a row after
+	// which a worker process is considered unhealthy and restarted, or 0 to
+	// never restart it. malformed holds the length of the current run of
+	// malformed responses of each worker process.
+	malformedLimit int
+	malformed      map[int]int
+	restart        func(pid int) error
+
+	// maxSendSize and maxRecvSize are the largest messages, in bytes, sent
+	// to and received from workers.
+	maxSendSize int
+	maxRecvSize int
+
+	// cancelledIDs maps the IDs of the messages whose workers cancelled
+	// their work after accepting them to the worker's PID, so that a result
+	// sent afterwards, within assignmentRetention, is discarded.
+	// cancelWorker forwards a cancellation to the worker listening on an
+	// address.
+	cancelledIDs map[string]forgottenAssignment
+	cancelWorker func(addr string, id string) error
+
+	// external, if set, registers the workers connecting over the external
+	// registration socket.
+	external *externalRegistry
 }
 
 func newDispatcher(httpClient *http.Client) *dispatcher {
 	return &dispatcher{
-		dispatchers: make(chan map[string]map[string]string),
-		sendQ:       make(chan yggdrasil.Data),
-		recvQ:       make(chan yggdrasil.Data),
-		deadWorkers: make(chan int),
-		workers:     make(map[string]worker),
-		pidHandlers: make(map[int]string),
-		httpClient:  httpClient,
+		dispatchers:  make(chan map[string]map[string]string),
+		queue:        newMemoryQueue(),
+		queueBackend: queueBackendMemory,
+		recvQ:        make(chan yggdrasil.Data),
+		deadWorkers:  make(chan int),
+		workers:      make(map[string]worker),
+		pidHandlers:  make(map[int]string),
+		httpClient:   httpClient,
+		shadows:      make(map[string]shadowRoute),
+		shadowIDs:    newShadowTracker(),
+		shadowSem:    make(chan struct{}, maxConcurrentShadowDispatches),
+
+		upgraded:       upgradedExecutable,
+		retire:         retireProcess,
+		outstanding:    make(map[int]map[string]bool),
+		retiring:       make(map[int]chan struct{}),
+		lastActivity:   make(map[int]time.Time),
+		assignments:    make(map[string]*assignment),
+		timedOut:       make(map[string]forgottenAssignment),
+		lateResults:    lateResultDiscard,
+		strategies:     make(map[string]string),
+		pools:          make(map[string][]worker),
+		next:           make(map[string]int),
+		processRunning: processRunning,
+		selfTests:      make(map[string]chan struct{}),
+		malformed:      make(map[int]int),
+		restart:        killProcess,
+		cancelledIDs:   make(map[string]forgottenAssignment),
+		cancelWorker:   cancelOnWorker,
+		maxSendSize:    defaultWorkerMessageSize,
+		maxRecvSize:    defaultWorkerMessageSize,
 	}
 }
 
 func (d *dispatcher) Register(ctx context.Context, r *pb.RegistrationRequest) (*pb.RegistrationResponse, error) {
-	d.RLock()
-	if _, prs := d.workers[r.GetHandler()]; prs {
-		d.RUnlock()
-		log.Errorf("worker failed to register for handler %v", r.GetHandler())
+	pid := int(r.GetPid())
+	addr := fmt.Sprintf("@ygg-%v-%v", r.GetHandler(), randomString(6))
+	if id, a, ok, err := d.external.worker(ctx, r.GetHandler()); err != nil {
+		log.Errorf("external worker failed to register: %v", err)
 		return &pb.RegistrationResponse{Registered: false}, nil
+	} else if ok {
+		pid, addr = id, a
 	}
+
+	logger := processLogger(pid)
+
+	d.RLock()
+	old, prs := d.workers[r.GetHandler()]
+	_, pooled := d.strategies[r.GetHandler()]
+	pooled = prs && pooled
+	handover := prs && !pooled && d.canHandOver(old, pid)
+	displace := prs && !pooled && !handover && d.duplicatePolicy == duplicateRegistrationDisplace
 	d.RUnlock()
+	if prs && !handover && !pooled && !displace {
+		logger.Errorf("worker failed to register for handler %v", r.GetHandler())
+		return &pb.RegistrationResponse{Registered: false}, nil
+	}
 
 	w := worker{
-		pid:             int(r.GetPid()),
+		pid:             pid,
 		handler:         r.GetHandler(),
-		addr:            fmt.Sprintf("@ygg-%v-%v", r.GetHandler(), randomString(6)),
+		addr:            addr,
 		features:        r.GetFeatures(),
 		detachedContent: r.GetDetachedContent(),
 	}
 
+	if err := checkWorkerFacts(r.GetFacts()); err != nil {
+		logger.Errorf("ignoring facts from worker %v: %v", r.GetHandler(), err)
+	} else {
+		w.facts = r.GetFacts()
+	}
+	if err := checkWorkerMetadata(r.GetMetadata()); err != nil {
+		logger.Errorf("ignoring metadata from worker %v: %v", r.GetHandler(), err)
+	} else {
+		w.metadata = r.GetMetadata()
+	}
+
 	d.Lock()
-	d.workers[r.GetHandler()] = w
-	d.pidHandlers[int(r.GetPid())] = r.GetHandler()
+	if pooled {
+		d.pools[r.GetHandler()] = append(d.pools[r.GetHandler()], w)
+	} else {
+		d.workers[r.GetHandler()] = w
+	}
+	d.pidHandlers[pid] = r.GetHandler()
+	d.lastActivity[pid] = time.Now()
 	d.Unlock()
+	externalConnFromContext(ctx).add(pid)
+
+	if pooled {
+		logger.Infof("worker joined pool for handler %v: %+v", r.GetHandler(), w)
+		return &pb.RegistrationResponse{Registered: true, Address: w.addr}, nil
+	}
+
+	logger.Infof("worker registered: %+v", w)
+	events.emit(event{Type: eventWorkerRegistered, Worker: w.handler, PID: w.pid})
 
-	log.Infof("worker registered: %+v", w)
+	if handover {
+		go d.handOver(old)
+	}
+	if displace && old.pid != w.pid {
+		go d.displace(old)
+	}
 
 	d.sendDispatchersMap()
 
@@ -89,112 +312,383 @@ func (d *dispatcher) Send(ctx context.Context, r *pb.Data) (*pb.Receipt, error)
 		Content:    r.GetContent(),
 	}
 
+	if err := validateResponse(data); err != nil {
+		d.malformedResponse(data, err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// The worker is known by the assignment the data responds to, if any.
+	logger := processLogger(d.responder(data.ResponseTo))
+
+	if data.ResponseTo != "" && d.cancelledLate(data.ResponseTo) {
+		logger.Infof("discarding result %v to message %v: its worker cancelled it", data.MessageID, data.ResponseTo)
+		payloadLog.log("cancelled", &data)
+		return &pb.Receipt{}, nil
+	}
+
+	if data.ResponseTo != "" && d.late(data.ResponseTo) {
+		if !d.lateResponse(&data) {
+			return &pb.Receipt{}, nil
+		}
+	} else if data.ResponseTo != "" {
+		if d.malformedLimit > 0 {
+			d.resetMalformed(d.responder(data.ResponseTo))
+		}
+		d.trackResponse(data.ResponseTo)
+		d.history.finish(data.ResponseTo, assignmentCompleted, nil)
+		d.releaseSlot(data.ResponseTo)
+		if d.responded(data.ResponseTo) {
+			logger.Warnf("cancelling message %v was too late; worker finished it", data.ResponseTo)
+			metadata := make(map[string]string, len(data.Metadata)+1)
+			for k, v := range data.Metadata {
+				metadata[k] = v
+			}
+			metadata[cancelMetadataKey] = cancelStatusTooLate
+			data.Metadata = metadata
+		}
+	}
+
+	if data.ResponseTo != "" && d.finishSelfTest(data.ResponseTo) {
+		logger.Debugf("received self-test response from worker %v", data.Directive)
+		return &pb.Receipt{}, nil
+	}
+
+	if data.ResponseTo != "" && d.shadowIDs.has(data.ResponseTo) {
+		logger.Debugf("discarding message %v from shadow worker", data.MessageID)
+		payloadLog.log("discarded shadow", &data)
+		return &pb.Receipt{}, nil
+	}
+
 	URL, err := url.Parse(data.Directive)
 	if err != nil {
 		e := fmt.Errorf("cannot parse message content as URL: %w", err)
-		log.Error(e)
+		logger.Errorf("%v", e)
 		return nil, e
 	}
 
 	if URL.Scheme == "" {
 		d.recvQ <- data
 	} else {
-		if yggdrasil.DataHost != "" {
-			URL.Host = yggdrasil.DataHost
+		if host := dataHost.get(); host != "" {
+			URL.Host = host
 		}
 		if err := d.httpClient.Post(URL.String(), data.Metadata, data.Content); err != nil {
 			e := fmt.Errorf("cannot post detached message content: %w", err)
-			log.Error(e)
+			logger.Errorf("%v", e)
 			return nil, e
 		}
 	}
-	log.Debugf("received message %v", data.MessageID)
-	log.Tracef("message: %+v", data.Content)
+	logger.Debugf("received message %v", data.MessageID)
+	payloadLog.log("result", &data)
+	events.emit(event{Type: eventResultReceived, MessageID: data.MessageID, ResponseTo: data.ResponseTo, Directive: data.Directive, Digest: contentDigest(data.Content)})
 
 	return &pb.Receipt{}, nil
 }
 
 // sendData receives values on a channel and sends the data over gRPC
 func (d *dispatcher) sendData() {
-	for data := range d.sendQ {
-		f := func() {
-			d.RLock()
-			w, prs := d.workers[data.Directive]
-			d.RUnlock()
-
-			if !prs {
-				log.Warnf("cannot route message to directive: %v", data.Directive)
-				return
-			}
+	for {
+		q, ok := d.queue.Dequeue()
+		if !ok {
+			return
+		}
+		d.dispatch(q)
+	}
+}
 
-			if w.detachedContent {
-				var urlString string
-				if err := json.Unmarshal(data.Content, &urlString); err != nil {
-					log.Errorf("cannot unmarshal message content: %v", err)
-					return
-				}
-				URL, err := url.Parse(urlString)
-				if err != nil {
-					log.Errorf("cannot parse message content as URL: %v", err)
-					return
-				}
-				if yggdrasil.DataHost != "" {
-					URL.Host = yggdrasil.DataHost
-				}
+// dispatch sends the data of q to its worker over gRPC, unless it is stale,
+// its worker is paused or it must wait for a slot of its worker group, or the
+// queue of its worker group is full. The memory budget is enforced
+// afterwards, as holding q may exceed it.
+func (d *dispatcher) dispatch(q queuedData) {
+	defer d.enforceMemoryBudget()
 
-				content, err := d.httpClient.Get(URL.String())
-				if err != nil {
-					log.Errorf("cannot get detached message content: %v", err)
-					return
-				}
-				data.Content = content
-			}
+	if d.dropExpired(q) || d.holdPaused(q) {
+		return
+	}
+	d.deliver(q)
+}
 
-			conn, err := grpc.Dial("unix:"+w.addr, grpc.WithInsecure())
-			if err != nil {
-				log.Errorf("cannot dial socket: %v", err)
-				return
-			}
-			defer conn.Close()
-
-			c := pb.NewWorkerClient(conn)
-			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-			defer cancel()
-
-			msg := pb.Data{
-				MessageId:  data.MessageID,
-				ResponseTo: data.ResponseTo,
-				Directive:  data.Directive,
-				Metadata:   data.Metadata,
-				Content:    data.Content,
-			}
-			_, err = c.Send(ctx, &msg)
-			if err != nil {
-				log.Errorf("cannot send message %v: %v", data.MessageID, err)
-				log.Tracef("message: %+v", data)
-				return
-			}
-			log.Debugf("dispatched message %v to worker %v", msg.MessageId, data.Directive)
+// dispatchHeld dispatches q, held while its worker was paused, as dispatch
+// does, except that q is not held again.
+func (d *dispatcher) dispatchHeld(q queuedData) {
+	defer d.enforceMemoryBudget()
+
+	if d.dropExpired(q) {
+		return
+	}
+	d.deliver(q)
+}
+
+// dropExpired handles q as a stale message, and returns true, if it waited
+// too long to be dispatched.
+func (d *dispatcher) dropExpired(q queuedData) bool {
+	data := q.data
+	err := d.expire(q, time.Now())
+	if err == nil {
+		return false
+	}
+	d.releaseSlot(data.MessageID)
+	d.history.record(data, nil, assignmentExpired, err, q.queued)
+	if d.stale != nil {
+		d.stale(data, err)
+	} else {
+		log.Warnf("dropping message %v: %v", data.MessageID, err)
+	}
+	return true
+}
+
+// deliver sends the data of q to its worker over gRPC once it has the turn of
+// its ordered sequence and a slot of its worker group.
+func (d *dispatcher) deliver(q queuedData) {
+	data := q.data
+	if !d.ordering.acquire(q) {
+		return
+	}
+
+	acquired, reason := d.groups.acquire(q)
+	if reason != nil {
+		d.releaseSlot(data.MessageID)
+		d.history.record(data, nil, assignmentRejected, reason, q.queued)
+		if d.rejected != nil {
+			d.rejected(data, reason)
+		} else {
+			log.Warnf("rejecting message %v: %v", data.MessageID, reason)
+		}
+		return
+	}
+	if !acquired {
+		return
+	}
+
+	d.shadow(data)
+
+	w, prs := d.selectWorker(data)
+	if !prs {
+		d.releaseSlot(data.MessageID)
+		log.Warnf("cannot route message to directive: %v", data.Directive)
+		metrics.add("messages_undeliverable_total", 1)
+		d.history.record(data, nil, assignmentUndeliverable, nil, time.Now())
+		if d.undeliverable != nil {
+			d.undeliverable(data)
+		}
+		return
+	}
+
+	logger := processLogger(w.pid)
+	s := tracing.startSpan("dispatch", data.Metadata)
+	s.set("message_id", data.MessageID)
+	s.set("directive", data.Directive)
+	s.set("worker.pid", fmt.Sprint(w.pid))
+	data.Metadata = s.withTraceparent(data.Metadata)
+
+	// The message is tracked as outstanding before it is sent, as the worker
+	// may respond before its Send call returns.
+	d.trackDispatch(w.pid, data.MessageID)
+	start := time.Now()
+	err := d.sendQueuedToWorker(w, queuedData{data: data, queued: q.queued})
+	s.finish(err)
+	if err != nil {
+		d.trackResponse(data.MessageID)
+	}
+	tracing.remember(data.MessageID, data.Metadata)
+	if errors.Is(err, errAssignmentDisplaced) {
+		logger.Infof("dispatching message %v again: worker process %v was displaced", data.MessageID, w.pid)
+		go d.dispatch(q)
+		return
+	}
+	if errors.Is(err, errAssignmentCancelled) {
+		d.releaseSlot(data.MessageID)
+		logger.Infof("cancelled message %v", data.MessageID)
+		d.history.record(data, &w, assignmentCancelled, nil, start)
+		d.recvQ <- cancelledResult(data)
+		return
+	}
+	if err != nil {
+		d.releaseSlot(data.MessageID)
+		logger.Errorf("cannot send message %v: %v", data.MessageID, err)
+		payloadLog.log("undeliverable", &data)
+		metrics.add("messages_undeliverable_total", 1)
+		outcome := assignmentFailed
+		if status.Code(err) == codes.DeadlineExceeded {
+			outcome = assignmentTimeout
+		}
+		d.history.record(data, &w, outcome, err, start)
+		if d.undeliverable != nil {
+			d.undeliverable(data)
+		}
+		return
+	}
+	// Without an assignment timeout, a message whose worker never responds
+	// would stay in a persistent queue, to be dispatched again on every
+	// restart, so it is acknowledged once it is delivered.
+	if d.assignmentTimeoutFor(w.pid) <= 0 {
+		if err := d.queue.Ack(data.MessageID); err != nil {
+			logger.Errorf("cannot acknowledge queued message %v: %v", data.MessageID, err)
 		}
+	}
+	logger.Debugf("dispatched message %v to worker %v", data.MessageID, data.Directive)
+	payloadLog.log("dispatched", &data)
+	events.emit(event{Type: eventAssignmentCreated, MessageID: data.MessageID, Directive: data.Directive, Worker: w.handler, PID: w.pid})
+	metrics.add("messages_dispatched_total", 1)
+	metrics.addSeries("worker_assignments_total", []metricLabel{{"worker", w.handler}}, 1)
+	metrics.observe("dispatch_duration_seconds", time.Since(start).Seconds())
+	labels := q.labels
+	if labels == nil {
+		labels = payloadLabels.seriesLabels(&data)
+	}
+	payloadLabels.add("payload_messages_dispatched_total", labels, 1)
+	payloadLabels.observe("payload_dispatch_duration_seconds", labels, time.Since(start).Seconds())
+	d.history.record(data, &w, assignmentDispatched, nil, start)
 
-		f()
+	if d.dispatched != nil {
+		d.dispatched(data)
 	}
 }
 
+// sendToWorker sends data to the worker w over gRPC, first retrieving the
+// message content if the worker requires detached content.
+func (d *dispatcher) sendToWorker(w worker, data yggdrasil.Data) error {
+	return d.sendQueuedToWorker(w, queuedData{data: data, queued: time.Now()})
+}
+
+// sendQueuedToWorker sends the data of q to the worker w as sendToWorker
+// does. The assignment keeps the time q was queued, so that a message
+// dispatched again keeps its age.
+func (d *dispatcher) sendQueuedToWorker(w worker, q queuedData) error {
+	dispatched := q
+	data := q.data
+	if w.detachedContent {
+		var urlString string
+		if err := json.Unmarshal(data.Content, &urlString); err != nil {
+			return fmt.Errorf("cannot unmarshal message content: %w", err)
+		}
+		URL, err := url.Parse(urlString)
+		if err != nil {
+			return fmt.Errorf("cannot parse message content as URL: %w", err)
+		}
+		if host := dataHost.get(); host != "" {
+			URL.Host = host
+		}
+
+		content, err := d.httpClient.Get(URL.String())
+		if err != nil {
+			return fmt.Errorf("cannot get detached message content: %w", err)
+		}
+		data.Content = content
+	}
+
+	msg := pb.Data{
+		MessageId:  data.MessageID,
+		ResponseTo: data.ResponseTo,
+		Directive:  data.Directive,
+		Metadata:   data.Metadata,
+		Content:    data.Content,
+	}
+	if err := d.checkWorkerMessageSize(&msg); err != nil {
+		return err
+	}
+
+	conn, err := grpc.Dial("unix:"+w.addr, grpc.WithInsecure(), grpc.WithDefaultCallOptions(d.callOptions()...))
+	if err != nil {
+		return fmt.Errorf("cannot dial socket: %w", err)
+	}
+	defer conn.Close()
+
+	c := pb.NewWorkerClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Shadow copies are not tracked, and cannot be cancelled.
+	if d.shadowIDs.has(data.MessageID) {
+		_, err = c.Send(ctx, &msg)
+		return workerSendError(err)
+	}
+	d.assign(dispatched, w.pid, cancel)
+	_, err = c.Send(ctx, &msg)
+	return d.delivered(data.MessageID, workerSendError(err))
+}
+
 func (d *dispatcher) unregisterWorker() {
 	for pid := range d.deadWorkers {
+		logger := processLogger(pid)
 		d.Lock()
 		handler := d.pidHandlers[pid]
 		delete(d.pidHandlers, pid)
-		delete(d.workers, handler)
+		d.removeWorker(handler, pid)
+		delete(d.outstanding, pid)
+		delete(d.malformed, pid)
+		delete(d.lastActivity, pid)
+		d.history.workerExited(pid)
+		var released []string
+		for id, a := range d.assignments {
+			if a.pid == pid {
+				delete(d.assignments, id)
+				if a.timer != nil {
+					a.timer.Stop()
+				}
+				released = append(released, id)
+			}
+		}
+		for id, f := range d.timedOut {
+			if f.pid == pid {
+				delete(d.timedOut, id)
+			}
+		}
+		for id, f := range d.cancelledIDs {
+			if f.pid == pid {
+				delete(d.cancelledIDs, id)
+			}
+		}
+		if drained, retiring := d.retiring[pid]; retiring {
+			close(drained)
+			delete(d.retiring, pid)
+		}
 		d.Unlock()
-		log.Infof("unregistered worker: %v", handler)
+		for _, id := range released {
+			d.releaseSlot(id)
+			if d.abandoned != nil {
+				d.abandoned(id)
+			}
+		}
+		logger.Infof("unregistered worker: %v", handler)
+		workerNames.Delete(pid)
 
 		d.sendDispatchersMap()
 	}
 }
 
-func (d *dispatcher) makeDispatchersMap() map[string]map[string]string {
+// Dispatch queues data for delivery to the worker for its directive, along
+// with the payload labels of its metrics. Data that does not fit in the memory
+// budget is rejected, and data that cannot be queued is undeliverable.
+func (d *dispatcher) Dispatch(data yggdrasil.Data, labels []metricLabel) {
+	if err := d.memory.admit(data); err != nil {
+		d.history.record(data, nil, assignmentRejected, err, time.Now())
+		if d.rejected != nil {
+			d.rejected(data, err)
+		} else {
+			log.Warnf("rejecting message %v: %v", data.MessageID, err)
+		}
+		return
+	}
+	if err := d.queue.Enqueue(queuedData{data: data, labels: labels}); err != nil {
+		log.Errorf("cannot queue message %v: %v", data.MessageID, err)
+		metrics.add("messages_undeliverable_total", 1)
+		d.history.record(data, nil, assignmentUndeliverable, err, time.Now())
+		if d.undeliverable != nil {
+			d.undeliverable(data)
+		}
+	}
+}
+
+// Results returns the channel on which data sent by workers is received.
+func (d *dispatcher) Results() <-chan yggdrasil.Data {
+	return d.recvQ
+}
+
+// Dispatchers returns the features of each registered worker, keyed by
+// handler.
+func (d *dispatcher) Dispatchers() map[string]map[string]string {
 	d.RLock()
 	defer d.RUnlock()
 
@@ -207,5 +701,5 @@ func (d *dispatcher) makeDispatchersMap() map[string]map[string]string {
 }
 
 func (d *dispatcher) sendDispatchersMap() {
-	d.dispatchers <- d.makeDispatchersMap()
+	d.dispatchers <- d.Dispatchers()
 }
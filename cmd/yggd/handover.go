@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// processExecutable returns the base name of the executable file the process
+// pid is running. If the file has been replaced or removed since the process
+// started, the name it was started from is returned and replaced is true.
+func processExecutable(pid int) (name string, replaced bool, err error) {
+	path, err := os.Readlink(fmt.Sprintf("/proc/%v/exe", pid))
+	if err != nil {
+		return "", false, fmt.Errorf("cannot read process executable: %w", err)
+	}
+	replaced = strings.HasSuffix(path, " (deleted)")
+	return filepath.Base(strings.TrimSuffix(path, " (deleted)")), replaced, nil
+}
+
+// upgradedExecutable returns true if the process pid is running an upgraded
+// version of the worker executable of the process old: the same executable
+// name, whose file was replaced since old started.
+func upgradedExecutable(old int, pid int) bool {
+	oldExe, replaced, err := processExecutable(old)
+	if err != nil {
+		log.Debugf("cannot determine executable of process %v: %v", old, err)
+		return false
+	}
+	exe, _, err := processExecutable(pid)
+	if err != nil {
+		log.Debugf("cannot determine executable of process %v: %v", pid, err)
+		return false
+	}
+	return replaced && oldExe == exe
+}
+
+// canHandOver returns true if the worker registering for a handler as pid
+// replaces the registered worker old, rather than conflicting with it: the
+// new process must run an upgraded version of the old one's worker
+// executable. A restart of the same executable is not a handover, and is
+// handled under the duplicate registration policy. The caller must hold the
+// lock.
+func (d *dispatcher) canHandOver(old worker, pid int) bool {
+	if d.handoverTimeout <= 0 || old.pid == pid {
+		return false
+	}
+	return d.upgraded(old.pid, pid)
+}
+
+// trackDispatch records that the message id was delivered to the worker
+// process pid and awaits a response.
+func (d *dispatcher) trackDispatch(pid int, id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.outstanding[pid] == nil {
+		d.outstanding[pid] = make(map[string]bool)
+	}
+	d.outstanding[pid][id] = true
+	d.lastActivity[pid] = time.Now()
+}
+
+// trackResponse records that a response to the message id was received. If
+// the message was the last one outstanding for a worker process being retired,
+// that process is signalled that it has drained.
+func (d *dispatcher) trackResponse(id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	for pid, ids := range d.outstanding {
+		if !ids[id] {
+			continue
+		}
+		delete(ids, id)
+		d.lastActivity[pid] = time.Now()
+		if drained, retiring := d.retiring[pid]; retiring && len(ids) == 0 {
+			close(drained)
+			delete(d.retiring, pid)
+		}
+		return
+	}
+}
+
+// handOver retires the worker old after a newer instance of it has registered
+// for the same handler. New messages are already routed to the newer instance;
+// the old instance is stopped once every message delivered to it has been
+// responded to, or once the handover timeout elapses.
+func (d *dispatcher) handOver(old worker) {
+	drained := make(chan struct{})
+
+	d.Lock()
+	if len(d.outstanding[old.pid]) == 0 {
+		close(drained)
+	} else {
+		d.retiring[old.pid] = drained
+	}
+	d.Unlock()
+
+	logger := processLogger(old.pid)
+	logger.Infof("handing over handler %v from worker process %v; waiting for it to finish its work", old.handler, old.pid)
+
+	timer := time.NewTimer(d.handoverTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		logger.Infof("worker process %v finished its work", old.pid)
+	case <-timer.C:
+		logger.Warnf("worker process %v did not finish its work within %v", old.pid, d.handoverTimeout)
+		d.Lock()
+		delete(d.retiring, old.pid)
+		d.Unlock()
+	}
+
+	if err := d.retire(old.pid); err != nil {
+		logger.Errorf("cannot stop worker process %v: %v", old.pid, err)
+	}
+}
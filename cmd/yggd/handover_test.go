@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+// PIDs above the kernel's maximum, so that retiring them signals no process.
+const (
+	oldWorkerPID = 999999901
+	newWorkerPID = 999999902
+)
+
+func TestRegisterHandover(t *testing.T) {
+	tests := []struct {
+		description    string
+		timeout        time.Duration
+		upgraded       bool
+		wantRegistered bool
+	}{
+		{
+			description:    "upgraded worker",
+			timeout:        time.Minute,
+			upgraded:       true,
+			wantRegistered: true,
+		},
+		{
+			description: "different worker",
+			timeout:     time.Minute,
+		},
+		{
+			description: "handover disabled",
+			upgraded:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.handoverTimeout = test.timeout
+			d.upgraded = func(old, pid int) bool { return test.upgraded }
+			go func() {
+				for range d.dispatchers {
+				}
+			}()
+			defer close(d.dispatchers)
+
+			if _, err := d.Register(context.Background(), &pb.RegistrationRequest{Handler: "echo", Pid: oldWorkerPID}); err != nil {
+				t.Fatal(err)
+			}
+			d.trackDispatch(oldWorkerPID, "1")
+
+			resp, err := d.Register(context.Background(), &pb.RegistrationRequest{Handler: "echo", Pid: newWorkerPID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.GetRegistered() != test.wantRegistered {
+				t.Fatalf("registered: %v", resp.GetRegistered())
+			}
+
+			wantPID := oldWorkerPID
+			if test.wantRegistered {
+				wantPID = newWorkerPID
+			}
+			d.RLock()
+			gotPID := d.workers["echo"].pid
+			d.RUnlock()
+			if gotPID != wantPID {
+				t.Errorf("echo routed to %v, want %v", gotPID, wantPID)
+			}
+		})
+	}
+}
+
+func TestHandOverDrains(t *testing.T) {
+	d := newDispatcher(nil)
+	d.handoverTimeout = time.Minute
+	d.trackDispatch(oldWorkerPID, "1")
+	d.trackDispatch(oldWorkerPID, "2")
+
+	done := make(chan struct{})
+	go func() {
+		d.handOver(worker{handler: "echo", pid: oldWorkerPID})
+		close(done)
+	}()
+
+	d.trackResponse("1")
+	select {
+	case <-done:
+		t.Fatal("old worker retired with outstanding messages")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	d.trackResponse("2")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("old worker not retired after its messages were responded to")
+	}
+}
+
+func TestUnregisterHandedOverWorker(t *testing.T) {
+	d := newDispatcher(nil)
+	go func() {
+		for range d.dispatchers {
+		}
+	}()
+	defer close(d.dispatchers)
+	d.workers["echo"] = worker{handler: "echo", pid: newWorkerPID}
+	d.pidHandlers[oldWorkerPID] = "echo"
+	d.pidHandlers[newWorkerPID] = "echo"
+
+	done := make(chan struct{})
+	go func() {
+		d.unregisterWorker()
+		close(done)
+	}()
+	d.deadWorkers <- oldWorkerPID
+	close(d.deadWorkers)
+	<-done
+
+	d.RLock()
+	defer d.RUnlock()
+	if d.workers["echo"].pid != newWorkerPID {
+		t.Errorf("newer worker unregistered when the old one exited")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// errHandshakeTimeout is returned by Handshake if the handshake does not
+// complete within the handshake timeout.
+var errHandshakeTimeout = errors.New("handshake timed out")
+
+// Handshake connects the transport, publishes the online presence and
+// capabilities messages, collects the canonical facts and publishes the
+// connection status. If the handshake does not complete within the handshake
+// timeout, the attempt is abandoned: the transport is disconnected and an
+// error naming the step the handshake was at is returned, so that the caller
+// can try again. If ctx is done before the handshake completes, it is
+// abandoned in the same way and the error of ctx is returned. An abandoned
+// handshake stops at its next step, and Handshake returns only once it has,
+// so that it does not go on publishing alongside the next attempt.
+func (c *Client) Handshake(ctx context.Context) error {
+	if c.handshakeTimeout <= 0 && ctx.Done() == nil {
+		return c.runHandshake(ctx)
+	}
+
+	hctx, cancel := ctx, context.CancelFunc(func() {})
+	if c.handshakeTimeout > 0 {
+		hctx, cancel = context.WithTimeout(ctx, c.handshakeTimeout)
+	}
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.runHandshake(hctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-hctx.Done():
+	}
+
+	step, _ := c.handshakeStep.Load().(string)
+	c.t.Disconnect(0)
+	<-done
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("handshake abandoned: step %q did not complete: %w", step, err)
+	}
+	return fmt.Errorf("%w after %v: step %q did not complete", errHandshakeTimeout, c.handshakeTimeout, step)
+}
+
+// runHandshake runs the steps of the handshake, stopping with the error of ctx
+// at the first step reached once ctx is done. Failing to publish the
+// connection status is logged rather than failing the handshake, since it is
+// published again when the facts change or the heartbeat is due.
+func (c *Client) runHandshake(ctx context.Context) error {
+	if err := c.connect(ctx); err != nil {
+		return err
+	}
+	if err := c.publishConnectionStatusContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Errorf("cannot send connection status message: %v", err)
+	}
+	c.startup.connected()
+	return nil
+}
+
+// runStep calls f, returning the error of ctx if ctx is done before f returns.
+// f is then left to return in the background, and anything it sets must not
+// be used.
+func runStep(ctx context.Context, f func()) error {
+	if ctx.Done() == nil {
+		f()
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		description string
+		timeout     time.Duration
+		stallSleep  bool
+		stallFacts  bool
+		wantStep    string
+	}{
+		{
+			description: "completes",
+			timeout:     time.Second,
+		},
+		{
+			description: "unbounded",
+		},
+		{
+			description: "warm up times out",
+			timeout:     50 * time.Millisecond,
+			stallSleep:  true,
+			wantStep:    "warm up",
+		},
+		{
+			description: "facts time out",
+			timeout:     50 * time.Millisecond,
+			stallFacts:  true,
+			wantStep:    "collect facts",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.description, func(t *testing.T) {
+			// The stalled steps are released, and waited for, once the
+			// handshake has returned.
+			var stalled sync.WaitGroup
+			stall := make(chan struct{})
+			if test.stallSleep || test.stallFacts {
+				stalled.Add(1)
+			}
+			defer stalled.Wait()
+			defer close(stall)
+
+			tr := &recordingTransport{}
+			c := Client{
+				t:                tr,
+				d:                newDispatcher(nil),
+				handshakeTimeout: test.timeout,
+				warmUp:           time.Second,
+				sleep: func(time.Duration) {
+					if test.stallSleep {
+						defer stalled.Done()
+						<-stall
+					}
+				},
+				facts: &factsCache{collect: func() (*yggdrasil.CanonicalFacts, error) {
+					if test.stallFacts {
+						defer stalled.Done()
+						<-stall
+					}
+					return &yggdrasil.CanonicalFacts{}, nil
+				}},
+			}
+
+			err := c.Handshake(context.Background())
+			if test.wantStep == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tr.sent["control"]) != 1 {
+					t.Errorf("expected a connection status message, sent %v", tr.sent)
+				}
+				return
+			}
+			if !errors.Is(err, errHandshakeTimeout) {
+				t.Fatalf("expected a handshake timeout, got %v", err)
+			}
+			if !strings.Contains(err.Error(), `"`+test.wantStep+`"`) {
+				t.Errorf("expected error to name step %q, got %v", test.wantStep, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthCheckTimeout bounds how long the health endpoint waits for the health
+// checks to complete before reporting the daemon as unhealthy.
+const healthCheckTimeout = 5 * time.Second
+
+// A healthEndpoint reports over HTTP whether the daemon is healthy, running
+// the same checks as the liveness file on each request. Until the checks are
+// set, once the daemon has started, it reports the daemon as starting.
+type healthEndpoint struct {
+	lock    sync.RWMutex
+	checks  []livenessCheck
+	timeout time.Duration
+}
+
+// health is the health endpoint served alongside the Prometheus metrics.
+var health = &healthEndpoint{timeout: healthCheckTimeout}
+
+// setChecks makes h report on checks.
+func (h *healthEndpoint) setChecks(checks []livenessCheck) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.checks = checks
+}
+
+// ServeHTTP responds with status 200 if each of the checks passes within the
+// timeout, and with status 503 and the reasons it does not otherwise.
+func (h *healthEndpoint) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.lock.RLock()
+	checks := h.checks
+	h.lock.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if checks == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "starting")
+		return
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- runLivenessChecks(checks) }()
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(h.timeout):
+		err = fmt.Errorf("health checks did not complete within %v", h.timeout)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "unhealthy: %v\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
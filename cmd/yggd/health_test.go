@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthEndpoint(t *testing.T) {
+	tests := []struct {
+		description string
+		checks      []livenessCheck
+		wantStatus  int
+		wantBody    string
+	}{
+		{
+			description: "starting",
+			wantStatus:  http.StatusServiceUnavailable,
+			wantBody:    "starting\n",
+		},
+		{
+			description: "healthy",
+			checks:      []livenessCheck{{"transport", func() error { return nil }}},
+			wantStatus:  http.StatusOK,
+			wantBody:    "ok\n",
+		},
+		{
+			description: "unhealthy",
+			checks: []livenessCheck{
+				{"transport", func() error { return errors.New("not connected to any broker") }},
+				{"dispatcher", func() error { return nil }},
+			},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "unhealthy: transport: not connected to any broker\n",
+		},
+		{
+			description: "stuck",
+			checks:      []livenessCheck{{"dispatcher", func() error { time.Sleep(time.Second); return nil }}},
+			wantStatus:  http.StatusServiceUnavailable,
+			wantBody:    "unhealthy: health checks did not complete within 10ms\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			h := &healthEndpoint{timeout: 10 * time.Millisecond}
+			if test.checks != nil {
+				h.setChecks(test.checks)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if w.Code != test.wantStatus {
+				t.Errorf("status: %v != %v", w.Code, test.wantStatus)
+			}
+			if got := w.Body.String(); got != test.wantBody {
+				t.Errorf("body: %q != %q", got, test.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// A heartbeat calls send periodically, every interval plus a random delay of
+// up to jitter, so that a fleet of clients started together does not publish
+// in synchronized bursts.
+type heartbeat struct {
+	interval time.Duration
+	jitter   time.Duration
+	send     func()
+	resetC   chan struct{}
+}
+
+func newHeartbeat(interval time.Duration, jitter time.Duration, send func()) *heartbeat {
+	return &heartbeat{
+		interval: interval,
+		jitter:   jitter,
+		send:     send,
+		resetC:   make(chan struct{}, 1),
+	}
+}
+
+// next returns the delay until the next heartbeat.
+func (h *heartbeat) next() time.Duration {
+	if h.jitter <= 0 {
+		return h.interval
+	}
+	return h.interval + time.Duration(rand.Int63n(int64(h.jitter)))
+}
+
+// run calls send each time the heartbeat timer fires. It does not return.
+func (h *heartbeat) run() {
+	timer := time.NewTimer(h.next())
+	for {
+		select {
+		case <-timer.C:
+			h.send()
+		case <-h.resetC:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+		timer.Reset(h.next())
+	}
+}
+
+// reset restarts the heartbeat timer, for example after a connection-status
+// message was published for another reason.
+func (h *heartbeat) reset() {
+	select {
+	case h.resetC <- struct{}{}:
+	default:
+	}
+}
+
+// A factsCache holds the canonical facts for up to ttl before collecting them
+// again.
+type factsCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	facts   *yggdrasil.CanonicalFacts
+	fetched time.Time
+
+	// collect collects the canonical facts. If nil, GetCanonicalFacts is
+	// used.
+	collect func() (*yggdrasil.CanonicalFacts, error)
+}
+
+// invalidate discards the cached facts, so that they are collected again on
+// the next call to get. It does nothing if c is nil.
+func (c *factsCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.facts = nil
+}
+
+// get returns the cached facts, collecting them if they are missing or older
+// than the cache TTL. Facts that were only partially collected are returned
+// along with the collection error, but are not cached, so that collection is
+// retried on the next call.
+func (c *factsCache) get() (*yggdrasil.CanonicalFacts, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.facts != nil && time.Since(c.fetched) < c.ttl {
+		return c.facts, nil
+	}
+
+	collect := c.collect
+	if collect == nil {
+		collect = yggdrasil.GetCanonicalFacts
+	}
+	facts, err := collect()
+	if err != nil {
+		return facts, err
+	}
+	log.Debug("collected canonical facts")
+	c.facts = facts
+	c.fetched = time.Now()
+
+	return facts, nil
+}
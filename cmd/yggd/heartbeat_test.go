@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestHeartbeatNext(t *testing.T) {
+	h := newHeartbeat(time.Minute, 10*time.Second, nil)
+	for i := 0; i < 100; i++ {
+		got := h.next()
+		if got < time.Minute || got >= time.Minute+10*time.Second {
+			t.Fatalf("%v out of range", got)
+		}
+	}
+
+	h = newHeartbeat(time.Minute, 0, nil)
+	if got := h.next(); got != time.Minute {
+		t.Errorf("%v != %v", got, time.Minute)
+	}
+}
+
+func TestHeartbeatReset(t *testing.T) {
+	sent := make(chan time.Time, 10)
+	h := newHeartbeat(100*time.Millisecond, 0, func() { sent <- time.Now() })
+	go h.run()
+
+	start := time.Now()
+	time.Sleep(60 * time.Millisecond)
+	h.reset()
+
+	select {
+	case at := <-sent:
+		if elapsed := at.Sub(start); elapsed < 150*time.Millisecond {
+			t.Errorf("heartbeat sent after %v; expected reset to delay it", elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat not sent")
+	}
+}
+
+func TestFactsCachePartial(t *testing.T) {
+	var calls int
+	partial := true
+	c := factsCache{
+		ttl: time.Hour,
+		collect: func() (*yggdrasil.CanonicalFacts, error) {
+			calls++
+			if partial {
+				errors := []string{"machine_id: no such file"}
+				return &yggdrasil.CanonicalFacts{FQDN: "foo.bar.com", Errors: errors}, &yggdrasil.FactsCollectionError{Errors: errors}
+			}
+			return &yggdrasil.CanonicalFacts{FQDN: "foo.bar.com"}, nil
+		},
+	}
+
+	facts, err := c.get()
+	if err == nil || facts == nil || facts.FQDN != "foo.bar.com" {
+		t.Fatalf("expected partial facts and an error, got %+v, %v", facts, err)
+	}
+
+	// Partial facts are not cached, so collection is retried.
+	partial = false
+	if _, err := c.get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.get(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("expected facts collected twice, got %v", calls)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultHistorySize is the number of assignment records kept unless a size
+// is given.
+const defaultHistorySize = 100
+
+// The outcomes of an assignment.
+const (
+	// assignmentDispatched is the outcome of an assignment the worker
+	// accepted but has not yet responded to.
+	assignmentDispatched = "dispatched"
+
+	// assignmentCompleted is the outcome of an assignment the worker
+	// responded to.
+	assignmentCompleted = "completed"
+
+	// assignmentFailed is the outcome of an assignment that could not be
+	// delivered to the worker, or whose worker exited before responding.
+	assignmentFailed = "failed"
+
+	// assignmentTimeout is the outcome of an assignment the worker did not
+	// accept in time.
+	assignmentTimeout = "timeout"
+
+	// assignmentCancelled is the outcome of an assignment cancelled before
+	// the worker accepted it.
+	assignmentCancelled = "cancelled"
+
+	// assignmentUndeliverable is the outcome of a message for which no
+	// worker was registered.
+	assignmentUndeliverable = "undeliverable"
+
+	// assignmentExpired is the outcome of a message that waited too long to
+	// be dispatched.
+	assignmentExpired = "expired"
+
+	// assignmentRejected is the outcome of a message rejected because the
+	// queue of its worker group was full.
+	assignmentRejected = "rejected"
+)
+
+// An assignmentRecord describes the outcome of dispatching a data message.
+type assignmentRecord struct {
+	MessageID       string    `json:"message_id"`
+	Directive       string    `json:"directive"`
+	Worker          string    `json:"worker,omitempty"`
+	PID             int       `json:"pid,omitempty"`
+	Outcome         string    `json:"outcome"`
+	Error           string    `json:"error,omitempty"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// An assignmentHistory keeps the records of the most recent size
+// assignments, in memory only, so that recent outcomes can be inspected
+// locally. Records of assignments still awaiting a response are updated once
+// the response arrives.
+type assignmentHistory struct {
+	lock    sync.Mutex
+	records []*assignmentRecord
+	next    int
+	pending map[string]*assignmentRecord
+}
+
+func newAssignmentHistory(size int) (*assignmentHistory, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid history size: %v", size)
+	}
+	return &assignmentHistory{
+		records: make([]*assignmentRecord, 0, size),
+		pending: make(map[string]*assignmentRecord),
+	}, nil
+}
+
+// add adds r to the history, replacing the oldest record once the history is
+// full.
+func (h *assignmentHistory) add(r *assignmentRecord) {
+	if len(h.records) < cap(h.records) {
+		h.records = append(h.records, r)
+		return
+	}
+	old := h.records[h.next]
+	if h.pending[old.MessageID] == old {
+		delete(h.pending, old.MessageID)
+	}
+	h.records[h.next] = r
+	h.next = (h.next + 1) % len(h.records)
+}
+
+// record records that dispatching data, begun at started, ended with outcome.
+// w is the worker the message was dispatched to, if any. It does nothing if h
+// is nil.
+func (h *assignmentHistory) record(data yggdrasil.Data, w *worker, outcome string, err error, started time.Time) {
+	if h == nil {
+		return
+	}
+
+	r := assignmentRecord{
+		MessageID:       data.MessageID,
+		Directive:       data.Directive,
+		Outcome:         outcome,
+		Started:         started,
+		DurationSeconds: time.Since(started).Seconds(),
+	}
+	if w != nil {
+		r.Worker = w.handler
+		r.PID = w.pid
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.add(&r)
+	if outcome == assignmentDispatched {
+		h.pending[r.MessageID] = &r
+	}
+}
+
+// finish records that the assignment of the message id ended with outcome,
+// if it is awaiting a response. It does nothing if h is nil.
+func (h *assignmentHistory) finish(id string, outcome string, err error) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	r, prs := h.pending[id]
+	if !prs {
+		return
+	}
+	delete(h.pending, id)
+	r.Outcome = outcome
+	r.DurationSeconds = time.Since(r.Started).Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// workerExited records that the assignments of the worker process pid that
+// are awaiting a response failed. It does nothing if h is nil.
+func (h *assignmentHistory) workerExited(pid int) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for id, r := range h.pending {
+		if r.PID != pid {
+			continue
+		}
+		delete(h.pending, id)
+		r.Outcome = assignmentFailed
+		r.Error = "worker process exited"
+		r.DurationSeconds = time.Since(r.Started).Seconds()
+	}
+}
+
+// list returns at most limit records, newest first, of the assignments for
+// directive with outcome. An empty directive or outcome matches any, and a
+// limit of 0 or less returns every matching record. It returns no records if
+// h is nil.
+func (h *assignmentHistory) list(limit int, directive string, outcome string) []assignmentRecord {
+	records := []assignmentRecord{}
+	if h == nil {
+		return records
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i := 0; i < len(h.records); i++ {
+		r := h.records[(h.next-1-i+2*len(h.records))%len(h.records)]
+		if (directive != "" && r.Directive != directive) || (outcome != "" && r.Outcome != outcome) {
+			continue
+		}
+		records = append(records, *r)
+		if limit > 0 && len(records) == limit {
+			break
+		}
+	}
+	return records
+}
+
+// handleHistory is the control handler for the "history" command. It reports
+// the recent assignments, limited by the "limit", "type" (directive) and
+// "outcome" arguments.
+func (d *dispatcher) handleHistory(args map[string]string) (interface{}, error) {
+	var limit int
+	if args["limit"] != "" {
+		var err error
+		limit, err = strconv.Atoi(args["limit"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit: %v", args["limit"])
+		}
+	}
+	return d.history.list(limit, args["type"], args["outcome"]), nil
+}
+
+// historyAction calls the "history" control command on the running daemon
+// and prints the recent assignments.
+func historyAction(c *cli.Context) error {
+	args := map[string]string{
+		"limit":   strconv.Itoa(c.Int("limit")),
+		"type":    c.String("type"),
+		"outcome": c.String("outcome"),
+	}
+	result, err := callControl(c.String("control-socket-addr"), "history", args)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var records []assignmentRecord
+	if err := json.Unmarshal(result, &records); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot marshal history: %w", err), 1)
+		}
+		fmt.Fprintln(c.App.Writer, string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.App.Writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tMESSAGE\tDIRECTIVE\tWORKER\tOUTCOME\tDURATION\tERROR")
+	for _, r := range records {
+		duration := time.Duration(r.DurationSeconds * float64(time.Second)).Round(time.Millisecond)
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", r.Started.Format(time.RFC3339), r.MessageID, r.Directive, r.Worker, r.Outcome, duration, r.Error)
+	}
+	if err := w.Flush(); err != nil {
+		return cli.Exit(fmt.Errorf("cannot write history: %w", err), 1)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestAssignmentHistoryList(t *testing.T) {
+	tests := []struct {
+		description string
+		records     int
+		limit       int
+		directive   string
+		outcome     string
+		want        []string
+	}{
+		{
+			description: "within size",
+			records:     2,
+			want:        []string{"1", "0"},
+		},
+		{
+			description: "oldest replaced",
+			records:     5,
+			want:        []string{"4", "3", "2"},
+		},
+		{
+			description: "limit",
+			records:     5,
+			limit:       2,
+			want:        []string{"4", "3"},
+		},
+		{
+			description: "directive",
+			records:     5,
+			directive:   "echo",
+			want:        []string{"4", "2"},
+		},
+		{
+			description: "outcome",
+			records:     5,
+			outcome:     assignmentFailed,
+			want:        []string{"3"},
+		},
+		{
+			description: "no match",
+			records:     5,
+			directive:   "unknown",
+			want:        []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			h, err := newAssignmentHistory(3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < test.records; i++ {
+				data := yggdrasil.Data{MessageID: fmt.Sprint(i), Directive: "echo"}
+				outcome := assignmentCompleted
+				if i%2 == 1 {
+					data.Directive = "inventory"
+					outcome = assignmentFailed
+				}
+				h.record(data, nil, outcome, nil, time.Now())
+			}
+
+			got := []string{}
+			for _, r := range h.list(test.limit, test.directive, test.outcome) {
+				got = append(got, r.MessageID)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAssignmentHistoryFinish(t *testing.T) {
+	h, err := newAssignmentHistory(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &worker{pid: 4242, handler: "echo"}
+	h.record(yggdrasil.Data{MessageID: "a", Directive: "echo"}, w, assignmentDispatched, nil, time.Now())
+	h.record(yggdrasil.Data{MessageID: "b", Directive: "echo"}, w, assignmentDispatched, nil, time.Now())
+
+	h.finish("a", assignmentCompleted, nil)
+	h.finish("unknown", assignmentCompleted, nil)
+	h.workerExited(4242)
+
+	got := h.list(0, "", "")
+	if got[0].Outcome != assignmentFailed || got[0].Error == "" {
+		t.Errorf("assignment b: %#v", got[0])
+	}
+	if got[1].Outcome != assignmentCompleted || got[1].Worker != "echo" || got[1].PID != 4242 {
+		t.Errorf("assignment a: %#v", got[1])
+	}
+
+	// A finished assignment is not updated again.
+	h.finish("a", assignmentFailed, errors.New("late"))
+	if got := h.list(0, "", assignmentCompleted); len(got) != 1 {
+		t.Errorf("completed assignments: %#v", got)
+	}
+
+	// A dispatched assignment replaced by a newer record is no longer pending.
+	h.record(yggdrasil.Data{MessageID: "c", Directive: "echo"}, w, assignmentDispatched, nil, time.Now())
+	h.record(yggdrasil.Data{MessageID: "d", Directive: "echo"}, w, assignmentDispatched, nil, time.Now())
+	h.record(yggdrasil.Data{MessageID: "e", Directive: "echo"}, w, assignmentDispatched, nil, time.Now())
+	if _, prs := h.pending["c"]; prs {
+		t.Error("replaced assignment c still pending")
+	}
+}
+
+func TestAssignmentHistoryNil(t *testing.T) {
+	var h *assignmentHistory
+	h.record(yggdrasil.Data{MessageID: "a"}, nil, assignmentCompleted, nil, time.Now())
+	h.finish("a", assignmentCompleted, nil)
+	h.workerExited(1)
+	if got := h.list(0, "", ""); len(got) != 0 {
+		t.Errorf("%#v", got)
+	}
+}
+
+func TestNewAssignmentHistoryInvalid(t *testing.T) {
+	if _, err := newAssignmentHistory(0); err == nil {
+		t.Error("expected an error")
+	}
+}
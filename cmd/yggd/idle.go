@@ -0,0 +1,201 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// An idleDisconnector disconnects the transport once no messages have been
+// received or sent for timeout, to save power on devices for which an open
+// but idle connection is costly. While disconnected, it connects again every
+// interval (if not 0), opening a connection window of at least timeout in
+// which messages queued by the broker are received, and whenever a message
+// is about to be sent.
+type idleDisconnector struct {
+	timeout  time.Duration
+	interval time.Duration
+
+	// connect and disconnect connect and disconnect the transport. busy, if
+	// set, returns true while messages are being processed, which keeps the
+	// connection open.
+	connect    func() error
+	disconnect func()
+	busy       func() bool
+
+	lock    sync.Mutex
+	last    time.Time
+	asleep  bool
+	stopped bool
+
+	// connecting serializes connecting and disconnecting, so that a message
+	// sent while the transport is being connected or disconnected waits for
+	// it.
+	connecting sync.Mutex
+
+	wakeC chan struct{}
+	now   func() time.Time
+}
+
+func newIdleDisconnector(timeout time.Duration, interval time.Duration, connect func() error, disconnect func(), busy func() bool) *idleDisconnector {
+	return &idleDisconnector{
+		timeout:    timeout,
+		interval:   interval,
+		connect:    connect,
+		disconnect: disconnect,
+		busy:       busy,
+		last:       time.Now(),
+		wakeC:      make(chan struct{}, 1),
+		now:        time.Now,
+	}
+}
+
+// touch records that a message was received or sent. It does nothing if d is
+// nil.
+func (d *idleDisconnector) touch() {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.last = d.now()
+}
+
+// isAsleep returns true while the transport is disconnected for being idle.
+// It returns false if d is nil.
+func (d *idleDisconnector) isAsleep() bool {
+	if d == nil {
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.asleep
+}
+
+// wake connects the transport if it was disconnected for being idle, before a
+// message is sent, and records the activity. It does nothing if d is nil.
+func (d *idleDisconnector) wake() {
+	if d == nil {
+		return
+	}
+	d.touch()
+	if !d.isAsleep() {
+		return
+	}
+	if err := d.reconnect("outbound message"); err != nil {
+		log.Warnf("cannot connect to send message: %v", err)
+	}
+}
+
+// stop stops disconnecting and connecting the transport, for example because
+// it was told to disconnect permanently. It does nothing if d is nil.
+func (d *idleDisconnector) stop() {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.stopped = true
+	select {
+	case d.wakeC <- struct{}{}:
+	default:
+	}
+}
+
+// reconnect connects the transport, unless it was already connected by a
+// concurrent call.
+func (d *idleDisconnector) reconnect(reason string) error {
+	d.connecting.Lock()
+	defer d.connecting.Unlock()
+
+	d.lock.Lock()
+	if !d.asleep || d.stopped {
+		d.lock.Unlock()
+		return nil
+	}
+	d.lock.Unlock()
+
+	log.Infof("connecting after idle disconnect: %v", reason)
+	if err := d.connect(); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	d.asleep = false
+	d.last = d.now()
+	d.lock.Unlock()
+
+	// Let run start watching for the connection to become idle again.
+	select {
+	case d.wakeC <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// idle returns the time until the connection has been idle for the timeout,
+// or 0 if it already has.
+func (d *idleDisconnector) idle() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.busy != nil && d.busy() {
+		d.last = d.now()
+	}
+	remaining := d.timeout - d.now().Sub(d.last)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// run disconnects the transport each time it becomes idle and connects it
+// again on schedule. It returns once stop is called.
+func (d *idleDisconnector) run() {
+	for {
+		d.lock.Lock()
+		stopped, asleep := d.stopped, d.asleep
+		d.lock.Unlock()
+		if stopped {
+			return
+		}
+
+		if !asleep {
+			if remaining := d.idle(); remaining > 0 {
+				time.Sleep(remaining)
+				continue
+			}
+			d.connecting.Lock()
+			if d.idle() > 0 {
+				d.connecting.Unlock()
+				continue
+			}
+			d.lock.Lock()
+			d.asleep = true
+			d.lock.Unlock()
+			log.Infof("disconnecting after %v without messages", d.timeout)
+			d.disconnect()
+			d.connecting.Unlock()
+			continue
+		}
+
+		var scheduled <-chan time.Time
+		if d.interval > 0 {
+			scheduled = time.After(d.interval)
+		}
+		select {
+		case <-scheduled:
+			if err := d.reconnect("scheduled connection window"); err != nil {
+				log.Warnf("cannot connect for scheduled connection window, retrying in %v: %v", d.interval, err)
+			}
+		case <-d.wakeC:
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdleDisconnector(t *testing.T) {
+	var connects, disconnects int32
+	d := newIdleDisconnector(20*time.Millisecond, 0,
+		func() error { atomic.AddInt32(&connects, 1); return nil },
+		func() { atomic.AddInt32(&disconnects, 1) },
+		nil)
+
+	done := make(chan struct{})
+	go func() {
+		d.run()
+		close(done)
+	}()
+
+	// Activity keeps the connection open.
+	for i := 0; i < 5; i++ {
+		d.touch()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&disconnects); n != 0 {
+		t.Fatalf("expected no disconnect while active, got %v", n)
+	}
+
+	waitFor(t, func() bool { return d.isAsleep() })
+	if n := atomic.LoadInt32(&disconnects); n != 1 {
+		t.Errorf("expected 1 disconnect, got %v", n)
+	}
+
+	// Sending a message connects again, and the connection is closed again
+	// once idle.
+	d.wake()
+	if d.isAsleep() || atomic.LoadInt32(&connects) != 1 {
+		t.Errorf("expected transport to be connected to send a message")
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&disconnects) == 2 })
+
+	d.stop()
+	<-done
+	d.wake()
+	if n := atomic.LoadInt32(&connects); n != 1 {
+		t.Errorf("expected no connect after stop, got %v", n)
+	}
+}
+
+func TestIdleDisconnectorBusy(t *testing.T) {
+	var busy int32 = 1
+	d := newIdleDisconnector(10*time.Millisecond, time.Hour, func() error { return nil }, func() {}, func() bool { return atomic.LoadInt32(&busy) == 1 })
+
+	go d.run()
+	defer d.stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if d.isAsleep() {
+		t.Fatal("expected connection to stay open while busy")
+	}
+	atomic.StoreInt32(&busy, 0)
+	waitFor(t, func() bool { return d.isAsleep() })
+}
+
+// waitFor polls cond until it returns true, failing the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
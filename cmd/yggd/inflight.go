@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// An inFlightTracker tracks data messages received from the transport from
+// the time they are dispatched until they have been processed. A message is
+// processed once the response of its worker has been published (or spooled)
+// or once it is found that it cannot be delivered to a worker. Messages that
+// are not processed within the tracker's timeout stop being tracked.
+//
+// If the tracker has a limit, at most that many messages are tracked at once;
+// tracking another message blocks until one of them is processed, or, if the
+// tracker rejects messages at its limit, fails.
+type inFlightTracker struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	limit   int
+	reject  bool
+	slots   chan struct{}
+	waiters map[string]chan struct{}
+}
+
+// newInFlightTracker creates a tracker that stops tracking a message after
+// timeout (or never, if timeout is 0) and that tracks at most limit messages
+// (or any number of messages, if limit is 0). If reject is true, acquire
+// fails at the limit rather than blocking.
+func newInFlightTracker(timeout time.Duration, limit int, reject bool) *inFlightTracker {
+	a := inFlightTracker{
+		timeout: timeout,
+		limit:   limit,
+		reject:  reject,
+		waiters: make(map[string]chan struct{}),
+	}
+	if limit > 0 {
+		a.slots = make(chan struct{}, limit)
+	}
+	return &a
+}
+
+// add begins tracking the message with the given ID and returns a channel
+// that is closed once the message is processed. If the tracker is at its
+// limit, add blocks until another message is processed.
+func (a *inFlightTracker) add(id string) <-chan struct{} {
+	a.lock.Lock()
+	c, ok := a.waiters[id]
+	a.lock.Unlock()
+	if ok {
+		return c
+	}
+
+	if a.slots != nil {
+		a.slots <- struct{}{}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if c, ok := a.waiters[id]; ok {
+		a.release()
+		return c
+	}
+	c = make(chan struct{})
+	a.waiters[id] = c
+	return c
+}
+
+// acquire begins tracking the message with the given ID as add does, unless
+// the tracker rejects messages at its limit and is at it, in which case it
+// returns false.
+func (a *inFlightTracker) acquire(id string) (<-chan struct{}, bool) {
+	if !a.reject || a.slots == nil {
+		return a.add(id), true
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if c, ok := a.waiters[id]; ok {
+		return c, true
+	}
+	select {
+	case a.slots <- struct{}{}:
+	default:
+		return nil, false
+	}
+	c := make(chan struct{})
+	a.waiters[id] = c
+	return c, true
+}
+
+// done marks the message with the given ID as processed. It does nothing if
+// the message is not being tracked.
+func (a *inFlightTracker) done(id string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if c, ok := a.waiters[id]; ok {
+		close(c)
+		delete(a.waiters, id)
+		a.release()
+	}
+}
+
+// wait blocks until the message with the given ID is processed or the
+// tracker's timeout elapses, returning false if it timed out. A timeout of
+// zero waits indefinitely.
+func (a *inFlightTracker) wait(id string, c <-chan struct{}) bool {
+	if a.timeout <= 0 {
+		<-c
+		return true
+	}
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-c:
+		return true
+	case <-timer.C:
+		a.lock.Lock()
+		defer a.lock.Unlock()
+
+		// The message may have been processed after the timer fired.
+		if a.waiters[id] == c {
+			delete(a.waiters, id)
+			a.release()
+		}
+		return false
+	}
+}
+
+// release frees a slot held by a tracked message. The caller must hold the
+// lock.
+func (a *inFlightTracker) release() {
+	if a.slots != nil {
+		<-a.slots
+	}
+}
+
+// inFlightStatus reports the number of messages being tracked and the
+// tracker's limit.
+type inFlightStatus struct {
+	InFlight int `json:"in_flight"`
+	Limit    int `json:"limit"`
+}
+
+// status returns the number of messages being tracked and the tracker's
+// limit.
+func (a *inFlightTracker) status() inFlightStatus {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return inFlightStatus{InFlight: len(a.waiters), Limit: a.limit}
+}
+
+// handle is the control handler for the "in-flight" command.
+func (a *inFlightTracker) handle(args map[string]string) (interface{}, error) {
+	if a == nil {
+		return nil, fmt.Errorf("in-flight messages are not tracked")
+	}
+	return a.status(), nil
+}
+
+// inFlightAction calls the "in-flight" control command on the running daemon
+// and prints the result.
+func inFlightAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "in-flight", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var status inFlightStatus
+	if err := json.Unmarshal(result, &status); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	if status.Limit > 0 {
+		fmt.Fprintf(c.App.Writer, "%v/%v\n", status.InFlight, status.Limit)
+	} else {
+		fmt.Fprintf(c.App.Writer, "%v\n", status.InFlight)
+	}
+
+	return nil
+}
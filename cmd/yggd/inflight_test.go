@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInFlightTrackerDone(t *testing.T) {
+	a := newInFlightTracker(time.Second, 0, false)
+	c := a.add("1")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		a.done("1")
+	}()
+
+	if !a.wait("1", c) {
+		t.Fatal("wait timed out")
+	}
+	if got := a.status().InFlight; got != 0 {
+		t.Errorf("%v messages still in flight", got)
+	}
+
+	// Marking an untracked message as done is a no-op.
+	a.done("2")
+}
+
+func TestInFlightTrackerTimeout(t *testing.T) {
+	a := newInFlightTracker(10*time.Millisecond, 1, false)
+	c := a.add("1")
+
+	if a.wait("1", c) {
+		t.Fatal("wait did not time out")
+	}
+	if got := a.status().InFlight; got != 0 {
+		t.Errorf("%v messages still in flight", got)
+	}
+
+	// The slot held by the timed out message is free again.
+	a.add("2")
+}
+
+func TestInFlightTrackerLimit(t *testing.T) {
+	a := newInFlightTracker(0, 2, false)
+	a.add("1")
+	a.add("2")
+
+	added := make(chan struct{})
+	go func() {
+		a.add("3")
+		close(added)
+	}()
+
+	select {
+	case <-added:
+		t.Fatal("message added beyond the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if got, want := a.status(), (inFlightStatus{InFlight: 2, Limit: 2}); got != want {
+		t.Errorf("%+v != %+v", got, want)
+	}
+
+	a.done("1")
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("message not added after a slot was freed")
+	}
+}
+
+func TestInFlightTrackerReject(t *testing.T) {
+	a := newInFlightTracker(0, 1, true)
+	if _, ok := a.acquire("1"); !ok {
+		t.Fatal("message rejected below the limit")
+	}
+	if _, ok := a.acquire("1"); !ok {
+		t.Error("message already in flight rejected")
+	}
+	if _, ok := a.acquire("2"); ok {
+		t.Error("message accepted beyond the limit")
+	}
+
+	a.done("1")
+	if _, ok := a.acquire("2"); !ok {
+		t.Error("message rejected after a slot was freed")
+	}
+}
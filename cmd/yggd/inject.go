@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// injectedMetadataKey is the metadata key marking the data messages injected
+// through the "dispatch" control command. Its value is injectedControl.
+const (
+	injectedMetadataKey = "injected"
+	injectedControl     = "control"
+)
+
+// maxInjectedMessages is the number of injected messages whose results are
+// recognized; the results of older injected messages are published.
+const maxInjectedMessages = 1024
+
+// injectedMessages holds the IDs of the most recently injected data messages,
+// so that the results responding to them can be recognized. The zero value is
+// empty and ready to use.
+type injectedMessages struct {
+	sync.Mutex
+	ids   map[string]bool
+	order []string
+}
+
+// add records id, forgetting the oldest ID if maxInjectedMessages are held.
+func (m *injectedMessages) add(id string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.ids == nil {
+		m.ids = make(map[string]bool)
+	}
+	if m.ids[id] {
+		return
+	}
+	if len(m.order) == maxInjectedMessages {
+		delete(m.ids, m.order[0])
+		m.order = m.order[1:]
+	}
+	m.ids[id] = true
+	m.order = append(m.order, id)
+}
+
+// contains returns true if id is the ID of an injected message.
+func (m *injectedMessages) contains(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	return m.ids[id]
+}
+
+// handleDispatch is the control handler for the "dispatch" command. It passes
+// the data message in the "message" argument through the pipeline as if it
+// had been received from the broker, for testing a worker locally, and returns
+// its message ID. A message ID, type, version and sent time are filled in if
+// the message has none. The message is marked with injectedMetadataKey, and
+// its receipts and results are logged rather than published, so that nothing
+// reaches the broker on its behalf.
+func (c *Client) handleDispatch(args map[string]string) (interface{}, error) {
+	var msg yggdrasil.Data
+	if err := json.Unmarshal([]byte(args["message"]), &msg); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal data message: %w", err)
+	}
+	if msg.Directive == "" {
+		return nil, fmt.Errorf("missing directive")
+	}
+	if msg.MessageID == "" {
+		msg.MessageID = uuid.New().String()
+	}
+	if msg.Type == "" {
+		msg.Type = yggdrasil.MessageTypeData
+	}
+	if msg.Version == 0 {
+		msg.Version = 1
+	}
+	if msg.Sent.IsZero() {
+		msg.Sent = time.Now()
+	}
+	msg.Metadata = copyMetadata(msg.Metadata)
+	msg.Metadata[injectedMetadataKey] = injectedControl
+	c.injected.add(msg.MessageID)
+
+	log.Infof("dispatching data message %v from the control socket", msg.MessageID)
+	if err := c.ReceiveDataMessage(&msg); err != nil {
+		return nil, err
+	}
+	return msg.MessageID, nil
+}
+
+// dispatchAction calls the "dispatch" control command on the running daemon
+// with the data message read from the file given as argument, or from
+// standard input if there is none or it is "-", and prints its message ID.
+func dispatchAction(c *cli.Context) error {
+	var data []byte
+	var err error
+	if file := c.Args().First(); file == "" || file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return cli.Exit(fmt.Errorf("cannot read data message: %w", err), 1)
+	}
+
+	result, err := callControl(c.String("control-socket-addr"), "dispatch", map[string]string{"message": string(data)})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var id string
+	if err := json.Unmarshal(result, &id); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+	fmt.Println(id)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestHandleDispatch(t *testing.T) {
+	tests := []struct {
+		description string
+		message     string
+		wantID      string
+		wantError   bool
+	}{
+		{
+			description: "message ID",
+			message:     `{"message_id":"1234","directive":"echo","content":"aGVsbG8="}`,
+			wantID:      "1234",
+		},
+		{
+			description: "generated message ID",
+			message:     `{"directive":"echo"}`,
+		},
+		{
+			description: "missing directive",
+			message:     `{"message_id":"1234"}`,
+			wantError:   true,
+		},
+		{
+			description: "not json",
+			message:     `echo`,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.queue = &bufferedQueue{}
+			tr := &recordingTransport{}
+			c := Client{t: tr, d: d, receipts: map[string]string{receiptWildcard: "status"}}
+
+			got, err := c.handleDispatch(map[string]string{"message": test.message})
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id := got.(string); id == "" || (test.wantID != "" && id != test.wantID) {
+				t.Errorf("unexpected message ID: %q", id)
+			}
+			if d.queue.Len() != 1 {
+				t.Fatalf("expected 1 queued message, got %v", d.queue.Len())
+			}
+			q, _ := d.queue.Dequeue()
+			if q.data.Metadata[injectedMetadataKey] != injectedControl {
+				t.Errorf("expected message to be marked injected: %v", q.data.Metadata)
+			}
+			if len(tr.sent) != 0 {
+				t.Errorf("expected nothing published, got %v", tr.sent)
+			}
+		})
+	}
+}
+
+func TestInjectedResult(t *testing.T) {
+	tests := []struct {
+		description   string
+		responseTo    string
+		wantPublished bool
+	}{
+		{
+			description: "injected",
+			responseTo:  "1234",
+		},
+		{
+			description:   "received",
+			responseTo:    "5678",
+			wantPublished: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tr := &recordingTransport{}
+			c := Client{t: tr}
+			c.injected.add("1234")
+
+			c.handleResult(yggdrasil.Data{MessageID: "result", ResponseTo: test.responseTo, Directive: "echo"})
+
+			if got := len(tr.sent) > 0; got != test.wantPublished {
+				t.Errorf("published: %v != %v", got, test.wantPublished)
+			}
+		})
+	}
+}
+
+func TestInjectedMessagesLimit(t *testing.T) {
+	var m injectedMessages
+	for i := 0; i <= maxInjectedMessages; i++ {
+		m.add(fmt.Sprint(i))
+	}
+	if m.contains("0") {
+		t.Error("expected the oldest ID to be forgotten")
+	}
+	if !m.contains(fmt.Sprint(maxInjectedMessages)) {
+		t.Error("expected the newest ID to be held")
+	}
+}
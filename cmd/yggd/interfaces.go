@@ -0,0 +1,48 @@
+package main
+
+import "github.com/redhatinsights/yggdrasil"
+
+// Dispatcher is an interface representing the ability to deliver data
+// messages to workers and to collect the data they send back. The Client
+// depends only on this interface, so the dispatching side of the daemon can
+// be replaced, for example in tests.
+type Dispatcher interface {
+	// Dispatch queues data for delivery to the worker for its directive,
+	// along with the payload labels of its metrics, if any.
+	Dispatch(data yggdrasil.Data, labels []metricLabel)
+
+	// Results returns a channel on which data sent by workers is received.
+	Results() <-chan yggdrasil.Data
+
+	// Dispatchers returns the features of each registered worker, keyed by
+	// handler.
+	Dispatchers() map[string]map[string]string
+
+	// WorkerFacts returns the facts contributed by each registered worker,
+	// keyed by handler.
+	WorkerFacts() map[string]map[string]string
+
+	// Cancel requests that the assignment of the message with the given ID
+	// be cancelled.
+	Cancel(id string) error
+}
+
+// Processor is an interface representing the ability to act on decoded
+// messages received from a transport.
+type Processor interface {
+	ReceiveDataMessage(msg *yggdrasil.Data) error
+	ReceiveControlMessage(msg *yggdrasil.Control) error
+}
+
+// Router is an interface representing the ability to decode data received
+// from a transport and route it to the appropriate handler based on its
+// destination.
+type Router interface {
+	Route(data []byte, dest string)
+}
+
+var (
+	_ Dispatcher = (*dispatcher)(nil)
+	_ Processor  = (*Client)(nil)
+	_ Router     = messageRouter{}
+)
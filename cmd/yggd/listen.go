@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// The actions the dispatcher can take when its socket address is in use.
+const (
+	// addrInUseFail fails to start the dispatcher.
+	addrInUseFail = "fail"
+
+	// addrInUseRemoveStale removes the socket file if no process is
+	// listening on it, left behind by an instance that did not clean up, and
+	// listens again. It fails if a live process is listening on it.
+	addrInUseRemoveStale = "remove-stale"
+
+	// addrInUseWait removes a stale socket file like addrInUseRemoveStale and
+	// retries, with backoff, while a live process is listening on it, until
+	// the address is released or the timeout passes.
+	addrInUseWait = "wait"
+)
+
+// listenRetryInterval is how long to wait before first retrying an address
+// in use. The wait doubles with each retry, up to listenRetryMaxInterval.
+var (
+	listenRetryInterval    = time.Second
+	listenRetryMaxInterval = 30 * time.Second
+)
+
+// errAddrInUseLive is returned when the socket address is in use by a live
+// process.
+var errAddrInUseLive = errors.New("another process is listening on the socket")
+
+// listenDispatcher listens on the unix socket addr, handling an address
+// already in use according to action. With addrInUseWait, it retries for up to
+// timeout.
+func listenDispatcher(addr string, action string, timeout time.Duration) (net.Listener, error) {
+	deadline := time.Now().Add(timeout)
+	wait := listenRetryInterval
+	removed := false
+	for {
+		l, err := net.Listen("unix", addr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) || action == addrInUseFail {
+			return l, err
+		}
+
+		// A socket removed once and in use again belongs to a live
+		// process that took it over in the meantime.
+		if !removed {
+			stale, serr := removeStaleSocket(addr)
+			if serr != nil {
+				return nil, fmt.Errorf("%v: cannot check for a stale socket: %w", err, serr)
+			}
+			if stale {
+				log.Warnf("removed stale socket %v: no process is listening on it", addr)
+				removed = true
+				continue
+			}
+		}
+
+		if action != addrInUseWait || !time.Now().Add(wait).Before(deadline) {
+			return nil, fmt.Errorf("cannot listen on %v: %w", addr, errAddrInUseLive)
+		}
+		log.Warnf("socket %v is in use by another process: retrying in %v", addr, wait)
+		time.Sleep(wait)
+		if wait *= 2; wait > listenRetryMaxInterval {
+			wait = listenRetryMaxInterval
+		}
+	}
+}
+
+// removeStaleSocket removes the socket file at addr and returns true if no
+// process is listening on it. The address of an abstract socket (starting with
+// "@") is released when its listener exits, so it is never stale. A file that
+// is not a socket is never removed.
+func removeStaleSocket(addr string) (bool, error) {
+	if strings.HasPrefix(addr, "@") {
+		return false, nil
+	}
+	info, err := os.Lstat(addr)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Released since; listening again will tell.
+			return true, nil
+		}
+		return false, err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return false, fmt.Errorf("%v is not a socket", addr)
+	}
+
+	conn, err := net.DialTimeout("unix", addr, time.Second)
+	if err == nil {
+		conn.Close()
+		return false, nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return false, err
+	}
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("cannot remove stale socket: %w", err)
+	}
+	return true, nil
+}
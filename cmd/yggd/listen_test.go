@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenDispatcher(t *testing.T) {
+	defer func(interval time.Duration) { listenRetryInterval = interval }(listenRetryInterval)
+	listenRetryInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		description string
+		action      string
+		stale       bool
+		release     bool
+		wantErr     bool
+	}{
+		{description: "fail stale", action: addrInUseFail, stale: true, wantErr: true},
+		{description: "remove stale", action: addrInUseRemoveStale, stale: true},
+		{description: "remove stale live", action: addrInUseRemoveStale, wantErr: true},
+		{description: "wait live", action: addrInUseWait, wantErr: true},
+		{description: "wait released", action: addrInUseWait, release: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			addr := filepath.Join(dir, "dispatcher.sock")
+
+			other, err := net.Listen("unix", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer other.Close()
+			if test.stale {
+				// Leave the socket file behind, as a process that died would.
+				other.(*net.UnixListener).SetUnlinkOnClose(false)
+				other.Close()
+			}
+			if test.release {
+				time.AfterFunc(50*time.Millisecond, func() { other.Close() })
+			}
+
+			l, err := listenDispatcher(addr, test.action, 200*time.Millisecond)
+			if test.wantErr {
+				if err == nil {
+					l.Close()
+					t.Fatal("expected error")
+				}
+				if _, err := os.Stat(addr); err != nil {
+					t.Errorf("expected the socket to be left in place: %v", err)
+				}
+				if !test.stale && !errors.Is(err, errAddrInUseLive) {
+					t.Errorf("expected a live process error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Close()
+		})
+	}
+}
+
+func TestRemoveStaleSocketNotSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "dispatcher.sock")
+	if err := ioutil.WriteFile(addr, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := listenDispatcher(addr, addrInUseRemoveStale, 0); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := os.Stat(addr); err != nil {
+		t.Errorf("expected the file to be left in place: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// defaultLivenessInterval is the interval at which the liveness file is
+// touched, if not set.
+const defaultLivenessInterval = 10 * time.Second
+
+// A livenessCheck is one of the conditions the daemon must meet to be
+// healthy. check returns an error describing why the condition is not met.
+type livenessCheck struct {
+	name  string
+	check func() error
+}
+
+// livenessFile touches a file every interval while the daemon is healthy, so
+// that an external watchdog can restart the daemon once the modification time
+// of the file goes stale. The daemon is healthy while each of checks passes
+// and the checks complete within the interval, so that a daemon whose
+// pipeline is stuck stops touching the file too.
+type livenessFile struct {
+	path     string
+	interval time.Duration
+	checks   []livenessCheck
+
+	// touch touches the file, or in its place notifies what path names.
+	touch func() error
+
+	stopOnce sync.Once
+	stopC    chan struct{}
+	done     chan struct{}
+
+	// healthy is the outcome of the last run of the checks, so that changes
+	// of health are logged once.
+	healthy bool
+}
+
+func newLivenessFile(path string, interval time.Duration, checks []livenessCheck) *livenessFile {
+	return &livenessFile{
+		path:     path,
+		interval: interval,
+		checks:   checks,
+		touch:    func() error { return touchFile(path) },
+		stopC:    make(chan struct{}),
+		done:     make(chan struct{}),
+		healthy:  true,
+	}
+}
+
+// run runs the checks and touches the file every interval until stop is
+// called.
+func (l *livenessFile) run() {
+	defer close(l.done)
+	log.Infof("touching %v every %v while healthy", l.path, l.interval)
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	var result chan error
+	for {
+		if result == nil {
+			result = make(chan error, 1)
+			go func(result chan<- error) { result <- l.check() }(result)
+		}
+
+		var err error
+		select {
+		case err = <-result:
+			result = nil
+		case <-ticker.C:
+			err = fmt.Errorf("health checks did not complete within %v", l.interval)
+		case <-l.stopC:
+			return
+		}
+		l.record(err)
+		if err == nil {
+			if err := l.touch(); err != nil {
+				log.Errorf("cannot touch %v: %v", l.path, err)
+			}
+		}
+
+		if result == nil {
+			select {
+			case <-ticker.C:
+			case <-l.stopC:
+				return
+			}
+		}
+	}
+}
+
+// check runs each of the checks, returning an error listing those that fail.
+func (l *livenessFile) check() error {
+	return runLivenessChecks(l.checks)
+}
+
+// runLivenessChecks runs each of checks, returning an error listing those
+// that fail.
+func runLivenessChecks(checks []livenessCheck) error {
+	var failures []string
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			failures = append(failures, c.name+": "+err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%v", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// record logs the outcome err of a run of the checks if the health of the
+// daemon changed.
+func (l *livenessFile) record(err error) {
+	switch {
+	case err != nil && l.healthy:
+		log.Warnf("unhealthy, not touching %v: %v", l.path, err)
+	case err == nil && !l.healthy:
+		log.Infof("healthy again, touching %v", l.path)
+	}
+	l.healthy = err == nil
+}
+
+// stop stops touching the file and waits for the last touch to complete. It
+// does nothing if l is nil.
+func (l *livenessFile) stop() {
+	if l == nil {
+		return
+	}
+
+	l.stopOnce.Do(func() { close(l.stopC) })
+	<-l.done
+}
+
+// touchFile sets the modification time of the file at path to the current
+// time, creating the file if needed.
+func touchFile(path string) error {
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %w", err)
+	}
+	return f.Close()
+}
+
+// connectedCheck returns an error if the client's transport is not connected
+// to any of its brokers, unless it was disconnected for being idle. A
+// transport that does not connect to brokers is always connected.
+func (c *Client) connectedCheck() error {
+	if c.idle.isAsleep() {
+		return nil
+	}
+	r, ok := c.t.(transport.BrokerStatusReporter)
+	if !ok {
+		return nil
+	}
+	if connectedBrokers(r.BrokerStatus()) > 0 {
+		return nil
+	}
+	return fmt.Errorf("not connected to any broker")
+}
+
+// responsiveCheck returns once the dispatcher's state can be read, so that a
+// dispatcher stuck holding its lock fails the health checks by not returning.
+func (d *dispatcher) responsiveCheck() error {
+	d.RLock()
+	defer d.RUnlock()
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLivenessFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alive")
+
+	// state is 0 while healthy, 1 while a check fails and 2 while a check
+	// hangs.
+	var state int32
+	hung := make(chan struct{})
+	l := newLivenessFile(path, 10*time.Millisecond, []livenessCheck{
+		{"test", func() error {
+			switch atomic.LoadInt32(&state) {
+			case 1:
+				return errors.New("failing")
+			case 2:
+				<-hung
+			}
+			return nil
+		}},
+	})
+	go l.run()
+	defer l.stop()
+
+	// touched waits for the file to be touched after since, returning false
+	// if it is not within a few intervals.
+	touched := func(since time.Time) bool {
+		deadline := time.Now().Add(100 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			if info, err := os.Stat(path); err == nil && info.ModTime().After(since) {
+				return true
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return false
+	}
+
+	if !touched(time.Time{}) {
+		t.Fatal("liveness file not created while healthy")
+	}
+	for _, s := range []int32{1, 2} {
+		atomic.StoreInt32(&state, s)
+		// Let a run of the checks that started before the change finish.
+		time.Sleep(30 * time.Millisecond)
+		if touched(time.Now()) {
+			t.Errorf("liveness file touched in state %v", s)
+		}
+	}
+
+	atomic.StoreInt32(&state, 0)
+	close(hung)
+	if !touched(time.Now()) {
+		t.Error("liveness file not touched once healthy again")
+	}
+
+	l.stop()
+	time.Sleep(30 * time.Millisecond)
+	if touched(time.Now()) {
+		t.Error("liveness file touched after stopping")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultWorkerLogMaxSize is the size in bytes at which a worker log file is
+// rotated if no size is configured.
+const defaultWorkerLogMaxSize = 10 * 1024 * 1024
+
+// defaultWorkerLogMaxFiles is the number of rotated worker log files kept if
+// no number is configured.
+const defaultWorkerLogMaxFiles = 5
+
+// A rotatingFile is an io.WriteCloser that appends to a file, rotating it when
+// a write would grow it beyond maxSize bytes. Rotated files are renamed with a
+// numeric suffix (".1" being the most recent) and at most maxFiles of them are
+// kept.
+type rotatingFile struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+
+	// discard, if set, is called with the name of the file about to be
+	// discarded by a rotation. If it returns false, the file is kept, and
+	// the rotated files are shifted beyond maxFiles.
+	discard func(name string) bool
+}
+
+// openRotatingFile opens path for appending, creating it and its parent
+// directory if necessary.
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("cannot create directory: %w", err)
+	}
+
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("cannot open file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot stat file: %w", err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate closes the current file, shifts the rotated files up by one,
+// discarding the oldest, and opens a new, empty file.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("cannot close file: %w", err)
+	}
+
+	n := f.maxFiles
+	for f.discard != nil && f.exists(n) && !f.discard(f.name(n)) {
+		n++
+	}
+	if n == 0 {
+		if err := os.Remove(f.path); err != nil {
+			return fmt.Errorf("cannot remove file: %w", err)
+		}
+		return f.open()
+	}
+	for i := n - 1; i > 0; i-- {
+		if err := os.Rename(f.name(i), f.name(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot rename file: %w", err)
+		}
+	}
+	if err := os.Rename(f.path, f.name(1)); err != nil {
+		return fmt.Errorf("cannot rename file: %w", err)
+	}
+
+	return f.open()
+}
+
+// exists returns true if the nth rotated file, or the current file if n is 0,
+// exists.
+func (f *rotatingFile) exists(n int) bool {
+	_, err := os.Stat(f.name(n))
+	return err == nil
+}
+
+// name returns the name of the nth rotated file, or of the current file if n
+// is 0.
+func (f *rotatingFile) name(n int) string {
+	if n == 0 {
+		return f.path
+	}
+	return fmt.Sprintf("%v.%v", f.path, n)
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.file.Close()
+}
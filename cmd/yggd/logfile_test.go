@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		description string
+		maxSize     int64
+		maxFiles    int
+		writes      []string
+		want        map[string]string
+	}{
+		{
+			description: "no rotation",
+			maxSize:     16,
+			maxFiles:    2,
+			writes:      []string{"one\n", "two\n"},
+			want:        map[string]string{"worker.log": "one\ntwo\n"},
+		},
+		{
+			description: "rotation",
+			maxSize:     8,
+			maxFiles:    2,
+			writes:      []string{"one\n", "two\n", "three\n", "four\n"},
+			want: map[string]string{
+				"worker.log":   "four\n",
+				"worker.log.1": "three\n",
+				"worker.log.2": "one\ntwo\n",
+			},
+		},
+		{
+			description: "oldest discarded",
+			maxSize:     4,
+			maxFiles:    1,
+			writes:      []string{"one\n", "two\n", "three\n"},
+			want: map[string]string{
+				"worker.log":   "three\n",
+				"worker.log.1": "two\n",
+			},
+		},
+		{
+			description: "no rotated files kept",
+			maxSize:     4,
+			maxFiles:    0,
+			writes:      []string{"one\n", "two\n"},
+			want:        map[string]string{"worker.log": "two\n"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			f, err := openRotatingFile(filepath.Join(dir, "logs", "worker.log"), test.maxSize, test.maxFiles)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range test.writes {
+				if _, err := f.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			fileInfos, err := ioutil.ReadDir(filepath.Join(dir, "logs"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			for _, info := range fileInfos {
+				data, err := ioutil.ReadFile(filepath.Join(dir, "logs", info.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[info.Name()] = string(data)
+			}
+
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/urfave/cli/v2"
+)
+
+// configuredLogLevel holds the log level the daemon was started with (from the
+// command line or config file), as changed by reloading the config file.
+// Runtime changes made through the control socket can be reverted to this
+// value.
+var configuredLogLevel struct {
+	sync.Mutex
+	level log.Level
+}
+
+// configuredLevel returns the configured log level.
+func configuredLevel() log.Level {
+	configuredLogLevel.Lock()
+	defer configuredLogLevel.Unlock()
+	return configuredLogLevel.level
+}
+
+// setConfiguredLevel makes level the configured log level, returning true if
+// it changed.
+func setConfiguredLevel(level log.Level) bool {
+	configuredLogLevel.Lock()
+	defer configuredLogLevel.Unlock()
+	changed := configuredLogLevel.level != level
+	configuredLogLevel.level = level
+	return changed
+}
+
+// setLogLevel changes the level of the standard logger. Because every
+// component logs through the standard logger, the new level takes effect
+// immediately across the daemon.
+func setLogLevel(level log.Level) {
+	log.SetLevel(level)
+	if level >= log.LevelDebug {
+		log.SetFlags(log.LstdFlags | log.Llongfile)
+	} else {
+		log.SetFlags(log.LstdFlags)
+	}
+}
+
+// handleLogLevel is the control handler for the "log-level" command. With no
+// "level" argument it reports the current level. A "level" of "configured"
+// reverts to the level the daemon was started with. With a "worker" argument,
+// it reports or changes the level of that worker instead.
+func handleLogLevel(args map[string]string) (interface{}, error) {
+	if name := args["worker"]; name != "" {
+		return handleWorkerLogLevel(name, args)
+	}
+	if value, ok := args["level"]; ok {
+		level := configuredLevel()
+		if value != "configured" {
+			var err error
+			level, err = log.ParseLevel(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if level != log.CurrentLevel() {
+			log.Infof("changing log level from %v to %v", log.CurrentLevel(), level)
+			setLogLevel(level)
+		}
+	}
+
+	return strings.ToLower(log.CurrentLevel().String()), nil
+}
+
+// logLevelAction calls the "log-level" control command on the running daemon
+// and prints the resulting level. The control arguments are chosen based on
+// which subcommand was invoked.
+func logLevelAction(c *cli.Context) error {
+	args := make(map[string]string)
+	switch c.Command.Name {
+	case "set":
+		if !c.Args().Present() {
+			return cli.Exit("missing LEVEL argument", 1)
+		}
+		args["level"] = c.Args().First()
+	case "reset":
+		args["level"] = "configured"
+	}
+	if c.String("worker") != "" {
+		args["worker"] = c.String("worker")
+	}
+
+	result, err := callControl(c.String("control-socket-addr"), "log-level", args)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var level string
+	if err := json.Unmarshal(result, &level); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+	fmt.Fprintln(c.App.Writer, level)
+
+	return nil
+}
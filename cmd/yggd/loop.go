@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// loopDetectorCapacity is the number of received message hop counts retained
+// so that responses to those messages can carry the hop count forward.
+const loopDetectorCapacity = 1024
+
+// A loopDetector protects against messages that loop between the client and
+// the broker, such as a backend that echoes published messages back onto a
+// subscribed topic. Outbound messages are stamped with the client ID and a hop
+// count, and inbound messages are rejected if they carry this client's origin
+// marker or have been relayed too many times.
+type loopDetector struct {
+	sync.Mutex
+	origin  string
+	maxHops int
+	hops    map[string]int
+	order   []string
+}
+
+func newLoopDetector(origin string, maxHops int) *loopDetector {
+	return &loopDetector{
+		origin:  origin,
+		maxHops: maxHops,
+		hops:    make(map[string]int),
+	}
+}
+
+// check returns an error if msg appears to have been published by this client
+// or has exceeded the maximum hop count. Otherwise, the hop count of msg is
+// recorded so it can be propagated to responses.
+func (l *loopDetector) check(msg *yggdrasil.Data) error {
+	if msg.Origin != "" && msg.Origin == l.origin {
+		return fmt.Errorf("loop detected: message %v originated from this client", msg.MessageID)
+	}
+	if l.maxHops > 0 && msg.Hops > l.maxHops {
+		return fmt.Errorf("loop detected: message %v exceeded %v hops", msg.MessageID, l.maxHops)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if _, prs := l.hops[msg.MessageID]; !prs {
+		if len(l.order) >= loopDetectorCapacity {
+			delete(l.hops, l.order[0])
+			l.order = l.order[1:]
+		}
+		l.order = append(l.order, msg.MessageID)
+	}
+	l.hops[msg.MessageID] = msg.Hops
+
+	return nil
+}
+
+// stamp sets the origin marker on msg and sets its hop count to one more than
+// that of the message it responds to.
+func (l *loopDetector) stamp(msg *yggdrasil.Data) {
+	l.Lock()
+	defer l.Unlock()
+	msg.Origin = l.origin
+	msg.Hops = l.hops[msg.ResponseTo] + 1
+}
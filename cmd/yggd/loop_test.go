@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestLoopDetector(t *testing.T) {
+	l := newLoopDetector("client-1", 3)
+
+	tests := []struct {
+		description string
+		input       yggdrasil.Data
+		wantError   bool
+	}{
+		{
+			description: "from backend",
+			input:       yggdrasil.Data{MessageID: "a"},
+		},
+		{
+			description: "relayed below limit",
+			input:       yggdrasil.Data{MessageID: "b", Origin: "client-2", Hops: 3},
+		},
+		{
+			description: "own origin",
+			input:       yggdrasil.Data{MessageID: "c", Origin: "client-1", Hops: 1},
+			wantError:   true,
+		},
+		{
+			description: "too many hops",
+			input:       yggdrasil.Data{MessageID: "d", Origin: "client-2", Hops: 4},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := l.check(&test.input)
+			if test.wantError && err == nil {
+				t.Errorf("expected error")
+			}
+			if !test.wantError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	response := yggdrasil.Data{MessageID: "e", ResponseTo: "b"}
+	l.stamp(&response)
+	if response.Origin != "client-1" || response.Hops != 4 {
+		t.Errorf("unexpected stamp: %v, %v", response.Origin, response.Hops)
+	}
+}
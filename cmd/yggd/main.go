@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -31,6 +31,17 @@ var ClientID = ""
 var UserAgent = yggdrasil.LongName + "/" + yggdrasil.Version
 
 func main() {
+	// A worker limited by a cgroup is started through the daemon's
+	// executable, which joins the cgroup and then executes the worker.
+	if len(os.Args) > 1 && os.Args[1] == cgroupTrampolineArg {
+		runCgroupTrampoline(os.Args[2:])
+	}
+	// A worker with a umask of its own is likewise started through the
+	// daemon's executable, which sets the umask and then executes the worker.
+	if len(os.Args) > 1 && os.Args[1] == umaskTrampolineArg {
+		runUmaskTrampoline(os.Args[2:])
+	}
+
 	app := cli.NewApp()
 	app.Name = yggdrasil.ShortName + "d"
 	app.Version = yggdrasil.Version
@@ -53,6 +64,25 @@ func main() {
 			Value: "info",
 			Usage: "Set the logging output level to `LEVEL`",
 		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "log-config-sources",
+			Usage: "Log the effective value of each config setting and its source (default, file, env or flag) at start up",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "log-payloads",
+			Usage: "Log the payloads of data messages as they are received, dispatched and returned by workers, at the trace level",
+			Value: true,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "log-payload-max-size",
+			Usage: "Log payloads of up to `BYTES` in full, and truncate larger ones (0 to log only their size)",
+			Value: defaultPayloadLogMaxSize,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "log-payload-redact",
+			Usage: "Redact the values of the JSON payload and metadata key `KEY` from logged payloads (may be repeated)",
+			Value: cli.NewStringSlice(defaultPayloadLogRedact...),
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:  "cert-file",
 			Usage: "Use `FILE` as the client certificate",
@@ -66,21 +96,212 @@ func main() {
 			Hidden: true,
 			Usage:  "Use `FILE` as the root CA",
 		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "cert-expiry-warning",
+			Usage: "Log a warning when the client certificate or a certificate authority expires within `DURATION`",
+			Value: 30 * 24 * time.Hour,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "cert-watch-interval",
+			Usage: "Check cert-file, key-file and ca-root for changes every `DURATION`, reloading them and reconnecting to the broker once they change (0 to disable)",
+		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
-			Name:   "topic-prefix",
-			Value:  yggdrasil.TopicPrefix,
-			Hidden: true,
-			Usage:  "Use `PREFIX` as the MQTT topic prefix",
+			Name:  "cert-expiry-topic",
+			Usage: "Publish a certificate-expiry message to `TOPIC` when a certificate expires within the expiry warning (disabled if empty)",
 		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
-			Name:  "protocol",
-			Usage: "Transmit data remotely using `PROTOCOL` ('mqtt' or 'http')",
-			Value: "mqtt",
+			Name:  "topic-prefix",
+			Value: yggdrasil.TopicPrefix,
+			Usage: "Use `PREFIX` as the MQTT topic prefix (may be empty)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "protocol",
+			Aliases: []string{"transport"},
+			Usage:   "Transmit data remotely using `PROTOCOL` ('mqtt', 'http' or 'file')",
+			Value:   "mqtt",
 		}),
 		altsrc.NewStringFlag(&cli.StringFlag{
 			Name:  "server",
 			Usage: "Connect the client to the specified `URI`",
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "no-brokers-action",
+			Usage: "Handle a configuration without MQTT brokers with `ACTION` ('fail' to exit with an error, or 'local' to run without a transport)",
+			Value: "fail",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "inbox-dir",
+			Usage:     "Receive messages from the files placed in `DIR` when the protocol is 'file'",
+			Value:     filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "inbox"),
+			TakesFile: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "outbox-dir",
+			Usage:     "Write sent messages to files in `DIR` when the protocol is 'file'",
+			Value:     filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "outbox"),
+			TakesFile: true,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "http-poll-interval",
+			Usage: "Poll the HTTP server for new messages every `DURATION` (with protocol 'http')",
+			Value: 5 * time.Second,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "inbox-poll-interval",
+			Usage: "Check the inbox directory for new message files every `DURATION`",
+			Value: 5 * time.Second,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "publish-server",
+			Usage: "Publish worker results to the MQTT broker at `URI` instead of the command broker",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "handshake-broker",
+			Usage: "Publish connection-status and other control messages to the `BROKER` ('inbound' or 'outbound') when results are published to a separate broker",
+			Value: "inbound",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "presence-broker",
+			Usage: "Publish presence messages to the `BROKER` ('inbound' or 'outbound') when results are published to a separate broker",
+			Value: "inbound",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "connect-mode",
+			Usage: "Connect to the server using `MODE` ('on-start' exits if the server is unreachable, 'lazy' keeps retrying in the background)",
+			Value: "on-start",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "connect-warm-up",
+			Usage: "Wait `DURATION` after connecting to the server before publishing the handshake",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "handshake-timeout",
+			Usage: "Abandon and retry a handshake that does not complete within `DURATION` (0 waits indefinitely)",
+			Value: 2 * time.Minute,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "mqtt-clean-session",
+			Usage: "Start a clean MQTT session on connect (disable to resume a persistent session)",
+			Value: true,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "mqtt-publish-wait-for-ack",
+			Usage: "Wait for the broker to acknowledge each published message (connection-status messages always wait)",
+			Value: true,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "mqtt-publish-qos",
+			Usage: "Publish messages at MQTT QoS `LEVEL` (0, 1 or 2; messages waiting for acknowledgement use 1 at least)",
+			Value: transport.DefaultPublishQoS,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-publish-timeout",
+			Usage: "Fail a publish if the broker does not acknowledge it within `DURATION` (0 to wait indefinitely)",
+			Value: 30 * time.Second,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "mqtt-max-message-size",
+			Usage: "Do not publish MQTT messages larger than `BYTES`, the broker's maximum message size (0 for no limit)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-keepalive",
+			Usage: "Send MQTT keepalive pings every `DURATION`",
+			Value: 30 * time.Second,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-initial-reconnect-interval",
+			Usage: "Wait `DURATION` after the first failed MQTT connection attempt, doubling the delay after each further failure",
+			Value: transport.DefaultInitialReconnectInterval,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-max-reconnect-interval",
+			Usage: "Wait at most `DURATION` between MQTT reconnection attempts",
+			Value: transport.DefaultMaxReconnectInterval,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-reconnect-jitter",
+			Usage: "Delay the first attempt to reconnect after losing the connection to the broker by a random duration of up to `DURATION`",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-failback-interval",
+			Usage: "While connected to a fallback broker, try the brokers listed before it every `DURATION` and move to the first that accepts the connection (disabled if 0)",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "mqtt-subscribe-retries",
+			Usage: "Retry subscribing to a topic after a transient failure up to `NUM` times before reconnecting",
+			Value: transport.DefaultSubscribeRetries,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "mqtt-fresh-client-id-after",
+			Usage: "Connect to a broker with a fresh client ID and a clean session after `NUM` consecutive failed connection attempts (0 to disable)",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "mqtt-revert-client-id",
+			Usage: "Use the client ID again on the next reconnect after connecting with a fresh one",
+			Value: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "mqtt-auth-failure-action",
+			Usage: "When a broker rejects the client's credentials, connect again after mqtt-auth-failure-retry-interval (\"backoff\") or stop connecting until restarted (\"stop\")",
+			Value: authFailureBackoff,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-auth-failure-retry-interval",
+			Usage: "Wait at least `DURATION` before connecting again to a broker that rejected the client's credentials",
+			Value: transport.DefaultAuthRetryInterval,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "mqtt-max-concurrent-connects",
+			Usage: "Make at most `NUM` MQTT connection attempts at once, across all brokers (0 for no limit)",
+			Value: 1,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-connect-interval",
+			Usage: "Start MQTT connection attempts, across all brokers, at least `DURATION` apart",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-dns-cache-ttl",
+			Usage: "Cache the addresses of MQTT broker hostnames for `DURATION`, refreshing them in the background (0 to resolve on every connection attempt)",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "mqtt-tcp-keepalive",
+			Usage: "Send TCP keepalive probes on MQTT broker connections",
+			Value: true,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-tcp-keepalive-idle",
+			Usage: "Send the first TCP keepalive probe after a broker connection is idle for `DURATION`",
+			Value: time.Minute,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-tcp-keepalive-interval",
+			Usage: "Send TCP keepalive probes every `DURATION`",
+			Value: 15 * time.Second,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "mqtt-tcp-keepalive-count",
+			Usage: "Consider a broker connection dead after `N` unacknowledged TCP keepalive probes",
+			Value: 4,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "mqtt-proxy",
+			Usage: "Connect to MQTT brokers through the HTTP or SOCKS5 proxy `URL` (from ALL_PROXY, HTTPS_PROXY or HTTP_PROXY if unset)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "mqtt-proxy-credentials-file",
+			Usage:     "Read the proxy username and password from `FILE`, as \"username:password\"",
+			TakesFile: true,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "mqtt-srv-refresh-interval",
+			Usage: "Resolve the DNS SRV records of 'srv://' brokers again every `DURATION`",
+			Value: transport.DefaultSRVRefreshInterval,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "mqtt-dns-use-stale",
+			Usage: "Connect to the last known address of an MQTT broker if its hostname cannot be resolved (requires mqtt-dns-cache-ttl)",
+			Value: true,
+		}),
 		&cli.BoolFlag{
 			Name:   "generate-man-page",
 			Hidden: true,
@@ -94,29 +315,1006 @@ func main() {
 			Usage: "Force all HTTP traffic over `HOST`",
 			Value: yggdrasil.DataHost,
 		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "metrics-exporter",
+			Usage: "Export metrics with `EXPORTER` ('prometheus', 'statsd' or 'otlp'; 'prometheus' if empty and metrics-address is set)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:    "metrics-address",
+			Aliases: []string{"metrics-addr"},
+			Usage:   "Serve Prometheus metrics on, or push metrics to, `ADDRESS` (an OTLP address is the collector's metrics URL)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "metrics-interval",
+			Usage: "Push metrics to StatsD or OTLP collectors every `DURATION`",
+			Value: 10 * time.Second,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "tracing-endpoint",
+			Usage: "Trace data messages through the pipeline and push the spans to the OTLP collector `URL` (disabled if empty)",
+		}),
+		altsrc.NewFloat64Flag(&cli.Float64Flag{
+			Name:  "tracing-sample-rate",
+			Usage: "Sample a fraction `RATE` (between 0 and 1) of the traces that do not continue a trace context received with the message",
+			Value: 1,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "skip-privileged",
+			Usage: "Skip operations that require a privileged user, such as reading the BIOS UUID",
+		}),
 		&cli.StringFlag{
 			Name:   "socket-addr",
 			Usage:  "Force yggd to listen on `SOCKET`",
 			Value:  fmt.Sprintf("@yggd-dispatcher-%v", randomString(6)),
 			Hidden: true,
 		},
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "socket-addr-in-use",
+			Usage: "When the dispatcher socket address is in use, fail (\"fail\"), remove a stale socket file (\"remove-stale\") or also wait for a live process to release it (\"wait\")",
+			Value: addrInUseFail,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "socket-addr-in-use-timeout",
+			Usage: "Wait up to `DURATION` for the dispatcher socket address to be released, with socket-addr-in-use = \"wait\"",
+			Value: 30 * time.Second,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "worker-registration-socket",
+			Usage:     "Accept registrations from workers yggd did not start on the unix socket `PATH` (disabled if empty)",
+			TakesFile: true,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "allow-directive",
+			Usage: "Accept only data messages with the directive `NAME` (may be repeated; all directives are accepted if unset)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "deny-directive",
+			Usage: "Reject data messages with the directive `NAME` (may be repeated)",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "dedup-cache-size",
+			Usage: "Drop data messages whose ID is among the last `N` IDs received (0 to disable)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "dedup-cache-ttl",
+			Usage: "Forget a received message ID after `DURATION` (0 to keep IDs until evicted)",
+			Value: time.Hour,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "dedup-key",
+			Usage: "Recognize duplicate data messages by their ID (\"id\"), by a hash of their directive and content (\"content-hash\") or by either (\"both\")",
+			Value: dedupKeyID,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "dedup-content-window",
+			Usage: "Drop data messages whose content was received within `DURATION`, with dedup-key \"content-hash\" or \"both\"",
+			Value: time.Minute,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "memory-budget",
+			Usage: "Evict duplicate detection cache entries, then reject data messages, once they and the queued data messages hold more than an estimated `BYTES` of memory (0 for no limit)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "denied-directive-action",
+			Usage: "Handle data messages with a directive that is not permitted with `ACTION` ('drop' or 'dead-letter')",
+			Value: "drop",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "max-queue-age",
+			Usage: "Do not dispatch data messages that waited longer than `DURATION` to be dispatched (0 to disable)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "queue-backend",
+			Usage: "Hold the queues of data messages waiting to be dispatched and published in `BACKEND` ('memory' or 'disk', which keeps them across restarts)",
+			Value: queueBackendMemory,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "queue-dir",
+			Usage:     "Store the queued data messages of the disk queue backend in `DIR`",
+			Value:     filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "queue"),
+			TakesFile: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "stale-message-action",
+			Usage: "Handle data messages that waited longer than the maximum queue age with `ACTION` ('drop' or 'dead-letter')",
+			Value: "drop",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "dead-letter-topic",
+			Usage: "Publish dead-lettered messages for a directive to a destination other than 'dead-letter', as `DIRECTIVE=DEST` (DIRECTIVE may be '*'; may be repeated)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "dead-letter-file",
+			Usage:     "Keep the most recent dead-lettered messages in `FILE` so that they can be replayed (not kept if empty)",
+			TakesFile: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "unparseable-payload-action",
+			Usage: "Handle received payloads that cannot be decoded with `ACTION` ('drop', 'dead-letter' or 'ack')",
+			Value: unparseableDrop,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "parse-error-topic",
+			Usage: "Publish parse-error messages for payloads that cannot be decoded to the destination `DEST` when the unparseable payload action is 'ack'",
+			Value: "parse-error",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "desired-state-topic",
+			Usage: "Reconcile desired-state messages received from the destination `DEST` (disabled if empty)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "desired-state-file",
+			Usage:     "Record the desired state versions applied by workers in `FILE` (not recorded across restarts if empty)",
+			Value:     defaultDesiredStateFile,
+			TakesFile: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "audit-file",
+			Usage:     "Append a record of every pipeline event to the audit log `FILE` (not kept if empty)",
+			Value:     defaultAuditFile,
+			TakesFile: true,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "audit-max-size",
+			Usage: "Rotate the audit log when it reaches `BYTES`",
+			Value: defaultAuditMaxSize,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "audit-max-files",
+			Usage: "Keep `NUM` rotated audit log files, or more while they are within audit-retention",
+			Value: defaultAuditMaxFiles,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "audit-retention",
+			Usage: "Keep rotated audit log files until they are older than `DURATION`, then remove them (0 to keep them until rotated out)",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "payload-dump-length",
+			Usage: "Log and report at most `NUM` bytes from the start of a payload that cannot be decoded",
+			Value: 64,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "payload-transform",
+			Usage: "Apply the payload transform `TOPIC=NAME` to payloads received on a topic matching the MQTT topic filter TOPIC before they are decoded ('gunzip', 'base64' or 'strip-bom'; TOPIC may be '*' for topics no other filter matches; may be repeated and is applied in order)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "inbound-transform",
+			Usage: "Apply the transform `NAME` to received data messages before dispatch ('validate' or 'client-id'; may be repeated and is applied in order)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "outbound-transform",
+			Usage: "Apply the transform `NAME` to worker data messages before publishing ('client-id' or 'gzip'; may be repeated and is applied in order)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "result-metadata",
+			Usage: "Add the metadata `KEY=TEMPLATE` to every published worker data message, where TEMPLATE may reference canonical facts as {facts.NAME} (may be repeated)",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "publish-workers",
+			Usage: "Publish up to `NUM` worker data messages concurrently",
+			Value: 1,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "publish-ordering",
+			Usage: "Preserve the order worker data messages are published in by `ORDERING` ('none' or 'directive') when publishing concurrently",
+			Value: publishOrderingNone,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "outbound-transform-failure",
+			Usage: "Handle worker data messages rejected by an outbound transform with `ACTION` ('drop' or 'dead-letter')",
+			Value: "drop",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "max-message-hops",
+			Usage: "Drop received data messages that have been relayed more than `NUM` times (0 for no limit)",
+			Value: 8,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "require-workers",
+			Usage: "Exit with an error if no workers are installed at startup",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "worker-bootstrap-policy",
+			Usage: "Handle workers failing to start at startup with `POLICY` ('strict' exits, 'best-effort' continues with the workers that started)",
+			Value: bootstrapPolicyBestEffort,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "bootstrap-shutdown",
+			Usage: "Handle a TERM or INT signal received during startup with `POLICY` ('abort' abandons the startup step in progress, 'wait' lets it complete), shutting down before the next step",
+			Value: bootstrapShutdownAbort,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "liveness-file",
+			Usage:     "Touch `FILE` every liveness-interval while connected and responsive, for external watchdogs (disabled if empty)",
+			TakesFile: true,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "liveness-interval",
+			Usage: "Touch the liveness file every `DURATION`",
+			Value: defaultLivenessInterval,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "required-worker",
+			Usage: "Exit if the worker executable `NAME` is not found or fails to start, regardless of the bootstrap policy (may be repeated)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "worker-verify-key",
+			Usage:     "Start only workers whose executable has a detached signature by the public key in `FILE`",
+			TakesFile: true,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "worker-require-checksum",
+			Usage: "Start only workers whose config lists the SHA-256 checksum of their executable",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "worker-handover-timeout",
+			Usage: "When an upgraded worker registers while the old instance is running, stop the old instance once its work is done or after `DURATION` (0 to reject the upgraded worker)",
+			Value: 5 * time.Minute,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "duplicate-registration-policy",
+			Usage: "Handle a worker registering for a handler that is already registered, other than an upgraded worker or one joining a pool, with `POLICY` ('reject' keeps the registered worker, 'displace' stops it and dispatches its outstanding messages to the new worker)",
+			Value: duplicateRegistrationReject,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "assignment-history-size",
+			Usage: "Keep the records of the most recent `NUM` assignments in memory (0 to disable)",
+			Value: defaultHistorySize,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "assignment-timeout",
+			Usage: "Publish a timed-out result for a data message the worker does not respond to within `DURATION` (0 to wait indefinitely)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "late-results",
+			Usage: "Handle a result that arrives after its assignment timed out with `ACTION` ('discard' drops it, 'publish' publishes it to late-results-topic, 'flag' publishes it as a response marked late)",
+			Value: lateResultDiscard,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "late-results-topic",
+			Usage: "Publish late results to the destination `DEST`, with late-results 'publish'",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "paused-queue-size",
+			Usage: "Hold at most `N` messages for a paused worker",
+			Value: defaultPausedQueueSize,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "paused-queue-overflow",
+			Usage: "Give up a message when a paused worker's queue is full with `POLICY` ('drop-oldest' or 'drop-newest'), handling it like a stale message",
+			Value: pausedOverflowDropOldest,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "worker-heartbeat-timeout",
+			Usage: "Consider a worker that sends heartbeats hung, and restart it, if it sends none for `DURATION` (0 to disable)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "worker-usage-interval",
+			Usage: "Sample the CPU and memory usage of worker processes every `DURATION` (0 to disable)",
+			Value: 30 * time.Second,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "worker-max-send-message-size",
+			Usage: "Send messages of up to `BYTES` to workers, failing larger assignments",
+			Value: defaultWorkerMessageSize,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "worker-max-receive-message-size",
+			Usage: "Receive messages of up to `BYTES` from workers",
+			Value: defaultWorkerMessageSize,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "malformed-response-limit",
+			Usage: "Consider a worker unhealthy, and restart it, after it sends `NUM` malformed responses in a row (0 to disable)",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "self-test",
+			Usage: "At startup, send each worker a self-test message and exclude workers that do not respond",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "self-test-timeout",
+			Usage: "Fail the self-test of a worker that does not respond within `DURATION`",
+			Value: 10 * time.Second,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "worker-selection",
+			Usage: "Let several workers register for a handler, selecting one for each message, as `HANDLER=STRATEGY` (STRATEGY is 'round-robin', 'least-busy', 'random' or 'sticky'; may be repeated)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "ordered-directive",
+			Usage: "Dispatch the data messages of `DIRECTIVE` one at a time, in the order they were received (may be repeated)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "ordered-by",
+			Usage: "Order the data messages of each ordered directive as one sequence per `SCOPE` ('directive' or 'ordering-key')",
+			Value: orderedByDirective,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "worker-bootstrap-parallelism",
+			Usage: "Start at most `NUM` workers concurrently at startup (0 for no limit)",
+			Value: 4,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "worker-startup-timeout",
+			Usage: "Stop a worker and treat it as failing to start if it does not register within `DURATION` of being launched at startup (0 for no limit)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "worker-stop-sequence",
+			Usage: "Stop workers by sending each signal `STEP` in turn, as \"SIGNAL:WAIT\", waiting for them to exit, and finally \"KILL\" (may be repeated)",
+			Value: cli.NewStringSlice("KILL"),
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "shadow-worker",
+			Usage: "Send a copy of messages for a directive to a shadow worker, discarding its responses, as `DIRECTIVE=HANDLER[:RATE]` (RATE is the sampled fraction, default 1; may be repeated)",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "receipt-topic",
+			Usage: "Publish receipts when messages for a directive are received and dispatched, as `DIRECTIVE=DEST` (DIRECTIVE may be '*'; may be repeated)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "handshake-encoding",
+			Usage: "Encode connection-status messages as `ENCODING` ('json' or 'cbor')",
+			Value: "json",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "handshake-topic",
+			Usage: "Publish connection-status messages to the `DEST` topic",
+			Value: "control",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "capabilities-topic",
+			Usage: "Publish the supported directives and commands to the destination `DEST` (disabled if empty)",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "capabilities-retain",
+			Usage: "Publish capabilities messages as retained messages",
+			Value: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "startup-topic",
+			Usage: "Publish a message to the destination `DEST` once started, connected and with the workers started (disabled if empty)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "worker-exit-topic",
+			Usage: "Publish a message to the destination `DEST` when a worker process exits unexpectedly (disabled if empty)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "worker-exit-notification-interval",
+			Usage: "Coalesce the exits of a worker into one message at most every `DURATION`",
+			Value: time.Minute,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "worker-restart-policy",
+			Usage: "Restart workers after they exit according to `POLICY` ('always', 'on-failure' or 'never')",
+			Value: restartAlways,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "worker-restart-jitter",
+			Usage: "Delay the restart of a worker that exited by a random duration of up to `DURATION`",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "worker-restart-limit",
+			Usage: "Give up restarting a worker after it exits more than `NUM` times within worker-restart-window (0 to disable)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "worker-restart-window",
+			Usage: "Count the exits of a worker against worker-restart-limit over `DURATION`",
+			Value: 10 * time.Minute,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "worker-restart-escalation",
+			Usage: "Take `ACTION` (alert, degraded or restart-daemon) when giving up on a worker for exceeding worker-restart-limit",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "worker-failed-topic",
+			Usage: "Publish the message of the alert escalation action to the destination `DEST`",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "presence-topic",
+			Usage: "Publish presence messages on connect and clean shutdown to the destination `DEST` (disabled if empty)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "presence-online-payload",
+			Usage: "Publish `PAYLOAD` as the presence message after connecting",
+			Value: `{"state":"online"}`,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "presence-offline-payload",
+			Usage: "Publish `PAYLOAD` as the presence message before a clean shutdown",
+			Value: `{"state":"offline"}`,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "presence-retain",
+			Usage: "Publish presence messages as retained messages",
+			Value: true,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "heartbeat-interval",
+			Usage: "Re-publish the connection status every `DURATION` (0 to disable)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "heartbeat-jitter",
+			Usage: "Delay each heartbeat by a random duration of up to `DURATION`",
+			Value: time.Minute,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "facts-cache-ttl",
+			Usage: "Reuse collected canonical facts for up to `DURATION`",
+			Value: 15 * time.Minute,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "facts-watch-interval",
+			Usage: "Collect the canonical facts every `DURATION` and re-publish the connection status when they change (0 to disable)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "facts-collector-timeout",
+			Usage: "Abandon collecting a canonical fact, omitting it, after `DURATION` (0 to wait indefinitely)",
+			Value: yggdrasil.FactCollectorTimeout,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "facts-collector-retries",
+			Usage: "Retry collecting a canonical fact that fails or times out up to `N` times",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "facts-collector-parallelism",
+			Usage: "Collect up to `N` canonical facts at once",
+			Value: yggdrasil.FactCollectorParallelism,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "facts-dir",
+			Usage:     "Publish the JSON objects written by the executables in `DIR` as custom facts, named after each executable",
+			TakesFile: true,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "disable-fact",
+			Usage: "Neither collect nor publish the canonical fact, or group of facts ('identifiers', 'network'), `NAME` (may be repeated)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "machine-id-provider",
+			Usage: "Resolve the machine ID with the registered provider `NAME` ('bios-uuid'), falling back to machine-id-command and /etc/machine-id",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "machine-id-command",
+			Usage: "Resolve the machine ID from the output of `COMMAND` (split on whitespace), falling back to /etc/machine-id",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "machine-id-required",
+			Usage: "Fail to start if no source yields a valid machine ID",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "facts-refresh-interval",
+			Usage: "Refresh the canonical facts at the request of workers at most once every `DURATION`",
+			Value: 30 * time.Second,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "connection-status-min-interval",
+			Usage: "Publish connection-status messages at most once every `DURATION`, coalescing the requests in between (0 for no limit)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "connection-status-forced-min-interval",
+			Usage: "Publish connection-status messages for facts refreshes and reconnects at most once every `DURATION`",
+			Value: 5 * time.Second,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "shutdown-message-action",
+			Usage: "Handle data messages received during shutdown with `ACTION` ('reject' or 'process')",
+			Value: "reject",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "ack-mode",
+			Usage: "Acknowledge data messages received from the broker in `MODE` ('auto' or 'after-processing')",
+			Value: "auto",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "ack-processing-timeout",
+			Usage: "Stop waiting for a data message to be processed after `DURATION`, acknowledging it in 'after-processing' ack mode (0 to wait indefinitely)",
+			Value: 5 * time.Minute,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "max-in-flight",
+			Usage: "Process at most `N` data messages at once (0 for no limit)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "idle-disconnect-timeout",
+			Usage: "Disconnect from the broker after `DURATION` without messages received or sent (0 to stay connected)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "idle-connect-interval",
+			Usage: "While disconnected for being idle, connect to the broker every `DURATION` to receive queued messages (0 to connect only to send messages)",
+			Value: 15 * time.Minute,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "upload-threshold",
+			Usage: "Upload the content of data messages from workers larger than `BYTES` over HTTP and publish a reference to it (0 to disable)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "upload-url",
+			Usage: "Upload large content to `URL`/<message-id>",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "upload-presign-url",
+			Usage: "Request a presigned upload URL for large content from `URL`",
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "upload-retries",
+			Usage: "Retry a failed upload `N` times",
+			Value: 3,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "upload-failure-action",
+			Usage: "Handle data messages whose content cannot be uploaded with `ACTION` ('inline', 'dead-letter' or 'drop')",
+			Value: uploadFailureDeadLetter,
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "download-references",
+			Usage: "Download the content of data messages received with an upload reference in its place over HTTPS before dispatching them",
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:  "download-host",
+			Usage: "Download referenced content only from `HOST` (may be repeated)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "download-timeout",
+			Usage: "Give up on downloading referenced content after `DURATION`",
+			Value: defaultDownloadTimeout,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "max-download-size",
+			Usage: "Refuse to download referenced content larger than `BYTES`, whatever size the reference declares (0 for no limit)",
+		}),
+		altsrc.NewBoolFlag(&cli.BoolFlag{
+			Name:  "sign-results",
+			Usage: "Sign published results with the device's private key, so that the backend can verify them",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "signing-key-file",
+			Usage:     "Sign results with the private key in `FILE` (defaults to the key file)",
+			TakesFile: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "signing-key-id",
+			Usage: "Identify the signing key as `ID` in signed results (defaults to the SHA-256 fingerprint of its public key)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "payload-verification",
+			Usage: "Verify the signatures of data messages received in `MODE` ('off', 'warn' to dispatch messages that fail verification with a warning, or 'strict' to reject them)",
+			Value: payloadVerificationOff,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:      "payload-verify-key",
+			Usage:     "Verify the signatures of data messages received with the public key in `FILE` (may be repeated)",
+			TakesFile: true,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "payload-verify-max-skew",
+			Usage: "Reject signed data messages sent more than `DURATION` before or after the current time (disabled if 0)",
+			Value: defaultPayloadMaxSkew,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "exit-reason-file",
+			Usage:     "Record why the daemon exited in `FILE`, to be read after a restart (disabled if empty)",
+			TakesFile: true,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "spool-dir",
+			Usage:     "Store data messages that cannot be sent in `DIR` until they can be sent (disabled if empty)",
+			TakesFile: true,
+		}),
+		altsrc.NewStringSliceFlag(&cli.StringSliceFlag{
+			Name:      "spool-key-file",
+			Usage:     "Encrypt spooled messages with a key derived from the contents of `FILE` (may be repeated; the first is used to encrypt, all are used to decrypt)",
+			TakesFile: true,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "spool-flush-interval",
+			Usage: "Attempt to send spooled messages every `DURATION`",
+			Value: 30 * time.Second,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "spool-max-size",
+			Usage: "Remove the oldest spooled messages to keep the spool within `BYTES` (0 for no limit)",
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "spool-max-age",
+			Usage: "Remove spooled messages not sent within `DURATION` (0 to keep them until sent)",
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:  "spool-disk-full-action",
+			Usage: "When the spool's disk is full, drop new messages (\"drop\"), remove the oldest spooled messages (\"evict\") or wait for room (\"block\")",
+			Value: diskFullDrop,
+		}),
+		altsrc.NewStringFlag(&cli.StringFlag{
+			Name:      "control-socket-addr",
+			Usage:     "Listen for control commands on the unix socket `PATH`",
+			Value:     defaultControlSocketAddr,
+			TakesFile: true,
+		}),
+		altsrc.NewIntFlag(&cli.IntFlag{
+			Name:  "control-max-connections",
+			Usage: "Reject connections to the control socket beyond `N` open at once (0 for no limit)",
+			Value: 16,
+		}),
+		altsrc.NewDurationFlag(&cli.DurationFlag{
+			Name:  "control-idle-timeout",
+			Usage: "Close control socket connections idle for `DURATION` (0 to never close them)",
+			Value: 30 * time.Second,
+		}),
+	}
+
+	app.Commands = []*cli.Command{
+		{
+			Name:  "facts",
+			Usage: "Print the canonical facts that would be published and exit",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "pretty",
+					Usage: "Indent the JSON output",
+				},
+				&cli.StringFlag{
+					Name:  "key",
+					Usage: "Print only the value of the fact named `KEY`",
+				},
+			},
+			Action: factsAction,
+		},
+		{
+			Name:  "validate-workers",
+			Usage: "Check the installed workers without starting them and exit",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:      "worker-dir",
+					Usage:     "Validate workers in `DIR` instead of the default worker directory",
+					TakesFile: true,
+				},
+				&cli.StringFlag{
+					Name:      "worker-config-dir",
+					Usage:     "Read the configs of the workers from `DIR` instead of the default worker config directory",
+					TakesFile: true,
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Run each worker with --version to confirm it starts",
+				},
+				&cli.DurationFlag{
+					Name:  "timeout",
+					Usage: "Wait at most `DURATION` for each dry run to exit",
+					Value: 5 * time.Second,
+				},
+			},
+			Action: validateWorkersAction,
+		},
+		{
+			Name:  "events",
+			Usage: "Print the running daemon's pipeline events as they happen",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "type",
+					Usage: "Print only events of type `TYPE` (may be repeated)",
+				},
+				&cli.StringFlag{
+					Name:  "worker",
+					Usage: "Print only events for the worker `NAME`",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print each event as JSON",
+				},
+			},
+			Action: eventsAction,
+		},
+		{
+			Name:  "replay",
+			Usage: "Replay dead-lettered messages through the running daemon as fresh messages",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "directive",
+					Usage: "Replay only messages for `DIRECTIVE`",
+				},
+				&cli.StringFlag{
+					Name:  "reason",
+					Usage: "Replay only messages whose dead-letter reason contains `TEXT`",
+				},
+				&cli.StringFlag{
+					Name:      "input",
+					Usage:     "Replay the messages captured from the dead-letter destination in `FILE`, one per line ('-' for standard input), instead of those in the daemon's dead-letter file",
+					TakesFile: true,
+				},
+				&cli.IntFlag{
+					Name:  "rate",
+					Usage: "Replay at most `NUM` messages per second",
+					Value: defaultReplayRate,
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print each replayed message as JSON",
+				},
+			},
+			Action: replayAction,
+		},
+		{
+			Name:  "worker-groups",
+			Usage: "Print the utilization of the running daemon's worker groups",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the worker groups as JSON",
+				},
+			},
+			Action: workerGroupsAction,
+		},
+		{
+			Name:  "brokers",
+			Usage: "Print the state of the running daemon's connections to MQTT brokers",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the broker state as JSON",
+				},
+			},
+			Action: brokersAction,
+		},
+		{
+			Name:  "subscriptions",
+			Usage: "Print the running daemon's subscriptions, with the QoS the broker granted and the type of message each delivers",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the subscriptions as JSON",
+				},
+			},
+			Action: subscriptionsAction,
+		},
+		{
+			Name:   "control-protocol",
+			Usage:  "Print the control protocol version of the running daemon and the control commands it supports",
+			Action: controlProtocolAction,
+		},
+		{
+			Name:  "desired-state",
+			Usage: "Print the desired state versions applied by the workers of the running daemon",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the desired state versions as JSON",
+				},
+			},
+			Action: desiredStateAction,
+		},
+		{
+			Name:  "routes",
+			Usage: "Print the directives the running daemon routes to workers",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the routing table as JSON",
+				},
+			},
+			Action: routesAction,
+		},
+		{
+			Name:      "cancel",
+			Usage:     "Cancel the running daemon's assignment of a data message",
+			ArgsUsage: "MESSAGE_ID",
+			Action:    cancelAction,
+		},
+		{
+			Name:      "dispatch",
+			Usage:     "Pass the data message in FILE (or standard input) to the running daemon's workers as if it was received from the broker",
+			ArgsUsage: "[FILE]",
+			Action:    dispatchAction,
+		},
+		{
+			Name:  "worker",
+			Usage: "Pause or resume dispatch to a worker of the running daemon",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "pause",
+					Usage:     "Hold the messages for the worker for handler NAME until it is resumed",
+					ArgsUsage: "NAME",
+					Action:    workerPauseAction,
+				},
+				{
+					Name:      "resume",
+					Usage:     "Dispatch the messages held for the worker for handler NAME and resume dispatch to it",
+					ArgsUsage: "NAME",
+					Action:    workerPauseAction,
+				},
+				{
+					Name:   "paused",
+					Usage:  "Print the paused workers and the number of messages held for each",
+					Action: workerPausedAction,
+				},
+			},
+		},
+		{
+			Name:  "history",
+			Usage: "Print the outcomes of the running daemon's most recent assignments",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "limit",
+					Usage: "Print at most `NUM` assignments (0 for all)",
+				},
+				&cli.StringFlag{
+					Name:  "type",
+					Usage: "Print only assignments for `DIRECTIVE`",
+				},
+				&cli.StringFlag{
+					Name:  "outcome",
+					Usage: "Print only assignments with `OUTCOME` ('dispatched', 'completed', 'failed', 'timeout', 'cancelled', 'undeliverable' or 'expired')",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the assignments as JSON",
+				},
+			},
+			Action: historyAction,
+		},
+		{
+			Name:  "audit",
+			Usage: "Print the records of the audit log, oldest first",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "since",
+					Usage: "Print only records from `TIME` (RFC 3339, or a duration ago such as '24h') on",
+				},
+				&cli.StringFlag{
+					Name:  "until",
+					Usage: "Print only records up to `TIME` (RFC 3339, or a duration ago such as '1h')",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print each record as JSON",
+				},
+			},
+			Action: auditAction,
+		},
+		{
+			Name:   "queue",
+			Usage:  "Print the state of the running daemon's queue of data messages waiting to be dispatched",
+			Action: queueAction,
+		},
+		{
+			Name:   "in-flight",
+			Usage:  "Print the number of data messages the running daemon is processing",
+			Action: inFlightAction,
+		},
+		{
+			Name:   "dedup-cache",
+			Usage:  "Print the size of the running daemon's duplicate message cache",
+			Action: dedupCacheAction,
+		},
+		{
+			Name:   "memory",
+			Usage:  "Print the memory held by the running daemon's queued messages and duplicate message cache",
+			Action: memoryAction,
+		},
+		{
+			Name:   "disk",
+			Usage:  "Print the parts of the running daemon that cannot write to a full disk",
+			Action: diskAction,
+		},
+		{
+			Name:   "bootstrap-status",
+			Usage:  "Print the workers the running daemon started and failed to start",
+			Action: bootstrapStatusAction,
+		},
+		{
+			Name:  "config",
+			Usage: "Print the effective configuration",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "dump",
+					Usage: "Print the configuration as resolved from the command line, the config file and the defaults, as TOML with secrets redacted",
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "running",
+							Usage: "Print the configuration of the running daemon",
+						},
+						&cli.BoolFlag{
+							Name:  "sources",
+							Usage: "Print the source (default, file, env or flag) of each value",
+						},
+					},
+					Action: configDumpAction,
+				},
+			},
+		},
+		{
+			Name:  "log-level",
+			Usage: "Query or change the log level of the running daemon",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "get",
+					Usage:  "Print the current log level",
+					Action: logLevelAction,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "worker",
+							Usage: "Print the log level of the worker `NAME`",
+						},
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "Change the log level to LEVEL",
+					ArgsUsage: "LEVEL",
+					Action:    logLevelAction,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "worker",
+							Usage: "Change the log level of the worker `NAME` only",
+						},
+					},
+				},
+				{
+					Name:   "reset",
+					Usage:  "Revert to the configured log level",
+					Action: logLevelAction,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "worker",
+							Usage: "Revert the log level of the worker `NAME` to the one in its config",
+						},
+					},
+				},
+			},
+		},
 	}
 
 	// This BeforeFunc will load flag values from a config file only if the
-	// "config" flag value is non-zero.
+	// "config" flag value is non-zero. The config file may be
+	// gzip-compressed. A config file missing from the default path is
+	// treated as an empty one, but one given with --config must exist.
 	app.Before = func(c *cli.Context) error {
+		configSources = flagSources(c, app.Flags)
 		filePath := c.String("config")
 		if filePath != "" {
-			inputSource, err := altsrc.NewTomlSourceFromFile(filePath)
-			if err != nil {
+			inputSource, err := newConfigInputSource(filePath)
+			switch {
+			case errors.Is(err, os.ErrNotExist) && !c.IsSet("config"):
+				log.Debugf("config file %v does not exist: using defaults", filePath)
+				if err := c.Set("config", ""); err != nil {
+					return err
+				}
+			case errors.Is(err, os.ErrNotExist):
+				return fmt.Errorf("config file %v does not exist", filePath)
+			case err != nil:
 				return err
+			default:
+				if err := altsrc.ApplyInputSourceValues(c, inputSource, app.Flags); err != nil {
+					return err
+				}
+				markFileSources(c, configSources)
+			}
+		}
+
+		// Fact collection settings apply to the "facts" command as well as
+		// to the daemon.
+		yggdrasil.FactCollectorTimeout = c.Duration("facts-collector-timeout")
+		yggdrasil.FactCollectorRetries = c.Int("facts-collector-retries")
+		yggdrasil.FactCollectorParallelism = c.Int("facts-collector-parallelism")
+		yggdrasil.FactsDir = c.String("facts-dir")
+		disabled, err := yggdrasil.ResolveFacts(c.StringSlice("disable-fact"))
+		if err != nil {
+			return fmt.Errorf("invalid disable-fact: %w", err)
+		}
+		for _, key := range yggdrasil.MinimalFacts {
+			if containsString(disabled, key) {
+				log.Warnf("disabling canonical fact %v: the platform may not be able to identify this host", key)
 			}
-			return altsrc.ApplyInputSourceValues(c, inputSource, app.Flags)
 		}
+		yggdrasil.DisabledFacts = disabled
+		if name := c.String("machine-id-provider"); name != "" {
+			if !containsString(yggdrasil.MachineIDProviders(), name) {
+				return fmt.Errorf("unknown machine-id-provider: %v (registered: %v)", name, strings.Join(yggdrasil.MachineIDProviders(), ", "))
+			}
+			yggdrasil.MachineIDProviderName = name
+		}
+		yggdrasil.MachineIDCommand = strings.Fields(c.String("machine-id-command"))
 		return nil
 	}
 
-	app.Action = func(c *cli.Context) error {
+	app.Action = func(c *cli.Context) (err error) {
 		if c.Bool("generate-man-page") || c.Bool("generate-markdown") {
 			type GenerationFunc func() (string, error)
 			var generationFunc GenerationFunc
@@ -127,149 +1325,1089 @@ func main() {
 			}
 			data, err := generationFunc()
 			if err != nil {
-				return err
+				return err
+			}
+			fmt.Println(data)
+			return nil
+		}
+
+		// Record why the daemon exits, so that the reason can be found after
+		// it is restarted.
+		defer func() {
+			if r := recover(); r != nil {
+				reportExit(newExitRecord(exitError("panic", fmt.Errorf("%v", r))), c.String("exit-reason-file"))
+				panic(r)
+			}
+			reportExit(newExitRecord(err), c.String("exit-reason-file"))
+		}()
+
+		// Set TopicPrefix globally. An empty value is permitted and results in
+		// topics that are not namespaced.
+		yggdrasil.TopicPrefix = c.String("topic-prefix")
+		topicPrefix.set(yggdrasil.TopicPrefix)
+
+		// Set DataHost globally if the config option is non-zero
+		if c.String("data-host") != "" {
+			yggdrasil.DataHost = c.String("data-host")
+		}
+		dataHost.set(yggdrasil.DataHost)
+
+		// Set up a channel to receive the TERM or INT signal over and clean up
+		// before quitting.
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+
+		// Set up logging
+		level, err := log.ParseLevel(c.String("log-level"))
+		if err != nil {
+			return exitError("config", err)
+		}
+		setConfiguredLevel(level)
+		setLogLevel(level)
+		log.SetPrefix(fmt.Sprintf("[%v] ", app.Name))
+
+		log.Infof("starting %v version %v", app.Name, app.Version)
+		if c.Bool("log-config-sources") {
+			logConfigSources(c, app.Flags, configSources)
+		}
+		if c.String("exit-reason-file") != "" {
+			prev, err := readExitRecord(c.String("exit-reason-file"))
+			if err != nil {
+				log.Errorf("cannot read previous exit reason: %v", err)
+			} else if prev != nil {
+				log.Infof("previous instance %v", prev)
+			}
+		}
+		log.Infof("using topic prefix: %q", topicPrefix.get())
+
+		checkPrivilegedOperations(privilegedOperations, c.Bool("skip-privileged"))
+
+		if file := c.String("audit-file"); file != "" {
+			if c.Int("audit-max-size") < 0 {
+				return exitError("config", fmt.Errorf("invalid audit-max-size: %v", c.Int("audit-max-size")))
+			}
+			if c.Int("audit-max-files") < 0 {
+				return exitError("config", fmt.Errorf("invalid audit-max-files: %v", c.Int("audit-max-files")))
+			}
+			audit, err := openAuditLog(file, int64(c.Int("audit-max-size")), c.Int("audit-max-files"), c.Duration("audit-retention"))
+			if err != nil {
+				return exitError("config", err)
+			}
+			events.audit = audit
+			go audit.runRetention()
+		}
+
+		workerStopSequence, err = parseStopSequence(c.StringSlice("worker-stop-sequence"))
+		if err != nil {
+			return exitError("config", fmt.Errorf("invalid worker-stop-sequence: %w", err))
+		}
+		if err := checkRestartPolicy(c.String("worker-restart-policy")); err != nil {
+			return exitError("config", fmt.Errorf("invalid worker-restart-policy: %w", err))
+		}
+		if c.String("protocol") == "mqtt" {
+			if err := checkBrokerURLs(c.String("config"), c.String("server"), c.String("publish-server")); err != nil {
+				return exitError("config", fmt.Errorf("cannot configure MQTT brokers: %w", err))
+			}
+		}
+		workerRestartPolicy = c.String("worker-restart-policy")
+		if c.Duration("worker-restart-jitter") < 0 {
+			return exitError("config", fmt.Errorf("invalid worker-restart-jitter: must be 0 or greater"))
+		}
+		workerRestartJitter = c.Duration("worker-restart-jitter")
+
+		log.Trace("attempting to kill any orphaned workers")
+		if err := killWorkers(); err != nil {
+			return exitError("workers", fmt.Errorf("cannot kill workers: %w", err))
+		}
+
+		// Start the control socket server.
+		controlServer := newControlServer()
+		if c.Int("control-max-connections") < 0 {
+			return exitError("config", fmt.Errorf("invalid control-max-connections: %v", c.Int("control-max-connections")))
+		}
+		controlServer.maxConns = c.Int("control-max-connections")
+		controlServer.idleTimeout = c.Duration("control-idle-timeout")
+		metrics.setGaugeFunc("control_connections", func() float64 { return float64(controlServer.connections()) })
+		controlServer.handle("log-level", handleLogLevel)
+		controlServer.handle("config", handleConfig(c, app.Flags))
+		controlServer.handleStream("events", events.streamEvents)
+		go func() {
+			if err := controlServer.listenAndServe(c.String("control-socket-addr")); err != nil {
+				log.Errorf("cannot start control server: %v", err)
+			}
+		}()
+		defer controlServer.close()
+
+		var machineID string
+		if c.Bool("machine-id-required") || c.String("machine-id-provider") != "" || c.String("machine-id-command") != "" {
+			machineID, err = yggdrasil.MachineID()
+			if err != nil {
+				if c.Bool("machine-id-required") {
+					return exitError("machine-id", fmt.Errorf("cannot resolve machine ID: %w", err))
+				}
+				log.Warnf("cannot resolve machine ID: %v", err)
+			}
+		}
+
+		clientIDFile := filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "client-id")
+		switch {
+		case c.String("cert-file") != "":
+			CN, err := parseCertCN(c.String("cert-file"))
+			if err != nil {
+				return exitError("client-id", fmt.Errorf("cannot parse certificate: %w", err))
+			}
+			if err := setClientID([]byte(CN), clientIDFile); err != nil {
+				return exitError("client-id", fmt.Errorf("cannot set client-id to CN: %w", err))
+			}
+		case machineID != "" && yggdrasil.MachineIDFromCustomSource():
+			// An identity from a custom source replaces the generated one;
+			// one read from /etc/machine-id after those failed does not.
+			if err := setClientID([]byte(machineID), clientIDFile); err != nil {
+				return exitError("client-id", fmt.Errorf("cannot set client-id to machine ID: %w", err))
+			}
+		}
+
+		clientID, err := getClientID(clientIDFile)
+		if err != nil {
+			return exitError("client-id", fmt.Errorf("cannot get client-id: %w", err))
+		}
+		if len(clientID) == 0 {
+			data, err := createClientID(clientIDFile)
+			if err != nil {
+				return exitError("client-id", fmt.Errorf("cannot create client-id: %w", err))
+			}
+			clientID = data
+		}
+
+		ClientID = string(clientID)
+
+		// Read certificates, create a TLS config, and initialize HTTP client
+		tlsLoader := newTLSLoader(c.String("cert-file"), c.String("key-file"), c.StringSlice("ca-root"), c.Duration("cert-expiry-warning"))
+		tlsConfig, err := tlsLoader.load()
+		if err != nil {
+			return exitError("tls", fmt.Errorf("cannot create TLS config: %w", err))
+		}
+		metrics.setGaugeFunc("client_certificate_expiry_timestamp_seconds", tlsLoader.certExpiryTimestamp)
+		metrics.setGaugeFunc("ca_certificate_expiry_timestamp_seconds", tlsLoader.caExpiryTimestamp)
+		httpClient := http.NewHTTPClient(tlsConfig, UserAgent)
+
+		// Create gRPC dispatcher service
+		d := newDispatcher(httpClient)
+		d.shadows, err = parseShadowRoutes(c.StringSlice("shadow-worker"))
+		if err != nil {
+			return exitError("config", fmt.Errorf("cannot configure shadow workers: %w", err))
+		}
+		d.strategies, err = parseSelectionStrategies(c.StringSlice("worker-selection"))
+		if err != nil {
+			return exitError("config", fmt.Errorf("cannot configure worker selection: %w", err))
+		}
+		if directives := c.StringSlice("ordered-directive"); len(directives) > 0 {
+			d.ordering, err = newOrderedSequences(directives, c.String("ordered-by"))
+			if err != nil {
+				return exitError("config", fmt.Errorf("cannot configure ordered directives: %w", err))
+			}
+			metrics.setGaugeFunc("ordered_queue_depth", func() float64 { return float64(d.ordering.queued()) })
+		}
+		groups, err := loadWorkerGroupConfigs(c.String("config"))
+		if err != nil {
+			return exitError("config", fmt.Errorf("cannot configure worker groups: %w", err))
+		}
+		if len(groups) > 0 {
+			d.groups = newWorkerGroups(groups)
+		}
+		labels, err := loadMetricsLabelConfigs(c.String("config"))
+		if err != nil {
+			return exitError("config", fmt.Errorf("cannot configure metrics labels: %w", err))
+		}
+		if len(labels) > 0 {
+			payloadLabels = newPayloadLabeler(labels)
+		}
+		if c.Int("log-payload-max-size") < 0 {
+			return exitError("config", fmt.Errorf("invalid log-payload-max-size: %v", c.Int("log-payload-max-size")))
+		}
+		payloadLog = nil
+		if c.Bool("log-payloads") {
+			payloadLog = newPayloadLogger(c.Int("log-payload-max-size"), c.StringSlice("log-payload-redact"))
+		}
+		rateLimits, err := loadPublishRateLimitConfigs(c.String("config"))
+		if err != nil {
+			return exitError("config", fmt.Errorf("cannot configure publish rate limits: %w", err))
+		}
+		d.handoverTimeout = c.Duration("worker-handover-timeout")
+		if err := checkDuplicateRegistrationPolicy(c.String("duplicate-registration-policy")); err != nil {
+			return exitError("config", err)
+		}
+		d.duplicatePolicy = c.String("duplicate-registration-policy")
+		d.paused, err = newPausedWorkers(c.Int("paused-queue-size"), c.String("paused-queue-overflow"))
+		if err != nil {
+			return exitError("config", err)
+		}
+		if c.Int("assignment-history-size") > 0 {
+			d.history, err = newAssignmentHistory(c.Int("assignment-history-size"))
+			if err != nil {
+				return exitError("config", err)
+			}
+		}
+		d.assignmentTimeout = c.Duration("assignment-timeout")
+		switch c.String("late-results") {
+		case lateResultDiscard, lateResultFlag:
+		case lateResultPublish:
+			if c.String("late-results-topic") == "" {
+				return exitError("config", fmt.Errorf("cannot publish late results: late-results-topic is not set"))
+			}
+		default:
+			return exitError("config", fmt.Errorf("invalid late-results: %v", c.String("late-results")))
+		}
+		d.lateResults = c.String("late-results")
+		d.heartbeatTimeout = c.Duration("worker-heartbeat-timeout")
+		d.malformedLimit = c.Int("malformed-response-limit")
+		idleWorker = d.retireIdle
+		keepWorker = d.keepRetiring
+		lostAssignments = d.lostAssignments
+		d.maxQueueAge = c.Duration("max-queue-age")
+		var resultQueue messageQueue
+		switch c.String("queue-backend") {
+		case queueBackendMemory:
+		case queueBackendDisk:
+			d.queue, err = newDiskQueue(filepath.Join(c.String("queue-dir"), "assignments"))
+			if err != nil {
+				return exitError("queue", fmt.Errorf("cannot open assignment queue: %w", err))
+			}
+			resultQueue, err = newDiskQueue(filepath.Join(c.String("queue-dir"), "results"))
+			if err != nil {
+				return exitError("queue", fmt.Errorf("cannot open result queue: %w", err))
+			}
+		default:
+			return exitError("config", fmt.Errorf("invalid queue-backend: %v", c.String("queue-backend")))
+		}
+		d.queueBackend = c.String("queue-backend")
+		metrics.setGaugeFunc("assignment_queue_depth", func() float64 { return float64(d.queue.Len()) })
+		if resultQueue != nil {
+			metrics.setGaugeFunc("result_queue_depth", func() float64 { return float64(resultQueue.Len()) })
+		}
+		metrics.setGaugeFunc("workers", func() float64 { return float64(len(d.Dispatchers())) })
+		if c.Duration("worker-usage-interval") > 0 {
+			d.usage = newUsageSampler(c.Duration("worker-usage-interval"))
+			go d.usage.run(d.workerPIDs)
+		}
+		metrics.setGaugeFunc("worker_cpu_percent", func() float64 { return d.usage.total().CPUPercent })
+		metrics.setGaugeFunc("worker_rss_bytes", func() float64 { return float64(d.usage.total().RSSBytes) })
+		if c.String("tracing-endpoint") != "" {
+			tracing, err = newTracer(c.String("tracing-endpoint"), c.Float64("tracing-sample-rate"))
+			if err != nil {
+				return exitError("config", fmt.Errorf("cannot configure tracing: %w", err))
+			}
+			go tracing.run()
+		}
+		// stopMetrics stops exporting metrics, pushing them one last time.
+		stopMetrics := func() {}
+		exporterName := c.String("metrics-exporter")
+		if exporterName == "" && c.String("metrics-address") != "" {
+			exporterName = "prometheus"
+		}
+		if exporterName != "" {
+			exporter, err := newMetricsExporter(exporterName, c.String("metrics-address"), c.Duration("metrics-interval"))
+			if err != nil {
+				return exitError("config", fmt.Errorf("cannot configure metrics: %w", err))
+			}
+			done := make(chan struct{})
+			stopped := make(chan struct{})
+			go observeEvents(metrics, events, done)
+			go func() {
+				defer close(stopped)
+				if err := exporter.run(metrics, done); err != nil {
+					log.Errorf("cannot export metrics: %v", err)
+				}
+			}()
+			stopMetrics = func() {
+				close(done)
+				<-stopped
+			}
+		}
+		controlServer.handle("queue", d.handleQueue)
+		controlServer.handle("routes", d.handleRoutes)
+		controlServer.handle("cancel", d.handleCancel)
+		controlServer.handle("worker-groups", d.groups.handle)
+		controlServer.handle("worker-pause", d.handlePause)
+		controlServer.handle("worker-resume", d.handleResume)
+		controlServer.handle("worker-paused", d.handlePaused)
+		controlServer.handle("history", d.handleHistory)
+		for _, name := range []string{"worker-max-send-message-size", "worker-max-receive-message-size"} {
+			if c.Int(name) <= 0 {
+				return exitError("config", fmt.Errorf("invalid %v: %v", name, c.Int(name)))
+			}
+		}
+		d.maxSendSize = c.Int("worker-max-send-message-size")
+		d.maxRecvSize = c.Int("worker-max-receive-message-size")
+		s := grpc.NewServer(d.serverOptions()...)
+		pb.RegisterDispatcherServer(s, d)
+
+		switch c.String("socket-addr-in-use") {
+		case addrInUseFail, addrInUseRemoveStale, addrInUseWait:
+		default:
+			return exitError("config", fmt.Errorf("invalid socket-addr-in-use: %v", c.String("socket-addr-in-use")))
+		}
+		if path := c.String("worker-registration-socket"); path != "" {
+			d.external = newExternalRegistry(path, d.deadWorkers)
+			el, err := d.external.listen(path, c.String("socket-addr-in-use"), c.Duration("socket-addr-in-use-timeout"))
+			if err != nil {
+				return exitError("dispatcher", fmt.Errorf("cannot listen to worker registration socket: %w", err))
 			}
-			fmt.Println(data)
-			return nil
+			es := grpc.NewServer(append(d.serverOptions(), grpc.StatsHandler(d.external))...)
+			pb.RegisterDispatcherServer(es, d)
+			go func() {
+				log.Infof("listening for worker registrations on socket: %v", path)
+				if err := es.Serve(el); err != nil {
+					log.Errorf("cannot start worker registration server: %v", err)
+				}
+			}()
 		}
 
-		// Set TopicPrefix globally if the config option is non-zero
-		if c.String("topic-prefix") != "" {
-			yggdrasil.TopicPrefix = c.String("topic-prefix")
+		l, err := listenDispatcher(c.String("socket-addr"), c.String("socket-addr-in-use"), c.Duration("socket-addr-in-use-timeout"))
+		if err != nil {
+			return exitError("dispatcher", fmt.Errorf("cannot listen to socket: %w", err))
 		}
+		go func() {
+			log.Infof("listening on socket: %v", c.String("socket-addr"))
+			if err := s.Serve(l); err != nil {
+				log.Errorf("cannot start server: %v", err)
+			}
+		}()
 
-		// Set DataHost globally if the config option is non-zero
-		if c.String("data-host") != "" {
-			yggdrasil.DataHost = c.String("data-host")
+		inbound, err := newTransformChain(c.StringSlice("inbound-transform"), inboundTransforms)
+		if err != nil {
+			return exitError("config", fmt.Errorf("cannot create inbound transform chain: %w", err))
 		}
 
-		// Set up a channel to receive the TERM or INT signal over and clean up
-		// before quitting.
-		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
-
-		// Set up logging
-		level, err := log.ParseLevel(c.String("log-level"))
+		outbound, err := newTransformChain(c.StringSlice("outbound-transform"), outboundTransforms)
 		if err != nil {
-			return cli.Exit(err, 1)
+			return exitError("config", fmt.Errorf("cannot create outbound transform chain: %w", err))
 		}
-		log.SetLevel(level)
-		log.SetPrefix(fmt.Sprintf("[%v] ", app.Name))
-		if log.CurrentLevel() >= log.LevelDebug {
-			log.SetFlags(log.LstdFlags | log.Llongfile)
+
+		var deadLetterRejected bool
+		switch c.String("outbound-transform-failure") {
+		case "drop":
+		case "dead-letter":
+			deadLetterRejected = true
+		default:
+			return exitError("config", fmt.Errorf("unsupported outbound transform failure mode: %v", c.String("outbound-transform-failure")))
 		}
 
-		log.Infof("starting %v version %v", app.Name, app.Version)
+		if err := checkBootstrapShutdown(c.String("bootstrap-shutdown")); err != nil {
+			return exitError("config", err)
+		}
+		if err := checkAuthFailureAction(c.String("mqtt-auth-failure-action")); err != nil {
+			return exitError("config", err)
+		}
+		if qos := c.Int("mqtt-publish-qos"); qos < 0 || qos > 2 {
+			return exitError("config", fmt.Errorf("invalid mqtt-publish-qos: %v", qos))
+		}
+		if c.Duration("mqtt-initial-reconnect-interval") <= 0 {
+			return exitError("config", fmt.Errorf("invalid mqtt-initial-reconnect-interval: %v", c.Duration("mqtt-initial-reconnect-interval")))
+		}
+		if c.Duration("mqtt-srv-refresh-interval") <= 0 {
+			return exitError("config", fmt.Errorf("invalid mqtt-srv-refresh-interval: %v", c.Duration("mqtt-srv-refresh-interval")))
+		}
+		if c.String("liveness-file") != "" && c.Duration("liveness-interval") <= 0 {
+			return exitError("config", fmt.Errorf("invalid liveness-interval: %v", c.Duration("liveness-interval")))
+		}
+		stopOnAuthFailure := c.String("mqtt-auth-failure-action") == authFailureStop
 
-		log.Trace("attempting to kill any orphaned workers")
-		if err := killWorkers(); err != nil {
-			return cli.Exit(fmt.Errorf("cannot kill workers: %w", err), 1)
+		var processWhileDraining bool
+		switch c.String("shutdown-message-action") {
+		case "reject":
+		case "process":
+			processWhileDraining = true
+		default:
+			return exitError("config", fmt.Errorf("unsupported shutdown message action: %v", c.String("shutdown-message-action")))
 		}
 
-		clientIDFile := filepath.Join(yggdrasil.LocalstateDir, yggdrasil.LongName, "client-id")
-		if c.String("cert-file") != "" {
-			CN, err := parseCertCN(c.String("cert-file"))
-			if err != nil {
-				return cli.Exit(fmt.Errorf("cannot parse certificate: %w", err), 1)
-			}
-			if err := setClientID([]byte(CN), clientIDFile); err != nil {
-				return cli.Exit(fmt.Errorf("cannot set client-id to CN: %w", err), 1)
+		var ackAfterProcessing bool
+		switch c.String("ack-mode") {
+		case "auto":
+		case "after-processing":
+			// Messages acknowledged after processing are handled
+			// concurrently as they arrive, losing the order the broker
+			// delivered them in.
+			if len(c.StringSlice("ordered-directive")) > 0 {
+				return exitError("config", fmt.Errorf("ordered-directive requires ack-mode 'auto'"))
 			}
+			ackAfterProcessing = true
+		default:
+			return exitError("config", fmt.Errorf("unsupported ack mode: %v", c.String("ack-mode")))
 		}
 
-		clientID, err := getClientID(clientIDFile)
+		var deadLetterDenied bool
+		switch c.String("denied-directive-action") {
+		case "drop":
+		case "dead-letter":
+			deadLetterDenied = true
+		default:
+			return exitError("config", fmt.Errorf("unsupported denied directive action: %v", c.String("denied-directive-action")))
+		}
+
+		var deadLetterStale bool
+		switch c.String("stale-message-action") {
+		case "drop":
+		case "dead-letter":
+			deadLetterStale = true
+		default:
+			return exitError("config", fmt.Errorf("unsupported stale message action: %v", c.String("stale-message-action")))
+		}
+
+		client := Client{
+			d:                    d,
+			directives:           newDirectiveFilter(c.StringSlice("allow-directive"), c.StringSlice("deny-directive")),
+			deadLetterDenied:     deadLetterDenied,
+			deadLetterStale:      deadLetterStale,
+			inbound:              inbound,
+			outbound:             outbound,
+			resultQueue:          resultQueue,
+			deadLetterRejected:   deadLetterRejected,
+			loops:                newLoopDetector(ClientID, c.Int("max-message-hops")),
+			ackTimeout:           c.Duration("mqtt-publish-timeout"),
+			publishQoS:           byte(c.Int("mqtt-publish-qos")),
+			warmUp:               c.Duration("connect-warm-up"),
+			handshakeTimeout:     c.Duration("handshake-timeout"),
+			authRetryInterval:    c.Duration("mqtt-auth-failure-retry-interval"),
+			stopOnAuthFailure:    stopOnAuthFailure,
+			processWhileDraining: processWhileDraining,
+			nackWhileDraining:    ackAfterProcessing,
+			facts:                &factsCache{ttl: c.Duration("facts-cache-ttl")},
+		}
+		if len(rateLimits) > 0 {
+			client.rateLimits = newPublishRateLimiter(rateLimits)
+		}
+		client.unparseable, err = newUnparseablePayloads(c.String("unparseable-payload-action"), c.String("parse-error-topic"), c.Int("payload-dump-length"))
 		if err != nil {
-			return cli.Exit(fmt.Errorf("cannot get client-id: %w", err), 1)
+			return exitError("config", fmt.Errorf("cannot configure unparseable payload handling: %w", err))
 		}
-		if len(clientID) == 0 {
-			data, err := createClientID(clientIDFile)
+		if dest := c.String("desired-state-topic"); dest != "" {
+			if dest == "data" || dest == "control" {
+				return exitError("config", fmt.Errorf("invalid desired state topic: %v", dest))
+			}
+			client.desiredState, err = newDesiredStateReconciler(dest, c.String("desired-state-file"))
 			if err != nil {
-				return cli.Exit(fmt.Errorf("cannot create client-id: %w", err), 1)
+				return exitError("config", fmt.Errorf("cannot configure desired state: %w", err))
 			}
-			clientID = data
 		}
-
-		ClientID = string(clientID)
-
-		// Read certificates, create a TLS config, and initialize HTTP client
-		var certData, keyData []byte
-		if c.String("cert-file") != "" && c.String("key-file") != "" {
-			var err error
-			certData, err = ioutil.ReadFile(c.String("cert-file"))
+		controlServer.handle("desired-state", client.desiredState.handle)
+		client.deadLetterDests, err = parseDeadLetterDests(c.StringSlice("dead-letter-topic"))
+		if err != nil {
+			return exitError("config", fmt.Errorf("cannot configure dead-letter topics: %w", err))
+		}
+		if file := c.String("dead-letter-file"); file != "" {
+			client.deadLetters = newDeadLetterStore(file)
+		}
+		controlServer.handleStream("replay", client.handleReplay)
+		if c.Int("upload-threshold") > 0 {
+			client.uploads, err = newPayloadUploader(c.Int("upload-threshold"), c.String("upload-url"), c.String("upload-presign-url"), c.Int("upload-retries"), c.String("upload-failure-action"), httpClient)
 			if err != nil {
-				return cli.Exit(fmt.Errorf("cannot read certificate file: %v", err), 1)
+				return exitError("config", fmt.Errorf("cannot configure uploads: %w", err))
+			}
+		}
+		if c.Bool("download-references") {
+			if len(c.StringSlice("download-host")) == 0 {
+				return exitError("config", fmt.Errorf("cannot configure downloads: no download-host is set"))
 			}
-			keyData, err = ioutil.ReadFile(c.String("key-file"))
+			if c.Duration("download-timeout") <= 0 {
+				return exitError("config", fmt.Errorf("invalid download-timeout: %v", c.Duration("download-timeout")))
+			}
+			if c.Int("max-download-size") < 0 {
+				return exitError("config", fmt.Errorf("invalid max-download-size: %v", c.Int("max-download-size")))
+			}
+			client.downloads = newPayloadDownloader(httpClient, c.StringSlice("download-host"), c.Duration("download-timeout"), int64(c.Int("max-download-size")))
+		}
+		if len(c.StringSlice("result-metadata")) > 0 {
+			client.enricher, err = newMetadataEnricher(c.StringSlice("result-metadata"))
 			if err != nil {
-				return cli.Exit(fmt.Errorf("cannot read key file: %w", err), 1)
+				return exitError("config", fmt.Errorf("cannot configure result metadata: %w", err))
 			}
 		}
-		rootCAs := make([][]byte, 0)
-		for _, file := range c.StringSlice("ca-root") {
-			data, err := ioutil.ReadFile(file)
+		client.handshake, err = newCodec(c.String("handshake-encoding"))
+		if err != nil {
+			return exitError("config", fmt.Errorf("cannot configure handshake: %w", err))
+		}
+		client.handshakeDest = c.String("handshake-topic")
+		if dest := c.String("cert-expiry-topic"); dest != "" {
+			client.certExpiryDest = dest
+			tlsLoader.alert = client.PublishCertExpiry
+		}
+		if c.Bool("sign-results") {
+			keyFile := c.String("signing-key-file")
+			if keyFile == "" {
+				keyFile = c.String("key-file")
+			}
+			if keyFile == "" {
+				return exitError("config", fmt.Errorf("cannot configure result signing: neither signing-key-file nor key-file is set"))
+			}
+			client.signer, err = newResultSigner(keyFile, c.String("signing-key-id"))
 			if err != nil {
-				return cli.Exit(fmt.Errorf("cannot read certificate authority: %v", err), 1)
+				return exitError("config", fmt.Errorf("cannot configure result signing: %w", err))
 			}
-			rootCAs = append(rootCAs, data)
+			log.Infof("signing results with key %v", client.signer.keyID)
 		}
-		tlsConfig, err := newTLSConfig(certData, keyData, rootCAs)
+		client.verifier, err = newPayloadVerifier(c.String("payload-verification"), c.StringSlice("payload-verify-key"), c.Duration("payload-verify-max-skew"))
 		if err != nil {
-			return cli.Exit(fmt.Errorf("cannot create TLS config: %w", err), 1)
+			return exitError("config", fmt.Errorf("cannot configure payload verification: %w", err))
 		}
-		httpClient := http.NewHTTPClient(tlsConfig, UserAgent)
-
-		// Create gRPC dispatcher service
-		d := newDispatcher(httpClient)
-		s := grpc.NewServer()
-		pb.RegisterDispatcherServer(s, d)
+		if c.String("startup-topic") != "" {
+			client.startup = newStartupAnnouncement(c.String("startup-topic"))
+		}
+		if dest := c.String("worker-exit-topic"); dest != "" {
+			notifier := newWorkerExitNotifier(c.Duration("worker-exit-notification-interval"), func(msg *yggdrasil.WorkerExit) {
+				client.PublishWorkerExit(msg, dest)
+			})
+			workerExited = notifier.exited
+		}
+		escalated := make(chan error, 1)
+		if limit := c.Int("worker-restart-limit"); limit > 0 {
+			actions := c.StringSlice("worker-restart-escalation")
+			if err := checkEscalationActions(actions); err != nil {
+				return exitError("config", fmt.Errorf("invalid worker-restart-escalation: %w", err))
+			}
+			dest := c.String("worker-failed-topic")
+			if containsString(actions, escalationAlert) && dest == "" {
+				return exitError("config", fmt.Errorf("worker-failed-topic is required for the alert escalation action"))
+			}
+			workerRestarts = newRestartLimiter(limit, c.Duration("worker-restart-window"), actions)
+			workerRestarts.alert = func(msg *yggdrasil.WorkerFailed) { client.PublishWorkerFailed(msg, dest) }
+			workerRestarts.statusChanged = func() { client.requestConnectionStatus(false) }
+			workerRestarts.restart = func(reason error) {
+				// The service manager restarts the daemon once it exits
+				// with an error; the watchdog trigger records why.
+				if notified, err := notifyWatchdogTrigger(); err != nil {
+					log.Errorf("cannot trigger watchdog: %v", err)
+				} else if notified {
+					log.Info("triggered service manager watchdog")
+				}
+				select {
+				case escalated <- reason:
+				default:
+				}
+			}
+			metrics.setGaugeFunc("workers_degraded", func() float64 { return float64(len(workerRestarts.degraded())) })
+		}
+		if c.String("presence-topic") != "" {
+			client.presence = &presence{
+				dest:    c.String("presence-topic"),
+				online:  []byte(c.String("presence-online-payload")),
+				offline: []byte(c.String("presence-offline-payload")),
+				retain:  c.Bool("presence-retain"),
+			}
+		}
+		if c.String("capabilities-topic") != "" {
+			client.capabilities = &capabilities{
+				dest:   c.String("capabilities-topic"),
+				retain: c.Bool("capabilities-retain"),
+			}
+		}
+		if c.Duration("heartbeat-interval") > 0 {
+			client.heartbeat = newHeartbeat(c.Duration("heartbeat-interval"), c.Duration("heartbeat-jitter"), client.HeartbeatFunc)
+		}
+		if c.Duration("facts-watch-interval") > 0 {
+			client.factsWatch = newFactsWatcher(c.Duration("facts-watch-interval"), client.collectFacts, client.FactsWatchFunc)
+		}
+		if c.Duration("connection-status-min-interval") > 0 {
+			client.statusThrottle = newStatusThrottle(c.Duration("connection-status-min-interval"), c.Duration("connection-status-forced-min-interval"), client.sendConnectionStatus)
+		}
+		// Evaluate worker activation conditions against the cached facts, so
+		// that starting workers does not collect them again.
+		activationFacts = client.facts.get
+		if c.String("worker-verify-key") != "" {
+			workerVerifyKey, err = loadVerifyKey(c.String("worker-verify-key"))
+			if err != nil {
+				return exitError("config", err)
+			}
+		}
+		workerRequireChecksum = c.Bool("worker-require-checksum")
 
-		l, err := net.Listen("unix", c.String("socket-addr"))
+		if c.Int("publish-workers") > 1 {
+			client.publishers, err = newPublishPool(c.Int("publish-workers"), c.String("publish-ordering"), client.handleResult)
+			if err != nil {
+				return exitError("config", fmt.Errorf("cannot configure publishing: %w", err))
+			}
+		}
+		metrics.setGaugeFunc("publish_queue_depth", func() float64 { return float64(client.publishers.depth()) })
+		client.payloadTransforms, err = parsePayloadTransforms(c.StringSlice("payload-transform"), payloadTransforms)
 		if err != nil {
-			return cli.Exit(fmt.Errorf("cannot listen to socket: %w", err), 1)
+			return exitError("config", fmt.Errorf("cannot configure payload transforms: %w", err))
 		}
-		go func() {
-			log.Infof("listening on socket: %v", c.String("socket-addr"))
-			if err := s.Serve(l); err != nil {
-				log.Errorf("cannot start server: %v", err)
+		client.receipts, err = parseReceiptDests(c.StringSlice("receipt-topic"))
+		if err != nil {
+			return exitError("config", fmt.Errorf("cannot configure receipts: %w", err))
+		}
+		if ackAfterProcessing || c.Int("max-in-flight") > 0 {
+			// Messages acknowledged on receipt cannot be held back from
+			// the broker, so those beyond the limit are rejected.
+			client.inFlight = newInFlightTracker(c.Duration("ack-processing-timeout"), c.Int("max-in-flight"), !ackAfterProcessing)
+			metrics.setGaugeFunc("in_flight_messages", func() float64 { return float64(client.inFlight.status().InFlight) })
+			metrics.setGaugeFunc("in_flight_limit", func() float64 { return float64(client.inFlight.limit) })
+		}
+		controlServer.handle("in-flight", client.inFlight.handle)
+		if c.Int("dedup-cache-size") > 0 {
+			client.seen = newSeenCache(c.Int("dedup-cache-size"), c.Duration("dedup-cache-ttl"))
+			switch c.String("dedup-key") {
+			case dedupKeyID:
+			case dedupKeyContent, dedupKeyBoth:
+				if c.Duration("dedup-content-window") <= 0 {
+					return exitError("config", fmt.Errorf("invalid dedup-content-window: %v", c.Duration("dedup-content-window")))
+				}
+				client.seen.contentTTL = c.Duration("dedup-content-window")
+			default:
+				return exitError("config", fmt.Errorf("invalid dedup-key: %v", c.String("dedup-key")))
 			}
-		}()
+			client.seen.key = c.String("dedup-key")
+		}
+		controlServer.handle("dedup-cache", client.seen.handle)
+		if c.Int("memory-budget") > 0 {
+			d.memory, err = newMemoryBudget(c.Int("memory-budget"), client.seen, d.queue, d.paused, d.groups)
+			if err != nil {
+				return exitError("config", err)
+			}
+		}
+		controlServer.handle("memory", d.memory.handle)
+		metrics.setGaugeFunc("memory_dedup_cache_bytes", func() float64 { return float64(client.seen.memoryUsage()) })
+		metrics.setGaugeFunc("memory_dispatch_queue_bytes", func() float64 { return float64(d.queue.memoryUsage()) })
+		metrics.setGaugeFunc("memory_paused_queue_bytes", func() float64 { return float64(d.paused.memoryUsage()) })
+		metrics.setGaugeFunc("memory_group_queue_bytes", func() float64 { return float64(d.groups.memoryUsage()) })
+		d.dispatched = client.DispatchedHandlerFunc
+		d.undeliverable = client.UndeliverableHandlerFunc
+		d.rejected = client.RejectedHandlerFunc
+		d.abandoned = client.AbandonedHandlerFunc
+		if dest := c.String("late-results-topic"); dest != "" {
+			d.lateResult = func(data yggdrasil.Data) { client.PublishLateResult(data, dest) }
+		}
+		d.stale = client.StaleHandlerFunc
+		d.factsChanged = client.FactsChangedHandlerFunc
+		d.factsRefresh = newFactsRefresher(c.Duration("facts-refresh-interval"), client.RefreshFacts)
 
-		client := Client{
-			d: d,
+		controlServer.handle("disk", disk.handle)
+		metrics.setGaugeFunc("disk_degraded", func() float64 { return float64(disk.degraded()) })
+		if c.String("spool-dir") != "" {
+			switch c.String("spool-disk-full-action") {
+			case diskFullDrop, diskFullEvict, diskFullBlock:
+			default:
+				return exitError("config", fmt.Errorf("invalid spool-disk-full-action: %v", c.String("spool-disk-full-action")))
+			}
+			if c.Int("spool-max-size") < 0 {
+				return exitError("config", fmt.Errorf("invalid spool-max-size: must be 0 or greater"))
+			}
+			if c.Duration("spool-max-age") < 0 {
+				return exitError("config", fmt.Errorf("invalid spool-max-age: must be 0 or greater"))
+			}
+			keys, err := loadSpoolKeys(c.StringSlice("spool-key-file"))
+			if err != nil {
+				return exitError("spool", fmt.Errorf("cannot load spool keys: %w", err))
+			}
+			client.spool, err = newSpool(c.String("spool-dir"), keys)
+			if isDiskFull(err) {
+				// Exiting would only restart the daemon onto the same
+				// full disk.
+				disk.full(spoolComponent, err, false)
+				log.Warnf("running without a spool: %v", err)
+			} else if err != nil {
+				return exitError("spool", fmt.Errorf("cannot create spool: %w", err))
+			} else {
+				client.spool.diskFullAction = c.String("spool-disk-full-action")
+				client.spool.maxSize = int64(c.Int("spool-max-size"))
+				client.spool.maxAge = c.Duration("spool-max-age")
+			}
 		}
 
 		var transporter transport.Transporter
+		var brokerSets []brokerSet
 		switch c.String("protocol") {
 		case "mqtt":
-			var err error
-			transporter, err = transport.NewMQTTTransport(ClientID, c.String("server"), tlsConfig, client.DataReceiveHandlerFunc)
+			brokers, err := mqttBrokers(c.String("server"), c.String("config"), "broker", c.Duration("cert-expiry-warning"))
+			if err != nil {
+				return exitError("config", fmt.Errorf("cannot configure MQTT brokers: %w", err))
+			}
+			publishBrokers, err := mqttBrokers(c.String("publish-server"), c.String("config"), "publish-broker", c.Duration("cert-expiry-warning"))
+			if err != nil {
+				return exitError("config", fmt.Errorf("cannot configure MQTT publish brokers: %w", err))
+			}
+			for _, b := range [][]transport.MQTTBroker{brokers, publishBrokers} {
+				if err := checkBrokerCertificates(b, tlsConfig); err != nil {
+					return exitError("tls", fmt.Errorf("cannot configure MQTT brokers: %w", err))
+				}
+			}
+			if len(brokers) == 0 {
+				switch c.String("no-brokers-action") {
+				case "fail":
+					return exitError("config", fmt.Errorf("no brokers configured: set 'server' or add a [[broker]] table, or set 'no-brokers-action' to 'local' to run without a transport"))
+				case "local":
+					log.Warn("no brokers configured; running in local mode: messages are neither received from nor published to a broker")
+					transporter = transport.NewLocalTransport(client.DataReceiveHandlerFunc)
+				default:
+					return exitError("config", fmt.Errorf("unsupported no brokers action: %v", c.String("no-brokers-action")))
+				}
+				break
+			}
+			for _, b := range brokers {
+				log.Infof("using MQTT broker %v", b.URL)
+			}
+			for _, b := range publishBrokers {
+				log.Infof("using MQTT publish broker %v", b.URL)
+			}
+			defaults := transport.MQTTBroker{
+				TLSConfig:            tlsConfig,
+				LoadTLSConfig:        tlsLoader.load,
+				KeepAlive:            c.Duration("mqtt-keepalive"),
+				MaxReconnectInterval: c.Duration("mqtt-max-reconnect-interval"),
+			}
+			publishOptions := transport.PublishOptions{
+				WaitForAck: c.Bool("mqtt-publish-wait-for-ack"),
+				AckTimeout: c.Duration("mqtt-publish-timeout"),
+				QoS:        byte(c.Int("mqtt-publish-qos")),
+			}
+			limiter := transport.NewConnectLimiter(c.Int("mqtt-max-concurrent-connects"), c.Duration("mqtt-connect-interval"))
+			tcpKeepAlive := transport.TCPKeepAlive{
+				Enabled:  c.Bool("mqtt-tcp-keepalive"),
+				Idle:     c.Duration("mqtt-tcp-keepalive-idle"),
+				Interval: c.Duration("mqtt-tcp-keepalive-interval"),
+				Count:    c.Int("mqtt-tcp-keepalive-count"),
+			}
+			proxyURL, err := brokerProxy(c.String("mqtt-proxy"), c.String("mqtt-proxy-credentials-file"))
+			if err != nil {
+				return exitError("config", fmt.Errorf("cannot configure MQTT proxy: %w", err))
+			}
+			if proxyURL != nil {
+				if err := transport.SetProxy(proxyURL); err != nil {
+					return exitError("config", fmt.Errorf("cannot configure MQTT proxy: %w", err))
+				}
+				log.Infof("connecting to MQTT brokers through proxy %v", redactURL(proxyURL.String()))
+			}
+			if err := transport.SetTCPKeepAlive(tcpKeepAlive); err != nil {
+				return exitError("config", fmt.Errorf("cannot configure TCP keepalive: %w", err))
+			}
+
+			if len(publishBrokers) == 0 {
+				t, err := transport.NewMQTTTransport(ClientID, brokers, defaults, c.Bool("mqtt-clean-session"), ackAfterProcessing, true, publishOptions, client.DataReceiveHandlerFunc)
+				if err != nil {
+					return exitError("transport", fmt.Errorf("cannot create MQTT transport: %w", err))
+				}
+				t.SetTopicReceiveHandler(client.TopicReceiveHandlerFunc)
+				if c.Duration("mqtt-dns-cache-ttl") > 0 {
+					t.SetDNSCache(c.Duration("mqtt-dns-cache-ttl"), c.Bool("mqtt-dns-use-stale"))
+				}
+				t.SetSRVRefreshInterval(c.Duration("mqtt-srv-refresh-interval"))
+				t.SetReconnectJitter(c.Duration("mqtt-reconnect-jitter"))
+				t.SetFailbackInterval(c.Duration("mqtt-failback-interval"))
+				t.SetInitialReconnectInterval(c.Duration("mqtt-initial-reconnect-interval"))
+				t.SetSubscribeRetries(c.Int("mqtt-subscribe-retries"))
+				t.SetFreshClientIDFallback(c.Int("mqtt-fresh-client-id-after"), c.Bool("mqtt-revert-client-id"))
+				t.SetAuthFailurePolicy(c.Duration("mqtt-auth-failure-retry-interval"), stopOnAuthFailure)
+				t.SetMaxMessageSize(c.Int("mqtt-max-message-size"))
+				t.SetConnectLimiter(limiter)
+				if client.desiredState != nil {
+					if err := t.AddReceiveDest(client.desiredState.dest); err != nil {
+						return exitError("transport", fmt.Errorf("cannot receive desired state: %w", err))
+					}
+				}
+				t.SetReconnectHandler(client.ReconnectHandlerFunc)
+				t.SetConnectionLostHandler(client.ConnectionLostHandlerFunc)
+				transporter = t
+				brokerSets = []brokerSet{{table: "broker", serverKey: "server", server: c.String("server"), t: t}}
+				break
+			}
+
+			// Control messages (including connection-status and
+			// capabilities) and presence messages are published to the
+			// inbound or outbound broker as configured; everything else is
+			// published to the outbound broker.
+			handshakeInbound, err := parseBrokerRole(c.String("handshake-broker"))
+			if err != nil {
+				return exitError("config", fmt.Errorf("cannot configure handshake broker: %w", err))
+			}
+			presenceInbound, err := parseBrokerRole(c.String("presence-broker"))
+			if err != nil {
+				return exitError("config", fmt.Errorf("cannot configure presence broker: %w", err))
+			}
+			var inDests []string
+			if handshakeInbound {
+				inDests = append(inDests, "control", c.String("handshake-topic"))
+				if c.String("capabilities-topic") != "" {
+					inDests = append(inDests, c.String("capabilities-topic"))
+				}
+			}
+			if presenceInbound && c.String("presence-topic") != "" {
+				inDests = append(inDests, c.String("presence-topic"))
+			}
+
+			in, err := transport.NewMQTTTransport(ClientID, brokers, defaults, c.Bool("mqtt-clean-session"), ackAfterProcessing, handshakeInbound, publishOptions, client.DataReceiveHandlerFunc)
+			if err != nil {
+				return exitError("transport", fmt.Errorf("cannot create inbound MQTT transport: %w", err))
+			}
+			in.SetTopicReceiveHandler(client.TopicReceiveHandlerFunc)
+			out, err := transport.NewMQTTTransport(ClientID, publishBrokers, defaults, c.Bool("mqtt-clean-session"), false, !handshakeInbound, publishOptions, nil)
 			if err != nil {
-				return cli.Exit(fmt.Errorf("cannot create MQTT transport: %w", err), 1)
+				return exitError("transport", fmt.Errorf("cannot create outbound MQTT transport: %w", err))
+			}
+			if c.Duration("mqtt-dns-cache-ttl") > 0 {
+				in.SetDNSCache(c.Duration("mqtt-dns-cache-ttl"), c.Bool("mqtt-dns-use-stale"))
+				out.SetDNSCache(c.Duration("mqtt-dns-cache-ttl"), c.Bool("mqtt-dns-use-stale"))
+			}
+			in.SetSRVRefreshInterval(c.Duration("mqtt-srv-refresh-interval"))
+			out.SetSRVRefreshInterval(c.Duration("mqtt-srv-refresh-interval"))
+			in.SetReconnectJitter(c.Duration("mqtt-reconnect-jitter"))
+			out.SetReconnectJitter(c.Duration("mqtt-reconnect-jitter"))
+			in.SetFailbackInterval(c.Duration("mqtt-failback-interval"))
+			out.SetFailbackInterval(c.Duration("mqtt-failback-interval"))
+			in.SetInitialReconnectInterval(c.Duration("mqtt-initial-reconnect-interval"))
+			out.SetInitialReconnectInterval(c.Duration("mqtt-initial-reconnect-interval"))
+			in.SetSubscribeRetries(c.Int("mqtt-subscribe-retries"))
+			out.SetSubscribeRetries(c.Int("mqtt-subscribe-retries"))
+			in.SetFreshClientIDFallback(c.Int("mqtt-fresh-client-id-after"), c.Bool("mqtt-revert-client-id"))
+			out.SetFreshClientIDFallback(c.Int("mqtt-fresh-client-id-after"), c.Bool("mqtt-revert-client-id"))
+			in.SetAuthFailurePolicy(c.Duration("mqtt-auth-failure-retry-interval"), stopOnAuthFailure)
+			out.SetAuthFailurePolicy(c.Duration("mqtt-auth-failure-retry-interval"), stopOnAuthFailure)
+			out.SetMaxMessageSize(c.Int("mqtt-max-message-size"))
+			in.SetConnectLimiter(limiter)
+			out.SetConnectLimiter(limiter)
+			if client.desiredState != nil {
+				if err := in.AddReceiveDest(client.desiredState.dest); err != nil {
+					return exitError("transport", fmt.Errorf("cannot receive desired state: %w", err))
+				}
+			}
+			if handshakeInbound || presenceInbound {
+				in.SetReconnectHandler(client.ReconnectHandlerFunc)
+			}
+			in.SetConnectionLostHandler(client.ConnectionLostHandlerFunc)
+			out.SetConnectionLostHandler(client.ConnectionLostHandlerFunc)
+			if !handshakeInbound || !presenceInbound {
+				out.SetReconnectHandler(client.ReconnectHandlerFunc)
+			}
+			transporter = transport.NewSplitTransport(in, out, inDests)
+			brokerSets = []brokerSet{
+				{table: "broker", serverKey: "server", server: c.String("server"), t: in},
+				{table: "publish-broker", serverKey: "publish-server", server: c.String("publish-server"), t: out},
 			}
 		case "http":
+			if client.desiredState != nil {
+				return exitError("config", fmt.Errorf("desired state is not supported by the HTTP transport"))
+			}
+			var err error
+			if c.Duration("http-poll-interval") <= 0 {
+				return exitError("config", fmt.Errorf("invalid http-poll-interval: must be greater than 0"))
+			}
+			transporter, err = transport.NewHTTPTransport(ClientID, c.String("server"), tlsConfig, UserAgent, c.Duration("http-poll-interval"), client.DataReceiveHandlerFunc)
+			if err != nil {
+				return exitError("transport", fmt.Errorf("cannot create HTTP transport: %w", err))
+			}
+		case "file":
 			var err error
-			transporter, err = transport.NewHTTPTransport(ClientID, c.String("server"), tlsConfig, UserAgent, time.Second*5, client.DataReceiveHandlerFunc)
+			transporter, err = transport.NewFileTransport(c.String("inbox-dir"), c.String("outbox-dir"), c.Duration("inbox-poll-interval"), client.DataReceiveHandlerFunc)
 			if err != nil {
-				return cli.Exit(fmt.Errorf("cannot create HTTP transport: %w", err), 1)
+				return exitError("transport", fmt.Errorf("cannot create file transport: %w", err))
 			}
 		default:
-			return cli.Exit(fmt.Errorf("unsupported transport protocol: %v", c.String("protocol")), 1)
+			return exitError("config", fmt.Errorf("unsupported transport protocol: %v", c.String("protocol")))
 		}
 		client.t = transporter
-		if err := client.Connect(); err != nil {
-			return cli.Exit(fmt.Errorf("cannot connect using transport: %w", err), 1)
+		if r, ok := transporter.(transport.BrokerStatusReporter); ok {
+			metrics.setGaugeFunc("brokers_connected", func() float64 { return float64(connectedBrokers(r.BrokerStatus())) })
+		}
+		controlServer.handle("brokers", client.handleBrokers)
+		controlServer.handle("subscriptions", client.handleSubscriptions)
+		controlServer.handle("dispatch", client.handleDispatch)
+		if c.Duration("idle-disconnect-timeout") > 0 {
+			client.idle = newIdleDisconnector(c.Duration("idle-disconnect-timeout"), c.Duration("idle-connect-interval"), client.ConnectAfterIdle, func() { transporter.Disconnect(500) }, client.busy)
 		}
+		// liveness, once started, touches the liveness file while the daemon
+		// is healthy.
+		var liveness, watchdog *livenessFile
+		// shutdown stops the daemon, whether it has started up or is stopped
+		// at a startup checkpoint.
+		shutdown := func(escalation error) error {
+			// Stop touching the liveness file first, so that a watchdog
+			// sees a daemon that hangs while shutting down go stale.
+			liveness.stop()
+			watchdog.stop()
+			if _, err := notifyServiceManager("STOPPING=1"); err != nil {
+				log.Errorf("cannot notify service manager: %v", err)
+			}
+			// Stop accepting data messages before disconnecting, so that any
+			// message that arrives while the transport shuts down is rejected
+			// rather than partially processed.
+			log.Info("shutting down...")
+			client.Drain()
+			// Give up the messages held for paused workers while the
+			// transport can still publish their dead letters.
+			d.releasePaused()
+			// Send the publishes held back by a rate limit while the
+			// transport is still connected.
+			client.rateLimits.close()
+			if err := client.PublishOffline(); err != nil {
+				log.Errorf("cannot publish offline presence: %v", err)
+			}
+			transporter.Disconnect(500)
+			client.Disconnected()
 
-		go func() {
-			msg, err := client.ConnectionStatus()
+			err := stopWorkers()
+			// Write the output the workers' logs still hold, whether or not
+			// the workers have exited yet.
+			flushWorkerLogs()
+			// Export the metrics last, so that they include the exits of
+			// the workers.
+			stopMetrics()
 			if err != nil {
-				log.Errorf("cannot get connection status: %v", err)
+				return exitError("workers", fmt.Errorf("cannot kill workers: %w", err))
+			}
+			if escalation != nil {
+				return exitError("workers", escalation)
 			}
-			if err := client.SendConnectionStatusMessage(msg); err != nil {
-				log.Errorf("cannot send connection status message: %v", err)
+
+			return nil
+		}
+		// Start a goroutine that watches for a TERM or INT signal during
+		// startup. Once one is received, the startup stops at the checkpoint
+		// that follows the step in progress, after abandoning the step under
+		// the abort policy, rather than racing the shutdown: every worker
+		// launched by then is known and stopped.
+		interrupted, interrupt := context.WithCancel(context.Background())
+		defer interrupt()
+		bootstrapCtx := context.Background()
+		if c.String("bootstrap-shutdown") == bootstrapShutdownAbort {
+			bootstrapCtx = interrupted
+		}
+		bootstrapped := make(chan struct{})
+		go watchBootstrapSignal(quit, interrupt, bootstrapped)
+		go extendStartTimeout(startTimeoutInterval, bootstrapped)
+
+		switch c.String("connect-mode") {
+		case "on-start":
+			err := client.Handshake(bootstrapCtx)
+			switch {
+			case interrupted.Err() != nil:
+				// The daemon shuts down at the checkpoint below.
+			case errors.Is(err, transport.ErrSubscribeRefused):
+				return exitError("transport", fmt.Errorf("cannot subscribe using transport; check the broker ACL: %w", err))
+			case errors.Is(err, transport.ErrAuthFailed) && stopOnAuthFailure:
+				return exitError("transport", fmt.Errorf("cannot connect using transport; check the client credentials: %w", err))
+			case errors.Is(err, errHandshakeTimeout), errors.Is(err, transport.ErrSubscribeFailed), errors.Is(err, transport.ErrAuthFailed):
+				// The server was reachable, so keep retrying in the
+				// background rather than exiting.
+				log.Warnf("cannot complete handshake, retrying: %v", err)
+				go func() {
+					if err := client.ConnectLazily(c.Duration("mqtt-initial-reconnect-interval"), c.Duration("mqtt-max-reconnect-interval")); err != nil {
+						log.Errorf("cannot connect using transport; not retrying: %v", err)
+						return
+					}
+					if client.idle != nil {
+						client.idle.touch()
+						client.idle.run()
+					}
+				}()
+			case err != nil:
+				return exitError("transport", fmt.Errorf("cannot connect using transport: %w", err))
+			case client.idle != nil:
+				go client.idle.run()
+			}
+		case "lazy":
+			// Start a goroutine that keeps trying to connect, so that workers
+			// are served while the broker is unreachable.
+			go func() {
+				if err := client.ConnectLazily(c.Duration("mqtt-initial-reconnect-interval"), c.Duration("mqtt-max-reconnect-interval")); err != nil {
+					log.Errorf("cannot connect using transport; not retrying: %v", err)
+					return
+				}
+				if client.idle != nil {
+					client.idle.touch()
+					client.idle.run()
+				}
+			}()
+		default:
+			return exitError("config", fmt.Errorf("unsupported connect mode: %v", c.String("connect-mode")))
+		}
+		if interrupted.Err() != nil {
+			log.Info("stopping startup before starting workers")
+			return shutdown(nil)
+		}
+		go tlsLoader.watchExpiry()
+		if c.Duration("cert-watch-interval") > 0 {
+			files := append([]string{c.String("cert-file"), c.String("key-file")}, c.StringSlice("ca-root")...)
+			w := newCertWatcher(files, c.Duration("cert-watch-interval"), func() {
+				if err := reloadTLSConfig(tlsLoader, httpClient, transporter); err != nil {
+					log.Errorf("cannot reload TLS config: %v", err)
+					return
+				}
+				if c.String("protocol") != "mqtt" {
+					return
+				}
+				if err := client.Reconnect(c.Duration("mqtt-initial-reconnect-interval"), c.Duration("mqtt-max-reconnect-interval")); err != nil {
+					log.Errorf("cannot reconnect using transport; not retrying: %v", err)
+				}
+			})
+			go w.run()
+		}
+
+		// Start a goroutine that applies changes to the topic prefix, log
+		// level, data host and brokers, and reloads the TLS config when the
+		// HUP signal is received. Workers keep running throughout.
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				log.Info("reloading configuration")
+				if err := reloadTLSConfig(tlsLoader, httpClient, transporter); err != nil {
+					log.Errorf("cannot reload TLS config: %v", err)
+				}
+				file := c.String("config")
+				if file == "" {
+					log.Warn("no config file to reload")
+					continue
+				}
+				if err := reloadLogLevel(file); err != nil {
+					log.Errorf("cannot reload log level: %v", err)
+				}
+				if err := reloadTopicPrefix(file, transporter); err != nil {
+					log.Errorf("cannot reload topic prefix: %v", err)
+				}
+				if err := reloadDataHost(file); err != nil {
+					log.Errorf("cannot reload data host: %v", err)
+				}
+				config, err := tlsLoader.load()
+				if err != nil {
+					log.Errorf("cannot reload brokers: %v", err)
+					continue
+				}
+				changed, err := reloadBrokers(file, config, c.Duration("cert-expiry-warning"), brokerSets)
+				if err != nil {
+					log.Errorf("cannot reload brokers: %v", err)
+				}
+				if changed {
+					if err := client.Reconnect(c.Duration("mqtt-initial-reconnect-interval"), c.Duration("mqtt-max-reconnect-interval")); err != nil {
+						log.Errorf("cannot reconnect using transport; not retrying: %v", err)
+					}
+				}
 			}
 		}()
 
+		// Start a goroutine that periodically re-publishes the connection
+		// status.
+		if client.heartbeat != nil {
+			go client.heartbeat.run()
+		}
+
+		// Start a goroutine that periodically checks the canonical facts for
+		// changes.
+		if client.factsWatch != nil {
+			go client.factsWatch.run()
+		}
+
+		// Start a goroutine that periodically sends any spooled messages.
+		if client.spool != nil {
+			go func() {
+				for {
+					if err := client.FlushSpool(); err != nil {
+						log.Debugf("cannot flush spool: %v", err)
+					}
+					time.Sleep(c.Duration("spool-flush-interval"))
+				}
+			}()
+		}
+
 		// Start a goroutine that receives values on the 'dispatchers' channel
 		// and publishes "connection-status" messages to MQTT.
 		var prevDispatchersHash atomic.Value
@@ -293,20 +2431,19 @@ func main() {
 				}
 				prevDispatchersHash.Store(sum)
 				go func() {
-					msg, err := client.ConnectionStatus()
-					if err != nil {
-						log.Errorf("cannot get connection status: %v", err)
-					}
-					if err = client.SendConnectionStatusMessage(msg); err != nil {
-						log.Errorf("cannot send connection status: %v", err)
+					if err := client.PublishCapabilities(false); err != nil {
+						log.Errorf("cannot publish capabilities: %v", err)
 					}
 				}()
+				client.requestConnectionStatus(false)
 			}
 		}()
 
-		// Start a goroutine that receives yggdrasil.Data values on a 'send'
-		// channel and dispatches them to worker processes.
-		go d.sendData()
+		// Start a goroutine that restarts workers that stop sending
+		// heartbeats.
+		if d.heartbeatTimeout > 0 {
+			go d.watchHeartbeats()
+		}
 
 		// Start a goroutine that receives yggdrasil.Data values on a 'recv'
 		// channel and publish them to MQTT.
@@ -314,14 +2451,17 @@ func main() {
 
 		// Locate and start worker child processes.
 		workerPath := filepath.Join(yggdrasil.LibexecDir, yggdrasil.LongName)
+		if _, err := os.Stat(workerPath); os.IsNotExist(err) {
+			log.Warnf("worker directory %v does not exist; creating it", workerPath)
+		}
 		if err := os.MkdirAll(workerPath, 0755); err != nil {
-			return cli.Exit(fmt.Errorf("cannot create directory: %w", err), 1)
+			return exitError("workers", fmt.Errorf("cannot create directory: %w", err))
 		}
 
-		fileInfos, err := ioutil.ReadDir(workerPath)
-		if err != nil {
-			return cli.Exit(fmt.Errorf("cannot read contents of directory: %w", err), 1)
+		if err := checkWorkersFound(workerPath, c.Bool("require-workers")); err != nil {
+			return exitError("workers", err)
 		}
+
 		configDir := filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName)
 		env := []string{
 			"YGG_SOCKET_ADDR=unix:" + c.String("socket-addr"),
@@ -330,20 +2470,95 @@ func main() {
 			"YGG_LOG_LEVEL=" + level.String(),
 			"YGG_CLIENT_ID=" + ClientID,
 		}
-		for _, info := range fileInfos {
-			if strings.HasSuffix(info.Name(), "worker") {
-				log.Debugf("starting worker: %v", info.Name())
-				go startProcess(filepath.Join(workerPath, info.Name()), env, 0, d.deadWorkers)
+		started, err := bootstrapWorkers(bootstrapCtx, workerPath, env, c.Int("worker-bootstrap-parallelism"), c.Duration("worker-startup-timeout"), d.isRegistered, d.deadWorkers)
+		if interrupted.Err() != nil {
+			log.Infof("stopping startup after starting %v workers", len(started))
+			return shutdown(nil)
+		}
+		if err != nil {
+			var bootstrapErr *workerBootstrapError
+			if !errors.As(err, &bootstrapErr) {
+				return exitError("workers", fmt.Errorf("cannot bootstrap workers: %w", err))
 			}
+			log.Error(err)
+		}
+		report := newBootstrapReport(started, err)
+		controlServer.handle("bootstrap-status", report.handle)
+		if err := checkBootstrapPolicy(report, c.String("worker-bootstrap-policy"), c.StringSlice("required-worker")); err != nil {
+			if err := stopWorkers(); err != nil {
+				log.Errorf("cannot kill workers: %v", err)
+			}
+			return exitError("workers", fmt.Errorf("cannot bootstrap workers: %w", err))
 		}
-		// Start a goroutine that watches the worker directory for added or
-		// deleted files. Any "worker" files it detects are started up.
-		go watchWorkerDir(workerPath, env, d.deadWorkers)
 
 		// Start a goroutine that receives handler values on a channel and
 		// removes the worker registration entry.
 		go d.unregisterWorker()
 
+		// Start a goroutine that forgets the assignments of workers that
+		// never respond.
+		go d.sweepAssignments()
+
+		if c.Bool("self-test") {
+			d.waitForRegistrations(bootstrapCtx, len(started), c.Duration("self-test-timeout"))
+			results := d.selfTest(bootstrapCtx, c.Duration("self-test-timeout"), d.sendToWorker)
+			if interrupted.Err() != nil {
+				log.Info("stopping startup after the self-test")
+				return shutdown(nil)
+			}
+			if failed := logSelfTestResults(results); failed > 0 && c.String("worker-bootstrap-policy") == bootstrapPolicyStrict {
+				if err := stopWorkers(); err != nil {
+					log.Errorf("cannot kill workers: %v", err)
+				}
+				return exitError("workers", fmt.Errorf("%v of the workers failed their self-test", failed))
+			}
+		}
+
+		close(bootstrapped)
+		if _, err := notifyServiceManager("READY=1"); err != nil {
+			log.Errorf("cannot notify service manager: %v", err)
+		}
+
+		// Start a goroutine that takes yggdrasil.Data values off the
+		// assignment queue and dispatches them to worker processes. It starts
+		// once the workers are started, so that the messages received during
+		// startup, or queued again after a restart, find their workers.
+		go d.sendData()
+
+		// Start a goroutine that touches the liveness file while the daemon
+		// is connected and its dispatcher responsive. The health endpoint
+		// reports on the same checks.
+		checks := []livenessCheck{
+			{"transport", client.connectedCheck},
+			{"dispatcher", d.responsiveCheck},
+		}
+		health.setChecks(checks)
+		if c.String("liveness-file") != "" {
+			liveness = newLivenessFile(c.String("liveness-file"), c.Duration("liveness-interval"), checks)
+			go liveness.run()
+		}
+		// Under systemd with WatchdogSec= set, notify the watchdog while the
+		// dispatcher is responsive. A lost connection is retried rather than
+		// restarting the daemon.
+		if interval, err := watchdogInterval(); err != nil {
+			log.Errorf("cannot start watchdog notifications: %v", err)
+		} else if interval > 0 {
+			watchdog = newWatchdogNotifier(interval, []livenessCheck{{"dispatcher", d.responsiveCheck}})
+			go watchdog.run()
+		}
+
+		// Start a goroutine that announces that the daemon is operational
+		// once it has connected.
+		go func() {
+			if err := client.AnnounceStartup(started); err != nil {
+				log.Errorf("cannot announce startup: %v", err)
+			}
+		}()
+
+		// Start a goroutine that watches the worker directory for added or
+		// deleted files. Any "worker" files it detects are started up.
+		go watchWorkerDir(workerPath, env, d.deadWorkers)
+
 		// Start a goroutine that watches the tags file for write events and
 		// publishes connection status messages when the file changes.
 		go func() {
@@ -374,13 +2589,14 @@ func main() {
 			}
 		}()
 
-		<-quit
-
-		if err := killWorkers(); err != nil {
-			return cli.Exit(fmt.Errorf("cannot kill workers: %w", err), 1)
+		var escalation error
+		select {
+		case <-quit:
+		case escalation = <-escalated:
+			log.Errorf("restarting: %v", escalation)
 		}
 
-		return nil
+		return shutdown(escalation)
 	}
 	app.EnableBashCompletion = true
 	app.BashComplete = internal.BashComplete
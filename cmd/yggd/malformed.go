@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// malformedMetadataKey is the metadata key of the result published in place of
+// a worker's malformed response. Its value describes what was wrong with the
+// response.
+const malformedMetadataKey = "malformed_response"
+
+// errMalformedResponse is wrapped by the errors describing a malformed
+// response.
+var errMalformedResponse = errors.New("malformed response")
+
+// validateResponse returns an error wrapping errMalformedResponse if the
+// message data sent by a worker cannot be published: it has no message ID,
+// its directive is not a URL or its content is not JSON. The content of a
+// message posted to a URL is not required to be JSON.
+func validateResponse(data yggdrasil.Data) error {
+	if data.MessageID == "" {
+		return fmt.Errorf("%w: missing message_id", errMalformedResponse)
+	}
+	URL, err := url.Parse(data.Directive)
+	if err != nil {
+		return fmt.Errorf("%w: cannot parse directive as URL: %v", errMalformedResponse, err)
+	}
+	if URL.Scheme == "" && len(data.Content) > 0 && !json.Valid(data.Content) {
+		return fmt.Errorf("%w: content is not valid JSON", errMalformedResponse)
+	}
+	return nil
+}
+
+// responder returns the worker process the message id was delivered to, or 0
+// if it is not awaiting a response.
+func (d *dispatcher) responder(id string) int {
+	d.RLock()
+	defer d.RUnlock()
+
+	for pid, ids := range d.outstanding {
+		if ids[id] {
+			return pid
+		}
+	}
+	return 0
+}
+
+// malformedResponse handles the malformed response data sent by a worker,
+// described by err. If the response identifies the assignment it responds to,
+// the assignment is failed and a result recording err is published in its
+// place, so that the backend is not left waiting for it. A worker process
+// that sends malformedLimit malformed responses in a row is considered
+// unhealthy: it is unregistered and restarted.
+func (d *dispatcher) malformedResponse(data yggdrasil.Data, err error) {
+	pid := 0
+	if data.ResponseTo != "" {
+		pid = d.responder(data.ResponseTo)
+	}
+	metrics.add("responses_malformed_total", 1)
+	if pid == 0 {
+		log.Errorf("discarding message %q from unidentified worker: %v", data.MessageID, err)
+		payloadLog.log("malformed", &data)
+		return
+	}
+
+	logger := processLogger(pid)
+	d.RLock()
+	handler := d.pidHandlers[pid]
+	d.RUnlock()
+	logger.Errorf("discarding response to message %v from worker %v (process %v): %v", data.ResponseTo, handler, pid, err)
+	payloadLog.log("malformed", &data)
+
+	d.trackResponse(data.ResponseTo)
+	d.history.finish(data.ResponseTo, assignmentFailed, err)
+	d.releaseSlot(data.ResponseTo)
+	d.responded(data.ResponseTo)
+	d.recvQ <- malformedResult(data, err)
+
+	if d.countMalformed(pid) {
+		logger.Warnf("worker %v (process %v) sent %v malformed responses in a row; marking it unhealthy", handler, pid, d.malformedLimit)
+		d.Lock()
+		d.removeWorker(handler, pid)
+		d.Unlock()
+		d.sendDispatchersMap()
+		if err := d.restart(pid); err != nil {
+			logger.Errorf("cannot stop worker process %v: %v", pid, err)
+		}
+	}
+}
+
+// countMalformed records a malformed response from the worker process pid and
+// returns true if it has now sent malformedLimit in a row. It always returns
+// false if malformedLimit is 0.
+func (d *dispatcher) countMalformed(pid int) bool {
+	if d.malformedLimit <= 0 {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.malformed[pid]++
+	if d.malformed[pid] < d.malformedLimit {
+		return false
+	}
+	delete(d.malformed, pid)
+	return true
+}
+
+// resetMalformed records a well-formed response from the worker process pid,
+// ending any run of malformed responses.
+func (d *dispatcher) resetMalformed(pid int) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.malformed, pid)
+}
+
+// malformedResult creates the result published in place of the malformed
+// response data, which failed with err.
+func malformedResult(data yggdrasil.Data, err error) yggdrasil.Data {
+	return yggdrasil.Data{
+		Type:       yggdrasil.MessageTypeData,
+		MessageID:  uuid.New().String(),
+		ResponseTo: data.ResponseTo,
+		Version:    1,
+		Sent:       time.Now(),
+		Directive:  data.Directive,
+		Metadata:   map[string]string{malformedMetadataKey: err.Error()},
+		Content:    json.RawMessage("null"),
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+func TestValidateResponse(t *testing.T) {
+	tests := []struct {
+		description string
+		input       yggdrasil.Data
+		wantError   bool
+	}{
+		{
+			description: "valid",
+			input:       yggdrasil.Data{MessageID: "1", ResponseTo: "0", Content: []byte(`{"a":1}`)},
+		},
+		{
+			description: "no content",
+			input:       yggdrasil.Data{MessageID: "1"},
+		},
+		{
+			description: "missing message ID",
+			input:       yggdrasil.Data{ResponseTo: "0", Content: []byte(`{}`)},
+			wantError:   true,
+		},
+		{
+			description: "invalid directive",
+			input:       yggdrasil.Data{MessageID: "1", Directive: "http://[::1"},
+			wantError:   true,
+		},
+		{
+			description: "invalid content",
+			input:       yggdrasil.Data{MessageID: "1", Content: []byte(`{"a":`)},
+			wantError:   true,
+		},
+		{
+			description: "detached content",
+			input:       yggdrasil.Data{MessageID: "1", Directive: "https://example.com/upload", Content: []byte("raw")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := validateResponse(test.input)
+			if test.wantError {
+				if !errors.Is(err, errMalformedResponse) {
+					t.Errorf("expected a malformed response error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	d := newDispatcher(nil)
+	d.malformedLimit = 2
+	var restarted []int
+	d.restart = func(pid int) error {
+		restarted = append(restarted, pid)
+		return nil
+	}
+	d.workers["echo"] = worker{pid: 100, handler: "echo"}
+	d.pidHandlers[100] = "echo"
+	for _, id := range []string{"a", "b", "c"} {
+		d.trackDispatch(100, id)
+	}
+	go func() {
+		for range d.dispatchers {
+		}
+	}()
+
+	send := func(r *pb.Data) (yggdrasil.Data, error) {
+		results := make(chan yggdrasil.Data, 1)
+		go func() { results <- <-d.recvQ }()
+		_, err := d.Send(context.Background(), r)
+		return <-results, err
+	}
+
+	// A malformed response fails the assignment it responds to.
+	result, err := send(&pb.Data{ResponseTo: "a", Directive: "echo", Content: []byte("{")})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if result.ResponseTo != "a" || result.Metadata[malformedMetadataKey] == "" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if d.responder("a") != 0 {
+		t.Error("assignment a still outstanding")
+	}
+
+	// A well-formed response ends the run of malformed responses.
+	if _, err := send(&pb.Data{MessageId: "2", ResponseTo: "b", Directive: "echo"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := send(&pb.Data{ResponseTo: "c", Directive: "echo"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(restarted) != 0 {
+		t.Fatalf("worker restarted after a single malformed response in a row: %v", restarted)
+	}
+
+	d.trackDispatch(100, "d")
+	if _, err := send(&pb.Data{ResponseTo: "d", Directive: "echo"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(restarted) != 1 || restarted[0] != 100 {
+		t.Errorf("expected process 100 restarted, got %v", restarted)
+	}
+	if _, prs := d.workers["echo"]; prs {
+		t.Error("expected echo to be unregistered")
+	}
+}
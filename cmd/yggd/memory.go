@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// seenEntryOverhead estimates the memory held by an entry of a seenCache
+// besides its ID: the map entry, the list element and the seenEntry.
+const seenEntryOverhead = 100
+
+// queuedDataOverhead estimates the memory held by a queuedData besides the
+// strings and content of its message.
+const queuedDataOverhead = 256
+
+// priorityMetadata is the metadata key of a data message's priority, an
+// integer where higher values are more important. A message without a valid
+// priority has priority 0.
+const priorityMetadata = "priority"
+
+// seenEntrySize returns the estimated memory held by a seenCache entry for id.
+func seenEntrySize(id string) int {
+	return seenEntryOverhead + len(id)
+}
+
+// queuedDataSize returns the estimated memory held by q.
+func queuedDataSize(q queuedData) int {
+	n := queuedDataOverhead + len(q.data.MessageID) + len(q.data.ResponseTo) + len(q.data.Directive) + len(q.data.Origin) + len(q.data.Content)
+	for k, v := range q.data.Metadata {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// messagePriority returns the priority of data, or 0 if it has none.
+func messagePriority(data yggdrasil.Data) int {
+	priority, err := strconv.Atoi(data.Metadata[priorityMetadata])
+	if err != nil {
+		return 0
+	}
+	return priority
+}
+
+// shedsBefore returns true if a is shed before b to reclaim memory: it has a
+// lower priority or, with the same priority, it was queued earlier.
+func shedsBefore(a queuedData, b queuedData) bool {
+	if pa, pb := messagePriority(a.data), messagePriority(b.data); pa != pb {
+		return pa < pb
+	}
+	return a.queued.Before(b.queued)
+}
+
+// nextShed returns the index of the message of items that is shed first, or
+// -1 if items is empty.
+func nextShed(items []queuedData) int {
+	next := -1
+	for i, q := range items {
+		if next < 0 || shedsBefore(q, items[next]) {
+			next = i
+		}
+	}
+	return next
+}
+
+// A shedder holds messages that can be shed to reclaim memory.
+type shedder interface {
+	// nextShed returns, without removing it, the message held that is shed
+	// first. It returns false if no message is held.
+	nextShed() (queuedData, bool)
+
+	// shed removes the message id and returns it. It returns false if the
+	// message is no longer held.
+	shed(id string) (queuedData, bool)
+}
+
+// A memoryBudget bounds the estimated memory held by the daemon's in-memory
+// state of received messages: the IDs in the duplicate detection cache and the
+// messages queued anywhere before they are dispatched, in the dispatch queue,
+// held for paused workers or waiting for a slot of a worker group. A message
+// is only queued if it fits in the budget once the least recently seen IDs
+// are evicted from the cache, which at worst lets a duplicate through;
+// otherwise it is rejected, so that the queued messages are not shed to make
+// room for it. Should the total exceed limit bytes anyway, memory is reclaimed
+// from the cache first and then by shedding queued messages, wherever they
+// are queued, until it no longer does: those with the lowest priority first
+// and, within a priority, those that have waited the longest.
+type memoryBudget struct {
+	lock   sync.Mutex
+	limit  int
+	seen   *seenCache
+	queue  messageQueue
+	paused *pausedWorkers
+	groups *workerGroups
+
+	// evicted counts the IDs evicted from the cache, shed the messages
+	// shed and rejected the messages rejected.
+	evicted  uint64
+	shed     uint64
+	rejected uint64
+}
+
+func newMemoryBudget(limit int, seen *seenCache, queue messageQueue, paused *pausedWorkers, groups *workerGroups) (*memoryBudget, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid memory budget: %v", limit)
+	}
+	return &memoryBudget{limit: limit, seen: seen, queue: queue, paused: paused, groups: groups}, nil
+}
+
+// A memoryUsage is the estimated memory, in bytes, held by each part of a
+// memoryBudget.
+type memoryUsage struct {
+	Limit      int    `json:"limit"`
+	Total      int    `json:"total"`
+	DedupCache int    `json:"dedup_cache"`
+	Queue      int    `json:"queue"`
+	Paused     int    `json:"paused"`
+	Groups     int    `json:"groups"`
+	Evicted    uint64 `json:"evicted"`
+	Shed       uint64 `json:"shed"`
+	Rejected   uint64 `json:"rejected"`
+}
+
+// usage returns the memory currently held under the budget.
+func (b *memoryBudget) usage() memoryUsage {
+	u := memoryUsage{
+		Limit:      b.limit,
+		DedupCache: b.seen.memoryUsage(),
+		Queue:      b.queue.memoryUsage(),
+		Paused:     b.paused.memoryUsage(),
+		Groups:     b.groups.memoryUsage(),
+	}
+	u.Total = u.DedupCache + u.Queue + u.Paused + u.Groups
+	b.lock.Lock()
+	u.Evicted, u.Shed, u.Rejected = b.evicted, b.shed, b.rejected
+	b.lock.Unlock()
+	return u
+}
+
+// total returns the memory currently held under the budget.
+func (b *memoryBudget) total() int {
+	return b.seen.memoryUsage() + b.queue.memoryUsage() + b.paused.memoryUsage() + b.groups.memoryUsage()
+}
+
+// evict evicts IDs from the cache until excess bytes are freed, or the cache
+// is empty, and returns the number of bytes freed. The caller holds b.lock.
+func (b *memoryBudget) evict(excess int) int {
+	evicted, freed := b.seen.evictBytes(excess)
+	if evicted > 0 {
+		log.Debugf("evicted %v message IDs from the duplicate detection cache: memory budget of %v bytes exceeded", evicted, b.limit)
+		b.evicted += uint64(evicted)
+		metrics.add("memory_budget_evictions_total", float64(evicted))
+	}
+	return freed
+}
+
+// admit makes room in the budget for data, about to be queued, by evicting
+// IDs from the cache. It returns an error if the messages already queued
+// leave no room for data, which must then not be queued. It does nothing if b
+// is nil.
+func (b *memoryBudget) admit(data yggdrasil.Data) error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	excess := b.total() + queuedDataSize(queuedData{data: data}) - b.limit
+	if excess <= 0 {
+		return nil
+	}
+	if excess -= b.evict(excess); excess <= 0 {
+		return nil
+	}
+	b.rejected++
+	metrics.add("memory_budget_rejected_total", 1)
+	return fmt.Errorf("memory budget of %v bytes exceeded by the queued messages", b.limit)
+}
+
+// enforce reclaims memory until the memory held is within the budget, passing
+// each message shed to shed. It does nothing if b is nil.
+func (b *memoryBudget) enforce(shed func(q queuedData, reason error)) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	excess := b.total() - b.limit
+	if excess <= 0 {
+		return
+	}
+	excess -= b.evict(excess)
+
+	reason := fmt.Errorf("memory budget of %v bytes exceeded", b.limit)
+	shedders := []shedder{b.paused, b.groups, b.queue}
+	for excess > 0 {
+		var from shedder
+		var next queuedData
+		for _, s := range shedders {
+			if q, ok := s.nextShed(); ok && (from == nil || shedsBefore(q, next)) {
+				from, next = s, q
+			}
+		}
+		if from == nil {
+			return
+		}
+		// The message may have been dequeued meanwhile.
+		q, ok := from.shed(next.data.MessageID)
+		if !ok {
+			continue
+		}
+		excess -= queuedDataSize(q)
+		b.shed++
+		metrics.add("memory_budget_shed_total", 1)
+		shed(q, reason)
+	}
+}
+
+// enforceMemoryBudget reclaims memory until the memory budget, if there is
+// one, is no longer exceeded. A message shed is handled like a stale message.
+func (d *dispatcher) enforceMemoryBudget() {
+	d.memory.enforce(func(q queuedData, reason error) {
+		// A message shed while waiting for a worker group slot may
+		// hold the turn of its ordered sequence.
+		d.releaseSlot(q.data.MessageID)
+		d.history.record(q.data, nil, assignmentExpired, reason, q.queued)
+		if d.stale != nil {
+			d.stale(q.data, reason)
+		} else {
+			log.Warnf("dropping message %v: %v", q.data.MessageID, reason)
+		}
+	})
+}
+
+// handle is the control handler for the "memory" command.
+func (b *memoryBudget) handle(args map[string]string) (interface{}, error) {
+	if b == nil {
+		return nil, fmt.Errorf("memory budget is disabled")
+	}
+	return b.usage(), nil
+}
+
+// memoryAction calls the "memory" control command on the running daemon and
+// prints the result.
+func memoryAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "memory", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var usage memoryUsage
+	if err := json.Unmarshal(result, &usage); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	fmt.Fprintf(c.App.Writer, "total: %v/%v bytes\n", usage.Total, usage.Limit)
+	fmt.Fprintf(c.App.Writer, "dedup cache: %v bytes\n", usage.DedupCache)
+	fmt.Fprintf(c.App.Writer, "dispatch queue: %v bytes\n", usage.Queue)
+	fmt.Fprintf(c.App.Writer, "paused queues: %v bytes\n", usage.Paused)
+	fmt.Fprintf(c.App.Writer, "group queues: %v bytes\n", usage.Groups)
+	fmt.Fprintf(c.App.Writer, "evicted: %v\n", usage.Evicted)
+	fmt.Fprintf(c.App.Writer, "shed: %v\n", usage.Shed)
+	fmt.Fprintf(c.App.Writer, "rejected: %v\n", usage.Rejected)
+
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestMemoryBudgetEnforce(t *testing.T) {
+	queued := func(id string, directive string, priority string, age time.Duration) queuedData {
+		return queuedData{
+			data:   yggdrasil.Data{MessageID: id, Directive: directive, Metadata: map[string]string{priorityMetadata: priority}, Content: []byte(strings.Repeat("x", 1000))},
+			queued: time.Now().Add(-age),
+		}
+	}
+	size := queuedDataSize(queued("p1", "paused", "0", 0))
+
+	tests := []struct {
+		description string
+		limit       int
+		wantSeen    int
+		wantShed    []string
+	}{
+		{
+			description: "within budget",
+			limit:       10 * size,
+			wantSeen:    3,
+		},
+		{
+			description: "cache evicted",
+			limit:       5 * size,
+			wantSeen:    0,
+		},
+		{
+			description: "oldest shed first",
+			limit:       4 * size,
+			wantShed:    []string{"g2"},
+		},
+		{
+			description: "lowest priority shed first",
+			limit:       2 * size,
+			wantShed:    []string{"g2", "p1", "p2"},
+		},
+		{
+			description: "then higher priority",
+			limit:       size / 2,
+			wantShed:    []string{"g2", "p1", "p2", "g1", "q1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			seen := newSeenCache(10, 0)
+			for _, id := range []string{"a", "b", "c"} {
+				seen.seen(id)
+			}
+			paused, err := newPausedWorkers(10, pausedOverflowDropOldest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paused.pause("paused")
+			paused.hold(queued("p1", "paused", "0", 3*time.Minute))
+			paused.hold(queued("p2", "paused", "0", 2*time.Minute))
+			groups := newWorkerGroups([]workerGroupConfig{{Name: "api", Members: []string{"a", "b"}, MaxConcurrency: 1}, {Name: "db", Members: []string{"c"}, MaxConcurrency: 1}})
+			groups.acquire(queued("g0", "a", "0", 0))
+			groups.acquire(queued("g1", "a", "0", time.Minute))
+			groups.acquire(queued("g3", "c", "0", 0))
+			groups.acquire(queued("g2", "c", "0", 4*time.Minute))
+
+			// The queued message is the oldest, but has a higher priority.
+			queue := &bufferedQueue{items: []queuedData{queued("q1", "echo", "1", 5*time.Minute)}}
+
+			b, err := newMemoryBudget(test.limit, seen, queue, paused, groups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var shed []string
+			b.enforce(func(q queuedData, reason error) { shed = append(shed, q.data.MessageID) })
+
+			if got := seen.status().Size; got != test.wantSeen {
+				t.Errorf("%v IDs in cache, want %v", got, test.wantSeen)
+			}
+			if !cmp.Equal(shed, test.wantShed) {
+				t.Errorf("shed %v, want %v", shed, test.wantShed)
+			}
+			if u := b.usage(); u.Total > test.limit {
+				t.Errorf("total %v exceeds limit %v", u.Total, test.limit)
+			}
+		})
+	}
+}
+
+func TestMemoryBudgetAdmit(t *testing.T) {
+	data := yggdrasil.Data{MessageID: "1", Directive: "echo", Content: []byte(strings.Repeat("x", 1000))}
+	size := queuedDataSize(queuedData{data: data})
+
+	seen := newSeenCache(10, 0)
+	seen.seen("a")
+	queue := &bufferedQueue{}
+	b, err := newMemoryBudget(2*size, seen, queue, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache is evicted to make room.
+	queue.items = append(queue.items, queuedData{data: data})
+	if err := b.admit(data); err != nil {
+		t.Fatal(err)
+	}
+	if got := seen.status().Size; got != 0 {
+		t.Errorf("%v IDs in cache, want 0", got)
+	}
+
+	// Queued messages are not shed to make room.
+	queue.items = append(queue.items, queuedData{data: data})
+	if err := b.admit(data); err == nil {
+		t.Error("expected error")
+	}
+	if got := len(queue.items); got != 2 {
+		t.Errorf("%v queued messages, want 2", got)
+	}
+	if u := b.usage(); u.Rejected != 1 {
+		t.Errorf("rejected %v, want 1", u.Rejected)
+	}
+
+	var nilBudget *memoryBudget
+	if err := nilBudget.admit(data); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemoryUsageAccounting(t *testing.T) {
+	paused, err := newPausedWorkers(1, pausedOverflowDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paused.pause("echo")
+	first := queuedData{data: yggdrasil.Data{MessageID: "1", Directive: "echo", Content: []byte("a")}}
+	second := queuedData{data: yggdrasil.Data{MessageID: "2", Directive: "echo", Content: []byte("bbb")}}
+	paused.hold(first)
+	paused.hold(second)
+	if got, want := paused.memoryUsage(), queuedDataSize(second); got != want {
+		t.Errorf("paused: %v != %v", got, want)
+	}
+	paused.resume("echo")
+	paused.take("echo")
+	if got := paused.memoryUsage(); got != 0 {
+		t.Errorf("paused after resume: %v", got)
+	}
+
+	seen := newSeenCache(1, 0)
+	seen.seen("1")
+	seen.seen("22")
+	if got, want := seen.memoryUsage(), seenEntrySize("22"); got != want {
+		t.Errorf("seen: %v != %v", got, want)
+	}
+
+	queue := newMemoryQueue()
+	if err := queue.push(first, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := queue.memoryUsage(), queuedDataSize(first); got != want {
+		t.Errorf("queue: %v != %v", got, want)
+	}
+	if q, ok := queue.shed("1"); !ok || q.data.MessageID != "1" {
+		t.Errorf("shed %v, %v", q.data.MessageID, ok)
+	}
+	if got := queue.memoryUsage(); got != 0 {
+		t.Errorf("queue after shedding: %v", got)
+	}
+
+	var nilBudget *memoryBudget
+	nilBudget.enforce(nil)
+}
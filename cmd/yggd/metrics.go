@@ -0,0 +1,311 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metricsPrefix is prepended to the name of every metric when it is exported.
+const metricsPrefix = "yggd"
+
+// A metricKind is the type of a metric.
+type metricKind string
+
+const (
+	// metricCounter is a value that only increases.
+	metricCounter metricKind = "counter"
+
+	// metricGauge is a value that may increase or decrease.
+	metricGauge metricKind = "gauge"
+
+	// metricSummary is the sum and count of a series of observations, such
+	// as latencies.
+	metricSummary metricKind = "summary"
+
+	// metricHistogram is a summary that also counts the observations within
+	// each of a set of buckets, so that their distribution can be told.
+	metricHistogram metricKind = "histogram"
+)
+
+// A metricDesc describes a metric.
+type metricDesc struct {
+	name string
+	kind metricKind
+	help string
+}
+
+// A metricLabel is the name and value of a label of a metric series.
+type metricLabel struct {
+	name  string
+	value string
+}
+
+// A metricSample is the value of a metric at the time it was collected. For
+// a summary or histogram, Value holds the sum of the observations and Count
+// their number; for a histogram, Buckets also holds the number of
+// observations less than or equal to each of the upper bounds Bounds. The
+// sample of a labeled metric is the value of one of its series.
+type metricSample struct {
+	metricDesc
+	Labels  []metricLabel
+	Value   float64
+	Count   uint64
+	Bounds  []float64
+	Buckets []uint64
+}
+
+// record adds the observation value to the summary or histogram s.
+func (s *metricSample) record(value float64) {
+	s.Value += value
+	s.Count++
+	for i, bound := range s.Bounds {
+		if value <= bound {
+			s.Buckets[i]++
+		}
+	}
+}
+
+// snapshot returns a copy of s that does not change as s does.
+func (s *metricSample) snapshot() metricSample {
+	c := *s
+	c.Buckets = append([]uint64(nil), s.Buckets...)
+	return c
+}
+
+// key identifies the series of s among those of its metric.
+func (s *metricSample) key() string {
+	parts := make([]string, 0, len(s.Labels)+1)
+	parts = append(parts, s.name)
+	for _, l := range s.Labels {
+		parts = append(parts, l.name+"="+l.value)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// A metricsRegistry holds the current value of a fixed set of metrics. A
+// labeled metric holds a series for each set of label values it has been
+// updated with instead of a single value.
+type metricsRegistry struct {
+	lock    sync.Mutex
+	descs   []metricDesc
+	samples map[string]*metricSample
+	gauges  map[string]func() float64
+	series  map[string]map[string]*metricSample
+}
+
+// newMetricsRegistry creates a registry holding the metrics descs, each
+// starting at zero.
+func newMetricsRegistry(descs ...metricDesc) *metricsRegistry {
+	r := metricsRegistry{
+		descs:   descs,
+		samples: make(map[string]*metricSample),
+		gauges:  make(map[string]func() float64),
+		series:  make(map[string]map[string]*metricSample),
+	}
+	for _, desc := range descs {
+		r.samples[desc.name] = &metricSample{metricDesc: desc}
+	}
+	return &r
+}
+
+// add adds delta to the counter or gauge name.
+func (r *metricsRegistry) add(name string, delta float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if s, prs := r.samples[name]; prs {
+		s.Value += delta
+	}
+}
+
+// observe records an observation of the summary or histogram name.
+func (r *metricsRegistry) observe(name string, value float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if s, prs := r.samples[name]; prs {
+		s.record(value)
+	}
+}
+
+// setBuckets sets the upper bounds of the buckets of the histogram name, in
+// increasing order. It must be called before the histogram is observed.
+func (r *metricsRegistry) setBuckets(name string, bounds ...float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if s, prs := r.samples[name]; prs {
+		s.Bounds = bounds
+		s.Buckets = make([]uint64, len(bounds))
+	}
+}
+
+// setLabeled makes the counters, summaries and histograms names labeled
+// metrics.
+func (r *metricsRegistry) setLabeled(names ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, name := range names {
+		r.series[name] = make(map[string]*metricSample)
+	}
+}
+
+// addSeries adds delta to the series labels of the labeled counter name.
+func (r *metricsRegistry) addSeries(name string, labels []metricLabel, delta float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if s := r.seriesLocked(name, labels); s != nil {
+		s.Value += delta
+	}
+}
+
+// observeSeries records an observation of the series labels of the labeled
+// summary or histogram name.
+func (r *metricsRegistry) observeSeries(name string, labels []metricLabel, value float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if s := r.seriesLocked(name, labels); s != nil {
+		s.record(value)
+	}
+}
+
+// seriesLocked returns the series labels of the labeled metric name, creating
+// it if needed, or nil if name is not a labeled metric.
+func (r *metricsRegistry) seriesLocked(name string, labels []metricLabel) *metricSample {
+	series, prs := r.series[name]
+	if !prs {
+		return nil
+	}
+	metric := r.samples[name]
+	sample := metricSample{metricDesc: metric.metricDesc, Labels: labels}
+	key := sample.key()
+	if s, prs := series[key]; prs {
+		return s
+	}
+	sample.Labels = append([]metricLabel{}, labels...)
+	sample.Bounds = metric.Bounds
+	sample.Buckets = make([]uint64, len(metric.Bounds))
+	series[key] = &sample
+	return &sample
+}
+
+// setGaugeFunc makes the value of the gauge name the value returned by f each
+// time the metrics are collected.
+func (r *metricsRegistry) setGaugeFunc(name string, f func() float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.gauges[name] = f
+}
+
+// collect returns the current value of every metric, in the order the
+// metrics were registered. The series of a labeled metric are returned in the
+// order of their label values.
+func (r *metricsRegistry) collect() []metricSample {
+	r.lock.Lock()
+	gauges := make(map[string]func() float64, len(r.gauges))
+	for name, f := range r.gauges {
+		gauges[name] = f
+	}
+	samples := make([]metricSample, 0, len(r.descs))
+	for _, desc := range r.descs {
+		series, labeled := r.series[desc.name]
+		if !labeled {
+			samples = append(samples, r.samples[desc.name].snapshot())
+			continue
+		}
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			samples = append(samples, series[key].snapshot())
+		}
+	}
+	r.lock.Unlock()
+
+	// Gauge functions may take locks of their own, so they are called
+	// without holding the registry lock.
+	for i := range samples {
+		if f, prs := gauges[samples[i].name]; prs {
+			samples[i].Value = f()
+		}
+	}
+	return samples
+}
+
+// metrics holds the metrics of the daemon.
+var metrics = newMetricsRegistry(
+	metricDesc{"messages_received_total", metricCounter, "Data messages received from the transport."},
+	metricDesc{"messages_dispatched_total", metricCounter, "Data messages delivered to a worker."},
+	metricDesc{"messages_undeliverable_total", metricCounter, "Data messages that could not be delivered to a worker."},
+	metricDesc{"assignments_timed_out_total", metricCounter, "Assignments a worker did not respond to within the assignment timeout."},
+	metricDesc{"late_results_total", metricCounter, "Worker results that arrived after their assignment timed out."},
+	metricDesc{"responses_malformed_total", metricCounter, "Malformed messages sent by workers."},
+	metricDesc{"downloads_failed_total", metricCounter, "Data messages not dispatched because the content they reference could not be downloaded."},
+	metricDesc{"messages_oversized_total", metricCounter, "Data messages not published for exceeding the maximum message size."},
+	metricDesc{"messages_published_total", metricCounter, "Data messages from workers published by the transport."},
+	metricDesc{"publish_queue_depth", metricGauge, "Data messages from workers waiting to be published."},
+	metricDesc{"assignment_queue_depth", metricGauge, "Data messages waiting in the assignment queue to be dispatched."},
+	metricDesc{"result_queue_depth", metricGauge, "Data messages from workers waiting in the result queue of the disk queue backend to be published."},
+	metricDesc{"ordered_queue_depth", metricGauge, "Data messages of ordered directives waiting for the message before them to be processed."},
+	metricDesc{"publish_duration_seconds", metricSummary, "Time taken to publish data messages from workers."},
+	metricDesc{"topic_publishes_total", metricCounter, "Messages published to a rate-limited destination, by destination."},
+	metricDesc{"topic_publishes_dropped_total", metricCounter, "Messages dropped for exceeding the rate limit of their destination, by destination."},
+	metricDesc{"topic_publish_delay_seconds", metricSummary, "Time messages waited for the rate limit of their destination, by destination."},
+	metricDesc{"workers", metricGauge, "Workers registered with the dispatcher."},
+	metricDesc{"workers_degraded", metricGauge, "Workers given up on for exceeding the restart limit, until started again."},
+	metricDesc{"worker_cpu_percent", metricGauge, "CPU used by the worker processes, as a percentage of one CPU."},
+	metricDesc{"worker_rss_bytes", metricGauge, "Resident memory held by the worker processes."},
+	metricDesc{"worker_starts_total", metricCounter, "Worker processes started, by worker."},
+	metricDesc{"worker_exits_total", metricCounter, "Worker processes exited, by worker."},
+	metricDesc{"brokers_connected", metricGauge, "Brokers the transport is connected to."},
+	metricDesc{"reconnects_total", metricCounter, "Reconnections of the transport to a broker after losing its connection."},
+	metricDesc{"payload_verification_failures_total", metricCounter, "Data messages received that failed signature verification."},
+	metricDesc{"worker_integrity_failures_total", metricCounter, "Workers not started for failing to match their checksum or signature."},
+	metricDesc{"worker_assignments_total", metricCounter, "Data messages delivered to a worker, by worker."},
+	metricDesc{"worker_assignment_duration_seconds", metricHistogram, "Time from delivering data messages to a worker to receiving its response, by worker."},
+	metricDesc{"worker_restarts_total", metricCounter, "Worker processes restarted after exiting, by worker."},
+	metricDesc{"dispatch_duration_seconds", metricSummary, "Time taken to deliver data messages to workers."},
+	metricDesc{"payload_messages_received_total", metricCounter, "Data messages received from the transport, by a field of their payload."},
+	metricDesc{"payload_messages_dispatched_total", metricCounter, "Data messages delivered to a worker, by a field of their payload."},
+	metricDesc{"payload_dispatch_duration_seconds", metricSummary, "Time taken to deliver data messages to workers, by a field of their payload."},
+	metricDesc{"connection_status_coalesced_total", metricCounter, "Connection-status publishes coalesced into one already scheduled."},
+	metricDesc{"facts_changes_total", metricCounter, "Changes of the canonical facts found by the facts watch."},
+	metricDesc{"audit_write_errors_total", metricCounter, "Events that could not be written to the audit log."},
+	metricDesc{"audit_dropped_records_total", metricCounter, "Audit records dropped from rotated audit log files discarded to make room."},
+	metricDesc{"in_flight_messages", metricGauge, "Data messages in flight."},
+	metricDesc{"in_flight_limit", metricGauge, "Maximum number of data messages in flight, or 0 for no limit."},
+	metricDesc{"in_flight_rejected_total", metricCounter, "Data messages rejected because the in-flight limit was reached."},
+	metricDesc{"memory_dedup_cache_bytes", metricGauge, "Estimated memory held by the duplicate detection cache."},
+	metricDesc{"memory_dispatch_queue_bytes", metricGauge, "Estimated memory held by the messages waiting in the dispatch queue."},
+	metricDesc{"memory_paused_queue_bytes", metricGauge, "Estimated memory held by the messages held for paused workers."},
+	metricDesc{"memory_group_queue_bytes", metricGauge, "Estimated memory held by the messages waiting for a worker group slot."},
+	metricDesc{"worker_group_rejected_total", metricCounter, "Data messages rejected because the queue of their worker group was full, by group."},
+	metricDesc{"memory_budget_evictions_total", metricCounter, "Message IDs evicted from the duplicate detection cache to stay within the memory budget."},
+	metricDesc{"memory_budget_shed_total", metricCounter, "Queued data messages shed to stay within the memory budget."},
+	metricDesc{"memory_budget_rejected_total", metricCounter, "Data messages rejected because the queued messages filled the memory budget."},
+	metricDesc{"disk_degraded", metricGauge, "Parts of the daemon that cannot write to a full disk."},
+	metricDesc{"disk_full_dropped_total", metricCounter, "Spooled messages and worker log lines dropped for a full disk."},
+	metricDesc{"spool_evicted_total", metricCounter, "Spooled messages removed to make room on a full disk or within the spool maximum size."},
+	metricDesc{"spool_expired_total", metricCounter, "Spooled messages removed for exceeding the spool maximum age."},
+	metricDesc{"client_certificate_expiry_timestamp_seconds", metricGauge, "Expiry time of the client certificate, in seconds since the epoch."},
+	metricDesc{"ca_certificate_expiry_timestamp_seconds", metricGauge, "Expiry time of the first certificate authority to expire, in seconds since the epoch."},
+	metricDesc{"control_connections", metricGauge, "Open connections to the control socket."},
+	metricDesc{"control_connections_rejected_total", metricCounter, "Connections to the control socket rejected for exceeding the limit."},
+)
+
+// assignmentDurationBuckets are the upper bounds, in seconds, of the buckets
+// of the time workers take to respond to data messages, which ranges from
+// milliseconds for a ping to an hour for a large report.
+var assignmentDurationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+func init() {
+	metrics.setLabeled("worker_assignments_total", "worker_assignment_duration_seconds", "worker_restarts_total", "worker_group_rejected_total")
+	metrics.setBuckets("worker_assignment_duration_seconds", assignmentDurationBuckets...)
+}
@@ -0,0 +1,32 @@
+package main
+
+func init() {
+	metrics.setLabeled("worker_starts_total", "worker_exits_total")
+}
+
+// observeEvents updates the metrics derived from the events of bus, such as
+// the starts and exits of worker processes, until done is closed. Events
+// dropped because the observer fell behind are not counted.
+func observeEvents(r *metricsRegistry, bus *eventBus, done <-chan struct{}) {
+	c := bus.subscribe()
+	defer bus.unsubscribe(c)
+
+	for {
+		select {
+		case e := <-c:
+			r.recordEvent(e)
+		case <-done:
+			return
+		}
+	}
+}
+
+// recordEvent updates the metrics derived from e.
+func (r *metricsRegistry) recordEvent(e event) {
+	switch e.Type {
+	case eventWorkerStarted:
+		r.addSeries("worker_starts_total", []metricLabel{{"worker", e.Worker}}, 1)
+	case eventWorkerDied:
+		r.addSeries("worker_exits_total", []metricLabel{{"worker", e.Worker}}, 1)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// A metricsExporter makes the metrics of a registry available to a metrics
+// system.
+type metricsExporter interface {
+	// run exports the metrics of r until an error occurs or done is
+	// closed, at which point it returns nil once it has stopped.
+	run(r *metricsRegistry, done <-chan struct{}) error
+}
+
+// metricsShutdownTimeout bounds how long a Prometheus exporter waits for the
+// scrapes in progress to complete when it stops.
+const metricsShutdownTimeout = 5 * time.Second
+
+// newMetricsExporter returns the exporter with the given name: "prometheus",
+// which serves the metrics for scraping on the listen address addr, or
+// "statsd" or "otlp", which push the metrics to the collector at addr every
+// interval.
+func newMetricsExporter(name string, addr string, interval time.Duration) (metricsExporter, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("no metrics address")
+	}
+	if name != "prometheus" && interval <= 0 {
+		return nil, fmt.Errorf("invalid metrics interval: %v", interval)
+	}
+	switch name {
+	case "prometheus":
+		return &prometheusExporter{addr: addr}, nil
+	case "statsd":
+		return &statsdExporter{addr: addr, interval: interval}, nil
+	case "otlp":
+		return &otlpExporter{url: addr, interval: interval, client: &http.Client{Timeout: interval}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported metrics exporter: %v", name)
+	}
+}
+
+// prometheusExporter serves metrics in the Prometheus text format over HTTP
+// at the path "/metrics", and the health of the daemon at "/healthz".
+type prometheusExporter struct {
+	addr string
+}
+
+func (e *prometheusExporter) run(r *metricsRegistry, done <-chan struct{}) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := writePrometheus(w, r.collect()); err != nil {
+			log.Errorf("cannot write metrics: %v", err)
+		}
+	})
+	mux.Handle("/healthz", health)
+	server := &http.Server{Addr: e.addr, Handler: mux}
+	go func() {
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Debugf("cannot stop serving metrics: %v", err)
+		}
+	}()
+
+	log.Infof("serving metrics on %v", e.addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// writePrometheus writes samples to w in the Prometheus text format. The
+// series of a labeled metric follow a single description of the metric.
+func writePrometheus(w io.Writer, samples []metricSample) error {
+	var buf bytes.Buffer
+	for i, s := range samples {
+		name := metricsPrefix + "_" + s.name
+		if i == 0 || samples[i-1].name != s.name {
+			fmt.Fprintf(&buf, "# HELP %v %v\n", name, s.help)
+			fmt.Fprintf(&buf, "# TYPE %v %v\n", name, s.kind)
+		}
+		labels := prometheusLabels(s.Labels)
+		if s.kind == metricHistogram {
+			for i, bound := range s.Bounds {
+				fmt.Fprintf(&buf, "%v_bucket%v %v\n", name, prometheusBucketLabels(s.Labels, formatFloat(bound)), s.Buckets[i])
+			}
+			fmt.Fprintf(&buf, "%v_bucket%v %v\n", name, prometheusBucketLabels(s.Labels, "+Inf"), s.Count)
+		}
+		if s.kind == metricSummary || s.kind == metricHistogram {
+			fmt.Fprintf(&buf, "%v_sum%v %v\n", name, labels, formatFloat(s.Value))
+			fmt.Fprintf(&buf, "%v_count%v %v\n", name, labels, s.Count)
+		} else {
+			fmt.Fprintf(&buf, "%v%v %v\n", name, labels, formatFloat(s.Value))
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// prometheusLabelEscaper escapes a label value in the Prometheus text format.
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// prometheusLabels formats labels as in the Prometheus text format, or
+// returns an empty string if there are none.
+func prometheusLabels(labels []metricLabel) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, l.name, prometheusLabelEscaper.Replace(l.value)))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// prometheusBucketLabels formats labels followed by the "le" label of the
+// histogram bucket with the upper bound le.
+func prometheusBucketLabels(labels []metricLabel, le string) string {
+	return prometheusLabels(append(append([]metricLabel{}, labels...), metricLabel{"le", le}))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// statsdMaxPacketSize is the size of the largest datagram the StatsD exporter
+// sends, so that its datagrams are not fragmented on a network with the common
+// MTU of 1500 bytes.
+const statsdMaxPacketSize = 1432
+
+// statsdWarnInterval is the minimum time between the warnings logged for
+// failed pushes to the StatsD server.
+const statsdWarnInterval = time.Minute
+
+// statsdExporter pushes metrics to a StatsD server over UDP. Counters and the
+// observations of summaries and histograms are sent as the change since the
+// previous push, and gauges as their current value. The labels of a series are
+// sent as DogStatsD tags.
+type statsdExporter struct {
+	addr     string
+	interval time.Duration
+}
+
+func (e *statsdExporter) run(r *metricsRegistry, done <-chan struct{}) error {
+	conn, err := net.Dial("udp", e.addr)
+	if err != nil {
+		return fmt.Errorf("cannot dial StatsD server: %w", err)
+	}
+	defer conn.Close()
+
+	log.Infof("pushing metrics to StatsD server %v every %v", e.addr, e.interval)
+
+	var prev []metricSample
+	var warned time.Time
+	failed := 0
+	for stopped := false; !stopped; {
+		stopped = waitInterval(e.interval, done)
+
+		var err error
+		prev, err = e.push(conn, r.collect(), prev)
+		if err == nil {
+			continue
+		}
+		// A server that is down fails every push, so the failures are
+		// logged at most once every statsdWarnInterval.
+		failed++
+		if time.Since(warned) >= statsdWarnInterval {
+			log.Warnf("cannot push metrics to StatsD server %v (%v failed pushes): %v", e.addr, failed, err)
+			warned = time.Now()
+			failed = 0
+		}
+	}
+	return nil
+}
+
+// push sends samples to the StatsD server over conn, in datagrams of at most
+// statsdMaxPacketSize bytes, and returns the samples the next push reports
+// changes since: those sent, and those of prev for the samples whose datagram
+// could not be sent. It returns the first error sending a datagram.
+func (e *statsdExporter) push(conn net.Conn, samples []metricSample, prev []metricSample) ([]metricSample, error) {
+	last := make(map[string]metricSample, len(prev))
+	for _, s := range prev {
+		last[s.key()] = s
+	}
+
+	next := make([]metricSample, 0, len(samples))
+	var failure error
+	for _, p := range statsdPackets(samples, prev, statsdMaxPacketSize) {
+		if _, err := conn.Write(p.data); err != nil {
+			if failure == nil {
+				failure = err
+			}
+			for _, s := range p.samples {
+				if l, prs := last[s.key()]; prs {
+					next = append(next, l)
+				}
+			}
+			continue
+		}
+		next = append(next, p.samples...)
+	}
+	return next, failure
+}
+
+// waitInterval waits for interval to elapse or done to be closed, returning
+// true in the latter case. Push exporters push one last time once done is
+// closed, so that the changes since the previous push are not lost.
+func waitInterval(interval time.Duration, done <-chan struct{}) bool {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return false
+	case <-done:
+		return true
+	}
+}
+
+// A statsdPacket is a datagram of StatsD metrics, and the samples they report.
+type statsdPacket struct {
+	data    []byte
+	samples []metricSample
+}
+
+// statsdPackets formats samples as StatsD metrics, one per line, in datagrams
+// of at most max bytes. The metrics of a sample are not split across
+// datagrams, so a sample whose metrics exceed max is sent in a datagram of its
+// own. Counters and summaries are sent as the change since prev, the samples
+// last sent.
+func statsdPackets(samples []metricSample, prev []metricSample, max int) []statsdPacket {
+	last := make(map[string]metricSample, len(prev))
+	for _, s := range prev {
+		last[s.key()] = s
+	}
+
+	var packets []statsdPacket
+	var p statsdPacket
+	for _, s := range samples {
+		lines := formatStatsDSample(s, last[s.key()])
+		if len(p.data) > 0 && len(p.data)+len(lines) > max {
+			packets = append(packets, p)
+			p = statsdPacket{}
+		}
+		p.data = append(p.data, lines...)
+		p.samples = append(p.samples, s)
+	}
+	if len(p.data) > 0 {
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+// formatStatsDSample formats s as StatsD metrics, one per line. Counters and
+// summaries are sent as the change since l, the sample last sent.
+func formatStatsDSample(s metricSample, l metricSample) []byte {
+	var buf bytes.Buffer
+	name := metricsPrefix + "." + s.name
+	tags := statsdTags(s.Labels)
+	switch s.kind {
+	case metricGauge:
+		fmt.Fprintf(&buf, "%v:%v|g%v\n", name, formatFloat(s.Value), tags)
+	case metricCounter:
+		fmt.Fprintf(&buf, "%v:%v|c%v\n", name, formatFloat(s.Value-l.Value), tags)
+	case metricSummary, metricHistogram:
+		fmt.Fprintf(&buf, "%v.sum:%v|c%v\n", name, formatFloat(s.Value-l.Value), tags)
+		fmt.Fprintf(&buf, "%v.count:%v|c%v\n", name, s.Count-l.Count, tags)
+	}
+	return buf.Bytes()
+}
+
+// statsdTagEscaper replaces the characters that separate DogStatsD tags and
+// metrics in a tag value.
+var statsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdTags formats labels as DogStatsD tags, or returns an empty string if
+// there are none.
+func statsdTags(labels []metricLabel) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(labels))
+	for _, l := range labels {
+		tags = append(tags, l.name+":"+statsdTagEscaper.Replace(l.value))
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+// otlpExporter pushes metrics to an OpenTelemetry collector using the OTLP
+// HTTP protocol with JSON encoding. url is the collector's metrics endpoint,
+// usually ending in "/v1/metrics".
+type otlpExporter struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+}
+
+func (e *otlpExporter) run(r *metricsRegistry, done <-chan struct{}) error {
+	log.Infof("pushing metrics to OTLP collector %v every %v", e.url, e.interval)
+
+	start := time.Now()
+	for stopped := false; !stopped; {
+		stopped = waitInterval(e.interval, done)
+
+		data, err := json.Marshal(otlpRequest(r.collect(), start, time.Now()))
+		if err != nil {
+			return fmt.Errorf("cannot marshal metrics: %w", err)
+		}
+		if err := e.push(data); err != nil {
+			log.Debugf("cannot push metrics: %v", err)
+		}
+	}
+	return nil
+}
+
+// push posts data, a JSON-encoded OTLP export request, to the collector. It is
+// also used by the tracer to push spans.
+func (e *otlpExporter) push(data []byte) error {
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response from collector: %v", resp.Status)
+	}
+	return nil
+}
+
+// otlpRequest creates the body of an OTLP metrics export request holding
+// samples, collected at now. Counters, summaries and histograms are cumulative
+// since start.
+func otlpRequest(samples []metricSample, start time.Time, now time.Time) map[string]interface{} {
+	startTime := strconv.FormatInt(start.UnixNano(), 10)
+	nowTime := strconv.FormatInt(now.UnixNano(), 10)
+
+	// AGGREGATION_TEMPORALITY_CUMULATIVE
+	const cumulative = 2
+
+	exported := make([]map[string]interface{}, 0, len(samples))
+	var points []map[string]interface{}
+	for i, s := range samples {
+		var point map[string]interface{}
+		switch s.kind {
+		case metricGauge:
+			point = map[string]interface{}{"timeUnixNano": nowTime, "asDouble": s.Value}
+		case metricCounter:
+			point = map[string]interface{}{"startTimeUnixNano": startTime, "timeUnixNano": nowTime, "asDouble": s.Value}
+		case metricSummary:
+			point = map[string]interface{}{"startTimeUnixNano": startTime, "timeUnixNano": nowTime, "count": strconv.FormatUint(s.Count, 10), "sum": s.Value}
+		case metricHistogram:
+			point = map[string]interface{}{"startTimeUnixNano": startTime, "timeUnixNano": nowTime, "count": strconv.FormatUint(s.Count, 10), "sum": s.Value, "explicitBounds": s.Bounds, "bucketCounts": otlpBucketCounts(s)}
+		}
+		if len(s.Labels) > 0 {
+			attributes := make([]map[string]interface{}, 0, len(s.Labels))
+			for _, l := range s.Labels {
+				attributes = append(attributes, map[string]interface{}{"key": l.name, "value": map[string]interface{}{"stringValue": l.value}})
+			}
+			point["attributes"] = attributes
+		}
+		points = append(points, point)
+
+		// The series of a labeled metric are the data points of one
+		// metric.
+		if i+1 < len(samples) && samples[i+1].name == s.name {
+			continue
+		}
+		m := map[string]interface{}{
+			"name":        metricsPrefix + "_" + s.name,
+			"description": s.help,
+		}
+		switch s.kind {
+		case metricGauge:
+			m["gauge"] = map[string]interface{}{"dataPoints": points}
+		case metricCounter:
+			m["sum"] = map[string]interface{}{
+				"aggregationTemporality": cumulative,
+				"isMonotonic":            true,
+				"dataPoints":             points,
+			}
+		case metricSummary:
+			m["summary"] = map[string]interface{}{"dataPoints": points}
+		case metricHistogram:
+			m["histogram"] = map[string]interface{}{
+				"aggregationTemporality": cumulative,
+				"dataPoints":             points,
+			}
+		}
+		exported = append(exported, m)
+		points = nil
+	}
+
+	return map[string]interface{}{
+		"resourceMetrics": []map[string]interface{}{
+			{
+				"resource": map[string]interface{}{
+					"attributes": []map[string]interface{}{
+						{"key": "service.name", "value": map[string]interface{}{"stringValue": metricsPrefix}},
+					},
+				},
+				"scopeMetrics": []map[string]interface{}{
+					{"metrics": exported},
+				},
+			},
+		},
+	}
+}
+
+// otlpBucketCounts returns the number of observations of the histogram s
+// within each of its buckets, and above the last bound, as OTLP expects them:
+// not cumulative, and encoded as strings.
+func otlpBucketCounts(s metricSample) []string {
+	counts := make([]string, 0, len(s.Bounds)+1)
+	var below uint64
+	for _, n := range s.Buckets {
+		counts = append(counts, strconv.FormatUint(n-below, 10))
+		below = n
+	}
+	return append(counts, strconv.FormatUint(s.Count-below, 10))
+}
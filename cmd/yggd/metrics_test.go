@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func newTestMetricsRegistry() *metricsRegistry {
+	r := newMetricsRegistry(
+		metricDesc{"received_total", metricCounter, "Messages received."},
+		metricDesc{"workers", metricGauge, "Workers registered."},
+		metricDesc{"duration_seconds", metricSummary, "Time taken."},
+	)
+	r.add("received_total", 3)
+	r.setGaugeFunc("workers", func() float64 { return 2 })
+	r.observe("duration_seconds", 0.5)
+	r.observe("duration_seconds", 1)
+	return r
+}
+
+// formatStatsD formats samples as StatsD metrics in a single datagram.
+func formatStatsD(samples []metricSample, prev []metricSample) []byte {
+	var data []byte
+	for _, p := range statsdPackets(samples, prev, math.MaxInt32) {
+		data = append(data, p.data...)
+	}
+	return data
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePrometheus(&buf, newTestMetricsRegistry().collect()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP yggd_received_total Messages received.
+# TYPE yggd_received_total counter
+yggd_received_total 3
+# HELP yggd_workers Workers registered.
+# TYPE yggd_workers gauge
+yggd_workers 2
+# HELP yggd_duration_seconds Time taken.
+# TYPE yggd_duration_seconds summary
+yggd_duration_seconds_sum 1.5
+yggd_duration_seconds_count 2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+}
+
+func TestFormatStatsD(t *testing.T) {
+	r := newTestMetricsRegistry()
+	prev := r.collect()
+	r.add("received_total", 2)
+	r.observe("duration_seconds", 0.25)
+
+	want := `yggd.received_total:2|c
+yggd.workers:2|g
+yggd.duration_seconds.sum:0.25|c
+yggd.duration_seconds.count:1|c
+`
+	if got := string(formatStatsD(r.collect(), prev)); got != want {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+}
+
+func TestOTLPRequest(t *testing.T) {
+	start := time.Unix(100, 0)
+	now := time.Unix(110, 0)
+	req := otlpRequest(newTestMetricsRegistry().collect(), start, now)
+
+	resourceMetrics := req["resourceMetrics"].([]map[string]interface{})
+	scopeMetrics := resourceMetrics[0]["scopeMetrics"].([]map[string]interface{})
+	got := scopeMetrics[0]["metrics"].([]map[string]interface{})
+	if len(got) != 3 {
+		t.Fatalf("expected 3 metrics, got %v", len(got))
+	}
+
+	sum := got[0]["sum"].(map[string]interface{})
+	point := sum["dataPoints"].([]map[string]interface{})[0]
+	if point["asDouble"] != 3.0 || point["startTimeUnixNano"] != "100000000000" || point["timeUnixNano"] != "110000000000" {
+		t.Errorf("unexpected counter data point: %v", point)
+	}
+	if _, ok := got[1]["gauge"]; !ok {
+		t.Errorf("expected gauge, got %v", got[1])
+	}
+	summary := got[2]["summary"].(map[string]interface{})
+	point = summary["dataPoints"].([]map[string]interface{})[0]
+	if point["count"] != "2" || point["sum"] != 1.5 {
+		t.Errorf("unexpected summary data point: %v", point)
+	}
+}
+
+func TestLabeledMetrics(t *testing.T) {
+	r := newMetricsRegistry(
+		metricDesc{"received_total", metricCounter, "Messages received."},
+		metricDesc{"duration_seconds", metricSummary, "Time taken."},
+	)
+	r.setLabeled("received_total", "duration_seconds")
+	a := []metricLabel{{"directive", "echo"}, {"campaign", `a"b`}}
+	b := []metricLabel{{"directive", "echo"}, {"campaign", "c,d"}}
+	r.addSeries("received_total", b, 1)
+	r.addSeries("received_total", a, 2)
+	r.observeSeries("duration_seconds", a, 0.5)
+
+	var buf bytes.Buffer
+	if err := writePrometheus(&buf, r.collect()); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP yggd_received_total Messages received.
+# TYPE yggd_received_total counter
+yggd_received_total{directive="echo",campaign="a\"b"} 2
+yggd_received_total{directive="echo",campaign="c,d"} 1
+# HELP yggd_duration_seconds Time taken.
+# TYPE yggd_duration_seconds summary
+yggd_duration_seconds_sum{directive="echo",campaign="a\"b"} 0.5
+yggd_duration_seconds_count{directive="echo",campaign="a\"b"} 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+
+	prev := r.collect()
+	r.addSeries("received_total", b, 3)
+	want = `yggd.received_total:0|c|#directive:echo,campaign:a"b
+yggd.received_total:3|c|#directive:echo,campaign:c_d
+yggd.duration_seconds.sum:0|c|#directive:echo,campaign:a"b
+yggd.duration_seconds.count:0|c|#directive:echo,campaign:a"b
+`
+	if got := string(formatStatsD(r.collect(), prev)); got != want {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+
+	req := otlpRequest(r.collect(), time.Unix(100, 0), time.Unix(110, 0))
+	resourceMetrics := req["resourceMetrics"].([]map[string]interface{})
+	scopeMetrics := resourceMetrics[0]["scopeMetrics"].([]map[string]interface{})
+	got := scopeMetrics[0]["metrics"].([]map[string]interface{})
+	if len(got) != 2 {
+		t.Fatalf("expected 2 metrics, got %v", len(got))
+	}
+	points := got[0]["sum"].(map[string]interface{})["dataPoints"].([]map[string]interface{})
+	if len(points) != 2 || points[0]["attributes"] == nil {
+		t.Errorf("unexpected data points: %v", points)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := newMetricsRegistry(metricDesc{"duration_seconds", metricHistogram, "Time taken."})
+	r.setLabeled("duration_seconds")
+	r.setBuckets("duration_seconds", 0.1, 1)
+	labels := []metricLabel{{"worker", "echo"}}
+	r.observeSeries("duration_seconds", labels, 0.05)
+	r.observeSeries("duration_seconds", labels, 0.5)
+	r.observeSeries("duration_seconds", labels, 2)
+
+	var buf bytes.Buffer
+	if err := writePrometheus(&buf, r.collect()); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP yggd_duration_seconds Time taken.
+# TYPE yggd_duration_seconds histogram
+yggd_duration_seconds_bucket{worker="echo",le="0.1"} 1
+yggd_duration_seconds_bucket{worker="echo",le="1"} 2
+yggd_duration_seconds_bucket{worker="echo",le="+Inf"} 3
+yggd_duration_seconds_sum{worker="echo"} 2.55
+yggd_duration_seconds_count{worker="echo"} 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+
+	req := otlpRequest(r.collect(), time.Unix(100, 0), time.Unix(110, 0))
+	resourceMetrics := req["resourceMetrics"].([]map[string]interface{})
+	scopeMetrics := resourceMetrics[0]["scopeMetrics"].([]map[string]interface{})
+	got := scopeMetrics[0]["metrics"].([]map[string]interface{})
+	histogram := got[0]["histogram"].(map[string]interface{})
+	point := histogram["dataPoints"].([]map[string]interface{})[0]
+	if !cmp.Equal(point["bucketCounts"], []string{"1", "1", "1"}) || !cmp.Equal(point["explicitBounds"], []float64{0.1, 1}) || point["count"] != "3" {
+		t.Errorf("unexpected histogram data point: %v", point)
+	}
+}
+
+func TestObserveEvents(t *testing.T) {
+	r := newMetricsRegistry(
+		metricDesc{"worker_starts_total", metricCounter, "Worker processes started."},
+		metricDesc{"worker_exits_total", metricCounter, "Worker processes exited."},
+	)
+	r.setLabeled("worker_starts_total", "worker_exits_total")
+	bus := newEventBus()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		observeEvents(r, bus, done)
+		close(stopped)
+	}()
+
+	// Wait for the observer to subscribe.
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		bus.lock.Lock()
+		n := len(bus.subscribers)
+		bus.lock.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("observer did not subscribe")
+		}
+	}
+	bus.emit(event{Type: eventWorkerStarted, Worker: "echo-worker"})
+	bus.emit(event{Type: eventWorkerDied, Worker: "echo-worker"})
+	bus.emit(event{Type: eventWorkerStarted, Worker: "echo-worker"})
+	bus.emit(event{Type: eventMessageReceived, MessageID: "1234"})
+
+	want := `yggd.worker_starts_total:2|c|#worker:echo-worker
+yggd.worker_exits_total:1|c|#worker:echo-worker
+`
+	var got string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if got = string(formatStatsD(r.collect(), nil)); got == want {
+			break
+		}
+	}
+	if got != want {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+
+	close(done)
+	<-stopped
+}
+
+func TestStatsDExporterStop(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	e := &statsdExporter{addr: conn.LocalAddr().String(), interval: time.Hour}
+	done := make(chan struct{})
+	close(done)
+	if err := e.run(newTestMetricsRegistry(), done); err != nil {
+		t.Fatal(err)
+	}
+
+	// The exporter pushes once more when stopped.
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no final push: %v", err)
+	}
+	if !bytes.Contains(buf[:n], []byte("yggd.received_total:3|c")) {
+		t.Errorf("unexpected push: %s", buf[:n])
+	}
+}
+
+func TestStatsDPackets(t *testing.T) {
+	r := newMetricsRegistry(metricDesc{"received_total", metricCounter, "Messages received."})
+	r.setLabeled("received_total")
+	for i := 0; i < 100; i++ {
+		r.addSeries("received_total", []metricLabel{{"directive", fmt.Sprintf("directive-%03d", i)}}, 1)
+	}
+	samples := r.collect()
+
+	packets := statsdPackets(samples, nil, statsdMaxPacketSize)
+	if len(packets) < 2 {
+		t.Fatalf("expected several packets, got %v", len(packets))
+	}
+	var data []byte
+	n := 0
+	for _, p := range packets {
+		if len(p.data) > statsdMaxPacketSize {
+			t.Errorf("packet of %v bytes exceeds %v", len(p.data), statsdMaxPacketSize)
+		}
+		if !bytes.HasSuffix(p.data, []byte("\n")) {
+			t.Errorf("packet splits a line: %q", p.data)
+		}
+		data = append(data, p.data...)
+		n += len(p.samples)
+	}
+	if got, want := string(data), string(formatStatsD(samples, nil)); got != want {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+	if n != len(samples) {
+		t.Errorf("%v != %v", n, len(samples))
+	}
+}
+
+// failingConn is a net.Conn whose writes fail after the first n.
+type failingConn struct {
+	net.Conn
+	n int
+}
+
+func (c *failingConn) Write(p []byte) (int, error) {
+	if c.n == 0 {
+		return 0, fmt.Errorf("connection refused")
+	}
+	c.n--
+	return len(p), nil
+}
+
+func TestStatsDPushFailure(t *testing.T) {
+	r := newMetricsRegistry(metricDesc{"received_total", metricCounter, "Messages received."})
+	r.setLabeled("received_total")
+	for i := 0; i < 100; i++ {
+		r.addSeries("received_total", []metricLabel{{"directive", fmt.Sprintf("directive-%03d", i)}}, 1)
+	}
+	samples := r.collect()
+	packets := statsdPackets(samples, nil, statsdMaxPacketSize)
+
+	e := &statsdExporter{}
+	next, err := e.push(&failingConn{n: 1}, samples, nil)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	// The samples of the datagrams not sent are reported again next time.
+	if !cmp.Equal(next, packets[0].samples, cmp.AllowUnexported(metricSample{}, metricDesc{}, metricLabel{})) {
+		t.Errorf("expected only the samples of the first datagram to be sent, got %v", len(next))
+	}
+}
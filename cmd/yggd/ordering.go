@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// The ways the messages of an ordered directive are divided into sequences.
+const (
+	// orderedByDirective puts all the messages of a directive in one
+	// sequence.
+	orderedByDirective = "directive"
+
+	// orderedByKey puts the messages of a directive with the same ordering
+	// key in one sequence, and those without one in another.
+	orderedByKey = "ordering-key"
+)
+
+// orderedSequences dispatches the messages of the ordered directives in
+// sequences: a message is only dispatched once the message before it in its
+// sequence has been responded to, cannot be delivered, or is otherwise done
+// with, so the messages of a sequence are processed one at a time in the
+// order they were received.
+type orderedSequences struct {
+	directives map[string]bool
+	byKey      bool
+
+	lock sync.Mutex
+
+	// busy maps each sequence to the ID of the message being processed,
+	// and held maps that ID back to its sequence. waiting holds the
+	// messages of each sequence waiting their turn, in order.
+	busy    map[string]string
+	held    map[string]string
+	waiting map[string][]queuedData
+}
+
+func newOrderedSequences(directives []string, by string) (*orderedSequences, error) {
+	s := orderedSequences{
+		directives: make(map[string]bool, len(directives)),
+		busy:       make(map[string]string),
+		held:       make(map[string]string),
+		waiting:    make(map[string][]queuedData),
+	}
+	switch by {
+	case orderedByDirective:
+	case orderedByKey:
+		s.byKey = true
+	default:
+		return nil, fmt.Errorf("invalid ordered-by: %v", by)
+	}
+	for _, directive := range directives {
+		s.directives[directive] = true
+	}
+	return &s, nil
+}
+
+// sequence returns the sequence of the message q, or false if its directive
+// is not ordered.
+func (s *orderedSequences) sequence(q queuedData) (string, bool) {
+	if !s.directives[q.data.Directive] {
+		return "", false
+	}
+	if !s.byKey {
+		return q.data.Directive, true
+	}
+	return q.data.Directive + "\x00" + q.data.Metadata[orderingKeyMetadata], true
+}
+
+// acquire makes q the message being processed in its sequence and returns
+// true, or, if another message of the sequence is being processed, queues q
+// behind it and returns false. A message of a directive that is not ordered,
+// or that is already being processed, is always dispatched. It always returns
+// true if s is nil.
+func (s *orderedSequences) acquire(q queuedData) bool {
+	if s == nil {
+		return true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seq, ordered := s.sequence(q)
+	if !ordered {
+		return true
+	}
+	if _, held := s.held[q.data.MessageID]; held {
+		return true
+	}
+	if id, busy := s.busy[seq]; busy {
+		log.Debugf("queueing message %v: message %v before it in its sequence is being processed", q.data.MessageID, id)
+		s.waiting[seq] = append(s.waiting[seq], q)
+		return false
+	}
+	s.busy[seq] = q.data.MessageID
+	s.held[q.data.MessageID] = seq
+	return true
+}
+
+// release ends the turn of the message id in its sequence, if it has one. If
+// a message of the sequence is waiting, the turn passes to it and the message
+// is returned, to be dispatched. It does nothing if s is nil.
+func (s *orderedSequences) release(id string) (queuedData, bool) {
+	if s == nil {
+		return queuedData{}, false
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seq, held := s.held[id]
+	if !held {
+		return queuedData{}, false
+	}
+	delete(s.held, id)
+	waiting := s.waiting[seq]
+	if len(waiting) == 0 {
+		delete(s.busy, seq)
+		return queuedData{}, false
+	}
+	next := waiting[0]
+	if len(waiting) == 1 {
+		delete(s.waiting, seq)
+	} else {
+		s.waiting[seq] = waiting[1:]
+	}
+	s.busy[seq] = next.data.MessageID
+	s.held[next.data.MessageID] = seq
+	return next, true
+}
+
+// queued returns the number of messages waiting their turn. It returns 0 if s
+// is nil.
+func (s *orderedSequences) queued() int {
+	if s == nil {
+		return 0
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	for _, waiting := range s.waiting {
+		n += len(waiting)
+	}
+	return n
+}
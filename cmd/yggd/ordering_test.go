@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestOrderedSequences(t *testing.T) {
+	queued := func(id string, directive string, key string) queuedData {
+		return queuedData{data: yggdrasil.Data{MessageID: id, Directive: directive, Metadata: map[string]string{orderingKeyMetadata: key}}}
+	}
+
+	tests := []struct {
+		description string
+		by          string
+		messages    []queuedData
+		wantDone    []string
+		wantWaiting []string
+		wantBusy    int
+	}{
+		{
+			description: "by directive",
+			by:          orderedByDirective,
+			messages:    []queuedData{queued("1", "echo", "a"), queued("2", "echo", "b"), queued("3", "other", ""), queued("4", "echo", "a")},
+			wantDone:    []string{"1", "3"},
+			wantWaiting: []string{"2", "4"},
+		},
+		{
+			description: "by ordering key",
+			by:          orderedByKey,
+			messages:    []queuedData{queued("1", "echo", "a"), queued("2", "echo", "b"), queued("3", "echo", ""), queued("4", "echo", "a")},
+			wantDone:    []string{"1", "2", "3"},
+			wantWaiting: []string{"4"},
+			wantBusy:    2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			s, err := newOrderedSequences([]string{"echo"}, test.by)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var done []string
+			var waiting []queuedData
+			for _, q := range test.messages {
+				if s.acquire(q) {
+					done = append(done, q.data.MessageID)
+				} else {
+					waiting = append(waiting, q)
+				}
+			}
+			if len(done) != len(test.wantDone) || s.queued() != len(test.wantWaiting) {
+				t.Fatalf("dispatched %v, %v waiting", done, s.queued())
+			}
+
+			// Each release passes the turn to the next message of the
+			// sequence, in the order they were received.
+			for i, want := range test.wantWaiting {
+				var prev string
+				if i == 0 {
+					prev = "1"
+				} else {
+					prev = test.wantWaiting[i-1]
+				}
+				next, ok := s.release(prev)
+				if !ok || next.data.MessageID != want {
+					t.Fatalf("expected message %v after %v, got %v, %v", want, prev, next.data.MessageID, ok)
+				}
+				if !s.acquire(next) {
+					t.Errorf("expected message %v holding its turn to be dispatched", want)
+				}
+			}
+			if _, ok := s.release(test.wantWaiting[len(test.wantWaiting)-1]); ok {
+				t.Error("expected no message after the last")
+			}
+			if s.queued() != 0 || len(s.busy) != test.wantBusy {
+				t.Errorf("unexpected sequences: %v", s.busy)
+			}
+		})
+	}
+
+	if _, err := newOrderedSequences([]string{"echo"}, "topic"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// contentDigestEncoding is the "content_encoding" metadata value of a
+// dead-lettered data message whose content was too large to publish and was
+// replaced by an oversizedContent.
+const contentDigestEncoding = "content-digest"
+
+// contentDigestLength is the number of hex digits of the SHA-256 digest of
+// the content kept in an oversizedContent, enough to tell one message from
+// another.
+const contentDigestLength = 16
+
+// An oversizedContent replaces the content of a data message that was too
+// large to publish as a dead letter. Size is the length of the content and
+// SHA256 the first contentDigestLength hex digits of its digest.
+type oversizedContent struct {
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// withContentDigest returns msg with its content replaced by an
+// oversizedContent, so that its metadata can be published where its content
+// cannot.
+func withContentDigest(msg yggdrasil.Data) (yggdrasil.Data, error) {
+	sum := sha256.Sum256(msg.Content)
+	content, err := json.Marshal(oversizedContent{Size: len(msg.Content), SHA256: hex.EncodeToString(sum[:])[:contentDigestLength]})
+	if err != nil {
+		return msg, fmt.Errorf("cannot marshal content digest: %w", err)
+	}
+	msg.Content = content
+	msg.Metadata = copyMetadata(msg.Metadata)
+	msg.Metadata["content_encoding"] = contentDigestEncoding
+	return msg, nil
+}
+
+// publishOversized handles the data message msg, which the transport did not
+// publish because it is too large, as described by reason. If the client
+// uploads large content, the content of msg is uploaded and a reference to it
+// published instead, however small the content. Otherwise, or if that fails
+// too, msg is dead-lettered without its content. Its content is not spooled,
+// as it would be rejected again once sent.
+func (c *Client) publishOversized(msg yggdrasil.Data, reason error) {
+	metrics.add("messages_oversized_total", 1)
+
+	if c.uploads != nil && msg.Metadata["content_encoding"] != uploadReferenceEncoding {
+		log.Warnf("uploading content of message %v: %v", msg.MessageID, reason)
+		uploaded, err := c.uploads.upload(msg)
+		if err == nil {
+			err = c.signer.sign(&uploaded)
+		}
+		if err == nil {
+			err = c.SendDataMessage(&uploaded)
+		}
+		if err == nil {
+			metrics.add("messages_published_total", 1)
+			return
+		}
+		log.Errorf("cannot publish uploaded content of message %v: %v", msg.MessageID, err)
+	}
+
+	log.Warnf("dead-lettering message %v: %v", msg.MessageID, reason)
+	if err := c.SendOversizedDeadLetterMessage(&msg, reason); err != nil {
+		log.Errorf("failed to send dead-letter message: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// limitedTransport is a recordingTransport that rejects data larger than
+// limit bytes, recording the destinations it was rejected for.
+type limitedTransport struct {
+	recordingTransport
+	limit    int
+	rejected []string
+}
+
+func (t *limitedTransport) SendData(data []byte, dest string) error {
+	if len(data) > t.limit {
+		t.rejected = append(t.rejected, dest)
+		return fmt.Errorf("%w: %v bytes", transport.ErrMessageTooLarge, len(data))
+	}
+	return t.recordingTransport.SendData(data, dest)
+}
+
+func (t *limitedTransport) SendDataWithOptions(data []byte, dest string, opts transport.PublishOptions) error {
+	t.options = opts
+	return t.SendData(data, dest)
+}
+
+func TestPublishOversized(t *testing.T) {
+	tests := []struct {
+		description  string
+		uploads      bool
+		failures     int
+		wantSent     []string
+		wantRejected []string
+	}{
+		{
+			description:  "uploaded",
+			uploads:      true,
+			wantSent:     []string{"data"},
+			wantRejected: []string{"data"},
+		},
+		{
+			description:  "upload failed",
+			uploads:      true,
+			failures:     1,
+			wantSent:     []string{"dead-letter"},
+			wantRejected: []string{"data"},
+		},
+		{
+			description:  "no uploads",
+			wantSent:     []string{"dead-letter"},
+			wantRejected: []string{"data"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tr := &limitedTransport{limit: 400}
+			c := Client{t: tr}
+			if test.uploads {
+				// The content is below the upload threshold, so it is only
+				// uploaded once the transport rejects the message.
+				u, err := newPayloadUploader(1000, "https://uploads.example.com", "", 0, uploadFailureInline, &fakeUploadClient{failures: test.failures})
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.uploads = u
+			}
+
+			content, err := json.Marshal(strings.Repeat("x", 500))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.publishResult(yggdrasil.Data{MessageID: "1234", Content: content}, nil)
+
+			var sent []string
+			for dest := range tr.sent {
+				sent = append(sent, dest)
+			}
+			if !cmp.Equal(sent, test.wantSent) {
+				t.Errorf("published to %v, want %v", sent, test.wantSent)
+			}
+			if !cmp.Equal(tr.rejected, test.wantRejected) {
+				t.Errorf("rejected for %v, want %v", tr.rejected, test.wantRejected)
+			}
+			for _, data := range tr.sent["dead-letter"] {
+				var msg yggdrasil.Data
+				if err := json.Unmarshal(data, &msg); err != nil {
+					t.Fatal(err)
+				}
+				if got := msg.Metadata["content_encoding"]; got != contentDigestEncoding {
+					t.Errorf("content_encoding %v, want %v", got, contentDigestEncoding)
+				}
+				var got oversizedContent
+				if err := json.Unmarshal(msg.Content, &got); err != nil {
+					t.Fatal(err)
+				}
+				if want := (oversizedContent{Size: len(content), SHA256: contentDigest(content)[len("sha256:"):][:contentDigestLength]}); got != want {
+					t.Errorf("%+v != %+v", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// The supported actions for payloads received from the transport that cannot
+// be decoded.
+const (
+	// unparseableDrop logs and drops the payload.
+	unparseableDrop = "drop"
+
+	// unparseableDeadLetter publishes the payload to the "dead-letter"
+	// destination.
+	unparseableDeadLetter = "dead-letter"
+
+	// unparseableAck publishes a parse-error message describing the payload.
+	unparseableAck = "ack"
+)
+
+// maxPayloadDumpLength bounds the number of bytes of an unparseable payload
+// that are logged or included in a parse-error message.
+const maxPayloadDumpLength = 1024
+
+// unparseablePayloads describes how payloads that cannot be decoded are
+// handled: action is one of the unparseable actions, dest is the destination
+// parse-error messages are published to, and dumpLength is the number of
+// bytes from the start of the payload that are logged and reported.
+type unparseablePayloads struct {
+	action     string
+	dest       string
+	dumpLength int
+}
+
+// newUnparseablePayloads validates the handling of unparseable payloads.
+func newUnparseablePayloads(action string, dest string, dumpLength int) (*unparseablePayloads, error) {
+	switch action {
+	case unparseableDrop, unparseableDeadLetter:
+	case unparseableAck:
+		if dest == "" {
+			return nil, fmt.Errorf("no parse-error destination")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported unparseable payload action: %v", action)
+	}
+	if dumpLength < 0 || dumpLength > maxPayloadDumpLength {
+		return nil, fmt.Errorf("invalid payload dump length: %v (must be between 0 and %v)", dumpLength, maxPayloadDumpLength)
+	}
+	return &unparseablePayloads{action: action, dest: dest, dumpLength: dumpLength}, nil
+}
+
+// payloadHead returns a hex dump of at most n bytes from the start of payload.
+func payloadHead(payload []byte, n int) string {
+	if len(payload) > n {
+		payload = payload[:n]
+	}
+	return hex.EncodeToString(payload)
+}
+
+// UnparseableHandlerFunc handles a payload received from the transport for
+// dest that could not be decoded, according to the client's configured
+// unparseable payload action.
+func (c *Client) UnparseableHandlerFunc(payload []byte, dest string, err error) {
+	u := c.unparseable
+	if u == nil {
+		u = &unparseablePayloads{action: unparseableDrop, dumpLength: 64}
+	}
+
+	head := payloadHead(payload, u.dumpLength)
+	log.Errorf("cannot unmarshal %v message (%v bytes, head %v): %v", dest, len(payload), head, err)
+
+	switch u.action {
+	case unparseableDeadLetter:
+		content, merr := json.Marshal(base64.StdEncoding.EncodeToString(payload))
+		if merr != nil {
+			log.Errorf("cannot marshal payload: %v", merr)
+			return
+		}
+		msg := yggdrasil.Data{
+			Type:      yggdrasil.MessageTypeData,
+			MessageID: uuid.New().String(),
+			Version:   1,
+			Sent:      time.Now(),
+			Metadata:  map[string]string{"payload_destination": dest, "payload_encoding": "base64"},
+			Content:   content,
+		}
+		if err := c.SendDeadLetterMessage(&msg, err); err != nil {
+			log.Errorf("failed to send dead-letter message: %v", err)
+		}
+	case unparseableAck:
+		msg := yggdrasil.ParseError{
+			Type:      yggdrasil.MessageTypeParseError,
+			MessageID: uuid.New().String(),
+			Version:   1,
+			Sent:      time.Now(),
+		}
+		msg.Content.Destination = dest
+		msg.Content.Topic = transport.Topic(topicPrefix.get(), ClientID, dest, "in")
+		msg.Content.Error = err.Error()
+		msg.Content.Length = len(payload)
+		msg.Content.Head = head
+		if err := c.sendMessage(&msg, u.dest); err != nil {
+			log.Errorf("cannot publish parse-error message: %v", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestNewUnparseablePayloads(t *testing.T) {
+	tests := []struct {
+		description string
+		action      string
+		dest        string
+		dumpLength  int
+		wantError   bool
+	}{
+		{
+			description: "drop",
+			action:      unparseableDrop,
+			dumpLength:  64,
+		},
+		{
+			description: "ack",
+			action:      unparseableAck,
+			dest:        "parse-error",
+			dumpLength:  64,
+		},
+		{
+			description: "ack without destination",
+			action:      unparseableAck,
+			dumpLength:  64,
+			wantError:   true,
+		},
+		{
+			description: "unsupported action",
+			action:      "retry",
+			wantError:   true,
+		},
+		{
+			description: "dump too long",
+			action:      unparseableDrop,
+			dumpLength:  maxPayloadDumpLength + 1,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := newUnparseablePayloads(test.action, test.dest, test.dumpLength)
+			if test.wantError != (err != nil) {
+				t.Errorf("error = %v, want error %v", err, test.wantError)
+			}
+		})
+	}
+}
+
+func TestPayloadHead(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []byte
+		n           int
+		want        string
+	}{
+		{
+			description: "short",
+			input:       []byte("ab"),
+			n:           4,
+			want:        "6162",
+		},
+		{
+			description: "truncated",
+			input:       []byte("abcdef"),
+			n:           4,
+			want:        "61626364",
+		},
+		{
+			description: "none",
+			input:       []byte("abcdef"),
+			want:        "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := payloadHead(test.input, test.n); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnparseableHandlerFunc(t *testing.T) {
+	payload := []byte("not json at all")
+
+	t.Run("ack", func(t *testing.T) {
+		tr := &recordingTransport{}
+		c := Client{t: tr, unparseable: &unparseablePayloads{action: unparseableAck, dest: "parse-error", dumpLength: 3}}
+		messageRouter{p: &c, unparseable: c.UnparseableHandlerFunc}.Route(payload, "data")
+
+		if len(tr.sent["parse-error"]) != 1 {
+			t.Fatalf("expected 1 parse-error message, got %v", tr.sent)
+		}
+		var got yggdrasil.ParseError
+		if err := json.Unmarshal(tr.sent["parse-error"][0], &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != yggdrasil.MessageTypeParseError || got.Content.Destination != "data" || got.Content.Length != len(payload) || got.Content.Head != "6e6f74" || got.Content.Error == "" {
+			t.Errorf("unexpected parse-error message: %+v", got)
+		}
+	})
+
+	t.Run("dead-letter", func(t *testing.T) {
+		tr := &recordingTransport{}
+		c := Client{t: tr, unparseable: &unparseablePayloads{action: unparseableDeadLetter, dumpLength: 3}}
+		c.UnparseableHandlerFunc(payload, "control", json.Unmarshal(payload, &struct{}{}))
+
+		if len(tr.sent["dead-letter"]) != 1 {
+			t.Fatalf("expected 1 dead-letter message, got %v", tr.sent)
+		}
+		var got yggdrasil.Data
+		if err := json.Unmarshal(tr.sent["dead-letter"][0], &got); err != nil {
+			t.Fatal(err)
+		}
+		var content string
+		if err := json.Unmarshal(got.Content, &content); err != nil {
+			t.Fatal(err)
+		}
+		if decoded, _ := base64.StdEncoding.DecodeString(content); string(decoded) != string(payload) {
+			t.Errorf("%q != %q", decoded, payload)
+		}
+		if got.Metadata["payload_destination"] != "control" || got.Metadata["dead_letter_reason"] == "" {
+			t.Errorf("unexpected metadata: %v", got.Metadata)
+		}
+	})
+}
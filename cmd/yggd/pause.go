@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultPausedQueueSize is the number of messages held for a paused worker,
+// unless a size is given.
+const defaultPausedQueueSize = 1000
+
+// The supported paused queue overflow policies, deciding which message is
+// given up when a message arrives for a paused worker whose queue is full.
+// The message given up is handled like a stale message.
+const (
+	// pausedOverflowDropOldest gives up the message held the longest.
+	pausedOverflowDropOldest = "drop-oldest"
+
+	// pausedOverflowDropNewest gives up the arriving message.
+	pausedOverflowDropNewest = "drop-newest"
+)
+
+// pausedWorkers holds the messages for workers whose dispatch is paused, in
+// the order they arrived, until they are resumed. At most size messages are
+// held for each paused worker; overflow decides which message is given up
+// beyond that.
+type pausedWorkers struct {
+	lock     sync.Mutex
+	size     int
+	overflow string
+	queues   map[string][]queuedData
+	resuming map[string]bool
+	bytes    int
+}
+
+func newPausedWorkers(size int, overflow string) (*pausedWorkers, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid paused queue size: %v", size)
+	}
+	switch overflow {
+	case pausedOverflowDropOldest, pausedOverflowDropNewest:
+	default:
+		return nil, fmt.Errorf("unsupported paused queue overflow policy: %v", overflow)
+	}
+	return &pausedWorkers{
+		size:     size,
+		overflow: overflow,
+		queues:   make(map[string][]queuedData),
+		resuming: make(map[string]bool),
+	}, nil
+}
+
+// pause pauses dispatch to the worker for handler. It returns false if it is
+// already paused.
+func (p *pausedWorkers) pause(handler string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, paused := p.queues[handler]; paused {
+		return false
+	}
+	p.queues[handler] = []queuedData{}
+	return true
+}
+
+// resume starts resuming dispatch to the worker for handler. The worker stays
+// paused, so that the messages arriving meanwhile are held behind those
+// already held, until take finds no message held for it. It returns false if
+// the worker is not paused or is already resuming.
+func (p *pausedWorkers) resume(handler string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, paused := p.queues[handler]; !paused || p.resuming[handler] {
+		return false
+	}
+	p.resuming[handler] = true
+	return true
+}
+
+// take removes the messages held for the worker for handler and returns them,
+// in the order they arrived. Once no message is held, the worker is resumed
+// and nil is returned.
+func (p *pausedWorkers) take(handler string) []queuedData {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	held := p.queues[handler]
+	if len(held) == 0 {
+		delete(p.queues, handler)
+		delete(p.resuming, handler)
+		return nil
+	}
+	p.queues[handler] = []queuedData{}
+	for _, q := range held {
+		p.bytes -= queuedDataSize(q)
+	}
+	return held
+}
+
+// release removes the messages held for all paused workers and returns them.
+// The workers stay paused. It returns nil if p is nil.
+func (p *pausedWorkers) release() []queuedData {
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var released []queuedData
+	for handler, held := range p.queues {
+		released = append(released, held...)
+		p.queues[handler] = []queuedData{}
+	}
+	p.bytes = 0
+	return released
+}
+
+// hold holds q if the worker it is dispatched to is paused, and returns true.
+// If the worker's queue is full, the message given up under the overflow
+// policy is returned too. It always returns false if p is nil.
+func (p *pausedWorkers) hold(q queuedData) (bool, *queuedData) {
+	if p == nil {
+		return false, nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	held, paused := p.queues[q.data.Directive]
+	if !paused {
+		return false, nil
+	}
+	if len(held) < p.size {
+		p.queues[q.data.Directive] = append(held, q)
+		p.bytes += queuedDataSize(q)
+		return true, nil
+	}
+	if p.overflow == pausedOverflowDropNewest {
+		return true, &q
+	}
+	oldest := held[0]
+	p.queues[q.data.Directive] = append(held[1:], q)
+	p.bytes += queuedDataSize(q) - queuedDataSize(oldest)
+	return true, &oldest
+}
+
+// memoryUsage returns the estimated memory held by the messages held for
+// paused workers, in bytes. It returns 0 if p is nil.
+func (p *pausedWorkers) memoryUsage() int {
+	if p == nil {
+		return 0
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.bytes
+}
+
+// nextShed returns the message held for any paused worker that is shed first
+// to reclaim memory. It returns false if no message is held or p is nil.
+func (p *pausedWorkers) nextShed() (queuedData, bool) {
+	if p == nil {
+		return queuedData{}, false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var next queuedData
+	var ok bool
+	for _, held := range p.queues {
+		if i := nextShed(held); i >= 0 && (!ok || shedsBefore(held[i], next)) {
+			next, ok = held[i], true
+		}
+	}
+	return next, ok
+}
+
+// shed removes and returns the message id held for a paused worker. It
+// returns false if the message is not held or p is nil.
+func (p *pausedWorkers) shed(id string) (queuedData, bool) {
+	if p == nil {
+		return queuedData{}, false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for handler, held := range p.queues {
+		for i, q := range held {
+			if q.data.MessageID == id {
+				p.queues[handler] = append(held[:i:i], held[i+1:]...)
+				p.bytes -= queuedDataSize(q)
+				return q, true
+			}
+		}
+	}
+	return queuedData{}, false
+}
+
+// A pausedWorkerStatus describes a paused worker.
+type pausedWorkerStatus struct {
+	Handler string `json:"handler"`
+	Held    int    `json:"held"`
+}
+
+// status returns the paused workers, sorted by handler.
+func (p *pausedWorkers) status() []pausedWorkerStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	statuses := make([]pausedWorkerStatus, 0, len(p.queues))
+	for handler, held := range p.queues {
+		statuses = append(statuses, pausedWorkerStatus{Handler: handler, Held: len(held)})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Handler < statuses[j].Handler })
+	return statuses
+}
+
+// holdPaused holds q if dispatch to its worker is paused, and returns true.
+// A message given up because the worker's queue is full is handled like a
+// stale message.
+func (d *dispatcher) holdPaused(q queuedData) bool {
+	held, dropped := d.paused.hold(q)
+	if !held {
+		return false
+	}
+	if dropped == nil {
+		log.Debugf("holding message %v: worker %v is paused", q.data.MessageID, q.data.Directive)
+		return true
+	}
+	err := fmt.Errorf("worker %v is paused and its queue of %v messages is full", dropped.data.Directive, d.paused.size)
+	if d.stale != nil {
+		d.stale(dropped.data, err)
+	} else {
+		log.Warnf("dropping message %v: %v", dropped.data.MessageID, err)
+	}
+	return true
+}
+
+// handlePause is the control handler for the "worker-pause" command. It
+// pauses dispatch to the worker for the handler given in the "name" argument.
+func (d *dispatcher) handlePause(args map[string]string) (interface{}, error) {
+	handler := args["name"]
+	d.RLock()
+	_, prs := d.workers[handler]
+	d.RUnlock()
+	if !prs {
+		return nil, fmt.Errorf("no worker registered for handler %v", handler)
+	}
+
+	if !d.paused.pause(handler) {
+		return nil, fmt.Errorf("worker %v is already paused", handler)
+	}
+	log.Infof("paused dispatch to worker %v", handler)
+	return pausedWorkerStatus{Handler: handler}, nil
+}
+
+// handleResume is the control handler for the "worker-resume" command. It
+// resumes dispatch to the worker for the handler given in the "name" argument
+// once it has dispatched the messages held for it, in the order they arrived.
+// The messages arriving meanwhile are held until they are dispatched in turn,
+// so that they do not overtake those held before them.
+func (d *dispatcher) handleResume(args map[string]string) (interface{}, error) {
+	handler := args["name"]
+	if !d.paused.resume(handler) {
+		return nil, fmt.Errorf("worker %v is not paused or is already resuming", handler)
+	}
+
+	var dispatched int
+	for {
+		held := d.paused.take(handler)
+		if held == nil {
+			break
+		}
+		for _, q := range held {
+			d.dispatchHeld(q)
+		}
+		dispatched += len(held)
+	}
+	log.Infof("resumed dispatch to worker %v; dispatched %v held messages", handler, dispatched)
+	return pausedWorkerStatus{Handler: handler, Held: dispatched}, nil
+}
+
+// releasePaused gives up the messages held for paused workers when the daemon
+// shuts down. A persistent queue keeps them until they are acknowledged, so
+// they are dispatched again once the daemon restarts; otherwise each is
+// handled like a stale message.
+func (d *dispatcher) releasePaused() {
+	released := d.paused.release()
+	if len(released) == 0 {
+		return
+	}
+	if d.queueBackend == queueBackendDisk {
+		log.Infof("keeping %v messages held for paused workers in the queue until the next start", len(released))
+		return
+	}
+	for _, q := range released {
+		err := fmt.Errorf("shutting down while worker %v is paused", q.data.Directive)
+		if d.stale != nil {
+			d.stale(q.data, err)
+		} else {
+			log.Warnf("dropping message %v: %v", q.data.MessageID, err)
+		}
+	}
+}
+
+// handlePaused is the control handler for the "worker-paused" command. It
+// reports the paused workers and the number of messages held for each.
+func (d *dispatcher) handlePaused(args map[string]string) (interface{}, error) {
+	return d.paused.status(), nil
+}
+
+// workerPauseAction calls the "worker-pause" or "worker-resume" control
+// command, according to the name of the command run, on the running daemon.
+func workerPauseAction(c *cli.Context) error {
+	if !c.Args().Present() {
+		return cli.Exit("missing NAME argument", 1)
+	}
+
+	result, err := callControl(c.String("control-socket-addr"), "worker-"+c.Command.Name, map[string]string{"name": c.Args().First()})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var status pausedWorkerStatus
+	if err := json.Unmarshal(result, &status); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+	if c.Command.Name == "resume" {
+		fmt.Fprintf(c.App.Writer, "resumed %v; dispatched %v held messages\n", status.Handler, status.Held)
+	} else {
+		fmt.Fprintf(c.App.Writer, "paused %v\n", status.Handler)
+	}
+	return nil
+}
+
+// workerPausedAction calls the "worker-paused" control command on the running
+// daemon and prints the paused workers.
+func workerPausedAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "worker-paused", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var statuses []pausedWorkerStatus
+	if err := json.Unmarshal(result, &statuses); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	w := tabwriter.NewWriter(c.App.Writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HANDLER\tHELD")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "%v\t%v\n", s.Handler, s.Held)
+	}
+	if err := w.Flush(); err != nil {
+		return cli.Exit(fmt.Errorf("cannot write paused workers: %w", err), 1)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestPausedWorkersHold(t *testing.T) {
+	tests := []struct {
+		description string
+		overflow    string
+		messages    int
+		wantHeld    []string
+		wantDropped []string
+	}{
+		{
+			description: "within size",
+			overflow:    pausedOverflowDropOldest,
+			messages:    2,
+			wantHeld:    []string{"0", "1"},
+		},
+		{
+			description: "drop oldest",
+			overflow:    pausedOverflowDropOldest,
+			messages:    4,
+			wantHeld:    []string{"2", "3"},
+			wantDropped: []string{"0", "1"},
+		},
+		{
+			description: "drop newest",
+			overflow:    pausedOverflowDropNewest,
+			messages:    4,
+			wantHeld:    []string{"0", "1"},
+			wantDropped: []string{"2", "3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			p, err := newPausedWorkers(2, test.overflow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.pause("echo")
+
+			if held, _ := p.hold(queuedData{data: yggdrasil.Data{MessageID: "other", Directive: "inventory"}}); held {
+				t.Error("held message for a worker that is not paused")
+			}
+			var dropped []string
+			for i := 0; i < test.messages; i++ {
+				held, d := p.hold(queuedData{data: yggdrasil.Data{MessageID: fmt.Sprint(i), Directive: "echo"}})
+				if !held {
+					t.Fatalf("message %v not held", i)
+				}
+				if d != nil {
+					dropped = append(dropped, d.data.MessageID)
+				}
+			}
+			if !cmp.Equal(dropped, test.wantDropped) {
+				t.Errorf("dropped: %v", cmp.Diff(dropped, test.wantDropped))
+			}
+
+			if !p.resume("echo") {
+				t.Fatal("worker not paused")
+			}
+			if p.resume("echo") {
+				t.Error("resumed a worker that is already resuming")
+			}
+			var got []string
+			for _, q := range p.take("echo") {
+				got = append(got, q.data.MessageID)
+			}
+			if !cmp.Equal(got, test.wantHeld) {
+				t.Errorf("held: %v", cmp.Diff(got, test.wantHeld))
+			}
+			if held := p.take("echo"); held != nil {
+				t.Errorf("took %v messages after taking all", len(held))
+			}
+			if held, _ := p.hold(queuedData{data: yggdrasil.Data{MessageID: "resumed", Directive: "echo"}}); held {
+				t.Error("held message for a resumed worker")
+			}
+		})
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	d := newDispatcher(nil)
+	d.paused, _ = newPausedWorkers(defaultPausedQueueSize, pausedOverflowDropOldest)
+	d.workers["echo"] = worker{handler: "echo", pid: newWorkerPID, addr: "@ygg-test-paused"}
+	var got []string
+	d.undeliverable = func(data yggdrasil.Data) {
+		got = append(got, data.MessageID)
+		if data.MessageID == "1" {
+			// A message arriving while the held messages are dispatched
+			// must not overtake them.
+			d.dispatch(queuedData{data: yggdrasil.Data{MessageID: "3", Directive: "echo"}, queued: time.Now()})
+		}
+	}
+
+	if _, err := d.handlePause(map[string]string{"name": "inventory"}); err == nil {
+		t.Error("expected error pausing an unregistered worker")
+	}
+	if _, err := d.handlePause(map[string]string{"name": "echo"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"1", "2"} {
+		d.dispatch(queuedData{data: yggdrasil.Data{MessageID: id, Directive: "echo"}, queued: time.Now()})
+	}
+	if len(got) != 0 {
+		t.Fatalf("messages %v dispatched to a paused worker", got)
+	}
+
+	result, err := d.handleResume(map[string]string{"name": "echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held := result.(pausedWorkerStatus).Held; held != 3 {
+		t.Errorf("resumed with %v held messages, want 3", held)
+	}
+
+	// The worker is not listening, so the held messages are undeliverable.
+	if want := []string{"1", "2", "3"}; !cmp.Equal(got, want) {
+		t.Errorf("dispatched: %v", cmp.Diff(got, want))
+	}
+	if _, err := d.handleResume(map[string]string{"name": "echo"}); err == nil {
+		t.Error("expected error resuming a worker that is not paused")
+	}
+}
+
+func TestReleasePaused(t *testing.T) {
+	tests := []struct {
+		description  string
+		queueBackend string
+		want         []string
+	}{
+		{
+			description:  "memory",
+			queueBackend: queueBackendMemory,
+			want:         []string{"1", "2"},
+		},
+		{
+			description:  "disk",
+			queueBackend: queueBackendDisk,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.queueBackend = test.queueBackend
+			d.paused, _ = newPausedWorkers(defaultPausedQueueSize, pausedOverflowDropOldest)
+			var got []string
+			d.stale = func(data yggdrasil.Data, reason error) { got = append(got, data.MessageID) }
+
+			d.paused.pause("echo")
+			for _, id := range []string{"1", "2"} {
+				d.dispatch(queuedData{data: yggdrasil.Data{MessageID: id, Directive: "echo"}, queued: time.Now()})
+			}
+			d.releasePaused()
+
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("given up: %v", cmp.Diff(got, test.want))
+			}
+			if status := d.paused.status(); len(status) != 1 || status[0].Held != 0 {
+				t.Errorf("unexpected paused workers: %+v", status)
+			}
+		})
+	}
+}
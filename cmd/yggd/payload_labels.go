@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/pelletier/go-toml"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func init() {
+	metrics.setLabeled("payload_messages_received_total", "payload_messages_dispatched_total", "payload_dispatch_duration_seconds")
+}
+
+// The values of a payload label that stand in for the value of the field.
+const (
+	// payloadLabelNone labels a message whose payload lacks the field, or
+	// holds an object or array in it.
+	payloadLabelNone = "none"
+
+	// payloadLabelOther labels a message whose value of the field is not
+	// allowed, or would exceed the label's cap on distinct values.
+	payloadLabelOther = "other"
+)
+
+// defaultPayloadLabelMaxValues is the number of distinct values a payload
+// label without an allowlist takes before further values are labeled "other".
+const defaultPayloadLabelMaxValues = 100
+
+// labelNamePattern matches a valid metric label name.
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// metricsLabelConfig holds the settings for labeling the message metrics of
+// a directive with a field of the payload, read from a "[[metrics-label]]"
+// table in the config file.
+type metricsLabelConfig struct {
+	// Directive is the directive of the messages to label.
+	Directive string `toml:"directive"`
+
+	// Label is the name of the label.
+	Label string `toml:"label"`
+
+	// Path is the path to the field in the JSON payload: dot-separated
+	// object keys and array indices, such as "campaign.id" or
+	// "tasks.0.action".
+	Path string `toml:"path"`
+
+	// Allow lists the values the label may take. Others are labeled
+	// "other".
+	Allow []string `toml:"allow"`
+
+	// MaxValues is the number of distinct values the label takes, if Allow
+	// is empty, before further values are labeled "other".
+	MaxValues int `toml:"max-values"`
+}
+
+// readMetricsLabelConfigs reads from its input, unmarshalling the
+// "metrics-label" tables of the TOML-encoded value and validating their
+// values. Other keys are ignored.
+func readMetricsLabelConfigs(in io.Reader) ([]metricsLabelConfig, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read input: %w", err)
+	}
+
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse TOML: %w", err)
+	}
+	if !tree.Has("metrics-label") {
+		return nil, nil
+	}
+	tables, ok := tree.Get("metrics-label").([]*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("metrics-label: not an array of tables")
+	}
+
+	directives := make(map[string]bool)
+	configs := make([]metricsLabelConfig, 0, len(tables))
+	for i, t := range tables {
+		var config metricsLabelConfig
+		if err := t.Unmarshal(&config); err != nil {
+			return nil, fmt.Errorf("metrics-label %v: %w", i, err)
+		}
+		if config.Directive == "" {
+			return nil, fmt.Errorf("metrics-label %v: missing directive", i)
+		}
+		if directives[config.Directive] {
+			return nil, fmt.Errorf("metrics-label %v: duplicate directive", config.Directive)
+		}
+		directives[config.Directive] = true
+		if !labelNamePattern.MatchString(config.Label) || config.Label == "directive" {
+			return nil, fmt.Errorf("metrics-label %v: invalid label: %q", config.Directive, config.Label)
+		}
+		if config.Path == "" {
+			return nil, fmt.Errorf("metrics-label %v: missing path", config.Directive)
+		}
+		if config.MaxValues < 0 {
+			return nil, fmt.Errorf("metrics-label %v: invalid max-values: %v", config.Directive, config.MaxValues)
+		}
+		if config.MaxValues == 0 {
+			config.MaxValues = defaultPayloadLabelMaxValues
+		}
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// loadMetricsLabelConfigs reads the metrics label tables from the config
+// file. If file is empty, no labels are returned.
+func loadMetricsLabelConfigs(file string) ([]metricsLabelConfig, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := readConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	configs, err := readMetricsLabelConfigs(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read metrics label config from '%v': %w", file, err)
+	}
+	return configs, nil
+}
+
+// A payloadLabel labels the messages of one directive. seen holds the
+// distinct values the label has taken, if it has no allowlist.
+type payloadLabel struct {
+	metricsLabelConfig
+
+	path    []string
+	allowed map[string]bool
+	seen    map[string]bool
+	capped  bool
+}
+
+// payloadLabeler labels the message metrics of the configured directives with
+// a field extracted from the message payload, capping the number of distinct
+// values each label takes.
+type payloadLabeler struct {
+	lock   sync.Mutex
+	labels map[string]*payloadLabel
+}
+
+// payloadLabels labels the message metrics, or is nil if no labels are
+// configured.
+var payloadLabels *payloadLabeler
+
+func newPayloadLabeler(configs []metricsLabelConfig) *payloadLabeler {
+	l := payloadLabeler{labels: make(map[string]*payloadLabel, len(configs))}
+	for _, config := range configs {
+		label := &payloadLabel{
+			metricsLabelConfig: config,
+			path:               strings.Split(strings.TrimPrefix(config.Path, "$."), "."),
+			seen:               make(map[string]bool),
+		}
+		if len(config.Allow) > 0 {
+			label.allowed = make(map[string]bool, len(config.Allow))
+			for _, value := range config.Allow {
+				label.allowed[value] = true
+			}
+		}
+		l.labels[config.Directive] = label
+	}
+	return &l
+}
+
+// add adds delta to the labeled counter name for the series labels, as
+// returned by seriesLabels. It does nothing if labels is empty.
+func (l *payloadLabeler) add(name string, labels []metricLabel, delta float64) {
+	if len(labels) > 0 {
+		metrics.addSeries(name, labels, delta)
+	}
+}
+
+// observe records an observation of the labeled summary name for the series
+// labels, as returned by seriesLabels. It does nothing if labels is empty.
+func (l *payloadLabeler) observe(name string, labels []metricLabel, value float64) {
+	if len(labels) > 0 {
+		metrics.observeSeries(name, labels, value)
+	}
+}
+
+// seriesLabels returns the labels of the series of data, or nil if l is nil
+// or the directive of data is not labeled. The payload is decoded before the
+// lock is taken, so it is best called once per message, with the labels kept
+// for each metric of the message.
+func (l *payloadLabeler) seriesLabels(data *yggdrasil.Data) []metricLabel {
+	if l == nil {
+		return nil
+	}
+
+	// labels is not modified once l is created.
+	label, prs := l.labels[data.Directive]
+	if !prs {
+		return nil
+	}
+	field, ok := extractPayloadField(data.Content, label.path)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return []metricLabel{
+		{name: "directive", value: data.Directive},
+		{name: label.Label, value: label.value(field, ok)},
+	}
+}
+
+// value returns the value label takes for the value of its payload field, or
+// for a payload lacking the field if ok is false, recording it as seen. It
+// must be called with the labeler's lock held.
+func (label *payloadLabel) value(value string, ok bool) string {
+	if !ok {
+		return payloadLabelNone
+	}
+	if label.allowed != nil {
+		if label.allowed[value] {
+			return value
+		}
+		return payloadLabelOther
+	}
+	if label.seen[value] {
+		return value
+	}
+	if len(label.seen) >= label.MaxValues {
+		if !label.capped {
+			log.Warnf("metrics label %v of directive %v reached %v distinct values: labeling further values %q", label.Label, label.Directive, label.MaxValues, payloadLabelOther)
+			label.capped = true
+		}
+		return payloadLabelOther
+	}
+	label.seen[value] = true
+	return value
+}
+
+// extractPayloadField returns the value of the field at path in the JSON
+// document content, formatted as a string, or false if content is not JSON,
+// lacks the field, or holds null, an object or an array in it.
+func extractPayloadField(content json.RawMessage, path []string) (string, bool) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return "", false
+	}
+
+	for _, key := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			var prs bool
+			if v, prs = node[key]; !prs {
+				return "", false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			v = node[i]
+		default:
+			return "", false
+		}
+	}
+
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	case bool:
+		return strconv.FormatBool(value), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestReadMetricsLabelConfigs(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        []metricsLabelConfig
+		wantError   bool
+	}{
+		{
+			description: "no labels",
+			input:       `server = "tcp://localhost:1883"`,
+		},
+		{
+			description: "labels",
+			input: strings.Join([]string{
+				`[[metrics-label]]`,
+				`directive = "rhc-worker-playbook"`,
+				`label = "campaign_id"`,
+				`path = "campaign.id"`,
+				`[[metrics-label]]`,
+				`directive = "package-manager"`,
+				`label = "action"`,
+				`path = "action"`,
+				`allow = ["install", "remove"]`,
+			}, "\n"),
+			want: []metricsLabelConfig{
+				{Directive: "rhc-worker-playbook", Label: "campaign_id", Path: "campaign.id", MaxValues: defaultPayloadLabelMaxValues},
+				{Directive: "package-manager", Label: "action", Path: "action", Allow: []string{"install", "remove"}, MaxValues: defaultPayloadLabelMaxValues},
+			},
+		},
+		{
+			description: "invalid label",
+			input: strings.Join([]string{
+				`[[metrics-label]]`,
+				`directive = "echo"`,
+				`label = "campaign-id"`,
+				`path = "campaign.id"`,
+			}, "\n"),
+			wantError: true,
+		},
+		{
+			description: "duplicate directive",
+			input: strings.Join([]string{
+				`[[metrics-label]]`,
+				`directive = "echo"`,
+				`label = "a"`,
+				`path = "a"`,
+				`[[metrics-label]]`,
+				`directive = "echo"`,
+				`label = "b"`,
+				`path = "b"`,
+			}, "\n"),
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := readMetricsLabelConfigs(strings.NewReader(test.input))
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPayloadLabeler(t *testing.T) {
+	l := newPayloadLabeler([]metricsLabelConfig{
+		{Directive: "playbook", Label: "campaign", Path: "tasks.0.campaign", MaxValues: 2},
+		{Directive: "packages", Label: "action", Path: "$.action", Allow: []string{"install"}},
+	})
+
+	tests := []struct {
+		description string
+		directive   string
+		content     string
+		want        string
+		wantOK      bool
+	}{
+		{description: "unlabeled directive", directive: "echo", content: `{"action":"install"}`},
+		{description: "first value", directive: "playbook", content: `{"tasks":[{"campaign":"a"}]}`, want: "a", wantOK: true},
+		{description: "number", directive: "playbook", content: `{"tasks":[{"campaign":12}]}`, want: "12", wantOK: true},
+		{description: "beyond cap", directive: "playbook", content: `{"tasks":[{"campaign":"c"}]}`, want: payloadLabelOther, wantOK: true},
+		{description: "seen value", directive: "playbook", content: `{"tasks":[{"campaign":"a"}]}`, want: "a", wantOK: true},
+		{description: "missing field", directive: "playbook", content: `{"tasks":[]}`, want: payloadLabelNone, wantOK: true},
+		{description: "not JSON", directive: "playbook", content: `"a`, want: payloadLabelNone, wantOK: true},
+		{description: "allowed", directive: "packages", content: `{"action":"install"}`, want: "install", wantOK: true},
+		{description: "not allowed", directive: "packages", content: `{"action":"remove"}`, want: payloadLabelOther, wantOK: true},
+		{description: "object", directive: "packages", content: `{"action":{"name":"install"}}`, want: payloadLabelNone, wantOK: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			labels := l.seriesLabels(&yggdrasil.Data{Directive: test.directive, Content: json.RawMessage(test.content)})
+			if ok := labels != nil; ok != test.wantOK {
+				t.Fatalf("%v != %v", ok, test.wantOK)
+			}
+			if labels == nil {
+				return
+			}
+			if labels[0].value != test.directive || labels[1].value != test.want {
+				t.Errorf("unexpected labels: %v", labels)
+			}
+		})
+	}
+
+	var nilLabeler *payloadLabeler
+	if labels := nilLabeler.seriesLabels(&yggdrasil.Data{Directive: "playbook"}); labels != nil {
+		t.Error("nil labeler labeled a message")
+	}
+}
+
+func TestReceiveDataMessageLabels(t *testing.T) {
+	payloadLabels = newPayloadLabeler([]metricsLabelConfig{
+		{Directive: "packages", Label: "action", Path: "action", MaxValues: 10},
+	})
+	defer func() { payloadLabels = nil }()
+
+	d := newDispatcher(nil)
+	d.queue = &bufferedQueue{}
+	c := Client{t: &recordingTransport{}, d: d}
+
+	if err := c.ReceiveDataMessage(&yggdrasil.Data{MessageID: "1", Directive: "packages", Content: json.RawMessage(`{"action":"install"}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	q, ok := d.queue.Dequeue()
+	if !ok {
+		t.Fatal("expected a queued message")
+	}
+	want := []metricLabel{{name: "directive", value: "packages"}, {name: "action", value: "install"}}
+	if !cmp.Equal(q.labels, want, cmp.AllowUnexported(metricLabel{})) {
+		t.Errorf("%v", cmp.Diff(q.labels, want, cmp.AllowUnexported(metricLabel{})))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// defaultPayloadLogMaxSize is the size in bytes of the largest payload logged
+// in full, if not set.
+const defaultPayloadLogMaxSize = 1024
+
+// defaultPayloadLogRedact are the keys whose values are redacted from the
+// payloads and metadata logged, if not set.
+var defaultPayloadLogRedact = []string{"password", "secret", "token"}
+
+// payloadLogger logs the payloads of data messages at the trace level, as they
+// are received, dispatched to workers and returned by them. A payload up to
+// maxSize bytes is logged in full; a larger one is truncated to maxSize bytes
+// and logged with its size, or, if maxSize is 0, only its size is logged. The
+// values of the keys in redact, compared without regard to case, are redacted
+// from JSON payloads and from the metadata, at any depth, before the payload
+// is logged or truncated. The transports log only the sizes of the payloads
+// they send, so that payloads are logged only through a payloadLogger.
+type payloadLogger struct {
+	maxSize int
+	redact  map[string]bool
+}
+
+func newPayloadLogger(maxSize int, redact []string) *payloadLogger {
+	l := payloadLogger{
+		maxSize: maxSize,
+		redact:  make(map[string]bool, len(redact)),
+	}
+	for _, key := range redact {
+		l.redact[strings.ToLower(key)] = true
+	}
+	return &l
+}
+
+// payloadLog logs the payloads of data messages. If nil, payloads are not
+// logged.
+var payloadLog = newPayloadLogger(defaultPayloadLogMaxSize, defaultPayloadLogRedact)
+
+// log logs the payload and metadata of data at the trace level, with what
+// happened to it. It does nothing if l is nil or trace logging is off.
+func (l *payloadLogger) log(what string, data *yggdrasil.Data) {
+	if l == nil || log.CurrentLevel() < log.LevelTrace {
+		return
+	}
+	log.Tracef("%v message %v: metadata %v, payload %v", what, data.MessageID, l.metadata(data.Metadata), l.payload(data.Content))
+}
+
+// metadata returns metadata with the values of the redacted keys replaced.
+func (l *payloadLogger) metadata(metadata map[string]string) map[string]string {
+	redactedMetadata := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if l.redact[strings.ToLower(k)] {
+			v = redacted
+		}
+		redactedMetadata[k] = v
+	}
+	return redactedMetadata
+}
+
+// payload returns content as logged: redacted if it is JSON, then truncated if
+// it is larger than the maximum size.
+func (l *payloadLogger) payload(content []byte) string {
+	text := string(content)
+	if len(l.redact) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(content, &v); err == nil {
+			if data, err := json.Marshal(l.redactValue(v)); err == nil {
+				text = string(data)
+			}
+		}
+	}
+	switch {
+	case len(text) <= l.maxSize:
+	case l.maxSize == 0:
+		return fmt.Sprintf("(%v bytes)", len(content))
+	default:
+		return fmt.Sprintf("%q... (%v bytes, truncated)", text[:l.maxSize], len(content))
+	}
+	return fmt.Sprintf("%q", text)
+}
+
+// redactValue replaces the values of the redacted keys in the objects held by
+// v, at any depth.
+func (l *payloadLogger) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if l.redact[strings.ToLower(k)] {
+				v[k] = redacted
+				continue
+			}
+			v[k] = l.redactValue(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = l.redactValue(val)
+		}
+	}
+	return v
+}
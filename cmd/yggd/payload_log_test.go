@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPayloadLoggerPayload(t *testing.T) {
+	tests := []struct {
+		description string
+		maxSize     int
+		redact      []string
+		input       string
+		want        string
+	}{
+		{
+			description: "small",
+			maxSize:     64,
+			input:       `{"command":"ping"}`,
+			want:        `"{\"command\":\"ping\"}"`,
+		},
+		{
+			description: "truncated",
+			maxSize:     8,
+			input:       `{"command":"ping"}`,
+			want:        `"{\"comman"... (18 bytes, truncated)`,
+		},
+		{
+			description: "size only",
+			input:       `{"command":"ping"}`,
+			want:        `(18 bytes)`,
+		},
+		{
+			description: "redacted",
+			maxSize:     128,
+			redact:      []string{"password"},
+			input:       `{"user":"a","auth":[{"Password":"hunter2"}]}`,
+			want:        `"{\"auth\":[{\"Password\":\"REDACTED\"}],\"user\":\"a\"}"`,
+		},
+		{
+			description: "redacted before truncation",
+			maxSize:     16,
+			redact:      []string{"token"},
+			input:       `{"token":"0123456789abcdef"}`,
+			want:        `"{\"token\":\"REDACT"... (28 bytes, truncated)`,
+		},
+		{
+			description: "not JSON",
+			maxSize:     64,
+			redact:      []string{"password"},
+			input:       `password=hunter2`,
+			want:        `"password=hunter2"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			l := newPayloadLogger(test.maxSize, test.redact)
+			if got := l.payload([]byte(test.input)); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPayloadLoggerMetadata(t *testing.T) {
+	l := newPayloadLogger(defaultPayloadLogMaxSize, []string{"Token"})
+	got := l.metadata(map[string]string{"token": "abc", "request_id": "1"})
+	want := map[string]string{"token": redacted, "request_id": "1"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// payloadTransformWildcard selects the payload transforms of the topics that
+// no other filter matches.
+const payloadTransformWildcard = "*"
+
+// A payloadTransformFunc normalizes the raw payload of a message received on a
+// topic, before it is decoded, returning the payload to decode instead.
+// Returning an error rejects the payload as unparseable.
+type payloadTransformFunc func(payload []byte) ([]byte, error)
+
+// payloadTransforms are the transforms that may be selected by name to run on
+// the payloads received on a topic. A custom transform is registered by
+// adding it to the map under the name it is selected by.
+var payloadTransforms = map[string]payloadTransformFunc{
+	"gunzip":    gunzipPayload,
+	"base64":    base64Payload,
+	"strip-bom": stripBOMPayload,
+}
+
+// A payloadChain is an ordered sequence of named payload transforms.
+type payloadChain struct {
+	names []string
+	funcs []payloadTransformFunc
+}
+
+// apply runs each transform in the order it was added, passing the output of
+// one transform as the input to the next, and stops at the first transform to
+// return an error.
+func (c *payloadChain) apply(payload []byte) ([]byte, error) {
+	for i, f := range c.funcs {
+		var err error
+		payload, err = f(payload)
+		if err != nil {
+			return payload, fmt.Errorf("payload transform '%v' rejected payload: %w", c.names[i], err)
+		}
+	}
+	return payload, nil
+}
+
+// A payloadTransformer maps MQTT topic filters to the chains of payload
+// transforms run on the payloads received on the topics they match. The
+// filters are tried in the order they were first given, and the filter "*"
+// applies to topics no other filter matches. Selecting transforms by the topic
+// a payload arrived on, rather than by its destination, lets the topics of a
+// wildcard subscription be normalized differently.
+type payloadTransformer struct {
+	filters []string
+	chains  map[string]*payloadChain
+}
+
+// parsePayloadTransforms parses values of the form TOPIC=TRANSFORM into a
+// payloadTransformer, looking each transform up in available. TOPIC is an MQTT
+// topic filter, and may contain the wildcards "+" and "#". The transforms
+// given for the same filter run in the order given.
+func parsePayloadTransforms(values []string, available map[string]payloadTransformFunc) (payloadTransformer, error) {
+	transforms := payloadTransformer{chains: make(map[string]*payloadChain)}
+	for _, value := range values {
+		filter, name := splitPair(value, "=")
+		if filter == "" || name == "" {
+			return payloadTransformer{}, fmt.Errorf("invalid payload transform: %v", value)
+		}
+		f, ok := available[name]
+		if !ok {
+			known := make([]string, 0, len(available))
+			for k := range available {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return payloadTransformer{}, fmt.Errorf("unknown payload transform '%v' (must be one of %v)", name, known)
+		}
+		chain, prs := transforms.chains[filter]
+		if !prs {
+			chain = &payloadChain{}
+			transforms.chains[filter] = chain
+			if filter != payloadTransformWildcard {
+				transforms.filters = append(transforms.filters, filter)
+			}
+		}
+		chain.names = append(chain.names, name)
+		chain.funcs = append(chain.funcs, f)
+	}
+	return transforms, nil
+}
+
+// apply runs the chain of payload transforms selected by topic on payload.
+// Payloads received on a topic without transforms are returned unchanged.
+func (t payloadTransformer) apply(payload []byte, topic string) ([]byte, error) {
+	chain, prs := t.chains[topic]
+	for _, filter := range t.filters {
+		if prs {
+			break
+		}
+		if topicMatches(filter, topic) {
+			chain, prs = t.chains[filter]
+		}
+	}
+	if !prs {
+		chain, prs = t.chains[payloadTransformWildcard]
+	}
+	if !prs {
+		return payload, nil
+	}
+	return chain.apply(payload)
+}
+
+// topicMatches returns true if the MQTT topic filter matches topic: "+"
+// matches a single level of the topic and a trailing "#" any number of them.
+func topicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	l := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" && i == len(f)-1 {
+			return true
+		}
+		if i >= len(l) || (level != "+" && level != l[i]) {
+			return false
+		}
+	}
+	return len(f) == len(l)
+}
+
+// gunzipPayload decompresses a gzip-compressed payload. Payloads that are not
+// gzip-compressed are returned unchanged.
+func gunzipPayload(payload []byte) ([]byte, error) {
+	if !bytes.HasPrefix(payload, []byte{0x1f, 0x8b}) {
+		return payload, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return payload, fmt.Errorf("cannot decompress payload: %w", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return payload, fmt.Errorf("cannot decompress payload: %w", err)
+	}
+	return data, nil
+}
+
+// base64Payload decodes a payload encoded with standard base64, ignoring
+// surrounding whitespace.
+func base64Payload(payload []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(payload)))
+	if err != nil {
+		return payload, fmt.Errorf("cannot decode payload: %w", err)
+	}
+	return data, nil
+}
+
+// stripBOMPayload removes a UTF-8 byte order mark from the start of a
+// payload, which the JSON decoder rejects.
+func stripBOMPayload(payload []byte) ([]byte, error) {
+	return bytes.TrimPrefix(payload, []byte("\xef\xbb\xbf")), nil
+}
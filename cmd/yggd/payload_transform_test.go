@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+)
+
+func TestPayloadTransformer(t *testing.T) {
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write([]byte(`{"message_id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	transforms, err := parsePayloadTransforms([]string{
+		"yggdrasil/c/telemetry/in=base64",
+		"yggdrasil/c/telemetry/in=gunzip",
+		"yggdrasil/+/sensors/legacy/in=strip-bom",
+		"yggdrasil/+/sensors/#=base64",
+		"*=gunzip",
+	}, payloadTransforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		topic       string
+		input       []byte
+		want        string
+		wantError   bool
+	}{
+		{
+			description: "chain",
+			topic:       "yggdrasil/c/telemetry/in",
+			input:       []byte(base64.StdEncoding.EncodeToString(compressed.Bytes()) + "\n"),
+			want:        `{"message_id":"1"}`,
+		},
+		{
+			description: "rejected",
+			topic:       "yggdrasil/c/telemetry/in",
+			input:       []byte(`{"message_id":"1"}`),
+			wantError:   true,
+		},
+		{
+			description: "byte order mark",
+			topic:       "yggdrasil/c/sensors/legacy/in",
+			input:       []byte("\xef\xbb\xbf{}"),
+			want:        `{}`,
+		},
+		{
+			description: "other topic of the wildcard subscription",
+			topic:       "yggdrasil/c/sensors/current/in",
+			input:       []byte(base64.StdEncoding.EncodeToString([]byte(`{}`))),
+			want:        `{}`,
+		},
+		{
+			description: "wildcard",
+			topic:       "yggdrasil/c/data/in",
+			input:       compressed.Bytes(),
+			want:        `{"message_id":"1"}`,
+		},
+		{
+			description: "wildcard uncompressed",
+			topic:       "yggdrasil/c/control/in",
+			input:       []byte(`{}`),
+			want:        `{}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := transforms.apply(test.input, test.topic)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("%q != %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParsePayloadTransforms(t *testing.T) {
+	tests := []struct {
+		input     []string
+		wantError bool
+	}{
+		{input: []string{"data=gunzip"}},
+		{input: []string{"data"}, wantError: true},
+		{input: []string{"=gunzip"}, wantError: true},
+		{input: []string{"data=unknown"}, wantError: true},
+	}
+
+	for _, test := range tests {
+		_, err := parsePayloadTransforms(test.input, payloadTransforms)
+		if (err != nil) != test.wantError {
+			t.Errorf("%v: unexpected error %v", test.input, err)
+		}
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "a/b/c", topic: "a/b/c", want: true},
+		{filter: "a/b/c", topic: "a/b/d"},
+		{filter: "a/+/c", topic: "a/b/c", want: true},
+		{filter: "a/+/c", topic: "a/b/c/d"},
+		{filter: "a/#", topic: "a/b/c", want: true},
+		{filter: "a/#", topic: "a", want: true},
+		{filter: "a/b", topic: "a"},
+	}
+
+	for _, test := range tests {
+		if got := topicMatches(test.filter, test.topic); got != test.want {
+			t.Errorf("%v matches %v: %v != %v", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestMessageRouterPayloadTransforms(t *testing.T) {
+	transforms, err := parsePayloadTransforms([]string{"yggdrasil/c/data/in=strip-bom"}, payloadTransforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &recordingProcessor{}
+	var unparseable []string
+	unparseableHandler := func(payload []byte, dest string, err error) {
+		unparseable = append(unparseable, dest)
+	}
+
+	r := messageRouter{p: p, transforms: transforms, unparseable: unparseableHandler, topic: "yggdrasil/c/data/in"}
+	r.Route([]byte("\xef\xbb\xbf"+`{"type":"data","message_id":"1234","directive":"echo"}`), "data")
+	r = messageRouter{p: p, transforms: transforms, unparseable: unparseableHandler, topic: "yggdrasil/c/control/in"}
+	r.Route([]byte("\xef\xbb\xbf"+`{"type":"command","message_id":"5678"}`), "control")
+
+	if len(p.data) != 1 || p.data[0].MessageID != "1234" {
+		t.Errorf("unexpected data messages: %+v", p.data)
+	}
+	if len(unparseable) != 1 || unparseable[0] != "control" {
+		t.Errorf("unexpected unparseable payloads: %v", unparseable)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// The modes of verification of the signatures of data messages received.
+const (
+	// payloadVerificationOff dispatches messages without verifying them.
+	payloadVerificationOff = "off"
+
+	// payloadVerificationWarn logs a warning for a message that fails
+	// verification, and dispatches it anyway.
+	payloadVerificationWarn = "warn"
+
+	// payloadVerificationStrict drops a message that fails verification.
+	payloadVerificationStrict = "strict"
+)
+
+// payloadSigningInputVersion is the first field of the signing input of data
+// messages received, so that the signature of a result cannot be passed off
+// as that of a message to dispatch. The signing input is bound to the client
+// ID of the host and the topic the message is received on.
+const payloadSigningInputVersion = "yggdrasil-payload-signature-v2"
+
+// defaultPayloadMaxSkew is how far the sent time of a data message received
+// may be from the current time, if no skew is configured.
+const defaultPayloadMaxSkew = 5 * time.Minute
+
+// A payloadVerifier verifies the signatures of data messages received against
+// a keyring of public keys, identified by their SHA-256 fingerprints. A
+// signature is bound to the client ID the message was sent to and the topic
+// it was received on, so that a signed message captured on its way to one host
+// cannot be passed to another, and a message sent more than maxSkew before or
+// after the current time is rejected, so that it cannot be passed again later.
+type payloadVerifier struct {
+	strict   bool
+	keys     map[string]crypto.PublicKey
+	maxSkew  time.Duration
+	now      func() time.Time
+	clientID func() string
+}
+
+// newPayloadVerifier creates a payloadVerifier in mode with the public keys in
+// keyFiles, rejecting messages sent more than maxSkew from the current time
+// (none if maxSkew is 0). It returns nil if mode is payloadVerificationOff.
+func newPayloadVerifier(mode string, keyFiles []string, maxSkew time.Duration) (*payloadVerifier, error) {
+	switch mode {
+	case payloadVerificationOff:
+		return nil, nil
+	case payloadVerificationWarn, payloadVerificationStrict:
+	default:
+		return nil, fmt.Errorf("unsupported payload verification mode: %v", mode)
+	}
+	if len(keyFiles) == 0 {
+		return nil, fmt.Errorf("no verification keys: set 'payload-verify-key'")
+	}
+
+	v := &payloadVerifier{
+		strict:   mode == payloadVerificationStrict,
+		keys:     make(map[string]crypto.PublicKey, len(keyFiles)),
+		maxSkew:  maxSkew,
+		now:      time.Now,
+		clientID: func() string { return ClientID },
+	}
+	for _, file := range keyFiles {
+		key, err := loadVerifyKey(file)
+		if err != nil {
+			return nil, err
+		}
+		id, err := signingKeyID(key)
+		if err != nil {
+			return nil, err
+		}
+		v.keys[id] = key
+	}
+	return v, nil
+}
+
+// verify returns an error if msg is not signed by one of the keys of the
+// keyring, the key its KeyID names or any of them if it names none, for the
+// client ID and data topic of the host, or if it was sent outside the skew.
+func (v *payloadVerifier) verify(msg yggdrasil.Data) error {
+	if msg.Signature == "" {
+		return fmt.Errorf("message is not signed")
+	}
+	if v.maxSkew > 0 {
+		skew := v.now().Sub(msg.Sent)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > v.maxSkew {
+			return fmt.Errorf("message sent at %v, more than %v from now", msg.Sent.Format(time.RFC3339), v.maxSkew)
+		}
+	}
+	signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("cannot decode signature: %w", err)
+	}
+
+	keys := v.keys
+	if msg.KeyID != "" {
+		key, ok := v.keys[msg.KeyID]
+		if !ok {
+			return fmt.Errorf("unknown key ID %v", msg.KeyID)
+		}
+		keys = map[string]crypto.PublicKey{msg.KeyID: key}
+	}
+
+	unsigned := msg
+	unsigned.Signature, unsigned.KeyID = "", ""
+	clientID := v.clientID()
+	topic := transport.Topic(topicPrefix.get(), clientID, "data", "in")
+	input := signingInput(payloadSigningInputVersion, unsigned, clientID, topic)
+	for _, key := range keys {
+		if verifySignature(key, input, signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid signature")
+}
+
+// check verifies msg, returning an error if it fails verification in strict
+// mode and must not be dispatched. In warn mode, a failure is logged. It does
+// nothing if v is nil.
+func (v *payloadVerifier) check(msg *yggdrasil.Data) error {
+	if v == nil {
+		return nil
+	}
+
+	err := v.verify(*msg)
+	if err == nil {
+		return nil
+	}
+	metrics.add("payload_verification_failures_total", 1)
+	if !v.strict {
+		log.Warnf("dispatching message %v that failed verification: %v", msg.MessageID, err)
+		return nil
+	}
+	return fmt.Errorf("cannot verify message: %w", err)
+}
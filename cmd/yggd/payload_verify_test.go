@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+func TestPayloadVerifier(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, err := signingKeyID(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "payload-signing.pub")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 3, 4, 10, 0, 0, 0, time.UTC)
+	topic := func(clientID string) string {
+		return transport.Topic(topicPrefix.get(), clientID, "data", "in")
+	}
+
+	// sign returns msg signed for version and bound, identified by id.
+	sign := func(msg yggdrasil.Data, version string, id string, bound ...string) *yggdrasil.Data {
+		msg.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, signingInput(version, msg, bound...)))
+		msg.KeyID = id
+		return &msg
+	}
+	msg := yggdrasil.Data{Type: yggdrasil.MessageTypeData, MessageID: "1234", Sent: now.Add(-time.Minute), Directive: "remediate", Content: json.RawMessage(`{"playbook":"fix.yml"}`)}
+	tampered := sign(msg, payloadSigningInputVersion, keyID, "host-a", topic("host-a"))
+	tampered.Content = json.RawMessage(`{"playbook":"rm.yml"}`)
+	stale := msg
+	stale.Sent = now.Add(-time.Hour)
+
+	tests := []struct {
+		description string
+		msg         *yggdrasil.Data
+		wantError   bool
+	}{
+		{
+			description: "signed",
+			msg:         sign(msg, payloadSigningInputVersion, keyID, "host-a", topic("host-a")),
+		},
+		{
+			description: "signed without key ID",
+			msg:         sign(msg, payloadSigningInputVersion, "", "host-a", topic("host-a")),
+		},
+		{
+			description: "signed for another client",
+			msg:         sign(msg, payloadSigningInputVersion, keyID, "host-b", topic("host-b")),
+			wantError:   true,
+		},
+		{
+			description: "signed without client",
+			msg:         sign(msg, payloadSigningInputVersion, keyID),
+			wantError:   true,
+		},
+		{
+			description: "sent outside skew",
+			msg:         sign(stale, payloadSigningInputVersion, keyID, "host-a", topic("host-a")),
+			wantError:   true,
+		},
+		{
+			description: "unsigned",
+			msg:         &msg,
+			wantError:   true,
+		},
+		{
+			description: "unknown key ID",
+			msg:         sign(msg, payloadSigningInputVersion, "sha256:0000", "host-a", topic("host-a")),
+			wantError:   true,
+		},
+		{
+			description: "tampered",
+			msg:         tampered,
+			wantError:   true,
+		},
+		{
+			description: "result signature",
+			msg:         sign(msg, signingInputVersion, keyID),
+			wantError:   true,
+		},
+	}
+
+	strict, err := newPayloadVerifier(payloadVerificationStrict, []string{keyFile}, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warn, err := newPayloadVerifier(payloadVerificationWarn, []string{keyFile}, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []*payloadVerifier{strict, warn} {
+		v.now = func() time.Time { return now }
+		v.clientID = func() string { return "host-a" }
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := strict.check(test.msg)
+			if test.wantError && err == nil {
+				t.Error("expected error")
+			}
+			if !test.wantError && err != nil {
+				t.Error(err)
+			}
+			if err := warn.check(test.msg); err != nil {
+				t.Errorf("warn mode: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewPayloadVerifier(t *testing.T) {
+	if v, err := newPayloadVerifier(payloadVerificationOff, nil, 0); v != nil || err != nil {
+		t.Errorf("off: %v, %v", v, err)
+	}
+	if _, err := newPayloadVerifier(payloadVerificationStrict, nil, 0); err == nil {
+		t.Error("expected error without keys")
+	}
+	if _, err := newPayloadVerifier("lenient", []string{"key.pub"}, 0); err == nil {
+		t.Error("expected error for an unsupported mode")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// The strategies for selecting which of the workers registered for a handler
+// a message is dispatched to.
+const (
+	// selectRoundRobin selects each worker in turn.
+	selectRoundRobin = "round-robin"
+
+	// selectLeastBusy selects the worker with the fewest messages
+	// outstanding.
+	selectLeastBusy = "least-busy"
+
+	// selectRandom selects a worker at random.
+	selectRandom = "random"
+
+	// selectSticky selects the same worker for every message with the same
+	// ordering key, and selects each worker in turn for messages without one.
+	selectSticky = "sticky"
+)
+
+// orderingKeyMetadata is the metadata key of a data message's ordering key.
+const orderingKeyMetadata = "ordering_key"
+
+// parseSelectionStrategies parses values of the form "HANDLER=STRATEGY" into
+// a map of handlers to worker selection strategies.
+func parseSelectionStrategies(values []string) (map[string]string, error) {
+	strategies := make(map[string]string, len(values))
+	for _, value := range values {
+		fields := strings.SplitN(value, "=", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid worker selection: %v", value)
+		}
+		switch fields[1] {
+		case selectRoundRobin, selectLeastBusy, selectRandom, selectSticky:
+		default:
+			return nil, fmt.Errorf("unsupported worker selection strategy: %v", fields[1])
+		}
+		strategies[fields[0]] = fields[1]
+	}
+	return strategies, nil
+}
+
+// selectWorker returns the worker data is dispatched to: the worker
+// registered for its directive or, if more workers have joined the handler's
+// pool, one of the pool's workers whose process is running, chosen using the
+// handler's selection strategy. A retiring worker is not selected.
+func (d *dispatcher) selectWorker(data yggdrasil.Data) (worker, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	primary, prs := d.workers[data.Directive]
+	if !prs || len(d.pools[data.Directive]) == 0 {
+		if _, retiring := d.retiring[primary.pid]; prs && retiring {
+			return worker{}, false
+		}
+		return primary, prs
+	}
+
+	var available, candidates []worker
+	for _, w := range append([]worker{primary}, d.pools[data.Directive]...) {
+		if _, retiring := d.retiring[w.pid]; retiring {
+			continue
+		}
+		available = append(available, w)
+		if isExternalWorker(w.pid) || d.processRunning(w.pid) {
+			candidates = append(candidates, w)
+		}
+	}
+	if len(available) == 0 {
+		return worker{}, false
+	}
+	if len(candidates) == 0 {
+		return available[0], true
+	}
+
+	switch d.strategies[data.Directive] {
+	case selectLeastBusy:
+		selected := candidates[0]
+		for _, w := range candidates[1:] {
+			if len(d.outstanding[w.pid]) < len(d.outstanding[selected.pid]) {
+				selected = w
+			}
+		}
+		return selected, true
+	case selectRandom:
+		return candidates[rand.Intn(len(candidates))], true
+	case selectSticky:
+		if key := data.Metadata[orderingKeyMetadata]; key != "" {
+			h := fnv.New32a()
+			h.Write([]byte(key))
+			return candidates[int(h.Sum32()%uint32(len(candidates)))], true
+		}
+	}
+
+	i := d.next[data.Directive] % len(candidates)
+	d.next[data.Directive] = i + 1
+	return candidates[i], true
+}
+
+// poolMember returns the index of the worker process pid in the pool of
+// handler, or -1 if it is not in the pool. The caller must hold the lock.
+func (d *dispatcher) poolMember(handler string, pid int) int {
+	for i, w := range d.pools[handler] {
+		if w.pid == pid {
+			return i
+		}
+	}
+	return -1
+}
+
+// workerByPID returns the worker process pid, registered for any handler,
+// either as its primary worker or in its pool. The caller must hold the lock.
+func (d *dispatcher) workerByPID(pid int) (worker, bool) {
+	handler, prs := d.pidHandlers[pid]
+	if !prs {
+		return worker{}, false
+	}
+	if i := d.poolMember(handler, pid); i >= 0 {
+		return d.pools[handler][i], true
+	}
+	w, prs := d.workers[handler]
+	return w, prs && w.pid == pid
+}
+
+// removeWorker removes the worker process pid registered for handler. If it
+// was the handler's primary worker, the first worker of the pool takes its
+// place. The caller must hold the lock.
+func (d *dispatcher) removeWorker(handler string, pid int) {
+	if i := d.poolMember(handler, pid); i >= 0 {
+		d.pools[handler] = append(d.pools[handler][:i], d.pools[handler][i+1:]...)
+		return
+	}
+	// The handler may have been handed over to a newer worker process.
+	if w, prs := d.workers[handler]; !prs || w.pid != pid {
+		return
+	}
+	delete(d.workers, handler)
+	if pool := d.pools[handler]; len(pool) > 0 {
+		d.workers[handler] = pool[0]
+		d.pools[handler] = pool[1:]
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+func TestParseSelectionStrategies(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		want        map[string]string
+		wantError   bool
+	}{
+		{
+			description: "empty",
+			want:        map[string]string{},
+		},
+		{
+			description: "valid",
+			input:       []string{"echo=least-busy", "sleep=sticky"},
+			want:        map[string]string{"echo": selectLeastBusy, "sleep": selectSticky},
+		},
+		{
+			description: "missing strategy",
+			input:       []string{"echo"},
+			wantError:   true,
+		},
+		{
+			description: "unsupported strategy",
+			input:       []string{"echo=fastest"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseSelectionStrategies(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectWorker(t *testing.T) {
+	tests := []struct {
+		description string
+		strategy    string
+		outstanding map[int]map[string]bool
+		stopped     map[int]bool
+		input       []yggdrasil.Data
+		want        []int
+	}{
+		{
+			description: "round-robin",
+			strategy:    selectRoundRobin,
+			input:       []yggdrasil.Data{{Directive: "echo"}, {Directive: "echo"}, {Directive: "echo"}, {Directive: "echo"}},
+			want:        []int{100, 101, 102, 100},
+		},
+		{
+			description: "least-busy",
+			strategy:    selectLeastBusy,
+			outstanding: map[int]map[string]bool{100: {"a": true, "b": true}, 101: {"c": true}},
+			input:       []yggdrasil.Data{{Directive: "echo"}},
+			want:        []int{102},
+		},
+		{
+			description: "sticky",
+			strategy:    selectSticky,
+			input: []yggdrasil.Data{
+				{Directive: "echo", Metadata: map[string]string{orderingKeyMetadata: "k"}},
+				{Directive: "echo", Metadata: map[string]string{orderingKeyMetadata: "k"}},
+				{Directive: "echo", Metadata: map[string]string{orderingKeyMetadata: "k"}},
+			},
+			want: []int{100, 100, 100},
+		},
+		{
+			description: "sticky without key",
+			strategy:    selectSticky,
+			input:       []yggdrasil.Data{{Directive: "echo"}, {Directive: "echo"}},
+			want:        []int{100, 101},
+		},
+		{
+			description: "stopped process excluded",
+			strategy:    selectRoundRobin,
+			stopped:     map[int]bool{101: true},
+			input:       []yggdrasil.Data{{Directive: "echo"}, {Directive: "echo"}, {Directive: "echo"}},
+			want:        []int{100, 102, 100},
+		},
+		{
+			description: "all processes stopped",
+			strategy:    selectLeastBusy,
+			stopped:     map[int]bool{100: true, 101: true, 102: true},
+			input:       []yggdrasil.Data{{Directive: "echo"}},
+			want:        []int{100},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.strategies["echo"] = test.strategy
+			d.workers["echo"] = worker{pid: 100, handler: "echo"}
+			d.pools["echo"] = []worker{{pid: 101, handler: "echo"}, {pid: 102, handler: "echo"}}
+			if test.outstanding != nil {
+				d.outstanding = test.outstanding
+			}
+			d.processRunning = func(pid int) bool { return !test.stopped[pid] }
+
+			var got []int
+			for _, data := range test.input {
+				w, prs := d.selectWorker(data)
+				if !prs {
+					t.Fatalf("no worker selected for %v", data.Directive)
+				}
+				got = append(got, w.pid)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRegisterPool(t *testing.T) {
+	d := newDispatcher(nil)
+	d.strategies["echo"] = selectRoundRobin
+	// Joining a pool takes precedence over handing the handler over.
+	d.handoverTimeout = time.Minute
+	d.upgraded = func(old int, pid int) bool { return true }
+	go func() {
+		for range d.dispatchers {
+		}
+	}()
+
+	for _, pid := range []int64{100, 101} {
+		r, err := d.Register(context.Background(), &pb.RegistrationRequest{Handler: "echo", Pid: pid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.GetRegistered() {
+			t.Fatalf("worker %v not registered", pid)
+		}
+	}
+	if d.workers["echo"].pid != 100 || len(d.pools["echo"]) != 1 || d.pools["echo"][0].pid != 101 {
+		t.Fatalf("unexpected workers: %+v, pool: %+v", d.workers, d.pools)
+	}
+
+	d.Lock()
+	d.removeWorker("echo", 100)
+	d.Unlock()
+	if d.workers["echo"].pid != 101 || len(d.pools["echo"]) != 0 {
+		t.Errorf("pool worker not promoted: %+v, pool: %+v", d.workers, d.pools)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// presence describes the messages published to announce that the client has
+// come online or is going offline on purpose. Unintentional disconnects are
+// announced by the broker publishing the transport's will message instead.
+type presence struct {
+	dest    string
+	online  []byte
+	offline []byte
+	retain  bool
+}
+
+// publishPresence publishes payload to the presence destination, waiting for
+// the transport to acknowledge it.
+func (c *Client) publishPresence(payload []byte) error {
+	if c.presence == nil {
+		return nil
+	}
+
+	if t, ok := c.t.(transport.AcknowledgingTransporter); ok {
+		if err := t.SendDataWithOptions(payload, c.presence.dest, c.acknowledgedOptions(c.presence.retain)); err != nil {
+			return fmt.Errorf("cannot publish presence: %w", err)
+		}
+	} else if err := c.t.SendData(payload, c.presence.dest); err != nil {
+		return fmt.Errorf("cannot publish presence: %w", err)
+	}
+	log.Debugf("published presence: %v", string(payload))
+
+	return nil
+}
+
+// PublishOnline publishes the online presence message.
+func (c *Client) PublishOnline() error {
+	if c.presence == nil {
+		return nil
+	}
+	return c.publishPresence(c.presence.online)
+}
+
+// PublishOffline publishes the offline presence message. It is called during
+// a clean shutdown, before the transport disconnects.
+func (c *Client) PublishOffline() error {
+	if c.presence == nil {
+		return nil
+	}
+	return c.publishPresence(c.presence.offline)
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestPublishPresence(t *testing.T) {
+	tr := &recordingTransport{}
+	c := Client{
+		t:          tr,
+		publishQoS: 2,
+		presence: &presence{
+			dest:    "presence",
+			online:  []byte("online"),
+			offline: []byte("offline"),
+			retain:  true,
+		},
+	}
+
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PublishOffline(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := tr.sent["presence"]
+	if len(got) != 2 || string(got[0]) != "online" || string(got[1]) != "offline" {
+		t.Errorf("unexpected presence messages: %q", got)
+	}
+	if !tr.options.Retain || !tr.options.WaitForAck || tr.options.QoS != 2 {
+		t.Errorf("expected retained, acknowledged publish at the configured QoS, got %+v", tr.options)
+	}
+}
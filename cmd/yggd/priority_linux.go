@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// setNice sets the nice value of every thread of the process pid to nice.
+// Threads the process creates afterwards inherit it.
+func setNice(pid int, nice int) error {
+	// On Linux, setpriority applies to a single thread, and a freshly
+	// started process may already have created more.
+	tasks, err := ioutil.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "task"))
+	if err != nil {
+		return fmt.Errorf("cannot read threads of process %v: %w", pid, err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil {
+			return fmt.Errorf("cannot set nice value of process %v: %w", pid, err)
+		}
+	}
+	return nil
+}
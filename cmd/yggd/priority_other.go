@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// setNice returns errNiceUnsupported; setting the nice value of workers is
+// only supported on Linux.
+func setNice(pid int, nice int) error {
+	return errNiceUnsupported
+}
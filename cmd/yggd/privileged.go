@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// A privilegedOperation is an operation the daemon performs that may require
+// running as a privileged user. If check fails, disable is called so that the
+// daemon does without the operation.
+type privilegedOperation struct {
+	// name describes the operation, for example "read the BIOS UUID".
+	name string
+
+	// degraded describes the effect of doing without the operation.
+	degraded string
+
+	check   func() error
+	disable func()
+}
+
+// privilegedOperations are the privileged operations checked at startup.
+var privilegedOperations = []privilegedOperation{
+	{
+		name:     "read the BIOS UUID",
+		degraded: "the bios_uuid fact is omitted",
+		check:    func() error { return checkReadable(yggdrasil.BIOSUUIDFile) },
+		disable:  func() { yggdrasil.SkipPrivilegedFacts = true },
+	},
+	{
+		name:     "write worker PID files",
+		degraded: "orphaned workers are not stopped at startup, and removing a worker executable does not stop its process",
+		check:    func() error { return checkWritableDir(workerPIDDir()) },
+		disable:  func() { writePIDFiles = false },
+	},
+	{
+		name:     "set up worker cgroups",
+		degraded: "the cpu-quota and memory-max of workers are ignored",
+		check:    checkCgroupSetup,
+		disable:  func() { workerCgroupsEnabled = false },
+	},
+	{
+		name:     "switch workers to their configured users",
+		degraded: "workers configured with a user or group fail to start",
+		check:    checkSwitchUser,
+		disable:  func() { switchWorkerUsers = false },
+	},
+}
+
+// checkPrivilegedOperations checks that each of ops can be performed, logging
+// a warning for and disabling each that cannot. If skip is true, every
+// operation is disabled without being checked. The names of the disabled
+// operations are returned.
+func checkPrivilegedOperations(ops []privilegedOperation, skip bool) []string {
+	var disabled []string
+	for _, op := range ops {
+		if skip {
+			log.Infof("skipping privileged operation: cannot %v; %v", op.name, op.degraded)
+		} else if err := op.check(); err != nil {
+			log.Warnf("cannot %v as user %v: %v; %v", op.name, os.Geteuid(), err, op.degraded)
+		} else {
+			continue
+		}
+		op.disable()
+		disabled = append(disabled, op.name)
+	}
+	return disabled
+}
+
+// effectiveCapabilities returns the effective capability set in status, the
+// content of a /proc/[pid]/status file.
+func effectiveCapabilities(status []byte) (uint64, error) {
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid effective capabilities: %v", line)
+		}
+		return caps, nil
+	}
+	return 0, fmt.Errorf("cannot find effective capabilities")
+}
+
+// checkReadable returns an error if file exists but cannot be opened for
+// reading.
+func checkReadable(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return f.Close()
+}
+
+// checkWritableDir returns an error if dir cannot be created or a file
+// cannot be created in it.
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	f, err := ioutil.TempFile(dir, ".write-test")
+	if err != nil {
+		return fmt.Errorf("cannot create file: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
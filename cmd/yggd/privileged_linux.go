@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkSwitchUser returns an error if the daemon lacks the CAP_SETUID and
+// CAP_SETGID capabilities it needs to start workers as their configured users,
+// whether directly or through the cgroup trampoline.
+func checkSwitchUser() error {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return fmt.Errorf("cannot read process status: %w", err)
+	}
+	caps, err := effectiveCapabilities(status)
+	if err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		name string
+		bit  uint
+	}{{"CAP_SETUID", unix.CAP_SETUID}, {"CAP_SETGID", unix.CAP_SETGID}} {
+		if caps&(1<<c.bit) == 0 {
+			return fmt.Errorf("missing capability %v", c.name)
+		}
+	}
+	return nil
+}
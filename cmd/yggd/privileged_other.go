@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// checkSwitchUser returns an error if the daemon is not running as root, as it
+// must to start workers as their configured users.
+func checkSwitchUser() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("not running as root")
+	}
+	return nil
+}
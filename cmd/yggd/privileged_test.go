@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckPrivilegedOperations(t *testing.T) {
+	tests := []struct {
+		description string
+		skip        bool
+		want        []string
+	}{
+		{
+			description: "checked",
+			want:        []string{"fail"},
+		},
+		{
+			description: "skipped",
+			skip:        true,
+			want:        []string{"pass", "fail"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			disabled := make(map[string]bool)
+			ops := []privilegedOperation{
+				{
+					name:    "pass",
+					check:   func() error { return nil },
+					disable: func() { disabled["pass"] = true },
+				},
+				{
+					name:    "fail",
+					check:   func() error { return errors.New("permission denied") },
+					disable: func() { disabled["fail"] = true },
+				},
+			}
+
+			got := checkPrivilegedOperations(ops, test.skip)
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+			for _, name := range test.want {
+				if !disabled[name] {
+					t.Errorf("expected %v to be disabled", name)
+				}
+			}
+			if len(disabled) != len(test.want) {
+				t.Errorf("expected %v disabled, got %v", len(test.want), disabled)
+			}
+		})
+	}
+}
+
+func TestEffectiveCapabilities(t *testing.T) {
+	tests := []struct {
+		description string
+		status      string
+		want        uint64
+		wantError   bool
+	}{
+		{
+			description: "root",
+			status:      "Name:\tyggd\nCapInh:\t0000000000000000\nCapEff:\t000001ffffffffff\nCapBnd:\t000001ffffffffff\n",
+			want:        0x000001ffffffffff,
+		},
+		{
+			description: "unprivileged",
+			status:      "Name:\tyggd\nCapEff:\t0000000000000000\n",
+		},
+		{
+			description: "missing",
+			status:      "Name:\tyggd\n",
+			wantError:   true,
+		},
+		{
+			description: "invalid",
+			status:      "CapEff:\tall\n",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := effectiveCapabilities([]byte(test.status))
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %x", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%x != %x", got, test.want)
+			}
+		})
+	}
+}
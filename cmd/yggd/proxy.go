@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// brokerProxy returns the proxy to connect to brokers through: the URL value
+// if it is set, or else the proxy named by the environment, or nil if there
+// is none. If credentialsFile is set, the proxy credentials are read from it,
+// as "username:password" on its first line, replacing any in the URL.
+func brokerProxy(value string, credentialsFile string) (*url.URL, error) {
+	var u *url.URL
+	if value != "" {
+		var err error
+		u, err = url.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse proxy URL: %w", err)
+		}
+	} else {
+		var err error
+		u, err = transport.ProxyFromEnvironment()
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			return nil, nil
+		}
+	}
+
+	if credentialsFile != "" {
+		info, err := os.Stat(credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read proxy credentials: %w", err)
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			log.Warnf("proxy credentials file %v is accessible by other users (mode %v)", credentialsFile, info.Mode().Perm())
+		}
+		data, err := ioutil.ReadFile(credentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read proxy credentials: %w", err)
+		}
+		line := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid proxy credentials in %v: expected username:password", credentialsFile)
+		}
+		u.User = url.UserPassword(fields[0], fields[1])
+	}
+	return u, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// publishQueueSize is the number of results each queue of a publishPool holds
+// before submitting more blocks.
+const publishQueueSize = 64
+
+// The orderings of the results published by a publishPool.
+const (
+	publishOrderingNone      = "none"
+	publishOrderingDirective = "directive"
+)
+
+// A publishPool publishes results with several goroutines at once, so that a
+// slow publish does not hold back the results that follow it. Without
+// ordering, the goroutines drain a single queue and results may be published
+// in any order. With directive ordering, each goroutine drains its own queue
+// and the results of a directive are always queued to the same one, so that
+// they are published in the order they were returned.
+type publishPool struct {
+	queues  []chan yggdrasil.Data
+	ordered bool
+	publish func(msg yggdrasil.Data)
+	wg      sync.WaitGroup
+}
+
+// newPublishPool starts size goroutines that call publish for each result
+// submitted, in the given ordering.
+func newPublishPool(size int, ordering string, publish func(msg yggdrasil.Data)) (*publishPool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid publish pool size: %v", size)
+	}
+	p := &publishPool{publish: publish}
+	switch ordering {
+	case publishOrderingNone:
+		queue := make(chan yggdrasil.Data, publishQueueSize)
+		for i := 0; i < size; i++ {
+			p.start(queue)
+		}
+		p.queues = []chan yggdrasil.Data{queue}
+	case publishOrderingDirective:
+		p.ordered = true
+		for i := 0; i < size; i++ {
+			queue := make(chan yggdrasil.Data, publishQueueSize)
+			p.start(queue)
+			p.queues = append(p.queues, queue)
+		}
+	default:
+		return nil, fmt.Errorf("invalid publish ordering: %v", ordering)
+	}
+	return p, nil
+}
+
+// start starts a goroutine that publishes the results in queue until it is
+// closed.
+func (p *publishPool) start(queue chan yggdrasil.Data) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		for msg := range queue {
+			p.publish(msg)
+		}
+	}()
+}
+
+// submit queues msg to be published, waiting while its queue is full.
+func (p *publishPool) submit(msg yggdrasil.Data) {
+	queue := p.queues[0]
+	if p.ordered {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(msg.Directive))
+		queue = p.queues[h.Sum32()%uint32(len(p.queues))]
+	}
+	queue <- msg
+}
+
+// depth returns the number of results waiting to be published. It returns 0
+// if p is nil.
+func (p *publishPool) depth() int {
+	if p == nil {
+		return 0
+	}
+	var n int
+	for _, queue := range p.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// close stops accepting results and waits for those queued to be published.
+func (p *publishPool) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
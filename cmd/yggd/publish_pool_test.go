@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestPublishPoolOrdering(t *testing.T) {
+	var lock sync.Mutex
+	got := make(map[string][]string)
+	p, err := newPublishPool(3, publishOrderingDirective, func(msg yggdrasil.Data) {
+		lock.Lock()
+		defer lock.Unlock()
+		got[msg.Directive] = append(got[msg.Directive], msg.MessageID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string][]string)
+	for i := 0; i < 30; i++ {
+		directive := fmt.Sprintf("d%v", i%4)
+		id := fmt.Sprint(i)
+		want[directive] = append(want[directive], id)
+		p.submit(yggdrasil.Data{MessageID: id, Directive: directive})
+	}
+	p.close()
+
+	if !cmp.Equal(got, want) {
+		t.Errorf("%v", cmp.Diff(got, want))
+	}
+}
+
+func TestPublishPoolConcurrent(t *testing.T) {
+	blocked := make(chan struct{})
+	published := make(chan string, 1)
+	p, err := newPublishPool(2, publishOrderingNone, func(msg yggdrasil.Data) {
+		if msg.MessageID == "slow" {
+			<-blocked
+			return
+		}
+		published <- msg.MessageID
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.submit(yggdrasil.Data{MessageID: "slow"})
+	p.submit(yggdrasil.Data{MessageID: "fast"})
+	if id := <-published; id != "fast" {
+		t.Errorf("published %v, want fast", id)
+	}
+	close(blocked)
+	p.close()
+	if depth := p.depth(); depth != 0 {
+		t.Errorf("depth %v after close", depth)
+	}
+}
+
+func TestNewPublishPool(t *testing.T) {
+	tests := []struct {
+		size      int
+		ordering  string
+		wantError bool
+	}{
+		{size: 2, ordering: publishOrderingNone},
+		{size: 2, ordering: publishOrderingDirective},
+		{size: 0, ordering: publishOrderingNone, wantError: true},
+		{size: 2, ordering: "topic", wantError: true},
+	}
+
+	for _, test := range tests {
+		p, err := newPublishPool(test.size, test.ordering, func(yggdrasil.Data) {})
+		if (err != nil) != test.wantError {
+			t.Errorf("%v %v: unexpected error %v", test.size, test.ordering, err)
+		}
+		if p != nil {
+			p.close()
+		}
+	}
+}
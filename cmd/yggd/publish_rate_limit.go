@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/pelletier/go-toml"
+)
+
+func init() {
+	metrics.setLabeled("topic_publishes_total", "topic_publishes_dropped_total", "topic_publish_delay_seconds")
+}
+
+// The ways a publish beyond the rate limit of its topic is handled.
+const (
+	// rateLimitQueue queues the publish until the topic has a token, unless
+	// the topic already has max-queued publishes waiting.
+	rateLimitQueue = "queue"
+
+	// rateLimitDrop drops the publish.
+	rateLimitDrop = "drop"
+)
+
+// publishRateLimitWildcard is the topic of a rate limit that applies to each
+// destination without one of its own.
+const publishRateLimitWildcard = "*"
+
+// defaultPublishRateLimitMaxQueued is the number of publishes to a topic that
+// may wait for a token at once under the queue action, if not set.
+const defaultPublishRateLimitMaxQueued = 100
+
+// errPublishRateLimited is returned for a publish dropped for exceeding the
+// rate limit of its topic.
+var errPublishRateLimited = errors.New("publish rate limit exceeded")
+
+// publishRateLimitConfig holds the settings for limiting the rate of the
+// publishes to a topic, read from a "[[publish-rate-limit]]" table in the
+// config file.
+type publishRateLimitConfig struct {
+	// Topic is the destination the limit applies to, "data" or a
+	// dead-letter destination, or "*" for each of them without a limit of
+	// its own. Control messages are not limited.
+	Topic string `toml:"topic"`
+
+	// Rate is the number of publishes per second the topic sustains.
+	Rate float64 `toml:"rate"`
+
+	// Burst is the number of publishes the topic may take at once after
+	// being idle. If 0, it is Rate rounded up.
+	Burst int `toml:"burst"`
+
+	// Action is what is done with a publish beyond the limit: "queue" or
+	// "drop".
+	Action string `toml:"action"`
+
+	// MaxQueued is the number of publishes that may wait at once under the
+	// queue action. Further publishes are dropped.
+	MaxQueued int `toml:"max-queued"`
+}
+
+// readPublishRateLimitConfigs reads from its input, unmarshalling the
+// "publish-rate-limit" tables of the TOML-encoded value and validating their
+// values. Other keys are ignored.
+func readPublishRateLimitConfigs(in io.Reader) ([]publishRateLimitConfig, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read input: %w", err)
+	}
+
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse TOML: %w", err)
+	}
+	if !tree.Has("publish-rate-limit") {
+		return nil, nil
+	}
+	tables, ok := tree.Get("publish-rate-limit").([]*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("publish-rate-limit: not an array of tables")
+	}
+
+	topics := make(map[string]bool)
+	configs := make([]publishRateLimitConfig, 0, len(tables))
+	for i, t := range tables {
+		// An integer rate, as in "rate = 10", does not unmarshal to a
+		// float.
+		if rate, ok := t.Get("rate").(int64); ok {
+			t.Set("rate", float64(rate))
+		}
+		var config publishRateLimitConfig
+		if err := t.Unmarshal(&config); err != nil {
+			return nil, fmt.Errorf("publish-rate-limit %v: %w", i, err)
+		}
+		if config.Topic == "" {
+			return nil, fmt.Errorf("publish-rate-limit %v: missing topic", i)
+		}
+		if topics[config.Topic] {
+			return nil, fmt.Errorf("publish-rate-limit %v: duplicate topic", config.Topic)
+		}
+		if config.Topic == "control" {
+			return nil, fmt.Errorf("publish-rate-limit %v: only data and dead-letter destinations can be limited", config.Topic)
+		}
+		topics[config.Topic] = true
+		if config.Rate <= 0 {
+			return nil, fmt.Errorf("publish-rate-limit %v: invalid rate: %v", config.Topic, config.Rate)
+		}
+		if config.Burst < 0 {
+			return nil, fmt.Errorf("publish-rate-limit %v: invalid burst: %v", config.Topic, config.Burst)
+		}
+		if config.Burst == 0 {
+			config.Burst = int(config.Rate)
+			if float64(config.Burst) < config.Rate {
+				config.Burst++
+			}
+		}
+		switch config.Action {
+		case "":
+			config.Action = rateLimitQueue
+		case rateLimitQueue, rateLimitDrop:
+		default:
+			return nil, fmt.Errorf("publish-rate-limit %v: invalid action: %v", config.Topic, config.Action)
+		}
+		if config.MaxQueued < 0 {
+			return nil, fmt.Errorf("publish-rate-limit %v: invalid max-queued: %v", config.Topic, config.MaxQueued)
+		}
+		if config.MaxQueued == 0 {
+			config.MaxQueued = defaultPublishRateLimitMaxQueued
+		}
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// loadPublishRateLimitConfigs reads the publish rate limit tables from the
+// config file. If file is empty, no limits are returned.
+func loadPublishRateLimitConfigs(file string) ([]publishRateLimitConfig, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := readConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	configs, err := readPublishRateLimitConfigs(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read publish rate limit config from '%v': %w", file, err)
+	}
+	return configs, nil
+}
+
+// A queuedPublish is a publish waiting for a token of its topic, to be sent
+// with send at the time at. delay is how long it waits. done is passed the
+// error of send once it is sent.
+type queuedPublish struct {
+	at    time.Time
+	delay time.Duration
+	send  func() error
+	done  func(error)
+}
+
+// A publishBucket is the token bucket of one topic. tokens may be negative:
+// each publish waiting for a token has taken one in advance, so that the
+// publishes waiting are let through in the order they arrived. queued counts
+// the publishes waiting, which pending holds until a goroutine of the topic
+// sends them.
+type publishBucket struct {
+	publishRateLimitConfig
+
+	tokens  float64
+	last    time.Time
+	queued  int
+	pending chan queuedPublish
+}
+
+// publishRateLimiter limits the rate of the publishes to each topic with a
+// token bucket, queueing or dropping the publishes beyond it.
+type publishRateLimiter struct {
+	lock    sync.Mutex
+	configs map[string]publishRateLimitConfig
+	buckets map[string]*publishBucket
+
+	// closed is set, and stop closed, once close is called. drains counts
+	// the goroutines sending the queued publishes.
+	closed bool
+	stop   chan struct{}
+	drains sync.WaitGroup
+
+	// now and after are replaced in tests.
+	now   func() time.Time
+	after func(d time.Duration) <-chan time.Time
+}
+
+func newPublishRateLimiter(configs []publishRateLimitConfig) *publishRateLimiter {
+	l := publishRateLimiter{
+		configs: make(map[string]publishRateLimitConfig, len(configs)),
+		buckets: make(map[string]*publishBucket),
+		stop:    make(chan struct{}),
+		now:     time.Now,
+		after:   time.After,
+	}
+	for _, config := range configs {
+		l.configs[config.Topic] = config
+	}
+	return &l
+}
+
+// publish sends a publish to topic by calling send, at once if it is within
+// the rate limit of topic, returning the error of send. A publish beyond the
+// limit is queued under the queue action, for a goroutine of the topic to
+// send once the topic has a token, and true is returned: done, if set, is
+// passed the error of send once it is sent. A publish dropped under the drop
+// action, or beyond max-queued, is not sent and errPublishRateLimited is
+// returned. send is called at once if l is nil or closed, or topic is not
+// limited.
+func (l *publishRateLimiter) publish(topic string, send func() error, done func(error)) (queued bool, err error) {
+	if l == nil {
+		return false, send()
+	}
+
+	delay, limited, ok := l.reserve(topic, send, done)
+	if !limited {
+		return false, send()
+	}
+	labels := []metricLabel{{name: "topic", value: topic}}
+	if !ok {
+		metrics.addSeries("topic_publishes_dropped_total", labels, 1)
+		return false, fmt.Errorf("cannot publish to %v: %w", topic, errPublishRateLimited)
+	}
+	if delay > 0 {
+		log.Debugf("queueing publish to %v for %v: rate limit exceeded", topic, delay)
+		return true, nil
+	}
+	metrics.addSeries("topic_publishes_total", labels, 1)
+	metrics.observeSeries("topic_publish_delay_seconds", labels, 0)
+	return false, send()
+}
+
+// reserve takes a token from the bucket of topic, returning how long the
+// publish must wait for it, or false if the publish is dropped. A publish that
+// must wait is queued, to be sent with send. limited is false if topic has no
+// rate limit or l is closed.
+func (l *publishRateLimiter) reserve(topic string, send func() error, done func(error)) (delay time.Duration, limited bool, ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return 0, false, false
+	}
+
+	b, prs := l.buckets[topic]
+	if !prs {
+		config, prs := l.configs[topic]
+		if !prs {
+			if config, prs = l.configs[publishRateLimitWildcard]; !prs {
+				return 0, false, false
+			}
+		}
+		b = &publishBucket{publishRateLimitConfig: config, tokens: float64(config.Burst), last: l.now()}
+		if config.Action == rateLimitQueue {
+			b.pending = make(chan queuedPublish, config.MaxQueued)
+			l.drains.Add(1)
+			go l.drain(topic, b)
+		}
+		l.buckets[topic] = b
+	}
+
+	now := l.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.Rate
+	if b.tokens > float64(b.Burst) {
+		b.tokens = float64(b.Burst)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true, true
+	}
+	if b.Action == rateLimitDrop || b.queued >= b.MaxQueued {
+		return 0, true, false
+	}
+	b.tokens--
+	b.queued++
+	delay = time.Duration(-b.tokens / b.Rate * float64(time.Second))
+	// pending holds up to MaxQueued publishes, so this does not block.
+	b.pending <- queuedPublish{at: now.Add(delay), delay: delay, send: send, done: done}
+	return delay, true, true
+}
+
+// drain sends the publishes queued for topic, each once its time comes, in
+// the order they were queued. Once l is closed, the publishes still queued are
+// sent at once, and drain returns.
+func (l *publishRateLimiter) drain(topic string, b *publishBucket) {
+	defer l.drains.Done()
+	labels := []metricLabel{{name: "topic", value: topic}}
+	for p := range b.pending {
+		if wait := p.at.Sub(l.now()); wait > 0 {
+			select {
+			case <-l.after(wait):
+			case <-l.stop:
+			}
+		}
+		l.lock.Lock()
+		b.queued--
+		l.lock.Unlock()
+
+		metrics.addSeries("topic_publishes_total", labels, 1)
+		metrics.observeSeries("topic_publish_delay_seconds", labels, p.delay.Seconds())
+		err := p.send()
+		if p.done != nil {
+			p.done(err)
+		}
+	}
+}
+
+// close stops queueing publishes and sends those already queued at once,
+// returning once they are sent, so that none is lost on shutdown. Publishes
+// after close are sent at once. It does nothing if l is nil.
+func (l *publishRateLimiter) close() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.stop)
+		for _, b := range l.buckets {
+			if b.pending != nil {
+				close(b.pending)
+			}
+		}
+	}
+	l.lock.Unlock()
+	l.drains.Wait()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestReadPublishRateLimitConfigs(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        []publishRateLimitConfig
+		wantError   bool
+	}{
+		{
+			description: "no limits",
+			input:       `server = "tcp://localhost:1883"`,
+		},
+		{
+			description: "limits",
+			input: strings.Join([]string{
+				`[[publish-rate-limit]]`,
+				`topic = "data"`,
+				`rate = 2.5`,
+				`[[publish-rate-limit]]`,
+				`topic = "*"`,
+				`rate = 10`,
+				`burst = 20`,
+				`action = "drop"`,
+			}, "\n"),
+			want: []publishRateLimitConfig{
+				{Topic: "data", Rate: 2.5, Burst: 3, Action: rateLimitQueue, MaxQueued: defaultPublishRateLimitMaxQueued},
+				{Topic: "*", Rate: 10, Burst: 20, Action: rateLimitDrop, MaxQueued: defaultPublishRateLimitMaxQueued},
+			},
+		},
+		{
+			description: "missing rate",
+			input: strings.Join([]string{
+				`[[publish-rate-limit]]`,
+				`topic = "data"`,
+			}, "\n"),
+			wantError: true,
+		},
+		{
+			description: "invalid action",
+			input: strings.Join([]string{
+				`[[publish-rate-limit]]`,
+				`topic = "data"`,
+				`rate = 1`,
+				`action = "block"`,
+			}, "\n"),
+			wantError: true,
+		},
+		{
+			description: "duplicate topic",
+			input: strings.Join([]string{
+				`[[publish-rate-limit]]`,
+				`topic = "data"`,
+				`rate = 1`,
+				`[[publish-rate-limit]]`,
+				`topic = "data"`,
+				`rate = 2`,
+			}, "\n"),
+			wantError: true,
+		},
+		{
+			description: "control topic",
+			input: strings.Join([]string{
+				`[[publish-rate-limit]]`,
+				`topic = "control"`,
+				`rate = 1`,
+			}, "\n"),
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := readPublishRateLimitConfigs(strings.NewReader(test.input))
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPublishRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	slept := make(chan time.Duration, 1)
+	l := newPublishRateLimiter([]publishRateLimitConfig{
+		{Topic: "data", Rate: 2, Burst: 2, Action: rateLimitQueue, MaxQueued: 1},
+		{Topic: "*", Rate: 1, Burst: 1, Action: rateLimitDrop},
+	})
+	l.now = func() time.Time { return now }
+	l.after = func(d time.Duration) <-chan time.Time {
+		slept <- d
+		c := make(chan time.Time, 1)
+		c <- now.Add(d)
+		return c
+	}
+
+	sent := make(chan string, 4)
+	send := func(id string) func() error {
+		return func() error {
+			sent <- id
+			return nil
+		}
+	}
+
+	// The burst is sent at once.
+	for _, id := range []string{"1", "2"} {
+		if _, err := l.publish("data", send(id), nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-sent; got != id {
+			t.Fatalf("%v != %v", got, id)
+		}
+	}
+
+	// The next publish is queued, without waiting, and sent once the topic
+	// has a token.
+	if queued, err := l.publish("data", send("3"), nil); !queued || err != nil {
+		t.Fatalf("expected publish to be queued: %v, %v", queued, err)
+	}
+
+	// A publish beyond max-queued is dropped.
+	if _, err := l.publish("data", send("4"), nil); !errors.Is(err, errPublishRateLimited) {
+		t.Errorf("expected %v, got %v", errPublishRateLimited, err)
+	}
+
+	if got := <-slept; got != 500*time.Millisecond {
+		t.Errorf("expected a delay of 500ms, got %v", got)
+	}
+	if got := <-sent; got != "3" {
+		t.Errorf("%v != %v", got, "3")
+	}
+
+	// Other destinations have a bucket of their own under the wildcard.
+	for _, dest := range []string{"dead-letter", "dead-letter-echo"} {
+		if _, err := l.publish(dest, send(dest), nil); err != nil {
+			t.Fatal(err)
+		}
+		<-sent
+		if _, err := l.publish(dest, send(dest), nil); !errors.Is(err, errPublishRateLimited) {
+			t.Errorf("expected %v, got %v", errPublishRateLimited, err)
+		}
+	}
+
+	// The bucket refills with time.
+	now = now.Add(time.Second)
+	if _, err := l.publish("dead-letter", send("dead-letter"), nil); err != nil {
+		t.Error(err)
+	}
+	<-sent
+
+	var nilLimiter *publishRateLimiter
+	if _, err := nilLimiter.publish("data", send("5"), nil); err != nil {
+		t.Error(err)
+	}
+	if got := <-sent; got != "5" {
+		t.Errorf("%v != %v", got, "5")
+	}
+}
+
+func TestPublishRateLimiterClose(t *testing.T) {
+	l := newPublishRateLimiter([]publishRateLimitConfig{
+		{Topic: "data", Rate: 1, Burst: 1, Action: rateLimitQueue, MaxQueued: 10},
+	})
+	// The queued publish is not due for as long as the test runs.
+	l.after = func(time.Duration) <-chan time.Time { return nil }
+
+	var sent []string
+	send := func(id string) func() error {
+		return func() error {
+			sent = append(sent, id)
+			return nil
+		}
+	}
+
+	if _, err := l.publish("data", send("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	if queued, err := l.publish("data", send("2"), func(err error) { done <- err }); !queued || err != nil {
+		t.Fatalf("expected publish to be queued: %v, %v", queued, err)
+	}
+
+	// Closing sends the queued publish at once.
+	l.close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	default:
+		t.Fatal("queued publish not sent on close")
+	}
+
+	// Publishes after close are sent at once.
+	if queued, err := l.publish("data", send("3"), nil); queued || err != nil {
+		t.Errorf("expected publish to be sent: %v, %v", queued, err)
+	}
+	if want := []string{"1", "2", "3"}; !cmp.Equal(sent, want) {
+		t.Errorf("%v != %v", sent, want)
+	}
+}
+
+func TestPublishQueuedResult(t *testing.T) {
+	l := newPublishRateLimiter([]publishRateLimitConfig{
+		{Topic: "data", Rate: 1, Burst: 1, Action: rateLimitQueue, MaxQueued: 10},
+	})
+	l.after = func(time.Duration) <-chan time.Time { return nil }
+	tr := &recordingTransport{}
+	c := Client{t: tr, rateLimits: l}
+
+	var handled []string
+	c.publishResult(yggdrasil.Data{MessageID: "1"}, func() { handled = append(handled, "1") })
+	c.publishResult(yggdrasil.Data{MessageID: "2"}, func() { handled = append(handled, "2") })
+
+	// A result queued for the rate limit is not handled until it is sent.
+	if want := []string{"1"}; !cmp.Equal(handled, want) {
+		t.Errorf("%v != %v", handled, want)
+	}
+	l.close()
+	if want := []string{"1", "2"}; !cmp.Equal(handled, want) {
+		t.Errorf("%v != %v", handled, want)
+	}
+	if len(tr.sent["data"]) != 2 {
+		t.Errorf("expected 2 results published, got %v", len(tr.sent["data"]))
+	}
+}
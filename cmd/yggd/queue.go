@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// A queuedData is a data message waiting to be dispatched to a worker, along
+// with the time it was queued and the payload labels of its metrics, extracted
+// when it was received. labels is nil if the directive of data is not labeled
+// or, for a message queued again from disk, if they were not kept.
+type queuedData struct {
+	data   yggdrasil.Data
+	queued time.Time
+	labels []metricLabel
+}
+
+// expire returns an error if q has waited longer than the maximum queue age as
+// of now, counting it as expired.
+func (d *dispatcher) expire(q queuedData, now time.Time) error {
+	if d.maxQueueAge <= 0 {
+		return nil
+	}
+	age := now.Sub(q.queued)
+	if age <= d.maxQueueAge {
+		return nil
+	}
+	d.Lock()
+	d.expired++
+	d.Unlock()
+	return fmt.Errorf("message is stale: queued for %v, longer than %v", age.Round(time.Millisecond), d.maxQueueAge)
+}
+
+// queueStatus reports the queue backend, the number of messages waiting to be
+// dispatched, the maximum queue age and the number of messages dropped for
+// exceeding it.
+type queueStatus struct {
+	Backend string `json:"backend"`
+	Depth   int    `json:"depth"`
+	MaxAge  string `json:"max_age"`
+	Expired uint64 `json:"expired"`
+}
+
+// handleQueue is the control handler for the "queue" command.
+func (d *dispatcher) handleQueue(args map[string]string) (interface{}, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	return queueStatus{
+		Backend: d.queueBackend,
+		Depth:   d.queue.Len(),
+		MaxAge:  d.maxQueueAge.String(),
+		Expired: d.expired,
+	}, nil
+}
+
+// queueAction calls the "queue" control command on the running daemon and
+// prints the result.
+func queueAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "queue", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var status queueStatus
+	if err := json.Unmarshal(result, &status); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	fmt.Fprintf(c.App.Writer, "backend: %v\n", status.Backend)
+	fmt.Fprintf(c.App.Writer, "depth: %v\n", status.Depth)
+	fmt.Fprintf(c.App.Writer, "max age: %v\n", status.MaxAge)
+	fmt.Fprintf(c.App.Writer, "expired: %v\n", status.Expired)
+
+	return nil
+}
+
+// StaleHandlerFunc drops or dead-letters data that waited too long to be
+// dispatched, marking it as processed so that it no longer counts as in
+// flight.
+func (c *Client) StaleHandlerFunc(data yggdrasil.Data, reason error) {
+	if c.inFlight != nil {
+		c.inFlight.done(data.MessageID)
+	}
+	c.desiredState.failed(data.MessageID)
+	if !c.deadLetterStale {
+		log.Warnf("dropping message %v: %v", data.MessageID, reason)
+		return
+	}
+	log.Warnf("dead-lettering message %v: %v", data.MessageID, reason)
+	if err := c.SendDeadLetterMessage(&data, reason); err != nil {
+		log.Errorf("failed to send dead-letter message: %v", err)
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal"
+)
+
+// The backends that hold the assignment and outbound queues.
+const (
+	// queueBackendMemory holds the queues in memory. Queued messages are
+	// lost if the daemon stops.
+	queueBackendMemory = "memory"
+
+	// queueBackendDisk also writes each queued message to a file, removed
+	// once the message is acknowledged, so that the messages not yet
+	// acknowledged are queued again when the daemon restarts.
+	queueBackendDisk = "disk"
+)
+
+// queueFileExt is the extension of message files in a disk queue directory.
+const queueFileExt = ".json"
+
+// maxQueueAttempts is the number of times a disk queue dequeues a message
+// without it being acknowledged, across restarts, before it is dropped rather
+// than queued again, so that a message whose processing never ends is not
+// processed again on every restart.
+const maxQueueAttempts = 3
+
+// errQueueClosed is returned by Enqueue once the queue is closed.
+var errQueueClosed = errors.New("queue is closed")
+
+// A messageQueue holds data messages in the order they were enqueued until
+// they are dequeued, and, for a persistent queue, until they are acknowledged.
+type messageQueue interface {
+	// Enqueue appends item to the queue, setting the time it was queued.
+	Enqueue(item queuedData) error
+
+	// Dequeue removes the oldest message from the queue and returns it,
+	// waiting for one to be enqueued if the queue is empty. It returns false
+	// once the queue is closed and empty.
+	Dequeue() (queuedData, bool)
+
+	// Ack records that the processing of the dequeued message id has ended,
+	// so that it is not queued again.
+	Ack(id string) error
+
+	// Len returns the number of messages waiting to be dequeued.
+	Len() int
+
+	// Close stops the queue accepting messages. The messages already
+	// queued can still be dequeued.
+	Close() error
+
+	// memoryUsage returns the estimated memory held by the messages
+	// waiting to be dequeued, in bytes.
+	memoryUsage() int
+
+	// nextShed returns, without removing it, the queued message that is
+	// shed first to reclaim memory. It returns false if the queue is empty.
+	nextShed() (queuedData, bool)
+
+	// shed removes the queued message id, without waiting for it, and
+	// returns it. The message is not queued again. It returns false if the
+	// message is no longer queued.
+	shed(id string) (queuedData, bool)
+}
+
+// A memoryQueue is a messageQueue held in memory. Enqueue waits until the
+// message is dequeued, handing it over to the caller of Dequeue, so that a
+// slow consumer holds back the producer rather than letting messages pile up.
+type memoryQueue struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	items  []queuedData
+	bytes  int
+	closed bool
+
+	// seqs holds the sequence number of each item, and pushed counts the
+	// messages enqueued.
+	seqs   []uint64
+	pushed uint64
+}
+
+func newMemoryQueue() *memoryQueue {
+	var q memoryQueue
+	q.cond = sync.NewCond(&q.lock)
+	return &q
+}
+
+func (q *memoryQueue) Enqueue(item queuedData) error {
+	item.queued = time.Now()
+	return q.push(item, true)
+}
+
+// push appends item to the queue and, if wait is true, waits until it is
+// dequeued.
+func (q *memoryQueue) push(item queuedData, wait bool) error {
+	seq, err := q.add(item)
+	if err != nil || !wait {
+		return err
+	}
+	q.waitDequeued(seq)
+	return nil
+}
+
+// add appends item to the queue and returns its sequence number.
+func (q *memoryQueue) add(item queuedData) (uint64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return 0, errQueueClosed
+	}
+	q.pushed++
+	q.items = append(q.items, item)
+	q.seqs = append(q.seqs, q.pushed)
+	q.bytes += queuedDataSize(item)
+	q.cond.Broadcast()
+	return q.pushed, nil
+}
+
+// waitDequeued waits until the item with the sequence number seq is dequeued
+// or shed, or the queue is closed.
+func (q *memoryQueue) waitDequeued(seq uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for !q.closed {
+		i := sort.Search(len(q.seqs), func(i int) bool { return q.seqs[i] >= seq })
+		if i == len(q.seqs) || q.seqs[i] != seq {
+			return
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *memoryQueue) Dequeue() (queuedData, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for len(q.items) == 0 {
+		if q.closed {
+			return queuedData{}, false
+		}
+		q.cond.Wait()
+	}
+	return q.pop(), true
+}
+
+// pop removes the oldest item from the queue, which must not be empty, and
+// returns it, waking the caller of Enqueue waiting for it.
+func (q *memoryQueue) pop() queuedData {
+	return q.remove(0)
+}
+
+// remove removes the item i from the queue and returns it, waking the caller
+// of Enqueue waiting for it.
+func (q *memoryQueue) remove(i int) queuedData {
+	item := q.items[i]
+	if i == 0 {
+		q.items[0] = queuedData{}
+		q.items, q.seqs = q.items[1:], q.seqs[1:]
+	} else {
+		q.items = append(q.items[:i], q.items[i+1:]...)
+		q.seqs = append(q.seqs[:i], q.seqs[i+1:]...)
+	}
+	q.bytes -= queuedDataSize(item)
+	q.cond.Broadcast()
+	return item
+}
+
+// Ack does nothing: a message is no longer held once it is dequeued.
+func (q *memoryQueue) Ack(id string) error {
+	return nil
+}
+
+func (q *memoryQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.items)
+}
+
+func (q *memoryQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+	return nil
+}
+
+func (q *memoryQueue) memoryUsage() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.bytes
+}
+
+func (q *memoryQueue) nextShed() (queuedData, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	i := nextShed(q.items)
+	if i < 0 {
+		return queuedData{}, false
+	}
+	return q.items[i], true
+}
+
+func (q *memoryQueue) shed(id string) (queuedData, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i, item := range q.items {
+		if item.data.MessageID == id {
+			return q.remove(i), true
+		}
+	}
+	return queuedData{}, false
+}
+
+// queueFile is the on-disk representation of a message in a disk queue.
+// Attempts is the number of times the message was dequeued.
+type queueFile struct {
+	Queued   time.Time      `json:"queued"`
+	Data     yggdrasil.Data `json:"data"`
+	Attempts int            `json:"attempts,omitempty"`
+}
+
+// A diskQueue is a messageQueue that writes each message to a file in its
+// directory, named so that the files sort in the order the messages were
+// enqueued, and removes the file once the message is acknowledged. When the
+// queue is opened, the messages not yet acknowledged are queued again, oldest
+// first, unless they were dequeued maxQueueAttempts times. The messages are
+// also held in memory while they are queued, and, as with a memoryQueue,
+// Enqueue waits until the message is dequeued.
+type diskQueue struct {
+	last int64 // accessed atomically; kept first for alignment
+	dir  string
+	mem  *memoryQueue
+
+	lock sync.Mutex
+	// files maps the ID of each message written to the queue and not yet
+	// acknowledged to the name of its file.
+	files map[string]string
+	// attempts maps the ID of each message in files to the number of times
+	// it was dequeued.
+	attempts map[string]int
+}
+
+// newDiskQueue opens the disk queue in dir, creating dir if needed.
+func newDiskQueue(dir string) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create directory: %w", err)
+	}
+	q := &diskQueue{
+		dir:      dir,
+		mem:      newMemoryQueue(),
+		files:    make(map[string]string),
+		attempts: make(map[string]int),
+	}
+
+	names, err := q.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, name))
+		var f queueFile
+		if err == nil {
+			err = json.Unmarshal(contents, &f)
+		}
+		if err != nil {
+			log.Errorf("cannot read queued message '%v', removing it: %v", name, err)
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, fmt.Errorf("cannot remove file: %w", err)
+			}
+			continue
+		}
+		if _, dup := q.files[f.Data.MessageID]; dup {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if f.Attempts >= maxQueueAttempts {
+			log.Errorf("dropping queued message %v: it was dequeued %v times without its processing ending", f.Data.MessageID, f.Attempts)
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, fmt.Errorf("cannot remove file: %w", err)
+			}
+			continue
+		}
+		q.files[f.Data.MessageID] = name
+		q.attempts[f.Data.MessageID] = f.Attempts
+		_ = q.mem.push(queuedData{data: f.Data, queued: f.Queued}, false)
+	}
+	if len(names) > 0 {
+		last := names[len(names)-1]
+		q.last, _ = strconv.ParseInt(strings.TrimSuffix(last, queueFileExt), 10, 64)
+	}
+	if len(q.files) > 0 {
+		log.Infof("queued %v messages again from %v", len(q.files), dir)
+	}
+	return q, nil
+}
+
+// Enqueue writes the message of item to a file in the queue directory, appends
+// item to the queue and waits until it is dequeued. A message already in the
+// queue, as when the broker delivers again a message that was queued before a
+// restart, is not queued twice. The labels of item are only held in memory.
+func (q *diskQueue) Enqueue(item queuedData) error {
+	data := item.data
+	f := queueFile{Queued: time.Now(), Data: data}
+	contents, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("cannot marshal queue file: %w", err)
+	}
+
+	q.lock.Lock()
+	if _, queued := q.files[data.MessageID]; queued {
+		q.lock.Unlock()
+		log.Debugf("not queueing message %v: it is already queued", data.MessageID)
+		return nil
+	}
+	// File names sort in the order the messages were enqueued.
+	name := fmt.Sprintf("%020d%v", internal.Stamp(&q.last), queueFileExt)
+	if err := q.write(name, contents); err != nil {
+		q.lock.Unlock()
+		return err
+	}
+	q.files[data.MessageID] = name
+	item.queued = f.Queued
+	seq, err := q.mem.add(item)
+	q.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	q.mem.waitDequeued(seq)
+	return nil
+}
+
+// write writes contents to the queue file name, through a temporary file that
+// is synced before it is renamed, so that a message that was enqueued is found
+// in full after a crash.
+func (q *diskQueue) write(name string, contents []byte) error {
+	tmp := filepath.Join(q.dir, "."+name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %w", err)
+	}
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot write to file: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot rename file: %w", err)
+	}
+	return nil
+}
+
+// Dequeue removes the oldest message from the queue and returns it, counting
+// the attempt in its file.
+func (q *diskQueue) Dequeue() (queuedData, bool) {
+	item, ok := q.mem.Dequeue()
+	if !ok {
+		return item, ok
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	id := item.data.MessageID
+	name, prs := q.files[id]
+	if !prs {
+		return item, ok
+	}
+	q.attempts[id]++
+	contents, err := json.Marshal(queueFile{Queued: item.queued, Data: item.data, Attempts: q.attempts[id]})
+	if err == nil {
+		err = q.write(name, contents)
+	}
+	if err != nil {
+		log.Errorf("cannot record attempt of queued message %v: %v", id, err)
+	}
+	return item, ok
+}
+
+// Ack removes the file of the message id. It does nothing if id is not
+// queued.
+func (q *diskQueue) Ack(id string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	name, prs := q.files[id]
+	if !prs {
+		return nil
+	}
+	delete(q.files, id)
+	delete(q.attempts, id)
+	if err := os.Remove(filepath.Join(q.dir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove file: %w", err)
+	}
+	return nil
+}
+
+func (q *diskQueue) Len() int {
+	return q.mem.Len()
+}
+
+func (q *diskQueue) Close() error {
+	return q.mem.Close()
+}
+
+func (q *diskQueue) memoryUsage() int {
+	return q.mem.memoryUsage()
+}
+
+func (q *diskQueue) nextShed() (queuedData, bool) {
+	return q.mem.nextShed()
+}
+
+// shed removes the message id from the queue and its file.
+func (q *diskQueue) shed(id string) (queuedData, bool) {
+	item, ok := q.mem.shed(id)
+	if !ok {
+		return item, ok
+	}
+	if err := q.Ack(item.data.MessageID); err != nil {
+		log.Errorf("cannot remove shed message %v: %v", item.data.MessageID, err)
+	}
+	return item, ok
+}
+
+// list returns the names of the message files in the queue directory, oldest
+// first, removing the temporary files of incomplete writes.
+func (q *diskQueue) list() ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read contents of directory: %w", err)
+	}
+
+	names := make([]string, 0, len(fileInfos))
+	for _, info := range fileInfos {
+		if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), queueFileExt) {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			// A temporary file left by a write that did not complete.
+			os.Remove(filepath.Join(q.dir, info.Name()))
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
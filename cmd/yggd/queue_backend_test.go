@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"google.golang.org/grpc"
+)
+
+// A bufferedQueue is a messageQueue that never waits, for tests that queue
+// messages without dequeueing them.
+type bufferedQueue struct {
+	items []queuedData
+}
+
+func (q *bufferedQueue) Enqueue(item queuedData) error {
+	item.queued = time.Now()
+	q.items = append(q.items, item)
+	return nil
+}
+
+func (q *bufferedQueue) Dequeue() (queuedData, bool) {
+	if len(q.items) == 0 {
+		return queuedData{}, false
+	}
+	item := q.items[0]
+	q.items = q.items[1:]
+	return item, true
+}
+
+func (q *bufferedQueue) Ack(id string) error { return nil }
+
+func (q *bufferedQueue) Len() int { return len(q.items) }
+
+func (q *bufferedQueue) Close() error { return nil }
+
+func (q *bufferedQueue) memoryUsage() int {
+	var n int
+	for _, item := range q.items {
+		n += queuedDataSize(item)
+	}
+	return n
+}
+
+func (q *bufferedQueue) nextShed() (queuedData, bool) {
+	i := nextShed(q.items)
+	if i < 0 {
+		return queuedData{}, false
+	}
+	return q.items[i], true
+}
+
+func (q *bufferedQueue) shed(id string) (queuedData, bool) {
+	for i, item := range q.items {
+		if item.data.MessageID == id {
+			q.items = append(q.items[:i:i], q.items[i+1:]...)
+			return item, true
+		}
+	}
+	return queuedData{}, false
+}
+
+func TestMemoryQueue(t *testing.T) {
+	q := newMemoryQueue()
+
+	enqueued := make(chan string, 2)
+	for _, id := range []string{"1", "2"} {
+		id := id
+		go func() {
+			if err := q.Enqueue(queuedData{data: yggdrasil.Data{MessageID: id}}); err != nil {
+				t.Error(err)
+			}
+			enqueued <- id
+		}()
+		// Wait for the message to be queued, so that the messages are
+		// queued in order.
+		for q.Len() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case id := <-enqueued:
+			t.Fatalf("message %v was enqueued before it was dequeued", id)
+		default:
+		}
+
+		item, ok := q.Dequeue()
+		if !ok || item.data.MessageID != id {
+			t.Fatalf("dequeued %v, %v; want %v", item.data.MessageID, ok, id)
+		}
+		select {
+		case <-enqueued:
+		case <-time.After(time.Second):
+			t.Fatalf("message %v was not handed over", id)
+		}
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.Dequeue(); ok {
+		t.Error("dequeued a message from a closed, empty queue")
+	}
+	if err := q.Enqueue(queuedData{data: yggdrasil.Data{MessageID: "3"}}); err != errQueueClosed {
+		t.Errorf("expected %v, got %v", errQueueClosed, err)
+	}
+}
+
+func TestMemoryQueueShed(t *testing.T) {
+	q := newMemoryQueue()
+	item := func(id string, priority string) queuedData {
+		return queuedData{data: yggdrasil.Data{MessageID: id, Metadata: map[string]string{priorityMetadata: priority}}, queued: time.Now()}
+	}
+	if err := q.push(item("1", "1"), false); err != nil {
+		t.Fatal(err)
+	}
+	seq, err := q.add(item("2", "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(item("3", "1"), false); err != nil {
+		t.Fatal(err)
+	}
+	handedOver := make(chan struct{})
+	go func() {
+		q.waitDequeued(seq)
+		close(handedOver)
+	}()
+
+	next, ok := q.nextShed()
+	if !ok || next.data.MessageID != "2" {
+		t.Fatalf("next shed %v, %v; want 2", next.data.MessageID, ok)
+	}
+	if _, ok := q.shed("2"); !ok {
+		t.Fatal("message 2 not shed")
+	}
+	select {
+	case <-handedOver:
+	case <-time.After(time.Second):
+		t.Fatal("the caller of Enqueue of the shed message still waits")
+	}
+	if _, ok := q.shed("2"); ok {
+		t.Error("shed message 2 twice")
+	}
+	for _, want := range []string{"1", "3"} {
+		if got, ok := q.Dequeue(); !ok || got.data.MessageID != want {
+			t.Errorf("dequeued %v, %v; want %v", got.data.MessageID, ok, want)
+		}
+	}
+}
+
+func TestDiskQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enqueue waits for each message to be dequeued.
+	enqueued := make(chan error)
+	go func() {
+		for _, id := range []string{"1", "2", "3", "2"} {
+			if err := q.Enqueue(queuedData{data: yggdrasil.Data{MessageID: id, Directive: "echo"}}); err != nil {
+				enqueued <- err
+				return
+			}
+		}
+		enqueued <- nil
+	}()
+
+	// Message 1 is processed, message 2 is being processed when the daemon
+	// stops and message 3 is still waiting.
+	first, _ := q.Dequeue()
+	if err := q.Ack(first.data.MessageID); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := q.Dequeue()
+	for q.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-enqueued; err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "00000000000000000001"+queueFileExt), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = newDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for q.Len() > 0 {
+		item, _ := q.Dequeue()
+		ids = append(ids, item.data.MessageID)
+		if item.data.MessageID == second.data.MessageID && !item.queued.Equal(second.queued) {
+			t.Errorf("queued time %v != %v", item.queued, second.queued)
+		}
+	}
+	if len(ids) != 2 || ids[0] != "2" || ids[1] != "3" {
+		t.Errorf("queued again %v, want [2 3]", ids)
+	}
+	if err := q.Ack("3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Message 2 is dequeued on every restart until it has been dequeued
+	// maxQueueAttempts times, and is then dropped.
+	for attempt := 2; attempt < maxQueueAttempts; attempt++ {
+		q, err = newDiskQueue(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item, _ := q.Dequeue(); item.data.MessageID != "2" {
+			t.Fatalf("dequeued %v, want 2", item.data.MessageID)
+		}
+	}
+	q, err = newDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected message 2 to be dropped, got %v queued", q.Len())
+	}
+
+	names, err := q.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("files left after acknowledging every message: %v", names)
+	}
+}
+
+// An ackWorker is a worker that accepts every message without responding.
+type ackWorker struct {
+	pb.UnimplementedWorkerServer
+}
+
+func (ackWorker) Send(ctx context.Context, data *pb.Data) (*pb.Receipt, error) {
+	return &pb.Receipt{}, nil
+}
+
+func TestDiskQueueDelivered(t *testing.T) {
+	l, err := net.Listen("unix", "@ygg-test-queue-delivered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	pb.RegisterWorkerServer(s, ackWorker{})
+	go s.Serve(l)
+	defer s.Stop()
+
+	tests := []struct {
+		description       string
+		assignmentTimeout time.Duration
+		wantQueued        bool
+	}{
+		{
+			description: "no assignment timeout",
+		},
+		{
+			description:       "assignment timeout",
+			assignmentTimeout: time.Minute,
+			wantQueued:        true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-queue")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			q, err := newDiskQueue(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := newDispatcher(nil)
+			d.queue = q
+			d.assignmentTimeout = test.assignmentTimeout
+			d.workers["echo"] = worker{handler: "echo", pid: 1, addr: "@ygg-test-queue-delivered"}
+			d.pidHandlers[1] = "echo"
+
+			enqueued := make(chan error, 1)
+			go func() { enqueued <- q.Enqueue(queuedData{data: yggdrasil.Data{MessageID: "1", Directive: "echo"}}) }()
+			item, _ := q.Dequeue()
+			if err := <-enqueued; err != nil {
+				t.Fatal(err)
+			}
+			d.dispatch(item)
+			d.Lock()
+			if a, ok := d.assignments["1"]; ok && a.timer != nil {
+				a.timer.Stop()
+			}
+			d.Unlock()
+
+			names, err := q.list()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(names) > 0; got != test.wantQueued {
+				t.Errorf("queued: %v != %v", got, test.wantQueued)
+			}
+		})
+	}
+}
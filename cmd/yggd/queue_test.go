@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	tests := []struct {
+		description string
+		maxQueueAge time.Duration
+		age         time.Duration
+		wantError   bool
+	}{
+		{
+			description: "disabled",
+			age:         time.Hour,
+		},
+		{
+			description: "fresh",
+			maxQueueAge: time.Minute,
+			age:         30 * time.Second,
+		},
+		{
+			description: "stale",
+			maxQueueAge: time.Minute,
+			age:         2 * time.Minute,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.maxQueueAge = test.maxQueueAge
+
+			now := time.Now()
+			err := d.expire(queuedData{queued: now.Add(-test.age)}, now)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				if d.expired != 1 {
+					t.Errorf("expected 1 expired message, got %v", d.expired)
+				}
+			} else {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if d.expired != 0 {
+					t.Errorf("expected no expired messages, got %v", d.expired)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// receiptWildcard matches any directive in the receipt destinations map.
+const receiptWildcard = "*"
+
+// parseReceiptDests parses values of the form "DIRECTIVE=DEST" into a map of
+// destinations that receipts for messages of each directive are published to.
+// A DIRECTIVE of "*" applies to every directive not listed explicitly.
+func parseReceiptDests(values []string) (map[string]string, error) {
+	dests := make(map[string]string)
+	for _, value := range values {
+		directive, dest := splitPair(value, "=")
+		if directive == "" || dest == "" {
+			return nil, fmt.Errorf("invalid receipt topic: %v", value)
+		}
+		dests[directive] = dest
+	}
+	return dests, nil
+}
+
+// receiptDest returns the destination receipts for messages of directive are
+// published to, or false if receipts are not enabled for directive.
+func (c *Client) receiptDest(directive string) (string, bool) {
+	if dest, prs := c.receipts[directive]; prs {
+		return dest, true
+	}
+	dest, prs := c.receipts[receiptWildcard]
+	return dest, prs
+}
+
+// SendReceiptMessage publishes a receipt with status for msg, if receipts are
+// enabled for its directive. The receipt of a message injected through the
+// control socket is logged instead.
+func (c *Client) SendReceiptMessage(msg *yggdrasil.Data, status yggdrasil.ReceiptStatus) error {
+	dest, ok := c.receiptDest(msg.Directive)
+	if !ok {
+		return nil
+	}
+	if msg.Metadata[injectedMetadataKey] != "" {
+		log.Infof("not publishing %v receipt for injected message %v", status, msg.MessageID)
+		return nil
+	}
+
+	receipt := yggdrasil.Receipt{
+		Type:       yggdrasil.MessageTypeReceipt,
+		MessageID:  uuid.New().String(),
+		ResponseTo: msg.MessageID,
+		Version:    1,
+		Sent:       time.Now(),
+	}
+	receipt.Content.Status = status
+	receipt.Content.Directive = msg.Directive
+
+	if err := c.sendMessage(&receipt, dest); err != nil {
+		return fmt.Errorf("cannot send %v receipt: %w", status, err)
+	}
+	log.Debugf("published %v receipt for message %v", status, msg.MessageID)
+
+	return nil
+}
+
+// DispatchedHandlerFunc publishes a "dispatched" receipt for msg. It is called
+// by the dispatcher after a message is delivered to a worker.
+func (c *Client) DispatchedHandlerFunc(msg yggdrasil.Data) {
+	if err := c.SendReceiptMessage(&msg, yggdrasil.ReceiptStatusDispatched); err != nil {
+		log.Errorf("cannot publish receipt: %v", err)
+	}
+}
+
+// RejectedHandlerFunc publishes a "rejected" receipt for msg, so that the
+// server may send it again later. It is called by the dispatcher after a
+// message is not dispatched because the queue of its worker group is full.
+func (c *Client) RejectedHandlerFunc(msg yggdrasil.Data, reason error) {
+	if c.inFlight != nil {
+		c.inFlight.done(msg.MessageID)
+	}
+	c.desiredState.failed(msg.MessageID)
+	log.Warnf("rejecting message %v: %v", msg.MessageID, reason)
+	if err := c.SendReceiptMessage(&msg, yggdrasil.ReceiptStatusRejected); err != nil {
+		log.Errorf("cannot publish receipt: %v", err)
+	}
+}
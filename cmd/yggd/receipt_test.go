@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// recordingTransport is a transport.AcknowledgingTransporter that records
+// the data sent to each destination and the options of the last message sent
+// with options.
+type recordingTransport struct {
+	sent    map[string][][]byte
+	options transport.PublishOptions
+}
+
+func (t *recordingTransport) Connect() error                   { return nil }
+func (t *recordingTransport) Disconnect(uint)                  {}
+func (t *recordingTransport) ReceiveData([]byte, string) error { return nil }
+func (t *recordingTransport) SendData(data []byte, dest string) error {
+	if t.sent == nil {
+		t.sent = make(map[string][][]byte)
+	}
+	t.sent[dest] = append(t.sent[dest], data)
+	return nil
+}
+
+func (t *recordingTransport) SendDataWithOptions(data []byte, dest string, opts transport.PublishOptions) error {
+	t.options = opts
+	return t.SendData(data, dest)
+}
+
+func TestSendReceiptMessage(t *testing.T) {
+	tests := []struct {
+		description string
+		receipts    map[string]string
+		directive   string
+		wantDest    string
+	}{
+		{
+			description: "disabled",
+			receipts:    map[string]string{},
+			directive:   "echo",
+		},
+		{
+			description: "directive",
+			receipts:    map[string]string{"echo": "status", receiptWildcard: "receipts"},
+			directive:   "echo",
+			wantDest:    "status",
+		},
+		{
+			description: "wildcard",
+			receipts:    map[string]string{"echo": "status", receiptWildcard: "receipts"},
+			directive:   "sleep",
+			wantDest:    "receipts",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tr := &recordingTransport{}
+			c := Client{t: tr, receipts: test.receipts}
+
+			msg := yggdrasil.Data{MessageID: "1234", Directive: test.directive}
+			if err := c.SendReceiptMessage(&msg, yggdrasil.ReceiptStatusReceived); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.wantDest == "" {
+				if len(tr.sent) > 0 {
+					t.Errorf("expected no receipts, got %v", tr.sent)
+				}
+				return
+			}
+
+			if len(tr.sent[test.wantDest]) != 1 {
+				t.Fatalf("expected 1 receipt on %v, got %v", test.wantDest, tr.sent)
+			}
+			var got yggdrasil.Receipt
+			if err := json.Unmarshal(tr.sent[test.wantDest][0], &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ResponseTo != msg.MessageID {
+				t.Errorf("%v != %v", got.ResponseTo, msg.MessageID)
+			}
+			if got.Content.Status != yggdrasil.ReceiptStatusReceived {
+				t.Errorf("%v != %v", got.Content.Status, yggdrasil.ReceiptStatusReceived)
+			}
+		})
+	}
+}
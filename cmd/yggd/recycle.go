@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// recycleCheckInterval is how often a worker process past its maximum
+// lifetime is checked for being idle enough to be recycled.
+var recycleCheckInterval = 30 * time.Second
+
+// idleWorker marks the worker process pid as retiring, so that no more
+// messages are routed to it, and returns true if it has had no assignments
+// for at least quiet as of now. It is replaced by the daemon with the
+// dispatcher's check; until then, no process is idle.
+var idleWorker = func(pid int, quiet time.Duration, now time.Time) bool { return false }
+
+// keepWorker routes messages to the worker process pid again after it could
+// not be stopped. It is replaced by the daemon with the dispatcher's.
+var keepWorker = func(pid int) {}
+
+// recycledProcesses holds the PIDs of worker processes stopped by
+// recycleProcess. They are restarted without delay.
+var recycledProcesses sync.Map
+
+// A recycleWindow is a range of local times of day, as offsets from midnight.
+// If end is before start, the window spans midnight.
+type recycleWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// parseRecycleWindow parses a range of times of day such as "02:00-05:00".
+func parseRecycleWindow(s string) (recycleWindow, error) {
+	first, last := splitPair(s, "-")
+	start, err := time.Parse("15:04", strings.TrimSpace(first))
+	if err != nil {
+		return recycleWindow{}, fmt.Errorf("invalid recycle-window: %v", s)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(last))
+	if err != nil || end.Equal(start) {
+		return recycleWindow{}, fmt.Errorf("invalid recycle-window: %v", s)
+	}
+	return recycleWindow{
+		start: time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+		end:   time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute,
+	}, nil
+}
+
+// contains returns true if the local time of day of t is within the window.
+func (w recycleWindow) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// recycleProcess recycles the worker process pid, started from file at
+// started, once its maximum lifetime has elapsed: as soon as it has had no
+// assignments for the configured idle period, within the configured window of
+// the day, it is marked as retiring, so that no more messages are routed to
+// it, and stopped, so that it is restarted. The worker is unregistered once
+// its process exits. It returns early when exited is closed.
+func recycleProcess(pid int, file string, config *workerConfig, started time.Time, exited <-chan struct{}) {
+	lifetime, _ := config.maxLifetime()
+	quiet, _ := config.recycleIdle()
+	var window *recycleWindow
+	if config.RecycleWindow != "" {
+		w, err := parseRecycleWindow(config.RecycleWindow)
+		if err != nil {
+			log.Errorf("cannot recycle worker %v: %v", file, err)
+			return
+		}
+		window = &w
+	}
+
+	timer := time.NewTimer(lifetime)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-exited:
+		return
+	}
+	log.Debugf("worker process %v reached its maximum lifetime of %v; recycling it once it is idle", pid, lifetime)
+
+	ticker := time.NewTicker(recycleCheckInterval)
+	defer ticker.Stop()
+	for now := time.Now(); ; now = <-ticker.C {
+		select {
+		case <-exited:
+			return
+		default:
+		}
+		if window != nil && !window.contains(now) {
+			continue
+		}
+		if !idleWorker(pid, quiet, now) {
+			continue
+		}
+
+		uptime := now.Sub(started).Round(time.Second)
+		log.Infof("recycling worker %v (process %v) after an uptime of %v", file, pid, uptime)
+		events.emit(event{Type: eventWorkerRecycled, Worker: filepath.Base(file), PID: pid, Detail: uptime.String()})
+		recycledProcesses.Store(pid, true)
+		if err := killProcess(pid); err != nil {
+			recycledProcesses.Delete(pid)
+			keepWorker(pid)
+			log.Errorf("cannot stop worker process %v: %v", pid, err)
+		}
+		return
+	}
+}
+
+// retireIdle marks the worker process pid as retiring and returns true if it
+// has no assignments and has had none for at least quiet as of now. A
+// retiring worker stays registered, but no more messages are routed to it,
+// until its process exits.
+func (d *dispatcher) retireIdle(pid int, quiet time.Duration, now time.Time) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	_, prs := d.pidHandlers[pid]
+	_, retiring := d.retiring[pid]
+	idle := prs && !retiring && len(d.outstanding[pid]) == 0 && now.Sub(d.lastActivity[pid]) >= quiet
+	for _, a := range d.assignments {
+		if a.pid == pid {
+			idle = false
+		}
+	}
+	if idle {
+		d.retiring[pid] = make(chan struct{})
+	}
+	return idle
+}
+
+// keepRetiring clears the retiring mark of the worker process pid, so that
+// messages are routed to it again.
+func (d *dispatcher) keepRetiring(pid int) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.retiring, pid)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestRecycleWindowContains(t *testing.T) {
+	tests := []struct {
+		description string
+		window      string
+		input       string
+		want        bool
+	}{
+		{
+			description: "within",
+			window:      "02:00-05:00",
+			input:       "03:30",
+			want:        true,
+		},
+		{
+			description: "start",
+			window:      "02:00-05:00",
+			input:       "02:00",
+			want:        true,
+		},
+		{
+			description: "end",
+			window:      "02:00-05:00",
+			input:       "05:00",
+		},
+		{
+			description: "outside",
+			window:      "02:00-05:00",
+			input:       "12:00",
+		},
+		{
+			description: "spanning midnight before",
+			window:      "22:00-04:00",
+			input:       "23:15",
+			want:        true,
+		},
+		{
+			description: "spanning midnight after",
+			window:      "22:00-04:00",
+			input:       "01:00",
+			want:        true,
+		},
+		{
+			description: "spanning midnight outside",
+			window:      "22:00-04:00",
+			input:       "12:00",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			w, err := parseRecycleWindow(test.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now, err := time.Parse("15:04", test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.contains(now); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRecycleWindowInvalid(t *testing.T) {
+	for _, input := range []string{"", "02:00", "02:00-", "2am-5am", "02:00-02:00", "25:00-26:00"} {
+		if _, err := parseRecycleWindow(input); err == nil {
+			t.Errorf("expected an error parsing %q", input)
+		}
+	}
+}
+
+func TestRetireIdle(t *testing.T) {
+	now := time.Now()
+
+	d := newDispatcher(nil)
+	go func() {
+		for range d.dispatchers {
+		}
+	}()
+	d.workers["echo"] = worker{pid: 100, handler: "echo"}
+	d.pidHandlers[100] = "echo"
+	d.lastActivity[100] = now.Add(-time.Minute)
+
+	if d.retireIdle(101, 0, now) {
+		t.Error("retired a process that is not registered")
+	}
+
+	d.trackDispatch(100, "a")
+	if d.retireIdle(100, 0, now) {
+		t.Error("retired a worker with an outstanding message")
+	}
+	d.trackResponse("a")
+
+	_, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.assign(queuedData{data: yggdrasil.Data{MessageID: "b"}}, 100, cancel)
+	if d.retireIdle(100, 0, now) {
+		t.Error("retired a worker with an assignment being delivered")
+	}
+	d.responded("b")
+
+	if d.retireIdle(100, time.Minute, now) {
+		t.Error("retired a worker that was active within the idle period")
+	}
+	if !d.retireIdle(100, time.Minute, now.Add(2*time.Minute)) {
+		t.Fatal("expected an idle worker to be retired")
+	}
+	if _, prs := d.workers["echo"]; !prs {
+		t.Error("expected echo to stay registered until its process exits")
+	}
+	if _, ok := d.selectWorker(yggdrasil.Data{Directive: "echo"}); ok {
+		t.Error("selected a retiring worker")
+	}
+	if d.retireIdle(100, time.Minute, now.Add(2*time.Minute)) {
+		t.Error("retired a worker that is already retiring")
+	}
+
+	d.keepRetiring(100)
+	if w, ok := d.selectWorker(yggdrasil.Data{Directive: "echo"}); !ok || w.pid != 100 {
+		t.Errorf("worker not selected after it could not be stopped: %+v, %v", w, ok)
+	}
+
+	if !d.retireIdle(100, time.Minute, now.Add(2*time.Minute)) {
+		t.Fatal("expected an idle worker to be retired")
+	}
+	done := make(chan struct{})
+	go func() {
+		d.unregisterWorker()
+		close(done)
+	}()
+	d.deadWorkers <- 100
+	close(d.deadWorkers)
+	<-done
+
+	d.RLock()
+	defer d.RUnlock()
+	if _, prs := d.workers["echo"]; prs {
+		t.Error("expected echo to be unregistered once its process exited")
+	}
+	if _, retiring := d.retiring[100]; retiring {
+		t.Error("expected the retiring mark to be cleared once the process exited")
+	}
+}
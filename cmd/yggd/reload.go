@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/pelletier/go-toml"
+	"github.com/redhatinsights/yggdrasil/internal/http"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+// A reloadableString is a setting that a reload may change while other
+// goroutines read it.
+type reloadableString struct {
+	v atomic.Value
+}
+
+func (s *reloadableString) get() string {
+	v, _ := s.v.Load().(string)
+	return v
+}
+
+func (s *reloadableString) set(v string) {
+	s.v.Store(v)
+}
+
+// topicPrefix is the topic prefix in use. It is set from
+// yggdrasil.TopicPrefix at startup, and changed by reloadTopicPrefix.
+var topicPrefix reloadableString
+
+// dataHost is the data host in use. It is set from yggdrasil.DataHost at
+// startup, and changed by reloadDataHost.
+var dataHost reloadableString
+
+// readConfigString reads the string key from the TOML config file, which may
+// be compressed. If the file does not set it, ok is false.
+func readConfigString(file string, key string) (value string, ok bool, err error) {
+	data, err := readConfigFile(file)
+	if err != nil {
+		return "", false, err
+	}
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return "", false, fmt.Errorf("cannot load config file: %w", err)
+	}
+	if !tree.Has(key) {
+		return "", false, nil
+	}
+	value, ok = tree.Get(key).(string)
+	if !ok {
+		return "", false, fmt.Errorf("%v: not a string", key)
+	}
+	return value, true, nil
+}
+
+// overridesConfigFile returns true if the flag name was set on the command
+// line or from the environment. Either takes precedence over the config file,
+// so reloading the config file leaves the flag as it is.
+func overridesConfigFile(name string) bool {
+	switch configSources[name] {
+	case sourceFlag, sourceEnv:
+		return true
+	}
+	return false
+}
+
+// readReloadedString reads the string key from the TOML config file, as
+// readConfigString does, unless the flag of the same name overrides the
+// config file, in which case ok is false.
+func readReloadedString(file string, key string) (value string, ok bool, err error) {
+	if overridesConfigFile(key) {
+		log.Debugf("not reloading %v: it is set on the command line or in the environment", key)
+		return "", false, nil
+	}
+	return readConfigString(file, key)
+}
+
+// reloadTopicPrefix re-reads the topic prefix from the config file and, if it
+// changed, moves the transport to the new topics without disconnecting.
+func reloadTopicPrefix(file string, t transport.Transporter) error {
+	if file == "" {
+		return fmt.Errorf("no config file")
+	}
+	prefix, ok, err := readReloadedString(file, "topic-prefix")
+	if err != nil {
+		return err
+	}
+	if !ok || prefix == topicPrefix.get() {
+		log.Debug("topic prefix unchanged")
+		return nil
+	}
+
+	p, ok := t.(transport.PrefixedTransporter)
+	if !ok {
+		return fmt.Errorf("transport does not support changing the topic prefix")
+	}
+	if err := p.SetTopicPrefix(prefix); err != nil {
+		return fmt.Errorf("cannot change topic prefix: %w", err)
+	}
+	log.Infof("changed topic prefix from %q to %q", topicPrefix.get(), prefix)
+	topicPrefix.set(prefix)
+
+	return nil
+}
+
+// reloadLogLevel re-reads the log level from the config file and, if it
+// changed, makes it the configured log level and applies it. A level set
+// through the control socket is kept while the config file leaves the level
+// unchanged.
+func reloadLogLevel(file string) error {
+	value, ok, err := readReloadedString(file, "log-level")
+	if err != nil || !ok {
+		return err
+	}
+	level, err := log.ParseLevel(value)
+	if err != nil {
+		return fmt.Errorf("log-level: %w", err)
+	}
+	if !setConfiguredLevel(level) {
+		return nil
+	}
+	log.Infof("changing log level from %v to %v", log.CurrentLevel(), level)
+	setLogLevel(level)
+	return nil
+}
+
+// reloadDataHost re-reads the data host from the config file and, if it
+// changed, uses it for the detached content of messages dispatched from then
+// on.
+func reloadDataHost(file string) error {
+	host, ok, err := readReloadedString(file, "data-host")
+	if err != nil || !ok || host == dataHost.get() {
+		return err
+	}
+	log.Infof("changed data host from %q to %q", dataHost.get(), host)
+	dataHost.set(host)
+	return nil
+}
+
+// A brokerSet is an MQTT transport whose brokers are reloaded from the
+// config file: the broker given by the server key, or by server if the
+// config file does not set it, followed by those of the broker tables named
+// table.
+type brokerSet struct {
+	table     string
+	serverKey string
+	server    string
+	t         *transport.MQTT
+}
+
+// reloadBrokers re-reads the brokers of each of sets from the config file
+// and replaces those of its transport with them, returning true if the
+// brokers of any transport changed, so that it reconnects to make use of
+// them. The brokers of every set are read before any is replaced, so that an
+// invalid config file changes none of them.
+func reloadBrokers(file string, config *tls.Config, expiryWarning time.Duration, sets []brokerSet) (bool, error) {
+	brokers := make([][]transport.MQTTBroker, len(sets))
+	for i, set := range sets {
+		server, ok, err := readReloadedString(file, set.serverKey)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			server = set.server
+		}
+		brokers[i], err = mqttBrokers(server, file, set.table, expiryWarning)
+		if err != nil {
+			return false, err
+		}
+		if len(brokers[i]) == 0 {
+			return false, fmt.Errorf("no %v configured", strings.ReplaceAll(set.table, "-", " "))
+		}
+		if err := checkBrokerCertificates(brokers[i], config); err != nil {
+			return false, err
+		}
+	}
+
+	changed := false
+	for i, set := range sets {
+		c, err := set.t.SetBrokers(brokers[i])
+		if err != nil {
+			return changed, fmt.Errorf("cannot change %v brokers: %w", set.table, err)
+		}
+		if c {
+			for _, b := range brokers[i] {
+				log.Infof("using MQTT %v %v", strings.ReplaceAll(set.table, "-", " "), b.URL)
+			}
+		}
+		changed = changed || c
+	}
+	return changed, nil
+}
+
+// A tlsConfigSetter is a transport whose TLS config can be replaced while it
+// is running.
+type tlsConfigSetter interface {
+	SetTLSConfig(config *tls.Config)
+}
+
+// reloadTLSConfig re-reads the certificate, key and certificate authority
+// files and makes the HTTP client, and the transport if it supports it, use
+// them for subsequent requests. MQTT transports reload them before each
+// connection attempt instead, so the new files are used from the next
+// reconnect.
+func reloadTLSConfig(loader *tlsLoader, client *http.Client, t transport.Transporter) error {
+	config, err := loader.load()
+	if err != nil {
+		return err
+	}
+	client.SetTLSConfig(config)
+	if s, ok := t.(tlsConfigSetter); ok {
+		s.SetTLSConfig(config)
+	}
+	log.Info("reloaded TLS config")
+	return nil
+}
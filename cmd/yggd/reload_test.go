@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+)
+
+func TestReloadBrokers(t *testing.T) {
+	tests := []struct {
+		description string
+		config      []string
+		wantChanged bool
+		wantError   bool
+	}{
+		{
+			description: "unchanged",
+			config:      []string{`[[broker]]`, `url = "tcp://fallback.example.com:1883"`},
+		},
+		{
+			description: "broker added",
+			config:      []string{`[[broker]]`, `url = "tcp://fallback.example.com:1883"`, `[[broker]]`, `url = "tcp://other.example.com:1883"`},
+			wantChanged: true,
+		},
+		{
+			description: "server changed",
+			config:      []string{`server = "tcp://new.example.com:1883"`, `[[broker]]`, `url = "tcp://fallback.example.com:1883"`},
+			wantChanged: true,
+		},
+		{
+			description: "invalid broker",
+			config:      []string{`[[broker]]`, `url = "ftp://fallback.example.com"`},
+			wantError:   true,
+		},
+		{
+			description: "TLS broker without certificate",
+			config:      []string{`[[broker]]`, `url = "ssl://fallback.example.com:8883"`},
+			wantError:   true,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.toml")
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if err := ioutil.WriteFile(configFile, []byte(strings.Join(test.config, "\n")), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			brokers := []transport.MQTTBroker{{URL: "tcp://primary.example.com:1883"}, {URL: "tcp://fallback.example.com:1883"}}
+			tr, err := transport.NewMQTTTransport("c", brokers, transport.MQTTBroker{}, true, false, false, transport.PublishOptions{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sets := []brokerSet{{table: "broker", serverKey: "server", server: "primary.example.com:1883", t: tr}}
+
+			changed, err := reloadBrokers(configFile, &tls.Config{}, 0, sets)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if changed != test.wantChanged {
+				t.Errorf("changed: %v != %v", changed, test.wantChanged)
+			}
+		})
+	}
+}
+
+func TestReloadLogLevel(t *testing.T) {
+	defer func(level log.Level) {
+		setConfiguredLevel(level)
+		setLogLevel(level)
+	}(log.CurrentLevel())
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(configFile, []byte(`log-level = "debug"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	setConfiguredLevel(log.LevelInfo)
+	setLogLevel(log.LevelInfo)
+	if err := reloadLogLevel(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if log.CurrentLevel() != log.LevelDebug || configuredLevel() != log.LevelDebug {
+		t.Errorf("log level not changed: %v", log.CurrentLevel())
+	}
+
+	// A level set through the control socket is kept while the configured
+	// level is unchanged.
+	setLogLevel(log.LevelTrace)
+	if err := reloadLogLevel(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if log.CurrentLevel() != log.LevelTrace {
+		t.Errorf("log level changed: %v", log.CurrentLevel())
+	}
+
+	// A level given on the command line is kept.
+	defer func(sources map[string]string) { configSources = sources }(configSources)
+	configSources = map[string]string{"log-level": sourceFlag}
+	setConfiguredLevel(log.LevelInfo)
+	setLogLevel(log.LevelInfo)
+	if err := reloadLogLevel(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if log.CurrentLevel() != log.LevelInfo || configuredLevel() != log.LevelInfo {
+		t.Errorf("log level given on the command line changed: %v", log.CurrentLevel())
+	}
+}
+
+func TestReloadDataHost(t *testing.T) {
+	defer dataHost.set(dataHost.get())
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A compressed config file is reloaded as it is read at startup.
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(`data-host = "data.example.com"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.toml.gz")
+	if err := ioutil.WriteFile(configFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dataHost.set("")
+	if err := reloadDataHost(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dataHost.get(), "data.example.com"; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// The metadata keys set on a replayed message: replayMetadataKey marks it as
+// replayed and replayOfMetadataKey holds the message ID of the dead-lettered
+// message it replays.
+const (
+	replayMetadataKey   = "replayed"
+	replayOfMetadataKey = "replay_of"
+)
+
+// maxDeadLetters is the number of dead-lettered messages a deadLetterStore
+// keeps by default; the oldest are discarded first.
+const maxDeadLetters = 1000
+
+// defaultReplayRate is the number of messages replayed per second, unless a
+// rate is given.
+const defaultReplayRate = 10
+
+// A deadLetterStore keeps a copy of the messages published to the
+// "dead-letter" destination in file, one JSON-encoded message per line, so
+// that they can be replayed once the cause of their failure is fixed. Messages
+// are appended to file, which is rewritten with the most recent max messages
+// only once it holds twice as many.
+type deadLetterStore struct {
+	file string
+	max  int
+	lock sync.Mutex
+
+	// count is the number of messages in file, or -1 until file is first
+	// read.
+	count int
+}
+
+func newDeadLetterStore(file string) *deadLetterStore {
+	return &deadLetterStore{file: file, max: maxDeadLetters, count: -1}
+}
+
+// add appends msg to the store, discarding the oldest messages beyond max. It
+// does nothing if s is nil.
+func (s *deadLetterStore) add(msg yggdrasil.Data) error {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.count < 0 || s.count >= 2*s.max {
+		// Rewriting the file on first use also converts a file written as a
+		// JSON array by earlier versions.
+		msgs, err := s.read()
+		if err != nil {
+			return err
+		}
+		if err := s.write(msgs); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("cannot marshal dead letter: %w", err)
+	}
+	f, err := os.OpenFile(s.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open dead-letter file: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("cannot write dead-letter file: %w", err)
+	}
+	s.count++
+	return nil
+}
+
+// take removes the messages matched by f from the store and returns them.
+func (s *deadLetterStore) take(f replayFilter) ([]yggdrasil.Data, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	msgs, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	var taken, kept []yggdrasil.Data
+	for _, msg := range msgs {
+		if f.match(msg) {
+			taken = append(taken, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	if len(taken) == 0 {
+		return nil, nil
+	}
+	if err := s.write(kept); err != nil {
+		return nil, err
+	}
+	return taken, nil
+}
+
+// read returns the most recent max messages in file.
+func (s *deadLetterStore) read() ([]yggdrasil.Data, error) {
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read dead-letter file: %w", err)
+	}
+	var msgs []yggdrasil.Data
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &msgs); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal dead-letter file: %w", err)
+		}
+	} else {
+		msgs, err = readDeadLetters(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read dead-letter file: %w", err)
+		}
+	}
+	if len(msgs) > s.max {
+		msgs = msgs[len(msgs)-s.max:]
+	}
+	return msgs, nil
+}
+
+// write replaces the content of file with msgs.
+func (s *deadLetterStore) write(msgs []yggdrasil.Data) error {
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return fmt.Errorf("cannot marshal dead letter: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		return fmt.Errorf("cannot rename file: %w", err)
+	}
+	s.count = len(msgs)
+	return nil
+}
+
+// A replayFilter selects the dead-lettered messages to replay: those for
+// directive, if set, whose dead-letter reason contains reason, if set.
+type replayFilter struct {
+	directive string
+	reason    string
+}
+
+func (f replayFilter) match(msg yggdrasil.Data) bool {
+	if f.directive != "" && msg.Directive != f.directive {
+		return false
+	}
+	return f.reason == "" || strings.Contains(msg.Metadata["dead_letter_reason"], f.reason)
+}
+
+// replayMessage returns a fresh copy of the dead-lettered message msg, with a
+// new message ID, marked as a replay of msg.
+func replayMessage(msg yggdrasil.Data) yggdrasil.Data {
+	data := msg
+	data.MessageID = uuid.New().String()
+	data.Sent = time.Now()
+	data.Metadata = copyMetadata(msg.Metadata)
+	delete(data.Metadata, "dead_letter_reason")
+	data.Metadata[replayMetadataKey] = "true"
+	data.Metadata[replayOfMetadataKey] = msg.MessageID
+	return data
+}
+
+// A replayResult reports the replay of a single dead-lettered message.
+type replayResult struct {
+	MessageID string `json:"message_id"`
+	ReplayID  string `json:"replay_id"`
+	Directive string `json:"directive"`
+}
+
+// handleReplay is the control stream handler for the "replay" command. It
+// reinjects the dead-lettered messages given in the "messages" argument (a
+// JSON array) or, if none are given, those taken from the dead-letter store,
+// into the pipeline as fresh messages, at most "rate" per second. Messages
+// are filtered by the "directive" and "reason" arguments. Only one replay
+// runs at a time. If the client disconnects, the messages taken from the
+// store that were not replayed are put back.
+func (c *Client) handleReplay(args map[string]string, send func(v interface{}) error, done <-chan struct{}) error {
+	rate := defaultReplayRate
+	if args["rate"] != "" {
+		var err error
+		rate, err = strconv.Atoi(args["rate"])
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("invalid rate: %v", args["rate"])
+		}
+	}
+	f := replayFilter{directive: args["directive"], reason: args["reason"]}
+
+	if !atomic.CompareAndSwapInt32(&c.replaying, 0, 1) {
+		return fmt.Errorf("a replay is already in progress")
+	}
+	defer atomic.StoreInt32(&c.replaying, 0)
+
+	var msgs []yggdrasil.Data
+	fromStore := args["messages"] == ""
+	if fromStore {
+		if c.deadLetters == nil {
+			return fmt.Errorf("no dead-letter file is configured")
+		}
+		var err error
+		msgs, err = c.deadLetters.take(f)
+		if err != nil {
+			return err
+		}
+	} else {
+		var given []yggdrasil.Data
+		if err := json.Unmarshal([]byte(args["messages"]), &given); err != nil {
+			return fmt.Errorf("cannot unmarshal messages: %w", err)
+		}
+		for _, msg := range given {
+			if f.match(msg) {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	for i, msg := range msgs {
+		if i > 0 {
+			select {
+			case <-ticker.C:
+			case <-done:
+				if fromStore {
+					c.restoreDeadLetters(msgs[i:])
+				}
+				return nil
+			}
+		}
+
+		data := replayMessage(msg)
+		log.Infof("replaying message %v as %v", msg.MessageID, data.MessageID)
+		if err := c.ReceiveDataMessage(&data); err != nil {
+			log.Errorf("cannot replay message %v: %v", msg.MessageID, err)
+			continue
+		}
+		if err := send(replayResult{MessageID: msg.MessageID, ReplayID: data.MessageID, Directive: data.Directive}); err != nil {
+			log.Debugf("cannot send replay result: %v", err)
+		}
+	}
+	return nil
+}
+
+// restoreDeadLetters puts msgs back in the dead-letter store.
+func (c *Client) restoreDeadLetters(msgs []yggdrasil.Data) {
+	for _, msg := range msgs {
+		if err := c.deadLetters.add(msg); err != nil {
+			log.Errorf("cannot restore dead-lettered message %v: %v", msg.MessageID, err)
+		}
+	}
+}
+
+// readDeadLetters reads dead-lettered messages from r, one JSON-encoded
+// message per line, as captured from the "dead-letter" destination.
+func readDeadLetters(r io.Reader) ([]yggdrasil.Data, error) {
+	var msgs []yggdrasil.Data
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var msg yggdrasil.Data
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			return nil, fmt.Errorf("cannot unmarshal message: %w", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read messages: %w", err)
+	}
+	return msgs, nil
+}
+
+// replayAction calls the "replay" control command on the running daemon and
+// prints each message replayed.
+func replayAction(c *cli.Context) error {
+	args := map[string]string{}
+	if c.String("directive") != "" {
+		args["directive"] = c.String("directive")
+	}
+	if c.String("reason") != "" {
+		args["reason"] = c.String("reason")
+	}
+	args["rate"] = strconv.Itoa(c.Int("rate"))
+	if file := c.String("input"); file != "" {
+		var r io.Reader = os.Stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return cli.Exit(fmt.Errorf("cannot open input: %w", err), 1)
+			}
+			defer f.Close()
+			r = f
+		}
+		msgs, err := readDeadLetters(r)
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		data, err := json.Marshal(msgs)
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot marshal messages: %w", err), 1)
+		}
+		args["messages"] = string(data)
+	}
+
+	var replayed int
+	err := streamControl(c.String("control-socket-addr"), "replay", args, func(result json.RawMessage) error {
+		replayed++
+		if c.Bool("json") {
+			fmt.Fprintln(c.App.Writer, string(result))
+			return nil
+		}
+		var r replayResult
+		if err := json.Unmarshal(result, &r); err != nil {
+			return fmt.Errorf("cannot unmarshal result: %w", err)
+		}
+		fmt.Fprintf(c.App.Writer, "replayed %v (%v) as %v\n", r.MessageID, r.Directive, r.ReplayID)
+		return nil
+	})
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if !c.Bool("json") {
+		fmt.Fprintf(c.App.Writer, "%v messages replayed\n", replayed)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestDeadLetterStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-dead-letters-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := newDeadLetterStore(filepath.Join(dir, "dead-letters.json"))
+	s.max = 4
+
+	for i := 0; i < s.max+2; i++ {
+		directive := "echo"
+		if i%2 == 1 {
+			directive = "sleep"
+		}
+		msg := yggdrasil.Data{MessageID: fmt.Sprint(i), Directive: directive, Metadata: map[string]string{"dead_letter_reason": "directive not permitted"}}
+		if err := s.add(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(data), "\n"); got != s.max+2 {
+		t.Errorf("file holds %v lines, want %v appended", got, s.max+2)
+	}
+
+	taken, err := s.take(replayFilter{directive: "echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(taken) != 2 || taken[0].MessageID != "2" {
+		t.Errorf("took %+v, want 2 messages starting at 2", taken)
+	}
+
+	if taken, err := s.take(replayFilter{reason: "stale"}); err != nil || len(taken) != 0 {
+		t.Errorf("expected no messages to match, got %v, %v", len(taken), err)
+	}
+	taken, err = s.take(replayFilter{reason: "not permitted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(taken) != 2 {
+		t.Errorf("took %v messages, want 2", len(taken))
+	}
+}
+
+func TestDeadLetterStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-dead-letters-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "dead-letters.json")
+	legacy, err := json.Marshal([]yggdrasil.Data{{MessageID: "0"}, {MessageID: "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, legacy, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newDeadLetterStore(file)
+	s.max = 2
+	for i := 2; i < 6; i++ {
+		if err := s.add(yggdrasil.Data{MessageID: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := readDeadLetters(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, msg.MessageID)
+	}
+	if want := []string{"2", "3", "4", "5"}; !cmp.Equal(got, want) {
+		t.Errorf("file holds %v, want %v", got, want)
+	}
+	if msgs, err := s.read(); err != nil || len(msgs) != 2 || msgs[0].MessageID != "4" {
+		t.Errorf("read %+v, %v, want messages 4 and 5", msgs, err)
+	}
+}
+
+func TestHandleReplay(t *testing.T) {
+	d := newDispatcher(nil)
+	d.queue = &bufferedQueue{}
+	c := Client{t: &recordingTransport{}, d: d, seen: newSeenCache(10, 0)}
+
+	msgs, err := json.Marshal([]yggdrasil.Data{
+		{MessageID: "1", Directive: "echo", Metadata: map[string]string{"dead_letter_reason": "stale"}},
+		{MessageID: "2", Directive: "sleep"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.seen.seen("1")
+
+	var results []replayResult
+	send := func(v interface{}) error {
+		results = append(results, v.(replayResult))
+		return nil
+	}
+	args := map[string]string{"messages": string(msgs), "directive": "echo", "rate": "100"}
+	if err := c.handleReplay(args, send, make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 1 || results[0].MessageID != "1" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if d.queue.Len() != 1 {
+		t.Fatalf("expected 1 dispatched message, got %v", d.queue.Len())
+	}
+	q, _ := d.queue.Dequeue()
+	if q.data.MessageID != results[0].ReplayID || q.data.MessageID == "1" {
+		t.Errorf("unexpected message ID %v", q.data.MessageID)
+	}
+	if q.data.Metadata[replayMetadataKey] != "true" || q.data.Metadata[replayOfMetadataKey] != "1" || q.data.Metadata["dead_letter_reason"] != "" {
+		t.Errorf("unexpected metadata: %v", q.data.Metadata)
+	}
+
+	c.replaying = 1
+	if err := c.handleReplay(args, send, make(chan struct{})); err == nil {
+		t.Errorf("expected error for concurrent replay")
+	}
+	c.replaying = 0
+	if err := c.handleReplay(map[string]string{"rate": "0"}, send, make(chan struct{})); err == nil {
+		t.Errorf("expected error for invalid rate")
+	}
+	if err := c.handleReplay(map[string]string{}, send, make(chan struct{})); err == nil {
+		t.Errorf("expected error without a dead-letter file")
+	}
+}
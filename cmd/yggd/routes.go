@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// A route describes the worker registered to handle a directive, including
+// the metadata it declared when it registered.
+type route struct {
+	Directive       string            `json:"directive"`
+	PID             int               `json:"pid"`
+	Address         string            `json:"address"`
+	Healthy         bool              `json:"healthy"`
+	DetachedContent bool              `json:"detached_content"`
+	Features        map[string]string `json:"features,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	LastHeartbeat   *time.Time        `json:"last_heartbeat,omitempty"`
+	ShadowHandler   string            `json:"shadow_handler,omitempty"`
+	ShadowRate      float64           `json:"shadow_rate,omitempty"`
+	Usage           *workerUsage      `json:"usage,omitempty"`
+}
+
+// routes returns the current routing table, sorted by directive, with the
+// health of each worker as reported by healthy.
+func (d *dispatcher) routes() []route {
+	d.RLock()
+	defer d.RUnlock()
+
+	now := time.Now()
+	routes := make([]route, 0, len(d.workers))
+	for directive, w := range d.workers {
+		r := route{
+			Directive:       directive,
+			PID:             w.pid,
+			Address:         w.addr,
+			Healthy:         d.healthy(w, now),
+			DetachedContent: w.detachedContent,
+			Features:        w.features,
+			Metadata:        w.metadata,
+		}
+		if !w.lastHeartbeat.IsZero() {
+			lastHeartbeat := w.lastHeartbeat
+			r.LastHeartbeat = &lastHeartbeat
+		}
+		if shadow, prs := d.shadows[directive]; prs {
+			r.ShadowHandler = shadow.handler
+			r.ShadowRate = shadow.rate
+		}
+		if usage, prs := d.usage.get(w.pid); prs {
+			r.Usage = &usage
+		}
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Directive < routes[j].Directive })
+
+	return routes
+}
+
+// healthy returns true if the worker w is healthy as of now. A worker yggd
+// started is healthy if its process is still running. An external worker has
+// no process yggd can inspect, and stays registered only while connected; it
+// is healthy unless it has sent heartbeats but none within the heartbeat
+// timeout. The caller must hold the lock.
+func (d *dispatcher) healthy(w worker, now time.Time) bool {
+	if !isExternalWorker(w.pid) {
+		return processRunning(w.pid)
+	}
+	return w.lastHeartbeat.IsZero() || d.heartbeatTimeout <= 0 || now.Sub(w.lastHeartbeat) < d.heartbeatTimeout
+}
+
+// handleRoutes is the control handler for the "routes" command.
+func (d *dispatcher) handleRoutes(args map[string]string) (interface{}, error) {
+	return d.routes(), nil
+}
+
+// routesAction calls the "routes" control command on the running daemon and
+// prints the routing table, either as a table or as JSON.
+func routesAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "routes", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var routes []route
+	if err := json.Unmarshal(result, &routes); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(routes, "", "  ")
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot marshal routes: %w", err), 1)
+		}
+		fmt.Fprintln(c.App.Writer, string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.App.Writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTIVE\tPID\tHEALTH\tHEARTBEAT\tDETACHED\tCPU\tRSS\tSHADOW\tFEATURES\tMETADATA")
+	for _, r := range routes {
+		health := "unhealthy"
+		if r.Healthy {
+			health = "healthy"
+		}
+		shadow := ""
+		if r.ShadowHandler != "" {
+			shadow = fmt.Sprintf("%v (%v)", r.ShadowHandler, r.ShadowRate)
+		}
+		heartbeat := ""
+		if r.LastHeartbeat != nil {
+			heartbeat = fmt.Sprintf("%v ago", time.Since(*r.LastHeartbeat).Round(time.Second))
+		}
+		cpu, rss := "", ""
+		if r.Usage != nil {
+			cpu = fmt.Sprintf("%.1f%%", r.Usage.CPUPercent)
+			rss = fmt.Sprintf("%v KiB", r.Usage.RSSBytes/1024)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", r.Directive, r.PID, health, heartbeat, r.DetachedContent, cpu, rss, shadow, formatFeatures(r.Features), formatFeatures(r.Metadata))
+	}
+	if err := w.Flush(); err != nil {
+		return cli.Exit(fmt.Errorf("cannot write routes: %w", err), 1)
+	}
+
+	return nil
+}
+
+// formatFeatures formats features as a comma-separated list of key=value
+// pairs, sorted by key.
+func formatFeatures(features map[string]string) string {
+	pairs := make([]string, 0, len(features))
+	for k, v := range features {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// processRunning returns true if a process with the given pid exists.
+func processRunning(pid int) bool {
+	// Non-positive pids address process groups rather than a single process.
+	if pid <= 0 {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDispatcherRoutes(t *testing.T) {
+	d := newDispatcher(nil)
+	d.workers["echo"] = worker{pid: os.Getpid(), handler: "echo", addr: "@ygg-echo", features: map[string]string{"version": "1"}, metadata: map[string]string{"version": "1.2.0", "maintainer": "ops@example.com"}}
+	d.workers["sleep"] = worker{pid: -1, handler: "sleep", addr: "@ygg-sleep", detachedContent: true}
+	d.workers["remote"] = worker{pid: externalWorkerIDBase, handler: "remote", addr: "/run/yggdrasil/ygg-remote.sock"}
+	stalled := time.Now().Add(-time.Hour)
+	d.workers["stalled"] = worker{pid: externalWorkerIDBase + 1, handler: "stalled", addr: "/run/yggdrasil/ygg-stalled.sock", lastHeartbeat: stalled}
+	d.heartbeatTimeout = time.Minute
+	d.shadows["echo"] = shadowRoute{handler: "echo-next", rate: 0.5}
+
+	want := []route{
+		{
+			Directive:     "echo",
+			PID:           os.Getpid(),
+			Address:       "@ygg-echo",
+			Healthy:       true,
+			Features:      map[string]string{"version": "1"},
+			Metadata:      map[string]string{"version": "1.2.0", "maintainer": "ops@example.com"},
+			ShadowHandler: "echo-next",
+			ShadowRate:    0.5,
+		},
+		{
+			Directive: "remote",
+			PID:       externalWorkerIDBase,
+			Address:   "/run/yggdrasil/ygg-remote.sock",
+			Healthy:   true,
+		},
+		{
+			Directive:       "sleep",
+			PID:             -1,
+			Address:         "@ygg-sleep",
+			DetachedContent: true,
+		},
+		{
+			Directive:     "stalled",
+			PID:           externalWorkerIDBase + 1,
+			Address:       "/run/yggdrasil/ygg-stalled.sock",
+			LastHeartbeat: &stalled,
+		},
+	}
+
+	got := d.routes()
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+}
+
+func TestFormatFeatures(t *testing.T) {
+	got := formatFeatures(map[string]string{"version": "1", "arch": "x86_64"})
+	want := "arch=x86_64,version=1"
+	if got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
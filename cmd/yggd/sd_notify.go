@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// startTimeoutInterval is how often the daemon extends the start timeout
+// systemd set for it while it starts up.
+const startTimeoutInterval = 10 * time.Second
+
+// notifyServiceManager sends state, such as "READY=1", to systemd, if it
+// started the daemon with a notification socket. It returns false if there is
+// no notification socket.
+func notifyServiceManager(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return true, fmt.Errorf("cannot connect to notification socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return true, fmt.Errorf("cannot notify service manager: %w", err)
+	}
+	return true, nil
+}
+
+// extendStartTimeout asks systemd, every interval until done is closed, to
+// extend the start timeout of the daemon (TimeoutStartSec= in the unit) by
+// twice the interval. A startup waiting on an unreachable broker for the
+// handshake timeout, on workers to start or on their self-test, is then not
+// taken for a hung one and restarted before it sends READY=1. It returns at
+// once if there is no notification socket.
+func extendStartTimeout(interval time.Duration, done <-chan struct{}) {
+	state := fmt.Sprintf("EXTEND_TIMEOUT_USEC=%v", int64(2*interval/time.Microsecond))
+	for {
+		notified, err := notifyServiceManager(state)
+		if !notified {
+			return
+		}
+		if err != nil {
+			log.Debugf("cannot extend start timeout: %v", err)
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// watchdogInterval returns the interval at which the daemon must notify
+// systemd that it is alive: half the watchdog timeout systemd set for it
+// (WatchdogSec= in the unit). It returns 0 if no watchdog timeout is set for
+// the daemon's process.
+func watchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(usec, 10, 63)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC: %v", usec)
+	}
+	return time.Duration(n) * time.Microsecond / 2, nil
+}
+
+// newWatchdogNotifier creates a livenessFile that, rather than touching a
+// file, notifies the systemd watchdog every interval while the daemon is
+// healthy, so that systemd restarts a daemon that is stuck or disconnected
+// just as an external watchdog would.
+func newWatchdogNotifier(interval time.Duration, checks []livenessCheck) *livenessFile {
+	l := newLivenessFile("systemd watchdog", interval, checks)
+	l.touch = func() error {
+		_, err := notifyServiceManager("WATCHDOG=1")
+		return err
+	}
+	return l
+}
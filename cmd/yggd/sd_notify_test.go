@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		description string
+		usec        string
+		pid         string
+		want        time.Duration
+		wantError   bool
+	}{
+		{
+			description: "no watchdog",
+		},
+		{
+			description: "watchdog",
+			usec:        "60000000",
+			want:        30 * time.Second,
+		},
+		{
+			description: "watchdog for this process",
+			usec:        "60000000",
+			pid:         strconv.Itoa(os.Getpid()),
+			want:        30 * time.Second,
+		},
+		{
+			description: "watchdog for another process",
+			usec:        "60000000",
+			pid:         "1",
+		},
+		{
+			description: "invalid",
+			usec:        "1m",
+			wantError:   true,
+		},
+	}
+
+	defer os.Setenv("WATCHDOG_USEC", os.Getenv("WATCHDOG_USEC"))
+	defer os.Setenv("WATCHDOG_PID", os.Getenv("WATCHDOG_PID"))
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			os.Setenv("WATCHDOG_USEC", test.usec)
+			os.Setenv("WATCHDOG_PID", test.pid)
+			got, err := watchdogInterval()
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExtendStartTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	defer os.Setenv("NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"))
+	os.Setenv("NOTIFY_SOCKET", socket)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		extendStartTimeout(10*time.Millisecond, done)
+		close(stopped)
+	}()
+
+	buf := make([]byte, 64)
+	for i := 0; i < 2; i++ {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf[:n]), "EXTEND_TIMEOUT_USEC=20000"; got != want {
+			t.Errorf("%q != %q", got, want)
+		}
+	}
+
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("start timeout still extended once the daemon is ready")
+	}
+}
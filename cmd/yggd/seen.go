@@ -0,0 +1,246 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// The keys data messages can be recognized as duplicates by.
+const (
+	// dedupKeyID drops a message whose ID was recently received.
+	dedupKeyID = "id"
+
+	// dedupKeyContent drops a message whose directive and content were
+	// recently received, whatever its ID.
+	dedupKeyContent = "content-hash"
+
+	// dedupKeyBoth drops a message that is a duplicate by either.
+	dedupKeyBoth = "both"
+)
+
+// A seenCache remembers the IDs of recently received messages so that
+// redelivered duplicates can be dropped. It holds at most maxEntries IDs,
+// evicting the least recently seen ID when full, and forgets an ID once ttl
+// has passed since it was first seen.
+//
+// If key is dedupKeyContent or dedupKeyBoth, it also remembers the hashes of
+// the directive and content of the messages, each for contentTTL, under
+// the same limit.
+type seenCache struct {
+	sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	key        string
+	contentTTL time.Duration
+	entries    map[string]*list.Element
+	order      *list.List // most recently seen at the front
+	evictions  uint64
+	expiries   uint64
+	bytes      int
+	now        func() time.Time
+}
+
+type seenEntry struct {
+	id      string
+	expires time.Time // zero if the entry never expires
+}
+
+// newSeenCache creates a cache holding at most maxEntries IDs, each for at
+// most ttl (or until evicted, if ttl is 0).
+func newSeenCache(maxEntries int, ttl time.Duration) *seenCache {
+	return &seenCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		key:        dedupKeyID,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// duplicate records msg and returns the key it is a duplicate by, or an empty
+// string if it is not a duplicate.
+func (c *seenCache) duplicate(msg *yggdrasil.Data) string {
+	var dup string
+	if c.key == dedupKeyID || c.key == dedupKeyBoth {
+		if c.seen(msg.MessageID) {
+			dup = dedupKeyID
+		}
+	}
+	if c.key == dedupKeyContent || c.key == dedupKeyBoth {
+		if c.seenFor(contentKey(msg), c.contentTTL) && dup == "" {
+			dup = dedupKeyContent
+		}
+	}
+	return dup
+}
+
+// contentKey returns the key msg is recorded under by its content: a hash of
+// its type, directive and content. Metadata does not count, as it often
+// differs between sends of the same command.
+func contentKey(msg *yggdrasil.Data) string {
+	h := sha256.New()
+	for _, field := range [][]byte{[]byte(msg.Type), []byte(msg.Directive), msg.Content} {
+		fmt.Fprintf(h, "%v:", len(field))
+		h.Write(field)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// seen records id and returns true if it was already in the cache.
+func (c *seenCache) seen(id string) bool {
+	return c.seenFor(id, c.ttl)
+}
+
+// seenFor records id, to be forgotten once ttl has passed (or never, if ttl is
+// 0), and returns true if it was already in the cache.
+func (c *seenCache) seenFor(id string, ttl time.Duration) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.now()
+	c.expire(now)
+
+	if e, ok := c.entries[id]; ok {
+		if !c.expired(e.Value.(*seenEntry), now) {
+			c.order.MoveToFront(e)
+			return true
+		}
+		c.remove(e)
+		c.expiries++
+	}
+
+	entry := &seenEntry{id: id}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+	c.entries[id] = c.order.PushFront(entry)
+	c.bytes += seenEntrySize(id)
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+	return false
+}
+
+func (c *seenCache) expired(e *seenEntry, now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// expire removes expired IDs from the back of the cache. IDs that expire
+// while more recently seen IDs are behind them are removed when they are
+// next looked up or evicted.
+func (c *seenCache) expire(now time.Time) {
+	for e := c.order.Back(); e != nil && c.expired(e.Value.(*seenEntry), now); e = c.order.Back() {
+		c.remove(e)
+		c.expiries++
+	}
+}
+
+func (c *seenCache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*seenEntry).id)
+	c.bytes -= seenEntrySize(e.Value.(*seenEntry).id)
+}
+
+// memoryUsage returns the estimated memory held by the cache, in bytes. It
+// returns 0 if c is nil.
+func (c *seenCache) memoryUsage() int {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.bytes
+}
+
+// evictBytes evicts the least recently seen IDs until at least n bytes are
+// freed or the cache is empty, and returns the number of IDs evicted and the
+// bytes freed. It does nothing if c is nil.
+func (c *seenCache) evictBytes(n int) (int, int) {
+	if c == nil {
+		return 0, 0
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	var evicted, freed int
+	for e := c.order.Back(); e != nil && freed < n; e = c.order.Back() {
+		freed += seenEntrySize(e.Value.(*seenEntry).id)
+		c.remove(e)
+		c.evictions++
+		evicted++
+	}
+	return evicted, freed
+}
+
+// seenCacheStatus reports the size and limits of a seenCache and the number
+// of IDs removed from it.
+type seenCacheStatus struct {
+	Size       int    `json:"size"`
+	MaxEntries int    `json:"max_entries"`
+	TTL        string `json:"ttl"`
+	Key        string `json:"key"`
+	ContentTTL string `json:"content_ttl,omitempty"`
+	Evictions  uint64 `json:"evictions"`
+	Expiries   uint64 `json:"expiries"`
+}
+
+func (c *seenCache) status() seenCacheStatus {
+	c.Lock()
+	defer c.Unlock()
+
+	status := seenCacheStatus{
+		Size:       c.order.Len(),
+		MaxEntries: c.maxEntries,
+		TTL:        c.ttl.String(),
+		Key:        c.key,
+		Evictions:  c.evictions,
+		Expiries:   c.expiries,
+	}
+	if c.key != dedupKeyID {
+		status.ContentTTL = c.contentTTL.String()
+	}
+	return status
+}
+
+// handle is the control handler for the "dedup-cache" command.
+func (c *seenCache) handle(args map[string]string) (interface{}, error) {
+	if c == nil {
+		return nil, fmt.Errorf("duplicate detection is disabled")
+	}
+	return c.status(), nil
+}
+
+// dedupCacheAction calls the "dedup-cache" control command on the running
+// daemon and prints the result.
+func dedupCacheAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "dedup-cache", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var status seenCacheStatus
+	if err := json.Unmarshal(result, &status); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	fmt.Fprintf(c.App.Writer, "size: %v/%v\n", status.Size, status.MaxEntries)
+	fmt.Fprintf(c.App.Writer, "key: %v\n", status.Key)
+	fmt.Fprintf(c.App.Writer, "ttl: %v\n", status.TTL)
+	if status.ContentTTL != "" {
+		fmt.Fprintf(c.App.Writer, "content window: %v\n", status.ContentTTL)
+	}
+	fmt.Fprintf(c.App.Writer, "evictions: %v\n", status.Evictions)
+	fmt.Fprintf(c.App.Writer, "expiries: %v\n", status.Expiries)
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestSeenCache(t *testing.T) {
+	now := time.Now()
+	c := newSeenCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	if c.seen("1") {
+		t.Error("1 seen before it was received")
+	}
+	if !c.seen("1") {
+		t.Error("duplicate 1 not detected")
+	}
+
+	// Adding a third ID evicts the least recently seen.
+	c.seen("2")
+	c.seen("1")
+	c.seen("3")
+	if !c.seen("1") {
+		t.Error("recently seen 1 evicted")
+	}
+	if c.seen("2") {
+		t.Error("2 not evicted")
+	}
+
+	// IDs expire once the TTL has passed since they were first seen.
+	now = now.Add(time.Minute)
+	if c.seen("1") {
+		t.Error("1 not expired")
+	}
+
+	got := c.status()
+	if got.Size != 1 || got.MaxEntries != 2 || got.Evictions != 2 || got.Expiries != 2 {
+		t.Errorf("unexpected status: %+v", got)
+	}
+}
+
+func TestSeenCacheDuplicate(t *testing.T) {
+	msg := func(id, directive, content string) *yggdrasil.Data {
+		return &yggdrasil.Data{Type: yggdrasil.MessageTypeData, MessageID: id, Directive: directive, Content: []byte(content)}
+	}
+
+	tests := []struct {
+		description string
+		key         string
+		first, next *yggdrasil.Data
+		wait        time.Duration
+		want        string
+	}{
+		{description: "id same id", key: dedupKeyID, first: msg("1", "echo", "a"), next: msg("1", "echo", "b"), want: dedupKeyID},
+		{description: "id same content", key: dedupKeyID, first: msg("1", "echo", "a"), next: msg("2", "echo", "a")},
+		{description: "content same content", key: dedupKeyContent, first: msg("1", "echo", "a"), next: msg("2", "echo", "a"), want: dedupKeyContent},
+		{description: "content same id", key: dedupKeyContent, first: msg("1", "echo", "a"), next: msg("1", "echo", "b")},
+		{description: "content other directive", key: dedupKeyContent, first: msg("1", "echo", "a"), next: msg("2", "cat", "a")},
+		{description: "content ambiguous fields", key: dedupKeyContent, first: msg("1", "echo", "ab"), next: msg("2", "echoa", "b")},
+		{description: "content outside window", key: dedupKeyContent, first: msg("1", "echo", "a"), next: msg("2", "echo", "a"), wait: time.Minute},
+		{description: "both same id", key: dedupKeyBoth, first: msg("1", "echo", "a"), next: msg("1", "echo", "b"), want: dedupKeyID},
+		{description: "both same content", key: dedupKeyBoth, first: msg("1", "echo", "a"), next: msg("2", "echo", "a"), want: dedupKeyContent},
+		{description: "both same id outside window", key: dedupKeyBoth, first: msg("1", "echo", "a"), next: msg("1", "echo", "a"), wait: time.Minute, want: dedupKeyID},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			now := time.Now()
+			c := newSeenCache(10, time.Hour)
+			c.key = test.key
+			c.contentTTL = time.Minute
+			c.now = func() time.Time { return now }
+
+			if got := c.duplicate(test.first); got != "" {
+				t.Fatalf("first message reported as duplicate by %v", got)
+			}
+			now = now.Add(test.wait)
+			if got := c.duplicate(test.next); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
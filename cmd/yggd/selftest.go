@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// A selfTestResult is the outcome of the startup self-test of a worker.
+type selfTestResult struct {
+	handler string
+	pid     int
+	elapsed time.Duration
+	err     error
+}
+
+// waitForRegistrations waits until at least n worker processes have
+// registered, until timeout elapses or until ctx is done.
+func (d *dispatcher) waitForRegistrations(ctx context.Context, n int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		d.RLock()
+		registered := len(d.pidHandlers)
+		d.RUnlock()
+		if registered >= n || time.Now().After(deadline) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// isRegistered returns true if the worker process pid has registered.
+func (d *dispatcher) isRegistered(pid int) bool {
+	d.RLock()
+	defer d.RUnlock()
+
+	_, registered := d.pidHandlers[pid]
+	return registered
+}
+
+// selfTest sends a self-test message to every registered worker using send, and
+// waits up to timeout, or until ctx is done, for each to respond. Workers that
+// fail are unregistered so that no messages are routed to them. The results are
+// returned sorted by handler.
+func (d *dispatcher) selfTest(ctx context.Context, timeout time.Duration, send func(w worker, data yggdrasil.Data) error) []selfTestResult {
+	d.RLock()
+	var workers []worker
+	for handler, w := range d.workers {
+		workers = append(workers, w)
+		workers = append(workers, d.pools[handler]...)
+	}
+	d.RUnlock()
+
+	results := make([]selfTestResult, len(workers))
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		wg.Add(1)
+		go func(i int, w worker) {
+			defer wg.Done()
+			start := time.Now()
+			err := d.selfTestWorker(ctx, w, timeout, send)
+			results[i] = selfTestResult{handler: w.handler, pid: w.pid, elapsed: time.Since(start), err: err}
+		}(i, w)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].handler != results[j].handler {
+			return results[i].handler < results[j].handler
+		}
+		return results[i].pid < results[j].pid
+	})
+
+	var failed bool
+	d.Lock()
+	for _, r := range results {
+		if r.err != nil {
+			d.removeWorker(r.handler, r.pid)
+			failed = true
+		}
+	}
+	d.Unlock()
+	if failed {
+		d.sendDispatchersMap()
+	}
+
+	return results
+}
+
+// selfTestWorker sends a self-test message to w and waits up to timeout for
+// it to respond. The message is sent with its content attached, even to a
+// worker that requires detached content. If ctx is done first, the self-test
+// is abandoned.
+func (d *dispatcher) selfTestWorker(ctx context.Context, w worker, timeout time.Duration, send func(w worker, data yggdrasil.Data) error) error {
+	data := yggdrasil.Data{
+		Type:      yggdrasil.MessageTypeData,
+		MessageID: uuid.New().String(),
+		Version:   1,
+		Sent:      time.Now(),
+		Directive: w.handler,
+		Metadata:  map[string]string{yggdrasil.SelfTestMetadataKey: yggdrasil.SelfTestPing},
+		Content:   []byte(`"` + yggdrasil.SelfTestPing + `"`),
+	}
+	w.detachedContent = false
+
+	responded := make(chan struct{})
+	d.Lock()
+	d.selfTests[data.MessageID] = responded
+	d.Unlock()
+	defer func() {
+		d.Lock()
+		delete(d.selfTests, data.MessageID)
+		d.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	sent := make(chan error, 1)
+	go func() { sent <- send(w, data) }()
+	select {
+	case err := <-sent:
+		if err != nil {
+			return fmt.Errorf("cannot send self-test message: %w", err)
+		}
+	case <-timer.C:
+		return fmt.Errorf("timed out sending self-test message after %v", timeout)
+	case <-ctx.Done():
+		return fmt.Errorf("self-test abandoned: %w", ctx.Err())
+	}
+
+	select {
+	case <-responded:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("self-test abandoned: %w", ctx.Err())
+	case <-timer.C:
+		return fmt.Errorf("no response to self-test message after %v", timeout)
+	}
+}
+
+// finishSelfTest records the response to the self-test message id. It returns
+// false if id is not an outstanding self-test message.
+func (d *dispatcher) finishSelfTest(id string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	responded, prs := d.selfTests[id]
+	if !prs {
+		return false
+	}
+	close(responded)
+	delete(d.selfTests, id)
+	return true
+}
+
+// logSelfTestResults logs results and returns the number of workers that
+// failed their self-test.
+func logSelfTestResults(results []selfTestResult) int {
+	var failed int
+	for _, r := range results {
+		if r.err != nil {
+			log.Errorf("worker %v (process %v) failed its self-test; excluding it: %v", r.handler, r.pid, r.err)
+			failed++
+			continue
+		}
+		log.Infof("worker %v (process %v) passed its self-test in %v", r.handler, r.pid, r.elapsed.Round(time.Millisecond))
+	}
+	log.Infof("self-test complete: %v of %v workers passed", len(results)-failed, len(results))
+	return failed
+}
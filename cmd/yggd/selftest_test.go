@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		description string
+		send        func(d *dispatcher, w worker, data yggdrasil.Data) error
+		wantPassed  bool
+	}{
+		{
+			description: "responds",
+			send: func(d *dispatcher, w worker, data yggdrasil.Data) error {
+				if data.Metadata[yggdrasil.SelfTestMetadataKey] != yggdrasil.SelfTestPing {
+					return errors.New("not a self-test message")
+				}
+				go d.Send(context.Background(), &pb.Data{MessageId: "r", ResponseTo: data.MessageID, Directive: w.handler})
+				return nil
+			},
+			wantPassed: true,
+		},
+		{
+			description: "no response",
+			send: func(d *dispatcher, w worker, data yggdrasil.Data) error {
+				return nil
+			},
+		},
+		{
+			description: "delivery fails",
+			send: func(d *dispatcher, w worker, data yggdrasil.Data) error {
+				return errors.New("connection refused")
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.workers["echo"] = worker{pid: 100, handler: "echo", detachedContent: true}
+			go func() {
+				for range d.dispatchers {
+				}
+			}()
+
+			results := d.selfTest(context.Background(), 100*time.Millisecond, func(w worker, data yggdrasil.Data) error {
+				if w.detachedContent {
+					return errors.New("self-test message sent as detached content")
+				}
+				return test.send(d, w, data)
+			})
+			if len(results) != 1 {
+				t.Fatalf("expected 1 result, got %v", len(results))
+			}
+			if passed := results[0].err == nil; passed != test.wantPassed {
+				t.Errorf("passed = %v, want %v (%v)", passed, test.wantPassed, results[0].err)
+			}
+			if _, registered := d.workers["echo"]; registered != test.wantPassed {
+				t.Errorf("registered = %v, want %v", registered, test.wantPassed)
+			}
+			if len(d.selfTests) != 0 {
+				t.Errorf("self-test messages left outstanding: %v", d.selfTests)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// shadowTrackerCapacity is the number of shadow message IDs retained so that
+// responses from shadow workers can be recognized and discarded.
+const shadowTrackerCapacity = 1024
+
+// maxConcurrentShadowDispatches bounds the number of copies being sent to
+// shadow workers at once. Copies beyond this limit are skipped so that a slow
+// shadow worker cannot hold up primary dispatch.
+const maxConcurrentShadowDispatches = 16
+
+// A shadowRoute designates a worker that receives a copy of a sampled fraction
+// of the messages for a directive.
+type shadowRoute struct {
+	handler string
+	rate    float64
+}
+
+// parseShadowRoutes parses values of the form "DIRECTIVE=HANDLER[:RATE]" into
+// a map of shadow routes keyed by directive. RATE is the fraction of messages
+// copied, between 0 and 1; it defaults to 1.
+func parseShadowRoutes(values []string) (map[string]shadowRoute, error) {
+	routes := make(map[string]shadowRoute)
+	for _, value := range values {
+		directive, target := splitPair(value, "=")
+		if directive == "" || target == "" {
+			return nil, fmt.Errorf("invalid shadow worker: %v", value)
+		}
+
+		route := shadowRoute{rate: 1}
+		route.handler = target
+		if i := strings.LastIndex(target, ":"); i >= 0 {
+			rate, err := strconv.ParseFloat(target[i+1:], 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid shadow worker sampling rate: %v", value)
+			}
+			route.handler = target[:i]
+			route.rate = rate
+		}
+		if route.handler == "" || route.handler == directive {
+			return nil, fmt.Errorf("invalid shadow worker: %v", value)
+		}
+
+		routes[directive] = route
+	}
+	return routes, nil
+}
+
+// splitPair splits s around the first instance of sep. If sep is not found,
+// the second value is empty.
+func splitPair(s, sep string) (string, string) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):]
+	}
+	return s, ""
+}
+
+// A shadowTracker remembers the message IDs of copies sent to shadow workers.
+type shadowTracker struct {
+	sync.Mutex
+	ids   map[string]bool
+	order []string
+}
+
+func newShadowTracker() *shadowTracker {
+	return &shadowTracker{ids: make(map[string]bool)}
+}
+
+// add records id, forgetting the oldest ID if the tracker is full.
+func (s *shadowTracker) add(id string) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.order) >= shadowTrackerCapacity {
+		delete(s.ids, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.ids[id] = true
+	s.order = append(s.order, id)
+}
+
+// has returns true if id was recorded.
+func (s *shadowTracker) has(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.ids[id]
+}
+
+// shadow sends a copy of data to the shadow worker configured for its
+// directive, if any and if the message is sampled. The copy is given a new
+// message ID, so responses to it can be discarded, and records the original
+// message ID in the "shadow_of" metadata key. Sending happens in the
+// background and never blocks the caller.
+func (d *dispatcher) shadow(data yggdrasil.Data) {
+	route, prs := d.shadows[data.Directive]
+	if !prs || rand.Float64() >= route.rate {
+		return
+	}
+
+	d.RLock()
+	w, prs := d.workers[route.handler]
+	d.RUnlock()
+	if !prs {
+		log.Debugf("shadow worker %v is not registered", route.handler)
+		return
+	}
+
+	select {
+	case d.shadowSem <- struct{}{}:
+	default:
+		log.Debugf("skipping shadow copy of message %v: too many shadow dispatches in progress", data.MessageID)
+		return
+	}
+
+	shadowed := data
+	shadowed.MessageID = uuid.New().String()
+	shadowed.Directive = route.handler
+	shadowed.Metadata = copyMetadata(data.Metadata)
+	shadowed.Metadata["shadow_of"] = data.MessageID
+	d.shadowIDs.add(shadowed.MessageID)
+
+	go func() {
+		defer func() { <-d.shadowSem }()
+		if err := d.sendToWorker(w, shadowed); err != nil {
+			log.Debugf("cannot send shadow copy of message %v: %v", data.MessageID, err)
+			return
+		}
+		log.Debugf("dispatched shadow copy %v of message %v to worker %v", shadowed.MessageID, data.MessageID, route.handler)
+	}()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseShadowRoutes(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		want        map[string]shadowRoute
+		wantError   bool
+	}{
+		{
+			description: "default rate",
+			input:       []string{"echo=echo-next"},
+			want:        map[string]shadowRoute{"echo": {handler: "echo-next", rate: 1}},
+		},
+		{
+			description: "sampled",
+			input:       []string{"echo=echo-next:0.25", "sleep=sleep-next:0"},
+			want: map[string]shadowRoute{
+				"echo":  {handler: "echo-next", rate: 0.25},
+				"sleep": {handler: "sleep-next", rate: 0},
+			},
+		},
+		{
+			description: "missing handler",
+			input:       []string{"echo="},
+			wantError:   true,
+		},
+		{
+			description: "invalid rate",
+			input:       []string{"echo=echo-next:2"},
+			wantError:   true,
+		},
+		{
+			description: "shadows itself",
+			input:       []string{"echo=echo"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseShadowRoutes(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(shadowRoute{})) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestShadowTracker(t *testing.T) {
+	s := newShadowTracker()
+	for i := 0; i <= shadowTrackerCapacity; i++ {
+		s.add(fmt.Sprint(i))
+	}
+
+	if s.has("0") {
+		t.Error("expected oldest ID to be forgotten")
+	}
+	if !s.has(fmt.Sprint(shadowTrackerCapacity)) {
+		t.Error("expected newest ID to be recorded")
+	}
+}
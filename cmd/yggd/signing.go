@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// signingInputVersion is the first field of the signing input of results,
+// identifying the canonicalization the signature was computed over.
+const signingInputVersion = "yggdrasil-result-signature-v1"
+
+// A resultSigner signs the results published by the client with the device's
+// private key, so that the backend can verify which device they came from.
+type resultSigner struct {
+	key   crypto.Signer
+	keyID string
+}
+
+// newResultSigner creates a resultSigner signing with the PEM-encoded private
+// key in keyFile. If keyID is empty, the key is identified by the SHA-256
+// fingerprint of its public key.
+func newResultSigner(keyFile string, keyID string) (*resultSigner, error) {
+	key, err := loadSigningKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if keyID == "" {
+		keyID, err = signingKeyID(key.Public())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &resultSigner{key: key, keyID: keyID}, nil
+}
+
+// loadSigningKey reads the first PEM-encoded RSA, ECDSA or Ed25519 private key
+// in file.
+func loadSigningKey(file string) (crypto.Signer, error) {
+	key, err := readPEMKey(file, map[string]func([]byte) (interface{}, error){
+		"RSA PRIVATE KEY": func(der []byte) (interface{}, error) { return x509.ParsePKCS1PrivateKey(der) },
+		"EC PRIVATE KEY":  func(der []byte) (interface{}, error) { return x509.ParseECPrivateKey(der) },
+		"PRIVATE KEY":     x509.ParsePKCS8PrivateKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot load signing key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("cannot load signing key: unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// readPEMKey parses the first block in the PEM-encoded file whose type has a
+// parser in parsers, skipping blocks of other types.
+func readPEMKey(file string, parsers map[string]func([]byte) (interface{}, error)) (interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key: %w", err)
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no key found in '%v'", file)
+		}
+		parse, ok := parsers[block.Type]
+		if !ok {
+			continue
+		}
+		key, err := parse(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse key: %w", err)
+		}
+		return key, nil
+	}
+}
+
+// signingKeyID returns the SHA-256 fingerprint of the DER-encoded public key
+// pub, as "sha256:" followed by the hex-encoded digest.
+func signingKeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// writeNetstring appends s to buf as a netstring: its length in bytes in
+// decimal, ":", s and ",".
+func writeNetstring(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+	buf.WriteByte(',')
+}
+
+// signingInput returns the canonical form of msg that its signature is
+// computed over. It is the concatenation of netstrings of, in order: version
+// (such as signingInputVersion), each of bound, the values outside msg that
+// the signature is bound to, the type, message ID, response_to, version, sent
+// time (formatted as RFC 3339 with nanoseconds, in the time zone of the
+// message), directive, origin and hops, the number of metadata entries
+// followed by each key and value sorted by key, and the content exactly as
+// encoded in the message.
+func signingInput(version string, msg yggdrasil.Data, bound ...string) []byte {
+	var buf bytes.Buffer
+	writeNetstring(&buf, version)
+	for _, field := range bound {
+		writeNetstring(&buf, field)
+	}
+	for _, field := range []string{
+		string(msg.Type),
+		msg.MessageID,
+		msg.ResponseTo,
+		strconv.Itoa(msg.Version),
+		msg.Sent.Format(time.RFC3339Nano),
+		msg.Directive,
+		msg.Origin,
+		strconv.Itoa(msg.Hops),
+		strconv.Itoa(len(msg.Metadata)),
+	} {
+		writeNetstring(&buf, field)
+	}
+
+	keys := make([]string, 0, len(msg.Metadata))
+	for k := range msg.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		writeNetstring(&buf, k)
+		writeNetstring(&buf, msg.Metadata[k])
+	}
+
+	writeNetstring(&buf, string(msg.Content))
+	return buf.Bytes()
+}
+
+// sign signs msg, setting its signature and key ID. The content of msg is
+// first replaced by its compact encoding, as it is published, so that the
+// signature covers the content as the backend receives it. It does nothing
+// if s is nil.
+func (s *resultSigner) sign(msg *yggdrasil.Data) error {
+	if s == nil {
+		return nil
+	}
+
+	content, err := json.Marshal(msg.Content)
+	if err != nil {
+		return fmt.Errorf("cannot marshal content: %w", err)
+	}
+	msg.Content = content
+	msg.Signature = ""
+	msg.KeyID = ""
+
+	input := signingInput(signingInputVersion, *msg)
+	var signature []byte
+	switch s.key.(type) {
+	case ed25519.PrivateKey:
+		signature, err = s.key.Sign(rand.Reader, input, crypto.Hash(0))
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		digest := sha256.Sum256(input)
+		signature, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return fmt.Errorf("cannot sign message: unsupported key type %T", s.key)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot sign message: %w", err)
+	}
+
+	msg.Signature = base64.StdEncoding.EncodeToString(signature)
+	msg.KeyID = s.keyID
+	return nil
+}
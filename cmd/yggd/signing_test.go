@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestSigningInput(t *testing.T) {
+	msg := yggdrasil.Data{
+		Type:       yggdrasil.MessageTypeData,
+		MessageID:  "2",
+		ResponseTo: "1",
+		Version:    1,
+		Sent:       time.Date(2021, 1, 12, 14, 58, 13, 0, time.UTC),
+		Directive:  "echo",
+		Metadata:   map[string]string{"b": "2", "a": "1"},
+		Content:    json.RawMessage(`{"x":1}`),
+	}
+	want := "29:yggdrasil-result-signature-v1,4:data,1:2,1:1,1:1,20:2021-01-12T14:58:13Z,4:echo,0:,1:0,1:2,1:a,1:1,1:b,1:2,7:{\"x\":1},"
+
+	if got := string(signingInput(signingInputVersion, msg)); got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+func TestResultSignerSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description string
+		block       *pem.Block
+		verify      func(input []byte, signature []byte) bool
+	}{
+		{
+			description: "rsa",
+			block:       &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)},
+			verify: func(input []byte, signature []byte) bool {
+				digest := sha256.Sum256(input)
+				return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], signature) == nil
+			},
+		},
+		{
+			description: "ecdsa",
+			block:       &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER},
+			verify: func(input []byte, signature []byte) bool {
+				var sig struct{ R, S *big.Int }
+				if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+					return false
+				}
+				digest := sha256.Sum256(input)
+				return ecdsa.Verify(&ecKey.PublicKey, digest[:], sig.R, sig.S)
+			},
+		},
+		{
+			description: "ed25519",
+			block:       &pem.Block{Type: "PRIVATE KEY", Bytes: edDER},
+			verify: func(input []byte, signature []byte) bool {
+				return ed25519.Verify(edKey.Public().(ed25519.PublicKey), input, signature)
+			},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			keyFile := filepath.Join(dir, test.description+".pem")
+			if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(test.block), 0600); err != nil {
+				t.Fatal(err)
+			}
+			s, err := newResultSigner(keyFile, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(s.keyID, "sha256:") {
+				t.Errorf("unexpected key ID %v", s.keyID)
+			}
+
+			msg := yggdrasil.Data{MessageID: "2", ResponseTo: "1", Content: json.RawMessage("{ \"x\": 1 }")}
+			if err := s.sign(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if string(msg.Content) != `{"x":1}` {
+				t.Errorf("content not compacted: %s", msg.Content)
+			}
+			if msg.KeyID != s.keyID {
+				t.Errorf("%v != %v", msg.KeyID, s.keyID)
+			}
+			signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unsigned := msg
+			unsigned.Signature, unsigned.KeyID = "", ""
+			if !test.verify(signingInput(signingInputVersion, unsigned), signature) {
+				t.Error("signature does not verify")
+			}
+		})
+	}
+}
+
+func TestNewResultSignerKeyID(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ioutil.TempFile("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if err := pem.Encode(file, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	s, err := newResultSigner(file.Name(), "device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.keyID != "device-1" {
+		t.Errorf("%v != device-1", s.keyID)
+	}
+
+	var nilSigner *resultSigner
+	msg := yggdrasil.Data{MessageID: "1"}
+	if err := nilSigner.sign(&msg); err != nil || msg.Signature != "" {
+		t.Errorf("nil signer signed message: %+v, %v", msg, err)
+	}
+}
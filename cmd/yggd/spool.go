@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil/internal"
+)
+
+// spoolFileExt is the extension of message files in the spool directory.
+const spoolFileExt = ".msg"
+
+// spoolQuarantineDir is the subdirectory of the spool directory that files
+// which cannot be read back are moved into.
+const spoolQuarantineDir = "quarantine"
+
+// spoolComponent names the spool in the disk state.
+const spoolComponent = "spool"
+
+// writeSpoolFile writes a spool file. It is replaced in tests.
+var writeSpoolFile = ioutil.WriteFile
+
+// A spoolKey is an AES-256 key used to encrypt spooled messages.
+type spoolKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// newSpoolKey derives an AES-256 key from secret. The key ID is derived from
+// the key so that files can be matched to the key that encrypted them without
+// revealing the key itself.
+func newSpoolKey(secret []byte) (*spoolKey, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+	key := sha256.Sum256(secret)
+	id := sha256.Sum256(key[:])
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cipher: %w", err)
+	}
+
+	return &spoolKey{id: hex.EncodeToString(id[:8]), aead: aead}, nil
+}
+
+// loadSpoolKeys reads the secrets from files and derives a key from each.
+// Any file may hold a dedicated key or a device secret.
+func loadSpoolKeys(files []string) ([]*spoolKey, error) {
+	keys := make([]*spoolKey, 0, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key file: %w", err)
+		}
+		key, err := newSpoolKey([]byte(strings.TrimSpace(string(data))))
+		if err != nil {
+			return nil, fmt.Errorf("cannot load key from '%v': %w", file, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// spoolFile is the on-disk representation of a spooled message.
+type spoolFile struct {
+	// Dest is the transport destination the message is sent to.
+	Dest string `json:"dest"`
+
+	// KeyID identifies the key that encrypted Data. It is empty if Data is
+	// not encrypted.
+	KeyID string `json:"key_id,omitempty"`
+
+	// Data is the message, encrypted if KeyID is set. When encrypted, the
+	// nonce is prepended to the ciphertext.
+	Data []byte `json:"data"`
+}
+
+// A spool stores messages that could not be sent on disk until they can be
+// sent. If keys are configured, messages are encrypted at rest with the first
+// key; any of the keys may decrypt a message, so a new key may be placed
+// first while messages encrypted with a previous key are flushed.
+type spool struct {
+	// last is the time in nanoseconds since the epoch that the most recent
+	// message was spooled at, as recorded in its file name. It is accessed
+	// atomically and kept first for alignment.
+	last int64
+
+	// retryAt is the time in nanoseconds since the epoch before which
+	// messages are dropped rather than written, after a write found the
+	// disk full. It is accessed atomically.
+	retryAt int64
+
+	dir  string
+	keys []*spoolKey
+	lock sync.Mutex
+
+	// diskFullAction is what put does when the disk is full: one of
+	// diskFullDrop, diskFullEvict or diskFullBlock. If empty, messages are
+	// dropped.
+	diskFullAction string
+
+	// maxSize is the size in bytes the spool files are kept within by
+	// removing the oldest, or 0 for no limit.
+	maxSize int64
+
+	// maxAge is the age after which spooled messages are removed rather than
+	// sent, or 0 to keep them until they are sent.
+	maxAge time.Duration
+}
+
+// newSpool creates a spool that stores messages in dir.
+func newSpool(dir string, keys []*spoolKey) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create directory: %w", err)
+	}
+	s := &spool{dir: dir, keys: keys}
+
+	// Messages spooled before a restart may carry later times than the
+	// wall clock now reads, as after booting with a clock that is behind.
+	names, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		if t, ok := spoolFileTime(names[len(names)-1]); ok {
+			s.last = t.UnixNano()
+		}
+	}
+	return s, nil
+}
+
+// spoolFileTime returns the time recorded in the name of a spool file, when
+// the message was spooled.
+func spoolFileTime(name string) (time.Time, bool) {
+	i := strings.Index(name, "-")
+	if i <= 0 {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(name[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// put writes data to the spool to be sent to dest later. If the disk is full,
+// put drops data, evicts the oldest messages to make room for it or waits for
+// room, depending on the spool's diskFullAction.
+func (s *spool) put(data []byte, dest string) error {
+	f := spoolFile{Dest: dest, Data: data}
+
+	if len(s.keys) > 0 {
+		key := s.keys[0]
+		nonce := make([]byte, key.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return fmt.Errorf("cannot generate nonce: %w", err)
+		}
+		f.KeyID = key.id
+		f.Data = key.aead.Seal(nonce, nonce, data, []byte(dest))
+	}
+
+	contents, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("cannot marshal spool file: %w", err)
+	}
+
+	// File names sort in the order the messages were spooled.
+	name := fmt.Sprintf("%020d-%v%v", internal.Stamp(&s.last), uuid.New().String(), spoolFileExt)
+	if err := s.makeRoom(name, int64(len(contents))); err != nil {
+		return err
+	}
+	for {
+		if time.Now().UnixNano() < atomic.LoadInt64(&s.retryAt) {
+			disk.full(spoolComponent, errDiskFull, true)
+			return fmt.Errorf("cannot write to file: %w", errDiskFull)
+		}
+
+		err := s.write(name, contents)
+		if err == nil {
+			disk.ok(spoolComponent)
+			return nil
+		}
+		if !isDiskFull(err) {
+			return err
+		}
+
+		switch s.diskFullAction {
+		case diskFullEvict:
+			evicted, evictErr := s.evictOldest(name)
+			if evictErr != nil {
+				log.Errorf("cannot evict spooled message: %v", evictErr)
+			}
+			if !evicted {
+				disk.full(spoolComponent, err, true)
+				return err
+			}
+			disk.full(spoolComponent, err, false)
+		case diskFullBlock:
+			disk.full(spoolComponent, err, false)
+			time.Sleep(diskFullRetryInterval)
+		default:
+			atomic.StoreInt64(&s.retryAt, time.Now().Add(diskFullRetryInterval).UnixNano())
+			disk.full(spoolComponent, err, true)
+			return err
+		}
+	}
+}
+
+// write writes contents to the spool file name, through a temporary file that
+// is removed if it cannot be written in full.
+func (s *spool) write(name string, contents []byte) error {
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := writeSpoolFile(tmp, contents, 0600); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot write to file: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot rename file: %w", err)
+	}
+	return nil
+}
+
+// evictOldest removes the oldest spooled message, unless it would be spooled
+// after the message to be spooled as name. It returns false if there is no
+// message to remove.
+func (s *spool) evictOldest(name string) (bool, error) {
+	names, err := s.list()
+	if err != nil {
+		return false, err
+	}
+	if len(names) == 0 || names[0] > name {
+		return false, nil
+	}
+	if err := os.Remove(filepath.Join(s.dir, names[0])); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("cannot remove file: %w", err)
+	}
+	log.Debugf("evicted spooled message '%v' to make room on a full disk", names[0])
+	metrics.add("spool_evicted_total", 1)
+	return true, nil
+}
+
+// makeRoom removes the oldest spooled messages until a file of size bytes,
+// spooled as name, fits within the spool's maxSize. Messages spooled
+// concurrently may take the spool over the limit until the next message is
+// spooled.
+func (s *spool) makeRoom(name string, size int64) error {
+	if s.maxSize <= 0 {
+		return nil
+	}
+	if size > s.maxSize {
+		return fmt.Errorf("message of %v bytes exceeds the spool maximum size of %v bytes", size, s.maxSize)
+	}
+
+	names, err := s.list()
+	if err != nil {
+		return err
+	}
+	sizes := make([]int64, len(names))
+	total := size
+	for i, n := range names {
+		info, err := os.Stat(filepath.Join(s.dir, n))
+		if err != nil {
+			continue
+		}
+		sizes[i] = info.Size()
+		total += sizes[i]
+	}
+
+	for i := 0; total > s.maxSize && i < len(names) && names[i] < name; i++ {
+		if err := os.Remove(filepath.Join(s.dir, names[i])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove file: %w", err)
+		}
+		log.Warnf("evicted spooled message '%v' to stay within the spool maximum size", names[i])
+		metrics.add("spool_evicted_total", 1)
+		total -= sizes[i]
+	}
+	return nil
+}
+
+// read reads and decrypts the spool file at path.
+func (s *spool) read(path string) ([]byte, string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot read file: %w", err)
+	}
+
+	var f spoolFile
+	if err := json.Unmarshal(contents, &f); err != nil {
+		return nil, "", fmt.Errorf("cannot unmarshal spool file: %w", err)
+	}
+
+	if f.KeyID == "" {
+		return f.Data, f.Dest, nil
+	}
+
+	for _, key := range s.keys {
+		if key.id != f.KeyID {
+			continue
+		}
+		size := key.aead.NonceSize()
+		if len(f.Data) < size {
+			return nil, "", fmt.Errorf("cannot decrypt data: ciphertext too short")
+		}
+		data, err := key.aead.Open(nil, f.Data[:size], f.Data[size:], []byte(f.Dest))
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot decrypt data: %w", err)
+		}
+		return data, f.Dest, nil
+	}
+
+	return nil, "", fmt.Errorf("no key with ID %v", f.KeyID)
+}
+
+// flush sends each spooled message, oldest first, using send. Messages that
+// are sent are removed from the spool, as are messages older than the spool's
+// maxAge, without being sent. Flushing stops at the first message
+// that cannot be sent. Files that cannot be read or decrypted are moved to the
+// quarantine directory so they do not block the messages behind them.
+func (s *spool) flush(send func(data []byte, dest string) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names, err := s.list()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+
+		if t, ok := spoolFileTime(name); ok && s.maxAge > 0 && time.Since(t) > s.maxAge {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("cannot remove file: %w", err)
+			}
+			log.Warnf("removed spooled message '%v' older than %v", name, s.maxAge)
+			metrics.add("spool_expired_total", 1)
+			continue
+		}
+
+		data, dest, err := s.read(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// The message was evicted to make room on a full disk.
+			continue
+		}
+		if err != nil {
+			log.Errorf("cannot read spooled message '%v': %v", name, err)
+			if err := s.quarantine(name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := send(data, dest); err != nil {
+			return fmt.Errorf("cannot send spooled message: %w", err)
+		}
+
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove file: %w", err)
+		}
+		log.Debugf("sent spooled message '%v'", name)
+	}
+
+	return nil
+}
+
+// list returns the names of the spooled message files, oldest first.
+func (s *spool) list() ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read contents of directory: %w", err)
+	}
+
+	names := make([]string, 0, len(fileInfos))
+	for _, info := range fileInfos {
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") && strings.HasSuffix(info.Name(), spoolFileExt) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// quarantine moves the spool file name aside into the quarantine directory.
+func (s *spool) quarantine(name string) error {
+	dir := filepath.Join(s.dir, spoolQuarantineDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+	if err := os.Rename(filepath.Join(s.dir, name), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("cannot move file to quarantine: %w", err)
+	}
+	log.Warnf("moved unreadable spooled message '%v' to %v", name, dir)
+	return nil
+}
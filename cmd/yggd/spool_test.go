@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type spooledMessage struct {
+	Data string
+	Dest string
+}
+
+func TestSpool(t *testing.T) {
+	oldKey, err := newSpoolKey([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := newSpoolKey([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		description    string
+		putKeys        [][]*spoolKey
+		flushKeys      []*spoolKey
+		want           []spooledMessage
+		wantQuarantine int
+	}{
+		{
+			description: "plaintext",
+			putKeys:     [][]*spoolKey{nil, nil},
+			want:        []spooledMessage{{"0", "data"}, {"1", "data"}},
+		},
+		{
+			description: "encrypted",
+			putKeys:     [][]*spoolKey{{newKey}},
+			flushKeys:   []*spoolKey{newKey},
+			want:        []spooledMessage{{"0", "data"}},
+		},
+		{
+			description: "rotated",
+			putKeys:     [][]*spoolKey{{oldKey}, {newKey, oldKey}},
+			flushKeys:   []*spoolKey{newKey, oldKey},
+			want:        []spooledMessage{{"0", "data"}, {"1", "data"}},
+		},
+		{
+			description:    "unknown key",
+			putKeys:        [][]*spoolKey{{oldKey}, {newKey}},
+			flushKeys:      []*spoolKey{newKey},
+			want:           []spooledMessage{{"1", "data"}},
+			wantQuarantine: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			for i, keys := range test.putKeys {
+				s, err := newSpool(dir, keys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.put([]byte(fmt.Sprint(i)), "data"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s, err := newSpool(dir, test.flushKeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []spooledMessage
+			if err := s.flush(func(data []byte, dest string) error {
+				got = append(got, spooledMessage{string(data), dest})
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+
+			remaining, err := s.list()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(remaining) != 0 {
+				t.Errorf("expected empty spool, got %v", remaining)
+			}
+
+			quarantined, _ := ioutil.ReadDir(filepath.Join(dir, spoolQuarantineDir))
+			if len(quarantined) != test.wantQuarantine {
+				t.Errorf("expected %v quarantined files, got %v", test.wantQuarantine, len(quarantined))
+			}
+		})
+	}
+}
+
+func TestSpoolFlushStopsOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.put([]byte(fmt.Sprint(i)), "data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.flush(func(data []byte, dest string) error {
+		return fmt.Errorf("offline")
+	}); err == nil {
+		t.Error("expected error")
+	}
+
+	remaining, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 2 {
+		t.Errorf("expected 2 spooled messages, got %v", len(remaining))
+	}
+}
+
+func TestSpoolOrderAfterClockStep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A message spooled before a restart, while the clock was a year ahead.
+	future := time.Now().Add(365 * 24 * time.Hour).UnixNano()
+	first, err := newSpool(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.last = future
+	if err := first.put([]byte("0"), "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newSpool(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.last <= future {
+		t.Errorf("expected the spool to resume after %v, got %v", future, s.last)
+	}
+	if err := s.put([]byte("1"), "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []spooledMessage
+	if err := s.flush(func(data []byte, dest string) error {
+		got = append(got, spooledMessage{string(data), dest})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []spooledMessage{{"0", "data"}, {"1", "data"}}; !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.put([]byte("0"), "data"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Room for two messages of the same size.
+	s.maxSize = 2 * info.Size()
+	for i := 1; i < 3; i++ {
+		if err := s.put([]byte(fmt.Sprint(i)), "data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.put(make([]byte, s.maxSize), "data"); err == nil {
+		t.Error("expected error for a message larger than the maximum size")
+	}
+
+	var got []spooledMessage
+	if err := s.flush(func(data []byte, dest string) error {
+		got = append(got, spooledMessage{string(data), dest})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []spooledMessage{{"1", "data"}, {"2", "data"}}; !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.maxAge = time.Minute
+	// A message spooled two minutes ago.
+	s.last = time.Now().Add(-2 * time.Minute).UnixNano()
+	name := fmt.Sprintf("%020d-old%v", s.last, spoolFileExt)
+	if err := s.write(name, []byte(`{"dest":"data","data":"MA=="}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.put([]byte("1"), "data"); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []spooledMessage
+	if err := s.flush(func(data []byte, dest string) error {
+		got = append(got, spooledMessage{string(data), dest})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []spooledMessage{{"1", "data"}}; !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+	remaining, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("expected no spooled messages, got %v", remaining)
+	}
+}
+
+func TestSpoolDiskFull(t *testing.T) {
+	tests := []struct {
+		action string
+		want   []string
+	}{
+		{action: diskFullDrop, want: []string{"0", "1"}},
+		{action: diskFullEvict, want: []string{"1", "2"}},
+		{action: diskFullBlock, want: []string{"1", "2"}},
+	}
+
+	defer func(writeFile func(string, []byte, os.FileMode) error, interval time.Duration, state *diskState) {
+		writeSpoolFile, diskFullRetryInterval, disk = writeFile, interval, state
+	}(writeSpoolFile, diskFullRetryInterval, disk)
+	diskFullRetryInterval = 10 * time.Millisecond
+
+	for _, test := range tests {
+		t.Run(test.action, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "yggd-test-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s, err := newSpool(dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.diskFullAction = test.action
+			disk = newDiskState()
+
+			// The disk has room for two messages.
+			writes := 0
+			writeSpoolFile = func(name string, data []byte, perm os.FileMode) error {
+				writes++
+				names, err := s.list()
+				if err != nil {
+					return err
+				}
+				if len(names) >= 2 {
+					return &os.PathError{Op: "write", Path: name, Err: syscall.ENOSPC}
+				}
+				return ioutil.WriteFile(name, data, perm)
+			}
+
+			for i := 0; i < 2; i++ {
+				if err := s.put([]byte(fmt.Sprint(i)), "data"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			done := make(chan error)
+			go func() { done <- s.put([]byte("2"), "data") }()
+			if test.action == diskFullBlock {
+				waitFor(t, func() bool { full, _ := disk.isFull(spoolComponent); return full })
+				names, err := s.list()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = <-done
+			if test.action == diskFullDrop {
+				if !isDiskFull(err) {
+					t.Errorf("expected a disk full error, got %v", err)
+				}
+				before := writes
+				if err := s.put([]byte("3"), "data"); !isDiskFull(err) {
+					t.Errorf("expected a disk full error, got %v", err)
+				}
+				if writes != before {
+					t.Error("expected no write before the retry interval")
+				}
+				if full, _ := disk.isFull(spoolComponent); !full {
+					t.Error("expected the spool to be degraded")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if full, _ := disk.isFull(spoolComponent); full {
+					t.Error("expected the spool to recover")
+				}
+			}
+
+			var got []string
+			if err := s.flush(func(data []byte, dest string) error {
+				got = append(got, string(data))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// processStart is the time the daemon started.
+var processStart = time.Now()
+
+// A startupAnnouncement publishes a "started" message to dest once the
+// daemon is operational.
+type startupAnnouncement struct {
+	dest  string
+	ready chan struct{}
+	once  sync.Once
+}
+
+func newStartupAnnouncement(dest string) *startupAnnouncement {
+	return &startupAnnouncement{dest: dest, ready: make(chan struct{})}
+}
+
+// connected records that the handshake completed. It does nothing if a is
+// nil.
+func (a *startupAnnouncement) connected() {
+	if a == nil {
+		return
+	}
+	a.once.Do(func() { close(a.ready) })
+}
+
+// Started creates a "started" message announcing that the workers started
+// and that the daemon took until now to become operational.
+func (c *Client) Started(workers []string) *yggdrasil.Started {
+	directives := make([]string, 0)
+	for directive := range c.d.Dispatchers() {
+		directives = append(directives, directive)
+	}
+	sort.Strings(directives)
+
+	sorted := append([]string{}, workers...)
+	sort.Strings(sorted)
+
+	msg := yggdrasil.Started{
+		Type:      yggdrasil.MessageTypeStarted,
+		MessageID: uuid.New().String(),
+		Version:   1,
+		Sent:      time.Now(),
+	}
+	msg.Content.ClientVersion = yggdrasil.Version
+	msg.Content.Workers = sorted
+	msg.Content.Directives = directives
+	msg.Content.BootTime = processStart
+	msg.Content.BootDuration = msg.Sent.Sub(processStart).Seconds()
+	return &msg
+}
+
+// AnnounceStartup waits for the first handshake to complete and then logs and
+// publishes a "started" message for workers, the workers started at boot. It
+// does nothing if no startup destination is configured.
+func (c *Client) AnnounceStartup(workers []string) error {
+	if c.startup == nil {
+		return nil
+	}
+	<-c.startup.ready
+
+	msg := c.Started(workers)
+	log.Infof("started in %.1fs with workers %v handling %v", msg.Content.BootDuration, msg.Content.Workers, msg.Content.Directives)
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("cannot marshal message: %w", err)
+	}
+	if err := c.sendAcknowledgedData(data, c.startup.dest); err != nil {
+		return fmt.Errorf("cannot publish started message: %w", err)
+	}
+	log.Debugf("published started message %v", msg.MessageID)
+	return nil
+}
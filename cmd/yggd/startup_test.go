@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestAnnounceStartup(t *testing.T) {
+	tr := &recordingTransport{}
+	c := Client{
+		t:       tr,
+		d:       newDispatcher(nil),
+		startup: newStartupAnnouncement("started"),
+		facts: &factsCache{collect: func() (*yggdrasil.CanonicalFacts, error) {
+			return &yggdrasil.CanonicalFacts{}, nil
+		}},
+	}
+
+	done := make(chan error)
+	go func() { done <- c.AnnounceStartup([]string{"b-worker", "a-worker"}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("expected to wait for the handshake, returned %v", err)
+	default:
+	}
+
+	if err := c.Handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	sent := tr.sent["started"]
+	if len(sent) != 1 {
+		t.Fatalf("expected a started message, sent %v", tr.sent)
+	}
+	var got yggdrasil.Started
+	if err := json.Unmarshal(sent[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != yggdrasil.MessageTypeStarted {
+		t.Errorf("unexpected type: %v", got.Type)
+	}
+	if want := []string{"a-worker", "b-worker"}; !cmp.Equal(got.Content.Workers, want) {
+		t.Errorf("%v != %v", got.Content.Workers, want)
+	}
+	if got.Content.BootDuration <= 0 || !got.Content.BootTime.Equal(processStart) {
+		t.Errorf("unexpected boot time: %v, %v", got.Content.BootTime, got.Content.BootDuration)
+	}
+	if !tr.options.WaitForAck {
+		t.Error("expected an acknowledged publish")
+	}
+
+	// A later handshake does not announce the startup again.
+	if err := c.Handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.sent["started"]) != 1 {
+		t.Errorf("expected one started message, sent %v", len(tr.sent["started"]))
+	}
+}
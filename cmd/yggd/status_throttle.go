@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// A statusThrottle bounds the rate at which connection-status messages are
+// published. A request made within interval of the last publish is deferred
+// until the interval has elapsed, and requests made while one is deferred are
+// coalesced into it. Since the message is created when it is published, the
+// coalesced publish carries the latest state. A forced request, such as one
+// for an explicit facts refresh, only waits for floor since the last publish,
+// bringing forward a publish already deferred for longer.
+type statusThrottle struct {
+	interval time.Duration
+	floor    time.Duration
+	publish  func()
+
+	lock sync.Mutex
+	last time.Time
+
+	// due is the time the deferred publish, if pending, is run at. gen
+	// identifies the timer of the deferred publish, so that one that fired
+	// after being replaced does not publish.
+	pending bool
+	due     time.Time
+	gen     uint64
+}
+
+func newStatusThrottle(interval time.Duration, floor time.Duration, publish func()) *statusThrottle {
+	if floor > interval {
+		floor = interval
+	}
+	return &statusThrottle{
+		interval: interval,
+		floor:    floor,
+		publish:  publish,
+	}
+}
+
+// request requests a publish, forced if force is true. It returns false if
+// the request was coalesced into a publish already scheduled.
+func (t *statusThrottle) request(force bool) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	min := t.interval
+	if force {
+		min = t.floor
+	}
+	now := time.Now()
+	due := t.last.Add(min)
+	if due.Before(now) {
+		due = now
+	}
+	if t.pending && !due.Before(t.due) {
+		metrics.add("connection_status_coalesced_total", 1)
+		return false
+	}
+
+	t.pending = true
+	t.due = due
+	t.gen++
+	gen := t.gen
+	time.AfterFunc(due.Sub(now), func() { t.run(gen) })
+	return true
+}
+
+// run publishes for the deferred publish identified by gen, unless it has
+// since been replaced.
+func (t *statusThrottle) run(gen uint64) {
+	t.lock.Lock()
+	if !t.pending || gen != t.gen {
+		t.lock.Unlock()
+		return
+	}
+	t.pending = false
+	t.last = time.Now()
+	t.lock.Unlock()
+
+	t.publish()
+}
+
+// mark records that a connection-status message was just published outside
+// the throttle, as during the handshake. It does nothing if t is nil.
+func (t *statusThrottle) mark() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.last = time.Now()
+	t.lock.Unlock()
+}
+
+// requestConnectionStatus publishes a connection-status message in the
+// background, through the throttle if publishes are throttled. If force is
+// true, the publish is only held back by the throttle's floor.
+func (c *Client) requestConnectionStatus(force bool) {
+	if c.statusThrottle != nil {
+		if !c.statusThrottle.request(force) {
+			log.Debug("connection status publish coalesced into one already scheduled")
+		}
+		return
+	}
+	go c.sendConnectionStatus()
+}
+
+// sendConnectionStatus publishes a connection-status message, logging a
+// failure.
+func (c *Client) sendConnectionStatus() {
+	if err := c.publishConnectionStatus(); err != nil {
+		log.Errorf("cannot send connection status message: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStatusThrottle(t *testing.T) {
+	tests := []struct {
+		description string
+		forced      []bool
+		want        []bool
+		wantRuns    int32
+	}{
+		{
+			description: "coalesced",
+			forced:      []bool{false, false, false},
+			want:        []bool{true, false, false},
+			wantRuns:    1,
+		},
+		{
+			description: "forced brings forward",
+			forced:      []bool{false, true, false},
+			want:        []bool{true, true, false},
+			wantRuns:    1,
+		},
+		{
+			description: "forced coalesced",
+			forced:      []bool{true, true},
+			want:        []bool{true, false},
+			wantRuns:    1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var runs int32
+			s := newStatusThrottle(50*time.Millisecond, 10*time.Millisecond, func() { atomic.AddInt32(&runs, 1) })
+			s.mark()
+
+			got := make([]bool, 0, len(test.forced))
+			for _, force := range test.forced {
+				got = append(got, s.request(force))
+			}
+			for i := range test.want {
+				if got[i] != test.want[i] {
+					t.Fatalf("request %v: got %v, want %v", i, got[i], test.want[i])
+				}
+			}
+			waitFor(t, func() bool { return atomic.LoadInt32(&runs) == test.wantRuns })
+			time.Sleep(100 * time.Millisecond)
+			if runs := atomic.LoadInt32(&runs); runs != test.wantRuns {
+				t.Errorf("%v runs, want %v", runs, test.wantRuns)
+			}
+		})
+	}
+}
+
+func TestStatusThrottleFloor(t *testing.T) {
+	var runs int32
+	s := newStatusThrottle(time.Hour, 100*time.Millisecond, func() { atomic.AddInt32(&runs, 1) })
+
+	s.request(false)
+	waitFor(t, func() bool { return atomic.LoadInt32(&runs) == 1 })
+
+	start := time.Now()
+	s.request(true)
+	waitFor(t, func() bool { return atomic.LoadInt32(&runs) == 2 })
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("forced publish ran after %v, before the floor", elapsed)
+	}
+}
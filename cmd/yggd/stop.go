@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A stopStep is a step of the sequence a worker process is stopped with: a
+// signal sent to it and how long to wait for it to exit before the next step.
+type stopStep struct {
+	signal syscall.Signal
+	wait   time.Duration
+}
+
+func (s stopStep) String() string {
+	return stopSignalName(s.signal)
+}
+
+// stopSignals are the signals a stop sequence may send, by name.
+var stopSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"KILL": syscall.SIGKILL,
+}
+
+// stopSignalName returns the name of sig, as in a stop sequence, prefixed
+// with "SIG".
+func stopSignalName(sig syscall.Signal) string {
+	for name, s := range stopSignals {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+// defaultStopSequence kills a worker process at once.
+var defaultStopSequence = []stopStep{{signal: syscall.SIGKILL}}
+
+// workerStopSequence is the sequence worker processes are stopped with,
+// unless their config sets their own.
+var workerStopSequence = defaultStopSequence
+
+// stopSequences holds the stop sequences of the running worker processes
+// whose config sets their own, by PID.
+var stopSequences sync.Map
+
+// stopPollInterval is how often a process is checked for having exited while
+// a stop sequence waits for it.
+var stopPollInterval = 100 * time.Millisecond
+
+// workersStopping is set once the daemon stops its workers to exit, after
+// which exited workers are not restarted. It is accessed atomically.
+var workersStopping int32
+
+// errWorkersStopping is returned by startProcess once the daemon stops its
+// workers to exit.
+var errWorkersStopping = errors.New("workers are stopping")
+
+// stoppingWorkers returns true once the daemon stops its workers to exit.
+func stoppingWorkers() bool {
+	return atomic.LoadInt32(&workersStopping) == 1
+}
+
+// parseStopSequence parses a stop sequence: a list of steps, each the name of
+// a signal (such as "TERM" or "SIGTERM") and, for all but the last step, how
+// long to wait for the process to exit after sending it (as in "TERM:10s").
+// The last step must be "KILL", so that the process is stopped in the end.
+func parseStopSequence(steps []string) ([]stopStep, error) {
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("cannot parse stop sequence: no steps")
+	}
+
+	sequence := make([]stopStep, 0, len(steps))
+	for i, s := range steps {
+		fields := strings.SplitN(s, ":", 2)
+		name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(fields[0])), "SIG")
+		sig, ok := stopSignals[name]
+		if !ok {
+			return nil, fmt.Errorf("cannot parse stop sequence: unsupported signal: %v", fields[0])
+		}
+		step := stopStep{signal: sig}
+
+		last := i == len(steps)-1
+		switch {
+		case last && (sig != syscall.SIGKILL || len(fields) == 2):
+			return nil, fmt.Errorf("cannot parse stop sequence: the last step must be KILL, without a wait")
+		case !last && sig == syscall.SIGKILL:
+			return nil, fmt.Errorf("cannot parse stop sequence: KILL must be the last step")
+		case !last:
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("cannot parse stop sequence: missing wait after %v", fields[0])
+			}
+			wait, err := time.ParseDuration(fields[1])
+			if err != nil || wait <= 0 {
+				return nil, fmt.Errorf("cannot parse stop sequence: invalid wait: %v", fields[1])
+			}
+			step.wait = wait
+		}
+		sequence = append(sequence, step)
+	}
+	return sequence, nil
+}
+
+// killProcess stops the process pid with its stop sequence: each step sends
+// its signal and waits for the process to exit, until the last one kills it.
+// The step that stopped the process is logged.
+func killProcess(pid int) error {
+	process, err := os.FindProcess(int(pid))
+	if err != nil {
+		return fmt.Errorf("cannot find process with pid: %w", err)
+	}
+
+	logger := processLogger(pid)
+	steps := workerStopSequence
+	if v, ok := stopSequences.Load(pid); ok {
+		steps = v.([]stopStep)
+	}
+	for i, step := range steps {
+		if err := process.Signal(step.signal); err != nil {
+			if i == 0 {
+				logger.Errorf("cannot kill process: %v", err)
+			} else {
+				// It exited after the previous step's wait ran out.
+				logger.Infof("process %v stopped after %v", pid, steps[i-1])
+			}
+			return nil
+		}
+		if i == len(steps)-1 {
+			break
+		}
+		logger.Debugf("sent %v to process %v; waiting up to %v for it to exit", step, pid, step.wait)
+		if waitForExit(pid, step.wait) {
+			logger.Infof("process %v stopped after %v (step %v of %v)", pid, step, i+1, len(steps))
+			return nil
+		}
+	}
+	if len(steps) > 1 {
+		logger.Infof("killed process %v: it did not exit after %v", pid, steps[len(steps)-2])
+	} else {
+		logger.Infof("killed process %v", pid)
+	}
+	return nil
+}
+
+// waitForExit waits up to timeout for the process pid to exit and returns
+// true if it did.
+func waitForExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processRunning(pid) {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(stopPollInterval)
+	}
+	return true
+}
+
+// stopWorkers stops the workers, without restarting them, for the daemon to
+// exit.
+func stopWorkers() error {
+	atomic.StoreInt32(&workersStopping, 1)
+	return killWorkers()
+}
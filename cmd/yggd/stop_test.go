@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseStopSequence(t *testing.T) {
+	tests := []struct {
+		description string
+		input       []string
+		want        []stopStep
+		wantError   bool
+	}{
+		{
+			description: "kill",
+			input:       []string{"KILL"},
+			want:        []stopStep{{signal: syscall.SIGKILL}},
+		},
+		{
+			description: "escalation",
+			input:       []string{"SIGTERM:10s", "usr1:5s", "KILL"},
+			want:        []stopStep{{syscall.SIGTERM, 10 * time.Second}, {syscall.SIGUSR1, 5 * time.Second}, {signal: syscall.SIGKILL}},
+		},
+		{
+			description: "empty",
+			wantError:   true,
+		},
+		{
+			description: "not ending with kill",
+			input:       []string{"TERM:10s"},
+			wantError:   true,
+		},
+		{
+			description: "kill before the end",
+			input:       []string{"KILL:1s", "KILL"},
+			wantError:   true,
+		},
+		{
+			description: "missing wait",
+			input:       []string{"TERM", "KILL"},
+			wantError:   true,
+		},
+		{
+			description: "wait on the last step",
+			input:       []string{"TERM:10s", "KILL:1s"},
+			wantError:   true,
+		},
+		{
+			description: "unsupported signal",
+			input:       []string{"STOP:1s", "KILL"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseStopSequence(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want, cmp.AllowUnexported(stopStep{})) {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestKillProcessEscalation(t *testing.T) {
+	defer func(interval time.Duration) { stopPollInterval = interval }(stopPollInterval)
+	stopPollInterval = 10 * time.Millisecond
+
+	sequence := []stopStep{{syscall.SIGTERM, 200 * time.Millisecond}, {syscall.SIGUSR1, 5 * time.Second}, {signal: syscall.SIGKILL}}
+	tests := []struct {
+		description string
+		script      string
+		want        string
+	}{
+		{
+			description: "stopped by the first step",
+			script:      "trap 'exit 3' TERM; while :; do sleep 0.01; done",
+			want:        "exit status 3",
+		},
+		{
+			description: "stopped by the second step",
+			script:      "trap '' TERM; trap 'exit 4' USR1; while :; do sleep 0.01; done",
+			want:        "exit status 4",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", test.script)
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+			// Let the shell set its traps.
+			time.Sleep(100 * time.Millisecond)
+
+			stopSequences.Store(cmd.Process.Pid, sequence)
+			defer stopSequences.Delete(cmd.Process.Pid)
+			if err := killProcess(cmd.Process.Pid); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case err := <-exited:
+				if err == nil || err.Error() != test.want {
+					t.Errorf("%v != %v", err, test.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected the process to have exited")
+			}
+		})
+	}
+}
+
+func TestStartProcessWhileStopping(t *testing.T) {
+	defer atomic.StoreInt32(&workersStopping, atomic.LoadInt32(&workersStopping))
+	atomic.StoreInt32(&workersStopping, 1)
+
+	// No worker is started once the daemon stops its workers, whether it is
+	// started or restarted after a delay.
+	for _, delay := range []time.Duration{0, 10 * time.Millisecond} {
+		if _, err := startProcess("/bin/true", nil, delay, make(chan int, 1)); !errors.Is(err, errWorkersStopping) {
+			t.Errorf("delay %v: %v != %v", delay, err, errWorkersStopping)
+		}
+	}
+}
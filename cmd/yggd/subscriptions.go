@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/redhatinsights/yggdrasil/internal/transport"
+	"github.com/urfave/cli/v2"
+)
+
+// A subscriptionStatus describes a subscription of the transport and the
+// type of the messages the client handles from it, or "unsupported" if it
+// does not handle them.
+type subscriptionStatus struct {
+	transport.Subscription
+	Type string `json:"type"`
+}
+
+// handleSubscriptions is the control handler for the "subscriptions" command.
+// It reports the state of the transport's subscriptions.
+func (c *Client) handleSubscriptions(args map[string]string) (interface{}, error) {
+	r, ok := c.t.(transport.SubscriptionReporter)
+	if !ok {
+		return nil, fmt.Errorf("transport does not subscribe to topics")
+	}
+
+	statuses := make([]subscriptionStatus, 0)
+	for _, s := range r.Subscriptions() {
+		statuses = append(statuses, subscriptionStatus{Subscription: s, Type: c.destMessageType(s.Dest)})
+	}
+	return statuses, nil
+}
+
+// destMessageType returns the type of the messages the client handles from
+// dest.
+func (c *Client) destMessageType(dest string) string {
+	switch {
+	case dest == "":
+		return ""
+	case c.desiredState != nil && dest == c.desiredState.dest:
+		return string(yggdrasil.MessageTypeDesiredState)
+	case dest == "data":
+		return string(yggdrasil.MessageTypeData)
+	case dest == "control":
+		return string(yggdrasil.MessageTypeCommand)
+	default:
+		return "unsupported"
+	}
+}
+
+// subscriptionsAction calls the "subscriptions" control command on the
+// running daemon and prints the state of each subscription, either as a table
+// or as JSON.
+func subscriptionsAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "subscriptions", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var subscriptions []subscriptionStatus
+	if err := json.Unmarshal(result, &subscriptions); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(subscriptions, "", "  ")
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot marshal subscriptions: %w", err), 1)
+		}
+		fmt.Fprintln(c.App.Writer, string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.App.Writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tTYPE\tSTATE\tQOS\tSINCE")
+	for _, s := range subscriptions {
+		qos := "-"
+		if s.QoS != nil {
+			qos = fmt.Sprint(*s.QoS)
+		}
+		since := "-"
+		if s.Since != nil {
+			since = fmt.Sprintf("%v ago", time.Since(*s.Since).Round(time.Second))
+		}
+		typ := s.Type
+		if typ == "" {
+			typ = "-"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", s.Topic, typ, s.State, qos, since)
+	}
+	if err := w.Flush(); err != nil {
+		return cli.Exit(fmt.Errorf("cannot write subscriptions: %w", err), 1)
+	}
+
+	return nil
+}
@@ -3,7 +3,16 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
 )
 
 func newTLSConfig(certPEMBlock []byte, keyPEMBlock []byte, CARootPEMBlocks [][]byte) (*tls.Config, error) {
@@ -29,3 +38,316 @@ func newTLSConfig(certPEMBlock []byte, keyPEMBlock []byte, CARootPEMBlocks [][]b
 
 	return config, nil
 }
+
+// loadTLSConfig reads the PEM-encoded certificate, key and certificate
+// authority files and creates a TLS config from them. The certificate and key
+// are only loaded if both files are given.
+func loadTLSConfig(certFile string, keyFile string, CARootFiles []string) (*tls.Config, error) {
+	var certData, keyData []byte
+	if certFile != "" && keyFile != "" {
+		var err error
+		certData, err = ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read certificate file: %w", err)
+		}
+		keyData, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key file: %w", err)
+		}
+		keyData, err = decryptKeyPEM(keyData, os.Getenv(keyPasswordEnv))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt key file: %w", err)
+		}
+	}
+	rootCAs := make([][]byte, 0)
+	for _, file := range CARootFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read certificate authority: %w", err)
+		}
+		rootCAs = append(rootCAs, data)
+	}
+	return newTLSConfig(certData, keyData, rootCAs)
+}
+
+// keyPasswordEnv is the environment variable holding the password of an
+// encrypted private key.
+const keyPasswordEnv = "YGG_KEY_PASSWORD"
+
+// decryptKeyPEM returns the PEM-encoded private key keyPEMBlock, decrypted
+// with password if it is encrypted. An unencrypted key is returned as is.
+// Only the legacy PEM encryption written by "openssl rsa -aes256" and the
+// like is supported.
+func decryptKeyPEM(keyPEMBlock []byte, password string) ([]byte, error) {
+	block, _ := pem.Decode(keyPEMBlock)
+	if block == nil || !x509.IsEncryptedPEMBlock(block) {
+		return keyPEMBlock, nil
+	}
+	if password == "" {
+		return nil, fmt.Errorf("key is encrypted but %v is not set", keyPasswordEnv)
+	}
+	der, err := x509.DecryptPEMBlock(block, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), nil
+}
+
+// certExpiryLogInterval is how often a tlsLoader logs that a certificate is
+// close to expiry, however often it is loaded.
+const certExpiryLogInterval = 24 * time.Hour
+
+// certExpiryCheckInterval is how often a tlsLoader checks the expiry of the
+// certificates it last loaded, so that an approaching expiry is reported even
+// if the certificates are not loaded again.
+const certExpiryCheckInterval = time.Hour
+
+// The kinds of certificate whose expiry a tlsLoader reports.
+const (
+	certKindClient = "client"
+	certKindCA     = "ca"
+)
+
+// A tlsLoader creates TLS configs from certificate, key and certificate
+// authority files, reading the files each time so that rotated files are
+// picked up. It logs a warning when the client certificate or a certificate
+// authority expires within expiryWarning, and an error once it has expired.
+// If alert is set, it is also called, at the same rate, to publish an alert.
+// Alerts are only published by watchExpiry, never while loading, as a config
+// is loaded while connecting and publishing may wait for the connection.
+type tlsLoader struct {
+	certFile      string
+	keyFile       string
+	caRootFiles   []string
+	expiryWarning time.Duration
+	alert         func(kind string, file string, notAfter time.Time) error
+
+	lock      sync.Mutex
+	logged    time.Time
+	caLogged  time.Time
+	alerted   time.Time
+	caAlerted time.Time
+	notAfter  time.Time
+	caExpiry  caExpiry
+	now       func() time.Time
+
+	// loaded wakes watchExpiry to check the certificates just loaded.
+	loaded chan struct{}
+}
+
+// A caExpiry is the expiry time of the certificate authority that expires
+// first, and the file it was read from.
+type caExpiry struct {
+	file     string
+	notAfter time.Time
+}
+
+func newTLSLoader(certFile string, keyFile string, caRootFiles []string, expiryWarning time.Duration) *tlsLoader {
+	return &tlsLoader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		caRootFiles:   caRootFiles,
+		expiryWarning: expiryWarning,
+		now:           time.Now,
+		loaded:        make(chan struct{}, 1),
+	}
+}
+
+// load reads the files and creates a TLS config from them.
+func (l *tlsLoader) load() (*tls.Config, error) {
+	config, err := loadTLSConfig(l.certFile, l.keyFile, l.caRootFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter, ok, err := certificateExpiry(config)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := caRootExpiry(l.caRootFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	l.lock.Lock()
+	l.notAfter = notAfter
+	l.caExpiry = ca
+	l.lock.Unlock()
+
+	if ok {
+		l.warnExpiry(certKindClient, l.certFile, notAfter, &l.logged, &l.alerted, false)
+	}
+	if ca.file != "" {
+		l.warnExpiry(certKindCA, ca.file, ca.notAfter, &l.caLogged, &l.caAlerted, false)
+	}
+	select {
+	case l.loaded <- struct{}{}:
+	default:
+	}
+	return config, nil
+}
+
+// checkExpiry logs if notAfter, the expiry time of the certificate, is within
+// the expiry warning, at most once per certExpiryLogInterval.
+func (l *tlsLoader) checkExpiry(notAfter time.Time) {
+	l.warnExpiry(certKindClient, l.certFile, notAfter, &l.logged, &l.alerted, true)
+}
+
+// checkCAExpiry logs if ca, the certificate authority that expires first, is
+// within the expiry warning, at most once per certExpiryLogInterval.
+func (l *tlsLoader) checkCAExpiry(ca caExpiry) {
+	l.warnExpiry(certKindCA, ca.file, ca.notAfter, &l.caLogged, &l.caAlerted, true)
+}
+
+// warnExpiry logs if notAfter, the expiry time of the certificate of kind
+// read from file, is within the expiry warning, unless it last did so at
+// logged, within certExpiryLogInterval. Likewise, if publish is true, it calls
+// alert unless it last did so successfully at alerted.
+func (l *tlsLoader) warnExpiry(kind string, file string, notAfter time.Time, logged *time.Time, alerted *time.Time, publish bool) {
+	l.lock.Lock()
+	now := l.now()
+	remaining := notAfter.Sub(now)
+	if remaining > l.expiryWarning {
+		l.lock.Unlock()
+		return
+	}
+	warn := now.Sub(*logged) >= certExpiryLogInterval
+	if warn {
+		*logged = now
+	}
+	alert := publish && l.alert != nil && now.Sub(*alerted) >= certExpiryLogInterval
+	l.lock.Unlock()
+
+	if warn {
+		name := "certificate"
+		if kind == certKindCA {
+			name = "certificate authority"
+		}
+		if remaining <= 0 {
+			log.Errorf("%v %v expired at %v", name, file, notAfter.Format(time.RFC3339))
+		} else {
+			log.Warnf("%v %v expires in %v, at %v", name, file, remaining.Round(time.Hour), notAfter.Format(time.RFC3339))
+		}
+	}
+	if alert {
+		// An alert that cannot be published is retried at the next check.
+		if err := l.alert(kind, file, notAfter); err != nil {
+			log.Debugf("cannot publish certificate expiry alert: %v", err)
+			return
+		}
+		l.lock.Lock()
+		*alerted = now
+		l.lock.Unlock()
+	}
+}
+
+// watchExpiry checks the expiry of the certificates last loaded now, every
+// certExpiryCheckInterval after and each time certificates are loaded,
+// publishing the alerts that are due.
+func (l *tlsLoader) watchExpiry() {
+	for {
+		l.lock.Lock()
+		notAfter, ca := l.notAfter, l.caExpiry
+		l.lock.Unlock()
+
+		if !notAfter.IsZero() {
+			l.checkExpiry(notAfter)
+		}
+		if ca.file != "" {
+			l.checkCAExpiry(ca)
+		}
+
+		select {
+		case <-time.After(certExpiryCheckInterval):
+		case <-l.loaded:
+		}
+	}
+}
+
+// certExpiryTimestamp returns the expiry time of the client certificate last
+// loaded, in seconds since the epoch, or 0 if there is none.
+func (l *tlsLoader) certExpiryTimestamp() float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.notAfter.IsZero() {
+		return 0
+	}
+	return float64(l.notAfter.Unix())
+}
+
+// caExpiryTimestamp returns the expiry time of the certificate authority last
+// loaded that expires first, in seconds since the epoch, or 0 if there is
+// none.
+func (l *tlsLoader) caExpiryTimestamp() float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.caExpiry.file == "" {
+		return 0
+	}
+	return float64(l.caExpiry.notAfter.Unix())
+}
+
+// certificateExpiry returns the expiry time of the client certificate in
+// config, or false if config has none.
+func certificateExpiry(config *tls.Config) (time.Time, bool, error) {
+	if len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return time.Time{}, false, nil
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("cannot parse certificate: %w", err)
+	}
+	return cert.NotAfter, true, nil
+}
+
+// caRootExpiry returns the expiry of the certificate authority in the
+// PEM-encoded files that expires first. The file of the returned caExpiry is
+// empty if the files hold no certificate.
+func caRootExpiry(files []string) (caExpiry, error) {
+	var first caExpiry
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return caExpiry{}, fmt.Errorf("cannot read certificate authority: %w", err)
+		}
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				// Like the certificate pool, skip certificates that
+				// cannot be parsed.
+				continue
+			}
+			if first.file == "" || cert.NotAfter.Before(first.notAfter) {
+				first = caExpiry{file: file, notAfter: cert.NotAfter}
+			}
+		}
+	}
+	return first, nil
+}
+
+// PublishCertExpiry publishes a certificate-expiry message for the
+// certificate of kind read from file, which expires at notAfter, to the
+// certificate expiry destination.
+func (c *Client) PublishCertExpiry(kind string, file string, notAfter time.Time) error {
+	msg := yggdrasil.CertExpiry{
+		Type:      yggdrasil.MessageTypeCertExpiry,
+		MessageID: uuid.New().String(),
+		Version:   1,
+		Sent:      time.Now(),
+	}
+	msg.Content.Certificate = kind
+	msg.Content.File = file
+	msg.Content.NotAfter = notAfter
+	msg.Content.Expired = !notAfter.After(msg.Sent)
+	return c.sendMessage(&msg, c.certExpiryDest)
+}
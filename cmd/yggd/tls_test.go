@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCertificateExpiry(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    notAfter.Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := certificateExpiry(&tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !got.Equal(notAfter) {
+		t.Errorf("got %v, %v, want %v", got, ok, notAfter)
+	}
+
+	if _, ok, err := certificateExpiry(&tls.Config{}); ok || err != nil {
+		t.Errorf("expected no expiry without a certificate, got %v, %v", ok, err)
+	}
+}
+
+func TestCheckExpiry(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		description string
+		notAfter    time.Time
+		logged      time.Time
+		wantLogged  time.Time
+	}{
+		{
+			description: "not expiring",
+			notAfter:    now.Add(60 * 24 * time.Hour),
+		},
+		{
+			description: "expiring",
+			notAfter:    now.Add(24 * time.Hour),
+			wantLogged:  now,
+		},
+		{
+			description: "expired",
+			notAfter:    now.Add(-time.Hour),
+			wantLogged:  now,
+		},
+		{
+			description: "logged recently",
+			notAfter:    now.Add(24 * time.Hour),
+			logged:      now.Add(-time.Hour),
+			wantLogged:  now.Add(-time.Hour),
+		},
+		{
+			description: "logged yesterday",
+			notAfter:    now.Add(24 * time.Hour),
+			logged:      now.Add(-certExpiryLogInterval),
+			wantLogged:  now,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			l := newTLSLoader("cert.pem", "key.pem", nil, 30*24*time.Hour)
+			l.now = func() time.Time { return now }
+			l.logged = test.logged
+
+			l.checkExpiry(test.notAfter)
+
+			if !l.logged.Equal(test.wantLogged) {
+				t.Errorf("logged at %v, want %v", l.logged, test.wantLogged)
+			}
+		})
+	}
+}
+
+func TestCARootExpiry(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(notAfter time.Time) []byte {
+		template := x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			NotBefore:    notAfter.Add(-time.Hour),
+			NotAfter:     notAfter,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+
+	first := time.Date(2029, 6, 1, 0, 0, 0, 0, time.UTC)
+	dir, err := ioutil.TempDir("", "yggd-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "bundle.pem")
+	if err := ioutil.WriteFile(bundle, append(encode(first.AddDate(1, 0, 0)), encode(first)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "other.pem")
+	if err := ioutil.WriteFile(other, encode(first.AddDate(2, 0, 0)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := caRootExpiry([]string{other, bundle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.file != bundle || !got.notAfter.Equal(first) {
+		t.Errorf("got %v at %v, want %v at %v", got.file, got.notAfter, bundle, first)
+	}
+
+	if got, err := caRootExpiry(nil); err != nil || got.file != "" {
+		t.Errorf("expected no expiry without certificate authorities, got %v, %v", got, err)
+	}
+}
+
+func TestCheckExpiryAlert(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newTLSLoader("cert.pem", "key.pem", nil, 30*24*time.Hour)
+	l.now = func() time.Time { return now }
+
+	var alerts []string
+	var alertErr error
+	l.alert = func(kind string, file string, notAfter time.Time) error {
+		if alertErr != nil {
+			return alertErr
+		}
+		alerts = append(alerts, kind+" "+file)
+		return nil
+	}
+
+	// Certificates being loaded are only logged; the alert is left for
+	// watchExpiry to publish.
+	l.warnExpiry(certKindClient, l.certFile, now.Add(24*time.Hour), &l.logged, &l.alerted, false)
+	if len(alerts) != 0 {
+		t.Fatalf("expected no alert while loading, got %v", alerts)
+	}
+
+	alertErr = errors.New("not connected")
+	l.checkExpiry(now.Add(24 * time.Hour))
+	if len(alerts) != 0 || !l.alerted.IsZero() {
+		t.Fatalf("expected a failed alert not to be recorded, got %v", alerts)
+	}
+
+	alertErr = nil
+	l.checkExpiry(now.Add(24 * time.Hour))
+	l.checkCAExpiry(caExpiry{file: "ca.pem", notAfter: now.Add(-time.Hour)})
+	l.checkExpiry(now.Add(24 * time.Hour))
+	if want := []string{"client cert.pem", "ca ca.pem"}; !cmp.Equal(alerts, want) {
+		t.Errorf("got alerts %v, want %v", alerts, want)
+	}
+}
+
+func TestDecryptKeyPEM(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	block, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte("hunter2"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := pem.EncodeToMemory(block)
+
+	tests := []struct {
+		description string
+		input       []byte
+		password    string
+		wantError   bool
+	}{
+		{
+			description: "unencrypted",
+			input:       plain,
+		},
+		{
+			description: "encrypted",
+			input:       encrypted,
+			password:    "hunter2",
+		},
+		{
+			description: "wrong password",
+			input:       encrypted,
+			password:    "hunter3",
+			wantError:   true,
+		},
+		{
+			description: "no password",
+			input:       encrypted,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := decryptKeyPEM(test.input, test.password)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, plain) {
+				t.Errorf("%q != %q", got, plain)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// traceparentMetadataKey is the metadata key of a data message's W3C trace
+// context.
+const traceparentMetadataKey = "traceparent"
+
+// traceExportInterval is how often finished spans are pushed to the
+// collector, and maxQueuedSpans the number of finished spans held between
+// pushes. Spans finished while the queue is full are dropped.
+const (
+	traceExportInterval = 5 * time.Second
+	maxQueuedSpans      = 2048
+)
+
+// traceContextCapacity is the number of dispatched messages whose trace
+// context is retained so that the worker's response can be linked to it.
+const traceContextCapacity = 1024
+
+// A spanContext identifies a span within a trace.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent parses a W3C traceparent header value.
+func parseTraceparent(value string) (spanContext, error) {
+	var sc spanContext
+	fields := strings.Split(value, "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return sc, fmt.Errorf("invalid traceparent: %v", value)
+	}
+	if len(fields[1]) != 32 || len(fields[2]) != 16 || len(fields[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent: %v", value)
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(fields[1])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent: %v", value)
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(fields[2])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent: %v", value)
+	}
+	flags, err := strconv.ParseUint(fields[3], 16, 8)
+	if err != nil {
+		return sc, fmt.Errorf("invalid traceparent: %v", value)
+	}
+	if sc.traceID == [16]byte{} || sc.spanID == [8]byte{} {
+		return sc, fmt.Errorf("invalid traceparent: %v", value)
+	}
+	sc.sampled = flags&1 == 1
+	return sc, nil
+}
+
+// traceparent formats sc as a W3C traceparent header value.
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// A span records one stage of the processing of a message.
+type span struct {
+	t          *tracer
+	name       string
+	ctx        spanContext
+	parent     [8]byte
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        string
+}
+
+// finish ends s, recording err if it is not nil, and queues it for export if
+// it is sampled. It does nothing if s is nil.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	// The end time is derived from the monotonic clock, so that the span
+	// keeps its duration if the wall clock changes while it runs.
+	s.end = s.start.Add(time.Since(s.start))
+	if err != nil {
+		s.err = err.Error()
+	}
+	if s.ctx.sampled {
+		s.t.queue(s)
+	}
+}
+
+// set sets the attribute key of s to value. It does nothing if s is nil.
+func (s *span) set(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// traceparent returns the trace context of s as a traceparent header value.
+func (s *span) traceparent() string {
+	return s.ctx.traceparent()
+}
+
+// A tracer creates spans for the stages of the message pipeline and pushes
+// the sampled ones to an OpenTelemetry collector using the OTLP HTTP protocol
+// with JSON encoding.
+type tracer struct {
+	rate     float64
+	exporter *otlpExporter
+
+	lock     sync.Mutex
+	finished []*span
+	contexts map[string]spanContext
+	order    []string
+}
+
+// newTracer creates a tracer that pushes spans to the collector endpoint url,
+// usually ending in "/v1/traces". Traces started by the client (rather than
+// continued from a message's trace context) are sampled at rate, between 0
+// and 1; continued traces follow the sampling decision of their parent.
+func newTracer(url string, rate float64) (*tracer, error) {
+	if url == "" {
+		return nil, fmt.Errorf("no tracing endpoint")
+	}
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid tracing sample rate: %v", rate)
+	}
+	return &tracer{
+		rate:     rate,
+		exporter: &otlpExporter{url: url, interval: traceExportInterval, client: &http.Client{Timeout: traceExportInterval}},
+		contexts: make(map[string]spanContext),
+	}, nil
+}
+
+// tracing, if set, traces messages through the pipeline.
+var tracing *tracer
+
+// startSpan starts a span named name as a child of the trace context in
+// metadata, or as the root of a new trace if metadata has none. It returns nil
+// if t is nil.
+func (t *tracer) startSpan(name string, metadata map[string]string) *span {
+	if t == nil {
+		return nil
+	}
+
+	s := span{t: t, name: name, start: time.Now(), attributes: make(map[string]string)}
+	parent, err := parseTraceparent(metadata[traceparentMetadataKey])
+	if err == nil {
+		s.ctx.traceID = parent.traceID
+		s.ctx.sampled = parent.sampled
+		s.parent = parent.spanID
+	} else {
+		if _, prs := metadata[traceparentMetadataKey]; prs {
+			log.Debugf("starting new trace: %v", err)
+		}
+		rand.Read(s.ctx.traceID[:])
+		s.ctx.sampled = mathrand.Float64() < t.rate
+	}
+	rand.Read(s.ctx.spanID[:])
+	return &s
+}
+
+// withTraceparent returns a copy of metadata with its trace context set to
+// that of s. It returns metadata unchanged if s is nil.
+func (s *span) withTraceparent(metadata map[string]string) map[string]string {
+	if s == nil {
+		return metadata
+	}
+	m := copyMetadata(metadata)
+	m[traceparentMetadataKey] = s.traceparent()
+	return m
+}
+
+// remember records the trace context of the message id, so that the response
+// to it can be linked to the trace even if the worker does not return the
+// trace context. It does nothing if t is nil.
+func (t *tracer) remember(id string, metadata map[string]string) {
+	if t == nil {
+		return
+	}
+	sc, err := parseTraceparent(metadata[traceparentMetadataKey])
+	if err != nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.order) >= traceContextCapacity {
+		delete(t.contexts, t.order[0])
+		t.order = t.order[1:]
+	}
+	t.contexts[id] = sc
+	t.order = append(t.order, id)
+}
+
+// responseMetadata returns the metadata used to start the span for the
+// response msg: its own metadata if it carries a trace context, or else its
+// metadata with the trace context recorded for the message it responds to.
+func (t *tracer) responseMetadata(msg yggdrasil.Data) map[string]string {
+	if t == nil {
+		return msg.Metadata
+	}
+	if _, err := parseTraceparent(msg.Metadata[traceparentMetadataKey]); err == nil {
+		return msg.Metadata
+	}
+
+	t.lock.Lock()
+	sc, prs := t.contexts[msg.ResponseTo]
+	t.lock.Unlock()
+	if !prs {
+		return msg.Metadata
+	}
+	m := copyMetadata(msg.Metadata)
+	m[traceparentMetadataKey] = sc.traceparent()
+	return m
+}
+
+func (t *tracer) queue(s *span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.finished) >= maxQueuedSpans {
+		log.Debugf("dropping span %v: export queue full", s.name)
+		return
+	}
+	t.finished = append(t.finished, s)
+}
+
+// run pushes the finished spans to the collector every traceExportInterval.
+func (t *tracer) run() {
+	log.Infof("pushing traces to OTLP collector %v every %v", t.exporter.url, traceExportInterval)
+
+	for {
+		time.Sleep(traceExportInterval)
+
+		t.lock.Lock()
+		spans := t.finished
+		t.finished = nil
+		t.lock.Unlock()
+		if len(spans) == 0 {
+			continue
+		}
+
+		data, err := json.Marshal(otlpTraceRequest(spans))
+		if err != nil {
+			log.Errorf("cannot marshal spans: %v", err)
+			continue
+		}
+		if err := t.exporter.push(data); err != nil {
+			log.Debugf("cannot push spans: %v", err)
+		}
+	}
+}
+
+// otlpTraceRequest creates the body of an OTLP trace export request holding
+// spans.
+func otlpTraceRequest(spans []*span) map[string]interface{} {
+	// SPAN_KIND_INTERNAL, STATUS_CODE_OK and STATUS_CODE_ERROR
+	const (
+		kindInternal = 1
+		statusOK     = 1
+		statusError  = 2
+	)
+
+	exported := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		attributes := make([]map[string]interface{}, 0, len(s.attributes))
+		for k, v := range s.attributes {
+			attributes = append(attributes, map[string]interface{}{"key": k, "value": map[string]interface{}{"stringValue": v}})
+		}
+		status := map[string]interface{}{"code": statusOK}
+		if s.err != "" {
+			status = map[string]interface{}{"code": statusError, "message": s.err}
+		}
+		m := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.ctx.traceID[:]),
+			"spanId":            hex.EncodeToString(s.ctx.spanID[:]),
+			"name":              s.name,
+			"kind":              kindInternal,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attributes,
+			"status":            status,
+		}
+		if s.parent != [8]byte{} {
+			m["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		exported = append(exported, m)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{
+			{
+				"resource": map[string]interface{}{
+					"attributes": []map[string]interface{}{
+						{"key": "service.name", "value": map[string]interface{}{"stringValue": metricsPrefix}},
+					},
+				},
+				"scopeSpans": []map[string]interface{}{
+					{"spans": exported},
+				},
+			},
+		},
+	}
+}
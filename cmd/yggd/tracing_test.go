@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		wantSampled bool
+		wantError   bool
+	}{
+		{
+			description: "sampled",
+			input:       "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantSampled: true,
+		},
+		{
+			description: "not sampled",
+			input:       "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		},
+		{
+			description: "future version with more fields",
+			input:       "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			wantSampled: true,
+		},
+		{
+			description: "zero trace ID",
+			input:       "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			wantError:   true,
+		},
+		{
+			description: "short span ID",
+			input:       "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01",
+			wantError:   true,
+		},
+		{
+			description: "invalid version",
+			input:       "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantError:   true,
+		},
+		{
+			description: "empty",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseTraceparent(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.sampled != test.wantSampled {
+				t.Errorf("sampled = %v, want %v", got.sampled, test.wantSampled)
+			}
+		})
+	}
+}
+
+func TestStartSpan(t *testing.T) {
+	tr, err := newTracer("http://localhost:4318/v1/traces", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	s := tr.startSpan("receive", map[string]string{traceparentMetadataKey: parent})
+	if !s.ctx.sampled {
+		t.Errorf("expected span of a sampled parent to be sampled")
+	}
+	child, err := parseTraceparent(s.withTraceparent(nil)[traceparentMetadataKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := parseTraceparent(parent)
+	if child.traceID != want.traceID || child.spanID == want.spanID {
+		t.Errorf("unexpected child context %v of %v", s.traceparent(), parent)
+	}
+	s.finish(nil)
+
+	// A new trace is sampled at the sample rate, which is zero.
+	root := tr.startSpan("receive", nil)
+	if root.ctx.sampled || root.parent != [8]byte{} {
+		t.Errorf("unexpected root span: %+v", root)
+	}
+	root.finish(nil)
+
+	if len(tr.finished) != 1 || tr.finished[0] != s {
+		t.Errorf("expected only the sampled span queued, got %v", tr.finished)
+	}
+
+	var disabled *tracer
+	if s := disabled.startSpan("receive", nil); s != nil {
+		t.Errorf("expected no span from a disabled tracer")
+	}
+}
+
+func TestResponseMetadata(t *testing.T) {
+	tr, err := newTracer("http://localhost:4318/v1/traces", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dispatched := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tr.remember("1234", map[string]string{traceparentMetadataKey: dispatched})
+
+	tests := []struct {
+		description string
+		input       yggdrasil.Data
+		want        string
+	}{
+		{
+			description: "worker returns trace context",
+			input:       yggdrasil.Data{ResponseTo: "1234", Metadata: map[string]string{traceparentMetadataKey: "00-4bf92f3577b34da6a3ce929d0e0e4736-b7ad6b7169203331-01"}},
+			want:        "00-4bf92f3577b34da6a3ce929d0e0e4736-b7ad6b7169203331-01",
+		},
+		{
+			description: "worker drops trace context",
+			input:       yggdrasil.Data{ResponseTo: "1234"},
+			want:        dispatched,
+		},
+		{
+			description: "unknown message",
+			input:       yggdrasil.Data{ResponseTo: "5678"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := tr.responseMetadata(test.input)[traceparentMetadataKey]; got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// A dataTransformFunc inspects and optionally modifies a data message,
+// returning the message that should continue through the pipeline. Returning
+// an error drops the message.
+type dataTransformFunc func(msg yggdrasil.Data) (yggdrasil.Data, error)
+
+// A transformChain is an ordered sequence of named transforms applied to a
+// data message.
+type transformChain struct {
+	names []string
+	funcs []dataTransformFunc
+}
+
+// add appends the transform f to the end of the chain.
+func (c *transformChain) add(name string, f dataTransformFunc) {
+	c.names = append(c.names, name)
+	c.funcs = append(c.funcs, f)
+}
+
+// apply runs each transform in the order it was added, passing the output of
+// one transform as the input to the next. The chain short-circuits on the
+// first transform to return an error; later transforms are not run.
+func (c *transformChain) apply(msg yggdrasil.Data) (yggdrasil.Data, error) {
+	for i, f := range c.funcs {
+		var err error
+		msg, err = f(msg)
+		if err != nil {
+			return msg, fmt.Errorf("transform '%v' rejected message: %w", c.names[i], err)
+		}
+	}
+	return msg, nil
+}
+
+// inboundTransforms are the transforms that may be selected by name to run on
+// data messages received from the broker, before they are dispatched to a
+// worker.
+var inboundTransforms = map[string]dataTransformFunc{
+	"validate":  validateTransform,
+	"client-id": clientIDTransform,
+}
+
+// outboundTransforms are the transforms that may be selected by name to run on
+// data messages returned by workers, before they are published.
+var outboundTransforms = map[string]dataTransformFunc{
+	"client-id": clientIDTransform,
+	"gzip":      gzipTransform,
+}
+
+// newTransformChain creates a chain of the named transforms, looked up in
+// available, in the order given.
+func newTransformChain(names []string, available map[string]dataTransformFunc) (*transformChain, error) {
+	var chain transformChain
+	for _, name := range names {
+		f, ok := available[name]
+		if !ok {
+			known := make([]string, 0, len(available))
+			for k := range available {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown transform '%v' (must be one of %v)", name, known)
+		}
+		chain.add(name, f)
+	}
+	return &chain, nil
+}
+
+// validateTransform rejects messages that are missing a message ID or
+// directive.
+func validateTransform(msg yggdrasil.Data) (yggdrasil.Data, error) {
+	if msg.MessageID == "" {
+		return msg, errors.New("missing message_id")
+	}
+	if msg.Directive == "" {
+		return msg, errors.New("missing directive")
+	}
+	return msg, nil
+}
+
+// gzipTransform compresses the message content with gzip. Because Content must
+// remain valid JSON, the compressed bytes are encoded as a base64 JSON string
+// and the encoding is recorded in the "content_encoding" metadata key.
+func gzipTransform(msg yggdrasil.Data) (yggdrasil.Data, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(msg.Content); err != nil {
+		return msg, fmt.Errorf("cannot compress content: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return msg, fmt.Errorf("cannot compress content: %w", err)
+	}
+
+	content, err := json.Marshal(buf.Bytes())
+	if err != nil {
+		return msg, fmt.Errorf("cannot marshal content: %w", err)
+	}
+
+	msg.Metadata = copyMetadata(msg.Metadata)
+	msg.Metadata["content_encoding"] = "gzip+base64"
+	msg.Content = content
+	return msg, nil
+}
+
+// clientIDTransform adds the client ID to the message metadata under the key
+// "client_id".
+func clientIDTransform(msg yggdrasil.Data) (yggdrasil.Data, error) {
+	msg.Metadata = copyMetadata(msg.Metadata)
+	msg.Metadata["client_id"] = ClientID
+	return msg, nil
+}
+
+// copyMetadata returns a copy of metadata that transforms may modify without
+// affecting other references to the original message.
+func copyMetadata(metadata map[string]string) map[string]string {
+	m := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		m[k] = v
+	}
+	return m
+}
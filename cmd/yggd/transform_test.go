@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestTransformChain(t *testing.T) {
+	appendMetadata := func(v string) dataTransformFunc {
+		return func(msg yggdrasil.Data) (yggdrasil.Data, error) {
+			msg.Metadata["order"] += v
+			return msg, nil
+		}
+	}
+	reject := func(msg yggdrasil.Data) (yggdrasil.Data, error) {
+		return msg, errors.New("rejected")
+	}
+
+	tests := []struct {
+		description string
+		names       []string
+		input       yggdrasil.Data
+		want        yggdrasil.Data
+		wantError   bool
+	}{
+		{
+			description: "ordered",
+			names:       []string{"a", "b", "c"},
+			input:       yggdrasil.Data{Metadata: map[string]string{}},
+			want:        yggdrasil.Data{Metadata: map[string]string{"order": "abc"}},
+		},
+		{
+			description: "short-circuit",
+			names:       []string{"a", "reject", "c"},
+			input:       yggdrasil.Data{Metadata: map[string]string{}},
+			wantError:   true,
+		},
+		{
+			description: "validate missing directive",
+			names:       []string{"validate"},
+			input:       yggdrasil.Data{MessageID: "1234"},
+			wantError:   true,
+		},
+	}
+
+	available := map[string]dataTransformFunc{
+		"a":        appendMetadata("a"),
+		"b":        appendMetadata("b"),
+		"c":        appendMetadata("c"),
+		"reject":   reject,
+		"validate": validateTransform,
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			chain, err := newTransformChain(test.names, available)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := chain.apply(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := newTransformChain([]string{"bogus"}, available); err == nil {
+		t.Errorf("expected error for unknown transform")
+	}
+}
+
+func TestGzipTransform(t *testing.T) {
+	input := yggdrasil.Data{Content: []byte(`{"field":"value"}`)}
+
+	got, err := gzipTransform(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Metadata["content_encoding"] != "gzip+base64" {
+		t.Errorf("unexpected metadata: %#v", got.Metadata)
+	}
+
+	var compressed []byte
+	if err := json.Unmarshal(got.Content, &compressed); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(content, []byte(input.Content)) {
+		t.Errorf("%v != %v", string(content), string(input.Content))
+	}
+}
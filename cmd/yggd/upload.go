@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// The actions taken for a large data message whose content cannot be
+// uploaded.
+const (
+	uploadFailureInline     = "inline"
+	uploadFailureDeadLetter = "dead-letter"
+	uploadFailureDrop       = "drop"
+)
+
+// uploadReferenceEncoding is the "content_encoding" metadata value of a data
+// message whose content was uploaded and replaced by an uploadReference.
+const uploadReferenceEncoding = "upload-reference"
+
+// An uploadReference replaces the content of a data message that was
+// uploaded over HTTP. URL is where the content can be fetched, Size its length
+// and SHA256 its hex-encoded digest.
+type uploadReference struct {
+	URL    string `json:"url"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// A presignedUpload is the response of the presign endpoint: the URL to upload
+// content to and, if different, the URL it can be fetched from afterwards.
+type presignedUpload struct {
+	UploadURL string `json:"upload_url"`
+	Reference string `json:"reference"`
+}
+
+// An uploadClient sends HTTP requests on behalf of a payloadUploader.
+type uploadClient interface {
+	Get(url string) ([]byte, error)
+	Put(url string, headers map[string]string, body []byte) error
+}
+
+// A payloadUploader uploads the content of data messages larger than
+// threshold bytes over HTTP, so that only a reference to the content is
+// published. Content is uploaded either to a URL under a static endpoint,
+// uploadURL, or to a URL obtained for each message from presignURL. Failed
+// uploads are retried up to retries times, with a delay starting at one
+// second and doubling after each failure; once the retries are exhausted,
+// failureAction decides what happens to the message.
+type payloadUploader struct {
+	threshold     int
+	uploadURL     string
+	presignURL    string
+	retries       int
+	failureAction string
+	client        uploadClient
+
+	// sleep waits between attempts. It is replaced in tests.
+	sleep func(time.Duration)
+
+	// pending counts the uploads started by run that have not finished.
+	pending sync.WaitGroup
+}
+
+// newPayloadUploader creates an uploader for content larger than threshold
+// bytes. Exactly one of uploadURL and presignURL must be set.
+func newPayloadUploader(threshold int, uploadURL string, presignURL string, retries int, failureAction string, client uploadClient) (*payloadUploader, error) {
+	if threshold <= 0 {
+		return nil, fmt.Errorf("invalid upload threshold: %v", threshold)
+	}
+	if (uploadURL == "") == (presignURL == "") {
+		return nil, fmt.Errorf("exactly one of an upload URL and a presign URL must be set")
+	}
+	for _, u := range []string{uploadURL, presignURL} {
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse URL: %w", err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported URL scheme: %v", u)
+		}
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("invalid upload retries: %v", retries)
+	}
+	switch failureAction {
+	case uploadFailureInline, uploadFailureDeadLetter, uploadFailureDrop:
+	default:
+		return nil, fmt.Errorf("unsupported upload failure action: %v", failureAction)
+	}
+
+	return &payloadUploader{
+		threshold:     threshold,
+		uploadURL:     uploadURL,
+		presignURL:    presignURL,
+		retries:       retries,
+		failureAction: failureAction,
+		client:        client,
+		sleep:         time.Sleep,
+	}, nil
+}
+
+// exceeds returns true if the content of msg is larger than the threshold. It
+// returns false if u is nil.
+func (u *payloadUploader) exceeds(msg yggdrasil.Data) bool {
+	return u != nil && len(msg.Content) > u.threshold
+}
+
+// run runs the upload f on a goroutine of its own.
+func (u *payloadUploader) run(f func()) {
+	u.pending.Add(1)
+	go func() {
+		defer u.pending.Done()
+		f()
+	}()
+}
+
+// wait waits for the uploads started by run to finish. It returns at once if
+// u is nil.
+func (u *payloadUploader) wait() {
+	if u == nil {
+		return
+	}
+	u.pending.Wait()
+}
+
+// upload uploads the content of msg, retrying as configured, and returns msg
+// with its content replaced by a reference to the uploaded content.
+func (u *payloadUploader) upload(msg yggdrasil.Data) (yggdrasil.Data, error) {
+	delay := time.Second
+	var ref string
+	var err error
+	for attempt := 0; attempt <= u.retries; attempt++ {
+		if attempt > 0 {
+			log.Warnf("cannot upload content of message %v, retrying in %v: %v", msg.MessageID, delay, err)
+			u.sleep(delay)
+			delay *= 2
+		}
+		ref, err = u.put(msg)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return msg, err
+	}
+
+	sum := sha256.Sum256(msg.Content)
+	content, err := json.Marshal(uploadReference{URL: ref, Size: len(msg.Content), SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		return msg, fmt.Errorf("cannot marshal upload reference: %w", err)
+	}
+	log.Debugf("uploaded %v bytes of content of message %v to %v", len(msg.Content), msg.MessageID, ref)
+
+	msg.Metadata = copyMetadata(msg.Metadata)
+	msg.Metadata["content_encoding"] = uploadReferenceEncoding
+	msg.Content = content
+	return msg, nil
+}
+
+// put makes a single attempt to upload the content of msg, returning the URL
+// the content can be fetched from.
+func (u *payloadUploader) put(msg yggdrasil.Data) (string, error) {
+	target := strings.TrimSuffix(u.uploadURL, "/") + "/" + url.PathEscape(msg.MessageID)
+	ref := target
+	if u.presignURL != "" {
+		presigned, err := u.presign(msg)
+		if err != nil {
+			return "", err
+		}
+		target = presigned.UploadURL
+		ref = presigned.Reference
+		if ref == "" {
+			ref = target
+		}
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json",
+		"X-Message-ID": msg.MessageID,
+	}
+	if err := u.client.Put(target, headers, msg.Content); err != nil {
+		return "", fmt.Errorf("cannot upload content: %w", err)
+	}
+	return ref, nil
+}
+
+// presign requests an upload URL for the content of msg from the presign
+// endpoint.
+func (u *payloadUploader) presign(msg yggdrasil.Data) (*presignedUpload, error) {
+	endpoint, err := url.Parse(u.presignURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse presign URL: %w", err)
+	}
+	query := endpoint.Query()
+	query.Set("message_id", msg.MessageID)
+	query.Set("size", strconv.Itoa(len(msg.Content)))
+	endpoint.RawQuery = query.Encode()
+
+	data, err := u.client.Get(endpoint.String())
+	if err != nil {
+		return nil, fmt.Errorf("cannot get upload URL: %w", err)
+	}
+	var presigned presignedUpload
+	if err := json.Unmarshal(data, &presigned); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal presign response: %w", err)
+	}
+	if presigned.UploadURL == "" {
+		return nil, fmt.Errorf("presign response has no upload URL")
+	}
+	return &presigned, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// fakeUploadClient records uploads, failing the first failures of them.
+type fakeUploadClient struct {
+	failures  int
+	presigned string
+	gets      []string
+	puts      []string
+}
+
+func (c *fakeUploadClient) Get(url string) ([]byte, error) {
+	c.gets = append(c.gets, url)
+	return []byte(c.presigned), nil
+}
+
+func (c *fakeUploadClient) Put(url string, headers map[string]string, body []byte) error {
+	c.puts = append(c.puts, url)
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestPayloadUploader(t *testing.T) {
+	tests := []struct {
+		description string
+		uploadURL   string
+		presignURL  string
+		client      *fakeUploadClient
+		wantGets    []string
+		wantPuts    []string
+		wantRef     string
+		wantError   bool
+	}{
+		{
+			description: "static endpoint",
+			uploadURL:   "https://uploads.example.com/results/",
+			client:      &fakeUploadClient{},
+			wantPuts:    []string{"https://uploads.example.com/results/1234"},
+			wantRef:     "https://uploads.example.com/results/1234",
+		},
+		{
+			description: "presigned",
+			presignURL:  "https://api.example.com/presign",
+			client:      &fakeUploadClient{presigned: `{"upload_url":"https://bucket.example.com/1234?sig=abc","reference":"https://bucket.example.com/1234"}`},
+			wantGets:    []string{"https://api.example.com/presign?message_id=1234&size=8"},
+			wantPuts:    []string{"https://bucket.example.com/1234?sig=abc"},
+			wantRef:     "https://bucket.example.com/1234",
+		},
+		{
+			description: "retried",
+			uploadURL:   "https://uploads.example.com",
+			client:      &fakeUploadClient{failures: 2},
+			wantPuts:    []string{"https://uploads.example.com/1234", "https://uploads.example.com/1234", "https://uploads.example.com/1234"},
+			wantRef:     "https://uploads.example.com/1234",
+		},
+		{
+			description: "retries exhausted",
+			uploadURL:   "https://uploads.example.com",
+			client:      &fakeUploadClient{failures: 3},
+			wantPuts:    []string{"https://uploads.example.com/1234", "https://uploads.example.com/1234", "https://uploads.example.com/1234"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			u, err := newPayloadUploader(4, test.uploadURL, test.presignURL, 2, uploadFailureDeadLetter, test.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u.sleep = func(time.Duration) {}
+
+			msg := yggdrasil.Data{MessageID: "1234", Content: json.RawMessage(`"result"`)}
+			if !u.exceeds(msg) {
+				t.Fatal("expected content to exceed threshold")
+			}
+			got, err := u.upload(msg)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(test.client.gets, test.wantGets) {
+				t.Errorf("gets: %v", cmp.Diff(test.client.gets, test.wantGets))
+			}
+			if !cmp.Equal(test.client.puts, test.wantPuts) {
+				t.Errorf("puts: %v", cmp.Diff(test.client.puts, test.wantPuts))
+			}
+			if test.wantError {
+				return
+			}
+
+			if got.Metadata["content_encoding"] != uploadReferenceEncoding {
+				t.Errorf("unexpected metadata: %v", got.Metadata)
+			}
+			var ref uploadReference
+			if err := json.Unmarshal(got.Content, &ref); err != nil {
+				t.Fatal(err)
+			}
+			if ref.URL != test.wantRef || ref.Size != 8 || len(ref.SHA256) != 64 {
+				t.Errorf("unexpected reference: %+v", ref)
+			}
+		})
+	}
+}
+
+func TestPublishUploadFailure(t *testing.T) {
+	tests := []struct {
+		description   string
+		failureAction string
+		wantDest      string
+	}{
+		{description: "inline", failureAction: uploadFailureInline, wantDest: "data"},
+		{description: "dead-letter", failureAction: uploadFailureDeadLetter, wantDest: "dead-letter"},
+		{description: "drop", failureAction: uploadFailureDrop},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			u, err := newPayloadUploader(4, "https://uploads.example.com", "", 0, test.failureAction, &fakeUploadClient{failures: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := &recordingTransport{}
+			c := Client{t: tr, uploads: u}
+
+			c.publishResult(yggdrasil.Data{MessageID: "1234", Content: json.RawMessage(`"result"`)}, nil)
+			u.wait()
+
+			var dests []string
+			for dest := range tr.sent {
+				dests = append(dests, dest)
+			}
+			var want []string
+			if test.wantDest != "" {
+				want = []string{test.wantDest}
+			}
+			if !cmp.Equal(dests, want) {
+				t.Errorf("published to %v, want %v", dests, want)
+			}
+		})
+	}
+}
+
+// blockingUploadClient is a fakeUploadClient whose uploads wait until release
+// is closed.
+type blockingUploadClient struct {
+	fakeUploadClient
+	release chan struct{}
+}
+
+func (c *blockingUploadClient) Put(url string, headers map[string]string, body []byte) error {
+	<-c.release
+	return c.fakeUploadClient.Put(url, headers, body)
+}
+
+func TestPublishUploadAsync(t *testing.T) {
+	client := &blockingUploadClient{release: make(chan struct{})}
+	u, err := newPayloadUploader(4, "https://uploads.example.com", "", 0, uploadFailureDrop, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &recordingTransport{}
+	c := Client{t: tr, uploads: u}
+
+	var done []string
+	c.publishResult(yggdrasil.Data{MessageID: "large", Content: json.RawMessage(`"result"`)}, func() { done = append(done, "large") })
+	c.publishResult(yggdrasil.Data{MessageID: "small", Content: json.RawMessage(`1`)}, func() { done = append(done, "small") })
+	if want := []string{"small"}; !cmp.Equal(done, want) {
+		t.Errorf("published while uploading: %v", cmp.Diff(done, want))
+	}
+
+	close(client.release)
+	u.wait()
+	if want := []string{"small", "large"}; !cmp.Equal(done, want) {
+		t.Errorf("published: %v", cmp.Diff(done, want))
+	}
+	if len(tr.sent["data"]) != 2 {
+		t.Errorf("sent %v results, want 2", len(tr.sent["data"]))
+	}
+}
+
+func TestNewPayloadUploader(t *testing.T) {
+	tests := []struct {
+		description string
+		uploadURL   string
+		presignURL  string
+		action      string
+	}{
+		{description: "no URL", action: uploadFailureInline},
+		{description: "both URLs", uploadURL: "https://a.example.com", presignURL: "https://b.example.com", action: uploadFailureInline},
+		{description: "unsupported scheme", uploadURL: "ftp://a.example.com", action: uploadFailureInline},
+		{description: "unsupported action", uploadURL: "https://a.example.com", action: "retry"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if _, err := newPayloadUploader(1024, test.uploadURL, test.presignURL, 3, test.action, &fakeUploadClient{}); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
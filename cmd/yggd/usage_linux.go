@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// clockTicks is the number of clock ticks per second that the CPU times in
+// /proc are counted in (USER_HZ), which is 100 on every Linux architecture.
+const clockTicks = 100
+
+// procDir is the directory process information is read from. It is replaced
+// in tests.
+var procDir = "/proc"
+
+// readProcessUsage returns the CPU time used and the resident memory held so
+// far by the process pid, as reported in /proc/<pid>/stat.
+func readProcessUsage(pid int) (processUsage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return processUsage{}, fmt.Errorf("cannot read usage of process %v: %w", pid, err)
+	}
+	return parseProcStat(data)
+}
+
+// parseProcStat parses the CPU time and resident set size from the contents
+// of a /proc/<pid>/stat file.
+func parseProcStat(data []byte) (processUsage, error) {
+	// The command name may contain spaces and parentheses, so the fields
+	// are counted from the last closing parenthesis.
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return processUsage{}, fmt.Errorf("cannot parse process stat: missing command name")
+	}
+	fields := bytes.Fields(data[i+1:])
+	// fields[0] is field 3 of the file (state): utime, stime and rss are
+	// fields 14, 15 and 24.
+	if len(fields) < 22 {
+		return processUsage{}, fmt.Errorf("cannot parse process stat: %v fields", len(fields)+2)
+	}
+	utime, err := strconv.ParseUint(string(fields[11]), 10, 64)
+	if err != nil {
+		return processUsage{}, fmt.Errorf("cannot parse process stat: %w", err)
+	}
+	stime, err := strconv.ParseUint(string(fields[12]), 10, 64)
+	if err != nil {
+		return processUsage{}, fmt.Errorf("cannot parse process stat: %w", err)
+	}
+	rss, err := strconv.ParseInt(string(fields[21]), 10, 64)
+	if err != nil {
+		return processUsage{}, fmt.Errorf("cannot parse process stat: %w", err)
+	}
+	return processUsage{
+		cpuSeconds: float64(utime+stime) / clockTicks,
+		rssBytes:   rss * int64(os.Getpagesize()),
+	}, nil
+}
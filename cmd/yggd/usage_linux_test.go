@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        processUsage
+		wantError   bool
+	}{
+		{
+			description: "plain",
+			input:       "42 (worker) S 1 42 42 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 1 0 100 1000000 3 18446744073709551615",
+			want:        processUsage{cpuSeconds: 3, rssBytes: 3 * int64(os.Getpagesize())},
+		},
+		{
+			description: "spaces in the command name",
+			input:       "42 (a (b) c) R 1 42 42 0 -1 4194560 100 0 0 0 1 1 0 0 20 0 1 0 100 1000000 1 18446744073709551615",
+			want:        processUsage{cpuSeconds: 0.02, rssBytes: int64(os.Getpagesize())},
+		},
+		{
+			description: "truncated",
+			input:       "42 (worker) S 1 42",
+			wantError:   true,
+		},
+		{
+			description: "no command name",
+			input:       "42 worker S 1",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseProcStat([]byte(test.input))
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%+v != %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadProcessUsage(t *testing.T) {
+	u, err := readProcessUsage(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.rssBytes <= 0 {
+		t.Errorf("unexpected resident memory: %v", u.rssBytes)
+	}
+}
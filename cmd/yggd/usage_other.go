@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// readProcessUsage returns errUsageUnsupported; sampling the resource usage
+// of workers is only supported on Linux.
+func readProcessUsage(pid int) (processUsage, error) {
+	return processUsage{}, errUsageUnsupported
+}
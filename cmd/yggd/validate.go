@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/redhatinsights/yggdrasil"
+	"github.com/urfave/cli/v2"
+)
+
+// workerValidation is the result of validating a single worker executable.
+type workerValidation struct {
+	name     string
+	path     string
+	handlers []string
+	problems []string
+}
+
+func (v *workerValidation) status() string {
+	if len(v.problems) > 0 {
+		return "invalid"
+	}
+	return "ok"
+}
+
+// validateWorkersAction checks every worker in the worker directory, against
+// the configs in the worker config directory, without starting the daemon and
+// prints a table of the results. It exits non-zero if any worker has problems.
+func validateWorkersAction(c *cli.Context) error {
+	dir := c.String("worker-dir")
+	if dir == "" {
+		dir = filepath.Join(yggdrasil.LibexecDir, yggdrasil.LongName)
+	}
+	if configDir := c.String("worker-config-dir"); configDir != "" {
+		workerConfigPath = configDir
+	}
+
+	results, err := validateWorkers(dir, c.Bool("dry-run"), c.Duration("timeout"))
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	if err := writeWorkerValidations(c.App.Writer, results); err != nil {
+		return cli.Exit(fmt.Errorf("cannot write results: %w", err), 1)
+	}
+
+	var invalid int
+	for _, r := range results {
+		if len(r.problems) > 0 {
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		return cli.Exit(fmt.Sprintf("%v of %v workers are invalid", invalid, len(results)), 1)
+	}
+	return nil
+}
+
+// validateWorkers validates each candidate worker executable in dir. If
+// dryRun is true, each worker is also run with the "--version" argument and
+// must exit successfully within timeout.
+func validateWorkers(dir string, dryRun bool, timeout time.Duration) ([]*workerValidation, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read contents of directory: %w", err)
+	}
+
+	results := make([]*workerValidation, 0, len(fileInfos))
+	for _, info := range fileInfos {
+		if !strings.HasSuffix(info.Name(), "worker") {
+			continue
+		}
+		r := &workerValidation{
+			name: info.Name(),
+			path: filepath.Join(dir, info.Name()),
+		}
+
+		run := dryRun
+		config, err := loadWorkerConfig(r.name)
+		if err != nil {
+			r.problems = append(r.problems, err.Error())
+		} else {
+			r.handlers = config.Handlers
+			// A worker that fails its checksum is not run.
+			if f, err := verifyWorkerIntegrity(r.path, config); err != nil {
+				r.problems = append(r.problems, err.Error())
+				run = false
+			} else if f != nil {
+				f.Close()
+			}
+		}
+		r.problems = append(r.problems, checkWorker(r.path, info, run, timeout)...)
+
+		results = append(results, r)
+	}
+
+	findHandlerCollisions(results)
+
+	return results, nil
+}
+
+// checkWorker returns the problems found with the worker executable at path.
+func checkWorker(path string, info os.FileInfo, dryRun bool, timeout time.Duration) []string {
+	var problems []string
+
+	if !info.Mode().IsRegular() {
+		return append(problems, "not a regular file")
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return append(problems, "not executable")
+	}
+
+	if dryRun {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, path, "--version")
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				problems = append(problems, fmt.Sprintf("did not exit within %v", timeout))
+			} else {
+				problems = append(problems, fmt.Sprintf("dry run failed: %v", err))
+			}
+		}
+	}
+
+	return problems
+}
+
+// findHandlerCollisions records a problem on every result that declares a
+// handler also declared by another worker.
+func findHandlerCollisions(results []*workerValidation) {
+	declared := make(map[string][]string)
+	for _, r := range results {
+		for _, handler := range r.handlers {
+			declared[handler] = append(declared[handler], r.name)
+		}
+	}
+
+	for _, r := range results {
+		for _, handler := range r.handlers {
+			if len(declared[handler]) < 2 {
+				continue
+			}
+			others := make([]string, 0, len(declared[handler])-1)
+			for _, name := range declared[handler] {
+				if name != r.name {
+					others = append(others, name)
+				}
+			}
+			sort.Strings(others)
+			r.problems = append(r.problems, fmt.Sprintf("handler '%v' also declared by %v", handler, strings.Join(others, ", ")))
+		}
+	}
+}
+
+// writeWorkerValidations writes results to w as a table.
+func writeWorkerValidations(w io.Writer, results []*workerValidation) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPATH\tSTATUS\tPROBLEMS")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", r.name, r.path, r.status(), strings.Join(r.problems, "; "))
+	}
+	return tw.Flush()
+}
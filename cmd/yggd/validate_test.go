@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCheckWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		description string
+		script      string
+		mode        os.FileMode
+		dryRun      bool
+		want        []string
+	}{
+		{
+			description: "not executable",
+			script:      "#!/bin/sh\nexit 0\n",
+			mode:        0644,
+			want:        []string{"not executable"},
+		},
+		{
+			description: "executable",
+			script:      "#!/bin/sh\nexit 1\n",
+			mode:        0755,
+		},
+		{
+			description: "dry run",
+			script:      "#!/bin/sh\nexit 0\n",
+			mode:        0755,
+			dryRun:      true,
+		},
+		{
+			description: "dry run timeout",
+			script:      "#!/bin/sh\nexec sleep 5\n",
+			mode:        0755,
+			dryRun:      true,
+			want:        []string{"did not exit within 100ms"},
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i))+"-worker")
+			if err := ioutil.WriteFile(path, []byte(test.script), test.mode); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := checkWorker(path, info, test.dryRun, 100*time.Millisecond)
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFindHandlerCollisions(t *testing.T) {
+	results := []*workerValidation{
+		{name: "a-worker", handlers: []string{"echo"}},
+		{name: "b-worker", handlers: []string{"echo", "sleep"}},
+		{name: "c-worker", handlers: []string{"ping"}},
+	}
+	want := [][]string{
+		{"handler 'echo' also declared by b-worker"},
+		{"handler 'echo' also declared by a-worker"},
+		nil,
+	}
+
+	findHandlerCollisions(results)
+
+	for i, r := range results {
+		if !cmp.Equal(r.problems, want[i]) {
+			t.Errorf("%v: %#v != %#v", r.name, r.problems, want[i])
+		}
+	}
+}
+
+func TestValidateWorkersConfigDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { workerConfigPath = "" }()
+
+	tests := []struct {
+		description  string
+		config       string
+		wantHandlers []string
+		wantStatus   string
+	}{
+		{
+			description:  "handlers",
+			config:       `handlers = ["echo"]`,
+			wantHandlers: []string{"echo"},
+			wantStatus:   "ok",
+		},
+		{
+			description: "invalid config",
+			config:      `umask = "0999"`,
+			wantStatus:  "invalid",
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			workerDir := filepath.Join(dir, string(rune('a'+i)), "workers")
+			workerConfigPath = filepath.Join(dir, string(rune('a'+i)), "config")
+			for _, d := range []string{workerDir, workerConfigPath} {
+				if err := os.MkdirAll(d, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := ioutil.WriteFile(filepath.Join(workerDir, "echo-worker"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(workerConfigPath, "echo-worker.toml"), []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := validateWorkers(workerDir, false, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("expected 1 result, got %v", len(got))
+			}
+			if !cmp.Equal(got[0].handlers, test.wantHandlers) {
+				t.Errorf("%#v != %#v", got[0].handlers, test.wantHandlers)
+			}
+			if got[0].status() != test.wantStatus {
+				t.Errorf("%v != %v: %v", got[0].status(), test.wantStatus, got[0].problems)
+			}
+		})
+	}
+}
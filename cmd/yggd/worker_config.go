@@ -0,0 +1,551 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/pelletier/go-toml"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// workerConfig holds optional settings for a single worker. It is read from a
+// TOML file in the workers config directory, named after the worker
+// executable (for example "/etc/yggdrasil/workers/echo-worker.toml").
+type workerConfig struct {
+	// WorkingDirectory is the directory the worker is started in. It is
+	// created if it does not exist.
+	WorkingDirectory string `toml:"working-directory"`
+
+	// Umask is an octal file mode creation mask (for example "0027") applied
+	// to the worker process.
+	Umask string `toml:"umask"`
+
+	// Handlers lists the work types the worker registers to handle. It is
+	// informational and used to detect conflicting workers before they are
+	// started.
+	Handlers []string `toml:"handlers"`
+
+	// LogFile is a file the worker's stdout and stderr are written to instead
+	// of the daemon log.
+	LogFile string `toml:"log-file"`
+
+	// LogMaxSize is the size in bytes at which LogFile is rotated.
+	LogMaxSize int64 `toml:"log-max-size"`
+
+	// LogMaxFiles is the number of rotated log files kept. If 0, LogFile is
+	// truncated rather than rotated; if unset, defaultWorkerLogMaxFiles are
+	// kept.
+	LogMaxFiles *int `toml:"log-max-files"`
+
+	// LogBufferSize is the number of bytes of output held before they are
+	// written to LogFile. If neither it nor LogFlushInterval is set, each
+	// line is written at once.
+	LogBufferSize int `toml:"log-buffer-size"`
+
+	// LogFlushInterval is the longest time (for example "5s") output is held
+	// before it is written to LogFile.
+	LogFlushInterval string `toml:"log-flush-interval"`
+
+	// LogLevel is the level (for example "debug") the daemon logs the
+	// worker's output and lifecycle at, in place of its own level. It is
+	// also passed to the worker as YGG_LOG_LEVEL.
+	LogLevel string `toml:"log-level"`
+
+	// CPUAffinity is a list of CPU cores and ranges of cores (for example
+	// "2,4-5") the worker process is restricted to running on.
+	CPUAffinity string `toml:"cpu-affinity"`
+
+	// User is the name or ID of the user the worker process runs as. If
+	// unset, it runs as the user of the daemon.
+	User string `toml:"user"`
+
+	// Group is the name or ID of the group the worker process runs as. If
+	// unset, it is the primary group of User, or the group of the daemon.
+	Group string `toml:"group"`
+
+	// CPUQuota is the share of a single CPU (for example "50%", or "200%"
+	// for two CPUs) the worker process and its children may use, enforced
+	// with a cgroup. If unset, their CPU use is not limited.
+	CPUQuota string `toml:"cpu-quota"`
+
+	// MemoryMax is the number of bytes of memory the worker process and its
+	// children may use, enforced with a cgroup. If unset, their memory use
+	// is not limited.
+	MemoryMax int64 `toml:"memory-max"`
+
+	// StartupTimeout overrides the "worker-startup-timeout" flag for the
+	// worker.
+	StartupTimeout string `toml:"startup-timeout"`
+
+	// Nice is the nice value (from -20, the highest scheduling priority, to
+	// 19, the lowest) the worker process runs at. If unset, it inherits the
+	// nice value of the daemon.
+	Nice *int `toml:"nice"`
+
+	// ActivateIf is a condition on the canonical facts (for example
+	// "facts.fqdn =~ 'example.com$'") that must hold for the worker to be
+	// started. If unset, the worker is always started.
+	ActivateIf string `toml:"activate-if"`
+
+	// MaxLifetime is the duration (for example "24h") after which the worker
+	// process is recycled: once it is idle, it is stopped and restarted. If
+	// unset, the process is never recycled.
+	MaxLifetime string `toml:"max-lifetime"`
+
+	// RecycleIdle is how long a worker process past its MaxLifetime must
+	// have had no assignments before it is recycled. If unset, it is
+	// recycled as soon as it has none.
+	RecycleIdle string `toml:"recycle-idle"`
+
+	// RecycleWindow is a range of local times of day (for example
+	// "02:00-05:00") outside of which the worker process is not recycled. If
+	// unset, it may be recycled at any time.
+	RecycleWindow string `toml:"recycle-window"`
+
+	// RestartDelay is the least time (for example "10s") the worker waits
+	// after exiting before it is restarted, however short its crash-loop
+	// backoff. If unset, only the backoff applies.
+	RestartDelay string `toml:"restart-delay"`
+
+	// RestartPolicy overrides the "worker-restart-policy" flag for the
+	// worker: whether it is restarted after it exits ("always",
+	// "on-failure" or "never").
+	RestartPolicy string `toml:"restart-policy"`
+
+	// AssignmentTimeout overrides the "assignment-timeout" flag for the
+	// worker. "0s" disables assignment timeouts for the worker.
+	AssignmentTimeout string `toml:"assignment-timeout"`
+
+	// StopSequence overrides the "worker-stop-sequence" flag for the
+	// worker: the signals it is sent to stop it, each but the last followed
+	// by how long to wait for it to exit (for example ["TERM:10s", "KILL"]).
+	StopSequence []string `toml:"stop-sequence"`
+
+	// Args are the command-line arguments the worker is started with. An
+	// argument may refer to a runtime value of the daemon, such as
+	// "{socket_addr}", which is replaced by its value.
+	Args []string `toml:"args"`
+
+	// SHA256 is the hex-encoded SHA-256 checksum the worker executable must
+	// match to be started. If unset, the executable is not checked.
+	SHA256 string `toml:"sha256"`
+
+	// SignatureFile is the file holding the detached signature of the worker
+	// executable, verified against the "worker-verify-key" public key. If
+	// unset, it is the file named after the worker with the extension ".sig"
+	// in the workers config directory.
+	SignatureFile string `toml:"signature-file"`
+}
+
+// argReference matches a reference to a runtime value in a worker argument,
+// such as "{socket_addr}".
+var argReference = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// argValues maps the names of the runtime values worker arguments may refer to
+// to the variables of the worker's environment that hold them.
+var argValues = map[string]string{
+	"socket_addr": "YGG_SOCKET_ADDR",
+	"config_dir":  "YGG_CONFIG_DIR",
+	"log_level":   "YGG_LOG_LEVEL",
+	"client_id":   "YGG_CLIENT_ID",
+}
+
+// workerConfigPath, if set, is the directory worker config files are located
+// in instead of the default.
+var workerConfigPath string
+
+// workerConfigDir returns the directory in which worker config files are
+// located.
+func workerConfigDir() string {
+	if workerConfigPath != "" {
+		return workerConfigPath
+	}
+	return filepath.Join(yggdrasil.SysconfDir, yggdrasil.LongName, "workers")
+}
+
+// readWorkerConfig reads from its input, unmarshalling the TOML-encoded value
+// into a workerConfig and validating its values.
+func readWorkerConfig(in io.Reader) (*workerConfig, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read input: %w", err)
+	}
+
+	var config workerConfig
+	if err := toml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("cannot parse TOML: %w", err)
+	}
+
+	if config.Umask != "" {
+		if _, err := config.umask(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.CPUAffinity != "" {
+		if _, err := config.cpus(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.CPUQuota != "" {
+		if _, err := config.cpuQuota(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.MemoryMax < 0 {
+		return nil, fmt.Errorf("invalid memory-max: %v", config.MemoryMax)
+	}
+
+	if _, err := config.startupTimeout(); err != nil {
+		return nil, err
+	}
+
+	if _, err := config.maxLifetime(); err != nil {
+		return nil, err
+	}
+
+	if _, err := config.recycleIdle(); err != nil {
+		return nil, err
+	}
+
+	if _, err := config.args(nil); err != nil {
+		return nil, err
+	}
+
+	if _, err := config.restartDelay(); err != nil {
+		return nil, err
+	}
+
+	if _, _, err := config.assignmentTimeout(); err != nil {
+		return nil, err
+	}
+
+	if config.RestartPolicy != "" {
+		if err := checkRestartPolicy(config.RestartPolicy); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := config.stopSequence(); err != nil {
+		return nil, err
+	}
+
+	if _, _, err := config.logLevel(); err != nil {
+		return nil, err
+	}
+
+	if config.RecycleWindow != "" {
+		if _, err := parseRecycleWindow(config.RecycleWindow); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Nice != nil && (*config.Nice < -20 || *config.Nice > 19) {
+		return nil, fmt.Errorf("invalid nice: %v", *config.Nice)
+	}
+
+	if config.ActivateIf != "" {
+		if _, err := parseActivation(config.ActivateIf); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.SHA256 != "" {
+		if sum, err := hex.DecodeString(config.SHA256); err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256: %v", config.SHA256)
+		}
+	}
+
+	if config.LogMaxSize < 0 {
+		return nil, fmt.Errorf("invalid log-max-size: %v", config.LogMaxSize)
+	}
+	if config.LogMaxFiles != nil && *config.LogMaxFiles < 0 {
+		return nil, fmt.Errorf("invalid log-max-files: %v", *config.LogMaxFiles)
+	}
+	if _, _, err := config.logBuffer(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// loadWorkerConfig reads the config file for the worker executable named
+// name. If no config file exists, a zero-value config is returned.
+func loadWorkerConfig(name string) (*workerConfig, error) {
+	file := filepath.Join(workerConfigDir(), name+".toml")
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &workerConfig{}, nil
+		}
+		return nil, fmt.Errorf("cannot open '%v' for reading: %w", file, err)
+	}
+	defer f.Close()
+
+	config, err := readWorkerConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read worker config file '%v': %w", file, err)
+	}
+	return config, nil
+}
+
+// umask parses the Umask field as an octal file mode creation mask.
+func (c *workerConfig) umask() (int, error) {
+	mask, err := strconv.ParseUint(c.Umask, 8, 32)
+	if err != nil || mask > 0777 {
+		return 0, fmt.Errorf("invalid umask: %v", c.Umask)
+	}
+	return int(mask), nil
+}
+
+// startupTimeout parses the StartupTimeout field, returning 0 if it is not
+// set.
+func (c *workerConfig) startupTimeout() (time.Duration, error) {
+	d, err := parseOptionalDuration(c.StartupTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse startup-timeout: %w", err)
+	}
+	return d, nil
+}
+
+// maxLifetime parses the MaxLifetime field, returning 0 if it is not set.
+func (c *workerConfig) maxLifetime() (time.Duration, error) {
+	d, err := parseOptionalDuration(c.MaxLifetime)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse max-lifetime: %w", err)
+	}
+	return d, nil
+}
+
+// args returns the Args field with each reference to a runtime value replaced
+// by the value of its variable in env, a list of "KEY=value" strings.
+func (c *workerConfig) args(env []string) ([]string, error) {
+	vars := make(map[string]string, len(env))
+	for _, kv := range env {
+		key, value := splitPair(kv, "=")
+		vars[key] = value
+	}
+
+	args := make([]string, 0, len(c.Args))
+	for _, arg := range c.Args {
+		var unknown string
+		arg = argReference.ReplaceAllStringFunc(arg, func(ref string) string {
+			name := argReference.FindStringSubmatch(ref)[1]
+			key, ok := argValues[name]
+			if !ok {
+				unknown = name
+				return ref
+			}
+			return vars[key]
+		})
+		if unknown != "" {
+			return nil, fmt.Errorf("invalid args: unknown value {%v}", unknown)
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// logLevel parses the LogLevel field, returning false if it is not set.
+func (c *workerConfig) logLevel() (log.Level, bool, error) {
+	if c.LogLevel == "" {
+		return 0, false, nil
+	}
+	level, err := log.ParseLevel(c.LogLevel)
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot parse log-level: %w", err)
+	}
+	return level, true, nil
+}
+
+// restartDelay parses the RestartDelay field, returning 0 if it is not set.
+func (c *workerConfig) restartDelay() (time.Duration, error) {
+	d, err := parseOptionalDuration(c.RestartDelay)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse restart-delay: %w", err)
+	}
+	return d, nil
+}
+
+// assignmentTimeout parses the AssignmentTimeout field, returning false if it
+// is not set.
+func (c *workerConfig) assignmentTimeout() (time.Duration, bool, error) {
+	if c.AssignmentTimeout == "" {
+		return 0, false, nil
+	}
+	d, err := parseOptionalDuration(c.AssignmentTimeout)
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot parse assignment-timeout: %w", err)
+	}
+	return d, true, nil
+}
+
+// stopSequence parses the StopSequence field, returning nil if it is not set.
+func (c *workerConfig) stopSequence() ([]stopStep, error) {
+	if len(c.StopSequence) == 0 {
+		return nil, nil
+	}
+	return parseStopSequence(c.StopSequence)
+}
+
+// recycleIdle parses the RecycleIdle field, returning 0 if it is not set.
+func (c *workerConfig) recycleIdle() (time.Duration, error) {
+	d, err := parseOptionalDuration(c.RecycleIdle)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse recycle-idle: %w", err)
+	}
+	return d, nil
+}
+
+// logBuffer returns the number of bytes of output held before they are
+// written to the log file and the longest time they are held, defaulting
+// either one if only the other is set. They are both 0 if neither is set.
+func (c *workerConfig) logBuffer() (int, time.Duration, error) {
+	if c.LogBufferSize < 0 {
+		return 0, 0, fmt.Errorf("invalid log-buffer-size: %v", c.LogBufferSize)
+	}
+	interval, err := parseOptionalDuration(c.LogFlushInterval)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot parse log-flush-interval: %w", err)
+	}
+
+	size := c.LogBufferSize
+	if size == 0 && interval > 0 {
+		size = defaultWorkerLogBufferSize
+	}
+	if interval == 0 && size > 0 {
+		interval = defaultWorkerLogFlushInterval
+	}
+	return size, interval, nil
+}
+
+// cpus parses the CPUAffinity field into a sorted list of CPU cores.
+func (c *workerConfig) cpus() ([]int, error) {
+	set := make(map[int]bool)
+	for _, field := range strings.Split(c.CPUAffinity, ",") {
+		first, last := splitPair(strings.TrimSpace(field), "-")
+		if last == "" {
+			last = first
+		}
+		lo, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu-affinity: %v", c.CPUAffinity)
+		}
+		hi, err := strconv.ParseUint(last, 10, 16)
+		if err != nil || hi < lo {
+			return nil, fmt.Errorf("invalid cpu-affinity: %v", c.CPUAffinity)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			set[int(cpu)] = true
+		}
+	}
+
+	cpus := make([]int, 0, len(set))
+	for cpu := range set {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// cpuQuota parses the CPUQuota field as a percentage of a single CPU.
+func (c *workerConfig) cpuQuota() (int, error) {
+	percent, err := strconv.ParseUint(strings.TrimSuffix(c.CPUQuota, "%"), 10, 16)
+	if err != nil || percent == 0 || !strings.HasSuffix(c.CPUQuota, "%") {
+		return 0, fmt.Errorf("invalid cpu-quota: %v", c.CPUQuota)
+	}
+	return int(percent), nil
+}
+
+// prepareWorkingDirectory creates the configured working directory if it does
+// not exist, with the permissions the worker's umask allows (0755 if it has
+// none), and verifies that it is writable. If cred is not nil, the
+// directory is given to its user and group, so that a worker running as
+// another user than the daemon can write to it, and its permissions must let
+// that user write to it.
+func (c *workerConfig) prepareWorkingDirectory(cred *syscall.Credential) error {
+	if c.WorkingDirectory == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(c.WorkingDirectory); os.IsNotExist(err) {
+		// The mode is set explicitly, as the daemon's umask is not the
+		// worker's.
+		mode := os.FileMode(0755)
+		if c.Umask != "" {
+			mask, err := c.umask()
+			if err != nil {
+				return err
+			}
+			mode = 0777 &^ os.FileMode(mask)
+		}
+		if err := os.MkdirAll(c.WorkingDirectory, mode); err != nil {
+			return fmt.Errorf("cannot create working directory: %w", err)
+		}
+		if err := os.Chmod(c.WorkingDirectory, mode); err != nil {
+			return fmt.Errorf("cannot change mode of working directory: %w", err)
+		}
+	}
+
+	if cred != nil {
+		if err := os.Chown(c.WorkingDirectory, int(cred.Uid), int(cred.Gid)); err != nil {
+			return fmt.Errorf("cannot change owner of working directory: %w", err)
+		}
+		info, err := os.Stat(c.WorkingDirectory)
+		if err != nil {
+			return fmt.Errorf("cannot stat working directory: %w", err)
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && !canWriteDir(info.Mode().Perm(), st.Uid, st.Gid, cred) {
+			return fmt.Errorf("working directory '%v' is not writable by user %v", c.WorkingDirectory, cred.Uid)
+		}
+	}
+
+	f, err := ioutil.TempFile(c.WorkingDirectory, ".write-test")
+	if err != nil {
+		return fmt.Errorf("working directory '%v' is not writable: %w", c.WorkingDirectory, err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("cannot remove file: %w", err)
+	}
+
+	return nil
+}
+
+// openLogFile opens the configured worker log file for writing. It returns nil
+// if no log file is configured.
+func (c *workerConfig) openLogFile() (*rotatingFile, error) {
+	if c.LogFile == "" {
+		return nil, nil
+	}
+
+	maxSize := c.LogMaxSize
+	if maxSize == 0 {
+		maxSize = defaultWorkerLogMaxSize
+	}
+	maxFiles := defaultWorkerLogMaxFiles
+	if c.LogMaxFiles != nil {
+		maxFiles = *c.LogMaxFiles
+	}
+
+	f, err := openRotatingFile(c.LogFile, maxSize, maxFiles)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open worker log file: %w", err)
+	}
+	return f, nil
+}
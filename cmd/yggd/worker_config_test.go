@@ -0,0 +1,568 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadWorkerConfig(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        *workerConfig
+		wantError   bool
+	}{
+		{
+			description: "empty",
+			input:       "",
+			want:        &workerConfig{},
+		},
+		{
+			description: "working directory and umask",
+			input: strings.Join([]string{
+				`working-directory = "/var/lib/yggdrasil/echo"`,
+				`umask = "0027"`,
+			}, "\n"),
+			want: &workerConfig{
+				WorkingDirectory: "/var/lib/yggdrasil/echo",
+				Umask:            "0027",
+			},
+		},
+		{
+			description: "invalid umask",
+			input:       `umask = "0999"`,
+			wantError:   true,
+		},
+		{
+			description: "cpu affinity",
+			input:       `cpu-affinity = "2,4-5"`,
+			want:        &workerConfig{CPUAffinity: "2,4-5"},
+		},
+		{
+			description: "invalid cpu affinity",
+			input:       `cpu-affinity = "5-4"`,
+			wantError:   true,
+		},
+		{
+			description: "user and group",
+			input:       "user = \"yggdrasil\"\ngroup = \"yggdrasil\"",
+			want:        &workerConfig{User: "yggdrasil", Group: "yggdrasil"},
+		},
+		{
+			description: "resource limits",
+			input:       "cpu-quota = \"50%\"\nmemory-max = 536870912",
+			want:        &workerConfig{CPUQuota: "50%", MemoryMax: 536870912},
+		},
+		{
+			description: "invalid cpu-quota",
+			input:       `cpu-quota = "0.5"`,
+			wantError:   true,
+		},
+		{
+			description: "invalid memory-max",
+			input:       `memory-max = -1`,
+			wantError:   true,
+		},
+		{
+			description: "startup timeout",
+			input:       `startup-timeout = "30s"`,
+			want:        &workerConfig{StartupTimeout: "30s"},
+		},
+		{
+			description: "invalid startup timeout",
+			input:       `startup-timeout = "soon"`,
+			wantError:   true,
+		},
+		{
+			description: "nice",
+			input:       `nice = 10`,
+			want:        &workerConfig{Nice: func() *int { n := 10; return &n }()},
+		},
+		{
+			description: "invalid nice",
+			input:       `nice = 20`,
+			wantError:   true,
+		},
+		{
+			description: "activate-if",
+			input:       `activate-if = "facts.fqdn == 'db1.example.com'"`,
+			want:        &workerConfig{ActivateIf: "facts.fqdn == 'db1.example.com'"},
+		},
+		{
+			description: "invalid activate-if",
+			input:       `activate-if = "facts.kernel == 'linux'"`,
+			wantError:   true,
+		},
+		{
+			description: "max lifetime",
+			input:       "max-lifetime = \"24h\"\nrecycle-idle = \"5m\"\nrecycle-window = \"22:00-04:00\"",
+			want:        &workerConfig{MaxLifetime: "24h", RecycleIdle: "5m", RecycleWindow: "22:00-04:00"},
+		},
+		{
+			description: "invalid max lifetime",
+			input:       `max-lifetime = "-1h"`,
+			wantError:   true,
+		},
+		{
+			description: "restart delay",
+			input:       `restart-delay = "10s"`,
+			want:        &workerConfig{RestartDelay: "10s"},
+		},
+		{
+			description: "invalid restart delay",
+			input:       `restart-delay = "soon"`,
+			wantError:   true,
+		},
+		{
+			description: "assignment timeout",
+			input:       `assignment-timeout = "0s"`,
+			want:        &workerConfig{AssignmentTimeout: "0s"},
+		},
+		{
+			description: "invalid assignment timeout",
+			input:       `assignment-timeout = "-1m"`,
+			wantError:   true,
+		},
+		{
+			description: "restart policy",
+			input:       `restart-policy = "on-failure"`,
+			want:        &workerConfig{RestartPolicy: "on-failure"},
+		},
+		{
+			description: "invalid restart policy",
+			input:       `restart-policy = "sometimes"`,
+			wantError:   true,
+		},
+		{
+			description: "stop sequence",
+			input:       `stop-sequence = ["TERM:10s", "KILL"]`,
+			want:        &workerConfig{StopSequence: []string{"TERM:10s", "KILL"}},
+		},
+		{
+			description: "invalid stop sequence",
+			input:       `stop-sequence = ["TERM:10s"]`,
+			wantError:   true,
+		},
+		{
+			description: "log level",
+			input:       `log-level = "trace"`,
+			want:        &workerConfig{LogLevel: "trace"},
+		},
+		{
+			description: "invalid log level",
+			input:       `log-level = "loud"`,
+			wantError:   true,
+		},
+		{
+			description: "args",
+			input:       `args = ["--socket", "{socket_addr}"]`,
+			want:        &workerConfig{Args: []string{"--socket", "{socket_addr}"}},
+		},
+		{
+			description: "unknown arg value",
+			input:       `args = ["--socket={socket}"]`,
+			wantError:   true,
+		},
+		{
+			description: "invalid recycle window",
+			input:       `recycle-window = "02:00"`,
+			wantError:   true,
+		},
+		{
+			description: "log buffer",
+			input:       "log-buffer-size = 65536\nlog-flush-interval = \"5s\"",
+			want:        &workerConfig{LogBufferSize: 65536, LogFlushInterval: "5s"},
+		},
+		{
+			description: "no rotated log files",
+			input:       `log-max-files = 0`,
+			want:        &workerConfig{LogMaxFiles: func() *int { n := 0; return &n }()},
+		},
+		{
+			description: "invalid log-max-files",
+			input:       `log-max-files = -1`,
+			wantError:   true,
+		},
+		{
+			description: "invalid log flush interval",
+			input:       `log-flush-interval = "-5s"`,
+			wantError:   true,
+		},
+		{
+			description: "sha256",
+			input:       `sha256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"`,
+			want:        &workerConfig{SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		},
+		{
+			description: "invalid sha256",
+			input:       `sha256 = "e3b0c442"`,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := readWorkerConfig(strings.NewReader(test.input))
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWorkerConfigCPUs(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        []int
+		wantError   bool
+	}{
+		{
+			description: "single",
+			input:       "3",
+			want:        []int{3},
+		},
+		{
+			description: "list and ranges",
+			input:       "6, 0-2,1",
+			want:        []int{0, 1, 2, 6},
+		},
+		{
+			description: "descending range",
+			input:       "3-1",
+			wantError:   true,
+		},
+		{
+			description: "not a number",
+			input:       "all",
+			wantError:   true,
+		},
+		{
+			description: "empty element",
+			input:       "1,,2",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			config := workerConfig{CPUAffinity: test.input}
+			got, err := config.cpus()
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWorkerConfigOpenLogFile(t *testing.T) {
+	tests := []struct {
+		description string
+		maxFiles    *int
+		want        int
+	}{
+		{
+			description: "unset",
+			want:        defaultWorkerLogMaxFiles,
+		},
+		{
+			description: "none",
+			maxFiles:    func() *int { n := 0; return &n }(),
+			want:        0,
+		},
+		{
+			description: "set",
+			maxFiles:    func() *int { n := 3; return &n }(),
+			want:        3,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			config := workerConfig{LogFile: filepath.Join(dir, test.description+".log"), LogMaxFiles: test.maxFiles}
+			f, err := config.openLogFile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if f.maxFiles != test.want {
+				t.Errorf("%v != %v", f.maxFiles, test.want)
+			}
+		})
+	}
+}
+
+func TestWorkerConfigCredential(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	group, err := user.LookupGroupId(current.Gid)
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.ParseUint(current.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(current.Gid, 10, 32)
+
+	tests := []struct {
+		description string
+		config      workerConfig
+		wantUID     uint32
+		wantGID     uint32
+		wantError   bool
+	}{
+		{
+			description: "unset",
+		},
+		{
+			description: "user name",
+			config:      workerConfig{User: current.Username},
+			wantUID:     uint32(uid),
+			wantGID:     uint32(gid),
+		},
+		{
+			description: "user ID and group name",
+			config:      workerConfig{User: current.Uid, Group: group.Name},
+			wantUID:     uint32(uid),
+			wantGID:     uint32(gid),
+		},
+		{
+			description: "unknown user",
+			config:      workerConfig{User: "no-such-user-yggdrasil"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := test.config.credential()
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.config.User == "" {
+				if got != nil {
+					t.Errorf("expected no credential, got %#v", got)
+				}
+				return
+			}
+			if got.Uid != test.wantUID || got.Gid != test.wantGID {
+				t.Errorf("%v:%v != %v:%v", got.Uid, got.Gid, test.wantUID, test.wantGID)
+			}
+		})
+	}
+}
+
+func TestCanWriteDir(t *testing.T) {
+	tests := []struct {
+		description string
+		perm        os.FileMode
+		cred        syscall.Credential
+		want        bool
+	}{
+		{description: "owner", perm: 0700, cred: syscall.Credential{Uid: 1000, Gid: 1000}, want: true},
+		{description: "owner without write", perm: 0577, cred: syscall.Credential{Uid: 1000, Gid: 1000}},
+		{description: "group", perm: 0770, cred: syscall.Credential{Uid: 1001, Gid: 1000}, want: true},
+		{description: "group without write", perm: 0757, cred: syscall.Credential{Uid: 1001, Gid: 1000}},
+		{description: "supplementary group", perm: 0770, cred: syscall.Credential{Uid: 1001, Gid: 1001, Groups: []uint32{1000}}, want: true},
+		{description: "other", perm: 0775, cred: syscall.Credential{Uid: 1001, Gid: 1001}},
+		{description: "other with write", perm: 0703, cred: syscall.Credential{Uid: 1001, Gid: 1001}, want: true},
+		{description: "root", perm: 0500, cred: syscall.Credential{}, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := canWriteDir(test.perm, 1000, 1000, &test.cred); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPrepareWorkingDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		description string
+		umask       string
+		want        os.FileMode
+	}{
+		{
+			description: "default",
+			want:        0755,
+		},
+		{
+			description: "umask",
+			umask:       "0027",
+			want:        0750,
+		},
+		{
+			description: "permissive umask",
+			umask:       "0002",
+			want:        0775,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			config := workerConfig{WorkingDirectory: filepath.Join(dir, test.description), Umask: test.umask}
+			if err := config.prepareWorkingDirectory(nil); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(config.WorkingDirectory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Perm(); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNextRestartBackoff(t *testing.T) {
+	var got []time.Duration
+	for backoff := time.Duration(0); backoff < restartBackoffLimit; {
+		backoff = nextRestartBackoff(backoff)
+		got = append(got, backoff)
+	}
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second, 160 * time.Second}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestRestartWait(t *testing.T) {
+	tests := []struct {
+		description string
+		delay       string
+		backoff     time.Duration
+		want        time.Duration
+	}{
+		{
+			description: "unset",
+			backoff:     5 * time.Second,
+		},
+		{
+			description: "longer than backoff",
+			delay:       "8s",
+			backoff:     5 * time.Second,
+			want:        3 * time.Second,
+		},
+		{
+			description: "shorter than backoff",
+			delay:       "2s",
+			backoff:     5 * time.Second,
+		},
+		{
+			description: "no backoff",
+			delay:       "2s",
+			want:        2 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := restartWait(&workerConfig{RestartDelay: test.delay}, test.backoff)
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWorkerConfigArgs(t *testing.T) {
+	env := []string{"YGG_SOCKET_ADDR=unix:@yggd", "YGG_LOG_LEVEL=debug", "YGG_CONFIG_DIR=/etc/yggdrasil"}
+	tests := []struct {
+		description string
+		args        []string
+		want        []string
+		wantError   bool
+	}{
+		{
+			description: "none",
+			want:        []string{},
+		},
+		{
+			description: "literal",
+			args:        []string{"--verbose", "{"},
+			want:        []string{"--verbose", "{"},
+		},
+		{
+			description: "values",
+			args:        []string{"--socket", "{socket_addr}", "--log-level={log_level}", "{config_dir}/echo.toml"},
+			want:        []string{"--socket", "unix:@yggd", "--log-level=debug", "/etc/yggdrasil/echo.toml"},
+		},
+		{
+			description: "unset value",
+			args:        []string{"--client-id={client_id}"},
+			want:        []string{"--client-id="},
+		},
+		{
+			description: "unknown value",
+			args:        []string{"{home}"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			config := workerConfig{Args: test.args}
+			got, err := config.args(env)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// lostAssignments returns the IDs of the messages assigned to the worker
+// process pid that it has not responded to. It is replaced by the daemon with
+// the dispatcher's assignments.
+var lostAssignments = func(pid int) []string { return nil }
+
+// workerExited is called when a worker process exits unexpectedly. It is
+// replaced by the daemon to notify the backend.
+var workerExited = func(exit workerExit) {}
+
+// A workerExit describes the unexpected exit of a worker process.
+type workerExit struct {
+	worker     string
+	pid        int
+	reason     string
+	restarting bool
+	lost       []string
+}
+
+// lostAssignments returns the IDs of the messages assigned to the worker
+// process pid, sorted.
+func (d *dispatcher) lostAssignments(pid int) []string {
+	d.RLock()
+	defer d.RUnlock()
+
+	ids := make([]string, 0)
+	for id, a := range d.assignments {
+		if a.pid == pid {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// A workerExitNotifier publishes a notification of each unexpected exit of a
+// worker process, at most once every interval for each worker. The exits of a
+// worker within interval of its last notification are coalesced into one
+// notification, published when the interval has passed.
+type workerExitNotifier struct {
+	interval time.Duration
+	publish  func(msg *yggdrasil.WorkerExit)
+
+	lock     sync.Mutex
+	restarts map[string]int
+	last     map[string]time.Time
+	pending  map[string]*yggdrasil.WorkerExit
+}
+
+func newWorkerExitNotifier(interval time.Duration, publish func(msg *yggdrasil.WorkerExit)) *workerExitNotifier {
+	return &workerExitNotifier{
+		interval: interval,
+		publish:  publish,
+		restarts: make(map[string]int),
+		last:     make(map[string]time.Time),
+		pending:  make(map[string]*yggdrasil.WorkerExit),
+	}
+}
+
+// exited records exit, publishing a notification of it at once unless one was
+// published for the same worker within the interval.
+func (n *workerExitNotifier) exited(exit workerExit) {
+	n.lock.Lock()
+	n.restarts[exit.worker]++
+
+	if msg, prs := n.pending[exit.worker]; prs {
+		msg.Content.PID = exit.pid
+		msg.Content.Reason = exit.reason
+		msg.Content.Restarting = exit.restarting
+		msg.Content.Restarts = n.restarts[exit.worker]
+		msg.Content.Exits++
+		msg.Content.LostMessageIDs = append(msg.Content.LostMessageIDs, exit.lost...)
+		n.lock.Unlock()
+		return
+	}
+
+	msg := &yggdrasil.WorkerExit{
+		Type:    yggdrasil.MessageTypeWorkerExit,
+		Version: 1,
+	}
+	msg.Content.Worker = exit.worker
+	msg.Content.PID = exit.pid
+	msg.Content.Reason = exit.reason
+	msg.Content.Restarting = exit.restarting
+	msg.Content.Restarts = n.restarts[exit.worker]
+	msg.Content.Exits = 1
+	msg.Content.LostMessageIDs = append([]string{}, exit.lost...)
+
+	now := time.Now()
+	if last, prs := n.last[exit.worker]; prs && now.Sub(last) < n.interval {
+		n.pending[exit.worker] = msg
+		time.AfterFunc(last.Add(n.interval).Sub(now), func() { n.flush(exit.worker) })
+		n.lock.Unlock()
+		return
+	}
+	n.last[exit.worker] = now
+	n.lock.Unlock()
+
+	n.send(msg)
+}
+
+// flush publishes the pending notification for worker.
+func (n *workerExitNotifier) flush(worker string) {
+	n.lock.Lock()
+	msg, prs := n.pending[worker]
+	delete(n.pending, worker)
+	n.last[worker] = time.Now()
+	n.lock.Unlock()
+
+	if prs {
+		n.send(msg)
+	}
+}
+
+func (n *workerExitNotifier) send(msg *yggdrasil.WorkerExit) {
+	msg.MessageID = uuid.New().String()
+	msg.Sent = time.Now()
+	n.publish(msg)
+}
+
+// PublishWorkerExit publishes msg to dest.
+func (c *Client) PublishWorkerExit(msg *yggdrasil.WorkerExit, dest string) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("cannot marshal message: %v", err)
+		return
+	}
+	if err := c.sendAcknowledgedData(data, dest); err != nil {
+		log.Errorf("cannot publish exit of worker %v: %v", msg.Content.Worker, err)
+		return
+	}
+	log.Debugf("published exit of worker %v (%v exits, %v lost messages)", msg.Content.Worker, msg.Content.Exits, len(msg.Content.LostMessageIDs))
+}
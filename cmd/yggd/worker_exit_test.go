@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestWorkerExitNotifier(t *testing.T) {
+	var lock sync.Mutex
+	var published []yggdrasil.WorkerExit
+	n := newWorkerExitNotifier(50*time.Millisecond, func(msg *yggdrasil.WorkerExit) {
+		lock.Lock()
+		defer lock.Unlock()
+		published = append(published, *msg)
+	})
+	count := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(published)
+	}
+
+	n.exited(workerExit{worker: "echo-worker", pid: 1, reason: "exit status 1", restarting: true, lost: []string{"a"}})
+	if count() != 1 {
+		t.Fatalf("expected the first exit to be published at once, got %v", count())
+	}
+	n.exited(workerExit{worker: "echo-worker", pid: 2, reason: "exit status 2", restarting: true, lost: []string{"b"}})
+	n.exited(workerExit{worker: "other-worker", pid: 3, reason: "signal: killed", restarting: true})
+	n.exited(workerExit{worker: "echo-worker", pid: 4, reason: "exit status 3", restarting: false, lost: []string{"c"}})
+	if count() != 2 {
+		t.Fatalf("expected the exits of a flapping worker to be held, got %v", count())
+	}
+	waitFor(t, func() bool { return count() == 3 })
+
+	lock.Lock()
+	defer lock.Unlock()
+	got := published[2].Content
+	if got.Worker != "echo-worker" || got.PID != 4 || got.Reason != "exit status 3" || got.Restarting || got.Exits != 2 || got.Restarts != 3 {
+		t.Errorf("unexpected coalesced notification: %+v", got)
+	}
+	if want := []string{"b", "c"}; !cmp.Equal(got.LostMessageIDs, want) {
+		t.Errorf("%v != %v", got.LostMessageIDs, want)
+	}
+	if published[1].Content.Worker != "other-worker" || published[1].Content.Exits != 1 {
+		t.Errorf("unexpected notification: %+v", published[1].Content)
+	}
+	if published[0].MessageID == "" || published[0].Type != yggdrasil.MessageTypeWorkerExit {
+		t.Errorf("unexpected message: %+v", published[0])
+	}
+}
+
+func TestLostAssignments(t *testing.T) {
+	d := newDispatcher(nil)
+	d.assignments["b"] = &assignment{pid: 1}
+	d.assignments["a"] = &assignment{pid: 1}
+	d.assignments["c"] = &assignment{pid: 2}
+
+	if got, want := d.lostAssignments(1), []string{"a", "b"}; !cmp.Equal(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got := d.lostAssignments(3); len(got) != 0 {
+		t.Errorf("unexpected assignments: %v", got)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"git.sr.ht/~spc/go-log"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+// maxWorkerFactsSize is the maximum total size in bytes of the keys and values
+// of the facts a single worker may contribute.
+const maxWorkerFactsSize = 8 * 1024
+
+// checkWorkerFacts returns an error if facts exceed the size permitted for a
+// single worker.
+func checkWorkerFacts(facts map[string]string) error {
+	var size int
+	for k, v := range facts {
+		if k == "" {
+			return fmt.Errorf("fact names must not be empty")
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxWorkerFactsSize {
+		return fmt.Errorf("facts size %v exceeds the maximum of %v bytes", size, maxWorkerFactsSize)
+	}
+	return nil
+}
+
+// SetFacts replaces the facts contributed by the registered worker for the
+// handler in r. Each worker's facts are kept under its own handler name, so
+// workers cannot overwrite each other's facts or the client's own facts.
+func (d *dispatcher) SetFacts(ctx context.Context, r *pb.Facts) (*pb.Receipt, error) {
+	if err := checkWorkerFacts(r.GetFacts()); err != nil {
+		return nil, fmt.Errorf("cannot set facts for worker %v: %w", r.GetHandler(), err)
+	}
+
+	d.Lock()
+	w, prs := d.workers[r.GetHandler()]
+	if !prs {
+		d.Unlock()
+		return nil, fmt.Errorf("cannot set facts: no worker registered for handler %v", r.GetHandler())
+	}
+	w.facts = r.GetFacts()
+	d.workers[r.GetHandler()] = w
+	d.Unlock()
+
+	log.Debugf("worker %v set %v facts", r.GetHandler(), len(r.GetFacts()))
+
+	if d.factsChanged != nil {
+		d.factsChanged()
+	}
+
+	return &pb.Receipt{}, nil
+}
+
+// WorkerFacts returns a copy of the facts contributed by each registered
+// worker, keyed by handler. Workers that contributed no facts are omitted.
+func (d *dispatcher) WorkerFacts() map[string]map[string]string {
+	d.RLock()
+	defer d.RUnlock()
+
+	facts := make(map[string]map[string]string)
+	for handler, w := range d.workers {
+		if len(w.facts) == 0 {
+			continue
+		}
+		m := make(map[string]string, len(w.facts))
+		for k, v := range w.facts {
+			m[k] = v
+		}
+		facts[handler] = m
+	}
+	return facts
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+func TestSetFacts(t *testing.T) {
+	tests := []struct {
+		description string
+		input       *pb.Facts
+		want        map[string]map[string]string
+		wantError   bool
+	}{
+		{
+			description: "registered",
+			input:       &pb.Facts{Handler: "inventory", Facts: map[string]string{"packages": "42"}},
+			want:        map[string]map[string]string{"inventory": {"packages": "42"}},
+		},
+		{
+			description: "unregistered",
+			input:       &pb.Facts{Handler: "echo", Facts: map[string]string{"packages": "42"}},
+			want:        map[string]map[string]string{},
+			wantError:   true,
+		},
+		{
+			description: "too large",
+			input:       &pb.Facts{Handler: "inventory", Facts: map[string]string{"packages": strings.Repeat("x", maxWorkerFactsSize)}},
+			want:        map[string]map[string]string{},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.workers["inventory"] = worker{handler: "inventory"}
+			var changed bool
+			d.factsChanged = func() { changed = true }
+
+			_, err := d.SetFacts(context.Background(), test.input)
+			if test.wantError {
+				if err == nil {
+					t.Error("expected error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if changed == test.wantError {
+				t.Errorf("factsChanged called: %v", changed)
+			}
+
+			got := d.WorkerFacts()
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
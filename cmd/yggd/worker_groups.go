@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/pelletier/go-toml"
+	"github.com/urfave/cli/v2"
+)
+
+// workerGroupConfig holds the settings for a worker group, read from a
+// "[[worker-group]]" table in the config file.
+type workerGroupConfig struct {
+	// Name identifies the group.
+	Name string `toml:"name"`
+
+	// Members lists the handlers of the workers in the group.
+	Members []string `toml:"members"`
+
+	// MaxConcurrency is the number of messages the workers in the group may
+	// be working on at once, together.
+	MaxConcurrency int `toml:"max-concurrency"`
+
+	// MaxQueueDepth is the number of messages that may wait for a slot of
+	// the group. Further messages are rejected. If zero, any number of
+	// messages may wait.
+	MaxQueueDepth int `toml:"max-queue-depth"`
+}
+
+// readWorkerGroupConfigs reads from its input, unmarshalling the
+// "worker-group" tables of the TOML-encoded value and validating their
+// values. Other keys are ignored.
+func readWorkerGroupConfigs(in io.Reader) ([]workerGroupConfig, error) {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read input: %w", err)
+	}
+
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse TOML: %w", err)
+	}
+	if !tree.Has("worker-group") {
+		return nil, nil
+	}
+	tables, ok := tree.Get("worker-group").([]*toml.Tree)
+	if !ok {
+		return nil, fmt.Errorf("worker-group: not an array of tables")
+	}
+
+	names := make(map[string]bool)
+	members := make(map[string]string)
+	groups := make([]workerGroupConfig, 0, len(tables))
+	for i, t := range tables {
+		var group workerGroupConfig
+		if err := t.Unmarshal(&group); err != nil {
+			return nil, fmt.Errorf("worker-group %v: %w", i, err)
+		}
+		if group.Name == "" {
+			return nil, fmt.Errorf("worker-group %v: missing name", i)
+		}
+		if names[group.Name] {
+			return nil, fmt.Errorf("worker-group %v: duplicate name", group.Name)
+		}
+		names[group.Name] = true
+		if len(group.Members) == 0 {
+			return nil, fmt.Errorf("worker-group %v: missing members", group.Name)
+		}
+		for _, member := range group.Members {
+			if other, prs := members[member]; prs {
+				return nil, fmt.Errorf("worker-group %v: %v is already a member of %v", group.Name, member, other)
+			}
+			members[member] = group.Name
+		}
+		if group.MaxConcurrency <= 0 {
+			return nil, fmt.Errorf("worker-group %v: invalid max-concurrency: %v", group.Name, group.MaxConcurrency)
+		}
+		if group.MaxQueueDepth < 0 {
+			return nil, fmt.Errorf("worker-group %v: invalid max-queue-depth: %v", group.Name, group.MaxQueueDepth)
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+// loadWorkerGroupConfigs reads the worker group tables from the config file.
+// If file is empty, no groups are returned.
+func loadWorkerGroupConfigs(file string) ([]workerGroupConfig, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := readConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := readWorkerGroupConfigs(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read worker group config from '%v': %w", file, err)
+	}
+	return groups, nil
+}
+
+// A workerGroup is a set of workers sharing a concurrency budget. inUse counts
+// the messages delivered to its members that have not been responded to, and
+// waiting holds the messages waiting for one of them to be responded to, in
+// the order they were queued. rejected counts the messages rejected because
+// waiting was full.
+type workerGroup struct {
+	workerGroupConfig
+
+	inUse    int
+	waiting  []queuedData
+	rejected uint64
+}
+
+// workerGroups enforces the concurrency budget of each worker group across
+// the messages dispatched to its members. A message dispatched to a member
+// takes one of the group's slots until the worker responds to it, it cannot be
+// delivered, its assignment times out or is cancelled, or the worker exits.
+type workerGroups struct {
+	lock     sync.Mutex
+	groups   map[string]*workerGroup
+	handlers map[string]*workerGroup
+
+	// slots maps the ID of each message holding a slot to its group.
+	slots map[string]*workerGroup
+
+	// bytes is the estimated memory held by the waiting messages.
+	bytes int
+}
+
+func newWorkerGroups(configs []workerGroupConfig) *workerGroups {
+	g := workerGroups{
+		groups:   make(map[string]*workerGroup, len(configs)),
+		handlers: make(map[string]*workerGroup),
+		slots:    make(map[string]*workerGroup),
+	}
+	for _, config := range configs {
+		group := &workerGroup{workerGroupConfig: config}
+		g.groups[config.Name] = group
+		for _, member := range config.Members {
+			g.handlers[member] = group
+		}
+	}
+	return &g
+}
+
+// acquire takes a slot of the group of the worker q is dispatched to and
+// returns true, or, if the group's slots are all in use, queues q to be
+// dispatched once one is released and returns false. If the group's queue is
+// full, q is not queued and an error is returned instead. A message for a
+// worker outside any group, or that already holds a slot, is always
+// dispatched. It always returns true if g is nil.
+func (g *workerGroups) acquire(q queuedData) (bool, error) {
+	if g == nil {
+		return true, nil
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	group, prs := g.handlers[q.data.Directive]
+	if !prs {
+		return true, nil
+	}
+	if _, held := g.slots[q.data.MessageID]; held {
+		return true, nil
+	}
+	if group.inUse >= group.MaxConcurrency {
+		if group.MaxQueueDepth > 0 && len(group.waiting) >= group.MaxQueueDepth {
+			group.rejected++
+			metrics.addSeries("worker_group_rejected_total", []metricLabel{{"group", group.Name}}, 1)
+			return false, fmt.Errorf("worker group %v has %v messages waiting for a slot", group.Name, len(group.waiting))
+		}
+		log.Debugf("queueing message %v: worker group %v is at its concurrency limit of %v", q.data.MessageID, group.Name, group.MaxConcurrency)
+		group.waiting = append(group.waiting, q)
+		g.bytes += queuedDataSize(q)
+		return false, nil
+	}
+	group.inUse++
+	g.slots[q.data.MessageID] = group
+	return true, nil
+}
+
+// release releases the slot held by the message id, if any. If a message is
+// waiting for a slot of the same group, the slot is handed to it and the
+// message is returned, to be dispatched. It does nothing if g is nil.
+func (g *workerGroups) release(id string) (queuedData, bool) {
+	if g == nil {
+		return queuedData{}, false
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	group, held := g.slots[id]
+	if !held {
+		return queuedData{}, false
+	}
+	delete(g.slots, id)
+	if len(group.waiting) == 0 {
+		group.inUse--
+		return queuedData{}, false
+	}
+	next := group.waiting[0]
+	group.waiting = group.waiting[1:]
+	g.bytes -= queuedDataSize(next)
+	g.slots[next.data.MessageID] = group
+	return next, true
+}
+
+// memoryUsage returns the estimated memory held by the messages waiting for a
+// slot, in bytes. It returns 0 if g is nil.
+func (g *workerGroups) memoryUsage() int {
+	if g == nil {
+		return 0
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.bytes
+}
+
+// nextShed returns the message waiting for a slot of any group that is shed
+// first to reclaim memory. It returns false if no message is waiting or g is
+// nil.
+func (g *workerGroups) nextShed() (queuedData, bool) {
+	if g == nil {
+		return queuedData{}, false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	var next queuedData
+	var ok bool
+	for _, group := range g.groups {
+		if i := nextShed(group.waiting); i >= 0 && (!ok || shedsBefore(group.waiting[i], next)) {
+			next, ok = group.waiting[i], true
+		}
+	}
+	return next, ok
+}
+
+// shed removes and returns the message id waiting for a slot of a group. It
+// returns false if the message is not waiting or g is nil.
+func (g *workerGroups) shed(id string) (queuedData, bool) {
+	if g == nil {
+		return queuedData{}, false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, group := range g.groups {
+		for i, q := range group.waiting {
+			if q.data.MessageID == id {
+				group.waiting = append(group.waiting[:i:i], group.waiting[i+1:]...)
+				g.bytes -= queuedDataSize(q)
+				return q, true
+			}
+		}
+	}
+	return queuedData{}, false
+}
+
+// A workerGroupStatus describes the utilization of a worker group.
+type workerGroupStatus struct {
+	Name           string   `json:"name"`
+	Members        []string `json:"members"`
+	MaxConcurrency int      `json:"max_concurrency"`
+	MaxQueueDepth  int      `json:"max_queue_depth"`
+	InUse          int      `json:"in_use"`
+	Waiting        int      `json:"waiting"`
+	Rejected       uint64   `json:"rejected"`
+}
+
+// status returns the utilization of each group, sorted by name.
+func (g *workerGroups) status() []workerGroupStatus {
+	statuses := make([]workerGroupStatus, 0)
+	if g == nil {
+		return statuses
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for _, group := range g.groups {
+		statuses = append(statuses, workerGroupStatus{
+			Name:           group.Name,
+			Members:        group.Members,
+			MaxConcurrency: group.MaxConcurrency,
+			MaxQueueDepth:  group.MaxQueueDepth,
+			InUse:          group.inUse,
+			Waiting:        len(group.waiting),
+			Rejected:       group.rejected,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// handle is the control handler for the "worker-groups" command. It reports
+// the utilization of each worker group.
+func (g *workerGroups) handle(args map[string]string) (interface{}, error) {
+	return g.status(), nil
+}
+
+// releaseSlot ends the turn of the message id in its ordered sequence and
+// releases the worker group slot it holds, dispatching the messages waiting
+// for them, if any. As its processing has ended, the message is acknowledged
+// to the queue.
+func (d *dispatcher) releaseSlot(id string) {
+	if err := d.queue.Ack(id); err != nil {
+		log.Errorf("cannot acknowledge queued message %v: %v", id, err)
+	}
+	if next, ok := d.ordering.release(id); ok {
+		go d.dispatch(next)
+	}
+	if next, ok := d.groups.release(id); ok {
+		go d.dispatch(next)
+	}
+}
+
+// workerGroupsAction calls the "worker-groups" control command on the running
+// daemon and prints the utilization of each worker group, either as a table
+// or as JSON.
+func workerGroupsAction(c *cli.Context) error {
+	result, err := callControl(c.String("control-socket-addr"), "worker-groups", nil)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+
+	var statuses []workerGroupStatus
+	if err := json.Unmarshal(result, &statuses); err != nil {
+		return cli.Exit(fmt.Errorf("cannot unmarshal result: %w", err), 1)
+	}
+
+	if c.Bool("json") {
+		data, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			return cli.Exit(fmt.Errorf("cannot marshal worker groups: %w", err), 1)
+		}
+		fmt.Fprintln(c.App.Writer, string(data))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.App.Writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tIN USE\tWAITING\tREJECTED\tMEMBERS")
+	for _, s := range statuses {
+		waiting := fmt.Sprint(s.Waiting)
+		if s.MaxQueueDepth > 0 {
+			waiting = fmt.Sprintf("%v/%v", s.Waiting, s.MaxQueueDepth)
+		}
+		fmt.Fprintf(w, "%v\t%v/%v\t%v\t%v\t%v\n", s.Name, s.InUse, s.MaxConcurrency, waiting, s.Rejected, strings.Join(s.Members, ","))
+	}
+	if err := w.Flush(); err != nil {
+		return cli.Exit(fmt.Errorf("cannot write worker groups: %w", err), 1)
+	}
+
+	return nil
+}
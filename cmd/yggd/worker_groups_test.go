@@ -0,0 +1,246 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestReadWorkerGroupConfigs(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        []workerGroupConfig
+		wantError   bool
+	}{
+		{
+			description: "no groups",
+			input:       `server = "tcp://localhost:1883"`,
+		},
+		{
+			description: "groups",
+			input: strings.Join([]string{
+				`[[worker-group]]`,
+				`name = "inventory-api"`,
+				`members = ["package-manager", "insights"]`,
+				`max-concurrency = 2`,
+			}, "\n"),
+			want: []workerGroupConfig{
+				{Name: "inventory-api", Members: []string{"package-manager", "insights"}, MaxConcurrency: 2},
+			},
+		},
+		{
+			description: "missing max-concurrency",
+			input: strings.Join([]string{
+				`[[worker-group]]`,
+				`name = "inventory-api"`,
+				`members = ["insights"]`,
+			}, "\n"),
+			wantError: true,
+		},
+		{
+			description: "queue depth",
+			input: strings.Join([]string{
+				`[[worker-group]]`,
+				`name = "sleep"`,
+				`members = ["sleep"]`,
+				`max-concurrency = 1`,
+				`max-queue-depth = 4`,
+			}, "\n"),
+			want: []workerGroupConfig{
+				{Name: "sleep", Members: []string{"sleep"}, MaxConcurrency: 1, MaxQueueDepth: 4},
+			},
+		},
+		{
+			description: "negative max-queue-depth",
+			input: strings.Join([]string{
+				`[[worker-group]]`,
+				`name = "sleep"`,
+				`members = ["sleep"]`,
+				`max-concurrency = 1`,
+				`max-queue-depth = -1`,
+			}, "\n"),
+			wantError: true,
+		},
+		{
+			description: "member of two groups",
+			input: strings.Join([]string{
+				`[[worker-group]]`,
+				`name = "a"`,
+				`members = ["insights"]`,
+				`max-concurrency = 1`,
+				`[[worker-group]]`,
+				`name = "b"`,
+				`members = ["insights"]`,
+				`max-concurrency = 1`,
+			}, "\n"),
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := readWorkerGroupConfigs(strings.NewReader(test.input))
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %#v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%#v != %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWorkerGroups(t *testing.T) {
+	g := newWorkerGroups([]workerGroupConfig{{Name: "api", Members: []string{"a", "b"}, MaxConcurrency: 2}})
+	queued := func(id string, directive string) queuedData {
+		return queuedData{data: yggdrasil.Data{MessageID: id, Directive: directive}}
+	}
+
+	for _, q := range []queuedData{queued("1", "a"), queued("2", "b")} {
+		if ok, err := g.acquire(q); !ok || err != nil {
+			t.Fatalf("expected message %v to take a slot", q.data.MessageID)
+		}
+	}
+	if ok, _ := g.acquire(queued("3", "c")); !ok {
+		t.Errorf("expected message outside any group to be dispatched")
+	}
+	for _, q := range []queuedData{queued("4", "a"), queued("5", "b")} {
+		if ok, err := g.acquire(q); ok || err != nil {
+			t.Fatalf("expected message %v to wait for a slot", q.data.MessageID)
+		}
+	}
+
+	want := []workerGroupStatus{{Name: "api", Members: []string{"a", "b"}, MaxConcurrency: 2, InUse: 2, Waiting: 2}}
+	if got := g.status(); !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+
+	// A released slot is handed to the oldest waiting message.
+	next, ok := g.release("2")
+	if !ok || next.data.MessageID != "4" {
+		t.Fatalf("expected message 4 to be dispatched, got %v, %v", next.data.MessageID, ok)
+	}
+	if ok, _ := g.acquire(next); !ok {
+		t.Errorf("expected message holding a slot to be dispatched")
+	}
+	if _, ok := g.release("3"); ok {
+		t.Errorf("expected no message to be dispatched for a message without a slot")
+	}
+	if next, ok := g.release("1"); !ok || next.data.MessageID != "5" {
+		t.Fatalf("expected message 5 to be dispatched, got %v, %v", next.data.MessageID, ok)
+	}
+	g.release("4")
+	g.release("5")
+	want[0].InUse, want[0].Waiting = 0, 0
+	if got := g.status(); !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+}
+
+func TestWorkerGroupQueueDepth(t *testing.T) {
+	g := newWorkerGroups([]workerGroupConfig{{Name: "sleep", Members: []string{"sleep"}, MaxConcurrency: 1, MaxQueueDepth: 1}})
+	queued := func(id string) queuedData {
+		return queuedData{data: yggdrasil.Data{MessageID: id, Directive: "sleep"}}
+	}
+
+	if ok, err := g.acquire(queued("1")); !ok || err != nil {
+		t.Fatalf("expected message 1 to take a slot: %v", err)
+	}
+	if ok, err := g.acquire(queued("2")); ok || err != nil {
+		t.Fatalf("expected message 2 to wait for a slot: %v", err)
+	}
+	if _, err := g.acquire(queued("3")); err == nil {
+		t.Fatalf("expected message 3 to be rejected")
+	}
+
+	want := []workerGroupStatus{{Name: "sleep", Members: []string{"sleep"}, MaxConcurrency: 1, MaxQueueDepth: 1, InUse: 1, Waiting: 1, Rejected: 1}}
+	if got := g.status(); !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+
+	// Once the queue has room, messages wait again.
+	if next, ok := g.release("1"); !ok || next.data.MessageID != "2" {
+		t.Fatalf("expected message 2 to be dispatched, got %v, %v", next.data.MessageID, ok)
+	}
+	if ok, err := g.acquire(queued("4")); ok || err != nil {
+		t.Errorf("expected message 4 to wait for a slot: %v", err)
+	}
+}
+
+func TestWorkerGroupSlotReleased(t *testing.T) {
+	tests := []struct {
+		description string
+		end         func(d *dispatcher)
+	}{
+		{
+			description: "assignment timed out",
+			end: func(d *dispatcher) {
+				d.assignmentTimeout = 10 * time.Millisecond
+				d.assign(queuedData{data: yggdrasil.Data{MessageID: "1234", Directive: "echo"}}, 1, nil)
+				<-d.Results()
+			},
+		},
+		{
+			description: "cancelled by worker",
+			end: func(d *dispatcher) {
+				d.cancelWorker = func(addr string, id string) error { return nil }
+				d.assign(queuedData{data: yggdrasil.Data{MessageID: "1234", Directive: "echo"}}, 1, nil)
+				if err := d.Cancel("1234"); err != nil {
+					t.Fatal(err)
+				}
+				<-d.Results()
+			},
+		},
+		{
+			description: "worker exited",
+			end: func(d *dispatcher) {
+				d.assign(queuedData{data: yggdrasil.Data{MessageID: "1234", Directive: "echo"}}, 1, nil)
+				go func() {
+					for range d.dispatchers {
+					}
+				}()
+				done := make(chan struct{})
+				go func() {
+					d.unregisterWorker()
+					close(done)
+				}()
+				d.deadWorkers <- 1
+				close(d.deadWorkers)
+				<-done
+				close(d.dispatchers)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.groups = newWorkerGroups([]workerGroupConfig{{Name: "echo", Members: []string{"echo"}, MaxConcurrency: 1}})
+			d.workers["echo"] = worker{pid: 1, handler: "echo", addr: "@ygg-echo-test"}
+			d.pidHandlers[1] = "echo"
+			if ok, err := d.groups.acquire(queuedData{data: yggdrasil.Data{MessageID: "1234", Directive: "echo"}}); !ok || err != nil {
+				t.Fatalf("expected message to take a slot: %v", err)
+			}
+
+			test.end(d)
+
+			deadline := time.Now().Add(5 * time.Second)
+			for d.groups.status()[0].InUse != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("slot not released")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
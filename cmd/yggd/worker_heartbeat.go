@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+// Heartbeat implements the "Heartbeat" method of the Dispatcher gRPC service.
+// It records the time a registered worker last reported that it is alive.
+func (d *dispatcher) Heartbeat(ctx context.Context, r *pb.HeartbeatRequest) (*pb.Receipt, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if i := d.poolMember(r.GetHandler(), int(r.GetPid())); i >= 0 {
+		d.pools[r.GetHandler()][i].lastHeartbeat = time.Now()
+		log.Tracef("received heartbeat from worker %v (process %v)", r.GetHandler(), r.GetPid())
+		return &pb.Receipt{}, nil
+	}
+
+	w, prs := d.workers[r.GetHandler()]
+	if !prs || w.pid != int(r.GetPid()) {
+		return nil, fmt.Errorf("cannot record heartbeat: worker process %v is not registered for handler %v", r.GetPid(), r.GetHandler())
+	}
+	w.lastHeartbeat = time.Now()
+	d.workers[r.GetHandler()] = w
+
+	log.Tracef("received heartbeat from worker %v", r.GetHandler())
+
+	return &pb.Receipt{}, nil
+}
+
+// hungWorkers unregisters and returns the workers that have sent a heartbeat
+// but none within the heartbeat timeout as of now. Workers that have never
+// sent a heartbeat are not expected to.
+func (d *dispatcher) hungWorkers(now time.Time) []worker {
+	d.Lock()
+	defer d.Unlock()
+
+	isHung := func(w worker) bool {
+		return !w.lastHeartbeat.IsZero() && now.Sub(w.lastHeartbeat) >= d.heartbeatTimeout
+	}
+
+	var hung []worker
+	for _, pool := range d.pools {
+		for _, w := range pool {
+			if isHung(w) {
+				hung = append(hung, w)
+			}
+		}
+	}
+	for _, w := range d.workers {
+		if isHung(w) {
+			hung = append(hung, w)
+		}
+	}
+	for _, w := range hung {
+		d.removeWorker(w.handler, w.pid)
+	}
+	return hung
+}
+
+// watchHeartbeats periodically checks for hung workers. A hung worker is
+// unregistered so that no more messages are routed to it, and its process is
+// killed so that it is restarted.
+func (d *dispatcher) watchHeartbeats() {
+	ticker := time.NewTicker(d.heartbeatTimeout / 2)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		hung := d.hungWorkers(now)
+		for _, w := range hung {
+			log.Warnf("worker %v (process %v) sent no heartbeat for %v; marking it dead", w.handler, w.pid, now.Sub(w.lastHeartbeat).Round(time.Second))
+			if err := killProcess(w.pid); err != nil {
+				log.Errorf("cannot stop worker process %v: %v", w.pid, err)
+			}
+		}
+		if len(hung) > 0 {
+			d.sendDispatchersMap()
+		}
+	}
+}
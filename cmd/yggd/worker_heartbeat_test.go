@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+)
+
+func TestHeartbeat(t *testing.T) {
+	tests := []struct {
+		description string
+		input       *pb.HeartbeatRequest
+		wantError   bool
+	}{
+		{
+			description: "registered",
+			input:       &pb.HeartbeatRequest{Handler: "echo", Pid: 100},
+		},
+		{
+			description: "unregistered handler",
+			input:       &pb.HeartbeatRequest{Handler: "sleep", Pid: 100},
+			wantError:   true,
+		},
+		{
+			description: "other process",
+			input:       &pb.HeartbeatRequest{Handler: "echo", Pid: 101},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			d := newDispatcher(nil)
+			d.workers["echo"] = worker{pid: 100, handler: "echo"}
+
+			_, err := d.Heartbeat(context.Background(), test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				if !d.workers["echo"].lastHeartbeat.IsZero() {
+					t.Errorf("expected no heartbeat recorded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.workers["echo"].lastHeartbeat.IsZero() {
+				t.Errorf("expected heartbeat recorded")
+			}
+		})
+	}
+}
+
+func TestHungWorkers(t *testing.T) {
+	now := time.Now()
+
+	d := newDispatcher(nil)
+	d.heartbeatTimeout = time.Minute
+	d.workers["echo"] = worker{pid: 100, handler: "echo", lastHeartbeat: now.Add(-30 * time.Second)}
+	d.workers["sleep"] = worker{pid: 101, handler: "sleep", lastHeartbeat: now.Add(-2 * time.Minute)}
+	d.workers["cat"] = worker{pid: 102, handler: "cat"}
+
+	hung := d.hungWorkers(now)
+	if len(hung) != 1 || hung[0].handler != "sleep" {
+		t.Fatalf("expected sleep to be hung, got %+v", hung)
+	}
+	if _, prs := d.workers["sleep"]; prs {
+		t.Errorf("expected sleep to be unregistered")
+	}
+	if len(d.workers) != 2 {
+		t.Errorf("expected 2 workers, got %v", len(d.workers))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errWorkerIntegrity is returned by startProcess if a worker executable does
+// not match the checksum or signature it is verified against.
+var errWorkerIntegrity = errors.New("worker integrity check failed")
+
+// workerVerifyKey, if set, is the public key that the detached signature of
+// each worker executable is verified against. A worker without a valid
+// signature is not started.
+var workerVerifyKey crypto.PublicKey
+
+// workerRequireChecksum, if true, refuses to start workers whose config does
+// not list the SHA-256 checksum of their executable.
+var workerRequireChecksum bool
+
+// loadVerifyKey reads the first PEM-encoded RSA, ECDSA or Ed25519 public key in
+// file.
+func loadVerifyKey(file string) (crypto.PublicKey, error) {
+	key, err := readPEMKey(file, map[string]func([]byte) (interface{}, error){
+		"RSA PUBLIC KEY": func(der []byte) (interface{}, error) { return x509.ParsePKCS1PublicKey(der) },
+		"PUBLIC KEY":     x509.ParsePKIXPublicKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot load verification key: %w", err)
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("cannot load verification key: unsupported key type %T", key)
+	}
+}
+
+// signatureFile returns the path of the detached signature of the worker
+// executable file: the config's signature file, or a file next to the
+// worker's config file named after the worker with the extension ".sig".
+func (c *workerConfig) signatureFile(file string) string {
+	if c.SignatureFile != "" {
+		return c.SignatureFile
+	}
+	return filepath.Join(workerConfigDir(), filepath.Base(file)+".sig")
+}
+
+// verifiedExecutablePath is the path the worker executable is run from once
+// verified: the file that was verified, passed to the worker process as its
+// first extra file.
+const verifiedExecutablePath = "/proc/self/fd/3"
+
+// verifyWorkerIntegrity opens the worker executable file and verifies it
+// against the SHA-256 checksum in its config and, if workerVerifyKey is set,
+// against its detached signature. It returns the open file that was verified,
+// or nil if there is nothing to verify; the worker is executed from it, not by
+// path, so that file cannot be replaced between verification and execution.
+// It returns an error wrapping errWorkerIntegrity if the executable does not
+// match either, or lacks one that is required.
+func verifyWorkerIntegrity(file string, config *workerConfig) (*os.File, error) {
+	if config.SHA256 == "" && !workerRequireChecksum && workerVerifyKey == nil {
+		return nil, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open worker executable: %w", err)
+	}
+	if err := verifyWorkerFile(f, file, config); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// verifyWorkerFile verifies the contents of f, the open worker executable
+// file, as verifyWorkerIntegrity does.
+func verifyWorkerFile(f *os.File, file string, config *workerConfig) error {
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("cannot read worker executable: %w", err)
+	}
+
+	if config.SHA256 != "" {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); got != strings.ToLower(config.SHA256) {
+			return fmt.Errorf("%w: '%v' has checksum %v, expected %v", errWorkerIntegrity, file, got, strings.ToLower(config.SHA256))
+		}
+	} else if workerRequireChecksum {
+		return fmt.Errorf("%w: no checksum configured for '%v'", errWorkerIntegrity, file)
+	}
+
+	if workerVerifyKey != nil {
+		sigFile := config.signatureFile(file)
+		sig, err := ioutil.ReadFile(sigFile)
+		if err != nil {
+			return fmt.Errorf("%w: cannot read signature of '%v': %v", errWorkerIntegrity, file, err)
+		}
+		if err := verifySignature(workerVerifyKey, data, decodeSignature(sig)); err != nil {
+			return fmt.Errorf("%w: signature '%v' of '%v': %v", errWorkerIntegrity, sigFile, file, err)
+		}
+	}
+
+	return nil
+}
+
+// decodeSignature returns the signature in the contents of a signature file,
+// which holds it either raw or base64-encoded.
+func decodeSignature(contents []byte) []byte {
+	if sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents))); err == nil {
+		return sig
+	}
+	return contents
+}
+
+// verifySignature verifies sig as the signature of data by pub. RSA signatures
+// are PKCS #1 v1.5 and ECDSA signatures ASN.1-encoded, both over the SHA-256
+// digest of data; Ed25519 signatures are over data itself.
+func verifySignature(pub crypto.PublicKey, data []byte, sig []byte) error {
+	digest := sha256.Sum256(data)
+	switch key := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		var esig struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) > 0 {
+			return fmt.Errorf("invalid signature")
+		}
+		if !ecdsa.Verify(key, digest[:], esig.R, esig.S) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyWorkerIntegrity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	worker := filepath.Join(dir, "test-worker")
+	data := []byte("#!/bin/sh\n")
+	if err := ioutil.WriteFile(worker, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(key crypto.Signer, encode bool) string {
+		var sig []byte
+		var err error
+		if _, ok := key.(ed25519.PrivateKey); ok {
+			sig, err = key.Sign(rand.Reader, data, crypto.Hash(0))
+		} else {
+			sig, err = key.Sign(rand.Reader, sum[:], crypto.SHA256)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encode {
+			sig = []byte(base64.StdEncoding.EncodeToString(sig) + "\n")
+		}
+		f, err := ioutil.TempFile(dir, "sig")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write(sig); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+
+	tests := []struct {
+		description     string
+		config          workerConfig
+		key             crypto.PublicKey
+		requireChecksum bool
+		wantError       bool
+	}{
+		{
+			description: "unchecked",
+		},
+		{
+			description: "checksum",
+			config:      workerConfig{SHA256: fmt.Sprintf("%X", sum)},
+		},
+		{
+			description: "checksum mismatch",
+			config:      workerConfig{SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+			wantError:   true,
+		},
+		{
+			description:     "checksum required",
+			requireChecksum: true,
+			wantError:       true,
+		},
+		{
+			description: "ed25519 signature",
+			config:      workerConfig{SignatureFile: sign(edKey, false)},
+			key:         edKey.Public(),
+		},
+		{
+			description: "rsa signature",
+			config:      workerConfig{SignatureFile: sign(rsaKey, true)},
+			key:         rsaKey.Public(),
+		},
+		{
+			description: "ecdsa signature",
+			config:      workerConfig{SignatureFile: sign(ecKey, true)},
+			key:         ecKey.Public(),
+		},
+		{
+			description: "signature by another key",
+			config:      workerConfig{SignatureFile: sign(edKey, false)},
+			key:         otherKey,
+			wantError:   true,
+		},
+		{
+			description: "missing signature",
+			config:      workerConfig{SignatureFile: filepath.Join(dir, "missing.sig")},
+			key:         edKey.Public(),
+			wantError:   true,
+		},
+	}
+
+	defer func(key crypto.PublicKey, require bool) {
+		workerVerifyKey, workerRequireChecksum = key, require
+	}(workerVerifyKey, workerRequireChecksum)
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			workerVerifyKey = test.key
+			workerRequireChecksum = test.requireChecksum
+
+			f, err := verifyWorkerIntegrity(worker, &test.config)
+			if f != nil {
+				defer f.Close()
+			}
+			if test.wantError {
+				if !errors.Is(err, errWorkerIntegrity) {
+					t.Errorf("expected an integrity error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	// The worker is executed from the file that was verified, even if its
+	// path is replaced afterwards.
+	workerVerifyKey, workerRequireChecksum = nil, false
+	f, err := verifyWorkerIntegrity(worker, &workerConfig{SHA256: fmt.Sprintf("%x", sum)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	replaced := filepath.Join(dir, "replaced")
+	if err := ioutil.WriteFile(replaced, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replaced, worker); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(worker)
+	cmd.Path = verifiedExecutablePath
+	cmd.ExtraFiles = []*os.File{f}
+	if err := cmd.Run(); err != nil {
+		t.Errorf("replaced executable was run: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// workerLogLevels holds the log levels of the workers that log at a level of
+// their own rather than the daemon's, by worker name: the level set in the
+// config of each worker, and the level set at runtime through the control
+// socket, which takes precedence.
+var workerLogLevels = struct {
+	sync.RWMutex
+	configured map[string]log.Level
+	runtime    map[string]log.Level
+}{
+	configured: make(map[string]log.Level),
+	runtime:    make(map[string]log.Level),
+}
+
+// workerNames holds the name of the worker of each running worker process, by
+// PID.
+var workerNames sync.Map
+
+// setConfiguredWorkerLogLevel records the level set in the config of the
+// worker name, or that it sets none if ok is false.
+func setConfiguredWorkerLogLevel(name string, level log.Level, ok bool) {
+	workerLogLevels.Lock()
+	defer workerLogLevels.Unlock()
+
+	if ok {
+		workerLogLevels.configured[name] = level
+	} else {
+		delete(workerLogLevels.configured, name)
+	}
+}
+
+// workerLogLevel returns the level the daemon logs at about the worker name.
+func workerLogLevel(name string) log.Level {
+	workerLogLevels.RLock()
+	defer workerLogLevels.RUnlock()
+
+	if level, ok := workerLogLevels.runtime[name]; ok {
+		return level
+	}
+	if level, ok := workerLogLevels.configured[name]; ok {
+		return level
+	}
+	return log.CurrentLevel()
+}
+
+// A workerLogger logs the output and lifecycle of the worker it names at the
+// level of that worker, which may be more or less verbose than the daemon's.
+type workerLogger string
+
+// processLogger returns the logger of the worker of process pid. The logger
+// of a process not started as a worker logs at the daemon's level.
+func processLogger(pid int) workerLogger {
+	if name, ok := workerNames.Load(pid); ok {
+		return workerLogger(name.(string))
+	}
+	return ""
+}
+
+func (l workerLogger) logf(level log.Level, format string, v ...interface{}) {
+	if workerLogLevel(string(l)) >= level {
+		// The logger's own level is bypassed by writing to it directly.
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+func (l workerLogger) Errorf(format string, v ...interface{}) {
+	l.logf(log.LevelError, format, v...)
+}
+
+func (l workerLogger) Warnf(format string, v ...interface{}) {
+	l.logf(log.LevelWarn, format, v...)
+}
+
+func (l workerLogger) Infof(format string, v ...interface{}) {
+	l.logf(log.LevelInfo, format, v...)
+}
+
+func (l workerLogger) Debugf(format string, v ...interface{}) {
+	l.logf(log.LevelDebug, format, v...)
+}
+
+func (l workerLogger) Tracef(format string, v ...interface{}) {
+	l.logf(log.LevelTrace, format, v...)
+}
+
+// handleWorkerLogLevel handles the "log-level" control command for the worker
+// name. A "level" of "configured" reverts to the level in the worker's config,
+// or the daemon's level if it sets none.
+func handleWorkerLogLevel(name string, args map[string]string) (interface{}, error) {
+	if value, ok := args["level"]; ok {
+		workerLogLevels.Lock()
+		if value == "configured" {
+			delete(workerLogLevels.runtime, name)
+		} else {
+			level, err := log.ParseLevel(value)
+			if err != nil {
+				workerLogLevels.Unlock()
+				return nil, err
+			}
+			workerLogLevels.runtime[name] = level
+		}
+		workerLogLevels.Unlock()
+		log.Infof("changed log level of worker %v to %v", name, workerLogLevel(name))
+	}
+
+	return strings.ToLower(workerLogLevel(name).String()), nil
+}
+
+// withWorkerLogLevel returns env with YGG_LOG_LEVEL set to level.
+func withWorkerLogLevel(env []string, level log.Level) []string {
+	result := make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "YGG_LOG_LEVEL=") {
+			result = append(result, kv)
+		}
+	}
+	return append(result, "YGG_LOG_LEVEL="+level.String())
+}
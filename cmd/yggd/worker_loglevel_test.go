@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+func TestWorkerLogger(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(w io.Writer, level log.Level) {
+		log.SetOutput(w)
+		log.SetLevel(level)
+	}(log.Writer(), log.CurrentLevel())
+	log.SetOutput(&buf)
+	log.SetLevel(log.LevelInfo)
+
+	setConfiguredWorkerLogLevel("chatty", log.LevelError, true)
+	setConfiguredWorkerLogLevel("verbose", log.LevelTrace, true)
+	defer setConfiguredWorkerLogLevel("chatty", 0, false)
+	defer setConfiguredWorkerLogLevel("verbose", 0, false)
+
+	tests := []struct {
+		description string
+		worker      string
+		runtime     string
+		want        bool
+	}{
+		{description: "daemon level", worker: "quiet"},
+		{description: "less verbose", worker: "chatty"},
+		{description: "more verbose", worker: "verbose", want: true},
+		{description: "runtime override", worker: "chatty", runtime: "debug", want: true},
+		{description: "runtime reset", worker: "verbose", runtime: "configured", want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			buf.Reset()
+			if test.runtime != "" {
+				if _, err := handleLogLevel(map[string]string{"worker": test.worker, "level": test.runtime}); err != nil {
+					t.Fatal(err)
+				}
+				defer handleLogLevel(map[string]string{"worker": test.worker, "level": "configured"})
+				buf.Reset()
+			}
+
+			workerLogger(test.worker).Debugf("started process")
+			if got := strings.Contains(buf.String(), "started process"); got != test.want {
+				t.Errorf("logged: %v != %v", got, test.want)
+			}
+			workerLogger(test.worker).Errorf("exited")
+			if test.worker != "" && !strings.Contains(buf.String(), "exited") {
+				t.Error("error not logged")
+			}
+		})
+	}
+
+	if log.CurrentLevel() != log.LevelInfo {
+		t.Errorf("daemon level changed to %v", log.CurrentLevel())
+	}
+
+	// The file and line logged are those of the caller of the logger.
+	defer log.SetFlags(log.Flags())
+	log.SetFlags(log.Lshortfile)
+	buf.Reset()
+	workerLogger("verbose").Infof("started process")
+	if !strings.HasPrefix(buf.String(), "worker_loglevel_test.go:") {
+		t.Errorf("logged with the wrong caller: %v", buf.String())
+	}
+}
+
+func TestDispatcherWorkerLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(w io.Writer, level log.Level) {
+		log.SetOutput(w)
+		log.SetLevel(level)
+	}(log.Writer(), log.CurrentLevel())
+	log.SetOutput(&buf)
+	log.SetLevel(log.LevelError)
+
+	setConfiguredWorkerLogLevel("verbose", log.LevelInfo, true)
+	defer setConfiguredWorkerLogLevel("verbose", 0, false)
+	workerNames.Store(4242, "verbose")
+	defer workerNames.Delete(4242)
+
+	d := newDispatcher(nil)
+	d.workers["echo"] = worker{pid: 4242, handler: "echo"}
+	d.pidHandlers[4242] = "echo"
+	done := make(chan struct{})
+	go func() {
+		d.unregisterWorker()
+		close(done)
+	}()
+	d.deadWorkers <- 4242
+	close(d.deadWorkers)
+	<-d.dispatchers
+	<-done
+
+	if !strings.Contains(buf.String(), "unregistered worker") {
+		t.Error("dispatcher did not log at the worker's level")
+	}
+	if _, ok := workerNames.Load(4242); ok {
+		t.Error("worker name kept after the worker was unregistered")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultWorkerMessageSize is the largest gRPC message, in bytes, exchanged
+// with workers by default. It is gRPC's own default limit on the messages it
+// receives, which workers built with gRPC apply unless they raise it.
+const defaultWorkerMessageSize = 4 * 1024 * 1024
+
+// errWorkerMessageLimit is returned when a message is not sent to a worker
+// because it exceeds the size of the messages exchanged with workers.
+var errWorkerMessageLimit = errors.New("payload exceeds worker message limit")
+
+// serverOptions returns the gRPC server options limiting the size of the
+// messages the dispatcher sends to and receives from workers.
+func (d *dispatcher) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.MaxSendMsgSize(d.maxSendSize),
+		grpc.MaxRecvMsgSize(d.maxRecvSize),
+	}
+}
+
+// callOptions returns the gRPC call options limiting the size of the messages
+// sent to and received from workers.
+func (d *dispatcher) callOptions() []grpc.CallOption {
+	return []grpc.CallOption{
+		grpc.MaxCallSendMsgSize(d.maxSendSize),
+		grpc.MaxCallRecvMsgSize(d.maxRecvSize),
+	}
+}
+
+// checkWorkerMessageSize returns an error wrapping errWorkerMessageLimit if
+// msg is larger than the messages sent to workers may be.
+func (d *dispatcher) checkWorkerMessageSize(msg proto.Message) error {
+	if size := proto.Size(msg); size > d.maxSendSize {
+		return fmt.Errorf("%w: message is %v bytes, limit is %v bytes", errWorkerMessageLimit, size, d.maxSendSize)
+	}
+	return nil
+}
+
+// workerSendError returns err, from sending a message to a worker, wrapped in
+// errWorkerMessageLimit if the worker rejected the message for its size.
+func workerSendError(err error) error {
+	if status.Code(err) == codes.ResourceExhausted {
+		return fmt.Errorf("%w: %v", errWorkerMessageLimit, status.Convert(err).Message())
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	pb "github.com/redhatinsights/yggdrasil/protocol"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckWorkerMessageSize(t *testing.T) {
+	d := newDispatcher(nil)
+	d.maxSendSize = 1024
+
+	if err := d.checkWorkerMessageSize(&pb.Data{MessageId: "small", Content: []byte("{}")}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err := d.checkWorkerMessageSize(&pb.Data{MessageId: "large", Content: []byte(strings.Repeat("x", 1024))})
+	if !errors.Is(err, errWorkerMessageLimit) {
+		t.Errorf("expected a worker message limit error, got %v", err)
+	}
+}
+
+func TestWorkerSendError(t *testing.T) {
+	tests := []struct {
+		description string
+		input       error
+		wantLimit   bool
+	}{
+		{description: "none", input: nil},
+		{description: "unavailable", input: status.Error(codes.Unavailable, "connection refused")},
+		{description: "resource exhausted", input: status.Error(codes.ResourceExhausted, "grpc: received message larger than max (5000000 vs. 4194304)"), wantLimit: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := workerSendError(test.input)
+			if errors.Is(got, errWorkerMessageLimit) != test.wantLimit {
+				t.Errorf("unexpected error: %v", got)
+			}
+			if !test.wantLimit && got != test.input {
+				t.Errorf("%v != %v", got, test.input)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "fmt"
+
+// maxWorkerMetadataSize is the maximum total size in bytes of the keys and
+// values of the metadata a single worker may declare.
+const maxWorkerMetadataSize = 4 * 1024
+
+// checkWorkerMetadata returns an error if metadata exceeds the size permitted
+// for a single worker.
+func checkWorkerMetadata(metadata map[string]string) error {
+	var size int
+	for k, v := range metadata {
+		if k == "" {
+			return fmt.Errorf("metadata keys must not be empty")
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxWorkerMetadataSize {
+		return fmt.Errorf("metadata size %v exceeds the maximum of %v bytes", size, maxWorkerMetadataSize)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// defaultWorkerLogBufferSize is the number of bytes of worker output held
+// before it is written, if only a flush interval is configured.
+const defaultWorkerLogBufferSize = 64 * 1024
+
+// defaultWorkerLogFlushInterval is the longest time worker output is held
+// before it is written, if only a buffer size is configured.
+const defaultWorkerLogFlushInterval = time.Second
+
+// errWorkerLogClosed is returned when output is written to a closed
+// workerLog.
+var errWorkerLogClosed = errors.New("worker log closed")
+
+// A workerLog is an io.WriteCloser that holds the output of a worker written
+// to it and writes it to w in batches: once size bytes are held, once
+// interval has passed since the oldest of them was written, and when it is
+// flushed or closed. With a size of zero, each write is passed on at once.
+//
+// Writing to w is not reported to the caller of Write, which may not be the
+// one whose output fails to be written, but to the disk state: output that
+// cannot be written for a full disk is dropped.
+type workerLog struct {
+	lock     sync.Mutex
+	w        io.WriteCloser
+	size     int
+	interval time.Duration
+	buf      []byte
+	timer    *time.Timer
+	closed   bool
+}
+
+// workerLogs holds the open worker logs, to flush them all on shutdown.
+var workerLogs = struct {
+	sync.Mutex
+	logs map[*workerLog]struct{}
+}{logs: make(map[*workerLog]struct{})}
+
+func newWorkerLog(w io.WriteCloser, size int, interval time.Duration) *workerLog {
+	l := &workerLog{w: w, size: size, interval: interval}
+	workerLogs.Lock()
+	workerLogs.logs[l] = struct{}{}
+	workerLogs.Unlock()
+	return l
+}
+
+// Write holds p until the output held is written.
+func (l *workerLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return 0, errWorkerLogClosed
+	}
+	l.buf = append(l.buf, p...)
+	if len(l.buf) >= l.size {
+		l.flushLocked()
+	} else if l.timer == nil && l.interval > 0 {
+		l.timer = time.AfterFunc(l.interval, l.flush)
+	}
+	return len(p), nil
+}
+
+// flush writes the output held.
+func (l *workerLog) flush() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.flushLocked()
+}
+
+func (l *workerLog) flushLocked() {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	if len(l.buf) == 0 || l.closed {
+		return
+	}
+
+	_, err := l.w.Write(l.buf)
+	l.buf = l.buf[:0]
+	if isDiskFull(err) {
+		disk.full(workerLogComponent, err, true)
+	} else if err != nil {
+		log.Errorf("cannot write to worker log file: %v", err)
+	} else {
+		disk.ok(workerLogComponent)
+	}
+}
+
+// Close writes the output held and closes w.
+func (l *workerLog) Close() error {
+	workerLogs.Lock()
+	delete(workerLogs.logs, l)
+	workerLogs.Unlock()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.flushLocked()
+	l.closed = true
+	return l.w.Close()
+}
+
+// flushWorkerLogs writes the output held by all the open worker logs.
+func flushWorkerLogs() {
+	workerLogs.Lock()
+	logs := make([]*workerLog, 0, len(workerLogs.logs))
+	for l := range workerLogs.logs {
+		logs = append(logs, l)
+	}
+	workerLogs.Unlock()
+
+	for _, l := range logs {
+		l.flush()
+	}
+}
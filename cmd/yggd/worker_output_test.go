@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A bufferWriteCloser records the writes made to it.
+type bufferWriteCloser struct {
+	lock   sync.Mutex
+	writes []string
+	err    error
+	closed bool
+}
+
+func (b *bufferWriteCloser) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.writes = append(b.writes, string(p))
+	return len(p), nil
+}
+
+func (b *bufferWriteCloser) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	return nil
+}
+
+func (b *bufferWriteCloser) written() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string{}, b.writes...)
+}
+
+func TestWorkerLog(t *testing.T) {
+	tests := []struct {
+		description string
+		size        int
+		interval    time.Duration
+		wantHeld    int
+	}{
+		{description: "unbuffered", wantHeld: 0},
+		{description: "size", size: 8, wantHeld: 1},
+		{description: "interval", size: 1024, interval: 20 * time.Millisecond, wantHeld: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			w := &bufferWriteCloser{}
+			l := newWorkerLog(w, test.size, test.interval)
+			for _, line := range []string{"one\n", "two\n", "six\n"} {
+				if _, err := l.Write([]byte(line)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.interval > 0 {
+				if len(w.written()) != 0 {
+					t.Fatalf("expected output to be held, got %q", w.written())
+				}
+				waitFor(t, func() bool { return len(w.written()) > 0 })
+			}
+
+			got := w.written()
+			if held := 3 - strings.Count(strings.Join(got, ""), "\n"); held != test.wantHeld {
+				t.Errorf("expected %v lines held, got %v: %q", test.wantHeld, held, got)
+			}
+
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(w.written(), ""); got != "one\ntwo\nsix\n" || !w.closed {
+				t.Errorf("expected all output written on close, got %q", got)
+			}
+			if _, err := l.Write([]byte("late\n")); err != errWorkerLogClosed {
+				t.Errorf("expected %v, got %v", errWorkerLogClosed, err)
+			}
+		})
+	}
+}
+
+func TestFlushWorkerLogs(t *testing.T) {
+	w := &bufferWriteCloser{}
+	l := newWorkerLog(w, 1024, time.Hour)
+	defer l.Close()
+	if _, err := l.Write([]byte("one\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	flushWorkerLogs()
+	if got := strings.Join(w.written(), ""); got != "one\n" {
+		t.Errorf("expected output to be flushed, got %q", got)
+	}
+}
+
+func TestWorkerLogDiskFull(t *testing.T) {
+	defer func(state *diskState) { disk = state }(disk)
+	disk = newDiskState()
+
+	w := &bufferWriteCloser{err: &os.PathError{Op: "write", Path: "worker.log", Err: syscall.ENOSPC}}
+	l := newWorkerLog(w, 1024, time.Hour)
+	if _, err := l.Write([]byte("one\n")); err != nil {
+		t.Fatal(err)
+	}
+	l.flush()
+	if full, _ := disk.isFull(workerLogComponent); !full {
+		t.Error("expected the worker log to be degraded")
+	}
+
+	w.lock.Lock()
+	w.err = nil
+	w.lock.Unlock()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.written(); len(got) != 0 {
+		t.Errorf("expected the output to be dropped, got %q", got)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/google/uuid"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+// The actions that can be taken when a worker is given up on for exceeding
+// the restart limit.
+const (
+	// escalationAlert publishes a "worker-failed" message.
+	escalationAlert = "alert"
+
+	// escalationDegraded lists the worker as degraded in connection-status
+	// messages until it is started again.
+	escalationDegraded = "degraded"
+
+	// escalationRestartDaemon restarts the daemon, through the service
+	// manager.
+	escalationRestartDaemon = "restart-daemon"
+)
+
+// A restartLimiter gives up restarting a worker that exits more than limit
+// times within window, and escalates by taking each of the configured
+// actions.
+type restartLimiter struct {
+	limit   int
+	window  time.Duration
+	actions []string
+
+	// alert publishes the message of the alert action, statusChanged
+	// publishes the connection status after the degraded workers change,
+	// and restart restarts the daemon for err.
+	alert         func(msg *yggdrasil.WorkerFailed)
+	statusChanged func()
+	restart       func(err error)
+
+	lock  sync.Mutex
+	exits map[string][]time.Time
+	// failed holds the degraded workers.
+	failed map[string]bool
+}
+
+// workerRestarts limits the restarts of workers, or is nil if they are not
+// limited.
+var workerRestarts *restartLimiter
+
+func newRestartLimiter(limit int, window time.Duration, actions []string) *restartLimiter {
+	return &restartLimiter{
+		limit:         limit,
+		window:        window,
+		actions:       actions,
+		alert:         func(msg *yggdrasil.WorkerFailed) {},
+		statusChanged: func() {},
+		restart:       func(err error) {},
+		exits:         make(map[string][]time.Time),
+		failed:        make(map[string]bool),
+	}
+}
+
+// checkEscalationActions returns an error if actions holds an unknown
+// escalation action.
+func checkEscalationActions(actions []string) error {
+	for _, action := range actions {
+		switch action {
+		case escalationAlert, escalationDegraded, escalationRestartDaemon:
+		default:
+			return fmt.Errorf("unknown escalation action: %v", action)
+		}
+	}
+	return nil
+}
+
+// exited records an unexpected exit of worker for reason. It returns true if
+// the worker has now exited more than the limit within the window, in which
+// case it is not to be restarted and the escalation actions are taken. It
+// always returns false if l is nil.
+func (l *restartLimiter) exited(worker string, reason string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	exits := append(l.exits[worker], now)
+	for len(exits) > 0 && now.Sub(exits[0]) > l.window {
+		exits = exits[1:]
+	}
+	if len(exits) <= l.limit {
+		l.exits[worker] = exits
+		l.lock.Unlock()
+		return false
+	}
+	delete(l.exits, worker)
+	if containsString(l.actions, escalationDegraded) {
+		l.failed[worker] = true
+	}
+	l.lock.Unlock()
+
+	log.Errorf("giving up on worker %v: it exited %v times within %v", worker, len(exits), l.window)
+	go l.escalate(worker, len(exits), reason)
+	return true
+}
+
+// escalate takes the escalation actions for worker, given up on after
+// exiting exits times, last for reason.
+func (l *restartLimiter) escalate(worker string, exits int, reason string) {
+	for _, action := range l.actions {
+		log.Warnf("escalating failure of worker %v: %v", worker, action)
+		switch action {
+		case escalationAlert:
+			msg := &yggdrasil.WorkerFailed{
+				Type:      yggdrasil.MessageTypeWorkerFailed,
+				MessageID: uuid.New().String(),
+				Version:   1,
+				Sent:      time.Now(),
+			}
+			msg.Content.Worker = worker
+			msg.Content.Exits = exits
+			msg.Content.Window = l.window.Seconds()
+			msg.Content.Reason = reason
+			msg.Content.Actions = append([]string{}, l.actions...)
+			l.alert(msg)
+		case escalationDegraded:
+			l.statusChanged()
+		case escalationRestartDaemon:
+			l.restart(fmt.Errorf("worker %v exited %v times within %v", worker, exits, l.window))
+		}
+	}
+}
+
+// started records that worker was started, clearing its degraded state. It
+// does nothing if l is nil.
+func (l *restartLimiter) started(worker string) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	failed := l.failed[worker]
+	delete(l.failed, worker)
+	l.lock.Unlock()
+
+	if failed {
+		log.Infof("worker %v started again: no longer degraded", worker)
+		l.statusChanged()
+	}
+}
+
+// degraded returns the degraded workers, sorted, or nil if there are none or
+// l is nil.
+func (l *restartLimiter) degraded() []string {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var workers []string
+	for worker := range l.failed {
+		workers = append(workers, worker)
+	}
+	sort.Strings(workers)
+	return workers
+}
+
+// PublishWorkerFailed publishes msg to dest.
+func (c *Client) PublishWorkerFailed(msg *yggdrasil.WorkerFailed, dest string) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("cannot marshal message: %v", err)
+		return
+	}
+	if err := c.sendAcknowledgedData(data, dest); err != nil {
+		log.Errorf("cannot publish failure of worker %v: %v", msg.Content.Worker, err)
+		return
+	}
+	log.Debugf("published failure of worker %v", msg.Content.Worker)
+}
+
+// notifyWatchdogTrigger tells systemd, if it started the daemon with a
+// notification socket, that the daemon failed and must be handled as a
+// watchdog timeout. It returns false if there is no notification socket.
+func notifyWatchdogTrigger() (bool, error) {
+	return notifyServiceManager("WATCHDOG=trigger")
+}
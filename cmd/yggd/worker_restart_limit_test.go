@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/redhatinsights/yggdrasil"
+)
+
+func TestRestartLimiter(t *testing.T) {
+	l := newRestartLimiter(2, time.Hour, []string{escalationAlert, escalationDegraded, escalationRestartDaemon})
+	alerts := make(chan *yggdrasil.WorkerFailed, 1)
+	restarts := make(chan error, 1)
+	statusChanges := make(chan struct{}, 2)
+	l.alert = func(msg *yggdrasil.WorkerFailed) { alerts <- msg }
+	l.restart = func(err error) { restarts <- err }
+	l.statusChanged = func() { statusChanges <- struct{}{} }
+
+	for i := 0; i < 2; i++ {
+		if l.exited("echo", "exit status 1") {
+			t.Fatalf("gave up after %v exits", i+1)
+		}
+	}
+	if l.exited("other", "exit status 1") {
+		t.Fatal("gave up on another worker")
+	}
+	if !l.exited("echo", "exit status 2") {
+		t.Fatal("did not give up after exceeding the limit")
+	}
+
+	select {
+	case msg := <-alerts:
+		if msg.Content.Worker != "echo" || msg.Content.Exits != 3 || msg.Content.Reason != "exit status 2" || msg.Content.Window != 3600 {
+			t.Errorf("unexpected alert: %+v", msg.Content)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no alert published")
+	}
+	select {
+	case <-restarts:
+	case <-time.After(time.Second):
+		t.Fatal("daemon not restarted")
+	}
+	<-statusChanges
+	if got := l.degraded(); !cmp.Equal(got, []string{"echo"}) {
+		t.Errorf("degraded: %v", got)
+	}
+
+	l.started("echo")
+	<-statusChanges
+	if got := l.degraded(); got != nil {
+		t.Errorf("still degraded: %v", got)
+	}
+	if l.exited("echo", "exit status 1") {
+		t.Error("exits before giving up still counted")
+	}
+
+	var nilLimiter *restartLimiter
+	if nilLimiter.exited("echo", "") || nilLimiter.degraded() != nil {
+		t.Error("nil limiter limited restarts")
+	}
+}
+
+func TestCheckEscalationActions(t *testing.T) {
+	if err := checkEscalationActions([]string{escalationAlert, escalationRestartDaemon}); err != nil {
+		t.Error(err)
+	}
+	if err := checkEscalationActions([]string{"reboot"}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestNotifyWatchdogTrigger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggd-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	defer os.Setenv("NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"))
+	os.Setenv("NOTIFY_SOCKET", "")
+	if notified, err := notifyWatchdogTrigger(); notified || err != nil {
+		t.Errorf("notified without a socket: %v, %v", notified, err)
+	}
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	if notified, err := notifyWatchdogTrigger(); !notified || err != nil {
+		t.Fatalf("not notified: %v, %v", notified, err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "WATCHDOG=trigger" {
+		t.Errorf("%q != %q", got, "WATCHDOG=trigger")
+	}
+}
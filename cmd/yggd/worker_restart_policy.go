@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// The policies deciding whether a worker is restarted after it exits.
+const (
+	// restartAlways restarts the worker however it exits.
+	restartAlways = "always"
+
+	// restartOnFailure restarts the worker unless it exits with status 0.
+	restartOnFailure = "on-failure"
+
+	// restartNever leaves the worker stopped once it exits.
+	restartNever = "never"
+)
+
+// workerRestartPolicy is the restart policy of workers, unless their config
+// sets their own.
+var workerRestartPolicy = restartAlways
+
+// workerRestartJitter is the longest random delay added before a worker is
+// restarted, so that workers crashing together do not restart in lockstep.
+var workerRestartJitter time.Duration
+
+// restartJitter returns a random delay of up to workerRestartJitter.
+func restartJitter() time.Duration {
+	if workerRestartJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(workerRestartJitter)))
+}
+
+// checkRestartPolicy returns an error if policy is not a known restart policy.
+func checkRestartPolicy(policy string) error {
+	switch policy {
+	case restartAlways, restartOnFailure, restartNever:
+		return nil
+	default:
+		return fmt.Errorf("invalid restart policy: %v", policy)
+	}
+}
+
+// restartsAfter returns true if a worker with the restart policy policy is
+// restarted after its process exits with state. A process killed by a signal
+// has failed.
+func restartsAfter(policy string, state *os.ProcessState) bool {
+	switch policy {
+	case restartNever:
+		return false
+	case restartOnFailure:
+		return !state.Success()
+	default:
+		return true
+	}
+}
+
+// restartPolicy returns the restart policy of the worker name: the one set
+// by its config, or workerRestartPolicy.
+func restartPolicy(name string) string {
+	config, err := loadWorkerConfig(name)
+	if err != nil || config.RestartPolicy == "" {
+		return workerRestartPolicy
+	}
+	return config.RestartPolicy
+}
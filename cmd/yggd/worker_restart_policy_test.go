@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRestartsAfter(t *testing.T) {
+	tests := []struct {
+		description string
+		policy      string
+		script      string
+		want        bool
+	}{
+		{
+			description: "always after success",
+			policy:      restartAlways,
+			script:      "exit 0",
+			want:        true,
+		},
+		{
+			description: "on-failure after success",
+			policy:      restartOnFailure,
+			script:      "exit 0",
+		},
+		{
+			description: "on-failure after failure",
+			policy:      restartOnFailure,
+			script:      "exit 3",
+			want:        true,
+		},
+		{
+			description: "on-failure after signal",
+			policy:      restartOnFailure,
+			script:      "kill -TERM $$",
+			want:        true,
+		},
+		{
+			description: "never after failure",
+			policy:      restartNever,
+			script:      "exit 3",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cmd := exec.Command("/bin/sh", "-c", test.script)
+			cmd.Run()
+			if got := restartsAfter(test.policy, cmd.ProcessState); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRestartJitter(t *testing.T) {
+	defer func(jitter time.Duration) { workerRestartJitter = jitter }(workerRestartJitter)
+
+	workerRestartJitter = 0
+	if got := restartJitter(); got != 0 {
+		t.Errorf("expected no jitter, got %v", got)
+	}
+
+	workerRestartJitter = time.Second
+	for i := 0; i < 100; i++ {
+		if got := restartJitter(); got < 0 || got >= workerRestartJitter {
+			t.Fatalf("jitter %v out of range [0, %v)", got, workerRestartJitter)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// errUsageUnsupported is returned by readProcessUsage on platforms that do not
+// report the resource usage of processes.
+var errUsageUnsupported = errors.New("sampling process resource usage is not supported on this platform")
+
+// A processUsage is the CPU time a process has used and the resident memory
+// it holds.
+type processUsage struct {
+	cpuSeconds float64
+	rssBytes   int64
+}
+
+// A workerUsage is the resource usage of a worker process as of its most
+// recent sample: the share of a CPU it used since the sample before it, as a
+// percentage, and its resident memory.
+type workerUsage struct {
+	CPUPercent float64   `json:"cpu_percent"`
+	RSSBytes   int64     `json:"rss_bytes"`
+	Sampled    time.Time `json:"sampled"`
+}
+
+// A usageSampler samples the resource usage of worker processes.
+type usageSampler struct {
+	interval time.Duration
+	read     func(pid int) (processUsage, error)
+
+	lock sync.Mutex
+	// last holds the CPU time of each process at its previous sample, and
+	// usage the usage computed from it.
+	last  map[int]usageSample
+	usage map[int]workerUsage
+}
+
+// A usageSample is the CPU time a process had used at a point in time.
+type usageSample struct {
+	cpuSeconds float64
+	at         time.Time
+}
+
+func newUsageSampler(interval time.Duration) *usageSampler {
+	return &usageSampler{
+		interval: interval,
+		read:     readProcessUsage,
+		last:     make(map[int]usageSample),
+		usage:    make(map[int]workerUsage),
+	}
+}
+
+// sample samples the usage of the processes pids, forgetting the processes
+// no longer among them.
+func (s *usageSampler) sample(pids []int, now time.Time) error {
+	last := make(map[int]usageSample, len(pids))
+	usage := make(map[int]workerUsage, len(pids))
+	for _, pid := range pids {
+		u, err := s.read(pid)
+		if errors.Is(err, errUsageUnsupported) {
+			return err
+		}
+		if err != nil {
+			log.Debugf("cannot sample usage of worker process %v: %v", pid, err)
+			continue
+		}
+		last[pid] = usageSample{cpuSeconds: u.cpuSeconds, at: now}
+
+		current := workerUsage{RSSBytes: u.rssBytes, Sampled: now}
+		s.lock.Lock()
+		prev, prs := s.last[pid]
+		s.lock.Unlock()
+		if elapsed := now.Sub(prev.at).Seconds(); prs && elapsed > 0 {
+			current.CPUPercent = (u.cpuSeconds - prev.cpuSeconds) / elapsed * 100
+		}
+		usage[pid] = current
+	}
+
+	s.lock.Lock()
+	s.last = last
+	s.usage = usage
+	s.lock.Unlock()
+	return nil
+}
+
+// get returns the most recently sampled usage of the process pid. It returns
+// false if the process has not been sampled or if s is nil.
+func (s *usageSampler) get(pid int) (workerUsage, bool) {
+	if s == nil {
+		return workerUsage{}, false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u, prs := s.usage[pid]
+	return u, prs
+}
+
+// total returns the sum of the most recently sampled usage of every process.
+// It returns zero usage if s is nil.
+func (s *usageSampler) total() workerUsage {
+	var total workerUsage
+	if s == nil {
+		return total
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, u := range s.usage {
+		total.CPUPercent += u.CPUPercent
+		total.RSSBytes += u.RSSBytes
+	}
+	return total
+}
+
+// run samples the usage of the processes returned by pids every interval. It
+// returns if usage cannot be sampled on this platform.
+func (s *usageSampler) run(pids func() []int) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.sample(pids(), time.Now()); err != nil {
+			log.Infof("not sampling worker resource usage: %v", err)
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// workerPIDs returns the PIDs of the registered workers, including the
+// members of worker pools.
+func (d *dispatcher) workerPIDs() []int {
+	d.RLock()
+	defer d.RUnlock()
+
+	pids := make([]int, 0, len(d.workers))
+	seen := make(map[int]bool, len(d.workers))
+	for _, w := range d.workers {
+		if !seen[w.pid] {
+			seen[w.pid] = true
+			pids = append(pids, w.pid)
+		}
+	}
+	for _, pool := range d.pools {
+		for _, w := range pool {
+			if !seen[w.pid] {
+				seen[w.pid] = true
+				pids = append(pids, w.pid)
+			}
+		}
+	}
+	return pids
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUsageSampler(t *testing.T) {
+	cpu := map[int]float64{1: 10, 2: 4}
+	s := newUsageSampler(time.Minute)
+	s.read = func(pid int) (processUsage, error) {
+		seconds, prs := cpu[pid]
+		if !prs {
+			return processUsage{}, errors.New("no such process")
+		}
+		return processUsage{cpuSeconds: seconds, rssBytes: int64(pid) * 1024}, nil
+	}
+
+	start := time.Unix(1000, 0)
+	if err := s.sample([]int{1, 2, 3}, start); err != nil {
+		t.Fatal(err)
+	}
+	if u, prs := s.get(1); !prs || u.CPUPercent != 0 || u.RSSBytes != 1024 {
+		t.Errorf("unexpected first sample: %+v, %v", u, prs)
+	}
+	if _, prs := s.get(3); prs {
+		t.Error("expected no sample of a missing process")
+	}
+
+	cpu[1] += 5
+	cpu[2] += 20
+	if err := s.sample([]int{1, 2}, start.Add(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for pid, want := range map[int]float64{1: 50, 2: 200} {
+		if u, _ := s.get(pid); u.CPUPercent != want {
+			t.Errorf("pid %v: %v != %v", pid, u.CPUPercent, want)
+		}
+	}
+	if total := s.total(); total.CPUPercent != 250 || total.RSSBytes != 3*1024 {
+		t.Errorf("unexpected total: %+v", total)
+	}
+
+	if err := s.sample([]int{2}, start.Add(20*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, prs := s.get(1); prs {
+		t.Error("expected the sample of a departed process to be forgotten")
+	}
+
+	s.read = func(pid int) (processUsage, error) { return processUsage{}, errUsageUnsupported }
+	if err := s.sample([]int{2}, start.Add(30*time.Second)); !errors.Is(err, errUsageUnsupported) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var nilSampler *usageSampler
+	if _, prs := nilSampler.get(1); prs {
+		t.Error("expected no usage from a nil sampler")
+	}
+}
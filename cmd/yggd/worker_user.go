@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credential returns the user, group and supplementary groups the worker
+// process runs as, or nil if neither User nor Group is set. A worker running as
+// User is given the supplementary groups of that user; one running only as
+// Group is given none, so that it does not keep those of the daemon.
+func (c *workerConfig) credential() (*syscall.Credential, error) {
+	if c.User == "" && c.Group == "" {
+		return nil, nil
+	}
+
+	cred := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+
+	if c.User != "" {
+		u, err := lookupUser(c.User)
+		if err != nil {
+			return nil, fmt.Errorf("cannot look up user: %w", err)
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse ID of user %v: %w", u.Username, err)
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse group ID of user %v: %w", u.Username, err)
+		}
+		cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+
+		ids, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("cannot look up groups of user %v: %w", u.Username, err)
+		}
+		for _, id := range ids {
+			gid, err := strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse group ID %v: %w", id, err)
+			}
+			cred.Groups = append(cred.Groups, uint32(gid))
+		}
+	}
+
+	if c.Group != "" {
+		g, err := lookupGroup(c.Group)
+		if err != nil {
+			return nil, fmt.Errorf("cannot look up group: %w", err)
+		}
+		gid, err := strconv.ParseUint(g.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse ID of group %v: %w", g.Name, err)
+		}
+		cred.Gid = uint32(gid)
+	}
+
+	return cred, nil
+}
+
+// lookupUser looks up the user name, which may also be a numeric user ID.
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		if _, e := strconv.ParseUint(name, 10, 32); e == nil {
+			return user.LookupId(name)
+		}
+	}
+	return u, err
+}
+
+// lookupGroup looks up the group name, which may also be a numeric group ID.
+func lookupGroup(name string) (*user.Group, error) {
+	g, err := user.LookupGroup(name)
+	if _, ok := err.(user.UnknownGroupError); ok {
+		if _, e := strconv.ParseUint(name, 10, 32); e == nil {
+			return user.LookupGroupId(name)
+		}
+	}
+	return g, err
+}
+
+// canWriteDir returns true if a process running as cred may create files in a
+// directory with permissions perm owned by uid and gid.
+func canWriteDir(perm os.FileMode, uid, gid uint32, cred *syscall.Credential) bool {
+	if cred.Uid == 0 {
+		return true
+	}
+	var bits os.FileMode
+	switch {
+	case uid == cred.Uid:
+		bits = perm >> 6
+	case gid == cred.Gid || containsGID(cred.Groups, gid):
+		bits = perm >> 3
+	default:
+		bits = perm
+	}
+	return bits&03 == 03
+}
+
+func containsGID(gids []uint32, gid uint32) bool {
+	for _, g := range gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
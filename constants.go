@@ -1,6 +1,9 @@
 package yggdrasil
 
-import "path/filepath"
+import (
+	"path/filepath"
+	"time"
+)
 
 var (
 	// Version is the version as described by git.
@@ -21,6 +24,39 @@ var (
 	// DataHost is used to force sending all HTTP traffic to a specific host.
 	DataHost string
 
+	// SkipPrivilegedFacts causes facts that only a privileged user can read
+	// to be omitted from the canonical facts rather than collected.
+	SkipPrivilegedFacts bool
+
+	// DisabledFacts lists the canonical facts, by JSON key, that are neither
+	// collected nor published. Use ResolveFacts to expand fact groups.
+	DisabledFacts []string
+
+	// FactCollectorTimeout is how long each canonical fact collector may
+	// run before it is abandoned and its fact omitted. If zero, collectors
+	// are never abandoned.
+	FactCollectorTimeout = 10 * time.Second
+
+	// FactCollectorRetries is the number of times a canonical fact collector
+	// that fails or times out is run again.
+	FactCollectorRetries int
+
+	// FactCollectorParallelism is the number of canonical fact collectors
+	// run at once.
+	FactCollectorParallelism = 4
+
+	// FactsDir, if set, is the directory holding executable fact scripts,
+	// each writing a JSON object of custom facts to its standard output.
+	FactsDir string
+
+	// MachineIDProviderName, if set, names the registered MachineIDProvider
+	// the machine ID is first resolved with.
+	MachineIDProviderName string
+
+	// MachineIDCommand, if set, is the command and arguments whose output is
+	// the machine ID, if no provider yields one.
+	MachineIDCommand []string
+
 	// Provider is used when constructing user-facing string output to identify
 	// the agency providing the connection broker.
 	Provider string
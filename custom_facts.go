@@ -0,0 +1,142 @@
+package yggdrasil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// customFactsKey is the JSON key of the canonical facts under which the
+// facts of custom fact collectors are published, keyed by collector name.
+const customFactsKey = "custom_facts"
+
+// commandEnv is the environment fact scripts and the machine ID command run
+// with, so that they do not inherit secrets from that of the daemon.
+var commandEnv = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+
+// A FactCollector returns site-specific facts, such as a rack ID or a
+// deployment tag, to publish with the canonical facts.
+type FactCollector func() (map[string]interface{}, error)
+
+// factCollectorRegistry holds the registered custom fact collectors, by name.
+var factCollectorRegistry = struct {
+	sync.RWMutex
+	m map[string]FactCollector
+}{m: map[string]FactCollector{}}
+
+// RegisterFactCollector registers fn as the custom fact collector name. Its
+// facts are published under custom_facts.NAME in the canonical facts. A
+// collector that fails is recorded in the Errors field of the facts like any
+// other, without holding back the rest.
+func RegisterFactCollector(name string, fn FactCollector) {
+	factCollectorRegistry.Lock()
+	defer factCollectorRegistry.Unlock()
+	factCollectorRegistry.m[name] = fn
+}
+
+// customFactCollectors returns a collector for each registered custom fact
+// collector and each fact script in FactsDir, sorted by name. A fact script
+// takes precedence over a registered collector of the same name.
+func customFactCollectors() []factCollector {
+	collectors := make(map[string]FactCollector)
+	factCollectorRegistry.RLock()
+	for name, fn := range factCollectorRegistry.m {
+		collectors[name] = fn
+	}
+	factCollectorRegistry.RUnlock()
+
+	if FactsDir != "" {
+		scripts, err := factScripts(FactsDir)
+		if err != nil {
+			log.Warnf("cannot read facts directory: %v", err)
+		}
+		for name, fn := range scripts {
+			collectors[name] = fn
+		}
+	}
+
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	factCollectors := make([]factCollector, 0, len(names))
+	for _, name := range names {
+		name, fn := name, collectors[name]
+		factCollectors = append(factCollectors, factCollector{customFactsKey + "." + name, func(facts *CanonicalFacts) error {
+			v, err := fn()
+			if err != nil {
+				return err
+			}
+			facts.CustomFacts = map[string]map[string]interface{}{name: v}
+			return nil
+		}})
+	}
+	return factCollectors
+}
+
+// factScripts returns a collector for each executable file in dir, named
+// after the file without its extension. It refuses a dir that is group or
+// world writable, since any script placed in it runs as the daemon.
+func factScripts(dir string) (map[string]FactCollector, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("%v is group or world writable", dir)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := make(map[string]FactCollector)
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		file := filepath.Join(dir, info.Name())
+		name := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		scripts[name] = func() (map[string]interface{}, error) { return runFactScript(file) }
+	}
+	return scripts, nil
+}
+
+// runFactScript runs the executable file, abandoning it after
+// FactCollectorTimeout (if positive), and returns the JSON object it writes
+// to its standard output.
+func runFactScript(file string) (map[string]interface{}, error) {
+	ctx := context.Background()
+	if FactCollectorTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, FactCollectorTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, file)
+	cmd.Env = commandEnv
+	output, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %v", FactCollectorTimeout)
+		}
+		return nil, err
+	}
+
+	var facts map[string]interface{}
+	if err := json.Unmarshal(output, &facts); err != nil {
+		return nil, fmt.Errorf("cannot parse output of %v as a JSON object: %w", file, err)
+	}
+	return facts, nil
+}
@@ -0,0 +1,74 @@
+package yggdrasil
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCustomFacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []struct {
+		name string
+		data string
+		perm os.FileMode
+	}{
+		{"rack.sh", "#!/bin/sh\necho '{\"id\": \"r12\", \"slot\": 4}'\n", 0755},
+		{"env.sh", "#!/bin/sh\necho \"{\\\"password\\\": \\\"$YGG_KEY_PASSWORD\\\"}\"\n", 0755},
+		{"broken", "#!/bin/sh\necho not json\n", 0755},
+		{"README", "not a script\n", 0644},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), []byte(f.data), f.perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fact scripts do not inherit the environment of the daemon.
+	defer os.Unsetenv("YGG_KEY_PASSWORD")
+	os.Setenv("YGG_KEY_PASSWORD", "secret")
+
+	defer func(dir string) { FactsDir = dir }(FactsDir)
+	FactsDir = dir
+	defer func(m map[string]FactCollector) { factCollectorRegistry.m = m }(factCollectorRegistry.m)
+	factCollectorRegistry.m = map[string]FactCollector{}
+	RegisterFactCollector("deployment", func() (map[string]interface{}, error) {
+		return map[string]interface{}{"tag": "canary"}, nil
+	})
+	RegisterFactCollector("inventory", func() (map[string]interface{}, error) {
+		return nil, errors.New("no inventory")
+	})
+
+	facts, err := collectFacts(customFactCollectors())
+	if err == nil {
+		t.Error("expected the failing collectors to be reported")
+	}
+	want := map[string]map[string]interface{}{
+		"deployment": {"tag": "canary"},
+		"env":        {"password": ""},
+		"rack":       {"id": "r12", "slot": float64(4)},
+	}
+	if !cmp.Equal(facts.CustomFacts, want) {
+		t.Errorf("custom facts: %v", cmp.Diff(facts.CustomFacts, want))
+	}
+	if len(facts.Errors) != 2 {
+		t.Errorf("expected errors for broken and inventory, got %v", facts.Errors)
+	}
+
+	// A facts directory others may write to is refused.
+	if err := os.Chmod(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := factScripts(dir); err == nil {
+		t.Error("expected a world writable facts directory to be refused")
+	}
+}
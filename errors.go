@@ -3,6 +3,7 @@ package yggdrasil
 import (
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 // ErrInvalidContentType indicates an unsupported "collector" value was given
@@ -61,3 +62,13 @@ func (e InvalidArgumentError) Error() string {
 	}
 	return "invalid value '" + e.value + "' for argument '" + e.flag + "'"
 }
+
+// A FactsCollectionError represents the failure to collect some of the
+// canonical facts. Errors describes each failure.
+type FactsCollectionError struct {
+	Errors []string
+}
+
+func (e FactsCollectionError) Error() string {
+	return "cannot collect some canonical facts: " + strings.Join(e.Errors, "; ")
+}
@@ -5,13 +5,14 @@ go 1.13
 require (
 	git.sr.ht/~spc/go-log v0.0.0-20210409014304-ce6a6f3602dc
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
-	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/eclipse/paho.mqtt.golang v1.4.1
 	github.com/google/go-cmp v0.5.6
 	github.com/google/uuid v1.1.2
 	github.com/pelletier/go-toml v1.9.3
 	github.com/rjeczalik/notify v0.9.2
 	github.com/urfave/cli/v2 v2.3.0
-	golang.org/x/net v0.0.0-20201031054903-ff519b6c9102 // indirect
+	golang.org/x/net v0.0.0-20201031054903-ff519b6c9102
+	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	google.golang.org/grpc v1.34.0
 	google.golang.org/protobuf v1.25.0
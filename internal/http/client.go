@@ -2,11 +2,15 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"git.sr.ht/~spc/go-log"
 	"github.com/redhatinsights/yggdrasil"
@@ -15,6 +19,7 @@ import (
 // Client is a specialized HTTP client, configured with mutual TLS certificate
 // authentication.
 type Client struct {
+	lock      sync.RWMutex
 	client    *http.Client
 	userAgent string
 }
@@ -22,15 +27,37 @@ type Client struct {
 // NewHTTPClient creates a client with the given TLS configuration and
 // user-agent string.
 func NewHTTPClient(config *tls.Config, ua string) *Client {
+	return &Client{
+		client:    newClient(config),
+		userAgent: ua,
+	}
+}
+
+func newClient(config *tls.Config) *http.Client {
 	client := &http.Client{
 		Transport: http.DefaultTransport.(*http.Transport).Clone(),
 	}
 	client.Transport.(*http.Transport).TLSClientConfig = config.Clone()
+	return client
+}
 
-	return &Client{
-		client:    client,
-		userAgent: ua,
-	}
+// SetTLSConfig makes requests sent after it returns use config, for example
+// after a rotated certificate was loaded. Requests in progress are not
+// affected.
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	client := newClient(config)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.client = client
+}
+
+// do sends req using the current HTTP client.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	c.lock.RLock()
+	client := c.client
+	c.lock.RUnlock()
+	return client.Do(req)
 }
 
 func (c *Client) Get(url string) ([]byte, error) {
@@ -43,7 +70,7 @@ func (c *Client) Get(url string) ([]byte, error) {
 	log.Debugf("sending HTTP request: %v %v", req.Method, req.URL)
 	log.Tracef("request: %v", req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("cannot download from URL: %w", err)
 	}
@@ -62,6 +89,43 @@ func (c *Client) Get(url string) ([]byte, error) {
 	return data, nil
 }
 
+// Download sends a GET request to url and returns the response body. It fails
+// if the response is not received in full within timeout or its body is larger
+// than maxSize bytes. Unlike Get, it does not log the body.
+func (c *Client) Download(url string, timeout time.Duration, maxSize int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create HTTP request: %w", err)
+	}
+	req.Header.Add("User-Agent", c.userAgent)
+
+	log.Debugf("sending HTTP request: %v %v", req.Method, req.URL)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download from URL: %w", err)
+	}
+	defer resp.Body.Close()
+	log.Debugf("received HTTP %v", resp.Status)
+
+	if resp.StatusCode >= 400 {
+		return nil, &yggdrasil.APIResponseError{Code: resp.StatusCode}
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response body: %w", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("response body exceeds %v bytes", maxSize)
+	}
+
+	return data, nil
+}
+
 func (c *Client) Post(url string, headers map[string]string, body []byte) error {
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
@@ -76,7 +140,7 @@ func (c *Client) Post(url string, headers map[string]string, body []byte) error
 	log.Debugf("sending HTTP request: %v %v", req.Method, req.URL)
 	log.Tracef("request: %v", req)
 
-	resp, err := c.client.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("cannot post to URL: %w", err)
 	}
@@ -94,3 +158,38 @@ func (c *Client) Post(url string, headers map[string]string, body []byte) error
 
 	return nil
 }
+
+// Put sends body to url with an HTTP PUT request, as expected by presigned
+// upload URLs.
+func (c *Client) Put(url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("cannot create HTTP request: %w", err)
+	}
+
+	for k, v := range headers {
+		req.Header.Add(k, strings.TrimSpace(v))
+	}
+	req.Header.Add("User-Agent", c.userAgent)
+
+	log.Debugf("sending HTTP request: %v %v", req.Method, req.URL)
+	log.Tracef("request: %v", req)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("cannot put to URL: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cannot read response body: %w", err)
+	}
+	log.Debugf("received HTTP %v: %v", resp.Status, strings.TrimSpace(string(data)))
+
+	if resp.StatusCode >= 400 {
+		return &yggdrasil.APIResponseError{Code: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+
+	return nil
+}
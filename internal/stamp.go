@@ -0,0 +1,23 @@
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stamp returns the time in nanoseconds since the epoch to name a file written
+// now after, and records it in last, which is accessed atomically. The times
+// recorded in last never go backwards, even when the wall clock does, so that
+// the files keep sorting in the order they were written.
+func Stamp(last *int64) int64 {
+	for {
+		prev := atomic.LoadInt64(last)
+		now := time.Now().UnixNano()
+		if now <= prev {
+			now = prev + 1
+		}
+		if atomic.CompareAndSwapInt64(last, prev, now) {
+			return now
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// SetFailbackInterval sets the interval at which the transport, while
+// connected to a broker other than the first, tries the brokers listed before
+// it and moves its connection to the first of them that accepts it. If
+// interval is zero, the transport stays connected to a broker until the
+// connection is lost. It must be called before Connect.
+func (t *MQTT) SetFailbackInterval(interval time.Duration) {
+	t.failbackInterval = interval
+}
+
+// runFailback tries to fail back every failback interval, for the lifetime of
+// the transport.
+func (t *MQTT) runFailback() {
+	ticker := time.NewTicker(t.failbackInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.failBack()
+	}
+}
+
+// failBack tries, in order, the brokers listed before the active broker, and
+// returns true once one of them accepts a connection and subscriptions. The
+// connection to the previously active broker is then closed and the reconnect
+// handler is called, as for any reconnection. It does nothing while the
+// transport is disconnected or reconnecting.
+func (t *MQTT) failBack() bool {
+	if t.disconnected.Load().(bool) {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&t.reconnecting, 0, 1) {
+		return false
+	}
+
+	// The brokers are replaced, rather than changed, by updateBrokers, so
+	// a snapshot taken under the lock stays consistent.
+	t.lock.RLock()
+	brokers, active := t.brokers, t.active
+	old := brokers[active]
+	client := old.client
+	t.lock.RUnlock()
+	if active == 0 || !client.IsConnected() {
+		atomic.StoreInt32(&t.reconnecting, 0)
+		return false
+	}
+
+	for _, b := range brokers[:active] {
+		err := t.connect(b)
+		if err == nil {
+			log.Infof("failed back to broker %v from %v", b.url, old.url)
+			client.Disconnect(250)
+			atomic.StoreInt32(&t.reconnecting, 0)
+			if f, ok := t.onReconnect.Load().(func()); ok {
+				f()
+			}
+			return true
+		}
+		log.Debugf("cannot fail back to broker %v: %v", b.url, err)
+		// A failed attempt may have taken over as the active broker after
+		// connecting and before subscribing.
+		t.lock.Lock()
+		t.activate(old)
+		t.lock.Unlock()
+	}
+
+	atomic.StoreInt32(&t.reconnecting, 0)
+
+	// A broker sharing sessions with the active one may have closed its
+	// connection when the same client ID connected to it, in which case the
+	// connection lost handler found the reconnect loop taken.
+	if !client.IsConnected() {
+		go t.reconnect()
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package transport
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+	"github.com/redhatinsights/yggdrasil/internal"
+)
+
+// FileExt is the extension of the message files read from the inbox and
+// written to the outbox. Files without it are ignored, so that a file can be
+// written under another name and renamed into place once it is complete.
+const FileExt = ".json"
+
+// File is a Transporter that exchanges messages through directories instead
+// of a broker, for hosts without network access to one. Each message is a
+// file. Messages are received from the subdirectories of an inbox directory,
+// each named after the destination its messages are received on (such as
+// "data" or "control"), and sent by writing them to the subdirectory of an
+// outbox directory named after their destination.
+//
+// Files in the inbox whose names start with "." or that lack the FileExt
+// extension are ignored, and each file is removed once it has been received
+// and handled. Files are written to the outbox under a temporary name starting
+// with "." and renamed into place, so a reader never sees a partial file.
+type File struct {
+	seq          uint64 // accessed atomically; kept first for alignment
+	last         int64  // accessed atomically
+	inbox        string
+	outbox       string
+	pollInterval time.Duration
+	dataHandler  DataReceiveHandlerFunc
+	disconnected atomic.Value
+	stop         chan struct{}
+	lock         sync.Mutex
+}
+
+// NewFileTransport creates a File transport receiving messages from inbox,
+// checked every pollInterval, and sending messages to outbox.
+func NewFileTransport(inbox string, outbox string, pollInterval time.Duration, dataRecvFunc DataReceiveHandlerFunc) (*File, error) {
+	if inbox == "" || outbox == "" {
+		return nil, fmt.Errorf("cannot create file transport: inbox and outbox directories are required")
+	}
+	if pollInterval <= 0 {
+		return nil, fmt.Errorf("cannot create file transport: invalid poll interval: %v", pollInterval)
+	}
+	t := &File{
+		inbox:        inbox,
+		outbox:       outbox,
+		pollInterval: pollInterval,
+		dataHandler:  dataRecvFunc,
+	}
+	t.disconnected.Store(true)
+	return t, nil
+}
+
+// Connect creates the inbox and outbox directories if they do not exist and
+// starts receiving the messages placed in the inbox.
+func (t *File) Connect() error {
+	for _, dir := range []string{t.inbox, t.outbox} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return fmt.Errorf("cannot create directory: %w", err)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.disconnected.Load().(bool) {
+		return nil
+	}
+	t.disconnected.Store(false)
+	t.stop = make(chan struct{})
+	go t.poll(t.stop)
+	return nil
+}
+
+// Disconnect stops receiving messages after waiting quiesce milliseconds.
+func (t *File) Disconnect(quiesce uint) {
+	time.Sleep(time.Millisecond * time.Duration(quiesce))
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.disconnected.Load().(bool) {
+		return
+	}
+	t.disconnected.Store(true)
+	close(t.stop)
+}
+
+// SendData writes data to a new file in the subdirectory of the outbox named
+// after dest. Files are named so that they sort in the order they were sent.
+func (t *File) SendData(data []byte, dest string) error {
+	dir, err := destDir(t.outbox, dest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+
+	name := fmt.Sprintf("%v-%06d%v", time.Unix(0, internal.Stamp(&t.last)).UTC().Format("20060102T150405.000000000Z"), atomic.AddUint64(&t.seq, 1), FileExt)
+	tmp, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return fmt.Errorf("cannot create file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot rename file: %w", err)
+	}
+	log.Tracef("wrote message to %v", filepath.Join(dir, name))
+	return nil
+}
+
+// ReceiveData passes data, received on dest, to the data handler.
+func (t *File) ReceiveData(data []byte, dest string) error {
+	t.dataHandler(data, dest)
+	return nil
+}
+
+// destDir returns the subdirectory of root for dest, which must not refer
+// outside root.
+func destDir(root string, dest string) (string, error) {
+	clean := filepath.Clean("/" + dest)
+	if dest == "" || clean == "/" || clean != "/"+dest {
+		return "", fmt.Errorf("invalid destination: %v", dest)
+	}
+	return filepath.Join(root, filepath.FromSlash(dest)), nil
+}
+
+// poll receives the messages in the inbox every poll interval until stop is
+// closed.
+func (t *File) poll(stop chan struct{}) {
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		t.receiveAll(stop)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// receiveAll receives the messages in the inbox, in the order of their file
+// names within each destination, unless stop is closed.
+func (t *File) receiveAll(stop chan struct{}) {
+	files, err := inboxFiles(t.inbox)
+	if err != nil {
+		log.Errorf("cannot read inbox: %v", err)
+		return
+	}
+	for _, f := range files {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		data, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			log.Errorf("cannot read message file: %v", err)
+			continue
+		}
+		log.Debugf("received message file %v", f.path)
+		_ = t.ReceiveData(data, f.dest)
+		// The file is removed only once the message has been handled, so
+		// that a message is received again if the daemon stops first.
+		if err := os.Remove(f.path); err != nil {
+			log.Errorf("cannot remove message file: %v", err)
+		}
+	}
+}
+
+// An inboxFile is a message file in the inbox.
+type inboxFile struct {
+	path string
+	dest string
+}
+
+// inboxFiles returns the message files in the subdirectories of inbox,
+// sorted by destination and file name.
+func inboxFiles(inbox string) ([]inboxFile, error) {
+	var files []inboxFile
+	err := filepath.Walk(inbox, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == inbox {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || filepath.Ext(info.Name()) != FileExt {
+			return nil
+		}
+		rel, err := filepath.Rel(inbox, filepath.Dir(path))
+		if err != nil || rel == "." {
+			return nil
+		}
+		files = append(files, inboxFile{path: path, dest: filepath.ToSlash(rel)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].dest != files[j].dest {
+			return files[i].dest < files[j].dest
+		}
+		return files[i].path < files[j].path
+	})
+	return files, nil
+}
@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFileReceive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inbox := filepath.Join(dir, "inbox")
+
+	files := map[string]string{
+		"data/2.json":        "second",
+		"data/1.json":        "first",
+		"control/1.json":     "command",
+		"data/.partial.json": "partial",
+		"data/3.json.tmp":    "temporary",
+		"top.json":           "no destination",
+	}
+	for name, content := range files {
+		path := filepath.Join(inbox, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	tr, err := NewFileTransport(inbox, filepath.Join(dir, "outbox"), time.Hour, func(data []byte, dest string) {
+		got = append(got, dest+":"+string(data))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.receiveAll(make(chan struct{}))
+
+	want := []string{"control:command", "data:first", "data:second"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+	for _, name := range []string{"data/1.json", "data/2.json", "control/1.json"} {
+		if _, err := os.Stat(filepath.Join(inbox, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("expected %v to be removed", name)
+		}
+	}
+	for _, name := range []string{"data/.partial.json", "data/3.json.tmp", "top.json"} {
+		if _, err := os.Stat(filepath.Join(inbox, filepath.FromSlash(name))); err != nil {
+			t.Errorf("expected %v to be kept: %v", name, err)
+		}
+	}
+}
+
+func TestFileSendData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr, err := NewFileTransport(filepath.Join(dir, "inbox"), dir, time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"a", "b"} {
+		if err := tr.SendData([]byte(data), "data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tr.SendData([]byte("c"), "../escape"); err == nil {
+		t.Error("expected an error sending outside the outbox")
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != FileExt {
+			t.Errorf("unexpected file %v", e.Name())
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, "data", e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(data))
+	}
+	if want := []string{"a", "b"}; !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+}
+
+func TestDestDir(t *testing.T) {
+	tests := []struct {
+		input     string
+		want      string
+		wantError bool
+	}{
+		{input: "data", want: "/out/data"},
+		{input: "results/inventory", want: "/out/results/inventory"},
+		{input: "", wantError: true},
+		{input: "../data", wantError: true},
+		{input: "/data", wantError: true},
+		{input: "a/../b", wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := destDir("/out", test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package transport
 import (
 	"crypto/tls"
 	"fmt"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -21,6 +22,10 @@ type HTTP struct {
 	disconnected    atomic.Value
 }
 
+// NewHTTPTransport creates a transport that polls server for control and data
+// messages every pollingInterval and posts the messages it sends to server.
+// server is a base URL, such as "https://gateway.example.com/api"; a server
+// given without a scheme, as "host:port", is sent requests over plain HTTP.
 func NewHTTPTransport(clientID string, server string, tlsConfig *tls.Config, userAgent string, pollingInterval time.Duration, dataRecvFunc DataReceiveHandlerFunc) (*HTTP, error) {
 	disconnected := atomic.Value{}
 	disconnected.Store(false)
@@ -34,6 +39,11 @@ func NewHTTPTransport(clientID string, server string, tlsConfig *tls.Config, use
 	}, nil
 }
 
+// SetTLSConfig makes requests sent after it returns use config.
+func (t *HTTP) SetTLSConfig(config *tls.Config) {
+	t.client.SetTLSConfig(config)
+}
+
 func (t *HTTP) Connect() error {
 	t.disconnected.Store(false)
 	go func() {
@@ -93,10 +103,14 @@ func (t *HTTP) send(message []byte, channel string) error {
 	headers := map[string]string{
 		"Content-Type": "application/json",
 	}
-	log.Tracef("posting HTTP request body: %s", string(message))
+	log.Tracef("posting HTTP request body: %v bytes", len(message))
 	return t.client.Post(url, headers, message)
 }
 
 func (t *HTTP) getUrl(direction string, channel string) string {
-	return fmt.Sprintf("http://%s/%s/%s/%s", t.server, channel, t.clientID, direction)
+	base := t.server
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", strings.TrimSuffix(base, "/"), channel, t.clientID, direction)
 }
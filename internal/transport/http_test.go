@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHTTPGetURL(t *testing.T) {
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{server: "localhost:8080", want: "http://localhost:8080/data/c1/in"},
+		{server: "https://gateway.example.com", want: "https://gateway.example.com/data/c1/in"},
+		{server: "https://gateway.example.com/api/", want: "https://gateway.example.com/api/data/c1/in"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.server, func(t *testing.T) {
+			tr, err := NewHTTPTransport("c1", test.server, &tls.Config{}, "test", time.Second, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tr.getUrl("in", "data"); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var lock sync.Mutex
+	var posted []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/control/c1/in":
+			_, _ = w.Write([]byte("command"))
+		case r.Method == http.MethodPost:
+			body, _ := ioutil.ReadAll(r.Body)
+			lock.Lock()
+			posted = append(posted, r.URL.Path+":"+string(body))
+			lock.Unlock()
+		}
+	}))
+	defer server.Close()
+
+	received := make(chan string, 10)
+	tr, err := NewHTTPTransport("c1", server.URL, &tls.Config{InsecureSkipVerify: true}, "test", 10*time.Millisecond, func(data []byte, dest string) {
+		received <- dest + ":" + string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Disconnect(0)
+
+	select {
+	case got := <-received:
+		if want := "control:command"; got != want {
+			t.Errorf("%v != %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+
+	if err := tr.SendData([]byte("result"), "data"); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if want := []string{"/data/c1/out:result"}; !cmp.Equal(posted, want) {
+		t.Errorf("%#v != %#v", posted, want)
+	}
+}
@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// TCPKeepAlive holds the TCP keepalive settings of the sockets the MQTT
+// transport connects to brokers over. Separate from MQTT keepalive pings, TCP
+// keepalive probes detect connections silently dropped by a NAT or firewall
+// along the way.
+type TCPKeepAlive struct {
+	// Enabled turns TCP keepalive on or off.
+	Enabled bool
+
+	// Idle is the time a connection is idle before the first probe is sent.
+	Idle time.Duration
+
+	// Interval is the time between probes.
+	Interval time.Duration
+
+	// Count is the number of unacknowledged probes after which the
+	// connection is considered dead.
+	Count int
+}
+
+// brokerKeepAlive holds the TCP keepalive settings set by SetTCPKeepAlive.
+var brokerKeepAlive struct {
+	sync.RWMutex
+	k *TCPKeepAlive
+}
+
+// SetTCPKeepAlive makes MQTT transports apply k to the socket of each broker
+// connection as it is dialed. Through a proxy, k applies to the connection to
+// the proxy. Connections over WebSocket are dialed by the MQTT client itself
+// and keep the operating system defaults. Where the platform does not support
+// setting these, it has no effect. It must be called before any transport is
+// created.
+func SetTCPKeepAlive(k TCPKeepAlive) error {
+	brokerKeepAlive.Lock()
+	brokerKeepAlive.k = &k
+	brokerKeepAlive.Unlock()
+
+	return nil
+}
+
+// currentKeepAlive returns the TCP keepalive settings set by SetTCPKeepAlive,
+// or nil if none are set.
+func currentKeepAlive() *TCPKeepAlive {
+	brokerKeepAlive.RLock()
+	defer brokerKeepAlive.RUnlock()
+	return brokerKeepAlive.k
+}
+
+// brokerDialer returns the dialer that connects to brokers, or to the proxy
+// they are connected through. It applies the TCP keepalive settings, if any,
+// to each socket before it connects.
+func brokerDialer() *net.Dialer {
+	d := &net.Dialer{Timeout: ProxyDialTimeout}
+	k := currentKeepAlive()
+	if k == nil {
+		return d
+	}
+	// A non-negative KeepAlive would override the settings once connected.
+	d.KeepAlive = -1
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		return c.Control(func(fd uintptr) {
+			if err := setSocketKeepAlive(int(fd), *k); err != nil {
+				log.Warnf("cannot apply TCP keepalive to connection to %v: %v", address, err)
+			}
+		})
+	}
+	return d
+}
@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSocketKeepAlive applies k to the socket fd.
+func setSocketKeepAlive(fd int, k TCPKeepAlive) error {
+	if !k.Enabled {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 0); err != nil {
+			return fmt.Errorf("cannot disable TCP keepalive: %w", err)
+		}
+		return nil
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+		return fmt.Errorf("cannot enable TCP keepalive: %w", err)
+	}
+	if k.Idle > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, int(k.Idle.Seconds())); err != nil {
+			return fmt.Errorf("cannot set TCP keepalive idle time: %w", err)
+		}
+	}
+	if k.Interval > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(k.Interval.Seconds())); err != nil {
+			return fmt.Errorf("cannot set TCP keepalive interval: %w", err)
+		}
+	}
+	if k.Count > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, k.Count); err != nil {
+			return fmt.Errorf("cannot set TCP keepalive count: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestBrokerDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	defer func(k *TCPKeepAlive) {
+		brokerKeepAlive.k = k
+	}(brokerKeepAlive.k)
+	brokerKeepAlive.k = &TCPKeepAlive{Enabled: true, Idle: 42 * time.Second, Interval: 7 * time.Second, Count: 3}
+
+	conn, err := brokerDialer().Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enabled, idle, interval, count int
+	if err := raw.Control(func(fd uintptr) {
+		enabled, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+		idle, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+		interval, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL)
+		count, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if enabled != 1 || idle != 42 || interval != 7 || count != 3 {
+		t.Errorf("enabled %v, idle %v, interval %v, count %v", enabled, idle, interval, count)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+// setSocketKeepAlive does nothing; TCP keepalive settings are only applied on
+// Linux.
+func setSocketKeepAlive(fd int, k TCPKeepAlive) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package transport
+
+import (
+	"sync"
+	"time"
+)
+
+// A ConnectLimiter bounds the connection attempts made by the transports that
+// share it, so that losing the network does not set off a storm of
+// simultaneous attempts against every broker.
+type ConnectLimiter struct {
+	slots    chan struct{}
+	interval time.Duration
+
+	lock sync.Mutex
+	next time.Time
+}
+
+// NewConnectLimiter creates a limiter that allows at most concurrency
+// connection attempts at once, starting at least interval apart. A
+// concurrency of zero does not bound the number of attempts at once, and an
+// interval of zero does not space them out.
+func NewConnectLimiter(concurrency int, interval time.Duration) *ConnectLimiter {
+	l := ConnectLimiter{interval: interval}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	return &l
+}
+
+// acquire blocks until a connection attempt may start, and returns a function
+// to call once the attempt completes. It does nothing if l is nil.
+func (l *ConnectLimiter) acquire() (release func()) {
+	if l == nil {
+		return func() {}
+	}
+
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+
+	if l.interval > 0 {
+		l.lock.Lock()
+		now := time.Now()
+		start := l.next
+		if start.Before(now) {
+			start = now
+		}
+		l.next = start.Add(l.interval)
+		l.lock.Unlock()
+		time.Sleep(time.Until(start))
+	}
+
+	return func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectLimiterConcurrency(t *testing.T) {
+	l := NewConnectLimiter(2, 0)
+
+	var running, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := l.acquire()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			release()
+		}()
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Errorf("%v attempts ran at once, want at most 2", peak)
+	}
+}
+
+func TestConnectLimiterInterval(t *testing.T) {
+	l := NewConnectLimiter(0, 20*time.Millisecond)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		l.acquire()()
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("3 attempts started within %v, want at least 40ms", elapsed)
+	}
+
+	var unlimited *ConnectLimiter
+	unlimited.acquire()()
+}
+
+func TestBrokerStatus(t *testing.T) {
+	tr, err := NewMQTTTransport("c", []MQTTBroker{{URL: "tcp://a:1883"}, {URL: "tcp://b:1883"}}, MQTTBroker{}, true, false, false, PublishOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr.recordAttempt(tr.brokers[1], errors.New("connection refused"))
+	tr.recordAttempt(tr.brokers[1], errors.New("connection refused"))
+	tr.recordAttempt(tr.brokers[0], errors.New("timeout"))
+	tr.recordAttempt(tr.brokers[0], nil)
+
+	status := tr.BrokerStatus()
+	if len(status) != 2 {
+		t.Fatalf("expected 2 brokers, got %v", len(status))
+	}
+	if status[0].URL != "tcp://a:1883" || !status[0].Active || status[0].Failures != 0 || status[0].LastError != "timeout" {
+		t.Errorf("unexpected status: %+v", status[0])
+	}
+	if status[1].Active || status[1].Failures != 2 || status[1].LastError != "connection refused" || status[1].LastErrorAt == nil {
+		t.Errorf("unexpected status: %+v", status[1])
+	}
+}
@@ -0,0 +1,37 @@
+package transport
+
+import "git.sr.ht/~spc/go-log"
+
+// Local is a Transporter for running without a broker. It connects to
+// nothing: messages sent are discarded, and the only messages received are
+// those passed to ReceiveData by the daemon itself.
+type Local struct {
+	dataHandler DataReceiveHandlerFunc
+}
+
+// NewLocalTransport creates a Local transport that passes the messages given
+// to ReceiveData to dataRecvFunc.
+func NewLocalTransport(dataRecvFunc DataReceiveHandlerFunc) *Local {
+	return &Local{dataHandler: dataRecvFunc}
+}
+
+// Connect does nothing.
+func (t *Local) Connect() error {
+	return nil
+}
+
+// Disconnect does nothing.
+func (t *Local) Disconnect(quiesce uint) {}
+
+// SendData discards data.
+func (t *Local) SendData(data []byte, dest string) error {
+	log.Debugf("discarding message sent to %v: no transport", dest)
+	log.Tracef("message: %v bytes", len(data))
+	return nil
+}
+
+// ReceiveData passes data, received on dest, to the data handler.
+func (t *Local) ReceiveData(data []byte, dest string) error {
+	t.dataHandler(data, dest)
+	return nil
+}
@@ -0,0 +1,29 @@
+package transport
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLocal(t *testing.T) {
+	var got []string
+	tr := NewLocalTransport(func(data []byte, dest string) {
+		got = append(got, dest+":"+string(data))
+	})
+
+	if err := tr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.SendData([]byte("result"), "data"); err != nil {
+		t.Errorf("cannot send data: %v", err)
+	}
+	if err := tr.ReceiveData([]byte("command"), "control"); err != nil {
+		t.Fatal(err)
+	}
+	tr.Disconnect(0)
+
+	if want := []string{"control:command"}; !cmp.Equal(got, want) {
+		t.Errorf("%#v != %#v", got, want)
+	}
+}
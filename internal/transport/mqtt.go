@@ -3,32 +3,370 @@ package transport
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.sr.ht/~spc/go-log"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/google/uuid"
 	"github.com/redhatinsights/yggdrasil"
 )
 
+// DefaultMaxReconnectInterval is the upper bound on the delay between
+// reconnection attempts to a broker when none is configured.
+const DefaultMaxReconnectInterval = 10 * time.Minute
+
+// DefaultInitialReconnectInterval is the delay before the first reconnection
+// attempt to a broker when none is configured. The delay doubles after each
+// failed attempt.
+const DefaultInitialReconnectInterval = time.Second
+
+// DefaultPublishQoS is the QoS level messages are published at when none is
+// configured.
+const DefaultPublishQoS = 1
+
+// DefaultSubscribeRetries is the number of times subscribing to a topic is
+// retried after a transient failure, when no other limit is set.
+const DefaultSubscribeRetries = 5
+
+// DefaultAuthRetryInterval is the delay before connecting again to a broker
+// that rejected the client's credentials, when none is configured.
+const DefaultAuthRetryInterval = 30 * time.Minute
+
+// subackFailure is the SUBACK return code with which a broker refuses a
+// subscription, as it does when its ACL denies the client the topic.
+const subackFailure = 0x80
+
+var (
+	// ErrSubscribeRefused is wrapped by the error returned when a broker
+	// accepts the connection but refuses a subscription. The refusal is
+	// persistent, so retrying does not help.
+	ErrSubscribeRefused = errors.New("broker refused subscription")
+
+	// ErrSubscribeFailed is wrapped by the error returned when a broker
+	// accepts the connection but subscribing to a topic still fails after
+	// every retry.
+	ErrSubscribeFailed = errors.New("cannot subscribe")
+
+	// ErrAuthFailed is wrapped by the error returned when a broker refuses
+	// the connection because it rejects the client's credentials or does
+	// not authorize the client to connect (CONNACK return code 4 or 5).
+	// Unlike a network failure, connecting again does not help until the
+	// credentials change.
+	ErrAuthFailed = errors.New("broker rejected credentials")
+
+	// ErrMessageTooLarge is wrapped by the error returned when a message is
+	// not published because it exceeds the maximum message size.
+	ErrMessageTooLarge = errors.New("message too large")
+)
+
+// sleep waits between subscription attempts. It is replaced in tests.
+var sleep = time.Sleep
+
+// MQTTBroker describes a broker the MQTT transport may connect to. Zero-value
+// fields fall back to the transport-wide defaults.
+type MQTTBroker struct {
+	// URL is the address of the broker.
+	URL string
+
+	// TLSConfig is used for connections to this broker.
+	TLSConfig *tls.Config
+
+	// LoadTLSConfig, if set, is called before each connection attempt to
+	// this broker to load the TLS config afresh, so that rotated
+	// certificates are used without a restart. If it fails, the previous
+	// TLS config is used.
+	LoadTLSConfig func() (*tls.Config, error)
+
+	// KeepAlive is the interval between MQTT keepalive pings.
+	KeepAlive time.Duration
+
+	// MaxReconnectInterval bounds the delay between reconnection attempts to
+	// this broker.
+	MaxReconnectInterval time.Duration
+}
+
+// mqttBroker is a client connection to a single broker.
+type mqttBroker struct {
+	url                  string
+	client               mqtt.Client
+	opts                 *mqtt.ClientOptions
+	maxReconnectInterval time.Duration
+	loadTLSConfig        func() (*tls.Config, error)
+
+	// addr is the address the broker's hostname was last resolved to, if
+	// the client connects to a resolved address.
+	addr string
+
+	// srvErr is set for an SRV broker whose record could not be resolved,
+	// standing in for the brokers it lists until it is.
+	srvErr error
+
+	// failures counts the connection attempts that failed since the last
+	// successful connection, and lastError holds the error of the most
+	// recent failed attempt, made at lastErrorAt.
+	failures    int
+	lastError   string
+	lastErrorAt time.Time
+
+	// returnCode is the CONNACK return code with which the broker refused
+	// the most recent failed attempt, or 0 if it did not refuse it.
+	returnCode byte
+
+	// freshClientID is set to the client ID the client of the broker uses
+	// in place of the transport's, once reconnecting with the latter has
+	// failed too often.
+	freshClientID string
+}
+
 // MQTT is a Transporter that sends and receives data and control
 // messages over MQTT by subscribing and publishing to topics on an MQTT broker.
+// When more than one broker is configured, the transport connects to the
+// first broker that accepts a connection and fails over to the others if that
+// connection is lost.
 type MQTT struct {
-	client         mqtt.Client
+	brokers        []*mqttBroker
+	active         int
+	lock           sync.RWMutex
 	receiveHandler DataReceiveHandlerFunc
+	topicHandler   TopicReceiveHandlerFunc
+	cleanSession   bool
+	clientID       string
+	prefix         string
+	subscriptions  map[string]string
+	publishOptions PublishOptions
+	onReconnect    atomic.Value
+	onLost         atomic.Value
+	disconnected   atomic.Value
+	connectedOnce  atomic.Value
+
+	ackAfterProcessing bool
+	hosts              *hostCache
+
+	// limiter, if set, bounds the connection attempts made by this and other
+	// transports. reconnecting is set while a reconnect loop is running, so
+	// that losing the connection more than once starts only one.
+	limiter      *ConnectLimiter
+	reconnecting int32
+
+	// unsubscribed holds topics removed from the subscriptions while
+	// disconnected, to be unsubscribed from when the transport next connects.
+	unsubscribed map[string]bool
+
+	// granted holds the subscriptions the broker holds for the current
+	// session, by topic.
+	granted map[string]subscriptionGrant
+
+	// receiveDests are the destinations, beyond "data" and "control", that
+	// the transport receives messages from.
+	receiveDests []string
+
+	// configured holds the brokers given to NewMQTTTransport or SetBrokers,
+	// and defaults and willMessage the settings every broker client is
+	// created with. If any broker is an SRV broker, srv caches the brokers
+	// its DNS SRV record lists, resolving them again every srvInterval.
+	configured  []MQTTBroker
+	defaults    MQTTBroker
+	willMessage []byte
+	srv         *srvCache
+	srvOnce     sync.Once
+	srvInterval time.Duration
+
+	// brokersChanged is set when SetBrokers replaces the configured brokers,
+	// so that the brokers are rebuilt when the transport next connects.
+	brokersChanged bool
+
+	// reconnectJitter, if set, is the window within which the first attempt
+	// of each reconnect loop is delayed at random, so that clients that lost
+	// their connections at the same time do not all reconnect at once.
+	reconnectJitter time.Duration
+
+	// initialReconnectInterval is the delay before the second attempt of
+	// each reconnect loop to a broker, doubling after each failed attempt.
+	initialReconnectInterval time.Duration
+
+	// subscribeRetries is the number of times subscribing to a topic is
+	// retried after a transient failure.
+	subscribeRetries int
+
+	// maxMessageSize, if positive, is the size in bytes of the largest
+	// message the transport publishes.
+	maxMessageSize int
+
+	// freshClientIDAfter, if positive, is the number of consecutive failed
+	// connection attempts to a broker after which the transport connects to
+	// it with a fresh client ID and a clean session. If revertClientID is
+	// true, the transport's client ID is used again on the next reconnect.
+	freshClientIDAfter int
+	revertClientID     bool
+
+	// authRetryInterval is the least delay before connecting again to a
+	// broker that rejected the client's credentials. If stopOnAuthFailure
+	// is true, such a broker is not tried again by the reconnect loop.
+	authRetryInterval time.Duration
+	stopOnAuthFailure bool
+
+	// failbackInterval, if positive, is the interval at which the brokers
+	// listed before the active broker are tried, so that the transport
+	// returns to a preferred broker once it is reachable again.
+	failbackInterval time.Duration
+	failbackOnce     sync.Once
 }
 
 // NewMQTTTransport creates a transport suitable for transmitting data over a
-// set of MQTT topics.
-func NewMQTTTransport(clientID string, broker string, tlsConfig *tls.Config, dataRecvFunc DataReceiveHandlerFunc) (*MQTT, error) {
-	var t MQTT
+// set of MQTT topics. The brokers are tried in the order given. defaults
+// supplies the TLS config, keepalive and reconnect interval for any broker
+// that does not set its own.
+//
+// A broker with a URL of the form "srv://_service._proto.domain" stands for the
+// brokers listed by that DNS SRV record, in the order of their priority and
+// weight, with the settings of the SRV broker. The record is resolved each
+// time the transport connects, and again in the background every SRV refresh
+// interval; if it cannot be resolved, the brokers it last listed are used.
+// Brokers of the "_mqtts" and "_secure-mqtt" services are connected to over
+// TLS, others over TCP.
+//
+// If cleanSession is false, the broker is asked to keep a persistent session
+// for the client ID, queueing messages while the client is offline. Because
+// persistent sessions are keyed by client ID, clientID must remain stable
+// across restarts for a session to be resumed.
+//
+// If ackAfterProcessing is true, a message received from the broker is not
+// acknowledged until dataRecvFunc returns, and messages are handled
+// concurrently rather than in the order they are received. Otherwise, each
+// message is acknowledged as soon as it is received.
+//
+// If will is true, the broker is asked to publish an offline connection-status
+// message on the client's behalf if the connection is lost unexpectedly.
+//
+// publishOptions control whether SendData waits for the broker to acknowledge
+// each message. If dataRecvFunc is nil, the transport only publishes and does
+// not subscribe to any topics.
+func NewMQTTTransport(clientID string, brokers []MQTTBroker, defaults MQTTBroker, cleanSession bool, ackAfterProcessing bool, will bool, publishOptions PublishOptions, dataRecvFunc DataReceiveHandlerFunc) (*MQTT, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("no brokers configured")
+	}
+
+	t := MQTT{
+		receiveHandler:           dataRecvFunc,
+		cleanSession:             cleanSession,
+		clientID:                 clientID,
+		prefix:                   yggdrasil.TopicPrefix,
+		publishOptions:           publishOptions,
+		ackAfterProcessing:       ackAfterProcessing,
+		unsubscribed:             make(map[string]bool),
+		granted:                  make(map[string]subscriptionGrant),
+		configured:               brokers,
+		defaults:                 defaults,
+		subscribeRetries:         DefaultSubscribeRetries,
+		authRetryInterval:        DefaultAuthRetryInterval,
+		initialReconnectInterval: DefaultInitialReconnectInterval,
+	}
+	t.subscriptions = t.topics(t.prefix)
+	t.disconnected.Store(false)
+	t.connectedOnce.Store(false)
+
+	willMessage, err := json.Marshal(&yggdrasil.ConnectionStatus{
+		Type:      yggdrasil.MessageTypeConnectionStatus,
+		MessageID: uuid.New().String(),
+		Version:   1,
+		Sent:      time.Now(),
+		Content: struct {
+			CanonicalFacts yggdrasil.CanonicalFacts     "json:\"canonical_facts\""
+			Dispatchers    map[string]map[string]string "json:\"dispatchers\""
+			State          yggdrasil.ConnectionState    "json:\"state\""
+			Tags           map[string]string            "json:\"tags,omitempty\""
+			Uptime         int64                        "json:\"uptime,omitempty\""
+			SessionID      string                       "json:\"session_id,omitempty\""
+			Degraded       []string                     "json:\"degraded,omitempty\""
+		}{
+			State: yggdrasil.ConnectionStateOffline,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal message to JSON: %w", err)
+	}
+
+	if will {
+		t.willMessage = willMessage
+	}
+
+	for _, broker := range brokers {
+		if isSRV(broker.URL) {
+			if _, _, err := parseSRV(broker.URL); err != nil {
+				return nil, err
+			}
+			if t.srv == nil {
+				t.srv = newSRVCache(DefaultSRVRefreshInterval)
+			}
+		}
+		t.brokers = append(t.brokers, t.newBroker(broker))
+	}
+
+	return &t, nil
+}
+
+// newBroker creates a client connection to broker, with the transport-wide
+// defaults for the settings broker does not set.
+func (t *MQTT) newBroker(broker MQTTBroker) *mqttBroker {
+	b := &mqttBroker{
+		url:                  broker.URL,
+		maxReconnectInterval: broker.MaxReconnectInterval,
+	}
+	if b.maxReconnectInterval == 0 {
+		b.maxReconnectInterval = t.defaults.MaxReconnectInterval
+	}
+	if b.maxReconnectInterval == 0 {
+		b.maxReconnectInterval = DefaultMaxReconnectInterval
+	}
+
+	tlsConfig := broker.TLSConfig
+	b.loadTLSConfig = broker.LoadTLSConfig
+	if tlsConfig == nil {
+		tlsConfig = t.defaults.TLSConfig
+		b.loadTLSConfig = t.defaults.LoadTLSConfig
+	}
+	keepAlive := broker.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = t.defaults.KeepAlive
+	}
 
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
-	opts.SetClientID(clientID)
-	opts.SetTLSConfig(tlsConfig.Clone())
-	opts.SetCleanSession(true)
+	opts.AddBroker(broker.URL)
+	opts.SetClientID(t.clientID)
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig.Clone())
+	}
+	if keepAlive > 0 {
+		opts.SetKeepAlive(keepAlive)
+	}
+	opts.SetCustomOpenConnectionFn(openBrokerConnection)
+	if u := currentProxy(); u != nil {
+		opts.SetWebsocketOptions(&mqtt.WebsocketOptions{Proxy: websocketProxy(u)})
+	}
+	opts.SetCleanSession(t.cleanSession)
+	// The client of the broker is replaced whenever its options change, as
+	// when the TLS config is reloaded before connecting. Its replacements
+	// share the store, so that the messages in flight when the connection
+	// was lost are sent again in the resumed session.
+	opts.SetStore(mqtt.NewMemoryStore())
+	// Reconnection is handled by the transport so that the session
+	// present flag of every CONNACK can be inspected and so that the
+	// transport can fail over between brokers.
+	opts.SetAutoReconnect(false)
+	// The client acknowledges a message once its handler returns. When
+	// order matters, handlers run one at a time, so a handler that
+	// blocks until processing completes would stall every other message.
+	opts.SetOrderMatters(!t.ackAfterProcessing)
 	opts.SetOnConnectHandler(func(c mqtt.Client) {
 		opts := c.OptionsReader()
 		for _, url := range opts.Servers() {
@@ -38,98 +376,1113 @@ func NewMQTTTransport(clientID string, broker string, tlsConfig *tls.Config, dat
 		// Publish a throwaway message in case the topic does not exist;
 		// this is a workaround for the Akamai MQTT broker implementation.
 		go func() {
-			topic := fmt.Sprintf("%v/%v/data/out", yggdrasil.TopicPrefix, opts.ClientID())
+			topic := Topic(t.topicPrefix(), t.clientID, "data", "out")
 			c.Publish(topic, 0, false, []byte{})
 		}()
-
-		var topic string
-		topic = fmt.Sprintf("%v/%v/data/in", yggdrasil.TopicPrefix, opts.ClientID())
-		c.Subscribe(topic, 1, func(c mqtt.Client, m mqtt.Message) {
-			go func() {
-				if err := t.ReceiveData(m.Payload(), "data"); err != nil {
-					log.Errorf("cannot receive data message: %v", err)
-				}
-			}()
-		})
-		log.Tracef("subscribed to topic: %v", topic)
-
-		topic = fmt.Sprintf("%v/%v/control/in", yggdrasil.TopicPrefix, opts.ClientID())
-		c.Subscribe(topic, 1, func(c mqtt.Client, m mqtt.Message) {
-			go func() {
-				if err := t.ReceiveData(m.Payload(), "control"); err != nil {
-					log.Errorf("cannot receive control message: %v", err)
-				}
-			}()
-		})
-		log.Tracef("subscribed to topic: %v", topic)
 	})
 
 	opts.SetDefaultPublishHandler(func(c mqtt.Client, m mqtt.Message) {
-		log.Errorf("unhandled message: %v", string(m.Payload()))
+		log.Errorf("unhandled message on topic %v: %v bytes", m.Topic(), len(m.Payload()))
 	})
 
 	opts.SetConnectionLostHandler(func(c mqtt.Client, e error) {
-		log.Errorf("connection lost unexpectedly: %v", e)
+		log.Errorf("connection to broker %v lost unexpectedly: %v", b.url, e)
+		if f, ok := t.onLost.Load().(func(error)); ok {
+			f(e)
+		}
+		go t.reconnect()
 	})
 
-	data, err := json.Marshal(&yggdrasil.ConnectionStatus{
-		Type:      yggdrasil.MessageTypeConnectionStatus,
-		MessageID: uuid.New().String(),
-		Version:   1,
-		Sent:      time.Now(),
-		Content: struct {
-			CanonicalFacts yggdrasil.CanonicalFacts     "json:\"canonical_facts\""
-			Dispatchers    map[string]map[string]string "json:\"dispatchers\""
-			State          yggdrasil.ConnectionState    "json:\"state\""
-			Tags           map[string]string            "json:\"tags,omitempty\""
-		}{
-			State: yggdrasil.ConnectionStateOffline,
-		},
-	})
+	if t.willMessage != nil {
+		opts.SetBinaryWill(t.willTopic(), t.willMessage, 1, false)
+	}
+
+	b.opts = opts
+	b.client = t.newClient(opts)
+
+	return b
+}
+
+// willTopic returns the topic the will of the transport is published to. It
+// follows the topic prefix, and stays on the transport's client ID when a
+// broker connects with a fresh one, as the backend knows the client by it.
+func (t *MQTT) willTopic() string {
+	return Topic(t.topicPrefix(), t.clientID, "control", "out")
+}
+
+// refreshWill replaces the client of the broker b with one whose will is
+// published to the current will topic, if the topic changed since the client
+// was created. The will is given to the broker when connecting, so it is only
+// refreshed between connections.
+func (t *MQTT) refreshWill(b *mqttBroker) {
+	if t.willMessage == nil {
+		return
+	}
+	t.lock.RLock()
+	topic := b.opts.WillTopic
+	t.lock.RUnlock()
+	if topic == t.willTopic() {
+		return
+	}
+	t.rebuildClient(b, func(opts *mqtt.ClientOptions) {})
+	log.Debugf("publishing will for broker %v to topic %v", b.url, t.willTopic())
+}
+
+// rebuildClient replaces the client of the broker b with one created with its
+// options as changed by update, which keeps the store of the client. The will
+// is set from the current will topic whenever the options are rebuilt, so that
+// it is never left behind by the other settings. A resolved address is discarded, so that the client created
+// by resolve uses the new options too.
+func (t *MQTT) rebuildClient(b *mqttBroker, update func(opts *mqtt.ClientOptions)) {
+	t.lock.RLock()
+	opts := *b.opts
+	t.lock.RUnlock()
+	update(&opts)
+	if t.willMessage != nil {
+		opts.SetBinaryWill(t.willTopic(), t.willMessage, 1, false)
+	}
+	client := t.newClient(&opts)
+
+	t.lock.Lock()
+	b.opts = &opts
+	b.client = client
+	b.addr = ""
+	t.lock.Unlock()
+}
+
+// topics returns the topics the transport subscribes to with the topic
+// prefix prefix, mapped to the destination of the messages received on each.
+func (t *MQTT) topics(prefix string) map[string]string {
+	topics := make(map[string]string)
+	if t.receiveHandler != nil {
+		topics[Topic(prefix, t.clientID, "data", "in")] = "data"
+		topics[Topic(prefix, t.clientID, "control", "in")] = "control"
+		for _, dest := range t.receiveDests {
+			topics[Topic(prefix, t.clientID, dest, "in")] = dest
+		}
+	}
+	return topics
+}
+
+// AddReceiveDest makes the transport also receive messages sent to dest, by
+// subscribing to the topic created by combining client information with dest.
+// It must be called before Connect.
+func (t *MQTT) AddReceiveDest(dest string) error {
+	if t.receiveHandler == nil {
+		return fmt.Errorf("transport does not receive data")
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.receiveDests = append(t.receiveDests, dest)
+	topic := Topic(t.prefix, t.clientID, dest, "in")
+	t.subscriptions[topic] = dest
+	for _, b := range t.brokers {
+		b.client.AddRoute(topic, t.route(dest))
+	}
+	return nil
+}
+
+// topicPrefix returns the prefix of the topics the transport publishes to.
+func (t *MQTT) topicPrefix() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.prefix
+}
+
+// newClient creates a client with opts that routes messages received on the
+// transport topics to the transport.
+func (t *MQTT) newClient(opts *mqtt.ClientOptions) mqtt.Client {
+	withServerName(opts)
+	client := mqtt.NewClient(opts)
+
+	// Routes are added before connecting so that messages queued in a
+	// persistent session, which the broker may deliver immediately after
+	// accepting the connection, are handled.
+	t.lock.RLock()
+	for topic, dest := range t.subscriptions {
+		client.AddRoute(topic, t.route(dest))
+	}
+	t.lock.RUnlock()
+
+	return client
+}
+
+// withServerName sets the server name that the TLS config of opts verifies
+// the broker certificate against, if it is not set, to the hostname of the
+// broker. Dialed by openBrokerConnection, the MQTT client does not set it
+// itself.
+func withServerName(opts *mqtt.ClientOptions) {
+	if len(opts.Servers) == 0 {
+		return
+	}
+	switch opts.Servers[0].Scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+	default:
+		return
+	}
+	if opts.TLSConfig != nil && opts.TLSConfig.ServerName != "" {
+		return
+	}
+	tlsConfig := &tls.Config{}
+	if opts.TLSConfig != nil {
+		tlsConfig = opts.TLSConfig.Clone()
+	}
+	tlsConfig.ServerName = opts.Servers[0].Hostname()
+	opts.TLSConfig = tlsConfig
+}
+
+// route returns a handler that passes messages to the transport as received
+// from dest.
+func (t *MQTT) route(dest string) mqtt.MessageHandler {
+	return func(c mqtt.Client, m mqtt.Message) {
+		receive := func() {
+			if t.topicHandler != nil {
+				t.topicHandler(m.Payload(), dest, m.Topic())
+				return
+			}
+			if err := t.ReceiveData(m.Payload(), dest); err != nil {
+				log.Errorf("cannot receive %v message: %v", dest, err)
+			}
+		}
+		if t.ackAfterProcessing {
+			receive()
+		} else {
+			go receive()
+		}
+	}
+}
+
+// SetTopicReceiveHandler makes the transport pass the data it receives to f,
+// along with the topic it arrived on, rather than to the handler it was created
+// with. It must be called before Connect.
+func (t *MQTT) SetTopicReceiveHandler(f TopicReceiveHandlerFunc) {
+	t.topicHandler = f
+}
+
+// SetDNSCache makes the transport resolve broker hostnames itself, caching
+// each address for ttl and re-resolving cached hostnames in the background
+// every ttl. If useStale is true and a hostname cannot be resolved when
+// connecting, the last address it resolved to is used. It must be called
+// before Connect.
+func (t *MQTT) SetDNSCache(ttl time.Duration, useStale bool) {
+	t.hosts = newHostCache(ttl, useStale)
+	go t.hosts.run()
+}
+
+// SetSRVRefreshInterval sets the interval at which the DNS SRV records of SRV
+// brokers are resolved again in the background. It must be called before
+// Connect.
+func (t *MQTT) SetSRVRefreshInterval(interval time.Duration) {
+	t.srvInterval = interval
+	if t.srv != nil {
+		t.srv.interval = interval
+	}
+}
+
+// SetReconnectJitter sets the window within which the first attempt to
+// reconnect after losing the connection is delayed at random. It must be
+// called before Connect.
+func (t *MQTT) SetReconnectJitter(window time.Duration) {
+	t.reconnectJitter = window
+}
+
+// SetInitialReconnectInterval sets the delay after the first failed attempt to
+// reconnect to a broker, which doubles after each further failed attempt up
+// to the broker's maximum reconnect interval. It must be called before
+// Connect.
+func (t *MQTT) SetInitialReconnectInterval(interval time.Duration) {
+	t.initialReconnectInterval = interval
+}
+
+// resolvedSchemes are the broker URL schemes for which the transport resolves
+// hostnames itself when a DNS cache is set. WebSocket brokers are always
+// dialed by hostname.
+var resolvedSchemes = map[string]bool{
+	"mqtt": true, "tcp": true,
+	"ssl": true, "tls": true, "mqtts": true, "mqtt+ssl": true, "tcps": true,
+}
+
+// resolve resolves the hostname of the broker b and, if it resolves to a
+// different address than the client of b connects to, replaces the client
+// with one that connects to the new address. TLS connections continue to
+// verify the broker certificate against the hostname.
+func (t *MQTT) resolve(b *mqttBroker) error {
+	u, err := url.Parse(b.url)
 	if err != nil {
-		return nil, fmt.Errorf("cannot marshal message to JSON: %w", err)
+		return fmt.Errorf("cannot parse broker URL: %w", err)
+	}
+	host := u.Hostname()
+	if !resolvedSchemes[u.Scheme] || net.ParseIP(host) != nil {
+		return nil
+	}
+	// The proxy resolves the hostname, which may not resolve from here.
+	if currentProxy() != nil {
+		return nil
 	}
 
-	opts.SetBinaryWill(fmt.Sprintf("%v/%v/control/out", yggdrasil.TopicPrefix, opts.ClientID), data, 1, false)
+	addr, err := t.hosts.resolve(host)
+	if err != nil {
+		return err
+	}
+	if addr == b.addr {
+		return nil
+	}
 
-	t.client = mqtt.NewClient(opts)
-	t.receiveHandler = dataRecvFunc
+	server := *u
+	server.Host = net.JoinHostPort(addr, u.Port())
 
-	return &t, nil
+	opts := *b.opts
+	opts.Servers = []*url.URL{&server}
+	if u.Scheme != "mqtt" && u.Scheme != "tcp" {
+		tlsConfig := &tls.Config{}
+		if opts.TLSConfig != nil {
+			tlsConfig = opts.TLSConfig.Clone()
+		}
+		tlsConfig.ServerName = host
+		opts.TLSConfig = tlsConfig
+	}
+	client := t.newClient(&opts)
+
+	t.lock.Lock()
+	b.client = client
+	b.addr = addr
+	t.lock.Unlock()
+
+	log.Debugf("connecting to broker %v at %v", b.url, server.Host)
+	return nil
 }
 
-// Connect connects an MQTT client to the configured broker and waits for the
-// connection to open.
+// reloadTLSConfig loads the TLS config of the broker b and replaces the client
+// of b with one that uses it.
+func (t *MQTT) reloadTLSConfig(b *mqttBroker) error {
+	tlsConfig, err := b.loadTLSConfig()
+	if err != nil {
+		return err
+	}
+	t.rebuildClient(b, func(opts *mqtt.ClientOptions) { opts.SetTLSConfig(tlsConfig) })
+
+	log.Debugf("reloaded TLS config for broker %v", b.url)
+	return nil
+}
+
+// Connect connects an MQTT client to the first of the configured brokers that
+// accepts the connection and waits for the connection to open.
 func (t *MQTT) Connect() error {
-	if token := t.client.Connect(); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("cannot connect to broker: %w", token.Error())
+	t.disconnected.Store(false)
+	t.refreshBrokers()
+	if t.connectedOnce.Load().(bool) {
+		t.revertClientIDs()
+	}
+
+	cerr := &connectError{errs: make([]string, 0, len(t.brokers))}
+	authFailures := 0
+	for i := range t.brokers {
+		err := t.connect(t.brokers[i])
+		if err == nil {
+			log.Infof("connected to broker %v", t.brokers[i].url)
+			if t.failbackInterval > 0 {
+				t.failbackOnce.Do(func() { go t.runFailback() })
+			}
+			return nil
+		}
+		log.Debugf("cannot connect to broker %v: %v", t.brokers[i].url, err)
+		if errors.Is(err, ErrAuthFailed) {
+			// A fresh client ID does not help with rejected credentials.
+			authFailures++
+			if authFailures == len(t.brokers) {
+				cerr.authErr = err
+			}
+		} else {
+			t.fallBackToFreshClientID(t.brokers[i])
+		}
+		cerr.errs = append(cerr.errs, fmt.Sprintf("%v: %v", t.brokers[i].url, err))
+		// A transient failure is preferred over a refusal, as connecting
+		// again may then succeed.
+		if errors.Is(err, ErrSubscribeFailed) || (cerr.subscribeErr == nil && errors.Is(err, ErrSubscribeRefused)) {
+			cerr.subscribeErr = err
+		}
+	}
+	return cerr
+}
+
+// A connectError is returned by Connect when no broker could be connected to.
+// It wraps the subscription error of a broker that accepted the connection,
+// if any, so that callers can tell a refused subscription from a broker that
+// could not be reached. Otherwise, if every broker rejected the client's
+// credentials, it wraps the error of the last one.
+type connectError struct {
+	errs         []string
+	subscribeErr error
+	authErr      error
+}
+
+func (e *connectError) Error() string {
+	return fmt.Sprintf("cannot connect to any broker: %v", strings.Join(e.errs, "; "))
+}
+
+func (e *connectError) Unwrap() error {
+	if e.subscribeErr != nil {
+		return e.subscribeErr
+	}
+	return e.authErr
+}
+
+// A connackError is returned when a broker refuses a connection with a
+// CONNACK return code. It wraps ErrAuthFailed if the code is 4 or 5.
+type connackError struct {
+	code byte
+	err  error
+}
+
+func (e *connackError) Error() string {
+	return fmt.Sprintf("%v (CONNACK return code %v)", e.err, e.code)
+}
+
+func (e *connackError) Unwrap() error {
+	if authRefusal(e.code) {
+		return ErrAuthFailed
 	}
 	return nil
 }
 
+// authRefusal returns true if code is a CONNACK return code with which a
+// broker refuses the client's credentials.
+func authRefusal(code byte) bool {
+	return code == packets.ErrRefusedBadUsernameOrPassword || code == packets.ErrRefusedNotAuthorised
+}
+
+// refusedConnection returns the error for a connection attempt that completed
+// with token, wrapping err in a *connackError if the broker refused the
+// connection with a CONNACK return code.
+func refusedConnection(token mqtt.Token, err error) error {
+	if ct, ok := token.(interface{ ReturnCode() byte }); ok && ct.ReturnCode() != packets.Accepted {
+		return &connackError{code: ct.ReturnCode(), err: err}
+	}
+	return err
+}
+
+// SetAuthFailurePolicy sets the least delay before connecting again to a
+// broker that rejected the client's credentials, in place of the broker's
+// reconnect schedule, which would retry it within a second. If stop is true,
+// the reconnect loop does not try such a broker again. It must be called
+// before Connect.
+func (t *MQTT) SetAuthFailurePolicy(retryInterval time.Duration, stop bool) {
+	t.authRetryInterval = retryInterval
+	t.stopOnAuthFailure = stop
+}
+
+// SetMaxMessageSize sets the size in bytes of the largest message the
+// transport publishes, usually the broker's maximum message size. Larger
+// messages are rejected before they are sent. A size of 0 sets no limit.
+func (t *MQTT) SetMaxMessageSize(size int) {
+	t.maxMessageSize = size
+}
+
+// SetSubscribeRetries sets the number of times subscribing to a topic is
+// retried after a transient failure, waiting one second after the first
+// failure and doubling the delay up to the broker's maximum reconnect
+// interval. A subscription refused by the broker is not retried. It must be
+// called before Connect.
+func (t *MQTT) SetSubscribeRetries(n int) {
+	t.subscribeRetries = n
+}
+
+// SetFreshClientIDFallback makes the transport connect to a broker with a
+// fresh client ID and a clean session once after consecutive failed
+// connection attempts to it with its client ID, in case the broker keeps
+// refusing the client ID, as it may while it considers a previous session
+// for it to still be active. If revert is true, the transport's client ID is
+// used again on the next reconnect. A value of after of 0 disables the
+// fallback. It must be called before Connect.
+func (t *MQTT) SetFreshClientIDFallback(after int, revert bool) {
+	t.freshClientIDAfter = after
+	t.revertClientID = revert
+}
+
+// fallBackToFreshClientID replaces the client of b with one that connects with
+// a fresh client ID and a clean session if the connection attempts to b have
+// failed at least as many consecutive times as the fallback threshold. The
+// topics the transport subscribes and publishes to still use the transport's
+// client ID.
+func (t *MQTT) fallBackToFreshClientID(b *mqttBroker) {
+	t.lock.RLock()
+	due := t.freshClientIDAfter > 0 && b.freshClientID == "" && b.failures >= t.freshClientIDAfter
+	failures := b.failures
+	t.lock.RUnlock()
+	if !due {
+		return
+	}
+
+	id := fmt.Sprintf("%v-%v", t.clientID, strings.SplitN(uuid.New().String(), "-", 2)[0])
+	log.Warnf("cannot connect to broker %v with client ID %v after %v attempts; connecting with fresh client ID %v and a clean session instead", b.url, t.clientID, failures, id)
+	t.setClientID(b, id, true)
+	t.lock.Lock()
+	b.freshClientID = id
+	t.lock.Unlock()
+}
+
+// revertClientIDs replaces the client of each broker that connects with a
+// fresh client ID with one that connects with the transport's client ID again,
+// if the transport reverts to it.
+func (t *MQTT) revertClientIDs() {
+	if !t.revertClientID {
+		return
+	}
+	for _, b := range t.brokers {
+		t.lock.RLock()
+		id := b.freshClientID
+		t.lock.RUnlock()
+		if id == "" {
+			continue
+		}
+		log.Infof("reverting from fresh client ID %v to client ID %v for broker %v", id, t.clientID, b.url)
+		t.setClientID(b, t.clientID, t.cleanSession)
+		t.lock.Lock()
+		b.freshClientID = ""
+		t.lock.Unlock()
+	}
+}
+
+// setClientID replaces the client of b with one that connects with client ID
+// id, asking for a clean session if cleanSession is true.
+func (t *MQTT) setClientID(b *mqttBroker, id string, cleanSession bool) {
+	t.rebuildClient(b, func(opts *mqtt.ClientOptions) {
+		opts.SetClientID(id)
+		opts.SetCleanSession(cleanSession)
+	})
+}
+
+// SetConnectLimiter makes the transport wait for l before each connection
+// attempt. It must be called before Connect.
+func (t *MQTT) SetConnectLimiter(l *ConnectLimiter) {
+	t.limiter = l
+}
+
+// SetBrokers replaces the brokers the transport connects to with brokers,
+// returning true if their URLs differ from those of the brokers it replaces.
+// The new brokers are used from the next time the transport connects; a
+// broker listed again keeps its client, connection history and settings.
+// While connected, the transport stays connected to its current broker.
+func (t *MQTT) SetBrokers(brokers []MQTTBroker) (bool, error) {
+	if len(brokers) == 0 {
+		return false, fmt.Errorf("no brokers configured")
+	}
+	srv := false
+	for _, broker := range brokers {
+		if isSRV(broker.URL) {
+			if _, _, err := parseSRV(broker.URL); err != nil {
+				return false, err
+			}
+			srv = true
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	changed := len(brokers) != len(t.configured)
+	for i := 0; !changed && i < len(brokers); i++ {
+		changed = brokers[i].URL != t.configured[i].URL
+	}
+	if srv && t.srv == nil {
+		interval := t.srvInterval
+		if interval <= 0 {
+			interval = DefaultSRVRefreshInterval
+		}
+		t.srv = newSRVCache(interval)
+	}
+	t.configured = brokers
+	t.brokersChanged = true
+	return changed, nil
+}
+
+// refreshBrokers rebuilds the brokers the transport connects to if any is an
+// SRV broker or they were replaced by SetBrokers, starting the refresh of the
+// SRV records the first time.
+func (t *MQTT) refreshBrokers() {
+	t.lock.Lock()
+	srv, changed := t.srv, t.brokersChanged
+	t.brokersChanged = false
+	t.lock.Unlock()
+
+	if srv != nil {
+		t.srvOnce.Do(func() { go srv.run() })
+	}
+	if srv != nil || changed {
+		t.updateBrokers()
+	}
+}
+
+// connect makes a single connection attempt to the broker b and subscribes to
+// topics as necessary. On success, the broker becomes the active broker.
+func (t *MQTT) connect(b *mqttBroker) (err error) {
+	defer func() { t.recordAttempt(b, err) }()
+
+	t.lock.RLock()
+	srvErr := b.srvErr
+	t.lock.RUnlock()
+	if srvErr != nil {
+		return srvErr
+	}
+
+	t.refreshWill(b)
+	if b.loadTLSConfig != nil {
+		if err := t.reloadTLSConfig(b); err != nil {
+			log.Warnf("cannot reload TLS config for broker %v; using previous config: %v", b.url, err)
+		}
+	}
+	if t.hosts != nil {
+		if err := t.resolve(b); err != nil {
+			return err
+		}
+	}
+
+	t.lock.RLock()
+	client := b.client
+	t.lock.RUnlock()
+
+	release := t.limiter.acquire()
+	token := client.Connect()
+	token.Wait()
+	release()
+	if token.Error() != nil {
+		return fmt.Errorf("cannot connect to broker: %w", refusedConnection(token, token.Error()))
+	}
+
+	var sessionPresent bool
+	if ct, ok := token.(*mqtt.ConnectToken); ok {
+		sessionPresent = ct.SessionPresent()
+	}
+
+	t.lock.Lock()
+	t.activate(b)
+	t.lock.Unlock()
+
+	if err := t.subscribe(client, sessionPresent, b.maxReconnectInterval); err != nil {
+		// The connection is of no use without its subscriptions.
+		client.Disconnect(0)
+		return err
+	}
+	return nil
+}
+
+// activate makes b the active broker, if it is still one of the brokers the
+// transport connects to. The caller must hold the lock.
+func (t *MQTT) activate(b *mqttBroker) {
+	for i, broker := range t.brokers {
+		if broker == b {
+			t.active = i
+			return
+		}
+	}
+}
+
+// recordAttempt records the outcome err of a connection attempt to b.
+func (t *MQTT) recordAttempt(b *mqttBroker, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		b.returnCode = packets.Accepted
+		return
+	}
+	b.failures++
+	b.lastError = err.Error()
+	b.lastErrorAt = time.Now()
+	b.returnCode = packets.Accepted
+	var refused *connackError
+	if errors.As(err, &refused) {
+		b.returnCode = refused.code
+	}
+}
+
+// BrokerStatus returns the connection state of each configured broker, in
+// the order they are tried.
+func (t *MQTT) BrokerStatus() []BrokerStatus {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	status := make([]BrokerStatus, 0, len(t.brokers))
+	for i, b := range t.brokers {
+		s := BrokerStatus{
+			URL:       b.url,
+			Active:    i == t.active,
+			Connected: b.client.IsConnected(),
+			Failures:  b.failures,
+			LastError: b.lastError,
+
+			FreshClientID: b.freshClientID,
+
+			ReturnCode: int(b.returnCode),
+			AuthFailed: authRefusal(b.returnCode),
+		}
+		if !b.lastErrorAt.IsZero() {
+			lastErrorAt := b.lastErrorAt
+			s.LastErrorAt = &lastErrorAt
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// activeClient returns the client for the broker most recently connected to.
+func (t *MQTT) activeClient() mqtt.Client {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.brokers[t.active].client
+}
+
+// subscribe subscribes to the transport topics, unless the broker resumed a
+// persistent session in which the subscriptions already exist. Transient
+// failures are retried with a delay of up to maxInterval.
+func (t *MQTT) subscribe(client mqtt.Client, sessionPresent bool, maxInterval time.Duration) error {
+	resumed := sessionPresent && !t.cleanSession
+	if !t.cleanSession {
+		switch {
+		case resumed:
+			log.Debug("resumed persistent session; reusing existing subscriptions")
+		case t.connectedOnce.Load().(bool):
+			log.Warn("broker did not resume the persistent session; messages sent while disconnected may have been lost")
+		}
+	}
+	t.connectedOnce.Store(true)
+
+	// A new session holds no subscriptions; a resumed one holds those
+	// made before, including by a previous run of the daemon.
+	t.lock.Lock()
+	if !resumed {
+		t.granted = make(map[string]subscriptionGrant)
+	}
+	now := time.Now()
+	for topic := range t.subscriptions {
+		if _, prs := t.granted[topic]; resumed && !prs {
+			t.granted[topic] = subscriptionGrant{qos: -1, since: now}
+		}
+	}
+	for topic := range t.unsubscribed {
+		if _, prs := t.granted[topic]; resumed && !prs {
+			t.granted[topic] = subscriptionGrant{qos: -1, since: now}
+		}
+	}
+	t.lock.Unlock()
+
+	t.lock.RLock()
+	topics := make([]string, 0, len(t.subscriptions))
+	for topic := range t.subscriptions {
+		topics = append(topics, topic)
+	}
+	unsubscribed := make([]string, 0, len(t.unsubscribed))
+	for topic := range t.unsubscribed {
+		unsubscribed = append(unsubscribed, topic)
+	}
+	t.lock.RUnlock()
+
+	// A resumed session holds the subscriptions made before the topics
+	// changed, so it must be brought up to date.
+	if resumed && len(unsubscribed) == 0 {
+		return nil
+	}
+
+	for _, topic := range topics {
+		if err := t.subscribeTopic(client, topic, maxInterval); err != nil {
+			return err
+		}
+		log.Tracef("subscribed to topic: %v", topic)
+	}
+
+	if resumed {
+		for _, topic := range unsubscribed {
+			if token := client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+				return fmt.Errorf("cannot unsubscribe from topic '%v': %w", topic, token.Error())
+			}
+			log.Infof("unsubscribed from topic: %v", topic)
+		}
+	}
+	t.lock.Lock()
+	for _, topic := range unsubscribed {
+		delete(t.unsubscribed, topic)
+		delete(t.granted, topic)
+	}
+	t.lock.Unlock()
+
+	return nil
+}
+
+// subscribeTopic subscribes client to topic. A failed attempt is retried up to
+// the transport's subscribe retries while the client stays connected, waiting
+// one second after the first failure and doubling the delay up to
+// maxInterval. A subscription refused by the broker is not retried.
+func (t *MQTT) subscribeTopic(client mqtt.Client, topic string, maxInterval time.Duration) error {
+	delay := DefaultInitialReconnectInterval
+	for attempt := 0; ; attempt++ {
+		token := client.Subscribe(topic, 1, nil)
+		token.Wait()
+		err := token.Error()
+		if err == nil {
+			t.grant(token, topic)
+			if refused(token, topic) {
+				log.Errorf("broker refused subscription to topic '%v'; check that the broker ACL allows the client to subscribe to it", topic)
+				return fmt.Errorf("%w to topic '%v'", ErrSubscribeRefused, topic)
+			}
+			return nil
+		}
+		if attempt >= t.subscribeRetries || !client.IsConnected() {
+			return fmt.Errorf("%w to topic '%v': %v", ErrSubscribeFailed, topic, err)
+		}
+		log.Warnf("cannot subscribe to topic '%v', retrying in %v: %v", topic, delay, err)
+		sleep(delay)
+		delay *= 2
+		if delay > maxInterval {
+			delay = maxInterval
+		}
+	}
+}
+
+// grant records the subscription to topic acknowledged by token, with the QoS
+// the SUBACK reports the broker granted.
+func (t *MQTT) grant(token mqtt.Token, topic string) {
+	qos := -1
+	if st, ok := token.(interface{ Result() map[string]byte }); ok {
+		if code, prs := st.Result()[topic]; prs {
+			qos = int(code)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.granted[topic] = subscriptionGrant{qos: qos, since: time.Now()}
+}
+
+// A subscriptionGrant is a subscription held by the broker: qos is the QoS it
+// granted, subackFailure if it refused the subscription, or -1 if unknown.
+type subscriptionGrant struct {
+	qos   int
+	since time.Time
+}
+
+// Subscriptions returns the state of each topic the transport subscribes to,
+// followed by those it is yet to unsubscribe from, sorted by topic. If the
+// transport uses a clean session, its subscriptions are pending while it is
+// disconnected.
+func (t *MQTT) Subscriptions() []Subscription {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	connected := t.brokers[t.active].client.IsConnectionOpen()
+	subscription := func(topic string, dest string, held string) Subscription {
+		s := Subscription{Topic: topic, Dest: dest, State: "pending"}
+		g, prs := t.granted[topic]
+		if !prs || (t.cleanSession && !connected) {
+			return s
+		}
+		since := g.since
+		s.Since = &since
+		switch {
+		case g.qos == subackFailure:
+			s.State = "refused"
+		case g.qos < 0:
+			s.State = "resumed"
+		default:
+			qos := g.qos
+			s.QoS = &qos
+			s.State = held
+		}
+		return s
+	}
+
+	subscriptions := make([]Subscription, 0, len(t.subscriptions)+len(t.unsubscribed))
+	for topic, dest := range t.subscriptions {
+		subscriptions = append(subscriptions, subscription(topic, dest, "subscribed"))
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].Topic < subscriptions[j].Topic })
+	var unsubscribing []Subscription
+	for topic := range t.unsubscribed {
+		if s := subscription(topic, "", "unsubscribing"); s.State != "pending" {
+			s.State = "unsubscribing"
+			unsubscribing = append(unsubscribing, s)
+		}
+	}
+	sort.Slice(unsubscribing, func(i, j int) bool { return unsubscribing[i].Topic < unsubscribing[j].Topic })
+	return append(subscriptions, unsubscribing...)
+}
+
+// refused returns true if the SUBACK acknowledging token reports that the
+// broker refused the subscription to topic.
+func refused(token mqtt.Token, topic string) bool {
+	st, ok := token.(interface{ Result() map[string]byte })
+	return ok && st.Result()[topic] == subackFailure
+}
+
+// SetTopicPrefix changes the prefix of the topics the transport subscribes
+// and publishes to. Only the subscriptions that differ are changed: the
+// transport subscribes to its new topics before unsubscribing from the old
+// ones, so that no messages are missed and the connection is not dropped. If
+// the transport is not connected, the subscriptions are changed when it next
+// connects. The will moves to the new control topic when the transport next
+// connects, as the broker keeps the will it was given when connecting.
+func (t *MQTT) SetTopicPrefix(prefix string) error {
+	t.lock.RLock()
+	old := t.subscriptions
+	t.lock.RUnlock()
+
+	subscriptions := t.topics(prefix)
+	added, removed := diffTopics(old, subscriptions)
+
+	// Route the new topics on every client, so that the client of any
+	// broker the transport fails over to handles them.
+	t.lock.RLock()
+	for _, b := range t.brokers {
+		for _, topic := range added {
+			b.client.AddRoute(topic, t.route(subscriptions[topic]))
+		}
+	}
+	t.lock.RUnlock()
+
+	client := t.activeClient()
+	connected := client.IsConnectionOpen()
+	if connected {
+		t.lock.RLock()
+		maxInterval := t.brokers[t.active].maxReconnectInterval
+		t.lock.RUnlock()
+		for _, topic := range added {
+			if err := t.subscribeTopic(client, topic, maxInterval); err != nil {
+				return err
+			}
+			log.Infof("subscribed to topic: %v", topic)
+		}
+	}
+
+	t.lock.Lock()
+	t.prefix = prefix
+	t.subscriptions = subscriptions
+	for _, topic := range added {
+		delete(t.unsubscribed, topic)
+	}
+	// A persistent session keeps the old subscriptions while disconnected,
+	// so they are unsubscribed from once connected again.
+	if !connected && !t.cleanSession {
+		for _, topic := range removed {
+			t.unsubscribed[topic] = true
+		}
+	}
+	t.lock.Unlock()
+	log.Infof("publishing with topic prefix: %q", prefix)
+
+	if connected {
+		for _, topic := range removed {
+			if token := client.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+				return fmt.Errorf("cannot unsubscribe from topic '%v': %w", topic, token.Error())
+			}
+			t.lock.Lock()
+			delete(t.granted, topic)
+			t.lock.Unlock()
+			log.Infof("unsubscribed from topic: %v", topic)
+		}
+	}
+
+	return nil
+}
+
+// diffTopics returns the topics in new but not in old, and those in old but
+// not in new, each sorted.
+func diffTopics(old map[string]string, new map[string]string) (added []string, removed []string) {
+	for topic := range new {
+		if _, prs := old[topic]; !prs {
+			added = append(added, topic)
+		}
+	}
+	for topic := range old {
+		if _, prs := new[topic]; !prs {
+			removed = append(removed, topic)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// reconnect attempts to reconnect to any of the configured brokers until it
+// succeeds or Disconnect is called. The first attempt is delayed by a random
+// jitter within the reconnect jitter window, if one is set. Each broker keeps
+// its own retry schedule: the delay between attempts to a broker doubles after
+// each failure, up to that broker's maximum reconnect interval. The broker due
+// soonest is always tried next, preferring brokers listed earlier when several
+// are due. A broker that refuses a subscription is not tried again, and
+// reconnect gives up once every broker has. A broker that rejects the client's
+// credentials is tried again no sooner than the auth retry interval, or, if the
+// transport stops on authentication failures, is treated as refusing. A broker
+// that keeps failing is tried with a fresh client ID once the fallback
+// threshold is reached, and brokers tried with one are tried with the
+// transport's client ID again at the start of the next loop if the transport
+// reverts to it. If a reconnect loop is already running, reconnect returns
+// immediately.
+func (t *MQTT) reconnect() {
+	if !atomic.CompareAndSwapInt32(&t.reconnecting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&t.reconnecting, 0)
+
+	t.refreshBrokers()
+	t.revertClientIDs()
+
+	start := time.Now()
+	if delay := jitter(t.reconnectJitter); delay > 0 {
+		log.Infof("waiting %v before reconnecting", delay.Round(time.Millisecond))
+		start = start.Add(delay)
+	}
+	next := make([]time.Time, len(t.brokers))
+	delays := make([]time.Duration, len(t.brokers))
+	refusing := make([]bool, len(t.brokers))
+	for i := range t.brokers {
+		next[i] = start
+		delays[i] = t.initialReconnectInterval
+	}
+
+	for {
+		i := -1
+		for j := range next {
+			if !refusing[j] && (i < 0 || next[j].Before(next[i])) {
+				i = j
+			}
+		}
+		if i < 0 {
+			log.Error("every broker refused subscription or rejected credentials; not reconnecting")
+			return
+		}
+		time.Sleep(time.Until(next[i]))
+
+		if t.disconnected.Load().(bool) {
+			return
+		}
+
+		b := t.brokers[i]
+		err := t.connect(b)
+		if err == nil {
+			log.Infof("reconnected to broker %v", b.url)
+			if f, ok := t.onReconnect.Load().(func()); ok {
+				f()
+			}
+			return
+		}
+		if errors.Is(err, ErrSubscribeRefused) {
+			log.Errorf("not reconnecting to broker %v: %v", b.url, err)
+			refusing[i] = true
+			continue
+		}
+		maxInterval := b.maxReconnectInterval
+		if errors.Is(err, ErrAuthFailed) {
+			if t.stopOnAuthFailure {
+				log.Errorf("not reconnecting to broker %v until restarted: %v", b.url, err)
+				refusing[i] = true
+				continue
+			}
+			// Retrying within seconds only hammers the broker, which may
+			// lock the client out for it.
+			if delays[i] < t.authRetryInterval {
+				delays[i] = t.authRetryInterval
+			}
+			if maxInterval < t.authRetryInterval {
+				maxInterval = t.authRetryInterval
+			}
+			log.Warnf("broker %v rejected credentials, retrying in %v: %v", b.url, delays[i], err)
+		} else {
+			log.Debugf("cannot reconnect to broker %v, retrying in %v: %v", b.url, delays[i], err)
+			t.fallBackToFreshClientID(b)
+		}
+
+		next[i] = time.Now().Add(delays[i])
+		delays[i] *= 2
+		if delays[i] > maxInterval {
+			delays[i] = maxInterval
+		}
+	}
+}
+
+// jitter returns a random delay from 0 up to, but not including, window. It
+// returns 0 if window is not positive.
+func jitter(window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(window)))
+}
+
+// SetReconnectHandler sets a function that is called each time the transport
+// reconnects to a broker after losing its connection.
+func (t *MQTT) SetReconnectHandler(f func()) {
+	t.onReconnect.Store(f)
+}
+
+// SetConnectionLostHandler sets a function that is called each time the
+// transport loses its connection to a broker unexpectedly.
+func (t *MQTT) SetConnectionLostHandler(f func(err error)) {
+	t.onLost.Store(f)
+}
+
 // Disconnect closes the connection to the MQTT broker, waiting for the
 // specified number of milliseconds for work to complete.
 func (t *MQTT) Disconnect(quiesce uint) {
-	t.client.Disconnect(quiesce)
+	t.disconnected.Store(true)
+	t.activeClient().Disconnect(quiesce)
 }
 
 // SendData publishes data to an MQTT topic created by combining client
-// information with dest.
+// information with dest, waiting for the broker's acknowledgement according
+// to the transport's publish options.
 func (t *MQTT) SendData(data []byte, dest string) error {
-	opts := t.client.OptionsReader()
-	topic := fmt.Sprintf("%v/%v/%v/out", yggdrasil.TopicPrefix, opts.ClientID(), dest)
+	return t.SendDataWithOptions(data, dest, t.publishOptions)
+}
+
+// SendDataWithOptions publishes data to an MQTT topic created by combining
+// client information with dest, at opts.QoS. If opts.WaitForAck is true, it
+// blocks until the broker acknowledges the message (PUBACK for QoS 1, PUBCOMP
+// for QoS 2) or opts.AckTimeout elapses.
+func (t *MQTT) SendDataWithOptions(data []byte, dest string, opts PublishOptions) error {
+	client := t.activeClient()
+	topic := Topic(t.topicPrefix(), t.clientID, dest, "out")
 
-	if token := t.client.Publish(topic, 1, false, data); token.Wait() && token.Error() != nil {
+	if t.maxMessageSize > 0 && len(data) > t.maxMessageSize {
+		log.Errorf("not publishing message to topic %v: its size of %v bytes exceeds the maximum message size of %v bytes", topic, len(data), t.maxMessageSize)
+		return fmt.Errorf("%w: %v bytes exceeds the maximum of %v bytes", ErrMessageTooLarge, len(data), t.maxMessageSize)
+	}
+
+	qos := opts.QoS
+	if opts.WaitForAck && qos == 0 {
+		qos = 1
+	}
+	token := client.Publish(topic, qos, opts.Retain, data)
+	if !opts.WaitForAck {
+		log.Debugf("published message to topic %v without waiting for acknowledgement", topic)
+		log.Tracef("message: %v bytes", len(data))
+		return nil
+	}
+
+	if opts.AckTimeout > 0 {
+		if !token.WaitTimeout(opts.AckTimeout) {
+			err := fmt.Errorf("broker did not acknowledge message on topic %v within %v", topic, opts.AckTimeout)
+			log.Errorf("failed to publish message: %v", err)
+			return err
+		}
+	} else {
+		token.Wait()
+	}
+	if token.Error() != nil {
 		log.Errorf("failed to publish message: %v", token.Error())
 		return token.Error()
 	}
 	log.Debugf("published message to topic %v", topic)
-	log.Tracef("message: %v", string(data))
+	log.Tracef("message: %v bytes", len(data))
 
 	return nil
 }
 
 func (t *MQTT) ReceiveData(data []byte, dest string) error {
+	if t.receiveHandler == nil {
+		return fmt.Errorf("transport does not receive data")
+	}
 	t.receiveHandler(data, dest)
 	return nil
 }
@@ -0,0 +1,721 @@
+package transport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffTopics(t *testing.T) {
+	tests := []struct {
+		description string
+		old         map[string]string
+		new         map[string]string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{
+			description: "unchanged",
+			old:         map[string]string{"a/c/data/in": "data", "a/c/control/in": "control"},
+			new:         map[string]string{"a/c/data/in": "data", "a/c/control/in": "control"},
+		},
+		{
+			description: "prefix changed",
+			old:         map[string]string{"a/c/data/in": "data", "a/c/control/in": "control"},
+			new:         map[string]string{"b/c/data/in": "data", "b/c/control/in": "control"},
+			wantAdded:   []string{"b/c/control/in", "b/c/data/in"},
+			wantRemoved: []string{"a/c/control/in", "a/c/data/in"},
+		},
+		{
+			description: "publish only",
+			old:         map[string]string{},
+			new:         map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			added, removed := diffTopics(test.old, test.new)
+			if !cmp.Equal(added, test.wantAdded) {
+				t.Errorf("added: %v", cmp.Diff(added, test.wantAdded))
+			}
+			if !cmp.Equal(removed, test.wantRemoved) {
+				t.Errorf("removed: %v", cmp.Diff(removed, test.wantRemoved))
+			}
+		})
+	}
+}
+
+func TestAddReceiveDest(t *testing.T) {
+	tr, err := NewMQTTTransport("c", []MQTTBroker{{URL: "tcp://a:1883"}}, MQTTBroker{}, true, false, false, PublishOptions{}, func([]byte, string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.prefix = "a"
+	tr.subscriptions = tr.topics(tr.prefix)
+	if err := tr.AddReceiveDest("desired-state"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a/c/data/in": "data", "a/c/control/in": "control", "a/c/desired-state/in": "desired-state"}
+	if !cmp.Equal(tr.subscriptions, want) {
+		t.Errorf("subscriptions: %v", cmp.Diff(tr.subscriptions, want))
+	}
+	// The destination keeps being received from when the prefix changes.
+	if got := tr.topics("b")["b/c/desired-state/in"]; got != "desired-state" {
+		t.Errorf("unexpected destination for new prefix: %q", got)
+	}
+
+	publisher, err := NewMQTTTransport("c", []MQTTBroker{{URL: "tcp://a:1883"}}, MQTTBroker{}, true, false, false, PublishOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.AddReceiveDest("desired-state"); err == nil {
+		t.Errorf("expected error for a transport that does not receive data")
+	}
+}
+
+func TestRefreshWill(t *testing.T) {
+	tr, err := NewMQTTTransport("c", []MQTTBroker{{URL: "tcp://a:1883"}}, MQTTBroker{}, true, false, true, PublishOptions{}, func([]byte, string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := tr.brokers[0]
+	if got, want := b.opts.WillTopic, Topic(tr.prefix, "c", "control", "out"); got != want {
+		t.Errorf("will topic: %v != %v", got, want)
+	}
+
+	client := b.client
+	tr.refreshWill(b)
+	if b.client != client {
+		t.Error("client replaced although the will topic is unchanged")
+	}
+
+	if err := tr.SetTopicPrefix("b"); err != nil {
+		t.Fatal(err)
+	}
+	tr.refreshWill(b)
+	if got, want := b.opts.WillTopic, "b/c/control/out"; got != want {
+		t.Errorf("will topic: %v != %v", got, want)
+	}
+
+	// The will stays on the client ID of the transport with a fresh client
+	// ID.
+	tr.SetFreshClientIDFallback(1, false)
+	b.failures = 1
+	tr.fallBackToFreshClientID(b)
+	tr.refreshWill(b)
+	if got, want := b.opts.WillTopic, "b/c/control/out"; got != want {
+		t.Errorf("will topic with fresh client ID: %v != %v", got, want)
+	}
+
+	// Rebuilding the options for another setting refreshes the will too.
+	if err := tr.SetTopicPrefix("d"); err != nil {
+		t.Fatal(err)
+	}
+	tr.setClientID(b, "c", true)
+	if got, want := b.opts.WillTopic, "d/c/control/out"; got != want {
+		t.Errorf("will topic after rebuilding the options: %v != %v", got, want)
+	}
+}
+
+func TestReloadTLSConfigKeepsStore(t *testing.T) {
+	tr, err := NewMQTTTransport("c", []MQTTBroker{{URL: "tcp://a:1883"}}, MQTTBroker{}, false, false, false, PublishOptions{}, func([]byte, string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := tr.brokers[0]
+	b.loadTLSConfig = func() (*tls.Config, error) { return &tls.Config{}, nil }
+
+	client, store := b.client, b.opts.Store
+	if store == nil {
+		t.Fatal("expected a store")
+	}
+	if err := tr.reloadTLSConfig(b); err != nil {
+		t.Fatal(err)
+	}
+	if b.client == client {
+		t.Error("client not replaced")
+	}
+	if b.opts.Store != store {
+		t.Error("store replaced with the client")
+	}
+}
+
+func TestSetBrokers(t *testing.T) {
+	tests := []struct {
+		description string
+		brokers     []string
+		want        []string
+		wantChanged bool
+		wantError   bool
+	}{
+		{
+			description: "unchanged",
+			brokers:     []string{"tcp://a:1883", "tcp://b:1883"},
+			want:        []string{"tcp://a:1883", "tcp://b:1883"},
+		},
+		{
+			description: "replaced",
+			brokers:     []string{"tcp://a:1883", "tcp://c:1883"},
+			want:        []string{"tcp://a:1883", "tcp://c:1883"},
+			wantChanged: true,
+		},
+		{
+			description: "reordered",
+			brokers:     []string{"tcp://b:1883", "tcp://a:1883"},
+			want:        []string{"tcp://b:1883", "tcp://a:1883"},
+			wantChanged: true,
+		},
+		{
+			description: "empty",
+			want:        []string{"tcp://a:1883", "tcp://b:1883"},
+			wantError:   true,
+		},
+		{
+			description: "invalid SRV broker",
+			brokers:     []string{"srv://example.com"},
+			want:        []string{"tcp://a:1883", "tcp://b:1883"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tr, err := NewMQTTTransport("c", []MQTTBroker{{URL: "tcp://a:1883"}, {URL: "tcp://b:1883"}}, MQTTBroker{}, true, false, false, PublishOptions{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := tr.brokers[0]
+
+			brokers := make([]MQTTBroker, 0, len(test.brokers))
+			for _, u := range test.brokers {
+				brokers = append(brokers, MQTTBroker{URL: u})
+			}
+			changed, err := tr.SetBrokers(brokers)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if changed != test.wantChanged {
+				t.Errorf("changed: %v != %v", changed, test.wantChanged)
+			}
+
+			tr.refreshBrokers()
+			got := make([]string, 0, len(tr.brokers))
+			for _, b := range tr.brokers {
+				got = append(got, b.url)
+				if b.url == a.url && b != a {
+					t.Errorf("broker %v was recreated", a.url)
+				}
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("brokers: %v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		description string
+		window      time.Duration
+	}{
+		{
+			description: "disabled",
+		},
+		{
+			description: "negative",
+			window:      -time.Second,
+		},
+		{
+			description: "window",
+			window:      time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := jitter(test.window)
+				if got < 0 || (test.window > 0 && got >= test.window) || (test.window <= 0 && got != 0) {
+					t.Fatalf("got %v, want a delay within [0, %v)", got, test.window)
+				}
+			}
+		})
+	}
+}
+
+// fakeToken is a completed token with err, acknowledging subscriptions with
+// the return codes in result.
+type fakeToken struct {
+	err    error
+	result map[string]byte
+}
+
+func (f *fakeToken) Wait() bool                     { return true }
+func (f *fakeToken) WaitTimeout(time.Duration) bool { return true }
+func (f *fakeToken) Done() <-chan struct{}          { return nil }
+func (f *fakeToken) Error() error                   { return f.err }
+func (f *fakeToken) Result() map[string]byte        { return f.result }
+
+// fakeSubscriber is a client whose subscription attempts complete with the
+// next token in tokens.
+type fakeSubscriber struct {
+	mqtt.Client
+	tokens       []*fakeToken
+	attempts     int
+	disconnected bool
+}
+
+func (f *fakeSubscriber) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	token := f.tokens[f.attempts]
+	f.attempts++
+	return token
+}
+
+func (f *fakeSubscriber) IsConnected() bool { return !f.disconnected }
+
+func (f *fakeSubscriber) IsConnectionOpen() bool { return !f.disconnected }
+
+func TestSubscribeTopic(t *testing.T) {
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = time.Sleep }()
+
+	failed := &fakeToken{err: errors.New("timeout")}
+	tests := []struct {
+		description  string
+		tokens       []*fakeToken
+		disconnected bool
+		wantError    error
+		wantAttempts int
+		wantDelays   []time.Duration
+	}{
+		{
+			description:  "subscribed",
+			tokens:       []*fakeToken{{result: map[string]byte{"t": 1}}},
+			wantAttempts: 1,
+		},
+		{
+			description:  "retried",
+			tokens:       []*fakeToken{failed, failed, {result: map[string]byte{"t": 1}}},
+			wantAttempts: 3,
+			wantDelays:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			description:  "retries exhausted",
+			tokens:       []*fakeToken{failed, failed, failed, failed},
+			wantError:    ErrSubscribeFailed,
+			wantAttempts: 4,
+			wantDelays:   []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			description:  "refused",
+			tokens:       []*fakeToken{{result: map[string]byte{"t": subackFailure}}},
+			wantError:    ErrSubscribeRefused,
+			wantAttempts: 1,
+		},
+		{
+			description:  "disconnected",
+			tokens:       []*fakeToken{failed},
+			disconnected: true,
+			wantError:    ErrSubscribeFailed,
+			wantAttempts: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			delays = nil
+			tr := MQTT{subscribeRetries: 3, granted: make(map[string]subscriptionGrant)}
+			client := &fakeSubscriber{tokens: test.tokens, disconnected: test.disconnected}
+
+			err := tr.subscribeTopic(client, "t", 3*time.Second)
+			if !errors.Is(err, test.wantError) || (err != nil) != (test.wantError != nil) {
+				t.Errorf("unexpected error %v, want %v", err, test.wantError)
+			}
+			if client.attempts != test.wantAttempts {
+				t.Errorf("%v attempts, want %v", client.attempts, test.wantAttempts)
+			}
+			if !cmp.Equal(delays, test.wantDelays) {
+				t.Errorf("delays: %v", cmp.Diff(delays, test.wantDelays))
+			}
+		})
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	tests := []struct {
+		description    string
+		cleanSession   bool
+		sessionPresent bool
+		disconnected   bool
+		want           []Subscription
+	}{
+		{
+			description:  "new session",
+			cleanSession: true,
+			want: []Subscription{
+				{Topic: "a/c/control/in", Dest: "control", State: "subscribed", QoS: intPtr(1)},
+				{Topic: "a/c/data/in", Dest: "data", State: "refused"},
+			},
+		},
+		{
+			description:  "clean session disconnected",
+			cleanSession: true,
+			disconnected: true,
+			want: []Subscription{
+				{Topic: "a/c/control/in", Dest: "control", State: "pending"},
+				{Topic: "a/c/data/in", Dest: "data", State: "pending"},
+			},
+		},
+		{
+			description:    "resumed session",
+			sessionPresent: true,
+			want: []Subscription{
+				{Topic: "a/c/control/in", Dest: "control", State: "resumed"},
+				{Topic: "a/c/data/in", Dest: "data", State: "resumed"},
+				{Topic: "b/c/data/in", State: "unsubscribing", QoS: intPtr(1)},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tr, err := NewMQTTTransport("c", []MQTTBroker{{URL: "tcp://a:1883"}}, MQTTBroker{}, test.cleanSession, false, false, PublishOptions{}, func([]byte, string) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr.prefix = "a"
+			tr.subscriptions = tr.topics(tr.prefix)
+			client := &fakeSubscriber{tokens: []*fakeToken{
+				{result: map[string]byte{"a/c/control/in": 1}},
+				{result: map[string]byte{"a/c/data/in": subackFailure}},
+			}}
+			tr.brokers[0].client = client
+			if test.sessionPresent {
+				tr.connectedOnce.Store(true)
+				tr.subscribe(client, true, time.Second)
+				// A topic removed while disconnected stays held by
+				// the session until it is unsubscribed from.
+				tr.unsubscribed["b/c/data/in"] = true
+				tr.granted["b/c/data/in"] = subscriptionGrant{qos: 1, since: time.Now()}
+			} else {
+				tr.subscribeTopic(client, "a/c/control/in", time.Second)
+				tr.subscribeTopic(client, "a/c/data/in", time.Second)
+			}
+			client.disconnected = test.disconnected
+
+			got := tr.Subscriptions()
+			for i := range got {
+				if got[i].State != "pending" && got[i].Since == nil {
+					t.Errorf("missing time of subscription %v", got[i].Topic)
+				}
+				got[i].Since = nil
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func intPtr(i int) *int { return &i }
+
+func TestConnectErrorUnwrap(t *testing.T) {
+	refused := fmt.Errorf("%w to topic 't'", ErrSubscribeRefused)
+	err := error(&connectError{errs: []string{"tcp://a:1883: " + refused.Error()}, subscribeErr: refused})
+	if !errors.Is(err, ErrSubscribeRefused) {
+		t.Errorf("expected %v to wrap %v", err, ErrSubscribeRefused)
+	}
+	if errors.Is(&connectError{errs: []string{"tcp://a:1883: refused"}}, ErrSubscribeRefused) {
+		t.Error("unexpected subscription error")
+	}
+}
+
+// fakeConnectToken is a completed connect token refused with returnCode.
+type fakeConnectToken struct {
+	fakeToken
+	returnCode byte
+}
+
+func (f *fakeConnectToken) ReturnCode() byte { return f.returnCode }
+
+func TestRefusedConnection(t *testing.T) {
+	tests := []struct {
+		description    string
+		returnCode     byte
+		wantAuthFailed bool
+	}{
+		{
+			description:    "bad user name or password",
+			returnCode:     4,
+			wantAuthFailed: true,
+		},
+		{
+			description:    "not authorized",
+			returnCode:     5,
+			wantAuthFailed: true,
+		},
+		{
+			description: "server unavailable",
+			returnCode:  3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			token := &fakeConnectToken{fakeToken: fakeToken{err: errors.New("refused")}, returnCode: test.returnCode}
+			connErr := fmt.Errorf("cannot connect to broker: %w", refusedConnection(token, token.err))
+			if got := errors.Is(connErr, ErrAuthFailed); got != test.wantAuthFailed {
+				t.Errorf("auth failed: %v, want %v (%v)", got, test.wantAuthFailed, connErr)
+			}
+
+			tr, err := NewMQTTTransport("c", []MQTTBroker{{URL: "tcp://a:1883"}}, MQTTBroker{}, false, false, false, PublishOptions{}, func([]byte, string) {})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr.recordAttempt(tr.brokers[0], connErr)
+			status := tr.BrokerStatus()[0]
+			if status.ReturnCode != int(test.returnCode) || status.AuthFailed != test.wantAuthFailed {
+				t.Errorf("broker status: return code %v, auth failed %v", status.ReturnCode, status.AuthFailed)
+			}
+			tr.recordAttempt(tr.brokers[0], nil)
+			if status := tr.BrokerStatus()[0]; status.ReturnCode != 0 || status.AuthFailed {
+				t.Errorf("broker status not reset: %#v", status)
+			}
+		})
+	}
+
+	if err := refusedConnection(&fakeToken{err: errors.New("timeout")}, errors.New("timeout")); errors.Is(err, ErrAuthFailed) {
+		t.Errorf("unexpected auth failure: %v", err)
+	}
+	authErr := fmt.Errorf("cannot connect to broker: %w", &connackError{code: 5, err: errors.New("not Authorized")})
+	if !errors.Is(&connectError{errs: []string{authErr.Error()}, authErr: authErr}, ErrAuthFailed) {
+		t.Errorf("expected connect error to wrap %v", ErrAuthFailed)
+	}
+}
+
+// fakePublisher is a client that records the QoS of the messages published
+// with it, completing each publish with token, if set.
+type fakePublisher struct {
+	mqtt.Client
+	qos   []byte
+	token mqtt.Token
+}
+
+func (f *fakePublisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	f.qos = append(f.qos, qos)
+	if f.token != nil {
+		return f.token
+	}
+	return &fakeToken{}
+}
+
+// pendingToken is a token the broker never acknowledges.
+type pendingToken struct {
+	fakeToken
+}
+
+func (p *pendingToken) WaitTimeout(time.Duration) bool { return false }
+
+func TestSendDataQoS(t *testing.T) {
+	tests := []struct {
+		description string
+		opts        PublishOptions
+		want        byte
+	}{
+		{
+			description: "fire and forget",
+			opts:        PublishOptions{QoS: 0},
+			want:        0,
+		},
+		{
+			description: "waiting for acknowledgement",
+			opts:        PublishOptions{QoS: 0, WaitForAck: true},
+			want:        1,
+		},
+		{
+			description: "exactly once",
+			opts:        PublishOptions{QoS: 2, WaitForAck: true},
+			want:        2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			client := &fakePublisher{}
+			tr := MQTT{brokers: []*mqttBroker{{client: client}}}
+
+			if err := tr.SendDataWithOptions([]byte("{}"), "data", test.opts); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(client.qos, []byte{test.want}) {
+				t.Errorf("published at QoS %v, want %v", client.qos, test.want)
+			}
+		})
+	}
+}
+
+func TestSendDataAckTimeout(t *testing.T) {
+	tests := []struct {
+		description string
+		token       mqtt.Token
+		opts        PublishOptions
+		wantError   bool
+	}{
+		{
+			description: "not waiting",
+			token:       &pendingToken{},
+		},
+		{
+			description: "acknowledged",
+			token:       &fakeToken{},
+			opts:        PublishOptions{WaitForAck: true, AckTimeout: time.Second},
+		},
+		{
+			description: "not acknowledged in time",
+			token:       &pendingToken{},
+			opts:        PublishOptions{WaitForAck: true, AckTimeout: time.Second},
+			wantError:   true,
+		},
+		{
+			description: "refused",
+			token:       &fakeToken{err: errors.New("not authorized")},
+			opts:        PublishOptions{WaitForAck: true},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tr := MQTT{brokers: []*mqttBroker{{client: &fakePublisher{token: test.token}}}}
+
+			err := tr.SendDataWithOptions([]byte("{}"), "data", test.opts)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFreshClientIDFallback(t *testing.T) {
+	tr, err := NewMQTTTransport("c", []MQTTBroker{{URL: "tcp://a:1883"}}, MQTTBroker{}, false, false, false, PublishOptions{}, func([]byte, string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.SetFreshClientIDFallback(3, true)
+	b := tr.brokers[0]
+
+	b.failures = 2
+	tr.fallBackToFreshClientID(b)
+	if b.freshClientID != "" || b.opts.ClientID != "c" {
+		t.Fatalf("fell back after %v failures: %v", b.failures, b.opts.ClientID)
+	}
+
+	b.failures = 3
+	tr.fallBackToFreshClientID(b)
+	if !strings.HasPrefix(b.freshClientID, "c-") || b.opts.ClientID != b.freshClientID {
+		t.Errorf("unexpected fresh client ID %q for client ID %q", b.freshClientID, b.opts.ClientID)
+	}
+	if !b.opts.CleanSession {
+		t.Error("expected a clean session with a fresh client ID")
+	}
+	if got := tr.BrokerStatus()[0].FreshClientID; got != b.freshClientID {
+		t.Errorf("broker status: %q != %q", got, b.freshClientID)
+	}
+
+	tr.revertClientIDs()
+	if b.freshClientID != "" || b.opts.ClientID != "c" || b.opts.CleanSession {
+		t.Errorf("did not revert: client ID %q, clean session %v", b.opts.ClientID, b.opts.CleanSession)
+	}
+
+	tr.SetFreshClientIDFallback(3, false)
+	tr.fallBackToFreshClientID(b)
+	id := b.freshClientID
+	tr.revertClientIDs()
+	if id == "" || b.opts.ClientID != id {
+		t.Errorf("reverted to %q from %q", b.opts.ClientID, id)
+	}
+}
+
+// fakeBrokerClient is a client connecting to a broker that accepts the
+// connection unless refuse is set, and granting every subscription.
+type fakeBrokerClient struct {
+	mqtt.Client
+	refuse    bool
+	connected bool
+}
+
+func (f *fakeBrokerClient) Connect() mqtt.Token {
+	if f.refuse {
+		return &fakeToken{err: fmt.Errorf("connection refused")}
+	}
+	f.connected = true
+	return &fakeToken{}
+}
+
+func (f *fakeBrokerClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return &fakeToken{result: map[string]byte{topic: qos}}
+}
+
+func (f *fakeBrokerClient) Disconnect(quiesce uint) { f.connected = false }
+
+func (f *fakeBrokerClient) IsConnected() bool { return f.connected }
+
+func TestFailBack(t *testing.T) {
+	brokers := []MQTTBroker{{URL: "tcp://a:1883"}, {URL: "tcp://b:1883"}, {URL: "tcp://c:1883"}}
+	tr, err := NewMQTTTransport("c", brokers, MQTTBroker{}, true, false, false, PublishOptions{}, func([]byte, string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := []*fakeBrokerClient{{refuse: true}, {refuse: true}, {connected: true}}
+	for i, c := range clients {
+		tr.brokers[i].client = c
+	}
+	tr.active = 2
+	reconnected := 0
+	tr.SetReconnectHandler(func() { reconnected++ })
+
+	if tr.failBack() {
+		t.Fatal("failed back to a broker refusing connections")
+	}
+	if tr.active != 2 || !clients[2].connected {
+		t.Fatalf("active broker changed to %v", tr.active)
+	}
+
+	clients[1].refuse = false
+	if !tr.failBack() {
+		t.Fatal("did not fail back")
+	}
+	if tr.active != 1 || clients[2].connected || reconnected != 1 {
+		t.Errorf("active broker %v, previous broker connected %v, reconnected %v", tr.active, clients[2].connected, reconnected)
+	}
+	if tr.BrokerStatus()[0].Failures != 2 {
+		t.Errorf("failures of the first broker: %v", tr.BrokerStatus()[0].Failures)
+	}
+
+	clients[0].refuse = false
+	if !tr.failBack() || tr.active != 0 || clients[1].connected {
+		t.Errorf("did not fail back to the first broker: %v", tr.active)
+	}
+	if tr.failBack() {
+		t.Error("failed back from the first broker")
+	}
+}
@@ -0,0 +1,265 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyDialTimeout bounds connecting to the proxy and, for an HTTP proxy, the
+// proxy connecting to the broker. Without a proxy, it bounds connecting to
+// brokers dialed with brokerDialer.
+const ProxyDialTimeout = 30 * time.Second
+
+// proxySchemes are the schemes of the proxy URLs SetProxy accepts.
+var proxySchemes = map[string]bool{"http": true, "socks5": true, "socks5h": true}
+
+// brokerProxy holds the proxy set by SetProxy.
+var brokerProxy struct {
+	sync.RWMutex
+	url *url.URL
+}
+
+// SetProxy makes MQTT transports connect to brokers through the proxy u: an
+// HTTP proxy ("http://host:port") that supports the CONNECT method, or a SOCKS5
+// proxy ("socks5://host:port"). Credentials for the proxy are taken from the
+// user information of u. Brokers whose hostnames match the NO_PROXY
+// environment variable are connected to directly. It must be called before
+// any transport is created.
+func SetProxy(u *url.URL) error {
+	if !proxySchemes[u.Scheme] {
+		return fmt.Errorf("unsupported proxy scheme: %v", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("invalid proxy: missing host")
+	}
+
+	brokerProxy.Lock()
+	brokerProxy.url = u
+	brokerProxy.Unlock()
+
+	return nil
+}
+
+// ProxyFromEnvironment returns the proxy named by the first of the ALL_PROXY,
+// HTTPS_PROXY and HTTP_PROXY environment variables (or their lowercase forms)
+// that is set, or nil if none is. A proxy without a scheme is an HTTP proxy.
+func ProxyFromEnvironment() (*url.URL, error) {
+	for _, name := range []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "://") {
+			value = "http://" + value
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %v: %w", name, err)
+		}
+		return u, nil
+	}
+	return nil, nil
+}
+
+// currentProxy returns the proxy set by SetProxy, or nil if none is set.
+func currentProxy() *url.URL {
+	brokerProxy.RLock()
+	defer brokerProxy.RUnlock()
+	return brokerProxy.url
+}
+
+// openBrokerConnection opens the network connection to the broker uri on
+// behalf of the MQTT client, in place of its own, so that TCP and TLS brokers
+// are dialed through the proxy set by SetProxy, if there is one, and with the
+// settings of SetTCPKeepAlive.
+func openBrokerConnection(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	switch uri.Scheme {
+	case "ws":
+		return mqtt.NewWebsocket(uri.String(), nil, options.ConnectTimeout, options.HTTPHeaders, options.WebsocketOptions)
+	case "wss":
+		return mqtt.NewWebsocket(uri.String(), options.TLSConfig, options.ConnectTimeout, options.HTTPHeaders, options.WebsocketOptions)
+	case "unix":
+		addr := uri.Host
+		if addr == "" {
+			addr = uri.Path
+		}
+		return brokerDialer().Dial("unix", addr)
+	case "mqtt", "tcp":
+		d, err := currentDialer()
+		if err != nil {
+			return nil, err
+		}
+		return d.Dial("tcp", uri.Host)
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		d, err := currentDialer()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := d.Dial("tcp", uri.Host)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, options.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme: %v", uri.Scheme)
+	}
+}
+
+// currentDialer returns the dialer that connects to TCP and TLS brokers:
+// through the proxy set by SetProxy, if there is one, or directly.
+func currentDialer() (proxy.Dialer, error) {
+	u := currentProxy()
+	if u == nil {
+		return brokerDialer(), nil
+	}
+	return proxyDialer(u)
+}
+
+// proxyDialer returns a dialer that connects through the proxy u.
+func proxyDialer(u *url.URL) (proxy.Dialer, error) {
+	forward := brokerDialer()
+	var auth *proxy.Auth
+	if u.User != nil {
+		auth = &proxy.Auth{User: u.User.Username()}
+		auth.Password, _ = u.User.Password()
+	}
+
+	var d proxy.Dialer
+	switch u.Scheme {
+	case "http":
+		d = &httpProxyDialer{addr: proxyAddr(u), auth: auth, forward: forward}
+	case "socks5", "socks5h":
+		var err error
+		d, err = proxy.SOCKS5("tcp", proxyAddr(u), auth, forward)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %v", u.Scheme)
+	}
+
+	if noProxy := noProxyEnv(); noProxy != "" {
+		perHost := proxy.NewPerHost(d, forward)
+		perHost.AddFromString(noProxy)
+		return perHost, nil
+	}
+	return d, nil
+}
+
+// websocketProxy returns the function the WebSocket dialer of the MQTT client
+// selects a proxy with, which selects u for any broker that does not match
+// NO_PROXY.
+func websocketProxy(u *url.URL) mqtt.ProxyFunction {
+	config := httpproxy.Config{HTTPProxy: u.String(), HTTPSProxy: u.String(), NoProxy: noProxyEnv()}
+	proxyFunc := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+}
+
+// noProxyEnv returns the value of the NO_PROXY environment variable or its
+// lowercase form.
+func noProxyEnv() string {
+	if v := os.Getenv("NO_PROXY"); v != "" {
+		return v
+	}
+	return os.Getenv("no_proxy")
+}
+
+// proxyAddr returns the address of the proxy u, with the default port of its
+// scheme if u has none.
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme != "http" {
+			port = "1080"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// An httpProxyDialer connects through an HTTP proxy with the CONNECT method.
+type httpProxyDialer struct {
+	addr    string
+	auth    *proxy.Auth
+	forward *net.Dialer
+}
+
+// Dial connects to addr through the proxy.
+func (d *httpProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to proxy: %w", err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != nil {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.auth.User + ":" + d.auth.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(ProxyDialTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot send request to proxy: %w", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot read response from proxy: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy cannot connect to %v: %v", addr, resp.Status)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The broker does not send before the client, but anything the proxy
+	// sent past its response must not be lost.
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// A bufferedConn is a net.Conn whose reads are served from r first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,227 @@
+package transport
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// serveHTTPProxy accepts a single connection on l, answers its CONNECT
+// request with status and, if the request is accepted, echoes what is sent
+// over the tunnel. It sends the request it received to reqs.
+func serveHTTPProxy(t *testing.T, l net.Listener, status int, reqs chan<- *http.Request) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	reqs <- req
+	resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+	if err := resp.Write(conn); err != nil {
+		t.Error(err)
+		return
+	}
+	if status == http.StatusOK {
+		io.Copy(conn, r)
+	}
+}
+
+func TestHTTPProxyDialer(t *testing.T) {
+	tests := []struct {
+		description string
+		user        *url.Userinfo
+		status      int
+		wantAuth    string
+		wantError   bool
+	}{
+		{
+			description: "connect",
+			status:      http.StatusOK,
+		},
+		{
+			description: "authenticated",
+			user:        url.UserPassword("user", "secret"),
+			status:      http.StatusOK,
+			wantAuth:    "Basic dXNlcjpzZWNyZXQ=",
+		},
+		{
+			description: "refused",
+			status:      http.StatusProxyAuthRequired,
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			reqs := make(chan *http.Request, 1)
+			go serveHTTPProxy(t, l, test.status, reqs)
+
+			d, err := proxyDialer(&url.URL{Scheme: "http", Host: l.Addr().String(), User: test.user})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := d.Dial("tcp", "broker.example.com:8883")
+			if test.wantError {
+				if err == nil {
+					conn.Close()
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			req := <-reqs
+			if req.Method != http.MethodConnect || req.Host != "broker.example.com:8883" {
+				t.Errorf("unexpected request: %v %v", req.Method, req.Host)
+			}
+			if got := req.Header.Get("Proxy-Authorization"); got != test.wantAuth {
+				t.Errorf("%q != %q", got, test.wantAuth)
+			}
+
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "ping" {
+				t.Errorf("%q != %q", got, "ping")
+			}
+		})
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	names := []string{"ALL_PROXY", "all_proxy", "HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"}
+	saved := make(map[string]string)
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			saved[name] = value
+		}
+	}
+	defer func() {
+		for _, name := range names {
+			os.Unsetenv(name)
+			if value, ok := saved[name]; ok {
+				os.Setenv(name, value)
+			}
+		}
+	}()
+
+	tests := []struct {
+		description string
+		env         map[string]string
+		want        string
+	}{
+		{
+			description: "unset",
+		},
+		{
+			description: "all proxy first",
+			env:         map[string]string{"ALL_PROXY": "socks5://proxy:1080", "HTTPS_PROXY": "http://other:3128"},
+			want:        "socks5://proxy:1080",
+		},
+		{
+			description: "https proxy before http proxy",
+			env:         map[string]string{"https_proxy": "http://proxy:3128", "HTTP_PROXY": "http://other:3128"},
+			want:        "http://proxy:3128",
+		},
+		{
+			description: "no scheme",
+			env:         map[string]string{"HTTP_PROXY": "proxy:3128"},
+			want:        "http://proxy:3128",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			for _, name := range names {
+				os.Unsetenv(name)
+			}
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+
+			u, err := ProxyFromEnvironment()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if u != nil {
+				got = u.String()
+			}
+			if got != test.want {
+				t.Errorf("%q != %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetProxyScheme(t *testing.T) {
+	if err := SetProxy(&url.URL{Scheme: "https", Host: "proxy:3128"}); err == nil {
+		t.Error("expected error")
+	}
+	if currentProxy() != nil {
+		t.Error("expected no proxy to be set")
+	}
+}
+
+func TestOpenBrokerConnection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	reqs := make(chan *http.Request, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveHTTPProxy(t, l, http.StatusOK, reqs)
+	}()
+
+	env := os.Getenv("all_proxy")
+	if err := SetProxy(&url.URL{Scheme: "http", Host: l.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		brokerProxy.Lock()
+		brokerProxy.url = nil
+		brokerProxy.Unlock()
+	}()
+	if got := os.Getenv("all_proxy"); got != env {
+		t.Errorf("all_proxy changed: %q != %q", got, env)
+	}
+
+	conn, err := openBrokerConnection(&url.URL{Scheme: "tcp", Host: "broker.example.com:1883"}, *mqtt.NewClientOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-reqs
+	if req.Host != "broker.example.com:1883" {
+		t.Errorf("%q != %q", req.Host, "broker.example.com:1883")
+	}
+	conn.Close()
+	<-done
+}
@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// dnsLookupTimeout bounds each lookup made by a hostCache.
+const dnsLookupTimeout = 10 * time.Second
+
+// A hostCache caches the addresses broker hostnames resolve to. A cached
+// address is reused until ttl has passed since it was resolved. If resolving
+// a hostname fails and useStale is true, the last address it resolved to is
+// used instead.
+type hostCache struct {
+	lock     sync.Mutex
+	ttl      time.Duration
+	useStale bool
+	entries  map[string]hostEntry
+	lookup   func(ctx context.Context, host string) ([]string, error)
+}
+
+type hostEntry struct {
+	addr     string
+	resolved time.Time
+}
+
+func newHostCache(ttl time.Duration, useStale bool) *hostCache {
+	return &hostCache{
+		ttl:      ttl,
+		useStale: useStale,
+		entries:  make(map[string]hostEntry),
+		lookup:   net.DefaultResolver.LookupHost,
+	}
+}
+
+// resolve returns an address for host, resolving it if no address is cached
+// or the cached address has expired.
+func (c *hostCache) resolve(host string) (string, error) {
+	c.lock.Lock()
+	entry, cached := c.entries[host]
+	c.lock.Unlock()
+
+	if cached && time.Since(entry.resolved) < c.ttl {
+		return entry.addr, nil
+	}
+
+	addr, err := c.refresh(host)
+	if err == nil {
+		return addr, nil
+	}
+	if !cached || !c.useStale {
+		return "", err
+	}
+	log.Warnf("using stale address %v for %v, resolved %v ago: %v", entry.addr, host, time.Since(entry.resolved).Round(time.Second), err)
+	return entry.addr, nil
+}
+
+// refresh resolves host and caches the first address it resolves to.
+func (c *hostCache) refresh(host string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve %v: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("cannot resolve %v: no addresses", host)
+	}
+
+	c.lock.Lock()
+	c.entries[host] = hostEntry{addr: addrs[0], resolved: time.Now()}
+	c.lock.Unlock()
+
+	log.Debugf("resolved %v to %v", host, addrs[0])
+	return addrs[0], nil
+}
+
+// run re-resolves every cached hostname each time ttl elapses, so that an
+// address is available for reconnecting even if DNS is unavailable at that
+// moment.
+func (c *hostCache) run() {
+	for {
+		time.Sleep(c.ttl)
+
+		c.lock.Lock()
+		hosts := make([]string, 0, len(c.entries))
+		for host := range c.entries {
+			hosts = append(hosts, host)
+		}
+		c.lock.Unlock()
+
+		for _, host := range hosts {
+			if _, err := c.refresh(host); err != nil {
+				log.Debugf("cannot refresh cached address: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHostCacheResolve(t *testing.T) {
+	tests := []struct {
+		description string
+		ttl         time.Duration
+		useStale    bool
+		want        string
+		wantError   bool
+	}{
+		{
+			description: "cached",
+			ttl:         time.Hour,
+			want:        "192.0.2.1",
+		},
+		{
+			description: "expired, stale fallback",
+			useStale:    true,
+			want:        "192.0.2.1",
+		},
+		{
+			description: "expired, no fallback",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			c := newHostCache(test.ttl, test.useStale)
+			c.lookup = func(ctx context.Context, host string) ([]string, error) {
+				return []string{"192.0.2.1"}, nil
+			}
+			if _, err := c.resolve("broker.example.com"); err != nil {
+				t.Fatal(err)
+			}
+
+			// DNS becomes unavailable.
+			c.lookup = func(ctx context.Context, host string) ([]string, error) {
+				return nil, errors.New("no such host")
+			}
+			got, err := c.resolve("broker.example.com")
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package transport
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Split is a Transporter that receives data over one transport and sends it
+// over another, so that messages can be published to a different broker than
+// the one commands are received from. Data sent to any of a configured set of
+// destinations is sent over the inbound transport instead.
+type Split struct {
+	in     Transporter
+	out    Transporter
+	inDest map[string]bool
+
+	lock         sync.Mutex
+	inConnected  bool
+	outConnected bool
+}
+
+// NewSplitTransport creates a transport that receives data over in and sends
+// data over out, except for data sent to one of the destinations in inDests,
+// which is sent over in.
+func NewSplitTransport(in Transporter, out Transporter, inDests []string) *Split {
+	t := Split{
+		in:     in,
+		out:    out,
+		inDest: make(map[string]bool),
+	}
+	for _, dest := range inDests {
+		t.inDest[dest] = true
+	}
+	return &t
+}
+
+// Connect connects both transports. If either fails to connect, Connect may be
+// called again to retry; a transport that is already connected is not
+// connected again.
+func (t *Split) Connect() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.inConnected {
+		if err := t.in.Connect(); err != nil {
+			return fmt.Errorf("cannot connect inbound transport: %w", err)
+		}
+		t.inConnected = true
+	}
+	if !t.outConnected {
+		if err := t.out.Connect(); err != nil {
+			return fmt.Errorf("cannot connect outbound transport: %w", err)
+		}
+		t.outConnected = true
+	}
+	return nil
+}
+
+// Disconnect disconnects both transports, waiting for the specified number of
+// milliseconds for work to complete.
+func (t *Split) Disconnect(quiesce uint) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.inConnected {
+		t.in.Disconnect(quiesce)
+		t.inConnected = false
+	}
+	if t.outConnected {
+		t.out.Disconnect(quiesce)
+		t.outConnected = false
+	}
+}
+
+// transport returns the transport data sent to dest is sent over.
+func (t *Split) transport(dest string) Transporter {
+	if t.inDest[dest] {
+		return t.in
+	}
+	return t.out
+}
+
+// SendData sends data to dest over the transport for dest.
+func (t *Split) SendData(data []byte, dest string) error {
+	return t.transport(dest).SendData(data, dest)
+}
+
+// SendDataWithOptions sends data to dest over the transport for dest using
+// opts. If that transport does not support publish options, the data is sent
+// using its defaults.
+func (t *Split) SendDataWithOptions(data []byte, dest string, opts PublishOptions) error {
+	switch tr := t.transport(dest).(type) {
+	case AcknowledgingTransporter:
+		return tr.SendDataWithOptions(data, dest, opts)
+	default:
+		return tr.SendData(data, dest)
+	}
+}
+
+// ReceiveData passes data received from dest to the inbound transport.
+func (t *Split) ReceiveData(data []byte, dest string) error {
+	return t.in.ReceiveData(data, dest)
+}
+
+// SetTopicPrefix changes the topic prefix of both transports, if they support
+// it.
+func (t *Split) SetTopicPrefix(prefix string) error {
+	for _, tr := range []Transporter{t.in, t.out} {
+		if p, ok := tr.(PrefixedTransporter); ok {
+			if err := p.SetTopicPrefix(prefix); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Subscriptions returns the subscriptions of the inbound transport followed
+// by those of the outbound transport, for those that report them.
+func (t *Split) Subscriptions() []Subscription {
+	var subscriptions []Subscription
+	for _, tr := range []Transporter{t.in, t.out} {
+		if r, ok := tr.(SubscriptionReporter); ok {
+			subscriptions = append(subscriptions, r.Subscriptions()...)
+		}
+	}
+	return subscriptions
+}
+
+// BrokerStatus returns the broker status of the inbound transport followed by
+// that of the outbound transport, for those that report it.
+func (t *Split) BrokerStatus() []BrokerStatus {
+	var status []BrokerStatus
+	for _, tr := range []Transporter{t.in, t.out} {
+		if r, ok := tr.(BrokerStatusReporter); ok {
+			status = append(status, r.BrokerStatus()...)
+		}
+	}
+	return status
+}
@@ -0,0 +1,71 @@
+package transport
+
+import (
+	"errors"
+	"testing"
+)
+
+type fakeTransport struct {
+	connectErr error
+	connects   int
+	sent       []string
+}
+
+func (t *fakeTransport) Connect() error {
+	t.connects++
+	return t.connectErr
+}
+
+func (t *fakeTransport) Disconnect(quiesce uint) {}
+
+func (t *fakeTransport) SendData(data []byte, dest string) error {
+	t.sent = append(t.sent, dest)
+	return nil
+}
+
+func (t *fakeTransport) ReceiveData(data []byte, dest string) error {
+	return nil
+}
+
+func TestSplitSendData(t *testing.T) {
+	in := &fakeTransport{}
+	out := &fakeTransport{}
+	tr := NewSplitTransport(in, out, []string{"control"})
+
+	for _, dest := range []string{"data", "control", "dead-letter"} {
+		if err := tr.SendData([]byte{}, dest); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(in.sent) != 1 || in.sent[0] != "control" {
+		t.Errorf("inbound transport sent %v", in.sent)
+	}
+	if len(out.sent) != 2 || out.sent[0] != "data" || out.sent[1] != "dead-letter" {
+		t.Errorf("outbound transport sent %v", out.sent)
+	}
+}
+
+func TestSplitConnect(t *testing.T) {
+	in := &fakeTransport{}
+	out := &fakeTransport{connectErr: errors.New("unreachable")}
+	tr := NewSplitTransport(in, out, nil)
+
+	if err := tr.Connect(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	out.connectErr = nil
+	if err := tr.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The inbound transport connected on the first attempt and is not
+	// connected again.
+	if in.connects != 1 {
+		t.Errorf("inbound transport connected %v times", in.connects)
+	}
+	if out.connects != 2 {
+		t.Errorf("outbound transport connected %v times", out.connects)
+	}
+}
@@ -0,0 +1,215 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// DefaultSRVRefreshInterval is the interval at which the DNS SRV records of
+// brokers are resolved again when none is configured.
+const DefaultSRVRefreshInterval = 5 * time.Minute
+
+// srvScheme is the URL scheme of a broker that stands for the brokers listed
+// by a DNS SRV record, such as "srv://_mqtt._tcp.example.com".
+const srvScheme = "srv"
+
+// srvTLSServices are the SRV service names of brokers accepting TLS
+// connections. The brokers of any other service are connected to over TCP.
+var srvTLSServices = map[string]bool{"_mqtts": true, "_secure-mqtt": true}
+
+// isSRV returns true if rawURL is the URL of a broker SRV record.
+func isSRV(rawURL string) bool {
+	return strings.HasPrefix(rawURL, srvScheme+"://")
+}
+
+// parseSRV returns the name of the SRV record the broker URL rawURL refers to
+// and the URL scheme of the brokers it lists.
+func parseSRV(rawURL string) (string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse broker URL: %w", err)
+	}
+	labels := strings.SplitN(u.Host, ".", 3)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") || labels[2] == "" {
+		return "", "", fmt.Errorf("invalid SRV record name %v: must be of the form _service._proto.domain", u.Host)
+	}
+	scheme := "tcp"
+	if srvTLSServices[labels[0]] {
+		scheme = "ssl"
+	}
+	return u.Host, scheme, nil
+}
+
+// A srvCache caches the broker URLs listed by DNS SRV records, in the order
+// their priority and weight select. Cached records are resolved again in the
+// background every interval. If a record cannot be resolved, the brokers it
+// last listed are used.
+type srvCache struct {
+	lock     sync.Mutex
+	interval time.Duration
+	entries  map[string]srvEntry
+	lookup   func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+type srvEntry struct {
+	urls     []string
+	resolved time.Time
+}
+
+func newSRVCache(interval time.Duration) *srvCache {
+	return &srvCache{
+		interval: interval,
+		entries:  make(map[string]srvEntry),
+		lookup:   net.DefaultResolver.LookupSRV,
+	}
+}
+
+// resolve returns the broker URLs listed by the SRV record of the broker URL
+// rawURL, resolving the record if it is not cached or was resolved more than
+// interval ago.
+func (c *srvCache) resolve(rawURL string) ([]string, error) {
+	c.lock.Lock()
+	entry, cached := c.entries[rawURL]
+	c.lock.Unlock()
+
+	if cached && time.Since(entry.resolved) < c.interval {
+		return entry.urls, nil
+	}
+
+	urls, err := c.refresh(rawURL)
+	if err == nil {
+		return urls, nil
+	}
+	if !cached {
+		return nil, err
+	}
+	log.Warnf("using brokers listed by %v %v ago: %v", rawURL, time.Since(entry.resolved).Round(time.Second), err)
+	return entry.urls, nil
+}
+
+// refresh resolves the SRV record of the broker URL rawURL and caches the
+// broker URLs it lists. The resolver returns the records sorted by priority
+// and, within a priority, randomized by weight, so brokers are tried in the
+// order RFC 2782 prescribes.
+func (c *srvCache) refresh(rawURL string) ([]string, error) {
+	name, scheme, err := parseSRV(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	_, records, err := c.lookup(ctx, "", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve SRV record %v: %w", name, err)
+	}
+	urls := make([]string, 0, len(records))
+	for _, r := range records {
+		target := strings.TrimSuffix(r.Target, ".")
+		// A target of "." means the service is not available.
+		if target == "" {
+			continue
+		}
+		urls = append(urls, fmt.Sprintf("%v://%v", scheme, net.JoinHostPort(target, strconv.Itoa(int(r.Port)))))
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("cannot resolve SRV record %v: no brokers", name)
+	}
+
+	c.lock.Lock()
+	c.entries[rawURL] = srvEntry{urls: urls, resolved: time.Now()}
+	c.lock.Unlock()
+
+	log.Debugf("resolved %v to %v", name, strings.Join(urls, ", "))
+	return urls, nil
+}
+
+// run resolves every cached SRV record again each time interval elapses, so
+// that the current brokers are known when the transport next connects.
+func (c *srvCache) run() {
+	for {
+		time.Sleep(c.interval)
+
+		c.lock.Lock()
+		urls := make([]string, 0, len(c.entries))
+		for rawURL := range c.entries {
+			urls = append(urls, rawURL)
+		}
+		c.lock.Unlock()
+
+		for _, rawURL := range urls {
+			if _, err := c.refresh(rawURL); err != nil {
+				log.Debugf("cannot refresh cached brokers: %v", err)
+			}
+		}
+	}
+}
+
+// updateBrokers rebuilds the brokers the transport connects to from the
+// configured brokers, replacing each SRV broker with the brokers its record
+// lists. A broker listed again keeps its client and connection history. An
+// SRV broker whose record has never been resolved is kept in place of the
+// brokers it lists, so that connecting to it fails with the resolution error.
+// It must only be called while the transport is not connected.
+func (t *MQTT) updateBrokers() {
+	t.lock.RLock()
+	existing := make(map[string]*mqttBroker, len(t.brokers))
+	for _, b := range t.brokers {
+		existing[b.url] = b
+	}
+	configured, srv := t.configured, t.srv
+	t.lock.RUnlock()
+
+	brokers := make([]*mqttBroker, 0, len(configured))
+	srvErrs := make(map[*mqttBroker]error)
+	add := func(broker MQTTBroker, srvErr error) {
+		b, prs := existing[broker.URL]
+		if !prs {
+			b = t.newBroker(broker)
+			existing[broker.URL] = b
+		} else if _, added := srvErrs[b]; added {
+			return
+		}
+		srvErrs[b] = srvErr
+		brokers = append(brokers, b)
+	}
+	for _, broker := range configured {
+		if !isSRV(broker.URL) {
+			add(broker, nil)
+			continue
+		}
+		urls, err := srv.resolve(broker.URL)
+		if err != nil {
+			log.Warnf("cannot resolve brokers listed by %v: %v", broker.URL, err)
+			add(broker, err)
+			continue
+		}
+		for _, u := range urls {
+			listed := broker
+			listed.URL = u
+			add(listed, nil)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	active := t.brokers[t.active]
+	t.active = 0
+	for i, b := range brokers {
+		b.srvErr = srvErrs[b]
+		if b == active {
+			t.active = i
+		}
+	}
+	t.brokers = brokers
+}
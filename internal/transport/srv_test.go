@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSRV(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		wantName    string
+		wantScheme  string
+		wantError   bool
+	}{
+		{
+			description: "tcp",
+			input:       "srv://_mqtt._tcp.example.com",
+			wantName:    "_mqtt._tcp.example.com",
+			wantScheme:  "tcp",
+		},
+		{
+			description: "tls",
+			input:       "srv://_mqtts._tcp.example.com",
+			wantName:    "_mqtts._tcp.example.com",
+			wantScheme:  "ssl",
+		},
+		{
+			description: "missing service",
+			input:       "srv://example.com",
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			name, scheme, err := parseSRV(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Errorf("expected error, got %v", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != test.wantName || scheme != test.wantScheme {
+				t.Errorf("%v, %v != %v, %v", name, scheme, test.wantName, test.wantScheme)
+			}
+		})
+	}
+}
+
+func TestUpdateBrokers(t *testing.T) {
+	tests := []struct {
+		description string
+		records     []*net.SRV
+		lookupErr   error
+		cached      bool
+		want        []string
+		wantSRVErr  bool
+	}{
+		{
+			description: "resolved",
+			records: []*net.SRV{
+				{Target: "b1.example.com.", Port: 1883},
+				{Target: "b2.example.com.", Port: 8883},
+			},
+			want: []string{"tcp://a:1883", "tcp://b1.example.com:1883", "tcp://b2.example.com:8883"},
+		},
+		{
+			description: "duplicate",
+			records:     []*net.SRV{{Target: "a.", Port: 1883}},
+			want:        []string{"tcp://a:1883"},
+		},
+		{
+			description: "unavailable, cached",
+			lookupErr:   errors.New("no such host"),
+			cached:      true,
+			want:        []string{"tcp://a:1883", "tcp://cached.example.com:1883"},
+		},
+		{
+			description: "unavailable",
+			lookupErr:   errors.New("no such host"),
+			want:        []string{"tcp://a:1883", "srv://_mqtt._tcp.example.com"},
+			wantSRVErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tr, err := NewMQTTTransport("c", []MQTTBroker{{URL: "tcp://a:1883"}, {URL: "srv://_mqtt._tcp.example.com"}}, MQTTBroker{}, true, false, false, PublishOptions{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr.srv.lookup = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+				return "", test.records, test.lookupErr
+			}
+			if test.cached {
+				tr.srv.entries["srv://_mqtt._tcp.example.com"] = srvEntry{urls: []string{"tcp://cached.example.com:1883"}, resolved: time.Now().Add(-time.Hour)}
+			}
+			static := tr.brokers[0]
+
+			tr.updateBrokers()
+
+			got := make([]string, 0, len(tr.brokers))
+			for _, b := range tr.brokers {
+				got = append(got, b.url)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("brokers: %v", cmp.Diff(got, test.want))
+			}
+			if tr.brokers[0] != static {
+				t.Error("static broker was recreated")
+			}
+			if gotSRVErr := tr.brokers[len(tr.brokers)-1].srvErr != nil; gotSRVErr != test.wantSRVErr {
+				t.Errorf("SRV error: %v", tr.brokers[len(tr.brokers)-1].srvErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package transport
+
+import "strings"
+
+// sharedSubscriptionPrefix is the topic filter prefix used by MQTT brokers to
+// identify a shared subscription ("$share/<group>/<filter>").
+const sharedSubscriptionPrefix = "$share/"
+
+// Topic joins elem into an MQTT topic, namespaced under prefix. Empty elements
+// (including an empty prefix) are omitted so that no leading, trailing or
+// repeated separators are introduced. If the first element is a shared
+// subscription filter, the prefix is applied to the filter rather than in
+// front of the "$share/<group>" portion, so the result remains a valid shared
+// subscription within the namespace.
+func Topic(prefix string, elem ...string) string {
+	var share string
+	if len(elem) > 0 && strings.HasPrefix(elem[0], sharedSubscriptionPrefix) {
+		fields := strings.SplitN(elem[0], "/", 3)
+		share = strings.Join(fields[:2], "/")
+		var filter string
+		if len(fields) == 3 {
+			filter = fields[2]
+		}
+		elem = append([]string{filter}, elem[1:]...)
+	}
+
+	parts := make([]string, 0, len(elem)+1)
+	for _, e := range append([]string{prefix}, elem...) {
+		e = strings.Trim(e, "/")
+		if e != "" {
+			parts = append(parts, e)
+		}
+	}
+	topic := strings.Join(parts, "/")
+
+	if share != "" {
+		return share + "/" + topic
+	}
+	return topic
+}
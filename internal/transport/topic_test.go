@@ -0,0 +1,52 @@
+package transport
+
+import "testing"
+
+func TestTopic(t *testing.T) {
+	tests := []struct {
+		description string
+		prefix      string
+		elem        []string
+		want        string
+	}{
+		{
+			description: "default prefix",
+			prefix:      "yggdrasil",
+			elem:        []string{"client-1", "data", "in"},
+			want:        "yggdrasil/client-1/data/in",
+		},
+		{
+			description: "empty prefix",
+			prefix:      "",
+			elem:        []string{"client-1", "control", "out"},
+			want:        "client-1/control/out",
+		},
+		{
+			description: "nested prefix with separators",
+			prefix:      "/fleet-a/yggdrasil/",
+			elem:        []string{"client-1", "data", "out"},
+			want:        "fleet-a/yggdrasil/client-1/data/out",
+		},
+		{
+			description: "shared subscription",
+			prefix:      "fleet-a",
+			elem:        []string{"$share/group/client-1", "data", "in"},
+			want:        "$share/group/fleet-a/client-1/data/in",
+		},
+		{
+			description: "shared subscription with empty prefix",
+			prefix:      "",
+			elem:        []string{"$share/group", "client-1", "data", "in"},
+			want:        "$share/group/client-1/data/in",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got := Topic(test.prefix, test.elem...)
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,14 @@
 package transport
 
+import "time"
+
 type DataReceiveHandlerFunc func([]byte, string)
 
+// A TopicReceiveHandlerFunc receives the data received on a destination along
+// with the topic it arrived on, which, for a wildcard subscription, is one of
+// the topics the subscription matches.
+type TopicReceiveHandlerFunc func(data []byte, dest string, topic string)
+
 // Transporter is an interface representing the ability to send and receive
 // data. It abstracts away the concrete implementation, leaving that up to the
 // implementing type.
@@ -11,3 +18,89 @@ type Transporter interface {
 	SendData(data []byte, dest string) error
 	ReceiveData(data []byte, dest string) error
 }
+
+// PublishOptions control whether sending data waits for the remote end to
+// acknowledge receipt of it.
+type PublishOptions struct {
+	// WaitForAck causes sending to block until the message is acknowledged,
+	// returning an error if it is not.
+	WaitForAck bool
+
+	// AckTimeout bounds the time spent waiting for an acknowledgement. A zero
+	// value waits indefinitely.
+	AckTimeout time.Duration
+
+	// Retain asks the remote end to retain the message, delivering it to
+	// future subscribers, where supported.
+	Retain bool
+
+	// QoS is the MQTT QoS level (0, 1 or 2) the message is published at,
+	// where supported. A message waiting for an acknowledgement is published
+	// at QoS 1 at least, since a QoS 0 message is never acknowledged.
+	QoS byte
+}
+
+// An AcknowledgingTransporter is a Transporter whose acknowledgement behavior
+// can be chosen for each message sent.
+type AcknowledgingTransporter interface {
+	Transporter
+	SendDataWithOptions(data []byte, dest string, opts PublishOptions) error
+}
+
+// A PrefixedTransporter is a Transporter whose topic prefix can be changed
+// while it is running.
+type PrefixedTransporter interface {
+	Transporter
+	SetTopicPrefix(prefix string) error
+}
+
+// BrokerStatus describes the connection to one of a transport's brokers.
+// Failures counts the connection attempts that failed since the broker was
+// last connected to, and LastError is the error of the most recent failed
+// attempt, made at LastErrorAt. FreshClientID is set to the client ID the
+// transport connects to the broker with in place of its own, if it fell back
+// to a fresh one. ReturnCode is the CONNACK return code with which the broker
+// refused the most recent failed attempt, if it refused it, and AuthFailed is
+// true if the code rejected the client's credentials.
+type BrokerStatus struct {
+	URL         string     `json:"url"`
+	Active      bool       `json:"active"`
+	Connected   bool       `json:"connected"`
+	Failures    int        `json:"failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+
+	FreshClientID string `json:"fresh_client_id,omitempty"`
+
+	ReturnCode int  `json:"connack_return_code,omitempty"`
+	AuthFailed bool `json:"auth_failed,omitempty"`
+}
+
+// Subscription describes one of the topics a transport subscribes to: Dest is
+// the destination of the messages received on it, and State is one of
+// "subscribed", "resumed" (held by a persistent session resumed on connecting,
+// with the QoS granted when it was made unknown), "refused", "pending" (not
+// yet subscribed to in the current session) or "unsubscribing" (removed while
+// disconnected but still held by the persistent session). QoS is the QoS the
+// broker granted, and Since the time the subscription was made or resumed.
+type Subscription struct {
+	Topic string     `json:"topic"`
+	Dest  string     `json:"dest"`
+	State string     `json:"state"`
+	QoS   *int       `json:"qos,omitempty"`
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// A SubscriptionReporter is a Transporter that reports the state of its
+// subscriptions.
+type SubscriptionReporter interface {
+	Transporter
+	Subscriptions() []Subscription
+}
+
+// A BrokerStatusReporter is a Transporter that reports the state of its
+// connections to brokers.
+type BrokerStatusReporter interface {
+	Transporter
+	BrokerStatus() []BrokerStatus
+}
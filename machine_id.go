@@ -0,0 +1,175 @@
+package yggdrasil
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"git.sr.ht/~spc/go-log"
+)
+
+// A MachineIDProvider returns the machine ID of the host, for example as
+// derived from a TPM or read from a cloud metadata service.
+type MachineIDProvider func() (string, error)
+
+// machineIDProviders holds the registered machine ID providers, by name.
+var machineIDProviders = struct {
+	sync.RWMutex
+	m map[string]MachineIDProvider
+}{m: map[string]MachineIDProvider{
+	"bios-uuid": func() (string, error) { return readFile(BIOSUUIDFile) },
+}}
+
+// RegisterMachineIDProvider registers p as the machine ID provider name, to
+// be selected with MachineIDProviderName.
+func RegisterMachineIDProvider(name string, p MachineIDProvider) {
+	machineIDProviders.Lock()
+	defer machineIDProviders.Unlock()
+	machineIDProviders.m[name] = p
+}
+
+// MachineIDProviders returns the names of the registered machine ID
+// providers, sorted.
+func MachineIDProviders() []string {
+	machineIDProviders.RLock()
+	defer machineIDProviders.RUnlock()
+
+	names := make([]string, 0, len(machineIDProviders.m))
+	for name := range machineIDProviders.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// machineIDFile is the file the machine ID is read from if no other source
+// yields one.
+var machineIDFile = "/etc/machine-id"
+
+// machineIDCache holds the machine ID once resolved, and whether it came from
+// a custom source rather than machineIDFile.
+var machineIDCache struct {
+	sync.Mutex
+	id     string
+	custom bool
+}
+
+// MachineID returns the machine ID of the host, from the first of these
+// sources that yields a valid ID: the provider named by MachineIDProviderName,
+// the output of MachineIDCommand, and the /etc/machine-id file. A source that
+// is not set is skipped, and one that fails is logged and skipped. The ID is
+// resolved once and cached.
+//
+// A valid ID that is a UUID is returned in its dashed form. Any other valid ID
+// is returned as is, and is valid unless it is empty, longer than 128
+// characters, or contains whitespace, control characters or the characters
+// "/", "+" or "#", which cannot appear in an MQTT topic level.
+func MachineID() (string, error) {
+	machineIDCache.Lock()
+	defer machineIDCache.Unlock()
+
+	if machineIDCache.id != "" {
+		return machineIDCache.id, nil
+	}
+
+	type source struct {
+		name    string
+		custom  bool
+		resolve func() (string, error)
+	}
+	var sources []source
+	if MachineIDProviderName != "" {
+		sources = append(sources, source{"provider " + MachineIDProviderName, true, func() (string, error) {
+			machineIDProviders.RLock()
+			p, ok := machineIDProviders.m[MachineIDProviderName]
+			machineIDProviders.RUnlock()
+			if !ok {
+				return "", fmt.Errorf("no such provider")
+			}
+			return p()
+		}})
+	}
+	if len(MachineIDCommand) > 0 {
+		sources = append(sources, source{"command " + MachineIDCommand[0], true, runMachineIDCommand})
+	}
+	sources = append(sources, source{machineIDFile, false, func() (string, error) {
+		id, err := readFile(machineIDFile)
+		if err != nil {
+			return "", err
+		}
+		return toUUIDv4(id)
+	}})
+
+	var errs []string
+	for _, s := range sources {
+		id, err := s.resolve()
+		if err == nil {
+			id, err = validMachineID(id)
+		}
+		if err != nil {
+			log.Warnf("cannot get machine ID from %v: %v", s.name, err)
+			errs = append(errs, s.name+": "+err.Error())
+			continue
+		}
+		log.Debugf("got machine ID from %v", s.name)
+		machineIDCache.id = id
+		machineIDCache.custom = s.custom
+		return id, nil
+	}
+	return "", fmt.Errorf("no source yielded a valid machine ID (%v)", strings.Join(errs, "; "))
+}
+
+// MachineIDFromCustomSource returns true if the machine ID resolved by
+// MachineID came from the provider named by MachineIDProviderName or the
+// output of MachineIDCommand, rather than from the /etc/machine-id file. It
+// returns false if no machine ID has been resolved.
+func MachineIDFromCustomSource() bool {
+	machineIDCache.Lock()
+	defer machineIDCache.Unlock()
+	return machineIDCache.id != "" && machineIDCache.custom
+}
+
+// runMachineIDCommand runs MachineIDCommand, abandoning it after
+// FactCollectorTimeout (if positive), and returns its output.
+func runMachineIDCommand() (string, error) {
+	ctx := context.Background()
+	if FactCollectorTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, FactCollectorTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, MachineIDCommand[0], MachineIDCommand[1:]...)
+	cmd.Env = commandEnv
+	output, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("timed out after %v", FactCollectorTimeout)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// validMachineID checks that id is a valid machine ID and returns it, in its
+// dashed form if it is a UUID.
+func validMachineID(id string) (string, error) {
+	if id == "" {
+		return "", fmt.Errorf("empty machine ID")
+	}
+	if UUID, err := toUUIDv4(id); err == nil {
+		return UUID, nil
+	}
+	if len(id) > 128 {
+		return "", fmt.Errorf("machine ID longer than 128 characters")
+	}
+	for _, r := range id {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune("/+#", r) {
+			return "", fmt.Errorf("invalid character in machine ID: %q", r)
+		}
+	}
+	return id, nil
+}
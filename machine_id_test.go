@@ -0,0 +1,78 @@
+package yggdrasil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMachineID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yggdrasil-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "machine-id")
+	if err := ioutil.WriteFile(file, []byte("acc046d00add4550ac7c5a833b1b6470\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterMachineIDProvider("test", func() (string, error) { return "tpm-0a1b2c", nil })
+	RegisterMachineIDProvider("test-invalid", func() (string, error) { return "a/b", nil })
+	RegisterMachineIDProvider("test-failing", func() (string, error) { return "", fmt.Errorf("no TPM") })
+
+	tests := []struct {
+		description string
+		provider    string
+		command     []string
+		file        string
+		want        string
+		wantCustom  bool
+		wantErr     bool
+	}{
+		{description: "file", file: file, want: "acc046d0-0add-4550-ac7c-5a833b1b6470"},
+		{description: "provider", provider: "test", file: file, want: "tpm-0a1b2c", wantCustom: true},
+		{description: "invalid provider falls back", provider: "test-invalid", file: file, want: "acc046d0-0add-4550-ac7c-5a833b1b6470"},
+		{description: "failing provider falls back to command", provider: "test-failing", command: []string{"echo", "cloud-i-1234"}, file: file, want: "cloud-i-1234", wantCustom: true},
+		{description: "command uuid", command: []string{"echo", "D8EC3CD5-A6BC-4742-BD2F-32940DA182B0"}, want: "d8ec3cd5-a6bc-4742-bd2f-32940da182b0", wantCustom: true},
+		{description: "failing command falls back", command: []string{"false"}, file: file, want: "acc046d0-0add-4550-ac7c-5a833b1b6470"},
+		{description: "no source", provider: "test-failing", command: []string{"echo"}, file: filepath.Join(dir, "missing"), wantErr: true},
+	}
+
+	defer func(provider string, command []string, file string) {
+		MachineIDProviderName, MachineIDCommand, machineIDFile = provider, command, file
+		machineIDCache.id = ""
+	}(MachineIDProviderName, MachineIDCommand, machineIDFile)
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			MachineIDProviderName, MachineIDCommand, machineIDFile = test.provider, test.command, test.file
+			machineIDCache.id = ""
+
+			got, err := MachineID()
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+			if got := MachineIDFromCustomSource(); got != test.wantCustom {
+				t.Errorf("from custom source: %v != %v", got, test.wantCustom)
+			}
+
+			// The resolved ID is cached.
+			MachineIDProviderName, MachineIDCommand, machineIDFile = "", nil, filepath.Join(dir, "missing")
+			if got, err := MachineID(); err != nil || got != test.want {
+				t.Errorf("ID not cached: %v, %v", got, err)
+			}
+		})
+	}
+}
@@ -14,6 +14,14 @@ const (
 	MessageTypeCommand          MessageType = "command"
 	MessageTypeEvent            MessageType = "event"
 	MessageTypeData             MessageType = "data"
+	MessageTypeReceipt          MessageType = "receipt"
+	MessageTypeCapabilities     MessageType = "capabilities"
+	MessageTypeParseError       MessageType = "parse-error"
+	MessageTypeDesiredState     MessageType = "desired-state"
+	MessageTypeCertExpiry       MessageType = "certificate-expiry"
+	MessageTypeStarted          MessageType = "started"
+	MessageTypeWorkerExit       MessageType = "worker-exit"
+	MessageTypeWorkerFailed     MessageType = "worker-failed"
 )
 
 // ConnectionState represents accepted values for the "state" field of
@@ -43,6 +51,10 @@ const (
 
 	// CommandNameDisconnect instructs a client to permanently disconnect.
 	CommandNameDisconnect CommandName = "disconnect"
+
+	// CommandNameCancel instructs a client to cancel the assignment of the
+	// data message identified by the "message_id" argument.
+	CommandNameCancel CommandName = "cancel"
 )
 
 // EventName represents accepted values for the "event" field of an Event
@@ -58,10 +70,53 @@ const (
 	EventNamePong EventName = "pong"
 )
 
+// ReceiptStatus represents accepted values for the "status" field of Receipt
+// messages.
+type ReceiptStatus string
+
+const (
+	// ReceiptStatusReceived indicates the client has received a data message.
+	ReceiptStatusReceived ReceiptStatus = "received"
+
+	// ReceiptStatusDispatched indicates the client has delivered a data
+	// message to a worker.
+	ReceiptStatusDispatched ReceiptStatus = "dispatched"
+
+	// ReceiptStatusRejected indicates the client did not accept a data
+	// message, for example because it is shutting down. The message was not
+	// delivered to a worker and may be sent again.
+	ReceiptStatusRejected ReceiptStatus = "rejected"
+)
+
+// SelfTestMetadataKey is the metadata key marking the synthetic data messages
+// the client sends to each worker at startup to check that it can process
+// work. Its value is SelfTestPing. A worker passes the self-test by sending a
+// data message in response, with ResponseTo set to the self-test message's ID;
+// the response is not published.
+const (
+	SelfTestMetadataKey = "self_test"
+	SelfTestPing        = "ping"
+)
+
+// SessionIDMetadataKey is the metadata key holding the session ID of the data
+// messages the client dispatches to workers. A new session ID is generated
+// each time the client connects, and is included in its connection-status
+// messages, so that all work done within one connection can be correlated.
+const SessionIDMetadataKey = "session_id"
+
+// DesiredStateVersionMetadataKey is the metadata key holding the state version
+// of the data messages the client sends to a worker to reconcile a
+// desired-state message. The worker's response to the data message marks that
+// version as applied.
+const DesiredStateVersionMetadataKey = "desired_state_version"
+
 // A ConnectionStatus message is published by the client when it connects to
 // the broker. The message is expected to be published as a retained message
 // and its presence is considered an acceptable way to decide whether a client
-// is active and functioning normally.
+// is active and functioning normally. It may also be re-published periodically
+// as a heartbeat, in which case Uptime holds the number of seconds the client
+// has been connected. Degraded lists the workers the client has given up
+// restarting, if any, which leave it unable to do the work of those workers.
 type ConnectionStatus struct {
 	Type       MessageType `json:"type"`
 	MessageID  string      `json:"message_id"`
@@ -73,6 +128,9 @@ type ConnectionStatus struct {
 		Dispatchers    map[string]map[string]string `json:"dispatchers"`
 		State          ConnectionState              `json:"state"`
 		Tags           map[string]string            `json:"tags,omitempty"`
+		Uptime         int64                        `json:"uptime,omitempty"`
+		SessionID      string                       `json:"session_id,omitempty"`
+		Degraded       []string                     `json:"degraded,omitempty"`
 	} `json:"content"`
 }
 
@@ -113,6 +171,13 @@ type Control struct {
 // Data messages are published by both client and server on their respective
 // "data" topic. The client consumes Data messages and routes them to an
 // appropriate worker based on the "Directive" field.
+//
+// Origin and Hops are set by the client on messages it publishes, and are used
+// to detect messages that loop back to the client that published them.
+//
+// Signature and KeyID are set by the client on the results it publishes if it
+// signs them, and by the server on the messages it sends if the client
+// verifies them; KeyID identifies the key the signature can be verified with.
 type Data struct {
 	Type       MessageType       `json:"type"`
 	MessageID  string            `json:"message_id"`
@@ -122,4 +187,160 @@ type Data struct {
 	Directive  string            `json:"directive"`
 	Metadata   map[string]string `json:"metadata"`
 	Content    json.RawMessage   `json:"content"`
+	Origin     string            `json:"origin,omitempty"`
+	Hops       int               `json:"hops,omitempty"`
+	Signature  string            `json:"signature,omitempty"`
+	KeyID      string            `json:"key_id,omitempty"`
+}
+
+// A Receipt message is published by the client to acknowledge the progress of
+// a data message, identified by ResponseTo, before the worker's result is
+// available. Receipts for a message are published in the order the statuses
+// occur.
+type Receipt struct {
+	Type       MessageType `json:"type"`
+	MessageID  string      `json:"message_id"`
+	ResponseTo string      `json:"response_to"`
+	Version    int         `json:"version"`
+	Sent       time.Time   `json:"sent"`
+	Content    struct {
+		Status    ReceiptStatus `json:"status"`
+		Directive string        `json:"directive"`
+	} `json:"content"`
+}
+
+// A Capabilities message is published by the client to announce what it can
+// do: the directives its registered workers handle and the commands it
+// accepts. It is re-published whenever the set of directives changes.
+type Capabilities struct {
+	Type       MessageType `json:"type"`
+	MessageID  string      `json:"message_id"`
+	ResponseTo string      `json:"response_to"`
+	Version    int         `json:"version"`
+	Sent       time.Time   `json:"sent"`
+	Content    struct {
+		Directives []string      `json:"directives"`
+		Commands   []CommandName `json:"commands"`
+	} `json:"content"`
+}
+
+// A ParseError message is published by the client when it receives a payload
+// it cannot decode. Content holds the destination and topic the payload was
+// received on, the decoding error, the payload's length and a hex dump of its
+// first bytes.
+type ParseError struct {
+	Type       MessageType `json:"type"`
+	MessageID  string      `json:"message_id"`
+	ResponseTo string      `json:"response_to"`
+	Version    int         `json:"version"`
+	Sent       time.Time   `json:"sent"`
+	Content    struct {
+		Destination string `json:"destination"`
+		Topic       string `json:"topic"`
+		Error       string `json:"error"`
+		Length      int    `json:"length"`
+		Head        string `json:"head"`
+	} `json:"content"`
+}
+
+// A DesiredState message is published by the server, usually as a retained
+// message, to describe the state a worker should bring the system to. Content
+// holds the directive of the worker, the version of the state and the state
+// itself, which is passed to the worker as the content of a data message. A
+// state whose version was already applied is not passed again; if
+// StateVersion is empty, the state is versioned by a digest of its contents.
+type DesiredState struct {
+	Type       MessageType `json:"type"`
+	MessageID  string      `json:"message_id"`
+	ResponseTo string      `json:"response_to"`
+	Version    int         `json:"version"`
+	Sent       time.Time   `json:"sent"`
+	Content    struct {
+		Directive    string          `json:"directive"`
+		StateVersion string          `json:"state_version"`
+		State        json.RawMessage `json:"state"`
+	} `json:"content"`
+}
+
+// A CertExpiry message is published by the client when a certificate it uses
+// expires within the configured warning threshold, or has expired. Content
+// holds the kind of certificate ("client" or "ca"), the file it was read from,
+// its expiry time and whether it has already expired.
+type CertExpiry struct {
+	Type       MessageType `json:"type"`
+	MessageID  string      `json:"message_id"`
+	ResponseTo string      `json:"response_to"`
+	Version    int         `json:"version"`
+	Sent       time.Time   `json:"sent"`
+	Content    struct {
+		Certificate string    `json:"certificate"`
+		File        string    `json:"file"`
+		NotAfter    time.Time `json:"not_after"`
+		Expired     bool      `json:"expired"`
+	} `json:"content"`
+}
+
+// A Started message is published by the client once after it starts, when it
+// is fully operational: connected and subscribed, with its workers started.
+// Content holds the version of the client, the workers it started, the
+// directives they registered, when the client started and how long, in
+// seconds, it took to become operational.
+type Started struct {
+	Type       MessageType `json:"type"`
+	MessageID  string      `json:"message_id"`
+	ResponseTo string      `json:"response_to"`
+	Version    int         `json:"version"`
+	Sent       time.Time   `json:"sent"`
+	Content    struct {
+		ClientVersion string    `json:"client_version"`
+		Workers       []string  `json:"workers"`
+		Directives    []string  `json:"directives"`
+		BootTime      time.Time `json:"boot_time"`
+		BootDuration  float64   `json:"boot_duration"`
+	} `json:"content"`
+}
+
+// A WorkerExit message is published by the client when a worker process
+// exits unexpectedly. Content holds the name of the worker executable, the PID
+// and exit reason of the process, whether the worker is restarted, the number
+// of times it has exited since the client started, and the IDs of the data
+// messages assigned to the process that it had not responded to. When a worker
+// exits repeatedly, its exits are coalesced: Exits is the number of exits the
+// message covers, PID and Reason are those of the last of them and
+// LostMessageIDs lists the messages lost by any of them.
+type WorkerExit struct {
+	Type       MessageType `json:"type"`
+	MessageID  string      `json:"message_id"`
+	ResponseTo string      `json:"response_to"`
+	Version    int         `json:"version"`
+	Sent       time.Time   `json:"sent"`
+	Content    struct {
+		Worker         string   `json:"worker"`
+		PID            int      `json:"pid"`
+		Reason         string   `json:"reason"`
+		Restarting     bool     `json:"restarting"`
+		Restarts       int      `json:"restarts"`
+		Exits          int      `json:"exits"`
+		LostMessageIDs []string `json:"lost_message_ids"`
+	} `json:"content"`
+}
+
+// A WorkerFailed message is published by the client when it gives up
+// restarting a worker that exited too many times. Content holds the name of
+// the worker executable, the number of times it exited within the window, in
+// seconds, that the limit applies to, the reason of its last exit and the
+// escalation actions the client takes.
+type WorkerFailed struct {
+	Type       MessageType `json:"type"`
+	MessageID  string      `json:"message_id"`
+	ResponseTo string      `json:"response_to"`
+	Version    int         `json:"version"`
+	Sent       time.Time   `json:"sent"`
+	Content    struct {
+		Worker  string   `json:"worker"`
+		Exits   int      `json:"exits"`
+		Window  float64  `json:"window"`
+		Reason  string   `json:"reason"`
+		Actions []string `json:"actions"`
+	} `json:"content"`
 }
@@ -23,6 +23,15 @@ type DispatcherClient interface {
 	Register(ctx context.Context, in *RegistrationRequest, opts ...grpc.CallOption) (*RegistrationResponse, error)
 	// Send is called by a worker to send data to the dispatcher.
 	Send(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Receipt, error)
+	// SetFacts is called by a worker to replace the facts it contributes to
+	// the client's canonical facts.
+	SetFacts(ctx context.Context, in *Facts, opts ...grpc.CallOption) (*Receipt, error)
+	// Heartbeat is called periodically by a worker to indicate it is still
+	// able to handle work.
+	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*Receipt, error)
+	// RefreshFacts is called by a worker to request that the client collect
+	// its canonical facts again and publish a connection-status message.
+	RefreshFacts(ctx context.Context, in *RefreshFactsRequest, opts ...grpc.CallOption) (*Receipt, error)
 }
 
 type dispatcherClient struct {
@@ -51,6 +60,33 @@ func (c *dispatcherClient) Send(ctx context.Context, in *Data, opts ...grpc.Call
 	return out, nil
 }
 
+func (c *dispatcherClient) SetFacts(ctx context.Context, in *Facts, opts ...grpc.CallOption) (*Receipt, error) {
+	out := new(Receipt)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/SetFacts", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dispatcherClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*Receipt, error) {
+	out := new(Receipt)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/Heartbeat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dispatcherClient) RefreshFacts(ctx context.Context, in *RefreshFactsRequest, opts ...grpc.CallOption) (*Receipt, error) {
+	out := new(Receipt)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Dispatcher/RefreshFacts", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DispatcherServer is the server API for Dispatcher service.
 // All implementations must embed UnimplementedDispatcherServer
 // for forward compatibility
@@ -60,6 +96,15 @@ type DispatcherServer interface {
 	Register(context.Context, *RegistrationRequest) (*RegistrationResponse, error)
 	// Send is called by a worker to send data to the dispatcher.
 	Send(context.Context, *Data) (*Receipt, error)
+	// SetFacts is called by a worker to replace the facts it contributes to
+	// the client's canonical facts.
+	SetFacts(context.Context, *Facts) (*Receipt, error)
+	// Heartbeat is called periodically by a worker to indicate it is still
+	// able to handle work.
+	Heartbeat(context.Context, *HeartbeatRequest) (*Receipt, error)
+	// RefreshFacts is called by a worker to request that the client collect
+	// its canonical facts again and publish a connection-status message.
+	RefreshFacts(context.Context, *RefreshFactsRequest) (*Receipt, error)
 	mustEmbedUnimplementedDispatcherServer()
 }
 
@@ -73,6 +118,15 @@ func (UnimplementedDispatcherServer) Register(context.Context, *RegistrationRequ
 func (UnimplementedDispatcherServer) Send(context.Context, *Data) (*Receipt, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
 }
+func (UnimplementedDispatcherServer) SetFacts(context.Context, *Facts) (*Receipt, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetFacts not implemented")
+}
+func (UnimplementedDispatcherServer) Heartbeat(context.Context, *HeartbeatRequest) (*Receipt, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
+func (UnimplementedDispatcherServer) RefreshFacts(context.Context, *RefreshFactsRequest) (*Receipt, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RefreshFacts not implemented")
+}
 func (UnimplementedDispatcherServer) mustEmbedUnimplementedDispatcherServer() {}
 
 // UnsafeDispatcherServer may be embedded to opt out of forward compatibility for this service.
@@ -122,6 +176,60 @@ func _Dispatcher_Send_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Dispatcher_SetFacts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Facts)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).SetFacts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/SetFacts",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).SetFacts(ctx, req.(*Facts))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dispatcher_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeartbeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/Heartbeat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).Heartbeat(ctx, req.(*HeartbeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Dispatcher_RefreshFacts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefreshFactsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DispatcherServer).RefreshFacts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Dispatcher/RefreshFacts",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DispatcherServer).RefreshFacts(ctx, req.(*RefreshFactsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Dispatcher_ServiceDesc is the grpc.ServiceDesc for Dispatcher service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -137,6 +245,18 @@ var Dispatcher_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Send",
 			Handler:    _Dispatcher_Send_Handler,
 		},
+		{
+			MethodName: "SetFacts",
+			Handler:    _Dispatcher_SetFacts_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _Dispatcher_Heartbeat_Handler,
+		},
+		{
+			MethodName: "RefreshFacts",
+			Handler:    _Dispatcher_RefreshFacts_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "protocol/yggdrasil.proto",
@@ -148,6 +268,9 @@ var Dispatcher_ServiceDesc = grpc.ServiceDesc{
 type WorkerClient interface {
 	// Send is called by the dispatcher to send data to a worker.
 	Send(ctx context.Context, in *Data, opts ...grpc.CallOption) (*Receipt, error)
+	// Cancel is called by the dispatcher to ask a worker to abort its work on
+	// a data message it has accepted.
+	Cancel(ctx context.Context, in *CancelRequest, opts ...grpc.CallOption) (*Receipt, error)
 }
 
 type workerClient struct {
@@ -167,12 +290,24 @@ func (c *workerClient) Send(ctx context.Context, in *Data, opts ...grpc.CallOpti
 	return out, nil
 }
 
+func (c *workerClient) Cancel(ctx context.Context, in *CancelRequest, opts ...grpc.CallOption) (*Receipt, error) {
+	out := new(Receipt)
+	err := c.cc.Invoke(ctx, "/yggdrasil.Worker/Cancel", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // WorkerServer is the server API for Worker service.
 // All implementations must embed UnimplementedWorkerServer
 // for forward compatibility
 type WorkerServer interface {
 	// Send is called by the dispatcher to send data to a worker.
 	Send(context.Context, *Data) (*Receipt, error)
+	// Cancel is called by the dispatcher to ask a worker to abort its work on
+	// a data message it has accepted.
+	Cancel(context.Context, *CancelRequest) (*Receipt, error)
 	mustEmbedUnimplementedWorkerServer()
 }
 
@@ -183,6 +318,9 @@ type UnimplementedWorkerServer struct {
 func (UnimplementedWorkerServer) Send(context.Context, *Data) (*Receipt, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
 }
+func (UnimplementedWorkerServer) Cancel(context.Context, *CancelRequest) (*Receipt, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Cancel not implemented")
+}
 func (UnimplementedWorkerServer) mustEmbedUnimplementedWorkerServer() {}
 
 // UnsafeWorkerServer may be embedded to opt out of forward compatibility for this service.
@@ -214,6 +352,24 @@ func _Worker_Send_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Worker_Cancel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkerServer).Cancel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/yggdrasil.Worker/Cancel",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkerServer).Cancel(ctx, req.(*CancelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Worker_ServiceDesc is the grpc.ServiceDesc for Worker service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -225,6 +381,10 @@ var Worker_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Send",
 			Handler:    _Worker_Send_Handler,
 		},
+		{
+			MethodName: "Cancel",
+			Handler:    _Worker_Cancel_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "protocol/yggdrasil.proto",
@@ -35,7 +35,11 @@ func main() {
 	defer cancel()
 
 	// Register as a handler of the "echo" type.
-	r, err := c.Register(ctx, &pb.RegistrationRequest{Handler: "echo", Pid: int64(os.Getpid())})
+	r, err := c.Register(ctx, &pb.RegistrationRequest{
+		Handler:  "echo",
+		Pid:      int64(os.Getpid()),
+		Metadata: map[string]string{"description": "Sends data messages back to their sender"},
+	})
 	if err != nil {
 		log.Fatal(err)
 	}